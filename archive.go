@@ -0,0 +1,170 @@
+package litestream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sqliteHeader is the magic string at the start of every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// WriteSnapshotArchive restores r to the position described by opt and writes
+// the resulting database to w as a gzip-compressed archive. The archive is a
+// standalone point-in-time backup which does not require the replica's
+// generation or WAL layout to restore. The output path of opt is ignored.
+func WriteSnapshotArchive(ctx context.Context, r Replica, opt RestoreOptions, w io.Writer) error {
+	if opt.DryRun {
+		return fmt.Errorf("cannot perform dry run when writing snapshot archive")
+	}
+
+	tmpdir, err := ioutil.TempDir("", "*-litestream-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	opt.OutputPath = filepath.Join(tmpdir, "db")
+	if err := RestoreReplica(ctx, r, opt); err != nil {
+		return err
+	}
+	return writeArchive(w, opt.OutputPath)
+}
+
+// writeArchive writes the database file at filename to w as a
+// gzip-compressed archive.
+func writeArchive(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, f); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ObjectWriter is implemented by replicas which can store standalone objects
+// outside of their generation & WAL layout.
+type ObjectWriter interface {
+	// Writes the contents of rd to key, relative to the replica root.
+	WriteObject(ctx context.Context, key string, rd io.Reader) error
+}
+
+// ValidateObjectKey returns an error if key is not a relative path inside the
+// replica root or if it would overlap with the replica's generations.
+func ValidateObjectKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("object key required")
+	} else if strings.HasPrefix(key, "/") || filepath.IsAbs(key) {
+		return fmt.Errorf("object key must be relative: %q", key)
+	}
+
+	key = path.Clean(filepath.ToSlash(key))
+	if key == "." || key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("object key must be inside replica: %q", key)
+	} else if key == "generations" || strings.HasPrefix(key, "generations/") {
+		return fmt.Errorf("object key must not be inside generations: %q", key)
+	}
+	return nil
+}
+
+// ArchiveTo takes a consistent online backup of the live database and writes
+// it to w under key as a standalone snapshot archive. Archives are written
+// outside the generation & WAL layout and can be restored with RestoreArchive.
+func (db *DB) ArchiveTo(ctx context.Context, w ObjectWriter, key string) error {
+	if err := ValidateObjectKey(key); err != nil {
+		return err
+	}
+
+	// Initialize database, if necessary. The lock is not held during the
+	// backup as it only requires a read transaction.
+	db.mu.Lock()
+	err := db.init()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	} else if db.db == nil {
+		return os.ErrNotExist
+	}
+
+	tmpdir, err := ioutil.TempDir("", "*-litestream-archive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// VACUUM INTO reads within a single transaction so the copy includes all
+	// committed data, including frames which have not been checkpointed.
+	tmpPath := filepath.Join(tmpdir, "db")
+	if _, err := db.db.ExecContext(ctx, `VACUUM INTO ?`, tmpPath); err != nil {
+		return fmt.Errorf("cannot backup database: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(writeArchive(pw, tmpPath)) }()
+	defer pr.Close()
+
+	if err := w.WriteObject(ctx, key, pr); err != nil {
+		return fmt.Errorf("cannot write archive: %w", err)
+	}
+	return nil
+}
+
+// RestoreArchive decompresses a snapshot archive from rd into outputPath.
+// Data is written to a temporary file and only moved into place once the
+// archive has been fully read & verified to contain a SQLite database.
+func RestoreArchive(rd io.Reader, outputPath string) (err error) {
+	if _, err := os.Stat(outputPath); err == nil {
+		return fmt.Errorf("cannot restore, output path already exists: %s", outputPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	zr, err := gzip.NewReader(rd)
+	if err != nil {
+		return fmt.Errorf("cannot read archive: %w", err)
+	}
+	defer zr.Close()
+
+	tmpPath := outputPath + ".tmp"
+	f, err := createFile(tmpPath, 0600, -1, -1)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := io.Copy(f, zr); err != nil {
+		return fmt.Errorf("cannot read archive: %w", err)
+	} else if err := zr.Close(); err != nil {
+		return fmt.Errorf("cannot read archive: %w", err)
+	}
+
+	// Verify the archive contained a database before moving it into place.
+	hdr := make([]byte, len(sqliteHeader))
+	if _, err := f.ReadAt(hdr, 0); err != nil || !bytes.Equal(hdr, []byte(sqliteHeader)) {
+		return fmt.Errorf("archive does not contain a sqlite database")
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, outputPath)
+}
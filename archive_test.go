@@ -0,0 +1,226 @@
+package litestream_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreArchive(t *testing.T) {
+	// Ensure a streamed snapshot archive can be restored without the replica.
+	t.Run("RoundTrip", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos.Generation
+		if err := litestream.WriteSnapshotArchive(context.Background(), r, opt, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreArchive(&buf, outputPath); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, outputPath, "foo"), 10; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Ensure an existing database is not overwritten.
+		if err := litestream.RestoreArchive(&buf, outputPath); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure an archive which does not contain a database is rejected.
+	t.Run("ErrInvalidDatabase", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte("not a database")); err != nil {
+			t.Fatal(err)
+		} else if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreArchive(&buf, outputPath); err == nil || err.Error() != `archive does not contain a sqlite database` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDB_ArchiveTo(t *testing.T) {
+	// Ensure the live database can be archived as a standalone object and
+	// restored without the replica's generations.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Archive without syncing so uncheckpointed WAL data must be included.
+		if err := db.ArchiveTo(context.Background(), r, "archives/daily.gz"); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filepath.Join(r.Path(), "archives", "daily.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreArchive(f, outputPath); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, outputPath, "foo"), 10; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Ensure the archive is not visible as part of a generation.
+		if generations, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(generations) != 0 {
+			t.Fatalf("unexpected generations: %v", generations)
+		}
+	})
+
+	// Ensure keys outside the replica or inside its generations are rejected.
+	t.Run("ErrInvalidKey", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		for _, key := range []string{"", "/tmp/db.gz", "../db.gz", "generations/db.gz"} {
+			if err := db.ArchiveTo(context.Background(), r, key); err == nil {
+				t.Fatalf("expected error for %q", key)
+			}
+		}
+	})
+}
+
+func TestFindDBs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.db", "a.db-wal", "a.db-shm", "a.db-journal", "notes.txt", "c.sqlite",
+		"sub/b.db", ".a.db-litestream/generations/x.db",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0777); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := litestream.FindDBs(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := paths, []string{filepath.Join(dir, "a.db"), filepath.Join(dir, "sub/b.db")}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths=%v, want %v", got, want)
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	// Ensure multiple live databases can be archived & extracted.
+	dir := t.TempDir()
+	for i, name := range []string{"a.db", "sub/b.db", "sub/deep/c.db"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		// Leave connections open so WAL & SHM files exist during the archive.
+		sqldb := MustOpenSQLDB(t, path)
+		defer MustCloseSQLDB(t, sqldb)
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= i; j++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Uninitialized databases are skipped.
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := litestream.ArchiveDir(context.Background(), dir, &buf); err != nil {
+		t.Fatal(err)
+	} else if got, want := n, 3; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	}
+
+	// Extract archive to a new directory.
+	outDir := t.TempDir()
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+
+		path := filepath.Join(outDir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := names, []string{"a.db", "sub/b.db", "sub/deep/c.db"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("names=%v, want %v", got, want)
+	}
+	for i, name := range names {
+		if got, want := MustCountRows(t, filepath.Join(outDir, name), "foo"), i+1; got != want {
+			t.Fatalf("%s: n=%d, want %d", name, got, want)
+		}
+	}
+}
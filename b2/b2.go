@@ -0,0 +1,327 @@
+package b2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	blazer "github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/base"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// B2 replica default settings.
+const (
+	DefaultSyncInterval = 10 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+
+	DefaultCompressionWorkers = 1
+
+	DefaultDeleteConcurrency = 4
+
+	DefaultDeleteBatchSize = 100
+
+	DefaultUserAgent = "litestream"
+)
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.ObjectWriter = (*Replica)(nil)
+var _ litestream.CommitTimeReader = (*Replica)(nil)
+var _ litestream.ReplicaWriter = (*Replica)(nil)
+var _ litestream.ObjectClient = (*Replica)(nil)
+var _ litestream.ObjectVersionLister = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to a Backblaze B2 bucket using
+// the B2 native API. Objects are named with the same layout as S3 replicas.
+//
+// B2 has no batch delete call so files are deleted one at a time. Files are
+// split into batches of DeleteBatchSize & at most DeleteConcurrency batches
+// are deleted concurrently to stay within B2's rate limits.
+type Replica struct {
+	*litestream.ObjectReplica
+
+	mu     sync.Mutex
+	client *blazer.Client // b2 client
+	bkt    *blazer.Bucket // handle to Bucket
+
+	// B2 application key credentials.
+	KeyID          string
+	ApplicationKey string
+
+	// B2 bucket name.
+	Bucket string
+
+	// URL root of B2 API requests. Uses the Backblaze API if blank.
+	APIBase string
+
+	// User-Agent header sent with every request so storage providers can
+	// attribute traffic.
+	UserAgent string
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		UserAgent: DefaultUserAgent,
+	}
+
+	r.ObjectReplica = litestream.NewObjectReplica(db, name, r, operationTotalCounterVec, operationBytesCounterVec)
+	r.SyncInterval = DefaultSyncInterval
+	r.Retention = DefaultRetention
+	r.RetentionCheckInterval = DefaultRetentionCheckInterval
+	r.CompressionWorkers = DefaultCompressionWorkers
+	r.DeleteConcurrency = DefaultDeleteConcurrency
+	r.DeleteBatchSize = DefaultDeleteBatchSize
+
+	return r
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "b2"
+}
+
+// URL returns the location of the replica as a "b2" URL.
+func (r *Replica) URL() string {
+	return (&url.URL{Scheme: "b2", Host: r.Bucket, Path: path.Join("/", r.Path)}).String()
+}
+
+// Init authorizes the account & looks up the bucket. No-op if already
+// initialized. The client re-authorizes the account when its token expires
+// & retries requests which fail with transient errors.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil {
+		return nil
+	}
+
+	if r.Bucket == "" {
+		return fmt.Errorf("b2 bucket required")
+	} else if r.KeyID == "" || r.ApplicationKey == "" {
+		return fmt.Errorf("b2 key id & application key required")
+	}
+
+	opts := []blazer.ClientOption{blazer.UserAgent(r.UserAgent)}
+	if r.APIBase != "" {
+		opts = append(opts, blazer.APIBase(r.APIBase))
+	}
+
+	client, err := blazer.NewClient(ctx, r.KeyID, r.ApplicationKey, opts...)
+	if err != nil {
+		return fmt.Errorf("cannot authorize b2 account: %w", wrapError(err))
+	}
+	bkt, err := client.Bucket(ctx, r.Bucket)
+	if err != nil {
+		return fmt.Errorf("cannot find b2 bucket: %w", wrapError(err))
+	}
+	r.client, r.bkt = client, bkt
+	return nil
+}
+
+// ListObjects calls fn for the latest version of each file whose name begins
+// with prefix. Folders below the prefix are passed as directories.
+func (r *Replica) ListObjects(ctx context.Context, prefix string, fn func(litestream.ObjectInfo) error) error {
+	it := r.bkt.List(ctx, blazer.ListPrefix(prefix), blazer.ListDelimiter("/"))
+	for it.Next() {
+		// Listings include the attributes of each file so no request is made.
+		attrs, err := it.Object().Attrs(ctx)
+		if err != nil {
+			return wrapError(err)
+		}
+
+		obj := fileInfo(attrs)
+		if attrs.Status == blazer.Folder {
+			obj = litestream.ObjectInfo{Key: strings.TrimSuffix(attrs.Name, "/"), IsDir: true}
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return wrapError(it.Err())
+}
+
+// ListObjectVersions calls fn for every version of each file whose name
+// begins with prefix, including hidden file markers.
+func (r *Replica) ListObjectVersions(ctx context.Context, prefix string, fn func(litestream.ObjectInfo) error) error {
+	it := r.bkt.List(ctx, blazer.ListPrefix(prefix), blazer.ListHidden())
+	for it.Next() {
+		attrs, err := it.Object().Attrs(ctx)
+		if err != nil {
+			return wrapError(err)
+		} else if err := fn(fileInfo(attrs)); err != nil {
+			return err
+		}
+	}
+	return wrapError(it.Err())
+}
+
+// fileInfo returns the object info for the attributes of a file version. The
+// modification time is the time set on upload, if any.
+func fileInfo(attrs *blazer.Attrs) litestream.ObjectInfo {
+	modTime := attrs.LastModified
+	if modTime.IsZero() {
+		modTime = attrs.UploadTimestamp
+	}
+
+	return litestream.ObjectInfo{
+		Key:      attrs.Name,
+		Size:     attrs.Size,
+		ModTime:  modTime.UTC(),
+		Metadata: lowerKeys(attrs.Info),
+		Version:  fileVersion(attrs),
+	}
+}
+
+// fileVersion returns a token which identifies a single version of a file.
+// The SDK does not expose file IDs so versions are identified by their upload
+// time & checksum.
+func fileVersion(attrs *blazer.Attrs) string {
+	return fmt.Sprintf("%d-%s", attrs.UploadTimestamp.UnixNano()/int64(time.Millisecond), attrs.SHA1)
+}
+
+// PutObject uploads the contents of rd to a new version of the file at key.
+// B2 requires the size & checksum of a file before it is uploaded so uploads
+// are buffered; snapshots are buffered in temporary files instead of memory.
+// The upload is aborted if rd returns an error. opts.ModTime is stored as the
+// file's last modified time.
+func (r *Replica) PutObject(ctx context.Context, key string, rd io.Reader, opts litestream.PutOptions) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := r.bkt.Object(key).NewWriter(ctx, blazer.WithAttrsOption(&blazer.Attrs{
+		Info:         opts.Metadata,
+		LastModified: opts.ModTime,
+	}))
+	w.UseFileBuffer = opts.Type == litestream.ObjectTypeSnapshot
+
+	n, err := io.Copy(w, litestream.NewThrottledReader(ctx, rd, opts.Limiter))
+	if err != nil {
+		cancel() // canceling the context before closing aborts the upload
+		_ = w.Close()
+		return n, wrapError(err)
+	} else if err := w.Close(); err != nil {
+		return n, wrapError(err)
+	}
+	return n, nil
+}
+
+// GetObject returns a reader for the latest version of the file at key.
+func (r *Replica) GetObject(ctx context.Context, key string) (io.ReadCloser, litestream.ObjectInfo, error) {
+	o := r.bkt.Object(key)
+	attrs, err := o.Attrs(ctx)
+	if blazer.IsNotExist(err) {
+		return nil, litestream.ObjectInfo{}, os.ErrNotExist
+	} else if err != nil {
+		return nil, litestream.ObjectInfo{}, wrapError(err)
+	}
+
+	return o.NewRangeReader(ctx, 0, attrs.Size), fileInfo(attrs), nil
+}
+
+// DeleteObjects deletes the given version of each file. Every version of a
+// file is deleted if no version is given. Versions are found by listing the
+// directory of each file.
+func (r *Replica) DeleteObjects(ctx context.Context, objs []litestream.ObjectInfo) error {
+	// Group the versions to delete by file name.
+	versions := make(map[string]map[string]bool)
+	dirs := make(map[string]struct{})
+	for _, obj := range objs {
+		if versions[obj.Key] == nil {
+			versions[obj.Key] = make(map[string]bool)
+		}
+		versions[obj.Key][obj.Version] = true
+		dirs[path.Dir(obj.Key)+"/"] = struct{}{}
+	}
+
+	for dir := range dirs {
+		var matches []*blazer.Object
+		it := r.bkt.List(ctx, blazer.ListPrefix(dir), blazer.ListHidden())
+		for it.Next() {
+			o := it.Object()
+			m := versions[o.Name()]
+			if m == nil {
+				continue
+			}
+
+			attrs, err := o.Attrs(ctx)
+			if err != nil {
+				return wrapError(err)
+			} else if m[""] || m[fileVersion(attrs)] {
+				matches = append(matches, o)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return wrapError(err)
+		}
+
+		for _, o := range matches {
+			if err := o.Delete(ctx); err != nil && !blazer.IsNotExist(err) {
+				return wrapError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// lowerKeys returns a copy of m with lowercase keys. B2 file info names are
+// case-insensitive & downloads return them in canonical header case.
+func lowerKeys(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	other := make(map[string]string, len(m))
+	for k, v := range m {
+		other[strings.ToLower(k)] = v
+	}
+	return other
+}
+
+// statusError wraps an error returned by the B2 API with its HTTP status
+// code so only server errors & rate limiting are retried.
+type statusError struct {
+	err  error
+	code int
+}
+
+func (e *statusError) Error() string   { return e.err.Error() }
+func (e *statusError) Unwrap() error   { return e.err }
+func (e *statusError) StatusCode() int { return e.code }
+
+// wrapError returns err with the status code of the B2 API error, if any.
+// See litestream.IsRetryableError.
+func wrapError(err error) error {
+	if code, _ := base.Code(err); code != 0 {
+		return &statusError{err: err, code: code}
+	}
+	return err
+}
+
+// B2 metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "b2",
+		Name:      "operation_total",
+		Help:      "The number of B2 operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "b2",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by B2 operations",
+	}, []string{"db", "name", "type"})
+)
@@ -0,0 +1,446 @@
+package b2_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/b2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if generations, err := r.Generations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(generations) != 1 || generations[0] != pos.Generation {
+		t.Fatalf("Generations()=%v, want [%s]", generations, pos.Generation)
+	}
+
+	// Ensure the database is restored from the stored files.
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(t.TempDir(), "db")
+	opt.Generation = pos.Generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var n int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatalf("n=%d, want 5", n)
+	}
+}
+
+func TestReplica_RunRetention(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload two versions of each file of an expired generation.
+	const generation = "0000000000000001"
+	createdAt := time.Now().Add(-2 * r.Retention)
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data"), createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if result, err := r.RunRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(result.Generations) != 1 || result.Generations[0] != generation {
+		t.Fatalf("Generations=%v, want [%s]", result.Generations, generation)
+	}
+
+	// Ensure every version is deleted, not just the latest.
+	if names := s.Versions(r.GenerationDir(generation) + "/"); len(names) != 0 {
+		t.Fatalf("unexpected versions: %v", names)
+	} else if names := s.Versions(r.GenerationDir(r.LastPos().Generation) + "/"); len(names) == 0 {
+		t.Fatal("expected versions in replicating generation")
+	}
+}
+
+func TestReplica_Init(t *testing.T) {
+	// Ensure an unauthorized key is reported when connecting.
+	t.Run("ErrUnauthorized", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.ApplicationKey = "bad"
+
+		if err := r.Init(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot authorize b2 account") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a bucket is required.
+	t.Run("ErrBucketRequired", func(t *testing.T) {
+		r := b2.NewReplica(nil, "")
+		if err := r.Init(context.Background()); err == nil || err.Error() != `b2 bucket required` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// NewTestReplica returns a replica for db which stores files on s.
+func NewTestReplica(tb testing.TB, db *litestream.DB, s *Server) *b2.Replica {
+	tb.Helper()
+
+	r := b2.NewReplica(db, "")
+	r.KeyID, r.ApplicationKey = "KEYID", "KEY"
+	r.Bucket = "bkt"
+	r.Path = "backups"
+	r.APIBase = s.URL
+	r.MonitorEnabled = false
+	return r
+}
+
+// MustOpenDBs returns a new instance of a DB & associated SQL DB. Both are
+// closed when the test ends.
+func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return db, sqldb
+}
+
+// Server is a fake B2 server which implements the native API calls used by
+// the replica & stores files in memory.
+type Server struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	files []*serverFile // all versions, in upload order
+	seq   int
+}
+
+type serverFile struct {
+	ID        string
+	Name      string
+	Data      []byte
+	Info      map[string]string
+	Timestamp int64
+}
+
+func (f *serverFile) json() map[string]interface{} {
+	return map[string]interface{}{
+		"fileId":          f.ID,
+		"fileName":        f.Name,
+		"action":          "upload",
+		"contentLength":   len(f.Data),
+		"contentSha1":     fmt.Sprintf("%x", sha1.Sum(f.Data)),
+		"contentType":     "application/octet-stream",
+		"uploadTimestamp": f.Timestamp,
+		"fileInfo":        f.Info,
+	}
+}
+
+// NewServer returns a running fake B2 server which is closed when the test ends.
+func NewServer(tb testing.TB) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Versions returns the names of all file versions beginning with prefix.
+func (s *Server) Versions(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for _, f := range s.files {
+		if strings.HasPrefix(f.Name, prefix) {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/b2api/v1/b2_authorize_account" {
+		if keyID, key, _ := r.BasicAuth(); keyID != "KEYID" || key != "KEY" {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"accountId":               "ACCOUNT",
+			"authorizationToken":      "TOKEN",
+			"apiUrl":                  s.URL,
+			"downloadUrl":             s.URL,
+			"recommendedPartSize":     100000000,
+			"absoluteMinimumPartSize": 5000000,
+		})
+		return
+	} else if r.Header.Get("Authorization") != "TOKEN" {
+		writeError(w, http.StatusUnauthorized, "bad_auth_token")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/b2api/v1/b2_list_buckets":
+		writeJSON(w, map[string]interface{}{
+			"buckets": []interface{}{map[string]interface{}{"bucketId": "BUCKET", "bucketName": "bkt", "bucketType": "allPrivate"}},
+		})
+	case r.URL.Path == "/b2api/v1/b2_get_upload_url":
+		writeJSON(w, map[string]interface{}{"bucketId": "BUCKET", "uploadUrl": s.URL + "/upload", "authorizationToken": "TOKEN"})
+	case r.URL.Path == "/upload":
+		s.upload(w, r)
+	case r.URL.Path == "/b2api/v1/b2_list_file_names":
+		s.listFileNames(w, r)
+	case r.URL.Path == "/b2api/v1/b2_list_file_versions":
+		s.listFileVersions(w, r)
+	case r.URL.Path == "/b2api/v1/b2_get_file_info":
+		s.getFileInfo(w, r)
+	case r.URL.Path == "/b2api/v1/b2_delete_file_version":
+		s.deleteFileVersion(w, r)
+	case strings.HasPrefix(r.URL.Path, "/file/bkt/"):
+		s.download(w, r)
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request")
+	}
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	} else if fmt.Sprintf("%x", sha1.Sum(data)) != r.Header.Get("X-Bz-Content-Sha1") {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	name, _ := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+
+	info := make(map[string]string)
+	for k := range r.Header {
+		if strings.HasPrefix(k, "X-Bz-Info-") {
+			v, _ := url.QueryUnescape(r.Header.Get(k))
+			info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = v
+		}
+	}
+
+	s.seq++
+	f := &serverFile{ID: strconv.Itoa(s.seq), Name: name, Data: data, Info: info, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+	s.files = append(s.files, f)
+	writeJSON(w, f.json())
+}
+
+// latest returns the latest version of each file, sorted by name.
+func (s *Server) latest() []*serverFile {
+	m := make(map[string]*serverFile)
+	for _, f := range s.files {
+		m[f.Name] = f
+	}
+
+	a := make([]*serverFile, 0, len(m))
+	for _, f := range m {
+		a = append(a, f)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+func (s *Server) listFileNames(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Prefix    string `json:"prefix"`
+		Delimiter string `json:"delimiter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	files := make([]interface{}, 0)
+	folders := make(map[string]bool)
+	for _, f := range s.latest() {
+		if !strings.HasPrefix(f.Name, in.Prefix) {
+			continue
+		}
+
+		if in.Delimiter != "" {
+			if i := strings.Index(f.Name[len(in.Prefix):], in.Delimiter); i >= 0 {
+				name := f.Name[:len(in.Prefix)+i+1]
+				if !folders[name] {
+					folders[name] = true
+					files = append(files, map[string]interface{}{"fileName": name, "action": "folder"})
+				}
+				continue
+			}
+		}
+		files = append(files, f.json())
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "nextFileName": nil})
+}
+
+func (s *Server) listFileVersions(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	files := make([]interface{}, 0)
+	for _, f := range s.files {
+		if strings.HasPrefix(f.Name, in.Prefix) {
+			files = append(files, f.json())
+		}
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "nextFileName": nil, "nextFileId": nil})
+}
+
+func (s *Server) getFileInfo(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		FileID string `json:"fileId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	for _, f := range s.files {
+		if f.ID == in.FileID {
+			writeJSON(w, f.json())
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+func (s *Server) deleteFileVersion(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		FileName string `json:"fileName"`
+		FileID   string `json:"fileId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	for i, f := range s.files {
+		if f.Name == in.FileName && f.ID == in.FileID {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			writeJSON(w, map[string]interface{}{"fileId": f.ID, "fileName": f.Name})
+			return
+		}
+	}
+	writeError(w, http.StatusBadRequest, "file_not_present")
+}
+
+// download writes the latest version of a file. Supports single byte ranges
+// as the client downloads files in chunks.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/file/bkt/")
+	for _, f := range s.latest() {
+		if f.Name != name {
+			continue
+		}
+
+		data, status := f.Data, http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request")
+				return
+			} else if start >= len(data) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable")
+				return
+			} else if end >= len(data) {
+				end = len(data) - 1
+			}
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+
+		for k, v := range f.Info {
+			w.Header().Set("X-Bz-Info-"+k, url.QueryEscape(v))
+		}
+		w.Header().Set("X-Bz-File-Id", f.ID)
+		w.Header().Set("X-Bz-Content-Sha1", fmt.Sprintf("%x", sha1.Sum(f.Data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		_, _ = w.Write(data)
+		return
+	}
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+}
@@ -0,0 +1,187 @@
+package litestream
+
+import (
+	"fmt"
+	"hash/crc64"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SnapshotChecksumExt is the extension of the file stored next to a snapshot
+// with the checksum of its uncompressed contents.
+const SnapshotChecksumExt = ".crc64"
+
+// FormatSnapshotChecksumPath formats the checksum filename of a snapshot.
+func FormatSnapshotChecksumPath(index int) string {
+	assert(index >= 0, "snapshot index must be non-negative")
+	return fmt.Sprintf("%08x%s", index, SnapshotChecksumExt)
+}
+
+// ParseSnapshotChecksumPath returns the index for a snapshot checksum filename.
+func ParseSnapshotChecksumPath(s string) (index int, err error) {
+	a := snapshotChecksumPathRegex.FindStringSubmatch(s)
+	if a == nil {
+		return 0, fmt.Errorf("invalid snapshot checksum path: %s", s)
+	}
+
+	i64, _ := strconv.ParseUint(a[1], 16, 64)
+	return int(i64), nil
+}
+
+var snapshotChecksumPathRegex = regexp.MustCompile(`^([0-9a-f]{8})\.crc64$`)
+
+// WALChecksumExt is the extension of the file stored next to a WAL file in a
+// file replica with the checksum & size of its uncompressed contents.
+const WALChecksumExt = WALExt + SnapshotChecksumExt
+
+// FormatWALChecksumPath formats the checksum filename of a WAL file.
+func FormatWALChecksumPath(index int) string {
+	assert(index >= 0, "wal index must be non-negative")
+	return fmt.Sprintf("%08x%s", index, WALChecksumExt)
+}
+
+// ParseWALChecksumPath returns the index for a WAL checksum filename.
+func ParseWALChecksumPath(s string) (index int, err error) {
+	a := walChecksumPathRegex.FindStringSubmatch(s)
+	if a == nil {
+		return 0, fmt.Errorf("invalid wal checksum path: %s", s)
+	}
+
+	i64, _ := strconv.ParseUint(a[1], 16, 64)
+	return int(i64), nil
+}
+
+var walChecksumPathRegex = regexp.MustCompile(`^([0-9a-f]{8})\.wal\.crc64$`)
+
+// EncodeWALChecksum returns the contents of a WAL checksum file for the
+// checksum of the first size bytes of a WAL file.
+func EncodeWALChecksum(checksum string, size int64) []byte {
+	return []byte(fmt.Sprintf("%s %d\n", checksum, size))
+}
+
+// DecodeWALChecksum returns the checksum & size stored in a WAL checksum file.
+func DecodeWALChecksum(b []byte) (checksum string, size int64, err error) {
+	a := strings.Fields(string(b))
+	if len(a) != 2 {
+		return "", 0, fmt.Errorf("invalid wal checksum: %q", b)
+	} else if size, err = strconv.ParseInt(a[1], 10, 64); err != nil || size < 0 {
+		return "", 0, fmt.Errorf("invalid wal checksum size: %q", a[1])
+	}
+	return a[0], size, nil
+}
+
+var crc64Table = crc64.MakeTable(crc64.ISO)
+
+// ChecksumWriter computes the checksum of the bytes written to it in the
+// same format as ChecksumWALChunk.
+type ChecksumWriter struct {
+	crc uint64
+}
+
+// NewChecksumWriter returns a new instance of ChecksumWriter.
+func NewChecksumWriter() *ChecksumWriter {
+	return &ChecksumWriter{}
+}
+
+// resumeChecksumWriter returns a ChecksumWriter which continues from the
+// checksum of previously written bytes.
+func resumeChecksumWriter(checksum string) (*ChecksumWriter, error) {
+	crc, err := strconv.ParseUint(checksum, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %q", checksum)
+	}
+	return &ChecksumWriter{crc: crc}, nil
+}
+
+// Write adds p to the checksum. Never returns an error.
+func (w *ChecksumWriter) Write(p []byte) (int, error) {
+	w.crc = crc64.Update(w.crc, crc64Table, p)
+	return len(p), nil
+}
+
+// Checksum returns the hex-encoded checksum of the bytes written so far.
+func (w *ChecksumWriter) Checksum() string {
+	return strconv.FormatUint(w.crc, 16)
+}
+
+// checksumReader verifies the checksum of the bytes read once rd is read
+// to the end.
+type checksumReader struct {
+	rd       io.Reader
+	w        *ChecksumWriter
+	checksum string
+	name     string
+}
+
+// NewChecksumReader returns a reader which reads from rd & returns an error
+// wrapping ErrChecksumMismatch, instead of io.EOF, if the bytes read do not
+// match checksum. Name is included in the error. Stored checksums may have
+// surrounding whitespace, which is ignored.
+func NewChecksumReader(rd io.Reader, checksum, name string) io.Reader {
+	return &checksumReader{
+		rd:       rd,
+		w:        NewChecksumWriter(),
+		checksum: strings.TrimSpace(checksum),
+		name:     name,
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	_, _ = r.w.Write(p[:n])
+	if err == io.EOF {
+		if other := r.w.Checksum(); other != r.checksum {
+			return n, fmt.Errorf("%s: checksum %s, expected %s: %w", r.name, other, r.checksum, ErrChecksumMismatch)
+		}
+	}
+	return n, err
+}
+
+// walChecksumReader verifies the checksum of the first size bytes read once
+// rd is read to the end.
+type walChecksumReader struct {
+	rd       io.Reader
+	w        *ChecksumWriter
+	n        int64 // bytes read
+	checksum string
+	size     int64
+	name     string
+}
+
+// NewWALChecksumReader returns a reader which reads from rd & returns an
+// error wrapping ErrChecksumMismatch, instead of io.EOF, if fewer than size
+// bytes are read or the first size bytes do not match checksum. Bytes after
+// size, such as frames written after the checksum was last updated, are not
+// verified. Name is included in the error.
+func NewWALChecksumReader(rd io.Reader, checksum string, size int64, name string) io.Reader {
+	return &walChecksumReader{
+		rd:       rd,
+		w:        NewChecksumWriter(),
+		checksum: checksum,
+		size:     size,
+		name:     name,
+	}
+}
+
+func (r *walChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if remaining := r.size - r.n; remaining > 0 {
+		m := int64(n)
+		if m > remaining {
+			m = remaining
+		}
+		_, _ = r.w.Write(p[:m])
+	}
+	r.n += int64(n)
+
+	if err == io.EOF {
+		if r.n < r.size {
+			return n, fmt.Errorf("%s: size %d, expected %d: %w", r.name, r.n, r.size, ErrChecksumMismatch)
+		} else if other := r.w.Checksum(); other != r.checksum {
+			return n, fmt.Errorf("%s: checksum %s, expected %s: %w", r.name, other, r.checksum, ErrChecksumMismatch)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,197 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+)
+
+// DefaultWALChunkRetryN is the default number of times a failed WAL chunk
+// upload is retried before the sync fails.
+const DefaultWALChunkRetryN = 3
+
+// DefaultSyncConcurrency is the default number of WAL segments a replica
+// uploads at once.
+const DefaultSyncConcurrency = 1
+
+// WALChunk is a frame-aligned portion of a WAL segment which can be uploaded
+// independently of the rest of the segment.
+type WALChunk struct {
+	Index  int    // index of the WAL file
+	Offset int64  // offset within the WAL file
+	Data   []byte // raw WAL bytes
+}
+
+// End returns the offset within the WAL file after the chunk.
+func (c WALChunk) End() int64 {
+	return c.Offset + int64(len(c.Data))
+}
+
+// Checksum returns the hex-encoded CRC64 checksum of the chunk data.
+func (c WALChunk) Checksum() string {
+	return ChecksumWALChunk(c.Data)
+}
+
+// ChecksumWALChunk returns the hex-encoded CRC64 checksum of b.
+func ChecksumWALChunk(b []byte) string {
+	return strconv.FormatUint(crc64.Checksum(b, crc64Table), 16)
+}
+
+// SplitWALChunks splits WAL data which starts at offset into chunks of at
+// most chunkSize bytes. Chunks are split on frame boundaries & always contain
+// at least one frame. The WAL header is kept with the first frame. Returns a
+// single chunk if chunkSize is zero or negative.
+func SplitWALChunks(b []byte, offset int64, pageSize, chunkSize int) []WALChunk {
+	frameSize := WALFrameHeaderSize + pageSize
+
+	var chunks []WALChunk
+	for len(b) > 0 {
+		n := len(b)
+		if chunkSize > 0 && n > chunkSize {
+			var hdr int
+			if offset == 0 {
+				hdr = WALHeaderSize
+			}
+
+			frameN := (chunkSize - hdr) / frameSize
+			if frameN < 1 {
+				frameN = 1
+			}
+			if sz := hdr + frameN*frameSize; sz < n {
+				n = sz
+			}
+		}
+
+		chunks = append(chunks, WALChunk{Offset: offset, Data: b[:n]})
+		b, offset = b[n:], offset+int64(n)
+	}
+	return chunks
+}
+
+// PendingWALChunks reads the shadow WAL from pos through the end of up to
+// fileN shadow WAL files & splits the data of each file into chunks of at
+// most chunkSize bytes. Returns io.EOF if there is no data after pos.
+func (db *DB) PendingWALChunks(pos Pos, fileN, chunkSize int) ([]WALChunk, error) {
+	var chunks []WALChunk
+	for i := 0; i < fileN || i == 0; i++ {
+		rd, err := db.ShadowWALReader(pos)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		start := rd.Pos()
+		b, err := ioutil.ReadAll(rd)
+		if e := rd.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chunk := range SplitWALChunks(b, start.Offset, db.PageSize(), chunkSize) {
+			chunk.Index = start.Index
+			chunks = append(chunks, chunk)
+		}
+		pos = rd.Pos()
+	}
+
+	if len(chunks) == 0 {
+		return nil, io.EOF
+	}
+	return chunks, nil
+}
+
+// UploadWALChunks uploads chunks using fn with up to concurrency uploads in
+// flight. A failed chunk is retried according to policy before an error is
+// returned; chunks which were already uploaded are not re-sent & no more
+// chunks are started once one fails.
+//
+// Returns the number of chunks uploaded before the first failed chunk. Later
+// chunks may also have been uploaded but callers must only advance their
+// position through this contiguous prefix so a failed chunk is never skipped.
+func UploadWALChunks(ctx context.Context, chunks []WALChunk, policy RetryPolicy, concurrency int, fn func(ctx context.Context, chunk WALChunk) error) (n int, err error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, concurrency)
+
+	started := 0
+	for ; started < len(chunks); started++ {
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := uploadWALChunk(ctx, chunks[i], policy, fn); err != nil {
+				mu.Lock()
+				errs[i], failed = err, true
+				mu.Unlock()
+			}
+		}(started)
+	}
+	wg.Wait()
+
+	for n = 0; n < started; n++ {
+		if errs[n] != nil {
+			return n, errs[n]
+		}
+	}
+	return n, nil
+}
+
+// uploadWALChunk uploads a single chunk with fn, retrying according to policy.
+func uploadWALChunk(ctx context.Context, chunk WALChunk, policy RetryPolicy, fn func(ctx context.Context, chunk WALChunk) error) error {
+	if err := policy.Do(ctx, func(ctx context.Context) error { return fn(ctx, chunk) }); err != nil {
+		return fmt.Errorf("cannot upload wal chunk at offset %d: %w", chunk.Offset, err)
+	}
+	return nil
+}
+
+// WALChunkEnds returns the position after the last chunk of each WAL file
+// in chunks, in order. Chunks must be ordered by index & offset.
+func WALChunkEnds(generation string, chunks []WALChunk) []Pos {
+	var a []Pos
+	for i, chunk := range chunks {
+		if i+1 < len(chunks) && chunks[i+1].Index == chunk.Index {
+			continue
+		}
+		a = append(a, Pos{Generation: generation, Index: chunk.Index, Offset: chunk.End()})
+	}
+	return a
+}
+
+// WALUploadError is returned by a replica sync when WAL segments fail to
+// upload. The replica position has been advanced through the segments which
+// were uploaded before the failure so the replica keeps it, rather than
+// recalculating its position from the segments on the replica which may
+// include later segments uploaded out of order.
+type WALUploadError struct {
+	Err error
+}
+
+// Error returns the underlying error message.
+func (e *WALUploadError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *WALUploadError) Unwrap() error { return e.Err }
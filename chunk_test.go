@@ -0,0 +1,304 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestSplitWALChunks(t *testing.T) {
+	const pageSize = 4096
+	const frameSize = litestream.WALFrameHeaderSize + pageSize
+
+	// Ensure chunks are split on frame boundaries & keep the header with the
+	// first frame.
+	t.Run("Header", func(t *testing.T) {
+		b := make([]byte, litestream.WALHeaderSize+5*frameSize)
+		chunks := litestream.SplitWALChunks(b, 0, pageSize, 2*frameSize+litestream.WALHeaderSize)
+		if got, want := len(chunks), 3; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+
+		offsets := []int64{0, litestream.WALHeaderSize + 2*frameSize, litestream.WALHeaderSize + 4*frameSize}
+		sizes := []int{litestream.WALHeaderSize + 2*frameSize, 2 * frameSize, frameSize}
+		for i, chunk := range chunks {
+			if chunk.Offset != offsets[i] {
+				t.Fatalf("chunks[%d].Offset=%d, want %d", i, chunk.Offset, offsets[i])
+			} else if len(chunk.Data) != sizes[i] {
+				t.Fatalf("chunks[%d].Data=%d bytes, want %d", i, len(chunk.Data), sizes[i])
+			}
+		}
+	})
+
+	// Ensure chunks from within the WAL start at the given offset.
+	t.Run("Offset", func(t *testing.T) {
+		b := make([]byte, 3*frameSize)
+		offset := int64(litestream.WALHeaderSize + 10*frameSize)
+		chunks := litestream.SplitWALChunks(b, offset, pageSize, frameSize)
+		if got, want := len(chunks), 3; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		} else if got, want := chunks[2].Offset, offset+2*frameSize; got != want {
+			t.Fatalf("offset=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a chunk size smaller than a frame still includes a whole frame.
+	t.Run("MinFrame", func(t *testing.T) {
+		chunks := litestream.SplitWALChunks(make([]byte, 2*frameSize), litestream.WALHeaderSize, pageSize, 100)
+		if got, want := len(chunks), 2; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure chunking is disabled if the chunk size is not set.
+	t.Run("Disabled", func(t *testing.T) {
+		chunks := litestream.SplitWALChunks(make([]byte, 10*frameSize), litestream.WALHeaderSize, pageSize, 0)
+		if got, want := len(chunks), 1; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestUploadWALChunks(t *testing.T) {
+	const pageSize = 4096
+	const frameSize = litestream.WALFrameHeaderSize + pageSize
+
+	b := make([]byte, litestream.WALHeaderSize+4*frameSize)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	chunks := litestream.SplitWALChunks(b, 0, pageSize, frameSize)
+
+	// Ensure only the failed chunk is re-sent and the uploaded chunks
+	// reassemble into the original WAL with valid checksums.
+	t.Run("RetryFailedChunk", func(t *testing.T) {
+		store := newMockChunkStore()
+		store.failures[chunks[2].Offset] = 1
+
+		n, err := litestream.UploadWALChunks(context.Background(), chunks, litestream.RetryPolicy{MaxRetries: 3}, 1, store.Upload)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := n, len(chunks); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		for i, chunk := range chunks {
+			want := 1
+			if i == 2 {
+				want = 2
+			}
+			if got := store.sends[chunk.Offset]; got != want {
+				t.Fatalf("chunks[%d] sent %d times, want %d", i, got, want)
+			}
+		}
+
+		if other, err := store.Reassemble(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(other, b) {
+			t.Fatal("reassembled wal mismatch")
+		}
+	})
+
+	// Ensure upload stops at a chunk which continues to fail.
+	t.Run("ErrRetryExceeded", func(t *testing.T) {
+		store := newMockChunkStore()
+		store.failures[chunks[1].Offset] = 10
+
+		n, err := litestream.UploadWALChunks(context.Background(), chunks, litestream.RetryPolicy{MaxRetries: 2}, 1, store.Upload)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if got, want := store.sends[chunks[1].Offset], 3; got != want {
+			t.Fatalf("sent %d times, want %d", got, want)
+		} else if _, ok := store.sends[chunks[2].Offset]; ok {
+			t.Fatal("expected later chunks to not be sent")
+		}
+	})
+
+	// Ensure concurrent uploads reassemble into the original WAL.
+	t.Run("Concurrent", func(t *testing.T) {
+		store := newMockChunkStore()
+		store.failures[chunks[1].Offset] = 1
+
+		n, err := litestream.UploadWALChunks(context.Background(), chunks, litestream.RetryPolicy{MaxRetries: 3}, 3, store.Upload)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := n, len(chunks); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		if other, err := store.Reassemble(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(other, b) {
+			t.Fatal("reassembled wal mismatch")
+		}
+	})
+
+	// Ensure the position does not skip a chunk which fails after later
+	// chunks were uploaded out of order.
+	t.Run("ErrOutOfOrder", func(t *testing.T) {
+		store := newMockChunkStore()
+		store.failures[chunks[1].Offset] = 1
+
+		// Hold the upload of the failing chunk until later chunks finish.
+		var wg sync.WaitGroup
+		wg.Add(len(chunks) - 2)
+		store.before = func(chunk litestream.WALChunk) {
+			if chunk.Offset == chunks[1].Offset {
+				wg.Wait()
+			}
+		}
+		store.after = func(chunk litestream.WALChunk) {
+			if chunk.Offset > chunks[1].Offset {
+				wg.Done()
+			}
+		}
+
+		n, err := litestream.UploadWALChunks(context.Background(), chunks, litestream.RetryPolicy{MaxRetries: 0}, len(chunks), store.Upload)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Later chunks were uploaded but the position stops at the failed chunk.
+		for _, chunk := range chunks[2:] {
+			if _, ok := store.chunks[chunk.Offset]; !ok {
+				t.Fatalf("expected chunk at offset %d to be uploaded", chunk.Offset)
+			}
+		}
+		if a := litestream.WALChunkEnds("0000000000000000", chunks[:n]); len(a) != 1 {
+			t.Fatalf("len=%d, want 1", len(a))
+		} else if got, want := a[0].Offset, chunks[1].Offset; got != want {
+			t.Fatalf("offset=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestWALChunkEnds(t *testing.T) {
+	chunks := []litestream.WALChunk{
+		{Index: 0, Offset: 0, Data: make([]byte, 10)},
+		{Index: 0, Offset: 10, Data: make([]byte, 20)},
+		{Index: 1, Offset: 0, Data: make([]byte, 5)},
+	}
+	a := litestream.WALChunkEnds("0000000000000000", chunks)
+	if got, want := a, []litestream.Pos{
+		{Generation: "0000000000000000", Index: 0, Offset: 30},
+		{Generation: "0000000000000000", Index: 1, Offset: 5},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ends=%v, want %v", got, want)
+	}
+}
+
+func TestDB_PendingWALChunks(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	// Write to the first WAL file, restart the WAL & write to the second.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Checkpoint(context.Background(), litestream.CheckpointModeRestart); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := litestream.Pos{Generation: pos.Generation}
+
+	// Ensure only the requested number of files are read.
+	if chunks, err := db.PendingWALChunks(start, 1, 0); err != nil {
+		t.Fatal(err)
+	} else if got, want := litestream.WALChunkEnds(pos.Generation, chunks), 1; len(got) != want {
+		t.Fatalf("files=%d, want %d", len(got), want)
+	}
+
+	// Ensure reading all files ends at the current position.
+	chunks, err := db.PendingWALChunks(start, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ends := litestream.WALChunkEnds(pos.Generation, chunks); len(ends) != 2 {
+		t.Fatalf("files=%d, want 2", len(ends))
+	} else if got, want := ends[1], pos; got != want {
+		t.Fatalf("pos=%v, want %v", got, want)
+	}
+
+	// Ensure EOF is returned once there is no pending data.
+	if _, err := db.PendingWALChunks(pos, 2, 0); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// mockChunkStore records uploaded chunks and fails uploads at configured offsets.
+type mockChunkStore struct {
+	failures  map[int64]int // remaining failures by offset
+	sends     map[int64]int // upload attempts by offset
+	chunks    map[int64][]byte
+	checksums map[int64]string
+
+	mu     sync.Mutex
+	before func(chunk litestream.WALChunk) // called before each upload
+	after  func(chunk litestream.WALChunk) // called after each successful upload
+}
+
+func newMockChunkStore() *mockChunkStore {
+	return &mockChunkStore{
+		failures:  make(map[int64]int),
+		sends:     make(map[int64]int),
+		chunks:    make(map[int64][]byte),
+		checksums: make(map[int64]string),
+	}
+}
+
+func (s *mockChunkStore) Upload(ctx context.Context, chunk litestream.WALChunk) error {
+	if s.before != nil {
+		s.before(chunk)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sends[chunk.Offset]++
+	if s.failures[chunk.Offset] > 0 {
+		s.failures[chunk.Offset]--
+		return errors.New("upload failed")
+	}
+	s.chunks[chunk.Offset] = append([]byte(nil), chunk.Data...)
+	s.checksums[chunk.Offset] = chunk.Checksum()
+
+	if s.after != nil {
+		s.after(chunk)
+	}
+	return nil
+}
+
+// Reassemble concatenates chunks in offset order & validates each checksum.
+func (s *mockChunkStore) Reassemble() ([]byte, error) {
+	var buf bytes.Buffer
+	for len(s.chunks) > 0 {
+		data, ok := s.chunks[int64(buf.Len())]
+		if !ok {
+			return nil, errors.New("missing chunk")
+		} else if litestream.ChecksumWALChunk(data) != s.checksums[int64(buf.Len())] {
+			return nil, litestream.ErrChecksumMismatch
+		}
+		delete(s.chunks, int64(buf.Len()))
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// ArchiveDirCommand represents a command to archive all databases in a directory.
+type ArchiveDirCommand struct{}
+
+// Run executes the command.
+func (c *ArchiveDirCommand) Run(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("litestream-archive-dir", flag.ContinueOnError)
+	outputPath := fs.String("o", "", "output path")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("directory path required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if *outputPath == "" {
+		return fmt.Errorf("output path required")
+	}
+
+	dir, err := expand(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Write to STDOUT if the output path is "-".
+	var w io.Writer = os.Stdout
+	if *outputPath != "-" {
+		if *outputPath, err = expand(*outputPath); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(*outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := litestream.ArchiveDir(ctx, dir, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "archived %d databases\n", n)
+
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *ArchiveDirCommand) Usage() {
+	fmt.Printf(`
+The archive-dir command writes a snapshot of every ".db" database found in a
+directory, including subdirectories, to a single gzip-compressed tar archive.
+Each database is copied with VACUUM INTO while it remains online. Databases
+are copied one at a time so the archive is not a single point-in-time across
+databases. This is intended for periodic full backups & complements
+continuous replication.
+
+Usage:
+
+	litestream archive-dir [arguments] DIR
+
+Arguments:
+
+	-o PATH
+	    Output path of the archive. Use "-" to write to STDOUT.
+	    Required.
+
+Examples:
+
+	# Archive all databases in /data.
+	$ litestream archive-dir -o backup.tar.gz /data
+
+	# Extract the archive to a new location.
+	$ tar -xzf backup.tar.gz -C /path/to/dir
+
+`[1:])
+}
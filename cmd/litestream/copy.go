@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// CopyCommand represents a command to copy the generations of one replica
+// to another.
+type CopyCommand struct{}
+
+// Run executes the command.
+func (c *CopyCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	fs := flag.NewFlagSet("litestream-copy", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath)
+	from := fs.String("from", "", "source replica")
+	to := fs.String("to", "", "destination replica")
+	generation := fs.String("generation", "", "generation name")
+	verbose := fs.Bool("v", false, "verbose output")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *from == "" || *to == "" {
+		return fmt.Errorf("-from & -to replicas required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	// Replicas specified by name are looked up in the database's config.
+	var db *litestream.DB
+	if !isURL(*from) || !isURL(*to) {
+		if fs.NArg() == 0 || fs.Arg(0) == "" {
+			return fmt.Errorf("database path required for replica names")
+		}
+
+		config, err := ReadConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+
+		if path, err := expand(fs.Arg(0)); err != nil {
+			return err
+		} else if dbc := config.DBConfig(path); dbc == nil {
+			return fmt.Errorf("database not found in config: %s", path)
+		} else if db, err = newDBFromConfig(&config, dbc); err != nil {
+			return err
+		}
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("database path not allowed with replica URLs")
+	}
+
+	src, err := c.loadReplica(db, *from)
+	if err != nil {
+		return err
+	}
+	dst, err := c.loadReplica(db, *to)
+	if err != nil {
+		return err
+	}
+
+	opt := litestream.CopyOptions{Generation: *generation}
+	if *verbose {
+		opt.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	result, err := litestream.CopyReplica(ctx, src, dst, opt)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d generations, %d snapshots & %d wal files (%d bytes), skipped %d files\n",
+		len(result.Generations),
+		result.SnapshotN,
+		result.WALN,
+		result.Size,
+		result.SkippedN,
+	)
+	return nil
+}
+
+// loadReplica returns the replica at the URL s or the replica of db named s.
+func (c *CopyCommand) loadReplica(db *litestream.DB, s string) (litestream.Replica, error) {
+	if isURL(s) {
+		return NewReplicaFromURL(s)
+	}
+
+	r := db.Replica(s)
+	if r == nil {
+		return nil, fmt.Errorf("replica %q not found for database %q", s, db.Path())
+	}
+	return r, nil
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *CopyCommand) Usage() {
+	fmt.Printf(`
+The copy command copies the generations, snapshots & WAL files of one replica
+to another with the same indexes so the destination can be restored from
+identically. Files already in the destination are skipped so an interrupted
+copy can be resumed. Each copied file is read back from the destination and
+verified against the source.
+
+Object storage replicas set the time of copied files to the time they are
+copied. Restores by timestamp remain identical where each WAL file has a
+commit time index, which is copied with the WAL file.
+
+Replicas may be specified by URL or by name from the database's config. The
+destination should not be replicated to while copying.
+
+Usage:
+
+	litestream copy [arguments] -from REPLICA_URL -to REPLICA_URL
+
+	litestream copy [arguments] -from NAME -to NAME DB_PATH
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-from REPLICA
+	    Specifies the replica to copy from. Required.
+
+	-to REPLICA
+	    Specifies the replica to copy to. Required.
+
+	-generation NAME
+	    Copies only the named generation.
+	    Defaults to all generations.
+
+	-v
+	    Verbose output.
+
+Examples:
+
+	# Copy all generations from S3 to GCS.
+	$ litestream copy -from s3://mybkt/db -to gcs://mybkt/db
+
+	# Copy between replicas in the config of a database.
+	$ litestream copy -from s3 -to gcs /path/to/db
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
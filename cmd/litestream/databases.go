@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 	"text/tabwriter"
+	"time"
+
+	"github.com/benbjohnson/litestream"
 )
 
 // DatabasesCommand is a command for listing managed databases.
@@ -18,6 +24,9 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
 	fs := flag.NewFlagSet("litestream-databases", flag.ContinueOnError)
 	registerConfigFlag(fs, &configPath)
+	jsonOutput := fs.Bool("json", false, "json output")
+	status := fs.Bool("status", false, "report replication health")
+	maxLag := fs.Duration("max-lag", time.Minute, "lag before a database is unhealthy")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -34,6 +43,12 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 		return err
 	}
 
+	if *status {
+		return c.writeStatus(ctx, &config, *maxLag, *jsonOutput)
+	} else if *jsonOutput {
+		return c.writeJSON(&config)
+	}
+
 	// List all databases.
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
 	defer w.Flush()
@@ -46,7 +61,7 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 
 		var replicaNames []string
-		for _, r := range db.Replicas {
+		for _, r := range db.ReplicaList() {
 			replicaNames = append(replicaNames, r.Name())
 		}
 
@@ -59,6 +74,228 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 	return nil
 }
 
+// writeJSON writes the databases & their lifetime compression totals to
+// STDOUT as a JSON array.
+func (c *DatabasesCommand) writeJSON(config *Config) error {
+	type compressionJSON struct {
+		RawBytes        int64 `json:"raw_bytes"`
+		CompressedBytes int64 `json:"compressed_bytes"`
+		SavedBytes      int64 `json:"saved_bytes"`
+	}
+	type databaseJSON struct {
+		Path        string          `json:"path"`
+		Replicas    []string        `json:"replicas"`
+		Compression compressionJSON `json:"compression"`
+	}
+
+	a := make([]databaseJSON, 0, len(config.DBs))
+	for _, dbConfig := range config.DBs {
+		db, err := newDBFromConfig(config, dbConfig)
+		if err != nil {
+			return err
+		}
+
+		totals, err := litestream.ReadCompressionTotals(db.CompressionTotalsPath())
+		if err != nil {
+			return fmt.Errorf("%s: %w", db.Path(), err)
+		}
+
+		item := databaseJSON{
+			Path:     db.Path(),
+			Replicas: []string{},
+			Compression: compressionJSON{
+				RawBytes:        totals.RawBytes,
+				CompressedBytes: totals.CompressedBytes,
+				SavedBytes:      totals.SavedBytes(),
+			},
+		}
+		for _, r := range db.ReplicaList() {
+			item.Replicas = append(item.Replicas, r.Name())
+		}
+		a = append(a, item)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(a)
+}
+
+// writeStatus writes the health of each database to STDOUT. Statuses are read
+// from the status endpoint of a running "replicate" command, if one is
+// serving on the configured address, and are otherwise computed from local
+// metadata. Returns an error if any database is unhealthy.
+func (c *DatabasesCommand) writeStatus(ctx context.Context, config *Config, maxLag time.Duration, jsonOutput bool) error {
+	statuses, err := c.fetchStatus(ctx, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status endpoint unavailable, using local metadata: %s\n", err)
+		if statuses, err = c.localStatus(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	var unhealthyN int
+	for i := range statuses {
+		if statuses[i].Health(maxLag) != "ok" {
+			unhealthyN++
+		}
+	}
+
+	if jsonOutput {
+		type statusJSON struct {
+			litestream.DBStatus
+			Health string `json:"health"`
+		}
+		a := make([]statusJSON, len(statuses))
+		for i := range statuses {
+			a[i] = statusJSON{DBStatus: statuses[i], Health: statuses[i].Health(maxLag)}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(a); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "path\thealth\ttracked\tgeneration\tlag\terror")
+		for i := range statuses {
+			s := &statuses[i]
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\n",
+				s.Path,
+				s.Health(maxLag),
+				s.Generation != "",
+				s.Generation,
+				s.MaxLag().Round(time.Millisecond),
+				s.LastError(),
+			)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if unhealthyN > 0 {
+		return fmt.Errorf("%d of %d databases unhealthy", unhealthyN, len(statuses))
+	}
+	return nil
+}
+
+// fetchStatus returns the status of each configured database from the status
+// endpoint served on the configured address. Databases not managed by the
+// running instance are reported with an error.
+func (c *DatabasesCommand) fetchStatus(ctx context.Context, config *Config) ([]litestream.DBStatus, error) {
+	if config.Addr == "" {
+		return nil, errors.New("no addr configured")
+	}
+	host, port, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, err
+	} else if host == "" {
+		host = "localhost"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+net.JoinHostPort(host, port)+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		DBs []litestream.DBStatus `json:"dbs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cannot decode status: %w", err)
+	}
+
+	m := make(map[string]litestream.DBStatus, len(body.DBs))
+	for _, s := range body.DBs {
+		m[s.Path] = s
+	}
+
+	statuses := make([]litestream.DBStatus, 0, len(config.DBs))
+	for _, dbConfig := range config.DBs {
+		path, err := expand(dbConfig.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := m[path]
+		if !ok {
+			s = litestream.DBStatus{Path: path, Error: "not managed by the running instance"}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// localStatus returns a best-effort status of each configured database from
+// its local metadata. The lag of a replica is the time between the last
+// change to the WAL file & the creation of the latest WAL segment uploaded to
+// the replica for the current generation.
+func (c *DatabasesCommand) localStatus(ctx context.Context, config *Config) ([]litestream.DBStatus, error) {
+	statuses := make([]litestream.DBStatus, 0, len(config.DBs))
+	for _, dbConfig := range config.DBs {
+		db, err := newDBFromConfig(config, dbConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		s := litestream.DBStatus{Path: db.Path(), Replicas: []litestream.ReplicaStatus{}}
+		if pos, err := db.Pos(); err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Generation, s.Index = pos.Generation, pos.Index
+		}
+
+		var walModTime time.Time
+		if fi, err := os.Stat(db.WALPath()); err == nil {
+			walModTime = fi.ModTime()
+		}
+
+		for _, r := range db.ReplicaList() {
+			rs := litestream.ReplicaStatus{Name: r.Name(), Type: r.Type()}
+			if s.Generation != "" {
+				if uploadedAt, err := c.lastUploadedAt(ctx, r, s.Generation); err != nil {
+					rs.LastSyncError = err.Error()
+				} else if walModTime.After(uploadedAt) {
+					rs.LagSeconds = walModTime.Sub(uploadedAt).Seconds()
+				}
+			}
+			s.Replicas = append(s.Replicas, rs)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// lastUploadedAt returns the creation time of the latest WAL segment of
+// generation on r. Returns the zero time if there are none.
+func (c *DatabasesCommand) lastUploadedAt(ctx context.Context, r litestream.Replica, generation string) (time.Time, error) {
+	infos, err := r.WALs(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var t time.Time
+	for _, info := range infos {
+		if info.Generation == generation && info.CreatedAt.After(t) {
+			t = info.CreatedAt
+		}
+	}
+	return t, nil
+}
+
 // Usage prints the help screen to STDOUT.
 func (c *DatabasesCommand) Usage() {
 	fmt.Printf(`
@@ -74,6 +311,22 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-json
+	    Output databases & lifetime compression totals as JSON.
+
+	-status
+	    Report the health of each database: whether its WAL is tracked,
+	    its generation, the highest replication lag of its replicas & the
+	    last error. Statuses are read from the /status endpoint if
+	    "replicate" is serving on the configured "addr", otherwise they
+	    are computed from local metadata & the replicas. Exits with a
+	    non-zero status if any database is unhealthy.
+
+	-max-lag DURATION
+	    Replication lag after which a database is reported as lagging
+	    with -status. Set to zero to ignore lag.
+	    Defaults to 1m.
+
 `[1:],
 		DefaultConfigPath(),
 	)
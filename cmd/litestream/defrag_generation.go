@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// DefragGenerationCommand represents a command to renumber a generation's
+// snapshot & WAL files into a contiguous index sequence.
+type DefragGenerationCommand struct{}
+
+// Run executes the command.
+func (c *DefragGenerationCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	fs := flag.NewFlagSet("litestream-defrag-generation", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath)
+	replicaName := fs.String("replica", "", "replica name")
+	generation := fs.String("generation", "", "generation name")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("database path or replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if *generation == "" {
+		return fmt.Errorf("generation required")
+	}
+
+	var r litestream.Replica
+	if isURL(fs.Arg(0)) {
+		if r, err = NewReplicaFromURL(fs.Arg(0)); err != nil {
+			return err
+		}
+	} else if configPath != "" {
+		// Load configuration.
+		config, err := ReadConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+
+		// Lookup database from configuration file by path.
+		var db *litestream.DB
+		if path, err := expand(fs.Arg(0)); err != nil {
+			return err
+		} else if dbc := config.DBConfig(path); dbc == nil {
+			return fmt.Errorf("database not found in config: %s", path)
+		} else if db, err = newDBFromConfig(&config, dbc); err != nil {
+			return err
+		}
+
+		// Require a replica name if there are multiple replicas.
+		if *replicaName != "" {
+			if r = db.Replica(*replicaName); r == nil {
+				return fmt.Errorf("replica %q not found for database %q", *replicaName, db.Path())
+			}
+		} else if len(db.Replicas) == 1 {
+			r = db.Replicas[0]
+		} else {
+			return fmt.Errorf("replica name required for database with multiple replicas")
+		}
+	} else {
+		return errors.New("config path or replica URL required")
+	}
+
+	fr, ok := r.(*litestream.FileReplica)
+	if !ok {
+		return fmt.Errorf("defrag is only supported for file replicas")
+	}
+
+	n, err := fr.DefragGeneration(ctx, *generation)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("renumbered %d indices in generation %s\n", n, *generation)
+	return nil
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *DefragGenerationCommand) Usage() {
+	fmt.Printf(`
+The defrag-generation command renumbers the snapshot & WAL files of a
+generation so its indices are contiguous. Gaps can only be removed when the
+index after the gap has a snapshot. The renumbered generation is built
+separately and swapped into place so the generation remains restorable.
+
+This command should not be run while the generation is being replicated.
+Only file replicas are supported.
+
+Usage:
+
+	litestream defrag-generation [arguments] DB_PATH
+
+	litestream defrag-generation [arguments] REPLICA_URL
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-replica NAME
+	    Specifies the replica to defragment.
+	    Required if the database has multiple replicas.
+
+	-generation NAME
+	    Specifies the generation to defragment. Required.
+
+Examples:
+
+	# Defragment a generation in a file replica.
+	$ litestream defrag-generation -generation xxxxxxxx file:///backups/db
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// DownloadCommand represents a command to download a backup bundle from a replica.
+type DownloadCommand struct{}
+
+// Run executes the command.
+func (c *DownloadCommand) Run(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("litestream-download", flag.ContinueOnError)
+	outputDir := fs.String("o", "", "output directory")
+	integrityHash := fs.String("integrity-hash", litestream.DefaultIntegrityHash, "integrity hash algorithm")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if *outputDir == "" {
+		return fmt.Errorf("output directory required")
+	} else if !isURL(fs.Arg(0)) {
+		return fmt.Errorf("invalid replica URL: %s", fs.Arg(0))
+	}
+
+	r, err := NewReplicaFromURL(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *outputDir, err = expand(*outputDir); err != nil {
+		return err
+	}
+
+	// Ensure an existing bundle is not overwritten.
+	if _, err := os.Stat(*outputDir); err == nil {
+		return fmt.Errorf("output directory already exists: %s", *outputDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	m, err := litestream.Download(ctx, r, *outputDir, *integrityHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("downloaded generation %s, index %08x-%08x to %s\n", m.Generation, m.SnapshotIndex, m.MaxWALIndex, *outputDir)
+	return nil
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *DownloadCommand) Usage() {
+	fmt.Println(`
+The download command copies the latest snapshot and all subsequent WAL files
+from a replica into a local directory along with a manifest. The directory can
+be moved to another machine and restored offline with "restore -from-dir".
+
+Usage:
+
+	litestream download [arguments] REPLICA_URL
+
+Arguments:
+
+	-o PATH
+	    Output directory of the backup bundle. Must not exist.
+	    Required.
+
+	-integrity-hash NAME
+	    Hash algorithm used for the checksums stored in the manifest.
+	    Must be "crc64" or "sha256". Defaults to "crc64".
+
+Examples:
+
+	# Download the latest backup from S3 into a local directory.
+	$ litestream download -o /mnt/usb/db s3://mybkt/db
+
+	# Restore the database from the bundle on an air-gapped host.
+	$ litestream restore -from-dir /mnt/usb/db -o /path/to/db
+
+`[1:])
+}
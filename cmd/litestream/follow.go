@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// FollowCommand represents a command to continuously restore a database from a replica.
+type FollowCommand struct{}
+
+// Run executes the command.
+func (c *FollowCommand) Run(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("litestream-follow", flag.ContinueOnError)
+	outputPath := fs.String("o", "", "output path")
+	interval := fs.Duration("interval", litestream.DefaultFollowInterval, "poll interval")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if *outputPath == "" {
+		return fmt.Errorf("output path required")
+	} else if !isURL(fs.Arg(0)) {
+		return fmt.Errorf("invalid replica URL: %s", fs.Arg(0))
+	}
+
+	r, err := NewReplicaFromURL(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *outputPath, err = expand(*outputPath); err != nil {
+		return err
+	}
+
+	// Setup signal handler.
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() { <-ch; cancel() }()
+
+	f := litestream.NewFollower(r, *outputPath)
+	f.Interval = *interval
+	return f.Run(ctx)
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *FollowCommand) Usage() {
+	fmt.Println(`
+The follow command restores a database from a replica and then continuously
+applies new WAL files from the replica to keep the database nearly current.
+If the replica starts a new generation then the database is fully restored
+from the new generation. The command runs until it receives a signal.
+
+The restored database should only be opened in read-only mode while the
+follow command is running.
+
+Usage:
+
+	litestream follow [arguments] REPLICA_URL
+
+Arguments:
+
+	-o PATH
+	    Output path of the restored database. Required.
+
+	-interval DURATION
+	    Time between polls of the replica for new WAL files.
+	    Defaults to 1s.
+
+Examples:
+
+	# Continuously restore from S3 into a local file.
+	$ litestream follow -o /tmp/db s3://mybkt/db
+
+`[1:])
+}
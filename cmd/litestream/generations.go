@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -22,6 +23,7 @@ func (c *GenerationsCommand) Run(ctx context.Context, args []string) (err error)
 	fs := flag.NewFlagSet("litestream-generations", flag.ContinueOnError)
 	registerConfigFlag(fs, &configPath)
 	replicaName := fs.String("replica", "", "replica name")
+	jsonOutput := fs.Bool("json", false, "json output")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -73,7 +75,11 @@ func (c *GenerationsCommand) Run(ctx context.Context, args []string) (err error)
 	if r != nil {
 		replicas = []litestream.Replica{r}
 	} else {
-		replicas = db.Replicas
+		replicas = db.ReplicaList()
+	}
+
+	if *jsonOutput {
+		return c.writeJSON(ctx, replicas, updatedAt)
 	}
 
 	// List each generation.
@@ -109,6 +115,51 @@ func (c *GenerationsCommand) Run(ctx context.Context, args []string) (err error)
 	return nil
 }
 
+// writeJSON writes the generations of each replica to STDOUT as a JSON array.
+// Lag is measured from updatedAt, the last time the database was updated.
+func (c *GenerationsCommand) writeJSON(ctx context.Context, replicas []litestream.Replica, updatedAt time.Time) error {
+	type generationJSON struct {
+		Replica    string  `json:"replica"`
+		Generation string  `json:"generation"`
+		SnapshotN  int     `json:"snapshot_count"`
+		WALN       int     `json:"wal_count"`
+		Lag        float64 `json:"lag_seconds"`
+		CreatedAt  string  `json:"created_at"`
+		UpdatedAt  string  `json:"updated_at"`
+	}
+
+	a := make([]generationJSON, 0)
+	for _, r := range replicas {
+		generations, err := r.Generations(ctx)
+		if err != nil {
+			log.Printf("%s: cannot list generations: %s", r.Name(), err)
+			continue
+		}
+
+		for _, generation := range generations {
+			stats, err := r.GenerationStats(ctx, generation)
+			if err != nil {
+				log.Printf("%s: cannot find generation stats: %s", r.Name(), err)
+				continue
+			}
+
+			a = append(a, generationJSON{
+				Replica:    r.Name(),
+				Generation: generation,
+				SnapshotN:  stats.SnapshotN,
+				WALN:       stats.WALN,
+				Lag:        updatedAt.Sub(stats.UpdatedAt).Seconds(),
+				CreatedAt:  stats.CreatedAt.UTC().Format(time.RFC3339),
+				UpdatedAt:  stats.UpdatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(a)
+}
+
 // Usage prints the help message to STDOUT.
 func (c *GenerationsCommand) Usage() {
 	fmt.Printf(`
@@ -131,6 +182,11 @@ Arguments:
 	-replica NAME
 	    Optional, filters by replica.
 
+	-json
+	    Output generations as a JSON array of objects with "replica",
+	    "generation", "snapshot_count", "wal_count", "lag_seconds",
+	    "created_at" & "updated_at" fields.
+
 `[1:],
 		DefaultConfigPath(),
 	)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerationsCommand_JSON(t *testing.T) {
+	// Ensure each generation is written as an object with its stats.
+	t.Run("OK", func(t *testing.T) {
+		db, r, u := MustOpenReplicatedDB(t, 1)
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := r.GenerationStats(context.Background(), pos.Generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&GenerationsCommand{}).Run(context.Background(), []string{"-json", u})
+		})
+		if len(a) != 1 {
+			t.Fatalf("len=%d, want 1: %v", len(a), a)
+		} else if got, want := a[0]["replica"], "file"; got != want {
+			t.Fatalf("replica=%v, want %v", got, want)
+		} else if got, want := a[0]["generation"], pos.Generation; got != want {
+			t.Fatalf("generation=%v, want %v", got, want)
+		} else if got, want := a[0]["snapshot_count"], float64(stats.SnapshotN); got != want {
+			t.Fatalf("snapshot_count=%v, want %v", got, want)
+		} else if got, want := a[0]["wal_count"], float64(stats.WALN); got != want {
+			t.Fatalf("wal_count=%v, want %v", got, want)
+		} else if lag, ok := a[0]["lag_seconds"].(float64); !ok || lag < 0 {
+			t.Fatalf("lag_seconds=%v, want non-negative", a[0]["lag_seconds"])
+		} else if _, err := time.Parse(time.RFC3339, a[0]["created_at"].(string)); err != nil {
+			t.Fatalf("created_at: %s", err)
+		} else if _, err := time.Parse(time.RFC3339, a[0]["updated_at"].(string)); err != nil {
+			t.Fatalf("updated_at: %s", err)
+		}
+	})
+
+	// Ensure a replica without generations is written as an empty array.
+	t.Run("Empty", func(t *testing.T) {
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&GenerationsCommand{}).Run(context.Background(), []string{"-json", "file://" + filepath.Join(t.TempDir(), "replica")})
+		})
+		if a == nil || len(a) != 0 {
+			t.Fatalf("generations=%#v, want empty array", a)
+		}
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/b2"
+	"github.com/benbjohnson/litestream/gcs"
+	"github.com/benbjohnson/litestream/s3"
+)
+
+func TestConfig_IsExcluded(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		exclude []string
+		path    string
+		want    bool
+	}{
+		{name: "NoPatterns", path: "/data/app.db", want: false},
+		{name: "NameGlob", exclude: []string{"*-test.db"}, path: "/data/app-test.db", want: true},
+		{name: "NameGlobNoMatch", exclude: []string{"*-test.db"}, path: "/data/app.db", want: false},
+		{name: "NameGlobIgnoresDir", exclude: []string{"data"}, path: "/data/app.db", want: false},
+		{name: "NameGlobNestedDir", exclude: []string{"*.db"}, path: "/data/a/b/app.db", want: true},
+		{name: "PathGlob", exclude: []string{"/data/tmp/*.db"}, path: "/data/tmp/app.db", want: true},
+		{name: "PathGlobOtherDir", exclude: []string{"/data/tmp/*.db"}, path: "/data/app.db", want: false},
+		{name: "PathGlobSubdir", exclude: []string{"/data/tmp/*.db"}, path: "/data/tmp/sub/app.db", want: false},
+		{name: "CharClass", exclude: []string{"app[0-9].db"}, path: "/data/app1.db", want: true},
+		{name: "AnyPattern", exclude: []string{"/other/*", "*-test.db"}, path: "/data/app-test.db", want: true},
+		{name: "BadPattern", exclude: []string{"["}, path: "/data/[", want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{Exclude: tt.exclude}
+			if got := c.IsExcluded(tt.path); got != tt.want {
+				t.Fatalf("IsExcluded(%q)=%v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile_Exclude(t *testing.T) {
+	// Ensure excluded databases are skipped & patterns are expanded like
+	// database paths.
+	t.Run("OK", func(t *testing.T) {
+		dir := t.TempDir()
+		home := MustHomeDir(t)
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := ReadConfigFile(MustWriteConfig(t, `
+exclude:
+  - "*-test.db"
+  - "~/litestream-exclude-test/*.db"
+  - "rel/*.db"
+  - "`+filepath.Join(dir, "tmp", "*.db")+`"
+dbs:
+  - path: `+filepath.Join(dir, "app.db")+`
+  - path: `+filepath.Join(dir, "app-test.db")+`
+  - path: ~/litestream-exclude-test/home.db
+  - path: rel/rel.db
+  - path: rel/sub/rel.db
+  - path: `+filepath.Join(dir, "tmp", "tmp.db")+`
+  - path: `+filepath.Join(dir, "tmp", "sub", "tmp.db")+`
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, dbc := range config.DBs {
+			paths = append(paths, dbc.Path)
+		}
+		if got, want := paths, []string{
+			filepath.Join(dir, "app.db"),
+			filepath.Join(wd, "rel", "sub", "rel.db"),
+			filepath.Join(dir, "tmp", "sub", "tmp.db"),
+		}; !equalStrings(got, want) {
+			t.Fatalf("DBs=%v, want %v", got, want)
+		}
+
+		if got, want := config.excludedDBs, []string{
+			filepath.Join(dir, "app-test.db"),
+			filepath.Join(home, "litestream-exclude-test", "home.db"),
+			filepath.Join(wd, "rel", "rel.db"),
+			filepath.Join(dir, "tmp", "tmp.db"),
+		}; !equalStrings(got, want) {
+			t.Fatalf("excluded=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure an invalid pattern is reported instead of matching nothing.
+	t.Run("ErrBadPattern", func(t *testing.T) {
+		_, err := ReadConfigFile(MustWriteConfig(t, `
+exclude:
+  - "data/["
+dbs:
+  - path: /data/app.db
+`))
+		if err == nil || !strings.HasPrefix(err.Error(), `invalid exclude pattern "data/[": `) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestNewS3ReplicaFromConfig_CredentialFiles(t *testing.T) {
+	// Ensure replica key files override the global files & are read when
+	// the replica is built.
+	t.Run("OK", func(t *testing.T) {
+		dir := t.TempDir()
+		MustWriteFile(t, filepath.Join(dir, "key"), "KEY\n")
+		MustWriteFile(t, filepath.Join(dir, "secret"), "SECRET\n")
+
+		c := &Config{AccessKeyIDFile: filepath.Join(dir, "global-key"), SecretAccessKeyFile: filepath.Join(dir, "global-secret")}
+		rc := &ReplicaConfig{
+			Type:                "s3",
+			Bucket:              "bkt",
+			AccessKeyIDFile:     filepath.Join(dir, "key"),
+			SecretAccessKeyFile: filepath.Join(dir, "secret"),
+		}
+		r, err := newS3ReplicaFromConfig(litestream.NewDB(filepath.Join(dir, "db")), c, &DBConfig{}, rc)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := r.AccessKeyIDFile, filepath.Join(dir, "key"); got != want {
+			t.Fatalf("AccessKeyIDFile=%q, want %q", got, want)
+		} else if got, want := r.SecretAccessKeyFile, filepath.Join(dir, "secret"); got != want {
+			t.Fatalf("SecretAccessKeyFile=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure a missing key file fails at startup instead of on first use.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		dir := t.TempDir()
+		c := &Config{AccessKeyIDFile: filepath.Join(dir, "missing")}
+		rc := &ReplicaConfig{Type: "s3", Bucket: "bkt"}
+		if _, err := newS3ReplicaFromConfig(litestream.NewDB(filepath.Join(dir, "db")), c, &DBConfig{}, rc); err == nil || !strings.Contains(err.Error(), "cannot read credentials file: ") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestObjectPath(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		prefix        string // global
+		replicaPrefix string
+		path          string
+		want          string
+		err           string
+	}{
+		{name: "NoPrefix", path: "db", want: "db"},
+		{name: "Global", prefix: "hosts/web-01", path: "db", want: "hosts/web-01/db"},
+		{name: "Replica", prefix: "hosts/web-01", replicaPrefix: "hosts/web-02", path: "db", want: "hosts/web-02/db"},
+		{name: "Slashes", prefix: "/hosts/web-01/", path: "/db/", want: "hosts/web-01/db"},
+		{name: "RootPrefix", prefix: "/", path: "db", want: "db"},
+		{name: "BlankPath", prefix: "hosts/web-01", path: "", want: "hosts/web-01"},
+		{name: "InsidePrefix", prefix: "hosts/web-01", path: "a/../db", want: "hosts/web-01/db"},
+		{name: "ErrOutsidePrefix", prefix: "hosts/web-01", path: "../web-02/db", err: `replica path "../web-02/db" is outside of prefix "hosts/web-01"`},
+		{name: "ErrPrefixSibling", prefix: "hosts/web", path: "../web-01/db", err: `replica path "../web-01/db" is outside of prefix "hosts/web"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := objectPath(&Config{Prefix: tt.prefix}, &ReplicaConfig{Prefix: tt.replicaPrefix}, tt.path)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got != tt.want {
+				t.Fatalf("objectPath()=%q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile_Prefix(t *testing.T) {
+	// Ensure the global prefix applies to every object store replica unless
+	// the replica sets its own.
+	t.Run("OK", func(t *testing.T) {
+		dir := t.TempDir()
+		config, err := ReadConfigFile(MustWriteConfig(t, `
+prefix: hosts/web-01
+dbs:
+  - path: `+filepath.Join(dir, "db")+`
+    replicas:
+      - name: s3
+        url: s3://bkt/db
+      - name: gcs
+        type: gcs
+        bucket: bkt
+        path: db
+        prefix: hosts/web-02
+      - name: b2
+        type: b2
+        bucket: bkt
+        path: db
+        key-id: KEYID
+        application-key: KEY
+      - name: file
+        path: `+filepath.Join(dir, "replica")+`
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := newDBFromConfig(&config, config.DBs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			name string
+			want string
+		}{
+			{"s3", "hosts/web-01/db"},
+			{"gcs", "hosts/web-02/db"},
+			{"b2", "hosts/web-01/db"},
+			{"file", filepath.Join(dir, "replica")},
+		} {
+			if got := replicaPath(t, db.Replica(tt.name)); got != tt.want {
+				t.Fatalf("%s path=%q, want %q", tt.name, got, tt.want)
+			}
+		}
+	})
+
+	// Ensure a replica path outside of the prefix is refused.
+	t.Run("ErrOutsidePrefix", func(t *testing.T) {
+		dir := t.TempDir()
+		config, err := ReadConfigFile(MustWriteConfig(t, `
+prefix: hosts/web-01
+dbs:
+  - path: `+filepath.Join(dir, "db")+`
+    replicas:
+      - type: s3
+        bucket: bkt
+        path: ../web-02/db
+`))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := newDBFromConfig(&config, config.DBs[0]); err == nil || !strings.HasSuffix(err.Error(), `is outside of prefix "hosts/web-01"`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// replicaPath returns the path of a file or object store replica.
+func replicaPath(tb testing.TB, r litestream.Replica) string {
+	tb.Helper()
+	switch r := r.(type) {
+	case *litestream.FileReplica:
+		return r.Path()
+	case *s3.Replica:
+		return r.Path
+	case *gcs.Replica:
+		return r.Path
+	case *b2.Replica:
+		return r.Path
+	default:
+		tb.Fatalf("unexpected replica type: %T", r)
+		return ""
+	}
+}
+
+// MustWriteConfig writes a config file to a temporary directory & returns
+// its path.
+func MustWriteConfig(tb testing.TB, s string) string {
+	tb.Helper()
+	filename := filepath.Join(tb.TempDir(), "litestream.yml")
+	if err := ioutil.WriteFile(filename, []byte(s), 0666); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}
+
+// MustWriteFile writes data to filename.
+func MustWriteFile(tb testing.TB, filename, data string) {
+	tb.Helper()
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustOpenReplicatedDB returns a database with a table of n rows which is
+// replicated to a file replica. Returns the replica URL.
+func MustOpenReplicatedDB(tb testing.TB, n int) (*litestream.DB, *litestream.FileReplica, string) {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	db := litestream.NewDB(filepath.Join(dir, "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	r := litestream.NewFileReplica(db, "", filepath.Join(dir, "replica"))
+	r.MonitorEnabled = false
+	db.Replicas = append(db.Replicas, r)
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := sqldb.Close(); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	})
+
+	if _, err := sqldb.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return db, r, "file://" + r.Path()
+}
+
+// MustRunJSON runs fn & decodes the JSON it writes to STDOUT into v.
+func MustRunJSON(tb testing.TB, v interface{}, fn func() error) {
+	tb.Helper()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = pw
+	defer func() { os.Stdout = stdout }()
+
+	ch := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, pr)
+		ch <- buf.Bytes()
+	}()
+
+	err = fn()
+	pw.Close()
+	buf := <-ch
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := json.Unmarshal(buf, v); err != nil {
+		tb.Fatalf("cannot decode output: %s: %q", err, buf)
+	}
+}
+
+// MustHomeDir returns the home directory used to expand "~" in paths.
+func MustHomeDir(tb testing.TB) string {
+	tb.Helper()
+	u, err := user.Current()
+	if err != nil {
+		tb.Fatal(err)
+	} else if u.HomeDir == "" {
+		tb.Skip("no home directory available")
+	}
+	return u.HomeDir
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
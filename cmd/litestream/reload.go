@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// reloadPlan represents the changes between the running databases & a new
+// configuration. New databases & replicas are built but not started until
+// the plan is applied so an invalid configuration changes nothing.
+type reloadPlan struct {
+	added     []*litestream.DB
+	removed   []*litestream.DB
+	restarted []dbRestart
+	replicas  []replicaChanges
+	unchanged int
+}
+
+// dbRestart represents a database whose own settings changed. The database
+// is shut down & opened again with new settings, continuing its generation.
+type dbRestart struct {
+	prev, db *litestream.DB
+}
+
+// replicaChanges represents the replicas added, changed or removed from a
+// database whose own settings are unchanged.
+type replicaChanges struct {
+	db       *litestream.DB
+	added    []litestream.Replica
+	replaced []litestream.Replica
+	removed  []string
+}
+
+// reload re-reads the configuration file & applies the changes to the
+// running databases. The current configuration is kept if the new one is
+// invalid. Databases & replicas which are unchanged keep replicating.
+func (c *ReplicateCommand) reload() error {
+	config, err := ReadConfigFile(c.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	plan, err := c.planReload(&config)
+	if err != nil {
+		return err
+	}
+
+	if config.Addr != c.Config.Addr {
+		log.Printf("config: addr change requires restart")
+	}
+	if config.MaxConcurrentUploads != c.Config.MaxConcurrentUploads {
+		log.Printf("config: max-concurrent-uploads change requires restart")
+	}
+
+	// Removed & changed replicas get the shutdown timeout to upload their
+	// pending changes.
+	timeout := litestream.DefaultShutdownSyncTimeout
+	if config.ShutdownTimeout > 0 {
+		timeout = config.ShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c.applyReload(ctx, plan)
+	c.Config = config
+	return nil
+}
+
+// planReload returns the changes required to replicate as set by config.
+func (c *ReplicateCommand) planReload(config *Config) (plan *reloadPlan, err error) {
+	plan = &reloadPlan{}
+	defer func() {
+		if err != nil {
+			plan.discard()
+		}
+	}()
+
+	// Settings shared by replicas, such as credentials, change every replica.
+	sharedChanged := !reflect.DeepEqual(replicaSettings(c.Config), replicaSettings(*config))
+
+	for _, dbc := range config.DBs {
+		if err := validateReplicaNames(dbc); err != nil {
+			return plan, err
+		}
+
+		db, prev := c.db(dbc.Path), c.Config.DBConfig(dbc.Path)
+		if db == nil || prev == nil {
+			newDB, err := newDBFromConfig(config, dbc)
+			if err != nil {
+				return plan, err
+			}
+			newDB.UploadScheduler = c.scheduler
+			plan.added = append(plan.added, newDB)
+			continue
+		}
+
+		if !dbSettingsEqual(prev, dbc) {
+			newDB, err := newDBFromConfig(config, dbc)
+			if err != nil {
+				return plan, err
+			}
+			newDB.UploadScheduler = c.scheduler
+			plan.restarted = append(plan.restarted, dbRestart{prev: db, db: newDB})
+			continue
+		}
+
+		changes := replicaChanges{db: db}
+		prevReplicas := make(map[string]*ReplicaConfig)
+		for _, rc := range prev.Replicas {
+			prevReplicas[replicaConfigName(rc)] = rc
+		}
+		for _, rc := range dbc.Replicas {
+			name := replicaConfigName(rc)
+			prc, ok := prevReplicas[name]
+			delete(prevReplicas, name)
+			if ok && !sharedChanged && reflect.DeepEqual(prc, rc) {
+				continue
+			}
+
+			r, err := newReplicaFromConfig(db, config, dbc, rc)
+			if err != nil {
+				return plan, err
+			} else if ok {
+				changes.replaced = append(changes.replaced, r)
+			} else {
+				changes.added = append(changes.added, r)
+			}
+		}
+		for _, rc := range prev.Replicas {
+			if _, ok := prevReplicas[replicaConfigName(rc)]; ok {
+				changes.removed = append(changes.removed, replicaConfigName(rc))
+			}
+		}
+
+		if len(changes.added)+len(changes.replaced)+len(changes.removed) == 0 {
+			plan.unchanged++
+			continue
+		}
+		plan.replicas = append(plan.replicas, changes)
+	}
+
+	for _, db := range c.DBs {
+		if config.DBConfig(db.Path()) == nil {
+			plan.removed = append(plan.removed, db)
+		}
+	}
+
+	return plan, nil
+}
+
+// discard releases the resources of the databases & replicas built by the
+// plan, such as shared clients, without starting them.
+func (p *reloadPlan) discard() {
+	for _, db := range p.added {
+		_ = db.SoftClose()
+	}
+	for _, r := range p.restarted {
+		_ = r.db.SoftClose()
+	}
+	for _, changes := range p.replicas {
+		for _, r := range append(changes.added, changes.replaced...) {
+			if c, ok := r.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}
+	}
+}
+
+// applyReload applies the changes of plan to the running databases. Pending
+// changes of removed & changed replicas are uploaded until ctx is done.
+func (c *ReplicateCommand) applyReload(ctx context.Context, plan *reloadPlan) {
+	var replicaAddedN, replicaReplacedN, replicaRemovedN int
+
+	for _, db := range plan.removed {
+		c.shutdownDB(ctx, db)
+		c.detachDB(db)
+		log.Printf("%s: config: removed db", db.Path())
+	}
+
+	for _, r := range plan.restarted {
+		c.shutdownDB(ctx, r.prev)
+		if err := r.db.Open(); err != nil {
+			log.Printf("%s: config: cannot open db, replication stopped: %s", r.db.Path(), err)
+			c.detachDB(r.prev)
+			continue
+		}
+
+		// Initialize the new database before closing the previous connection
+		// so closing it cannot checkpoint the database.
+		if err := r.db.Sync(); err != nil {
+			log.Printf("%s: config: sync error: %s", r.db.Path(), err)
+		}
+		if d := r.prev.SQLDB(); d != nil {
+			if err := d.Close(); err != nil {
+				log.Printf("%s: config: cannot close previous connection: %s", r.db.Path(), err)
+			}
+		}
+
+		for i := range c.DBs {
+			if c.DBs[i] == r.prev {
+				c.DBs[i] = r.db
+			}
+		}
+		log.Printf("%s: config: restarted db with new settings", r.db.Path())
+	}
+
+	for _, db := range plan.added {
+		if err := db.Open(); err != nil {
+			log.Printf("%s: config: cannot open db: %s", db.Path(), err)
+			continue
+		}
+		c.DBs = append(c.DBs, db)
+		log.Printf("%s: config: added db", db.Path())
+		for _, r := range db.ReplicaList() {
+			printReplica(r)
+		}
+	}
+
+	for _, changes := range plan.replicas {
+		db := changes.db
+		for _, name := range changes.removed {
+			if err := db.RemoveReplica(ctx, name); err != nil {
+				log.Printf("%s(%s): config: cannot remove replica: %s", db.Path(), name, err)
+				continue
+			}
+			log.Printf("%s(%s): config: removed replica", db.Path(), name)
+			replicaRemovedN++
+		}
+		for _, r := range changes.replaced {
+			if err := db.ReplaceReplica(ctx, r); err != nil {
+				log.Printf("%s(%s): config: cannot update replica: %s", db.Path(), r.Name(), err)
+				continue
+			}
+			log.Printf("%s(%s): config: updated replica", db.Path(), r.Name())
+			replicaReplacedN++
+		}
+		for _, r := range changes.added {
+			if err := db.AddReplica(r); err != nil {
+				log.Printf("%s(%s): config: cannot add replica: %s", db.Path(), r.Name(), err)
+				continue
+			}
+			log.Printf("%s(%s): config: added replica", db.Path(), r.Name())
+			printReplica(r)
+			replicaAddedN++
+		}
+	}
+
+	log.Printf("config reloaded: dbs added=%d removed=%d restarted=%d unchanged=%d, replicas added=%d updated=%d removed=%d",
+		len(plan.added), len(plan.removed), len(plan.restarted), plan.unchanged,
+		replicaAddedN, replicaReplacedN, replicaRemovedN)
+}
+
+// shutdownDB uploads the pending changes of db & closes it. If ctx is done
+// first, db is closed once its replicas have stopped.
+func (c *ReplicateCommand) shutdownDB(ctx context.Context, db *litestream.DB) {
+	if err := db.Shutdown(ctx); err != nil {
+		log.Printf("%s: config: shutdown: %s", db.Path(), err)
+		if err := db.SoftClose(); err != nil {
+			log.Printf("%s: config: close: %s", db.Path(), err)
+		}
+	}
+}
+
+// detachDB removes db from the list of managed databases.
+func (c *ReplicateCommand) detachDB(db *litestream.DB) {
+	for i := range c.DBs {
+		if c.DBs[i] == db {
+			c.DBs = append(c.DBs[:i:i], c.DBs[i+1:]...)
+			return
+		}
+	}
+}
+
+// db returns the managed database with the given path.
+func (c *ReplicateCommand) db(path string) *litestream.DB {
+	for _, db := range c.DBs {
+		if db.Path() == path {
+			return db
+		}
+	}
+	return nil
+}
+
+// replicaSettings returns config without the settings which do not affect
+// how replicas are built.
+func replicaSettings(config Config) Config {
+	config.Addr = ""
+	config.DBs, config.Exclude, config.excludedDBs = nil, nil, nil
+	config.MaxConcurrentUploads = 0
+	config.ShutdownTimeout = 0
+	return config
+}
+
+// dbSettingsEqual returns true if the database settings of a & b, other than
+// their replicas, are equal.
+func dbSettingsEqual(a, b *DBConfig) bool {
+	x, y := *a, *b
+	x.Replicas, y.Replicas = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// replicaConfigName returns the name of the replica built from rc.
+func replicaConfigName(rc *ReplicaConfig) string {
+	if rc.Name != "" {
+		return rc.Name
+	}
+	return rc.ReplicaType()
+}
+
+// validateReplicaNames returns an error if two replicas of dbc have the same name.
+func validateReplicaNames(dbc *DBConfig) error {
+	m := make(map[string]struct{})
+	for _, rc := range dbc.Replicas {
+		name := replicaConfigName(rc)
+		if _, ok := m[name]; ok {
+			return fmt.Errorf("%s: duplicate replica name: %q", dbc.Path, name)
+		}
+		m[name] = struct{}{}
+	}
+	return nil
+}
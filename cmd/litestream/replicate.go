@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,10 +12,15 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/b2"
+	"github.com/benbjohnson/litestream/gcs"
 	"github.com/benbjohnson/litestream/s3"
+	"github.com/benbjohnson/litestream/sftp"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -25,6 +31,9 @@ type ReplicateCommand struct {
 
 	// List of managed databases specified in the config.
 	DBs []*litestream.DB
+
+	mu        sync.Mutex // protects Config & DBs while reloading
+	scheduler *litestream.UploadScheduler
 }
 
 // Run loads all databases specified in the configuration.
@@ -39,6 +48,7 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 
 	// Load configuration or use CLI args to build db/replica.
 	var config Config
+	var reloadable bool
 	if fs.NArg() == 1 {
 		return fmt.Errorf("must specify at least one replica URL for %s", fs.Arg(0))
 	} else if fs.NArg() > 1 {
@@ -55,6 +65,7 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 		if err != nil {
 			return err
 		}
+		reloadable = true
 	} else {
 		return errors.New("-config flag or database/replica arguments required")
 	}
@@ -69,24 +80,34 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 		litestream.Tracef = log.New(f, "", log.LstdFlags|log.LUTC|log.Lshortfile).Printf
 	}
 
-	// Setup signal handler.
+	// Setup signal handler. Pending changes are uploaded before exiting.
 	ctx, cancel := context.WithCancel(ctx)
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	go func() { <-ch; cancel() }()
 
 	// Display version information.
 	fmt.Printf("litestream %s\n", Version)
 
+	for _, path := range config.excludedDBs {
+		fmt.Printf("excluded db: %s\n", path)
+	}
 	if len(config.DBs) == 0 {
 		fmt.Println("no databases specified in configuration")
 	}
 
+	// Share a single upload scheduler so databases are uploaded by priority.
+	if config.MaxConcurrentUploads > 0 {
+		c.scheduler = litestream.NewUploadScheduler(config.MaxConcurrentUploads)
+	}
+	c.Config = config
+
 	for _, dbConfig := range config.DBs {
 		db, err := newDBFromConfig(&config, dbConfig)
 		if err != nil {
 			return err
 		}
+		db.UploadScheduler = c.scheduler
 
 		// Open database & attach to program.
 		if err := db.Open(); err != nil {
@@ -98,24 +119,27 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	// Notify user that initialization is done.
 	for _, db := range c.DBs {
 		fmt.Printf("initialized db: %s\n", db.Path())
-		for _, r := range db.Replicas {
-			switch r := r.(type) {
-			case *litestream.FileReplica:
-				fmt.Printf("replicating to: name=%q type=%q path=%q\n", r.Name(), r.Type(), r.Path())
-			case *s3.Replica:
-				fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q region=%q\n", r.Name(), r.Type(), r.Bucket, r.Path, r.Region)
-			default:
-				fmt.Printf("replicating to: name=%q type=%q\n", r.Name(), r.Type())
-			}
+		for _, r := range db.ReplicaList() {
+			printReplica(r)
 		}
 	}
 
-	// Serve metrics over HTTP if enabled.
+	// Re-read the config file, if any, & replica credential files on SIGHUP
+	// so settings & rotated keys are used without restarting.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go c.reloadOnSignal(ctx, hup, reloadable)
+
+	// Serve metrics & replication status over HTTP if enabled.
 	if config.Addr != "" {
 		_, port, _ := net.SplitHostPort(config.Addr)
 		fmt.Printf("serving metrics on http://localhost:%s/metrics\n", port)
+		fmt.Printf("serving status on http://localhost:%s/status\n", port)
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
+			http.HandleFunc("/status", c.serveStatus)
+			http.HandleFunc("/pause", c.servePause)
+			http.HandleFunc("/resume", c.servePause)
 			if err := http.ListenAndServe(config.Addr, nil); err != nil {
 				log.Printf("cannot start metrics server: %s", err)
 			}
@@ -126,8 +150,17 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	<-ctx.Done()
 	signal.Reset()
 
-	// Gracefully close
-	if err := c.Close(); err != nil {
+	// Gracefully close after uploading pending changes.
+	timeout := litestream.DefaultShutdownSyncTimeout
+	c.mu.Lock()
+	if c.Config.ShutdownTimeout > 0 {
+		timeout = c.Config.ShutdownTimeout
+	}
+	c.mu.Unlock()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+
+	if err := c.Shutdown(shutdownCtx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -135,8 +168,37 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	return nil
 }
 
+// Shutdown uploads pending changes of all open databases & closes them.
+// Databases are shut down concurrently until ctx is done.
+func (c *ReplicateCommand) Shutdown(ctx context.Context) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errs := make([]error, len(c.DBs))
+	var wg sync.WaitGroup
+	for i, db := range c.DBs {
+		i, db := i, db
+		wg.Add(1)
+		go func() { defer wg.Done(); errs[i] = db.Shutdown(ctx) }()
+	}
+	wg.Wait()
+
+	for i, e := range errs {
+		if e != nil {
+			fmt.Printf("error closing db: path=%s err=%s\n", c.DBs[i].Path(), e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
 // Close closes all open databases.
 func (c *ReplicateCommand) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	for _, db := range c.DBs {
 		if e := db.SoftClose(); e != nil {
 			fmt.Printf("error closing db: path=%s err=%s\n", db.Path(), e)
@@ -148,6 +210,134 @@ func (c *ReplicateCommand) Close() (err error) {
 	return err
 }
 
+// printReplica prints the name, type & location of r.
+func printReplica(r litestream.Replica) {
+	switch r := r.(type) {
+	case *litestream.FileReplica:
+		fmt.Printf("replicating to: name=%q type=%q path=%q\n", r.Name(), r.Type(), r.Path())
+	case *s3.Replica:
+		fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q region=%q\n", r.Name(), r.Type(), r.Bucket, r.Path, r.Region)
+	case *b2.Replica:
+		fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q\n", r.Name(), r.Type(), r.Bucket, r.Path)
+	case *gcs.Replica:
+		fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q\n", r.Name(), r.Type(), r.Bucket, r.Path)
+	case *sftp.Replica:
+		fmt.Printf("replicating to: name=%q type=%q host=%q path=%q\n", r.Name(), r.Type(), r.Host, r.Path)
+	case *litestream.FailoverReplica:
+		names := make([]string, len(r.Clients))
+		for i, client := range r.Clients {
+			names[i] = client.Name()
+		}
+		fmt.Printf("replicating to: name=%q type=%q clients=%q\n", r.Name(), r.Type(), names)
+	default:
+		fmt.Printf("replicating to: name=%q type=%q\n", r.Name(), r.Type())
+	}
+}
+
+// dbs returns a copy of the list of managed databases.
+func (c *ReplicateCommand) dbs() []*litestream.DB {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*litestream.DB(nil), c.DBs...)
+}
+
+// reloadOnSignal reloads the config file, if reloadable is set, & then the
+// credentials of each replica whenever a signal is received on ch, until ctx
+// is canceled.
+func (c *ReplicateCommand) reloadOnSignal(ctx context.Context, ch <-chan os.Signal, reloadable bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+
+		if reloadable {
+			if err := c.reload(); err != nil {
+				log.Printf("cannot reload config, keeping current config: %s", err)
+			}
+		}
+		c.reloadCredentials()
+	}
+}
+
+// reloadCredentials reloads the credentials of each replica which supports it.
+func (c *ReplicateCommand) reloadCredentials() {
+	for _, db := range c.dbs() {
+		for _, r := range db.ReplicaList() {
+			rr, ok := r.(interface{ ReloadCredentials() error })
+			if !ok {
+				continue
+			} else if err := rr.ReloadCredentials(); err != nil {
+				log.Printf("%s(%s): cannot reload credentials: %s", db.Path(), r.Name(), err)
+				continue
+			}
+			log.Printf("%s(%s): credentials reloaded", db.Path(), r.Name())
+		}
+	}
+}
+
+// serveStatus writes the replication status of each database as JSON.
+func (c *ReplicateCommand) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dbs := c.dbs()
+	statuses := make([]litestream.DBStatus, 0, len(dbs))
+	for _, db := range dbs {
+		statuses = append(statuses, db.Status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		DBs []litestream.DBStatus `json:"dbs"`
+	}{statuses}); err != nil {
+		log.Printf("cannot write status: %s", err)
+	}
+}
+
+// servePause pauses or resumes replication of the database set by the "db"
+// query parameter, or of all databases if it is blank, depending on the path.
+func (c *ReplicateCommand) servePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("db")
+	if path != "" {
+		var err error
+		if path, err = expand(path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var n int
+	for _, db := range c.dbs() {
+		if path != "" && db.Path() != path {
+			continue
+		}
+		if r.URL.Path == "/pause" {
+			db.Pause()
+		} else {
+			db.Resume()
+		}
+		n++
+	}
+	if n == 0 {
+		http.Error(w, "database not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // Usage prints the help screen to STDOUT.
 func (c *ReplicateCommand) Usage() {
 	fmt.Printf(`
@@ -156,6 +346,36 @@ You can specify your database & replicas in a configuration file or you can
 replicate a single database file by specifying its path and its replicas in the
 command line arguments.
 
+On SIGINT or SIGTERM, pending changes are uploaded to each replica before
+exiting. Uploads are stopped after "shutdown-timeout", which defaults to 30s,
+& the amount of data left unflushed is logged.
+
+Sending SIGHUP re-reads the configuration file & applies the changes without
+restarting. Replication starts for new databases & replicas. Removed databases
+& replicas upload their pending changes, for up to "shutdown-timeout", & then
+stop. Changed replicas are flushed & replaced without starting a new
+generation & databases with changed settings are closed & reopened, continuing
+their generation. Unchanged databases & replicas keep replicating. If the new
+configuration is invalid, it is logged & the current one is kept. Changes to
+"addr" & "max-concurrent-uploads" require a restart.
+
+SIGHUP also re-reads replica credential files, such as those set with
+"access-key-id-file" & "secret-access-key-file".
+
+If "addr" is set in the configuration, metrics are served at /metrics & the
+position & last sync error of each database & replica are served as JSON at
+/status.
+
+Replication can also be paused with a POST to /pause & resumed with a POST to
+/resume, such as during a bulk import. Set the "db" query parameter to the
+path of a database to only pause or resume that database. While paused, the
+database can still be written but changes are not uploaded & unreplicated WAL
+may be discarded, in which case a new generation & snapshot are created when
+replication resumes.
+
+WARNING: changes made while replication is paused are not durable. They are
+lost if the local disk fails before replication resumes & catches up.
+
 Usage:
 
 	litestream replicate [arguments]
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"time"
@@ -24,17 +25,38 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 	fs := flag.NewFlagSet("litestream-restore", flag.ContinueOnError)
 	registerConfigFlag(fs, &configPath)
 	fs.StringVar(&opt.OutputPath, "o", "", "output path")
+	fs.StringVar(&opt.TempDir, "temp-dir", "", "temporary directory")
 	fs.StringVar(&opt.ReplicaName, "replica", "", "replica name")
 	fs.StringVar(&opt.Generation, "generation", "", "generation name")
 	fs.IntVar(&opt.Index, "index", opt.Index, "wal index")
+	fs.StringVar(&opt.Marker, "marker", "", "marker name")
 	fs.BoolVar(&opt.DryRun, "dry-run", false, "dry run")
+	fs.BoolVar(&opt.ValidateWALSalt, "validate-salt", opt.ValidateWALSalt, "validate wal salt")
+	fs.BoolVar(&opt.FallbackOnCorruption, "fallback-on-corruption", false, "restore to last good position on corrupt wal")
+	fs.IntVar(&opt.RecommendedPageSize, "page-size", 0, "recommended page size")
+	fs.BoolVar(&opt.ConvertPageSize, "convert-page-size", false, "vacuum to recommended page size")
+	fs.BoolVar(&opt.EnableWAL, "enable-wal", opt.EnableWAL, "set restored database to wal mode")
+	fs.BoolVar(&opt.Deterministic, "deterministic", false, "rebuild restored database into a reproducible file")
+	fs.BoolVar(&opt.Overwrite, "overwrite", false, "replace existing database")
+	fs.BoolVar(&opt.Validate, "validate", false, "run integrity check on restored database")
+	fs.BoolVar(&opt.ValidateForeignKeys, "validate-foreign-keys", false, "run foreign key check on restored database")
+	fs.StringVar(&opt.TableFormat, "format", litestream.TableFormatSQL, "table output format")
+	table := fs.String("table", "", "restore a single table")
+	fromDir := fs.String("from-dir", "", "backup bundle directory")
+	fromArchive := fs.String("from-archive", "", "snapshot archive path")
 	timestampStr := fs.String("timestamp", "", "timestamp")
+	watermarkPath := fs.String("watermark", "", "watermark file path")
+	ifReplicaExists := fs.Bool("if-replica-exists", false, "exit successfully if no backups found")
 	verbose := fs.Bool("v", false, "verbose output")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
-	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+	} else if *fromArchive != "" {
+		return c.restoreFromArchive(*fromArchive, fs, opt)
+	} else if *fromDir == "" && (fs.NArg() == 0 || fs.Arg(0) == "") {
 		return fmt.Errorf("database path or replica URL required")
+	} else if *fromDir != "" && fs.NArg() > 0 {
+		return fmt.Errorf("cannot specify database path or replica URL with -from-dir")
 	} else if fs.NArg() > 1 {
 		return fmt.Errorf("too many arguments")
 	}
@@ -46,19 +68,56 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	}
 
-	// Verbose output is automatically enabled if dry run is specified.
+	if opt.TempDir != "" {
+		if opt.TempDir, err = expand(opt.TempDir); err != nil {
+			return err
+		}
+	}
+
+	// Restore to the exact position in a watermark file, if specified.
+	if *watermarkPath != "" {
+		if err := c.applyWatermark(*watermarkPath, fs, &opt); err != nil {
+			return err
+		}
+	}
+
+	// A single table is written to the output path, or STDOUT if blank,
+	// so the original database path must not be used as the default.
+	tablePath := opt.OutputPath
+	if *table != "" && opt.OutputPath == "" {
+		opt.OutputPath = "-"
+	}
+
+	// Checking foreign keys also requires the integrity check.
+	if opt.ValidateForeignKeys {
+		opt.Validate = true
+	}
+
+	// Verbose output is automatically enabled if dry run is specified so
+	// the restore plan is printed.
 	if opt.DryRun {
 		*verbose = true
 	}
 
-	// Instantiate logger if verbose output is enabled.
+	// Instantiate logger & report progress if verbose output is enabled.
 	if *verbose {
 		opt.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		opt.Progress = func(p litestream.RestoreProgress) {
+			if p.TotalBytes <= 0 {
+				opt.Logger.Printf("restored %d bytes, eta unknown", p.DoneBytes)
+				return
+			}
+			opt.Logger.Printf("restored %d of %d bytes (%.0f%%), eta %s", p.DoneBytes, p.TotalBytes, float64(p.DoneBytes)/float64(p.TotalBytes)*100, p.ETA.Round(time.Second))
+		}
 	}
 
 	// Determine replica & generation to restore from.
 	var r litestream.Replica
-	if isURL(fs.Arg(0)) {
+	if *fromDir != "" {
+		if r, err = c.loadFromDir(*fromDir, &opt); err != nil {
+			return err
+		}
+	} else if isURL(fs.Arg(0)) {
 		if r, err = c.loadFromURL(ctx, fs.Arg(0), &opt); err != nil {
 			return err
 		}
@@ -70,24 +129,158 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 		return errors.New("config path or replica URL required")
 	}
 
-	// Return an error if no matching targets found.
-	if opt.Generation == "" {
+	// Return an error if no matching targets found, unless the restore is
+	// only performed if a replica exists.
+	if opt.Generation == "" && *ifReplicaExists {
+		fmt.Println("no matching backups found")
+		return nil
+	} else if opt.Generation == "" {
 		return fmt.Errorf("no matching backups found")
 	}
 
+	if *table != "" {
+		return c.restoreTable(ctx, r, opt, *table, tablePath)
+	}
 	return litestream.RestoreReplica(ctx, r, opt)
 }
 
+// restoreTable writes the rows of a single table from the replica to the
+// file at path, or STDOUT if path is blank.
+func (c *RestoreCommand) restoreTable(ctx context.Context, r litestream.Replica, opt litestream.RestoreOptions, table, path string) (err error) {
+	if path == "" {
+		return litestream.RestoreTable(ctx, r, opt, table, os.Stdout)
+	}
+
+	if path, err = expand(path); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := litestream.RestoreTable(ctx, r, opt, table, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// applyWatermark sets the restore position to the position recorded in a
+// watermark file. Other position arguments cannot be combined with it.
+func (c *RestoreCommand) applyWatermark(filename string, fs *flag.FlagSet, opt *litestream.RestoreOptions) (err error) {
+	var invalid string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "generation", "index", "timestamp", "marker":
+			invalid = f.Name
+		}
+	})
+	if invalid != "" {
+		return fmt.Errorf("cannot specify -%s with -watermark", invalid)
+	}
+
+	if filename, err = expand(filename); err != nil {
+		return err
+	}
+	pos, err := litestream.ReadWatermark(filename)
+	if err != nil {
+		return err
+	}
+	opt.Generation, opt.Index, opt.Offset = pos.Generation, pos.Index, pos.Offset
+	return nil
+}
+
 // loadFromURL creates a replica & updates the restore options from a replica URL.
 func (c *RestoreCommand) loadFromURL(ctx context.Context, replicaURL string, opt *litestream.RestoreOptions) (litestream.Replica, error) {
 	r, err := NewReplicaFromURL(replicaURL)
 	if err != nil {
 		return nil, err
 	}
-	opt.Generation, _, err = litestream.CalcReplicaRestoreTarget(ctx, r, *opt)
+	opt.Generation, _, err = litestream.CalcReplicaRestoreTarget(ctx, r, targetOptions(*opt))
 	return r, err
 }
 
+// targetOptions returns opt with a logger so skipped generations are always
+// reported when choosing a generation to restore, even without verbose output.
+func targetOptions(opt litestream.RestoreOptions) litestream.RestoreOptions {
+	if opt.Logger == nil {
+		opt.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return opt
+}
+
+// loadFromDir returns a replica & updates the restore options from a backup
+// bundle directory created by the download command.
+func (c *RestoreCommand) loadFromDir(dir string, opt *litestream.RestoreOptions) (litestream.Replica, error) {
+	dir, err := expand(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := litestream.ReadManifest(dir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("manifest not found, bundle may be incomplete: %s", dir)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if opt.OutputPath == "" {
+		return nil, fmt.Errorf("output path required when restoring from directory")
+	} else if err := litestream.VerifyManifest(dir, m); err != nil {
+		return nil, fmt.Errorf("cannot verify bundle: %w", err)
+	} else if opt.Generation != "" && opt.Generation != m.Generation {
+		return nil, fmt.Errorf("generation not found in bundle: %s", opt.Generation)
+	}
+	opt.Generation = m.Generation
+
+	return litestream.NewFileReplica(nil, m.Replica, dir), nil
+}
+
+// restoreFromArchive restores a standalone archive written by the snapshot
+// command. Archives contain a complete database so only -o applies.
+func (c *RestoreCommand) restoreFromArchive(filename string, fs *flag.FlagSet, opt litestream.RestoreOptions) (err error) {
+	if fs.NArg() > 0 {
+		return fmt.Errorf("cannot specify database path or replica URL with -from-archive")
+	} else if opt.OutputPath == "" {
+		return fmt.Errorf("output path required when restoring from archive")
+	}
+
+	// Only the output path is applicable to archives.
+	var invalid string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "from-archive", "o", "config":
+		default:
+			invalid = f.Name
+		}
+	})
+	if invalid != "" {
+		return fmt.Errorf("cannot specify -%s with -from-archive", invalid)
+	}
+
+	if opt.OutputPath, err = expand(opt.OutputPath); err != nil {
+		return err
+	}
+
+	// Read from STDIN if the archive path is "-".
+	var rd io.Reader = os.Stdin
+	if filename != "-" {
+		if filename, err = expand(filename); err != nil {
+			return err
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rd = f
+	}
+
+	return litestream.RestoreArchive(rd, opt.OutputPath)
+}
+
 // loadFromConfig returns a replica & updates the restore options from a DB reference.
 func (c *RestoreCommand) loadFromConfig(ctx context.Context, dbPath, configPath string, opt *litestream.RestoreOptions) (litestream.Replica, error) {
 	// Load configuration.
@@ -115,7 +308,7 @@ func (c *RestoreCommand) loadFromConfig(ctx context.Context, dbPath, configPath
 	}
 
 	// Determine the appropriate replica & generation to restore from,
-	r, generation, err := db.CalcRestoreTarget(ctx, *opt)
+	r, generation, err := db.CalcRestoreTarget(ctx, targetOptions(*opt))
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +328,10 @@ Usage:
 
 	litestream restore [arguments] REPLICA_URL
 
+	litestream restore [arguments] -from-dir PATH
+
+	litestream restore -from-archive PATH -o PATH
+
 Arguments:
 
 	-config PATH
@@ -147,7 +344,10 @@ Arguments:
 
 	-generation NAME
 	    Restore from a specific generation.
-	    Defaults to generation with latest data.
+	    Defaults to generation with latest data that has a
+	    snapshot to restore from. Newer generations without
+	    a snapshot, such as one still being uploaded, are
+	    skipped & logged.
 
 	-index NUM
 	    Restore up to a specific WAL index (inclusive).
@@ -157,13 +357,97 @@ Arguments:
 	    Restore to a specific point-in-time.
 	    Defaults to use the latest available backup.
 
+	-marker NAME
+	    Restore to just after the commit which inserted the row with
+	    NAME into the litestream_markers table. Restores from the
+	    earliest snapshot of the generation.
+
+	-watermark PATH
+	    Restore to the exact position recorded in a JSON file with
+	    "generation", "index" & "offset" fields. Fails if the
+	    replica does not contain the position.
+
 	-o PATH
 	    Output path of the restored database.
 	    Defaults to original DB path.
 
+	-temp-dir PATH
+	    Directory of the temporary files written while restoring.
+	    Defaults to the directory of the output path. If it is on
+	    another filesystem, the restored database is copied next to
+	    the output path before replacing it.
+
+	-from-dir PATH
+	    Restores offline from a directory created by the download
+	    command. Files are verified against the manifest checksums
+	    before restoring. Requires -o.
+
+	-from-archive PATH
+	    Restores a standalone archive written by the snapshot
+	    command. Use "-" to read from STDIN. Requires -o.
+
 	-dry-run
-	    Prints all log output as if it were running but does
-	    not perform actual restore.
+	    Prints the restore plan, including the generation, snapshot,
+	    number of WAL segments, the bytes to download for the snapshot
+	    & WAL files & the target position, without restoring. Sizes are
+	    read from the replica's listings. Fails if the target cannot be
+	    reached.
+
+	-validate-salt=BOOL
+	    Verifies that all frames in each WAL file share the same
+	    salt so segments from another WAL are not applied.
+	    Defaults to true.
+
+	-fallback-on-corruption
+	    If a WAL file is corrupt or cannot be read, restores up to the
+	    last good position instead of failing. The WAL files which
+	    were not applied are reported in the log.
+
+	-page-size NUM
+	    Warns if the restored database's page size differs from
+	    NUM, such as the block size of the target filesystem.
+
+	-convert-page-size
+	    Rebuilds the restored database with VACUUM to use the
+	    page size specified by -page-size.
+
+	-enable-wal=BOOL
+	    Sets the restored database to WAL mode so it can be
+	    replicated. If false, the PRAGMA to run is printed instead.
+	    Defaults to true.
+
+	-deterministic
+	    Rebuilds the restored database with VACUUM INTO so restores
+	    of the same backup produce byte-identical files.
+
+	-table NAME
+	    Writes the rows of a single table to -o, or STDOUT if -o is
+	    not specified, instead of restoring the database. The
+	    database is restored to a temporary file which is removed
+	    afterward.
+
+	-format FORMAT
+	    Format of the rows written by -table. Either "sql" for
+	    INSERT statements or "csv". Defaults to "sql".
+
+	-validate
+	    Runs "PRAGMA integrity_check" on the restored database before
+	    it is moved to the output path. The restore fails & reports
+	    the first problems found if the check does not pass.
+
+	-validate-foreign-keys
+	    Also runs "PRAGMA foreign_key_check". Implies -validate.
+
+	-if-replica-exists
+	    Returns exit code of 0 if no backups found.
+
+	-overwrite
+	    Replaces the database at the output path, if it exists. The
+	    database is restored to a temporary file in the same
+	    directory & verified before it is atomically renamed into
+	    place. The WAL & shared memory files of the existing database
+	    are removed. The existing database is kept if the restore
+	    fails.
 
 	-v
 	    Verbose output.
@@ -177,15 +461,30 @@ Examples:
 	# Restore replica for database to a given point in time.
 	$ litestream restore -timestamp 2020-01-01T00:00:00Z /path/to/db
 
+	# Replace the database with the latest replica, if one exists.
+	$ litestream restore -if-replica-exists -overwrite /path/to/db
+
 	# Restore latest replica for database to new /tmp directory
 	$ litestream restore -o /tmp/db /path/to/db
 
+	# Restore database from a downloaded backup bundle.
+	$ litestream restore -from-dir /mnt/usb/db -o /path/to/db
+
+	# Restore database from a snapshot archive.
+	$ litestream restore -from-archive db.gz -o /path/to/db
+
 	# Restore database from latest generation on S3.
 	$ litestream restore -replica s3 /path/to/db
 
 	# Restore database from specific generation on S3.
 	$ litestream restore -replica s3 -generation xxxxxxxx /path/to/db
 
+	# Write the rows of the "users" table as CSV.
+	$ litestream restore -table users -format csv -o users.csv /path/to/db
+
+	# Print the plan for restoring a generation without restoring.
+	$ litestream restore -dry-run -generation xxxxxxxx /path/to/db
+
 `[1:],
 		DefaultConfigPath(),
 	)
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// RetentionRunCommand represents a command to enforce retention on demand.
+type RetentionRunCommand struct{}
+
+// Run executes the command.
+func (c *RetentionRunCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	fs := flag.NewFlagSet("litestream-retention-run", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath)
+	replicaName := fs.String("replica", "", "replica name")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("database path required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	// Load configuration.
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	// Lookup database from configuration file by path.
+	var db *litestream.DB
+	if path, err := expand(fs.Arg(0)); err != nil {
+		return err
+	} else if dbc := config.DBConfig(path); dbc == nil {
+		return fmt.Errorf("database not found in config: %s", path)
+	} else if db, err = newDBFromConfig(&config, dbc); err != nil {
+		return err
+	}
+
+	// Filter by replica, if specified.
+	replicas := db.ReplicaList()
+	if *replicaName != "" {
+		r := db.Replica(*replicaName)
+		if r == nil {
+			return fmt.Errorf("replica %q not found for database %q", *replicaName, db.Path())
+		}
+		replicas = []litestream.Replica{r}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "replica\tgenerations\tsnapshots\twal\tsize")
+	for _, r := range replicas {
+		result, err := r.RunRetention(ctx)
+		if err != nil {
+			w.Flush()
+			return fmt.Errorf("%s: %w", r.Name(), err)
+		}
+
+		generations := "-"
+		if len(result.Generations) > 0 {
+			generations = strings.Join(result.Generations, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n",
+			r.Name(),
+			generations,
+			result.SnapshotN,
+			result.WALN,
+			result.Size,
+		)
+	}
+	return w.Flush()
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *RetentionRunCommand) Usage() {
+	fmt.Printf(`
+The retention-run command deletes snapshots & WAL files outside of each
+replica's retention period and reports the deleted generations, files, and
+bytes reclaimed. It is safe to run while the database is being replicated.
+The current generation of the database is never deleted.
+
+A new snapshot is not created if no snapshots are retained. Retention
+performed by "replicate" creates one instead.
+
+Usage:
+
+	litestream retention-run [arguments] DB_PATH
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-replica NAME
+	    Only enforce retention for a specific replica.
+	    Defaults to all replicas.
+
+Examples:
+
+	# Enforce retention for all replicas of a database.
+	$ litestream retention-run /path/to/db
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// SnapshotCommand represents a command to write a point-in-time archive of a database.
+type SnapshotCommand struct{}
+
+// Run executes the command.
+func (c *SnapshotCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	opt := litestream.NewRestoreOptions()
+
+	fs := flag.NewFlagSet("litestream-snapshot", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath)
+	outputPath := fs.String("o", "", "output path")
+	fs.StringVar(&opt.ReplicaName, "replica", "", "replica name")
+	fs.StringVar(&opt.Generation, "generation", "", "generation name")
+	fs.IntVar(&opt.Index, "index", opt.Index, "wal index")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("database path or replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if *outputPath == "" {
+		return fmt.Errorf("output path required")
+	}
+
+	// Determine replica & generation using the same rules as restore.
+	var r litestream.Replica
+	var rc RestoreCommand
+	if isURL(fs.Arg(0)) {
+		if r, err = rc.loadFromURL(ctx, fs.Arg(0), &opt); err != nil {
+			return err
+		}
+	} else if configPath != "" {
+		if r, err = rc.loadFromConfig(ctx, fs.Arg(0), configPath, &opt); err != nil {
+			return err
+		}
+	} else {
+		return errors.New("config path or replica URL required")
+	}
+
+	if opt.Generation == "" {
+		return fmt.Errorf("no matching backups found")
+	}
+
+	// Write to STDOUT if the output path is "-".
+	var w io.Writer = os.Stdout
+	if *outputPath != "-" {
+		if *outputPath, err = expand(*outputPath); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(*outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := litestream.WriteSnapshotArchive(ctx, r, opt, w); err != nil {
+		return err
+	}
+
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *SnapshotCommand) Usage() {
+	fmt.Printf(`
+The snapshot command restores a database from a replica and writes it as a
+single gzip-compressed archive. The archive is a standalone point-in-time
+backup which can be restored with "restore -from-archive".
+
+Usage:
+
+	litestream snapshot [arguments] DB_PATH
+
+	litestream snapshot [arguments] REPLICA_URL
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-o PATH
+	    Output path of the archive. Use "-" to write to STDOUT.
+	    Required.
+
+	-replica NAME
+	    Snapshot a specific replica.
+	    Defaults to replica with latest data.
+
+	-generation NAME
+	    Snapshot a specific generation.
+	    Defaults to generation with latest data.
+
+	-index NUM
+	    Snapshot up to a specific WAL index (inclusive).
+	    Defaults to use the highest available index.
+
+Examples:
+
+	# Stream the latest backup from S3 to a compressed archive.
+	$ litestream snapshot -o - s3://mybkt/db > db.gz
+
+	# Restore the archive to a new location.
+	$ litestream restore -from-archive db.gz -o /path/to/db
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
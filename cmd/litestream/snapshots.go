@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -21,6 +22,7 @@ func (c *SnapshotsCommand) Run(ctx context.Context, args []string) (err error) {
 	fs := flag.NewFlagSet("litestream-snapshots", flag.ContinueOnError)
 	registerConfigFlag(fs, &configPath)
 	replicaName := fs.String("replica", "", "replica name")
+	jsonOutput := fs.Bool("json", false, "json output")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -74,6 +76,10 @@ func (c *SnapshotsCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	}
 
+	if *jsonOutput {
+		return c.writeJSON(infos)
+	}
+
 	// List all snapshots.
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
 	defer w.Flush()
@@ -92,6 +98,32 @@ func (c *SnapshotsCommand) Run(ctx context.Context, args []string) (err error) {
 	return nil
 }
 
+// writeJSON writes the snapshots to STDOUT as a JSON array.
+func (c *SnapshotsCommand) writeJSON(infos []*litestream.SnapshotInfo) error {
+	type snapshotJSON struct {
+		Replica    string `json:"replica"`
+		Generation string `json:"generation"`
+		Index      int    `json:"index"`
+		Size       int64  `json:"size"`
+		CreatedAt  string `json:"created_at"`
+	}
+
+	a := make([]snapshotJSON, 0, len(infos))
+	for _, info := range infos {
+		a = append(a, snapshotJSON{
+			Replica:    info.Replica,
+			Generation: info.Generation,
+			Index:      info.Index,
+			Size:       info.Size,
+			CreatedAt:  info.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(a)
+}
+
 // Usage prints the help screen to STDOUT.
 func (c *SnapshotsCommand) Usage() {
 	fmt.Printf(`
@@ -112,6 +144,10 @@ Arguments:
 	-replica NAME
 	    Optional, filter by a specific replica.
 
+	-json
+	    Output snapshots as a JSON array of objects with "replica",
+	    "generation", "index", "size" & "created_at" fields.
+
 Examples:
 
 	# List all snapshots for a database.
@@ -123,6 +159,9 @@ Examples:
 	# List all snapshots by replica URL.
 	$ litestream snapshots s3://mybkt/db
 
+	# List the size of each snapshot with jq.
+	$ litestream snapshots -json /path/to/db | jq '.[].size'
+
 `[1:],
 		DefaultConfigPath(),
 	)
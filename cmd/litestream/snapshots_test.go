@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotsCommand_JSON(t *testing.T) {
+	// Ensure each snapshot is written as an object with its fields.
+	t.Run("OK", func(t *testing.T) {
+		db, _, u := MustOpenReplicatedDB(t, 1)
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&SnapshotsCommand{}).Run(context.Background(), []string{"-json", u})
+		})
+		if len(a) != 1 {
+			t.Fatalf("len=%d, want 1: %v", len(a), a)
+		} else if got, want := a[0]["replica"], "file"; got != want {
+			t.Fatalf("replica=%v, want %v", got, want)
+		} else if got, want := a[0]["generation"], pos.Generation; got != want {
+			t.Fatalf("generation=%v, want %v", got, want)
+		} else if got, want := a[0]["index"], float64(0); got != want {
+			t.Fatalf("index=%v, want %v", got, want)
+		} else if size, _ := a[0]["size"].(float64); size <= 0 {
+			t.Fatalf("size=%v, want positive", a[0]["size"])
+		} else if _, err := time.Parse(time.RFC3339, a[0]["created_at"].(string)); err != nil {
+			t.Fatalf("created_at: %s", err)
+		}
+	})
+
+	// Ensure a replica without snapshots is written as an empty array.
+	t.Run("Empty", func(t *testing.T) {
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&SnapshotsCommand{}).Run(context.Background(), []string{"-json", "file://" + filepath.Join(t.TempDir(), "replica")})
+		})
+		if a == nil || len(a) != 0 {
+			t.Fatalf("snapshots=%#v, want empty array", a)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// VerifyCommand represents a command to verify replicas against their database.
+type VerifyCommand struct{}
+
+// Run executes the command.
+func (c *VerifyCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	fs := flag.NewFlagSet("litestream-verify", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath)
+	replicaName := fs.String("replica", "", "replica name")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("database path required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	// Load configuration.
+	config, err := ReadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	// Lookup database from configuration file by path.
+	var db *litestream.DB
+	if path, err := expand(fs.Arg(0)); err != nil {
+		return err
+	} else if dbc := config.DBConfig(path); dbc == nil {
+		return fmt.Errorf("database not found in config: %s", path)
+	} else if db, err = newDBFromConfig(&config, dbc); err != nil {
+		return err
+	}
+
+	// Filter by replica, if specified.
+	if *replicaName != "" {
+		r := db.Replica(*replicaName)
+		if r == nil {
+			return fmt.Errorf("replica %q not found for database %q", *replicaName, db.Path())
+		}
+		db.Replicas = []litestream.Replica{r}
+	}
+
+	// Open the database so replicas sync up to the verified position.
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "replica\tgeneration\tindex\tdb\treplica\tstatus")
+
+	var mismatch error
+	for _, r := range db.ReplicaList() {
+		result, err := litestream.VerifyReplica(ctx, r)
+		var e *litestream.VerifyError
+		if errors.As(err, &e) {
+			mismatch = err
+		} else if err != nil {
+			w.Flush()
+			return fmt.Errorf("%s: %w", r.Name(), err)
+		}
+
+		status := "ok"
+		if !result.Match() {
+			status = "mismatch"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%08x\t%016x\t%016x\t%s\n",
+			r.Name(),
+			result.Generation,
+			result.Index,
+			result.DBChecksum,
+			result.ReplicaChecksum,
+			status,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return mismatch
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *VerifyCommand) Usage() {
+	fmt.Printf(`
+The verify command checkpoints a database, waits for each replica to reach
+the database's position, and restores the replica in memory. It reports the
+generation & WAL index restored and whether the CRC64 of the restored
+database matches the local database.
+
+The command replicates the database while running so it should not be run
+while "replicate" is managing the same database. It exits with a status of 2
+if any replica does not match the database.
+
+Usage:
+
+	litestream verify [arguments] DB_PATH
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-replica NAME
+	    Only verify a specific replica.
+	    Defaults to all replicas.
+
+Examples:
+
+	# Verify all replicas of a database.
+	$ litestream verify /path/to/db
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -22,6 +23,7 @@ func (c *WALCommand) Run(ctx context.Context, args []string) (err error) {
 	registerConfigFlag(fs, &configPath)
 	replicaName := fs.String("replica", "", "replica name")
 	generation := fs.String("generation", "", "generation name")
+	jsonOutput := fs.Bool("json", false, "json output")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -75,16 +77,27 @@ func (c *WALCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	}
 
+	// Filter by generation, if specified.
+	if *generation != "" {
+		other := infos[:0]
+		for _, info := range infos {
+			if info.Generation == *generation {
+				other = append(other, info)
+			}
+		}
+		infos = other
+	}
+
+	if *jsonOutput {
+		return c.writeJSON(infos)
+	}
+
 	// List all WAL files.
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
 	defer w.Flush()
 
 	fmt.Fprintln(w, "replica\tgeneration\tindex\toffset\tsize\tcreated")
 	for _, info := range infos {
-		if *generation != "" && info.Generation != *generation {
-			continue
-		}
-
 		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n",
 			info.Replica,
 			info.Generation,
@@ -98,6 +111,34 @@ func (c *WALCommand) Run(ctx context.Context, args []string) (err error) {
 	return nil
 }
 
+// writeJSON writes the WAL files to STDOUT as a JSON array.
+func (c *WALCommand) writeJSON(infos []*litestream.WALInfo) error {
+	type walJSON struct {
+		Replica    string `json:"replica"`
+		Generation string `json:"generation"`
+		Index      int    `json:"index"`
+		Offset     int64  `json:"offset"`
+		Size       int64  `json:"size"`
+		CreatedAt  string `json:"created_at"`
+	}
+
+	a := make([]walJSON, 0, len(infos))
+	for _, info := range infos {
+		a = append(a, walJSON{
+			Replica:    info.Replica,
+			Generation: info.Generation,
+			Index:      info.Index,
+			Offset:     info.Offset,
+			Size:       info.Size,
+			CreatedAt:  info.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(a)
+}
+
 // Usage prints the help screen to STDOUT.
 func (c *WALCommand) Usage() {
 	fmt.Printf(`
@@ -121,6 +162,10 @@ Arguments:
 	-generation NAME
 	    Optional, filter by a specific generation.
 
+	-json
+	    Output WAL files as a JSON array of objects with "replica",
+	    "generation", "index", "offset", "size" & "created_at" fields.
+
 Examples:
 
 	# List all WAL files for a database.
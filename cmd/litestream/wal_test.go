@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWALCommand_JSON(t *testing.T) {
+	// Ensure each WAL file is written as an object with its fields.
+	t.Run("OK", func(t *testing.T) {
+		db, _, u := MustOpenReplicatedDB(t, 1)
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&WALCommand{}).Run(context.Background(), []string{"-json", u})
+		})
+		if len(a) == 0 {
+			t.Fatal("expected wal files")
+		}
+		for _, m := range a {
+			if got, want := m["replica"], "file"; got != want {
+				t.Fatalf("replica=%v, want %v", got, want)
+			} else if got, want := m["generation"], pos.Generation; got != want {
+				t.Fatalf("generation=%v, want %v", got, want)
+			} else if _, ok := m["index"].(float64); !ok {
+				t.Fatalf("index=%v, want number", m["index"])
+			} else if _, ok := m["offset"].(float64); !ok {
+				t.Fatalf("offset=%v, want number", m["offset"])
+			} else if size, _ := m["size"].(float64); size <= 0 {
+				t.Fatalf("size=%v, want positive", m["size"])
+			} else if _, err := time.Parse(time.RFC3339, m["created_at"].(string)); err != nil {
+				t.Fatalf("created_at: %s", err)
+			}
+		}
+	})
+
+	// Ensure WAL files of other generations are filtered out.
+	t.Run("Generation", func(t *testing.T) {
+		_, _, u := MustOpenReplicatedDB(t, 1)
+
+		var a []map[string]interface{}
+		MustRunJSON(t, &a, func() error {
+			return (&WALCommand{}).Run(context.Background(), []string{"-json", "-generation", "0000000000000000", u})
+		})
+		if a == nil || len(a) != 0 {
+			t.Fatalf("wal=%#v, want empty array", a)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// WatchCommand represents a command to continuously verify that a replica
+// can be restored without writing to it.
+type WatchCommand struct{}
+
+// Run executes the command.
+func (c *WatchCommand) Run(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("litestream-watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", litestream.DefaultWatchInterval, "check interval")
+	once := fs.Bool("once", false, "check once & exit")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	} else if !isURL(fs.Arg(0)) {
+		return fmt.Errorf("invalid replica URL: %s", fs.Arg(0))
+	}
+
+	r, err := NewReplicaFromURL(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	w := litestream.NewWatcher(r)
+	w.Interval = *interval
+	if *once {
+		_, err := w.Check(ctx)
+		return err
+	}
+
+	// Setup signal handler.
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() { <-ch; cancel() }()
+
+	return w.Run(ctx)
+}
+
+// Usage prints the help screen to STDOUT.
+func (c *WatchCommand) Usage() {
+	fmt.Println(`
+The watch command continuously checks that the latest generation of a replica
+can be restored. Each check verifies that no WAL index is missing & restores
+the generation in memory, validating every WAL frame. Missing WAL indices are
+logged as CRITICAL. The command runs until it receives a signal.
+
+The replica is only read so the command can run on a standby host while
+another host replicates the database.
+
+Usage:
+
+	litestream watch [arguments] REPLICA_URL
+
+Arguments:
+
+	-interval DURATION
+	    Time between checks of the replica.
+	    Defaults to 1m.
+
+	-once
+	    Check the replica once & exit with an error if it cannot
+	    be restored.
+
+Examples:
+
+	# Continuously check that a replica on S3 can be restored.
+	$ litestream watch s3://mybkt/db
+
+`[1:])
+}
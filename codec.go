@@ -0,0 +1,200 @@
+package litestream
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Names of the built-in compression codecs.
+const (
+	CompressionNone = "none"
+	CompressionLZ4  = "lz4"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// DefaultCompression is the codec used by replicas if none is specified.
+const DefaultCompression = CompressionLZ4
+
+// Codec compresses & decompresses snapshot & WAL objects. The codec of an
+// object is identified by the extension of its name so objects written with
+// different codecs can be read from the same replica.
+type Codec struct {
+	// Name used to select the codec in the configuration.
+	Name string
+
+	// Extension appended to object names, including the leading dot.
+	// Only the uncompressed codec has a blank extension.
+	Ext string
+
+	// Bytes which begin every compressed stream, if any. Used to detect the
+	// codec of objects whose extension does not match their contents.
+	Magic []byte
+
+	// Returns a writer which compresses into w, or a reader which
+	// decompresses from r, using up to workers goroutines. Codecs which do
+	// not support parallelism ignore workers. Readers which are io.Closers
+	// must be closed to release their resources; closing them does not
+	// close r.
+	NewWriter func(w io.Writer, workers int) (io.WriteCloser, error)
+	NewReader func(r io.Reader, workers int) (io.Reader, error)
+}
+
+var codecs = struct {
+	mu     sync.RWMutex
+	byName map[string]*Codec
+	byExt  map[string]*Codec
+}{
+	byName: make(map[string]*Codec),
+	byExt:  make(map[string]*Codec),
+}
+
+// RegisterCodec makes a codec available to replicas by name & extension.
+// Panics if the codec is invalid or its name or extension is registered.
+func RegisterCodec(c *Codec) {
+	if c == nil || c.Name == "" || c.NewWriter == nil || c.NewReader == nil {
+		panic("litestream: invalid codec")
+	} else if c.Ext != "" && (!strings.HasPrefix(c.Ext, ".") || !isCodecExt(c.Ext[1:])) {
+		panic(fmt.Sprintf("litestream: invalid codec extension: %q", c.Ext))
+	} else if c.Ext == EncryptionExt {
+		panic(fmt.Sprintf("litestream: codec extension reserved for encryption: %q", c.Ext))
+	}
+
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	if _, ok := codecs.byName[c.Name]; ok {
+		panic(fmt.Sprintf("litestream: codec already registered: %q", c.Name))
+	} else if _, ok := codecs.byExt[c.Ext]; ok {
+		panic(fmt.Sprintf("litestream: codec extension already registered: %q", c.Ext))
+	}
+	codecs.byName[c.Name] = c
+	codecs.byExt[c.Ext] = c
+}
+
+// LookupCodec returns the registered codec with the given name.
+// Returns nil if no codec is registered with that name.
+func LookupCodec(name string) *Codec {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	return codecs.byName[name]
+}
+
+// CodecByExt returns the registered codec for an object name extension.
+// Returns nil if no codec is registered for the extension.
+func CodecByExt(ext string) *Codec {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	return codecs.byExt[ext]
+}
+
+// Codecs returns all registered codecs sorted by name.
+func Codecs() []*Codec {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+
+	a := make([]*Codec, 0, len(codecs.byName))
+	for _, c := range codecs.byName {
+		a = append(a, c)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+// isCodecExt returns true if s is a valid extension without the leading dot.
+func isCodecExt(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name: CompressionNone,
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			return r, nil
+		},
+	})
+
+	// Files are lz4 frames of independently compressed blocks so they can
+	// be compressed & decompressed in parallel.
+	RegisterCodec(&Codec{
+		Name:  CompressionLZ4,
+		Ext:   ".lz4",
+		Magic: []byte{0x04, 0x22, 0x4d, 0x18},
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			zw := lz4.NewWriter(w)
+			if err := zw.Apply(lz4.ConcurrencyOption(workers)); err != nil {
+				return nil, err
+			}
+			return zw, nil
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			zr := lz4.NewReader(r)
+			if err := zr.Apply(lz4.ConcurrencyOption(workers)); err != nil {
+				return nil, err
+			}
+			return zr, nil
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:  CompressionGzip,
+		Ext:   ".gz",
+		Magic: []byte{0x1f, 0x8b},
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:  CompressionZstd,
+		Ext:   ".zst",
+		Magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(zstdConcurrency(workers)))
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(zstdConcurrency(workers)))
+			if err != nil {
+				return nil, err
+			}
+
+			// Closing the reader releases the decoder goroutines.
+			return zr.IOReadCloser(), nil
+		},
+	})
+}
+
+// zstdConcurrency returns the zstd concurrency for workers. zstd requires a
+// positive value so non-positive values use all available CPUs, matching lz4.
+func zstdConcurrency(workers int) int {
+	if workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return workers
+}
+
+// nopWriteCloser wraps a writer with a no-op Close.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,178 @@
+package litestream_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func init() {
+	litestream.RegisterCodec(&litestream.Codec{
+		Name: "xor-test",
+		Ext:  ".xor",
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			return &xorWriter{w: w}, nil
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			return &xorReader{r: r}, nil
+		},
+	})
+}
+
+func TestFileReplica_Codec(t *testing.T) {
+	for _, name := range []string{"xor-test", litestream.CompressionGzip, litestream.CompressionZstd, litestream.CompressionNone} {
+		t.Run(name, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			r := NewTestFileReplica(t, db)
+			codec := litestream.LookupCodec(name)
+			r.Codec = codec
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			}
+			MustSyncDBReplica(t, db, r)
+			MustRollWALIndex(t, db, sqldb, r)
+
+			// Ensure the snapshot & closed WAL segment use the codec extension.
+			pos, err := db.Pos()
+			if err != nil {
+				t.Fatal(err)
+			} else if _, err := os.Stat(filepath.Join(r.SnapshotDir(pos.Generation), "00000000"+litestream.SnapshotExt+codec.Ext)); err != nil {
+				t.Fatal(err)
+			} else if _, err := os.Stat(r.WALPath(pos.Generation, pos.Index-1) + codec.Ext); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+				t.Fatalf("restored rows=%d, want %d", got, want)
+			}
+		})
+	}
+
+	// Ensure a replica reads segments written with a previous codec.
+	t.Run("Mixed", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		r.Codec = litestream.LookupCodec("xor-test")
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a replica switched from lz4 to zstd restores segments & snapshots
+	// written with either codec.
+	t.Run("MixedZstd", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Codec = litestream.LookupCodec(litestream.CompressionLZ4)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		r.Codec = litestream.LookupCodec(litestream.CompressionZstd)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.WALPath(pos.Generation, pos.Index-2) + ".lz4"); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.WALPath(pos.Generation, pos.Index-1) + ".zst"); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+
+		// Replace the lz4 snapshot with a zstd snapshot & restore from it.
+		MustWriteSnapshotAt(t, r, pos.Generation, pos.Index)
+		if err := os.Remove(filepath.Join(r.SnapshotDir(pos.Generation), "00000000"+litestream.SnapshotExt+".lz4")); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.SnapshotPath(pos.Generation, pos.Index)); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestLookupCodec(t *testing.T) {
+	for _, name := range []string{litestream.CompressionNone, litestream.CompressionLZ4, litestream.CompressionGzip, litestream.CompressionZstd} {
+		if c := litestream.LookupCodec(name); c == nil {
+			t.Fatalf("codec not registered: %q", name)
+		} else if c != litestream.CodecByExt(c.Ext) {
+			t.Fatalf("codec %q not registered by extension %q", name, c.Ext)
+		}
+	}
+	if c := litestream.LookupCodec("unknown"); c != nil {
+		t.Fatalf("unexpected codec: %q", c.Name)
+	}
+}
+
+// Ensure the zstd reader releases its decoder when closed.
+func TestZstdCodec_Close(t *testing.T) {
+	buf := MustObject(t, litestream.LookupCodec(litestream.CompressionZstd), "SQLite format 3\x00")
+	rd, err := litestream.NewObjectReader(bytes.NewReader(buf), litestream.LookupCodec(litestream.CompressionZstd), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, ok := rd.(io.ReadCloser)
+	if !ok {
+		t.Fatalf("unexpected reader type: %T", rd)
+	} else if b, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(b), "SQLite format 3\x00"; got != want {
+		t.Fatalf("data=%q, want %q", got, want)
+	} else if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := rc.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected closed decoder error, got %v", err)
+	}
+}
+
+// xorWriter is a trivial codec writer which inverts every byte.
+type xorWriter struct{ w io.Writer }
+
+func (w *xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i := range p {
+		buf[i] = ^p[i]
+	}
+	return w.w.Write(buf)
+}
+
+func (w *xorWriter) Close() error { return nil }
+
+// xorReader decodes data written by xorWriter.
+type xorReader struct{ r io.Reader }
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] = ^p[i]
+	}
+	return n, err
+}
@@ -0,0 +1,190 @@
+package litestream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommitTimesExt is the file extension of commit time index files. Each WAL
+// index has a separate commit time index file named after the index.
+const CommitTimesExt = ".commits"
+
+// commitTimeSize is the encoded size of a CommitTime: a big-endian offset
+// followed by a big-endian timestamp in nanoseconds since the Unix epoch.
+const commitTimeSize = 16
+
+// CommitTime records when a committed transaction was copied into the
+// shadow WAL. Offset is the position just after the transaction's commit frame.
+//
+// Commits are timestamped when a sync observes them so the precision of a
+// commit time is limited by how often the database is synced.
+type CommitTime struct {
+	Offset    int64
+	Timestamp time.Time
+}
+
+// CommitTimeReader is implemented by replicas which store commit time
+// indexes. Returns os.ErrNotExist if no index exists for the WAL index.
+type CommitTimeReader interface {
+	CommitTimes(ctx context.Context, generation string, index int) ([]CommitTime, error)
+}
+
+// FormatCommitTimesPath formats a commit time index filename for a WAL index.
+func FormatCommitTimesPath(index int) string {
+	assert(index >= 0, "commit times index must be non-negative")
+	return fmt.Sprintf("%08x%s", index, CommitTimesExt)
+}
+
+// ParseCommitTimesPath returns the WAL index for a commit time index filename.
+func ParseCommitTimesPath(s string) (index int, err error) {
+	a := commitTimesPathRegex.FindStringSubmatch(s)
+	if a == nil {
+		return 0, fmt.Errorf("invalid commit times path: %s", s)
+	}
+
+	i64, _ := strconv.ParseUint(a[1], 16, 64)
+	return int(i64), nil
+}
+
+var commitTimesPathRegex = regexp.MustCompile(`^([0-9a-f]{8})\.commits$`)
+
+// EncodeCommitTimes returns the binary encoding of a commit time index.
+func EncodeCommitTimes(a []CommitTime) []byte {
+	buf := make([]byte, len(a)*commitTimeSize)
+	for i, c := range a {
+		binary.BigEndian.PutUint64(buf[i*commitTimeSize:], uint64(c.Offset))
+		binary.BigEndian.PutUint64(buf[i*commitTimeSize+8:], uint64(c.Timestamp.UnixNano()))
+	}
+	return buf
+}
+
+// DecodeCommitTimes decodes a commit time index. A trailing partial record,
+// such as one left by a crash while appending, is ignored.
+func DecodeCommitTimes(buf []byte) []CommitTime {
+	a := make([]CommitTime, 0, len(buf)/commitTimeSize)
+	for ; len(buf) >= commitTimeSize; buf = buf[commitTimeSize:] {
+		a = append(a, CommitTime{
+			Offset:    int64(binary.BigEndian.Uint64(buf[0:])),
+			Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:]))).UTC(),
+		})
+	}
+	return a
+}
+
+// ReadCommitTimes reads & decodes a commit time index from rd.
+func ReadCommitTimes(rd io.Reader) ([]CommitTime, error) {
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCommitTimes(buf), nil
+}
+
+// ShadowCommitTimesPath returns the path of the commit time index for a
+// shadow WAL index.
+func (db *DB) ShadowCommitTimesPath(generation string, index int) string {
+	return filepath.Join(db.ShadowWALDir(generation), FormatCommitTimesPath(index))
+}
+
+// ShadowCommitTimes returns the commit times recorded for a shadow WAL index
+// at or before offset. Returns os.ErrNotExist if no commit times exist.
+func (db *DB) ShadowCommitTimes(generation string, index int, offset int64) ([]CommitTime, error) {
+	buf, err := ioutil.ReadFile(db.ShadowCommitTimesPath(generation, index))
+	if err != nil {
+		return nil, err
+	}
+
+	a := DecodeCommitTimes(buf)
+	for i, c := range a {
+		if c.Offset > offset {
+			return a[:i], nil
+		}
+	}
+	return a, nil
+}
+
+// appendShadowCommitTimes appends commit times to the index of the shadow WAL
+// at filename. Commits are only recorded from the start of a shadow WAL so an
+// index never omits earlier commits of its WAL.
+func (db *DB) appendShadowCommitTimes(filename string, origSize int64, a []CommitTime) error {
+	if len(a) == 0 {
+		return nil
+	}
+
+	path := strings.TrimSuffix(filename, WALExt) + CommitTimesExt
+	if _, err := os.Stat(path); os.IsNotExist(err) && origSize > WALHeaderSize {
+		return nil // enabled after the shadow wal started
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, db.metaFileMode())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := db.chmodMeta(path); err != nil {
+		return err
+	}
+	_ = os.Chown(path, db.uid, db.gid)
+
+	if _, err := f.Write(EncodeCommitTimes(a)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// commitOffsetAt resolves timestamp to the last commit at or before it using
+// the replica's commit time index. WAL file times are only as precise as the
+// last write to each file so the WAL after maxIndex, the last WAL file last
+// written before timestamp, may also contain earlier commits. Returns false if
+// no commit time index is available or the entire WAL at maxIndex applies.
+func commitOffsetAt(ctx context.Context, r Replica, generation string, maxIndex int, timestamp time.Time) (index int, offset int64, ok bool, err error) {
+	cr, isCommitTimeReader := r.(CommitTimeReader)
+	if !isCommitTimeReader {
+		return 0, 0, false, nil
+	}
+
+	// Use the next WAL file if it starts with a commit before timestamp.
+	if a, err := cr.CommitTimes(ctx, generation, maxIndex+1); err != nil && !os.IsNotExist(err) {
+		return 0, 0, false, err
+	} else if offset := lastCommitOffsetAt(a, timestamp); offset != 0 {
+		return maxIndex + 1, offset, true, nil
+	}
+
+	// Otherwise truncate the last WAL file if it has a commit after timestamp.
+	a, err := cr.CommitTimes(ctx, generation, maxIndex)
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	} else if len(a) == 0 || !a[len(a)-1].Timestamp.After(timestamp) {
+		return 0, 0, false, nil
+	}
+
+	if offset = lastCommitOffsetAt(a, timestamp); offset == 0 {
+		offset = WALHeaderSize // no commits before timestamp
+	}
+	return maxIndex, offset, true, nil
+}
+
+// lastCommitOffsetAt returns the offset of the last commit at or before
+// timestamp. Returns zero if no commit is at or before timestamp.
+func lastCommitOffsetAt(a []CommitTime, timestamp time.Time) (offset int64) {
+	for _, c := range a {
+		if c.Timestamp.After(timestamp) {
+			break
+		}
+		offset = c.Offset
+	}
+	return offset
+}
@@ -0,0 +1,84 @@
+package litestream_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreReplica_CommitTimeIndex(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	db.CommitTimeIndex = true
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Sync several commits into the same WAL file & record the time & row
+	// count between each one. Then roll over & repeat in the next WAL file.
+	type checkpoint struct {
+		t time.Time
+		n int
+	}
+	var checkpoints []checkpoint
+	commit := func() {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		checkpoints = append(checkpoints, checkpoint{t: time.Now(), n: MustCountRows(t, db.Path(), "foo")})
+	}
+
+	commit()
+	commit()
+	commit()
+	MustRollWALIndex(t, db, sqldb, r)
+	commit()
+	commit()
+
+	pos := r.LastPos()
+	if pos.Index == 0 {
+		t.Fatal("expected multiple wal indices")
+	}
+
+	for i, c := range checkpoints {
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation, opt.Timestamp = pos.Generation, c.t
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), c.n; got != want {
+			t.Fatalf("%d. restored rows=%d, want %d", i, got, want)
+		}
+	}
+
+	// Ensure the replica stores the same commit times as the database.
+	if a, err := r.CommitTimes(context.Background(), pos.Generation, pos.Index); err != nil {
+		t.Fatal(err)
+	} else if len(a) == 0 {
+		t.Fatal("expected commit times")
+	} else if other, err := db.ShadowCommitTimes(pos.Generation, pos.Index, pos.Offset); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, other) {
+		t.Fatalf("commit times=%v, want %v", a, other)
+	}
+}
+
+func TestParseCommitTimesPath(t *testing.T) {
+	if index, err := litestream.ParseCommitTimesPath(litestream.FormatCommitTimesPath(1000)); err != nil {
+		t.Fatal(err)
+	} else if got, want := index, 1000; got != want {
+		t.Fatalf("index=%d, want %d", got, want)
+	}
+	if _, err := litestream.ParseCommitTimesPath("000003e8.wal"); err == nil {
+		t.Fatal("expected error")
+	}
+}
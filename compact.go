@@ -0,0 +1,58 @@
+package litestream
+
+import (
+	"sort"
+)
+
+// CompactableWAL groups the WAL segment names or keys of one generation by
+// index & returns the indexes which have at least minN segments, with their
+// names in offset order. Names which are not WAL segments are ignored. The
+// highest index is never returned as it may still be written. Returns nil if
+// minN is less than two.
+//
+// Replicas merge the segments of each returned index into a single segment
+// at offset zero & then delete the remaining segments. Readers skip segments
+// already covered by a merged segment so the WAL file can be read while it is
+// compacted.
+func CompactableWAL(names []string, minN int) map[int][]string {
+	if minN < 2 {
+		return nil
+	}
+
+	type segment struct {
+		name   string
+		offset int64
+	}
+
+	m := make(map[int][]segment)
+	maxIndex := -1
+	for _, name := range names {
+		index, offset, _, err := ParseWALPath(name)
+		if err != nil {
+			continue
+		}
+		m[index] = append(m[index], segment{name: name, offset: offset})
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+
+	var indexes map[int][]string
+	for index, segments := range m {
+		if index == maxIndex || len(segments) < minN {
+			continue
+		}
+
+		sort.SliceStable(segments, func(i, j int) bool { return segments[i].offset < segments[j].offset })
+		a := make([]string, len(segments))
+		for i := range segments {
+			a[i] = segments[i].name
+		}
+
+		if indexes == nil {
+			indexes = make(map[int][]string)
+		}
+		indexes[index] = a
+	}
+	return indexes
+}
@@ -0,0 +1,41 @@
+package litestream_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestCompactableWAL(t *testing.T) {
+	names := []string{
+		"00000000_00000040.wal.lz4",
+		"00000000_00000000.wal.lz4",
+		"00000000_00000080.wal.lz4",
+		"00000001_00000000.wal.lz4",
+		"00000001_00000040.wal.lz4",
+		"00000002_00000000.wal.lz4",
+		"00000002_00000040.wal.lz4",
+		"00000002_00000080.wal.lz4",
+		"00000000.snapshot.lz4",
+	}
+
+	// Ensure indexes with enough segments are returned in offset order &
+	// the latest index is skipped.
+	t.Run("OK", func(t *testing.T) {
+		got := litestream.CompactableWAL(names, 3)
+		want := map[int][]string{
+			0: {"00000000_00000000.wal.lz4", "00000000_00000040.wal.lz4", "00000000_00000080.wal.lz4"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("CompactableWAL=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure nothing is returned if compaction is disabled.
+	t.Run("Disabled", func(t *testing.T) {
+		if got := litestream.CompactableWAL(names, 0); got != nil {
+			t.Fatalf("unexpected result: %v", got)
+		}
+	})
+}
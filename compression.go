@@ -0,0 +1,204 @@
+package litestream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default compression ratio warning settings.
+const (
+	DefaultCompressionWarnRatio    = 1.25
+	DefaultCompressionWarnMinBytes = 1 << 20
+	DefaultCompressionWarnInterval = 1 * time.Hour
+)
+
+// CompressionStats tracks the average compression ratio of the segments
+// written by a replica. A warning is logged periodically if the ratio is poor
+// as the data is likely incompressible and compression only costs CPU.
+type CompressionStats struct {
+	mu       sync.Mutex
+	db       *DB       // receives lifetime totals, if set
+	prefix   string    // log prefix
+	in, out  int64     // uncompressed & compressed bytes
+	warnedAt time.Time // last warning time
+
+	inCounter  prometheus.Counter
+	outCounter prometheus.Counter
+	ratioGauge prometheus.Gauge
+
+	// Ratio of uncompressed to compressed bytes below which compression
+	// is considered poor.
+	WarnRatio float64
+
+	// Minimum number of uncompressed bytes before the ratio is evaluated.
+	WarnMinBytes int64
+
+	// Minimum time between warnings.
+	WarnInterval time.Duration
+}
+
+// NewCompressionStats returns a new instance of CompressionStats for the
+// replica with the given name. Bytes are added to the lifetime totals of db,
+// if not nil.
+func NewCompressionStats(db *DB, name string) *CompressionStats {
+	var dbPath string
+	if db != nil {
+		dbPath = db.Path()
+	}
+
+	return &CompressionStats{
+		db:         db,
+		prefix:     dbPath + "(" + name + ")",
+		inCounter:  internal.ReplicaCompressionInputBytesCounterVec.WithLabelValues(dbPath, name),
+		outCounter: internal.ReplicaCompressionOutputBytesCounterVec.WithLabelValues(dbPath, name),
+		ratioGauge: internal.ReplicaCompressionRatioGaugeVec.WithLabelValues(dbPath, name),
+
+		WarnRatio:    DefaultCompressionWarnRatio,
+		WarnMinBytes: DefaultCompressionWarnMinBytes,
+		WarnInterval: DefaultCompressionWarnInterval,
+	}
+}
+
+// Add records a segment which compressed in bytes into out bytes. Logs a
+// warning if the average ratio is poor & no warning was logged recently.
+func (s *CompressionStats) Add(in, out int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.in, s.out = s.in+in, s.out+out
+	s.inCounter.Add(float64(in))
+	s.outCounter.Add(float64(out))
+	s.ratioGauge.Set(s.ratio())
+
+	if s.db != nil {
+		if err := s.db.addCompressionTotals(in, out); err != nil {
+			log.Printf("%s: cannot persist compression totals: %s", s.prefix, err)
+		}
+	}
+
+	if !s.poor() || (!s.warnedAt.IsZero() && time.Since(s.warnedAt) < s.WarnInterval) {
+		return
+	}
+	s.warnedAt = time.Now()
+	log.Printf("%s: poor compression ratio: %.2f (%d => %d bytes), data may be incompressible; consider disabling compression to save cpu", s.prefix, s.ratio(), s.in, s.out)
+}
+
+// Ratio returns the average ratio of uncompressed to compressed bytes.
+// Returns zero if no bytes have been compressed.
+func (s *CompressionStats) Ratio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ratio()
+}
+
+func (s *CompressionStats) ratio() float64 {
+	if s.out == 0 {
+		return 0
+	}
+	return float64(s.in) / float64(s.out)
+}
+
+// Poor returns true if enough bytes have been compressed to evaluate the
+// ratio and the average ratio is below WarnRatio.
+func (s *CompressionStats) Poor() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.poor()
+}
+
+func (s *CompressionStats) poor() bool {
+	return s.in >= s.WarnMinBytes && s.out > 0 && s.ratio() < s.WarnRatio
+}
+
+// CompressionTotals is the lifetime number of bytes compressed by all replicas
+// of a database. Totals are persisted in the metadata directory so they
+// survive restarts.
+type CompressionTotals struct {
+	RawBytes        int64 `json:"raw_bytes"`        // uncompressed bytes
+	CompressedBytes int64 `json:"compressed_bytes"` // compressed bytes
+}
+
+// SavedBytes returns the number of bytes saved by compression. Negative if
+// compression increased the size of the data.
+func (t CompressionTotals) SavedBytes() int64 {
+	return t.RawBytes - t.CompressedBytes
+}
+
+// ReadCompressionTotals reads totals persisted at filename. Returns zero
+// totals if the file does not exist.
+func ReadCompressionTotals(filename string) (CompressionTotals, error) {
+	var t CompressionTotals
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	} else if err := json.Unmarshal(buf, &t); err != nil {
+		return t, fmt.Errorf("cannot parse compression totals: %w", err)
+	}
+	return t, nil
+}
+
+// CompressionTotalsPath returns the path of the persisted compression totals.
+func (db *DB) CompressionTotalsPath() string {
+	return filepath.Join(db.MetaPath(), "compression")
+}
+
+// CompressionTotals returns the lifetime compression totals of the database.
+func (db *DB) CompressionTotals() CompressionTotals {
+	db.compressionMu.Lock()
+	defer db.compressionMu.Unlock()
+	return db.compressionTotals
+}
+
+// loadCompressionTotals reads the persisted totals into the database.
+func (db *DB) loadCompressionTotals() error {
+	t, err := ReadCompressionTotals(db.CompressionTotalsPath())
+	if err != nil {
+		return err
+	}
+
+	db.compressionMu.Lock()
+	defer db.compressionMu.Unlock()
+	db.compressionTotals = t
+	db.compressionInCounter.Add(float64(t.RawBytes))
+	db.compressionOutCounter.Add(float64(t.CompressedBytes))
+	return nil
+}
+
+// addCompressionTotals adds raw bytes compressed into compressed bytes to the
+// lifetime totals & atomically persists the new totals.
+func (db *DB) addCompressionTotals(raw, compressed int64) error {
+	db.compressionMu.Lock()
+	defer db.compressionMu.Unlock()
+
+	db.compressionTotals.RawBytes += raw
+	db.compressionTotals.CompressedBytes += compressed
+	db.compressionInCounter.Add(float64(raw))
+	db.compressionOutCounter.Add(float64(compressed))
+
+	buf, err := json.Marshal(db.compressionTotals)
+	if err != nil {
+		return err
+	}
+
+	filename := db.CompressionTotalsPath()
+	if err := db.mkdirMeta(filepath.Dir(filename)); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(filename+".tmp", buf, db.metaFileMode()); err != nil {
+		return err
+	} else if err := db.chmodMeta(filename + ".tmp"); err != nil {
+		return err
+	}
+	_ = os.Chown(filename+".tmp", db.uid, db.gid)
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,80 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/benbjohnson/litestream/internal"
+)
+
+// VerifyWALContinuity checks that the replica's WAL indices for generation
+// form a contiguous sequence from the earliest snapshot index to the latest
+// uploaded WAL index. Returns an error wrapping ErrWALGap at the first
+// missing index as a restore past that index would fail.
+func VerifyWALContinuity(ctx context.Context, r Replica, generation string) error {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+
+	// Determine the base index of the generation from its earliest snapshot.
+	minIndex := -1
+	for _, info := range snapshots {
+		if info.Generation == generation && (minIndex == -1 || info.Index < minIndex) {
+			minIndex = info.Index
+		}
+	}
+	if minIndex == -1 {
+		return nil // no snapshot yet, nothing to verify
+	}
+
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return fmt.Errorf("wals: %w", err)
+	}
+
+	// Collect the set of WAL indices available after the base index.
+	maxIndex := -1
+	indices := make(map[int]struct{})
+	for _, info := range wals {
+		if info.Generation != generation || info.Index < minIndex {
+			continue
+		}
+		indices[info.Index] = struct{}{}
+		if info.Index > maxIndex {
+			maxIndex = info.Index
+		}
+	}
+
+	for index := minIndex; index <= maxIndex; index++ {
+		if _, ok := indices[index]; !ok {
+			return fmt.Errorf("%w: generation=%s index=%08x range=%08x-%08x", ErrWALGap, generation, index, minIndex, maxIndex)
+		}
+	}
+	return nil
+}
+
+// CheckWALContinuity verifies WAL continuity for the current generation of
+// the replica's database. Gaps are reported as critical in the log & recorded
+// in the replica's wal_gap_total metric.
+func CheckWALContinuity(ctx context.Context, r Replica) error {
+	db := r.DB()
+
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if generation == "" {
+		return nil // no active generation
+	}
+
+	if err := VerifyWALContinuity(ctx, r, generation); errors.Is(err, ErrWALGap) {
+		internal.ReplicaWALGapTotalCounterVec.WithLabelValues(db.Path(), r.Name()).Inc()
+		log.Printf("%s(%s): CRITICAL: %s", db.Path(), r.Name(), err)
+		return err
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
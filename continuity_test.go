@@ -0,0 +1,98 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestVerifyWALContinuity(t *testing.T) {
+	// Ensure a contiguous sequence of indices from the base snapshot passes.
+	t.Run("OK", func(t *testing.T) {
+		r := &mockReplica{
+			snapshots: []*litestream.SnapshotInfo{{Generation: "0000000000000000", Index: 2}},
+			wals: []*litestream.WALInfo{
+				{Generation: "0000000000000000", Index: 1}, // before base, ignored
+				{Generation: "0000000000000000", Index: 2},
+				{Generation: "0000000000000000", Index: 3, Offset: 0},
+				{Generation: "0000000000000000", Index: 3, Offset: 4152},
+				{Generation: "0000000000000000", Index: 4},
+				{Generation: "0000000000000001", Index: 9}, // other generation
+			},
+		}
+		if err := litestream.VerifyWALContinuity(context.Background(), r, "0000000000000000"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure a missing index between the base snapshot & latest WAL is detected.
+	t.Run("ErrWALGap", func(t *testing.T) {
+		r := &mockReplica{
+			snapshots: []*litestream.SnapshotInfo{{Generation: "0000000000000000", Index: 2}},
+			wals: []*litestream.WALInfo{
+				{Generation: "0000000000000000", Index: 2},
+				{Generation: "0000000000000000", Index: 4},
+			},
+		}
+		if err := litestream.VerifyWALContinuity(context.Background(), r, "0000000000000000"); !errors.Is(err, litestream.ErrWALGap) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := err.Error(), "wal index gap: generation=0000000000000000 index=00000003 range=00000002-00000004"; got != want {
+			t.Fatalf("error=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure a generation without a snapshot is not reported.
+	t.Run("NoSnapshots", func(t *testing.T) {
+		r := &mockReplica{
+			wals: []*litestream.WALInfo{{Generation: "0000000000000000", Index: 4}},
+		}
+		if err := litestream.VerifyWALContinuity(context.Background(), r, "0000000000000000"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCheckWALContinuity(t *testing.T) {
+	// Ensure a WAL file dropped from a file replica is detected.
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+	MustRollWALIndex(t, db, sqldb, r)
+	MustRollWALIndex(t, db, sqldb, r)
+
+	if err := litestream.CheckWALContinuity(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	MustRemoveWAL(t, r, pos.Generation, pos.Index-1)
+
+	if err := litestream.CheckWALContinuity(context.Background(), r); !errors.Is(err, litestream.ErrWALGap) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// mockReplica is a replica which returns a fixed list of snapshots & WALs.
+type mockReplica struct {
+	litestream.Replica
+	snapshots []*litestream.SnapshotInfo
+	wals      []*litestream.WALInfo
+}
+
+func (r *mockReplica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, error) {
+	return r.snapshots, nil
+}
+
+func (r *mockReplica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
+	return r.wals, nil
+}
@@ -0,0 +1,251 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+)
+
+// ReplicaWriter is implemented by replicas which can store the files of
+// generations copied from another replica. Snapshot & WAL data is read
+// uncompressed, as returned by SnapshotReader & WALReader, and is stored with
+// the replica's own codec. If createdAt is not zero, replicas which can set
+// the modification time of their files set it so restores by timestamp
+// choose the same files as the source replica.
+type ReplicaWriter interface {
+	// Writes the snapshot of generation at index from rd.
+	WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error
+
+	// Writes the entire WAL file of generation at index from rd.
+	WriteWAL(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error
+
+	// Writes the commit time index of the WAL file of generation at index.
+	WriteCommitTimes(ctx context.Context, generation string, index int, a []CommitTime) error
+}
+
+// CopyOptions represents options for copying a replica with CopyReplica.
+type CopyOptions struct {
+	// Generation to copy. If blank, all generations are copied.
+	Generation string
+
+	// Logger used to report each copied & skipped file. Nothing is logged if nil.
+	Logger *log.Logger
+}
+
+// CopyResult summarizes the files copied by CopyReplica.
+type CopyResult struct {
+	Generations []string // generations copied
+	SnapshotN   int      // number of snapshot files copied
+	WALN        int      // number of WAL files copied
+	SkippedN    int      // number of files already in the destination
+	Size        int64    // total uncompressed bytes copied
+}
+
+// CopyReplica copies the snapshots, WAL files & commit time indexes of the
+// generations of src to dst with the same generation names & indexes so
+// restores from dst are identical to restores from src.
+//
+// Snapshots & WAL files already in dst are skipped so an interrupted copy can
+// be resumed, except the last WAL file of each generation which is copied
+// again in case it has grown. Each copied file is read back from dst and its
+// size & checksum are compared with the file read from src. Returns an error
+// if dst does not implement ReplicaWriter. The destination should not be
+// replicated to during the copy.
+func CopyReplica(ctx context.Context, src, dst Replica, opt CopyOptions) (result CopyResult, err error) {
+	w, ok := dst.(ReplicaWriter)
+	if !ok {
+		return result, fmt.Errorf("cannot copy to %s replica", dst.Type())
+	}
+
+	logger := opt.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	generations, err := src.Generations(ctx)
+	if err != nil {
+		return result, fmt.Errorf("cannot list source generations: %w", err)
+	} else if opt.Generation != "" {
+		generations = filterGeneration(generations, opt.Generation)
+		if len(generations) == 0 {
+			return result, fmt.Errorf("generation not found: %s", opt.Generation)
+		}
+	}
+
+	// Determine the files of each generation in both replicas.
+	srcSnapshots, srcWALs, err := replicaFiles(ctx, src)
+	if err != nil {
+		return result, fmt.Errorf("cannot list source files: %w", err)
+	}
+	dstSnapshots, dstWALs, err := replicaFiles(ctx, dst)
+	if err != nil {
+		return result, fmt.Errorf("cannot list destination files: %w", err)
+	}
+
+	for _, generation := range generations {
+		for _, snapshot := range sortedReplicaFiles(srcSnapshots[generation]) {
+			if _, ok := dstSnapshots[generation][snapshot.index]; ok {
+				logger.Printf("%s: skipping snapshot %s/%08x, already copied", dst.Name(), generation, snapshot.index)
+				result.SkippedN++
+				continue
+			}
+
+			n, err := copyReplicaFile(ctx, src, dst, generation, snapshot.index, func(rd io.Reader) error {
+				return w.WriteSnapshot(ctx, generation, snapshot.index, rd, snapshot.createdAt)
+			}, Replica.SnapshotReader)
+			if err != nil {
+				return result, fmt.Errorf("cannot copy snapshot %s/%08x: %w", generation, snapshot.index, err)
+			}
+			logger.Printf("%s: copied snapshot %s/%08x, size=%d", dst.Name(), generation, snapshot.index, n)
+			result.SnapshotN++
+			result.Size += n
+		}
+
+		wals := sortedReplicaFiles(srcWALs[generation])
+		for i, wal := range wals {
+			if _, ok := dstWALs[generation][wal.index]; ok && i < len(wals)-1 {
+				logger.Printf("%s: skipping wal %s/%08x, already copied", dst.Name(), generation, wal.index)
+				result.SkippedN++
+				continue
+			}
+
+			// Copy commit times first so a resumed copy rewrites them if
+			// the WAL file was not copied.
+			if err := copyCommitTimes(ctx, src, w, generation, wal.index); err != nil {
+				return result, fmt.Errorf("cannot copy commit times %s/%08x: %w", generation, wal.index, err)
+			}
+
+			n, err := copyReplicaFile(ctx, src, dst, generation, wal.index, func(rd io.Reader) error {
+				return w.WriteWAL(ctx, generation, wal.index, rd, wal.createdAt)
+			}, Replica.WALReader)
+			if err != nil {
+				return result, fmt.Errorf("cannot copy wal %s/%08x: %w", generation, wal.index, err)
+			}
+			logger.Printf("%s: copied wal %s/%08x, size=%d", dst.Name(), generation, wal.index, n)
+			result.WALN++
+			result.Size += n
+		}
+
+		result.Generations = append(result.Generations, generation)
+	}
+
+	return result, nil
+}
+
+// replicaFile is a snapshot or an entire WAL file of a replica.
+type replicaFile struct {
+	index     int
+	createdAt time.Time
+}
+
+// replicaFiles returns the snapshots & WAL files of each generation of r by
+// index. WAL files stored as multiple segments are returned once with the
+// time of their latest segment.
+func replicaFiles(ctx context.Context, r Replica) (snapshots, wals map[string]map[int]replicaFile, err error) {
+	snapshotInfos, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	walInfos, err := r.WALs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	add := func(m map[string]map[int]replicaFile, generation string, index int, createdAt time.Time) {
+		if m[generation] == nil {
+			m[generation] = make(map[int]replicaFile)
+		}
+		if f, ok := m[generation][index]; !ok || createdAt.After(f.createdAt) {
+			m[generation][index] = replicaFile{index: index, createdAt: createdAt}
+		}
+	}
+
+	snapshots, wals = make(map[string]map[int]replicaFile), make(map[string]map[int]replicaFile)
+	for _, info := range snapshotInfos {
+		add(snapshots, info.Generation, info.Index, info.CreatedAt)
+	}
+	for _, info := range walInfos {
+		add(wals, info.Generation, info.Index, info.CreatedAt)
+	}
+	return snapshots, wals, nil
+}
+
+// sortedReplicaFiles returns the files in m sorted by index.
+func sortedReplicaFiles(m map[int]replicaFile) []replicaFile {
+	a := make([]replicaFile, 0, len(m))
+	for _, f := range m {
+		a = append(a, f)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].index < a[j].index })
+	return a
+}
+
+// copyReplicaFile writes the file at index of generation read from src with
+// write, then reads it back from dst & verifies it has the same size &
+// checksum. Returns the uncompressed size of the file.
+func copyReplicaFile(ctx context.Context, src, dst Replica, generation string, index int, write func(io.Reader) error, open func(Replica, context.Context, string, int) (io.ReadCloser, error)) (int64, error) {
+	rd, err := open(src, ctx, generation, index)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	cw := NewChecksumWriter()
+	cr := internal.NewReadCounter(io.TeeReader(rd, cw))
+	if err := write(cr); err != nil {
+		return 0, err
+	} else if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return 0, err // read rest of source so it is verified in full
+	}
+
+	// Verify the file as it is read by restores of the destination.
+	other, err := open(dst, ctx, generation, index)
+	if err != nil {
+		return 0, fmt.Errorf("cannot verify: %w", err)
+	}
+	defer other.Close()
+
+	ocw := NewChecksumWriter()
+	if n, err := io.Copy(ocw, other); err != nil {
+		return 0, fmt.Errorf("cannot verify: %w", err)
+	} else if n != cr.N() {
+		return 0, fmt.Errorf("cannot verify: size %d, expected %d", n, cr.N())
+	} else if ocw.Checksum() != cw.Checksum() {
+		return 0, fmt.Errorf("cannot verify: %w", ErrChecksumMismatch)
+	}
+	return cr.N(), nil
+}
+
+// copyCommitTimes copies the commit time index of the WAL file at index of
+// generation from src to dst. No-op if src has no commit time index for it.
+func copyCommitTimes(ctx context.Context, src Replica, dst ReplicaWriter, generation string, index int) error {
+	cr, ok := src.(CommitTimeReader)
+	if !ok {
+		return nil
+	}
+
+	a, err := cr.CommitTimes(ctx, generation, index)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return dst.WriteCommitTimes(ctx, generation, index, a)
+}
+
+// filterGeneration returns generation if it exists in generations.
+func filterGeneration(generations []string, generation string) []string {
+	for _, g := range generations {
+		if g == generation {
+			return []string{generation}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package litestream_test
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestCopyReplica(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	db.CommitTimeIndex = true
+	src := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, src)
+	MustRollWALIndex(t, db, sqldb, src)
+	pos := src.LastPos()
+
+	// Ensure every file is copied & the destination restores identically.
+	dst := litestream.NewFileReplica(nil, "dst", t.TempDir())
+	result, err := litestream.CopyReplica(context.Background(), src, dst, litestream.CopyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := result.Generations, []string{pos.Generation}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("generations=%v, want %v", got, want)
+	} else if got, want := result.SnapshotN, 1; got != want {
+		t.Fatalf("SnapshotN=%d, want %d", got, want)
+	} else if got, want := result.WALN, pos.Index+1; got != want {
+		t.Fatalf("WALN=%d, want %d", got, want)
+	} else if got, want := MustRestoreRowCount(t, dst, pos.Generation), MustRestoreRowCount(t, src, pos.Generation); got != want {
+		t.Fatalf("rows=%d, want %d", got, want)
+	}
+
+	// Ensure file times & commit times are preserved.
+	srcSnapshots, err := src.Snapshots(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstSnapshots, err := dst.Snapshots(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := dstSnapshots[0].CreatedAt, srcSnapshots[0].CreatedAt; !got.Equal(want) {
+		t.Fatalf("CreatedAt=%s, want %s", got, want)
+	}
+	if a, err := dst.CommitTimes(context.Background(), pos.Generation, 0); err != nil {
+		t.Fatal(err)
+	} else if b, err := src.CommitTimes(context.Background(), pos.Generation, 0); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, b) {
+		t.Fatalf("commit times=%v, want %v", a, b)
+	}
+
+	// Ensure a second copy skips all files except the last WAL file.
+	if result, err = litestream.CopyReplica(context.Background(), src, dst, litestream.CopyOptions{}); err != nil {
+		t.Fatal(err)
+	} else if result.SnapshotN != 0 || result.WALN != 1 {
+		t.Fatalf("SnapshotN=%d WALN=%d, want 0 & 1", result.SnapshotN, result.WALN)
+	} else if got, want := result.SkippedN, 1+pos.Index; got != want {
+		t.Fatalf("SkippedN=%d, want %d", got, want)
+	}
+
+	// Ensure a missing generation is reported.
+	if _, err := litestream.CopyReplica(context.Background(), src, dst, litestream.CopyOptions{Generation: "0000000000000000"}); err == nil || err.Error() != "generation not found: 0000000000000000" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ensure a truncated copy fails verification.
+	other := &truncatingReplica{FileReplica: litestream.NewFileReplica(nil, "other", t.TempDir())}
+	if _, err := litestream.CopyReplica(context.Background(), src, other, litestream.CopyOptions{}); err == nil || !strings.Contains(err.Error(), "cannot verify: size") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// truncatingReplica is a file replica which stores only the start of snapshots.
+type truncatingReplica struct {
+	*litestream.FileReplica
+}
+
+func (r *truncatingReplica) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error {
+	return r.FileReplica.WriteSnapshot(ctx, generation, index, io.LimitReader(rd, 512), createdAt)
+}
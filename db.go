@@ -1,6 +1,7 @@
 package litestream
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"database/sql"
@@ -8,6 +9,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc64"
 	"io"
 	"io/ioutil"
@@ -28,9 +30,19 @@ import (
 // Default DB settings.
 const (
 	DefaultMonitorInterval    = 1 * time.Second
+	DefaultPriorityInterval   = 100 * time.Millisecond
 	DefaultCheckpointInterval = 1 * time.Minute
 	DefaultMinCheckpointPageN = 1000
 	DefaultMaxCheckpointPageN = 10000
+	DefaultCheckpointMode     = CheckpointModePassive
+	DefaultIntegrityHash      = IntegrityHashCRC64
+	DefaultGenerationRetryN   = 3
+)
+
+// Default restore settings.
+const (
+	DefaultRestoreWALRetryN     = 3
+	DefaultRestoreWALRetryDelay = 1 * time.Second
 )
 
 // MaxIndex is the maximum possible WAL index.
@@ -40,6 +52,15 @@ const MaxIndex = 0x7FFFFFFF
 // BusyTimeout is the timeout to wait for EBUSY from SQLite.
 const BusyTimeout = 1 * time.Second
 
+// ChecksumBufferSize is the size of the buffer used to stream a database file
+// when computing its checksum. Memory usage is bounded by this size
+// regardless of the size of the database.
+const ChecksumBufferSize = 1 << 20
+
+// maxIntegrityProblems is the number of problems reported in the error when a
+// restored database fails validation.
+const maxIntegrityProblems = 5
+
 // DB represents a managed instance of a SQLite database in the file system.
 type DB struct {
 	mu       sync.RWMutex
@@ -49,6 +70,13 @@ type DB struct {
 	pageSize int           // page size, in bytes
 	notify   chan struct{} // closes on WAL change
 
+	priority       priorityState // wal frames checked for priority tables
+	priorityNotify chan struct{} // closes on priority table change
+
+	schema           schemaState      // schema versions as of last sync
+	snapshotRequest  snapshotRequest  // latest snapshot requested of replicas
+	snapshotSchedule snapshotSchedule // wal copied since latest snapshot
+
 	uid, gid       int // db user/group obtained on init
 	mode           os.FileMode
 	diruid, dirgid int // db parent user/group obtained on init
@@ -58,6 +86,36 @@ type DB struct {
 	cancel func()
 	wg     sync.WaitGroup
 
+	maintenanceMu     sync.Mutex
+	maintenancePaused bool // true while inside a maintenance window
+
+	pauseMu sync.Mutex
+	pause   pauseState // replication paused by Pause
+
+	uninitialized bool // true while waiting for a valid database header
+
+	fsync fsyncState // durable shadow WAL position when fsyncs are batched
+
+	checkpointBusyN int // consecutive busy checkpoints
+
+	checkpointMu sync.Mutex // serializes checkpoints
+	checkpointCh chan int   // requests a background checkpoint through a frame
+	backfilled   bool       // true if a background checkpoint copied all frames
+
+	compressionMu     sync.Mutex
+	compressionTotals CompressionTotals // lifetime bytes compressed by replicas
+
+	walCache shadowWALCache // shadow WAL bytes shared between replicas
+	pages    pageLogState   // pages written since each replica's last snapshot
+
+	lagMu      sync.Mutex
+	lagPending map[string]time.Time // oldest unreplicated change, by replica name
+
+	replicasMu sync.RWMutex // guards Replicas once the database is open
+
+	statusMu      sync.Mutex
+	replicaStates map[string]replicaState // last sync & snapshot, by replica name
+
 	// Metrics
 	dbSizeGauge                 prometheus.Gauge
 	walSizeGauge                prometheus.Gauge
@@ -66,7 +124,13 @@ type DB struct {
 	shadowWALSizeGauge          prometheus.Gauge
 	syncNCounter                prometheus.Counter
 	syncErrorNCounter           prometheus.Counter
+	uninitializedNCounter       prometheus.Counter
+	fsyncNCounter               prometheus.Counter
+	lockDiagnosticNCounter      prometheus.Counter
+	tornFrameNCounter           prometheus.Counter
 	syncSecondsCounter          prometheus.Counter
+	compressionInCounter        prometheus.Counter
+	compressionOutCounter       prometheus.Counter
 	checkpointNCounterVec       *prometheus.CounterVec
 	checkpointErrorNCounterVec  *prometheus.CounterVec
 	checkpointSecondsCounterVec *prometheus.CounterVec
@@ -89,9 +153,141 @@ type DB struct {
 	// better precision.
 	CheckpointInterval time.Duration
 
+	// Checkpoint mode used when the WAL exceeds the minimum threshold or when
+	// the checkpoint interval has passed. Forced checkpoints at the maximum
+	// threshold always restart the WAL so they use "RESTART" unless this is
+	// set to "TRUNCATE".
+	CheckpointMode string
+
+	// Number of consecutive busy checkpoints before the lock state & the
+	// processes holding the database files are logged. A checkpoint is busy
+	// if it cannot run or a reader prevents some frames from being copied.
+	// OnLockDiagnostic, if set, is also called with the diagnostic.
+	CheckpointBusyN  int
+	OnLockDiagnostic func(*LockDiagnostic)
+
+	// Called after a replica writes a snapshot & after a replica writes the
+	// first snapshot of a new generation. Handlers are called in a separate
+	// goroutine so a slow handler does not delay replication. Handlers may
+	// run concurrently & a panic in a handler is recovered & logged.
+	OnSnapshot   func(SnapshotInfo)
+	OnGeneration func(replica, generation string)
+
+	// If true, passive checkpoints copy the WAL into the database in a
+	// separate goroutine so new frames can be captured into the shadow WAL
+	// while the checkpoint runs. The WAL is restarted by the next sync once
+	// all frames are copied. Forced & schema change checkpoints always run
+	// inline. Must be set before calling Open().
+	AsyncCheckpoint bool
+
+	// Policy applied when the real WAL is restarted by another process before
+	// the end of the shadow WAL is captured. See WALDivergencePolicyNewGeneration
+	// for policies.
+	WALDivergencePolicy string
+
+	// If true, the time each transaction is copied into the shadow WAL is
+	// recorded in a commit time index which replicas store with each WAL
+	// file. Restores to a timestamp then stop at the last commit before it
+	// instead of at the last WAL file written before it.
+	CommitTimeIndex bool
+
+	// Relative upload priority when the database shares an upload scheduler
+	// with other databases. Higher values are uploaded first.
+	Priority int
+
+	// Scheduler used to bound concurrent uploads across databases.
+	// Uploads are not limited if nil.
+	UploadScheduler *UploadScheduler
+
+	// If true, replicas snapshot only the pages changed since their previous
+	// snapshot, as found in the frames copied into the shadow WAL, on top of
+	// it. A full snapshot is taken when the changed pages are not known, such
+	// as after the database is reopened, or after MaxSnapshotLayerN layers.
+	IncrementalSnapshots bool
+
+	// If true, a change to the schema or user version of the database
+	// checkpoints the WAL & requests a new snapshot from each replica so
+	// restores after a migration do not need to replay it.
+	SnapshotOnSchemaChange bool
+
+	// Time & cumulative WAL bytes copied to the shadow WAL after which a new
+	// snapshot is requested from each replica, whichever is exceeded first.
+	// The interval only applies once WAL has been copied so idle databases
+	// are not snapshotted. Both are counted from the latest request or the
+	// start of the generation. Disabled if zero.
+	SnapshotInterval         time.Duration
+	SnapshotWALByteThreshold int64
+
+	// Daily time ranges during which replica uploads are paused.
+	MaintenanceWindows []MaintenanceWindow
+
+	// Returns the current time when evaluating maintenance windows & the
+	// age of snapshots. Defaults to time.Now if nil.
+	Now func() time.Time
+
+	// Returns the name of a new generation. Defaults to a random hex string
+	// if nil. A name which already exists locally or in a replica is
+	// regenerated up to GenerationRetryN times before creation fails.
+	NewGenerationName func() string
+	GenerationRetryN  int
+
+	// Hash algorithm used for integrity checksums when validating replicas
+	// and stored in download manifests. CRC64 is still used internally for
+	// fast change detection.
+	IntegrityHash string
+
 	// Frequency at which to perform db sync.
 	MonitorInterval time.Duration
 
+	// Maximum number of shadow WAL bytes held in memory so that, when the
+	// database has multiple replicas, each section of the shadow WAL is read
+	// from disk once & shared. Replicas read the shared bytes at their own
+	// positions. If zero, each replica reads from disk.
+	ShadowWALCacheSize int
+
+	// Number of bytes of committed transactions buffered in memory before
+	// writing to the shadow WAL, and the fsync policy for the shadow WAL.
+	// Buffered transactions are always written before a sync completes so
+	// replicas are unaffected. See ShadowWALSyncAlways for policies.
+	ShadowWALFlushSize int
+	ShadowWALSync      string
+
+	// Maximum number of bytes read from the WAL at a time when copying to
+	// the shadow WAL. Rounded down to whole frames. Defaults to one frame.
+	// Only frames below the WAL size at the start of a sync are read.
+	WALReadChunkSize int
+
+	// If set, shadow WAL & meta files are fsynced at most once per interval
+	// instead of on every copy, overriding ShadowWALSync. On power failure,
+	// up to FsyncInterval plus MonitorInterval of changes may be lost from
+	// the shadow WAL. Replicas only upload fsynced frames so a replica never
+	// has changes which were lost locally. The shadow WAL is still fsynced
+	// before each checkpoint.
+	FsyncInterval time.Duration
+
+	// If true, an empty database file is initialized by Litestream on the
+	// first sync. By default, syncing waits until the application writes a
+	// valid SQLite header so no generation or empty snapshot is created.
+	InitializeEmpty bool
+
+	// Permission bits of the meta directory, generation directories & files
+	// created within them, such as the shadow WAL. They are set explicitly
+	// so the umask does not apply. If zero, the permissions of the database
+	// file & its parent directory are used, subject to the umask.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// List of table names whose changes are synced immediately instead of
+	// waiting for the monitor interval. The WAL is checked for changes to
+	// these tables every priority interval.
+	PriorityTables   []string
+	PriorityInterval time.Duration
+
+	// File system used to read the WAL & manage the shadow WAL & generation
+	// name files. Defaults to the os package if nil. Must be set before
+	// calling Open().
+	FS FileSystem
+
 	// List of replicas for the database.
 	// Must be set before calling Open().
 	Replicas []Replica
@@ -105,10 +301,21 @@ func NewDB(path string) *DB {
 		uid:    -1, gid: -1, mode: 0600,
 		diruid: -1, dirgid: -1, dirmode: 0700,
 
-		MinCheckpointPageN: DefaultMinCheckpointPageN,
-		MaxCheckpointPageN: DefaultMaxCheckpointPageN,
-		CheckpointInterval: DefaultCheckpointInterval,
-		MonitorInterval:    DefaultMonitorInterval,
+		priorityNotify: make(chan struct{}),
+		checkpointCh:   make(chan int, 1),
+
+		MinCheckpointPageN:  DefaultMinCheckpointPageN,
+		MaxCheckpointPageN:  DefaultMaxCheckpointPageN,
+		CheckpointInterval:  DefaultCheckpointInterval,
+		CheckpointMode:      DefaultCheckpointMode,
+		WALDivergencePolicy: DefaultWALDivergencePolicy,
+		GenerationRetryN:    DefaultGenerationRetryN,
+		IntegrityHash:       DefaultIntegrityHash,
+		MonitorInterval:     DefaultMonitorInterval,
+		ShadowWALFlushSize:  DefaultShadowWALFlushSize,
+		ShadowWALSync:       DefaultShadowWALSync,
+		ShadowWALCacheSize:  DefaultShadowWALCacheSize,
+		PriorityInterval:    DefaultPriorityInterval,
 	}
 
 	db.dbSizeGauge = dbSizeGaugeVec.WithLabelValues(db.path)
@@ -118,7 +325,13 @@ func NewDB(path string) *DB {
 	db.shadowWALSizeGauge = shadowWALSizeGaugeVec.WithLabelValues(db.path)
 	db.syncNCounter = syncNCounterVec.WithLabelValues(db.path)
 	db.syncErrorNCounter = syncErrorNCounterVec.WithLabelValues(db.path)
+	db.uninitializedNCounter = uninitializedNCounterVec.WithLabelValues(db.path)
+	db.fsyncNCounter = fsyncNCounterVec.WithLabelValues(db.path)
+	db.lockDiagnosticNCounter = lockDiagnosticNCounterVec.WithLabelValues(db.path)
+	db.tornFrameNCounter = tornFrameNCounterVec.WithLabelValues(db.path)
 	db.syncSecondsCounter = syncSecondsCounterVec.WithLabelValues(db.path)
+	db.compressionInCounter = compressionRawBytesCounterVec.WithLabelValues(db.path)
+	db.compressionOutCounter = compressionCompressedBytesCounterVec.WithLabelValues(db.path)
 	db.checkpointNCounterVec = checkpointNCounterVec.MustCurryWith(prometheus.Labels{"db": db.path})
 	db.checkpointErrorNCounterVec = checkpointErrorNCounterVec.MustCurryWith(prometheus.Labels{"db": db.path})
 	db.checkpointSecondsCounterVec = checkpointSecondsCounterVec.MustCurryWith(prometheus.Labels{"db": db.path})
@@ -143,6 +356,11 @@ func (db *DB) WALPath() string {
 	return db.path + "-wal"
 }
 
+// SHMPath returns the path to the database's shared memory (WAL index) file.
+func (db *DB) SHMPath() string {
+	return db.path + "-shm"
+}
+
 // MetaPath returns the path to the database metadata.
 func (db *DB) MetaPath() string {
 	dir, file := filepath.Split(db.path)
@@ -185,7 +403,7 @@ func (db *DB) CurrentShadowWALPath(generation string) (string, error) {
 
 // CurrentShadowWALIndex returns the current WAL index & total size.
 func (db *DB) CurrentShadowWALIndex(generation string) (index int, size int64, err error) {
-	fis, err := ioutil.ReadDir(filepath.Join(db.GenerationPath(generation), "wal"))
+	fis, err := db.fs().ReadDir(filepath.Join(db.GenerationPath(generation), "wal"))
 	if os.IsNotExist(err) {
 		return 0, 0, nil // no wal files written for generation
 	} else if err != nil {
@@ -208,13 +426,152 @@ func (db *DB) CurrentShadowWALIndex(generation string) (index int, size int64, e
 	return index, size, nil
 }
 
-// Replica returns a replica by name.
+// Replica returns a replica by name. The clients of failover replicas can
+// also be looked up by name.
 func (db *DB) Replica(name string) Replica {
-	for _, r := range db.Replicas {
+	replicas := db.ReplicaList()
+	for _, r := range replicas {
 		if r.Name() == name {
 			return r
 		}
 	}
+	for _, r := range replicas {
+		if fr, ok := r.(*FailoverReplica); ok {
+			for _, c := range fr.Clients {
+				if c.Name() == name {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ReplicaList returns a snapshot of the replicas attached to the database.
+// It is safe to call while replicas are added, replaced or removed.
+func (db *DB) ReplicaList() []Replica {
+	db.replicasMu.RLock()
+	defer db.replicasMu.RUnlock()
+	return append([]Replica(nil), db.Replicas...)
+}
+
+// AddReplica attaches r to the database. It starts replicating immediately if
+// the database has been initialized & otherwise once it is, like the replicas
+// set before Open. Returns an error if a replica has the same name.
+func (db *DB) AddReplica(r Replica) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.replicasMu.Lock()
+	if replicaIndex(db.Replicas, r.Name()) != -1 {
+		db.replicasMu.Unlock()
+		return fmt.Errorf("duplicate replica name: %q", r.Name())
+	}
+	db.Replicas = append(db.Replicas, r)
+	db.replicasMu.Unlock()
+
+	if db.db != nil {
+		r.Start(db.ctx)
+	}
+	return nil
+}
+
+// ReplaceReplica uploads the pending changes of the replica with the same
+// name as r until ctx is done, like Shutdown, & then replaces it with r. The
+// generation of the database is unchanged so r continues replicating from its
+// own position.
+func (db *DB) ReplaceReplica(ctx context.Context, r Replica) error {
+	replicas := db.ReplicaList()
+	i := replicaIndex(replicas, r.Name())
+	if i == -1 {
+		return fmt.Errorf("replica not found: %q", r.Name())
+	}
+
+	prev := replicas[i]
+	db.flushReplica(ctx, prev)
+
+	db.mu.Lock()
+	if err := db.swapReplica(prev, r); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if db.db != nil {
+		r.Start(db.ctx)
+	}
+	db.mu.Unlock()
+
+	return closeReplica(prev)
+}
+
+// RemoveReplica uploads the pending changes of the replica named name until
+// ctx is done, like Shutdown, & then detaches & closes it.
+func (db *DB) RemoveReplica(ctx context.Context, name string) error {
+	replicas := db.ReplicaList()
+	i := replicaIndex(replicas, name)
+	if i == -1 {
+		return fmt.Errorf("replica not found: %q", name)
+	}
+
+	r := replicas[i]
+	db.flushReplica(ctx, r)
+
+	if err := db.swapReplica(r, nil); err != nil {
+		return err
+	}
+	return closeReplica(r)
+}
+
+// swapReplica replaces prev with r in db.Replicas, or removes prev if r is
+// nil. Returns an error if prev was replaced or removed concurrently.
+func (db *DB) swapReplica(prev, r Replica) error {
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+
+	for i := range db.Replicas {
+		if db.Replicas[i] != prev {
+			continue
+		} else if r == nil {
+			db.Replicas = append(db.Replicas[:i:i], db.Replicas[i+1:]...)
+		} else {
+			db.Replicas[i] = r
+		}
+		return nil
+	}
+	return fmt.Errorf("replica not found: %q", prev.Name())
+}
+
+// replicaIndex returns the index of the replica named name in replicas or
+// -1 if there is none. Failover clients are not matched.
+func replicaIndex(replicas []Replica, name string) int {
+	for i, r := range replicas {
+		if r.Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// flushReplica copies pending WAL data to the shadow WAL & uploads it to r
+// until ctx is done. r is stopped & the data left unflushed is logged.
+func (db *DB) flushReplica(ctx context.Context, r Replica) {
+	if err := db.Sync(); err != nil {
+		log.Printf("%s(%s): flush: sync error: %s", db.path, r.Name(), err)
+	}
+	db.shutdownReplica(ctx, r)
+
+	if n, size, err := db.unflushed(r.LastPos()); err != nil {
+		log.Printf("%s(%s): flush: cannot determine unflushed data: %s", db.path, r.Name(), err)
+	} else if n > 0 {
+		log.Printf("%s(%s): flush: %d bytes in %d wal files not flushed", db.path, r.Name(), size, n)
+	}
+}
+
+// closeReplica stops r & releases any resources it holds.
+func closeReplica(r Replica) error {
+	r.Stop()
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
 	return nil
 }
 
@@ -232,7 +589,7 @@ func (db *DB) Pos() (Pos, error) {
 		return Pos{}, err
 	}
 
-	fi, err := os.Stat(db.ShadowWALPath(generation, index))
+	fi, err := db.fs().Stat(db.ShadowWALPath(generation, index))
 	if os.IsNotExist(err) {
 		return Pos{Generation: generation, Index: index}, nil
 	} else if err != nil {
@@ -261,24 +618,56 @@ func (db *DB) PageSize() int {
 func (db *DB) Open() (err error) {
 	// Validate that all replica names are unique.
 	m := make(map[string]struct{})
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicaList() {
 		if _, ok := m[r.Name()]; ok {
 			return fmt.Errorf("duplicate replica name: %q", r.Name())
 		}
 		m[r.Name()] = struct{}{}
 	}
 
+	// Ensure the path is not a SQLite auxiliary file such as the WAL.
+	if err := ValidateDBPath(db.path); err != nil {
+		return err
+	}
+
+	// Ensure an existing file is a SQLite database before replicating it.
+	if _, err := db.isInitialized(); errors.Is(err, ErrNotSQLiteDatabase) {
+		return fmt.Errorf("%s: %w", db.path, err)
+	}
+
+	// Validate checkpoint mode.
+	if !IsCheckpointMode(db.CheckpointMode) {
+		return fmt.Errorf("invalid checkpoint mode: %q", db.CheckpointMode)
+	} else if _, err := NewIntegrityHash(db.IntegrityHash); err != nil {
+		return err
+	} else if !IsShadowWALSyncMode(db.ShadowWALSync) {
+		return fmt.Errorf("invalid shadow wal sync mode: %q", db.ShadowWALSync)
+	} else if !IsWALDivergencePolicy(db.WALDivergencePolicy) {
+		return fmt.Errorf("invalid wal divergence policy: %q", db.WALDivergencePolicy)
+	}
+
 	// Clear old temporary files that my have been left from a crash.
 	if err := removeTmpFiles(db.MetaPath()); err != nil {
 		return fmt.Errorf("cannot remove tmp files: %w", err)
 	}
 
+	// Restore lifetime compression totals from a previous run.
+	if err := db.loadCompressionTotals(); err != nil {
+		return fmt.Errorf("cannot load compression totals: %w", err)
+	}
+
 	// Start monitoring SQLite database in a separate goroutine.
 	if db.MonitorInterval > 0 {
 		db.wg.Add(1)
 		go func() { defer db.wg.Done(); db.monitor() }()
 	}
 
+	// Run passive checkpoints in a separate goroutine, if enabled.
+	if db.AsyncCheckpoint {
+		db.wg.Add(1)
+		go func() { defer db.wg.Done(); db.checkpointer() }()
+	}
+
 	return nil
 }
 
@@ -320,7 +709,7 @@ func (db *DB) UpdatedAt() (time.Time, error) {
 // Snapshots returns a list of all snapshots across all replicas.
 func (db *DB) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
 	var infos []*SnapshotInfo
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicaList() {
 		a, err := r.Snapshots(ctx)
 		if err != nil {
 			return nil, err
@@ -338,7 +727,7 @@ func (db *DB) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
 // WALs returns a list of all WAL files across all replicas.
 func (db *DB) WALs(ctx context.Context) ([]*WALInfo, error) {
 	var infos []*WALInfo
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicaList() {
 		a, err := r.WALs(ctx)
 		if err != nil {
 			return nil, err
@@ -378,6 +767,24 @@ func (db *DB) init() (err error) {
 	db.diruid, db.dirgid = fileinfo(fi)
 	db.dirmode = fi.Mode()
 
+	// Ensure the file is a SQLite database. Wait for the application to
+	// initialize an empty database unless configured to initialize empty
+	// files ourselves.
+	if ok, err := db.isInitialized(); err != nil {
+		return err
+	} else if !ok && !db.InitializeEmpty {
+		if !db.uninitialized {
+			db.uninitialized = true
+			db.uninitializedNCounter.Inc()
+			log.Printf("%s: database not initialized, waiting for valid header", db.path)
+		}
+		return nil
+	}
+	if db.uninitialized {
+		db.uninitialized = false
+		log.Printf("%s: database initialized", db.path)
+	}
+
 	dsn := db.path
 	dsn += fmt.Sprintf("?_busy_timeout=%d", BusyTimeout.Milliseconds())
 
@@ -419,14 +826,25 @@ func (db *DB) init() (err error) {
 	}
 
 	// Ensure meta directory structure exists.
-	if err := mkdirAll(db.MetaPath(), db.dirmode, db.diruid, db.dirgid); err != nil {
+	if err := db.mkdirMeta(db.MetaPath()); err != nil {
 		return err
+	} else if db.DirMode != 0 {
+		// Also restrict a meta directory created by an earlier run.
+		if err := db.fs().Chmod(db.MetaPath(), db.DirMode); err != nil {
+			return err
+		}
+	}
+
+	// Remove any partial frame left by a shadow WAL write which was
+	// interrupted, such as by the process being killed.
+	if err := db.truncatePartialShadowWAL(); err != nil {
+		return fmt.Errorf("truncate partial shadow wal: %w", err)
 	}
 
 	// If we have an existing shadow WAL, ensure the headers match.
 	if err := db.verifyHeadersMatch(); err != nil {
 		log.Printf("%s: init: cannot determine last wal position, clearing generation (%s)", db.path, err)
-		if err := os.Remove(db.GenerationNamePath()); err != nil && !os.IsNotExist(err) {
+		if err := db.fs().Remove(db.GenerationNamePath()); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("remove generation name: %w", err)
 		}
 	}
@@ -437,13 +855,55 @@ func (db *DB) init() (err error) {
 	}
 
 	// Start replication.
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicaList() {
 		r.Start(db.ctx)
 	}
 
 	return nil
 }
 
+// truncatePartialShadowWAL truncates the last shadow WAL of the current
+// generation to its last complete frame so the position recovered from its
+// size is valid. A shadow WAL without a complete header is truncated to zero,
+// which then clears the generation as the header cannot be verified.
+func (db *DB) truncatePartialShadowWAL() error {
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		return err
+	} else if generation == "" {
+		return nil
+	}
+
+	filename, err := db.CurrentShadowWALPath(generation)
+	if err != nil {
+		return err
+	}
+
+	fi, err := db.fs().Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Align to the frames of the shadow WAL, which may have been written
+	// with a page size from before the database's page size was changed.
+	pageSize := db.pageSize
+	if hdr, err := readWALHeader(db.fs(), filename); err == nil {
+		if n := walHeaderPageSize(hdr); isValidPageSize(n) {
+			pageSize = n
+		}
+	}
+
+	size := frameAlign(fi.Size(), pageSize)
+	if size == fi.Size() {
+		return nil
+	}
+
+	log.Printf("%s: init: truncating partial shadow wal %s from %d to %d bytes", db.path, filepath.Base(filename), fi.Size(), size)
+	return db.fs().Truncate(filename, size)
+}
+
 // verifyHeadersMatch returns true if the primary WAL and last shadow WAL header match.
 func (db *DB) verifyHeadersMatch() error {
 	// Determine current generation.
@@ -460,21 +920,29 @@ func (db *DB) verifyHeadersMatch() error {
 		return fmt.Errorf("cannot determine current shadow wal path: %w", err)
 	}
 
-	hdr0, err := readWALHeader(db.WALPath())
+	hdr0, err := readWALHeader(db.fs(), db.WALPath())
 	if os.IsNotExist(err) {
 		return fmt.Errorf("no primary wal: %w", err)
 	} else if err != nil {
 		return fmt.Errorf("primary wal header: %w", err)
 	}
 
-	hdr1, err := readWALHeader(shadowWALPath)
+	hdr1, err := readWALHeader(db.fs(), shadowWALPath)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("no shadow wal")
 	} else if err != nil {
 		return fmt.Errorf("shadow wal header: %w", err)
 	}
 
+	if n0, n1 := walHeaderPageSize(hdr0), walHeaderPageSize(hdr1); n0 != 0 && n1 != 0 && n0 != n1 {
+		return fmt.Errorf("page size changed from %d to %d", n1, n0)
+	}
+
 	if !bytes.Equal(hdr0, hdr1) {
+		// A restart recovered by the divergence policy is handled on sync.
+		if isRecoverableWALRestart(db.WALDivergencePolicy, hdr0, hdr1) {
+			return nil
+		}
 		return fmt.Errorf("wal header mismatch")
 	}
 	return nil
@@ -525,7 +993,7 @@ func (db *DB) cleanWAL() error {
 
 	// Determine lowest index that's been replicated to all replicas.
 	min := -1
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicaList() {
 		pos := r.LastPos()
 		if pos.Generation != generation {
 			pos = Pos{} // different generation, reset index to zero
@@ -535,6 +1003,21 @@ func (db *DB) cleanWAL() error {
 		}
 	}
 
+	// While replication is paused, remove WAL files the database no longer
+	// needs even if they have not been replicated. A new generation is then
+	// started when replication resumes.
+	if len(db.ReplicaList()) > 0 && db.Paused() {
+		index, _, err := db.CurrentShadowWALIndex(generation)
+		if err != nil {
+			return err
+		} else if index > min+1 {
+			db.markPauseDiscarded()
+		}
+		if index > min {
+			min = index
+		}
+	}
+
 	// Skip if our lowest index is too small.
 	if min <= 0 {
 		return nil
@@ -542,18 +1025,25 @@ func (db *DB) cleanWAL() error {
 	min-- // Keep an extra WAL file.
 
 	// Remove all WAL files for the generation before the lowest index.
+	db.walCache.evict(generation, min)
 	dir := db.ShadowWALDir(generation)
-	fis, err := ioutil.ReadDir(dir)
+	fis, err := db.fs().ReadDir(dir)
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
 		return err
 	}
 	for _, fi := range fis {
-		if idx, _, _, err := ParseWALPath(fi.Name()); err != nil || idx >= min {
+		idx, _, _, err := ParseWALPath(fi.Name())
+		if err != nil {
+			if idx, err = ParseCommitTimesPath(fi.Name()); err != nil {
+				continue
+			}
+		}
+		if idx >= min {
 			continue
 		}
-		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+		if err := db.fs().Remove(filepath.Join(dir, fi.Name())); err != nil {
 			return err
 		}
 	}
@@ -567,9 +1057,12 @@ func (db *DB) SoftClose() (err error) {
 	db.cancel()
 	db.wg.Wait()
 
-	// Ensure replicas all stop replicating.
-	for _, r := range db.Replicas {
-		r.Stop()
+	// Ensure replicas all stop replicating & release any resources they
+	// hold, such as a client shared with other databases.
+	for _, r := range db.ReplicaList() {
+		if e := closeReplica(r); e != nil && err == nil {
+			err = e
+		}
 	}
 
 	if db.rtx != nil {
@@ -580,6 +1073,115 @@ func (db *DB) SoftClose() (err error) {
 	return err
 }
 
+// Shutdown copies pending WAL data to the shadow WAL, uploads it to each
+// replica & then closes everything but the underlying db connection, like
+// SoftClose. Replicas are flushed concurrently until ctx is done.
+//
+// If ctx is done first, the data each replica has not uploaded is logged &
+// the context error is returned without closing as replicas may still be
+// uploading. The caller is expected to exit.
+func (db *DB) Shutdown(ctx context.Context) error {
+	if err := db.Sync(); err != nil {
+		log.Printf("%s: shutdown: sync error: %s", db.path, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range db.ReplicaList() {
+		r := r
+		wg.Add(1)
+		go func() { defer wg.Done(); db.shutdownReplica(ctx, r) }()
+	}
+	wg.Wait()
+
+	// Report data which could not be uploaded before the deadline.
+	var unflushed bool
+	for _, r := range db.ReplicaList() {
+		n, size, err := db.unflushed(r.LastPos())
+		if err != nil {
+			log.Printf("%s(%s): shutdown: cannot determine unflushed data: %s", db.path, r.Name(), err)
+		} else if n > 0 {
+			log.Printf("%s(%s): shutdown: %d bytes in %d wal files not flushed", db.path, r.Name(), size, n)
+			unflushed = true
+		}
+	}
+
+	if err := ctx.Err(); err != nil && unflushed {
+		return err
+	}
+	return db.SoftClose()
+}
+
+// shutdownReplica stops r, which flushes its pending changes, & then syncs
+// it if it is still behind, such as if its monitor is disabled. Returns once
+// ctx is done even if r has not stopped.
+func (db *DB) shutdownReplica(ctx context.Context, r Replica) {
+	done := make(chan struct{})
+	go func() { defer close(done); r.Stop() }()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-done:
+	}
+
+	s, ok := r.(Syncer)
+	if !ok {
+		return
+	} else if n, _, err := db.unflushed(r.LastPos()); err != nil || n == 0 {
+		return
+	}
+
+	if err := s.Sync(ctx); err != nil {
+		log.Printf("%s(%s): shutdown: sync error: %s", db.path, r.Name(), err)
+	}
+}
+
+// unflushed returns the number of shadow WAL files of the current generation
+// with frames after pos & the total size of those frames. All frames are
+// unflushed if pos is from another generation.
+func (db *DB) unflushed(pos Pos) (n int, size int64, err error) {
+	dpos, err := db.Pos()
+	if err != nil {
+		return 0, 0, err
+	} else if dpos.IsZero() {
+		return 0, 0, nil
+	}
+
+	fis, err := db.fs().ReadDir(db.ShadowWALDir(dpos.Generation))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), WALExt) {
+			continue
+		}
+		index, _, _, err := ParseWALPath(fi.Name())
+		if err != nil {
+			continue // invalid wal filename
+		}
+
+		// The header of each file is not data to upload so a new file with
+		// no frames is not unflushed.
+		offset := int64(WALHeaderSize)
+		if pos.Generation == dpos.Generation {
+			if index < pos.Index {
+				continue
+			} else if index == pos.Index && pos.Offset > offset {
+				offset = pos.Offset
+			}
+		}
+		sz := fi.Size() - offset
+
+		if sz > 0 {
+			n, size = n+1, size+sz
+		}
+	}
+	return n, size, nil
+}
+
 // acquireReadLock begins a read transaction on the database to prevent checkpointing.
 func (db *DB) acquireReadLock() error {
 	if db.rtx != nil {
@@ -603,6 +1205,23 @@ func (db *DB) acquireReadLock() error {
 	return nil
 }
 
+// refreshReadLock replaces the read transaction with a new one so it reads
+// from the current end of the WAL. The new transaction begins before the old
+// one ends so checkpoints are blocked throughout.
+func (db *DB) refreshReadLock() error {
+	rtx := db.rtx
+	db.rtx = nil
+	if err := db.acquireReadLock(); err != nil {
+		db.rtx = rtx
+		return err
+	}
+
+	if rtx == nil {
+		return nil
+	}
+	return rtx.Rollback()
+}
+
 // releaseReadLock rolls back the long-running read transaction.
 func (db *DB) releaseReadLock() error {
 	// Ignore if we do not have a read lock.
@@ -619,7 +1238,7 @@ func (db *DB) releaseReadLock() error {
 // CurrentGeneration returns the name of the generation saved to the "generation"
 // file in the meta data directory. Returns empty string if none exists.
 func (db *DB) CurrentGeneration() (string, error) {
-	buf, err := ioutil.ReadFile(db.GenerationNamePath())
+	buf, err := readFile(db.fs(), db.GenerationNamePath())
 	if os.IsNotExist(err) {
 		return "", nil
 	} else if err != nil {
@@ -639,14 +1258,23 @@ func (db *DB) CurrentGeneration() (string, error) {
 // directory, snapshotting to each replica, and updating the current
 // generation name.
 func (db *DB) createGeneration() (string, error) {
-	// Generate random generation hex name.
-	buf := make([]byte, GenerationNameLen/2)
-	_, _ = rand.New(rand.NewSource(time.Now().UnixNano())).Read(buf)
-	generation := hex.EncodeToString(buf)
+	// Generate a generation name which is not already in use.
+	var generation string
+	for i := 0; ; i++ {
+		generation = db.newGenerationName()
+		if ok, err := db.generationExists(generation); err != nil {
+			return "", err
+		} else if !ok {
+			break
+		} else if i >= db.GenerationRetryN {
+			return "", fmt.Errorf("cannot create generation after %d attempts: %w", i+1, ErrGenerationExists)
+		}
+		log.Printf("%s: generation %q already exists, regenerating", db.path, generation)
+	}
 
 	// Generate new directory.
 	dir := filepath.Join(db.MetaPath(), "generations", generation)
-	if err := mkdirAll(dir, db.dirmode, db.diruid, db.dirgid); err != nil {
+	if err := db.mkdirMeta(dir); err != nil {
 		return "", err
 	}
 
@@ -657,11 +1285,13 @@ func (db *DB) createGeneration() (string, error) {
 
 	// Atomically write generation name as current generation.
 	generationNamePath := db.GenerationNamePath()
-	if err := ioutil.WriteFile(generationNamePath+".tmp", []byte(generation+"\n"), db.mode); err != nil {
+	if err := writeFile(db.fs(), generationNamePath+".tmp", []byte(generation+"\n"), db.metaFileMode()); err != nil {
 		return "", fmt.Errorf("write generation temp file: %w", err)
+	} else if err := db.chmodMeta(generationNamePath + ".tmp"); err != nil {
+		return "", err
 	}
 	_ = os.Chown(generationNamePath+".tmp", db.uid, db.gid)
-	if err := os.Rename(generationNamePath+".tmp", generationNamePath); err != nil {
+	if err := db.fs().Rename(generationNamePath+".tmp", generationNamePath); err != nil {
 		return "", fmt.Errorf("rename generation file: %w", err)
 	}
 
@@ -673,16 +1303,85 @@ func (db *DB) createGeneration() (string, error) {
 	return generation, nil
 }
 
+// newGenerationName returns the name for a new generation.
+func (db *DB) newGenerationName() string {
+	if db.NewGenerationName != nil {
+		return db.NewGenerationName()
+	}
+
+	// Generate random generation hex name.
+	buf := make([]byte, GenerationNameLen/2)
+	_, _ = rand.New(rand.NewSource(time.Now().UnixNano())).Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// generationExists returns true if generation exists locally or in any
+// replica. Replicas which cannot be listed are skipped so a storage outage
+// does not prevent a new generation from being created locally.
+func (db *DB) generationExists(generation string) (bool, error) {
+	if _, err := os.Stat(db.GenerationPath(generation)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	for _, r := range db.ReplicaList() {
+		generations, err := r.Generations(db.ctx)
+		if err != nil {
+			log.Printf("%s(%s): cannot check generation %q: %s", db.path, r.Name(), generation, err)
+			continue
+		}
+		for _, g := range generations {
+			if g == generation {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isInitialized returns true if the database file starts with a valid SQLite
+// header. A database whose first transaction is still in the WAL is also
+// considered initialized. Returns ErrNotSQLiteDatabase if the file has data
+// which does not begin with the SQLite header.
+func (db *DB) isInitialized() (bool, error) {
+	f, err := os.Open(db.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, len(sqliteHeader))
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	} else if !bytes.HasPrefix([]byte(sqliteHeader), hdr[:n]) {
+		return false, ErrNotSQLiteDatabase
+	} else if n == len(hdr) {
+		return true, nil
+	}
+
+	if fi, err := db.fs().Stat(db.WALPath()); err == nil && fi.Size() > 0 {
+		return true, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
 // Sync copies pending data from the WAL to the shadow WAL.
 func (db *DB) Sync() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	return db.sync()
+}
 
+func (db *DB) sync() (err error) {
 	// Initialize database, if necessary. Exit if no DB exists.
 	if err := db.init(); err != nil {
 		return err
 	} else if db.db == nil {
-		Tracef("%s: sync: no database found", db.path)
+		Tracef("%s: sync: no initialized database found", db.path)
 		return nil
 	}
 
@@ -729,13 +1428,35 @@ func (db *DB) Sync() (err error) {
 	if err != nil {
 		return fmt.Errorf("cannot verify wal state: %w", err)
 	}
+
+	// Start a new generation if unreplicated WAL was discarded while
+	// replication was paused.
+	if reason := db.resumeGenerationReason(); reason != "" && info.reason == "" && info.generation != "" {
+		info.reason = reason
+	}
 	Tracef("%s: sync: info=%#v", db.path, info)
 
 	// Track if anything in the shadow WAL changes and then notify at the end.
 	changed := info.walSize != info.shadowWALSize || info.restart || info.reason != ""
 
+	// Detect schema changes, if enabled. A new generation is snapshotted
+	// regardless so a separate snapshot is only requested otherwise.
+	var schemaChanged bool
+	if db.SnapshotOnSchemaChange {
+		if schemaChanged, err = db.schemaChanged(tx); err != nil {
+			return fmt.Errorf("cannot check schema: %w", err)
+		}
+		schemaChanged = schemaChanged && info.reason == ""
+	}
+
 	// If we are unable to verify the WAL state then we start a new generation.
 	if info.reason != "" {
+		// Track the current page size, which may have changed, so frames of
+		// the new generation are copied whole.
+		if err := db.updatePageSize(tx); err != nil {
+			return err
+		}
+
 		// Start new generation & notify user via log message.
 		if info.generation, err = db.createGeneration(); err != nil {
 			return fmt.Errorf("create generation: %w", err)
@@ -759,15 +1480,47 @@ func (db *DB) Sync() (err error) {
 	// If WAL size is great than max threshold, force checkpoint.
 	// If WAL size is greater than min threshold, attempt checkpoint.
 	var checkpoint bool
-	checkpointMode := CheckpointModePassive
+	checkpointMode := db.CheckpointMode
 	if db.MaxCheckpointPageN > 0 && newWALSize >= calcWALSize(db.pageSize, db.MaxCheckpointPageN) {
-		checkpoint, checkpointMode = true, CheckpointModeRestart
+		checkpoint = true
+		if checkpointMode != CheckpointModeTruncate {
+			checkpointMode = CheckpointModeRestart
+		}
 	} else if newWALSize >= calcWALSize(db.pageSize, db.MinCheckpointPageN) {
 		checkpoint = true
 	} else if db.CheckpointInterval > 0 && !info.dbModTime.IsZero() && time.Since(info.dbModTime) > db.CheckpointInterval && newWALSize > calcWALSize(db.pageSize, 1) {
 		checkpoint = true
 	}
 
+	// Request a snapshot if too much time or WAL has passed since the last.
+	var snapshotReason string
+	if schemaChanged {
+		snapshotReason = SnapshotReasonSchemaChange
+	} else if snapshotReason = db.snapshotDue(info.generation); snapshotReason != "" {
+		log.Printf("%s: sync: requesting snapshot, reason=%s bytes=%d", db.path, snapshotReason, db.snapshotSchedule.size)
+	}
+
+	// Restart the WAL before a snapshot so the snapshot starts a new index.
+	if snapshotReason != "" {
+		checkpoint = true
+		if checkpointMode != CheckpointModeTruncate {
+			checkpointMode = CheckpointModeRestart
+		}
+	}
+
+	// Hand off a passive checkpoint to the background checkpointer, if
+	// enabled. The read lock is moved to the end of the WAL while the write
+	// lock is still held so every frame it pins has been copied to the
+	// shadow WAL. Once the frames are backfilled, the next sync checkpoints
+	// inline to restart the WAL & start a new shadow WAL.
+	if checkpoint && db.AsyncCheckpoint && checkpointMode == CheckpointModePassive && !db.backfilled {
+		if err := db.refreshReadLock(); err != nil {
+			return fmt.Errorf("refresh read lock: %w", err)
+		}
+		db.requestCheckpoint(int((newWALSize - WALHeaderSize) / int64(db.pageSize+WALFrameHeaderSize)))
+		checkpoint = false
+	}
+
 	// Release write lock before checkpointing & exiting.
 	if err := tx.Rollback(); err != nil {
 		return fmt.Errorf("rollback write tx: %w", err)
@@ -777,9 +1530,19 @@ func (db *DB) Sync() (err error) {
 	if checkpoint {
 		changed = true
 
-		if err := db.checkpointAndInit(info.generation, checkpointMode); err != nil {
+		if _, err := db.checkpointAndInit(db.ctx, info.generation, checkpointMode); err != nil {
 			return fmt.Errorf("checkpoint: mode=%v err=%w", checkpointMode, err)
 		}
+		db.backfilled = false
+	}
+
+	// Request a new snapshot from replicas once the change is checkpointed.
+	if schemaChanged {
+		log.Printf("%s: sync: schema change detected, requesting snapshot", db.path)
+	}
+	if snapshotReason != "" {
+		db.requestSnapshot(snapshotReason)
+		db.snapshotSchedule.reset(info.generation)
 	}
 
 	// Clean up any old files.
@@ -787,13 +1550,22 @@ func (db *DB) Sync() (err error) {
 		return fmt.Errorf("cannot clean: %w", err)
 	}
 
+	// Fsync the shadow WAL if batched by interval.
+	if err := db.fsyncIfDue(info.generation); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+
 	// Compute current index and total shadow WAL size.
 	// This is only for metrics so we ignore any errors that occur.
 	index, size, _ := db.CurrentShadowWALIndex(info.generation)
 	db.shadowWALIndexGauge.Set(float64(index))
 	db.shadowWALSizeGauge.Set(float64(size))
 
-	// Notify replicas of WAL changes.
+	// Start the lag clock for replicas & notify them of WAL changes.
+	if changed {
+		db.markWALChanged(time.Now())
+	}
+	db.updateReplicaLagMetrics()
 	if changed {
 		close(db.notify)
 		db.notify = make(chan struct{})
@@ -804,10 +1576,27 @@ func (db *DB) Sync() (err error) {
 	return nil
 }
 
-// ensureWALExists checks that the real WAL exists and has a header.
-func (db *DB) ensureWALExists() (err error) {
+// updatePageSize reads the page size of the database within tx & tracks it
+// if it has changed.
+func (db *DB) updatePageSize(tx *sql.Tx) error {
+	var pageSize int
+	if err := tx.QueryRowContext(db.ctx, `PRAGMA page_size;`).Scan(&pageSize); err != nil {
+		return fmt.Errorf("read page size: %w", err)
+	} else if pageSize <= 0 {
+		return fmt.Errorf("invalid db page size: %d", pageSize)
+	} else if pageSize == db.pageSize {
+		return nil
+	}
+
+	log.Printf("%s: sync: page size changed from %d to %d", db.path, db.pageSize, pageSize)
+	db.pageSize = pageSize
+	return nil
+}
+
+// ensureWALExists checks that the real WAL exists and has a header.
+func (db *DB) ensureWALExists() (err error) {
 	// Exit early if WAL header exists.
-	if fi, err := os.Stat(db.WALPath()); err == nil && fi.Size() >= WALHeaderSize {
+	if fi, err := db.fs().Stat(db.WALPath()); err == nil && fi.Size() >= WALHeaderSize {
 		return nil
 	}
 
@@ -819,98 +1608,99 @@ func (db *DB) ensureWALExists() (err error) {
 // verify ensures the current shadow WAL state matches where it left off from
 // the real WAL. Returns generation & WAL sync information. If info.reason is
 // not blank, verification failed and a new generation should be started.
+// The decision is made by CheckWALDivergence.
 func (db *DB) verify() (info syncInfo, err error) {
+	state, err := db.walState(&info)
+	if err != nil {
+		return info, err
+	}
+
+	switch d := CheckWALDivergence(state, db.WALDivergencePolicy); d.Action {
+	case DivergenceActionRestart:
+		log.Printf("%s: sync: %s, starting new shadow wal", db.path, d.Reason)
+		info.restart = true
+	case DivergenceActionNewGeneration:
+		info.reason = d.Reason
+	}
+	return info, nil
+}
+
+// walState reads the state of the real & shadow WAL used to verify a sync.
+// File sizes & paths are also recorded in info.
+func (db *DB) walState(info *syncInfo) (*WALState, error) {
 	// Look up existing generation.
 	generation, err := db.CurrentGeneration()
 	if err != nil {
-		return info, fmt.Errorf("cannot find current generation: %w", err)
-	} else if generation == "" {
-		info.reason = "no generation exists"
-		return info, nil
+		return nil, fmt.Errorf("cannot find current generation: %w", err)
+	}
+	state := &WALState{Generation: generation, PageSize: db.pageSize}
+	if generation == "" {
+		return state, nil
 	}
 	info.generation = generation
 
 	// Determine total bytes of real DB for metrics.
-	fi, err := os.Stat(db.Path())
+	fi, err := db.fs().Stat(db.Path())
 	if err != nil {
-		return info, err
+		return nil, err
 	}
 	info.dbModTime = fi.ModTime()
 	db.dbSizeGauge.Set(float64(fi.Size()))
 
 	// Determine total bytes of real WAL.
-	fi, err = os.Stat(db.WALPath())
+	fi, err = db.fs().Stat(db.WALPath())
 	if err != nil {
-		return info, err
+		return nil, err
 	}
 	info.walSize = fi.Size()
 	info.walModTime = fi.ModTime()
 	db.walSizeGauge.Set(float64(fi.Size()))
+	state.WALSize = info.walSize
 
 	// Open shadow WAL to copy append to.
 	index, _, err := db.CurrentShadowWALIndex(info.generation)
 	if err != nil {
-		return info, fmt.Errorf("cannot determine shadow WAL index: %w", err)
-	} else if index >= MaxIndex {
-		info.reason = "max index exceeded"
-		return info, nil
+		return nil, fmt.Errorf("cannot determine shadow WAL index: %w", err)
+	}
+	state.Index = index
+	if index >= MaxIndex {
+		return state, nil
 	}
 	info.shadowWALPath = db.ShadowWALPath(generation, index)
 
 	// Determine shadow WAL current size.
-	fi, err = os.Stat(info.shadowWALPath)
+	fi, err = db.fs().Stat(info.shadowWALPath)
 	if os.IsNotExist(err) {
-		info.reason = "no shadow wal"
-		return info, nil
+		return state, nil
 	} else if err != nil {
-		return info, err
+		return nil, err
 	}
 	info.shadowWALSize = frameAlign(fi.Size(), db.pageSize)
+	state.ShadowWALExists, state.ShadowWALSize = true, info.shadowWALSize
 
-	// Truncate shadow WAL if there is a partial page.
 	// Exit if shadow WAL does not contain a full header.
 	if info.shadowWALSize < WALHeaderSize {
-		info.reason = "short shadow wal"
-		return info, nil
+		return state, nil
 	}
 
-	// If shadow WAL is larger than real WAL then the WAL has been truncated
-	// so we cannot determine our last state.
-	if info.shadowWALSize > info.walSize {
-		info.reason = "wal truncated by another process"
-		return info, nil
+	// Read WAL headers.
+	if state.WALHeader, err = readWALHeader(db.fs(), db.WALPath()); err != nil {
+		return nil, fmt.Errorf("cannot read wal header: %w", err)
+	} else if state.ShadowWALHeader, err = readWALHeader(db.fs(), info.shadowWALPath); err != nil {
+		return nil, fmt.Errorf("cannot read shadow wal header: %w", err)
 	}
 
-	// Compare WAL headers. Start a new shadow WAL if they are mismatched.
-	if hdr0, err := readWALHeader(db.WALPath()); err != nil {
-		return info, fmt.Errorf("cannot read wal header: %w", err)
-	} else if hdr1, err := readWALHeader(info.shadowWALPath); err != nil {
-		return info, fmt.Errorf("cannot read shadow wal header: %w", err)
-	} else if !bytes.Equal(hdr0, hdr1) {
-		info.restart = !bytes.Equal(hdr0, hdr1)
-	}
-
-	// If we only have a header then ensure header matches.
-	// Otherwise we need to start a new generation.
-	if info.shadowWALSize == WALHeaderSize && info.restart {
-		info.reason = "wal header only, mismatched"
-		return info, nil
-	}
-
-	// Verify last page synced still matches.
-	if info.shadowWALSize > WALHeaderSize {
+	// Read last page synced & the same page in the real WAL.
+	if info.shadowWALSize > WALHeaderSize && info.shadowWALSize <= info.walSize {
 		offset := info.shadowWALSize - int64(db.pageSize+WALFrameHeaderSize)
-		if buf0, err := readFileAt(db.WALPath(), offset, int64(db.pageSize+WALFrameHeaderSize)); err != nil {
-			return info, fmt.Errorf("cannot read last synced wal page: %w", err)
-		} else if buf1, err := readFileAt(info.shadowWALPath, offset, int64(db.pageSize+WALFrameHeaderSize)); err != nil {
-			return info, fmt.Errorf("cannot read last synced shadow wal page: %w", err)
-		} else if !bytes.Equal(buf0, buf1) {
-			info.reason = "wal overwritten by another process"
-			return info, nil
+		if state.WALFrame, err = readFileAt(db.fs(), db.WALPath(), offset, int64(db.pageSize+WALFrameHeaderSize)); err != nil {
+			return nil, fmt.Errorf("cannot read last synced wal page: %w", err)
+		} else if state.ShadowWALFrame, err = readFileAt(db.fs(), info.shadowWALPath, offset, int64(db.pageSize+WALFrameHeaderSize)); err != nil {
+			return nil, fmt.Errorf("cannot read last synced shadow wal page: %w", err)
 		}
 	}
 
-	return info, nil
+	return state, nil
 }
 
 type syncInfo struct {
@@ -926,8 +1716,9 @@ type syncInfo struct {
 
 // syncWAL copies pending bytes from the real WAL to the shadow WAL.
 func (db *DB) syncWAL(info syncInfo) (newSize int64, err error) {
-	// Copy WAL starting from end of shadow WAL. Exit if no new shadow WAL needed.
-	newSize, err = db.copyToShadowWAL(info.shadowWALPath)
+	// Copy WAL starting from end of shadow WAL. When fsyncs are batched, the
+	// shadow WAL is fsynced before a restart as it is not fsynced afterward.
+	newSize, err = db.copyToShadowWAL(info.shadowWALPath, info.restart && db.FsyncInterval > 0)
 	if err != nil {
 		return newSize, fmt.Errorf("cannot copy to shadow wal: %w", err)
 	} else if !info.restart {
@@ -940,6 +1731,7 @@ func (db *DB) syncWAL(info syncInfo) (newSize int64, err error) {
 	if err != nil {
 		return 0, fmt.Errorf("cannot parse shadow wal filename: %s", base)
 	}
+	db.markDurable(Pos{Generation: info.generation, Index: index, Offset: newSize})
 
 	// Start a new shadow WAL file with next index.
 	newShadowWALPath := filepath.Join(dir, FormatWALPath(index+1))
@@ -951,7 +1743,7 @@ func (db *DB) syncWAL(info syncInfo) (newSize int64, err error) {
 }
 
 func (db *DB) initShadowWALFile(filename string) (int64, error) {
-	hdr, err := readWALHeader(db.WALPath())
+	hdr, err := readWALHeader(db.fs(), db.WALPath())
 	if err != nil {
 		return 0, fmt.Errorf("read header: %w", err)
 	}
@@ -970,31 +1762,39 @@ func (db *DB) initShadowWALFile(filename string) (int64, error) {
 	}
 
 	// Write header to new WAL shadow file.
-	if err := mkdirAll(filepath.Dir(filename), db.dirmode, db.diruid, db.dirgid); err != nil {
+	if err := db.mkdirMeta(filepath.Dir(filename)); err != nil {
 		return 0, err
-	} else if err := ioutil.WriteFile(filename, hdr, db.mode); err != nil {
+	} else if err := writeFile(db.fs(), filename, hdr, db.metaFileMode()); err != nil {
+		return 0, err
+	} else if err := db.chmodMeta(filename); err != nil {
 		return 0, err
 	}
 	_ = os.Chown(filename, db.uid, db.gid)
 
 	// Copy as much shadow WAL as available.
-	newSize, err := db.copyToShadowWAL(filename)
+	newSize, err := db.copyToShadowWAL(filename, false)
 	if err != nil {
 		return 0, fmt.Errorf("cannot copy to new shadow wal: %w", err)
 	}
 	return newSize, nil
 }
 
-func (db *DB) copyToShadowWAL(filename string) (newSize int64, err error) {
+// copyToShadowWAL copies committed transactions from the real WAL to the end
+// of the shadow WAL. Returns the new size of the shadow WAL.
+//
+// Committed transactions are buffered & written according to the database's
+// shadow WAL flush size and fsync policy. If force is true, the shadow WAL is
+// fsynced regardless of policy.
+func (db *DB) copyToShadowWAL(filename string, force bool) (newSize int64, err error) {
 	Tracef("%s: copy-shadow: %s", db.path, filename)
 
-	r, err := os.Open(db.WALPath())
+	r, err := db.fs().Open(db.WALPath())
 	if err != nil {
 		return 0, err
 	}
 	defer r.Close()
 
-	w, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	w, err := db.fs().OpenFile(filename, os.O_RDWR, 0666)
 	if err != nil {
 		return 0, err
 	}
@@ -1006,6 +1806,11 @@ func (db *DB) copyToShadowWAL(filename string) (newSize int64, err error) {
 	}
 	origSize := frameAlign(fi.Size(), db.pageSize)
 
+	// Track pages written by copied frames, even if the copy fails part way,
+	// so incremental snapshots never miss a changed page.
+	var pgnos []uint32
+	defer func() { db.recordPages(filename, origSize, pgnos) }()
+
 	// Read shadow WAL header to determine byte order for checksum & salt.
 	hdr := make([]byte, WALHeaderSize)
 	if _, err := io.ReadFull(w, hdr); err != nil {
@@ -1025,6 +1830,14 @@ func (db *DB) copyToShadowWAL(filename string) (newSize int64, err error) {
 		return 0, fmt.Errorf("last checksum: %w", err)
 	}
 
+	// Determine the frame-aligned size of the real WAL. Frames appended after
+	// this point are copied on the next sync.
+	rfi, err := r.Stat()
+	if err != nil {
+		return 0, err
+	}
+	walSize := frameAlign(rfi.Size(), db.pageSize)
+
 	// Seek to correct position on real wal.
 	if _, err := r.Seek(origSize, io.SeekStart); err != nil {
 		return 0, fmt.Errorf("real wal seek: %w", err)
@@ -1035,12 +1848,16 @@ func (db *DB) copyToShadowWAL(filename string) (newSize int64, err error) {
 	// Read through WAL from last position to find the page of the last
 	// committed transaction.
 	frame := make([]byte, db.pageSize+WALFrameHeaderSize)
+	rd := bufio.NewReaderSize(io.LimitReader(r, walSize-origSize), db.walReadChunkSize())
 	var buf bytes.Buffer
+	sw := NewShadowWALWriter(w, db.ShadowWALFlushSize, db.shadowWALSyncMode())
 	offset := origSize
 	lastCommitSize := origSize
+	var commits []CommitTime
+	now := time.Now()
 	for {
 		// Read next page from WAL file.
-		if _, err := io.ReadFull(r, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+		if _, err := io.ReadFull(rd, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
 			Tracef("%s: copy-shadow: break %s @ %d; err=%s", db.path, filename, offset, err)
 			break // end of file or partial page
 		} else if err != nil {
@@ -1061,40 +1878,66 @@ func (db *DB) copyToShadowWAL(filename string) (newSize int64, err error) {
 		chksum0, chksum1 = Checksum(bo, chksum0, chksum1, frame[:8])  // frame header
 		chksum0, chksum1 = Checksum(bo, chksum0, chksum1, frame[24:]) // frame data
 		if chksum0 != fchksum0 || chksum1 != fchksum1 {
-			log.Printf("copy shadow: checksum mismatch, skipping: offset=%d (%x,%x) != (%x,%x)", offset, chksum0, chksum1, fchksum0, fchksum1)
+			// A frame with a matching salt but an invalid checksum is still
+			// being written or was torn. Stop before its transaction so the
+			// frame is read again on the next sync.
+			log.Printf("%s: copy shadow: incomplete frame, retrying next sync: offset=%d (%x,%x) != (%x,%x)", db.path, offset, chksum0, chksum1, fchksum0, fchksum1)
+			db.tornFrameNCounter.Inc()
 			break
 		}
 
 		// Add page to the new size of the shadow WAL.
 		buf.Write(frame)
+		if db.IncrementalSnapshots {
+			pgnos = append(pgnos, binary.BigEndian.Uint32(frame[0:]))
+		}
 
 		Tracef("%s: copy-shadow: ok %s offset=%d salt=%x %x", db.path, filename, offset, salt0, salt1)
 		offset += int64(len(frame))
 
-		// Flush to shadow WAL if commit record.
+		// Pass transaction to shadow WAL writer if commit record.
 		newDBSize := binary.BigEndian.Uint32(frame[4:])
 		if newDBSize != 0 {
-			if _, err := buf.WriteTo(w); err != nil {
-				return 0, fmt.Errorf("write shadow wal: %w", err)
+			if err := sw.WriteTx(buf.Bytes()); err != nil {
+				return 0, err
 			}
 			buf.Reset()
 			lastCommitSize = offset
+
+			if db.CommitTimeIndex {
+				commits = append(commits, CommitTime{Offset: offset, Timestamp: now})
+			}
 		}
 	}
 
-	// Sync & close.
-	if err := w.Sync(); err != nil {
+	// Write remaining transactions, sync & close.
+	if err := sw.Close(force); err != nil {
 		return 0, err
 	} else if err := w.Close(); err != nil {
 		return 0, err
 	}
 
+	// Record commit times once the transactions are in the shadow WAL.
+	if err := db.appendShadowCommitTimes(filename, origSize, commits); err != nil {
+		return 0, fmt.Errorf("cannot record commit times: %w", err)
+	}
+
 	// Track total number of bytes written to WAL.
 	db.totalWALBytesCounter.Add(float64(lastCommitSize - origSize))
+	db.snapshotSchedule.size += lastCommitSize - origSize
 
 	return lastCommitSize, nil
 }
 
+// walReadChunkSize returns the frame-aligned size of reads from the WAL.
+func (db *DB) walReadChunkSize() int {
+	frameSize := db.pageSize + WALFrameHeaderSize
+	if db.WALReadChunkSize <= frameSize {
+		return frameSize
+	}
+	return db.WALReadChunkSize - (db.WALReadChunkSize % frameSize)
+}
+
 // ShadowWALReader opens a reader for a shadow WAL file at a given position.
 // If the reader is at the end of the file, it attempts to return the next file.
 //
@@ -1110,21 +1953,29 @@ func (db *DB) ShadowWALReader(pos Pos) (r *ShadowWALReader, err error) {
 		return nil, err
 	}
 
-	// Otherwise attempt to read the start of the next WAL file.
+	// Otherwise attempt to read the start of the next WAL file. Report EOF if
+	// it has no readable data yet.
 	pos.Index, pos.Offset = pos.Index+1, 0
 
 	r, err = db.shadowWALReader(pos)
 	if os.IsNotExist(err) {
 		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	} else if r.N() == 0 {
+		if err := r.Close(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
 	}
-	return r, err
+	return r, nil
 }
 
 // shadowWALReader opens a file reader for a shadow WAL file at a given position.
 func (db *DB) shadowWALReader(pos Pos) (r *ShadowWALReader, err error) {
 	filename := db.ShadowWALPath(pos.Generation, pos.Index)
 
-	f, err := os.Open(filename)
+	f, err := db.fs().Open(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -1147,6 +1998,23 @@ func (db *DB) shadowWALReader(pos Pos) (r *ShadowWALReader, err error) {
 		return nil, fmt.Errorf("wal reader offset too high: %d > %d", pos.Offset, fi.Size())
 	}
 
+	// Only read frames which have been fsynced, if fsyncs are batched.
+	if end, ok := db.durableOffset(pos); ok && end < fileSize {
+		if fileSize = end; fileSize < pos.Offset {
+			fileSize = pos.Offset
+		}
+	}
+
+	// Share bytes read from the file between replicas, if there are several.
+	if len(db.ReplicaList()) > 1 && db.ShadowWALCacheSize > 0 {
+		buf, err := db.walCache.read(f, pos, fileSize, int64(db.ShadowWALCacheSize))
+		if err != nil {
+			return nil, err
+		} else if buf != nil {
+			return &ShadowWALReader{f: f, buf: buf, n: int64(len(buf)), pos: pos}, nil
+		}
+	}
+
 	// Move file handle to offset position.
 	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
 		return nil, err
@@ -1176,7 +2044,8 @@ func frameAlign(offset int64, pageSize int) int64 {
 
 // ShadowWALReader represents a reader for a shadow WAL file that tracks WAL position.
 type ShadowWALReader struct {
-	f   *os.File
+	f   File
+	buf []byte // cached bytes, read instead of f if set
 	n   int64
 	pos Pos
 }
@@ -1202,7 +2071,11 @@ func (r *ShadowWALReader) Read(p []byte) (n int, err error) {
 	if int64(len(p)) > r.n {
 		p = p[0:r.n]
 	}
-	n, err = r.f.Read(p)
+	if r.buf != nil {
+		n = copy(p, r.buf[int64(len(r.buf))-r.n:])
+	} else {
+		n, err = r.f.Read(p)
+	}
 	r.n -= int64(n)
 	r.pos.Offset += int64(n)
 	return n, err
@@ -1214,7 +2087,7 @@ const (
 	WALFrameHeaderChecksumOffset = 16
 )
 
-func readLastChecksumFrom(f *os.File, pageSize int) (uint32, uint32, error) {
+func readLastChecksumFrom(f File, pageSize int) (uint32, uint32, error) {
 	// Determine the byte offset of the checksum for the header (if no pages
 	// exist) or for the last page (if at least one page exists).
 	offset := int64(WALHeaderChecksumOffset)
@@ -1234,17 +2107,52 @@ func readLastChecksumFrom(f *os.File, pageSize int) (uint32, uint32, error) {
 	return binary.BigEndian.Uint32(b[0:]), binary.BigEndian.Uint32(b[4:]), nil
 }
 
-// Checkpoint performs a checkpoint on the WAL file.
-func (db *DB) Checkpoint(mode string) (err error) {
+// Checkpoint copies pending data from the WAL to the shadow WAL & then
+// performs a checkpoint on the WAL file with the given mode. The database lock
+// is held throughout so a checkpoint never races a background sync. Returns
+// the number of frames checkpointed as reported by SQLite.
+func (db *DB) Checkpoint(ctx context.Context, mode string) (n int, err error) {
+	if !IsCheckpointMode(mode) {
+		return 0, fmt.Errorf("invalid checkpoint mode: %q", mode)
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.checkpoint(mode)
+
+	// Sync first so the shadow WAL has every frame before it is verified.
+	if err := db.sync(); err != nil {
+		return 0, fmt.Errorf("sync: %w", err)
+	} else if db.db == nil {
+		return 0, nil
+	}
+
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		return 0, fmt.Errorf("cannot find current generation: %w", err)
+	} else if generation == "" {
+		return 0, fmt.Errorf("no current generation")
+	}
+
+	if n, err = db.checkpointAndInit(ctx, generation, mode); err != nil {
+		return n, fmt.Errorf("checkpoint: mode=%v err=%w", mode, err)
+	}
+	db.backfilled = false
+
+	// Notify replicas as the WAL may have been restarted.
+	db.markWALChanged(time.Now())
+	db.updateReplicaLagMetrics()
+	close(db.notify)
+	db.notify = make(chan struct{})
+
+	return n, nil
 }
 
-func (db *DB) checkpoint(mode string) (err error) {
+// checkpoint performs a checkpoint on the WAL file. Returns the number of
+// frames checkpointed.
+func (db *DB) checkpoint(ctx context.Context, mode string) (n int, err error) {
 	// Ignore if there is no underlying database.
 	if db.db == nil {
-		return nil
+		return 0, nil
 	}
 
 	// Track checkpoint metrics.
@@ -1261,12 +2169,12 @@ func (db *DB) checkpoint(mode string) (err error) {
 	// Ensure the read lock has been removed before issuing a checkpoint.
 	// We defer the re-acquire to ensure it occurs even on an early return.
 	if err := db.releaseReadLock(); err != nil {
-		return fmt.Errorf("release read lock: %w", err)
+		return 0, fmt.Errorf("release read lock: %w", err)
 	}
 	defer func() { _ = db.acquireReadLock() }()
 
-	// A non-forced checkpoint is issued as "PASSIVE". This will only checkpoint
-	// if there are not pending transactions. A forced checkpoint ("RESTART")
+	// A non-forced checkpoint is issued as "PASSIVE" by default. This will only
+	// checkpoint if there are not pending transactions. A forced checkpoint ("RESTART")
 	// will wait for pending transactions to end & block new transactions before
 	// forcing the checkpoint and restarting the WAL.
 	//
@@ -1274,70 +2182,146 @@ func (db *DB) checkpoint(mode string) (err error) {
 	rawsql := `PRAGMA wal_checkpoint(` + mode + `);`
 
 	var row [3]int
-	if err := db.db.QueryRow(rawsql).Scan(&row[0], &row[1], &row[2]); err != nil {
-		return err
+	db.checkpointMu.Lock()
+	err = db.db.QueryRowContext(ctx, rawsql).Scan(&row[0], &row[1], &row[2])
+	db.checkpointMu.Unlock()
+	if err != nil {
+		return 0, err
 	}
 	Tracef("%s: checkpoint: mode=%v (%d,%d,%d)", db.path, mode, row[0], row[1], row[2])
+	db.trackCheckpointBusy(mode, row)
 
 	// Reacquire the read lock immediately after the checkpoint.
 	if err := db.acquireReadLock(); err != nil {
-		return fmt.Errorf("release read lock: %w", err)
+		return row[2], fmt.Errorf("release read lock: %w", err)
 	}
 
-	return nil
+	return row[2], nil
 }
 
 // checkpointAndInit performs a checkpoint on the WAL file and initializes a
-// new shadow WAL file.
-func (db *DB) checkpointAndInit(generation, mode string) error {
+// new shadow WAL file. Returns the number of frames checkpointed.
+func (db *DB) checkpointAndInit(ctx context.Context, generation, mode string) (n int, err error) {
 	shadowWALPath, err := db.CurrentShadowWALPath(generation)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Read WAL header before checkpoint to check if it has been restarted.
-	hdr, err := readWALHeader(db.WALPath())
+	hdr, err := readWALHeader(db.fs(), db.WALPath())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Copy shadow WAL before checkpoint to copy as much as possible.
-	if _, err := db.copyToShadowWAL(shadowWALPath); err != nil {
-		return fmt.Errorf("cannot copy to end of shadow wal before checkpoint: %w", err)
+	// Parse index of current shadow WAL file.
+	index, _, _, err := ParseWALPath(shadowWALPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse shadow wal filename: %s", shadowWALPath)
 	}
 
+	// Copy shadow WAL before checkpoint to copy as much as possible. The copy
+	// is always fsynced as the real WAL may be overwritten after checkpoint.
+	size, err := db.copyToShadowWAL(shadowWALPath, true)
+	if err != nil {
+		return 0, fmt.Errorf("cannot copy to end of shadow wal before checkpoint: %w", err)
+	}
+	db.markDurable(Pos{Generation: generation, Index: index, Offset: size})
+
 	// Execute checkpoint and immediately issue a write to the WAL to ensure
 	// a new page is written.
-	if err := db.checkpoint(mode); err != nil {
-		return err
+	if n, err = db.checkpoint(ctx, mode); err != nil {
+		return n, err
 	} else if _, err = db.db.Exec(`INSERT INTO _litestream_seq (id, seq) VALUES (1, 1) ON CONFLICT (id) DO UPDATE SET seq = seq + 1`); err != nil {
-		return err
+		return n, err
 	}
 
 	// If WAL hasn't been restarted, exit.
-	if other, err := readWALHeader(db.WALPath()); err != nil {
-		return err
+	if other, err := readWALHeader(db.fs(), db.WALPath()); err != nil {
+		return n, err
 	} else if bytes.Equal(hdr, other) {
-		return nil
+		return n, nil
 	}
 
 	// Copy the end of the previous WAL before starting a new shadow WAL.
-	if _, err := db.copyToShadowWAL(shadowWALPath); err != nil {
-		return fmt.Errorf("cannot copy to end of shadow wal: %w", err)
-	}
-
-	// Parse index of current shadow WAL file.
-	index, _, _, err := ParseWALPath(shadowWALPath)
-	if err != nil {
-		return fmt.Errorf("cannot parse shadow wal filename: %s", shadowWALPath)
+	if size, err = db.copyToShadowWAL(shadowWALPath, true); err != nil {
+		return n, fmt.Errorf("cannot copy to end of shadow wal: %w", err)
 	}
+	db.markDurable(Pos{Generation: generation, Index: index, Offset: size})
 
 	// Start a new shadow WAL file with next index.
 	newShadowWALPath := filepath.Join(filepath.Dir(shadowWALPath), FormatWALPath(index+1))
 	if _, err := db.initShadowWALFile(newShadowWALPath); err != nil {
-		return fmt.Errorf("cannot init shadow wal file: name=%s err=%w", newShadowWALPath, err)
+		return n, fmt.Errorf("cannot init shadow wal file: name=%s err=%w", newShadowWALPath, err)
 	}
 
+	return n, nil
+}
+
+// requestCheckpoint signals the background checkpointer to backfill the WAL
+// through frameN. A request is dropped if one is already pending.
+func (db *DB) requestCheckpoint(frameN int) {
+	select {
+	case db.checkpointCh <- frameN:
+	default:
+	}
+}
+
+// checkpointer runs in a separate goroutine and issues passive checkpoints
+// requested by Sync.
+func (db *DB) checkpointer() {
+	for {
+		var frameN int
+		select {
+		case <-db.ctx.Done():
+			return
+		case frameN = <-db.checkpointCh:
+		}
+
+		if err := db.backgroundCheckpoint(frameN); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("%s: background checkpoint error: %s", db.path, err)
+		}
+	}
+}
+
+// backgroundCheckpoint issues a passive checkpoint without holding the
+// database lock. The read lock is held throughout so only frames which have
+// already been copied to the shadow WAL are backfilled & the WAL cannot be
+// restarted until the next sync.
+//
+// Frames after the read lock are expected to remain so the checkpoint is
+// complete once frameN frames are backfilled. Busy checkpoints are not
+// tracked as the read lock always prevents a full checkpoint.
+func (db *DB) backgroundCheckpoint(frameN int) (err error) {
+	db.mu.RLock()
+	sqldb := db.db
+	db.mu.RUnlock()
+	if sqldb == nil {
+		return nil
+	}
+
+	// Track checkpoint metrics.
+	t := time.Now()
+	defer func() {
+		labels := prometheus.Labels{"mode": CheckpointModePassive}
+		db.checkpointNCounterVec.With(labels).Inc()
+		if err != nil {
+			db.checkpointErrorNCounterVec.With(labels).Inc()
+		}
+		db.checkpointSecondsCounterVec.With(labels).Add(float64(time.Since(t).Seconds()))
+	}()
+
+	var row [3]int
+	db.checkpointMu.Lock()
+	err = sqldb.QueryRowContext(db.ctx, `PRAGMA wal_checkpoint(PASSIVE);`).Scan(&row[0], &row[1], &row[2])
+	db.checkpointMu.Unlock()
+	if err != nil {
+		return err
+	}
+	Tracef("%s: background checkpoint: (%d,%d,%d)", db.path, row[0], row[1], row[2])
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.backfilled = row[0] == 0 && row[2] >= frameN
 	return nil
 }
 
@@ -1346,17 +2330,44 @@ func (db *DB) monitor() {
 	ticker := time.NewTicker(db.MonitorInterval)
 	defer ticker.Stop()
 
+	// Check for changes to priority tables more frequently, if specified.
+	var priorityCh <-chan time.Time
+	if len(db.PriorityTables) > 0 && db.PriorityInterval > 0 {
+		priorityTicker := time.NewTicker(db.PriorityInterval)
+		defer priorityTicker.Stop()
+		priorityCh = priorityTicker.C
+	}
+
 	for {
 		// Wait for ticker or context close.
+		var priority bool
 		select {
 		case <-db.ctx.Done():
 			return
 		case <-ticker.C:
+		case <-priorityCh:
+			changed, err := db.priorityTablesChanged()
+			if err != nil {
+				log.Printf("%s: priority check error: %s", db.path, err)
+				continue
+			} else if !changed {
+				continue
+			}
+			priority = true
 		}
 
 		// Sync the database to the shadow WAL.
 		if err := db.Sync(); err != nil && !errors.Is(err, context.Canceled) {
 			log.Printf("%s: sync error: %s", db.path, err)
+			continue
+		}
+
+		// Notify replicas that a priority change is available.
+		if priority {
+			db.mu.Lock()
+			close(db.priorityNotify)
+			db.priorityNotify = make(chan struct{})
+			db.mu.Unlock()
 		}
 	}
 }
@@ -1375,6 +2386,20 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 		return fmt.Errorf("must specify generation when restoring to index")
 	} else if opt.Index != math.MaxInt64 && !opt.Timestamp.IsZero() {
 		return fmt.Errorf("cannot specify index & timestamp to restore")
+	} else if opt.Marker != "" && opt.Generation == "" {
+		return fmt.Errorf("must specify generation when restoring to marker")
+	} else if opt.Marker != "" && opt.DryRun {
+		return fmt.Errorf("cannot perform dry run when restoring to marker")
+	} else if opt.Offset != 0 && opt.Index == math.MaxInt64 {
+		return fmt.Errorf("must specify index when restoring to offset")
+	} else if opt.Offset != 0 && opt.Offset < WALHeaderSize {
+		return fmt.Errorf("invalid offset: %d", opt.Offset)
+	} else if opt.Offset != 0 && opt.Marker != "" {
+		return fmt.Errorf("cannot specify offset & marker to restore")
+	} else if opt.RecommendedPageSize != 0 && !isValidPageSize(opt.RecommendedPageSize) {
+		return fmt.Errorf("invalid recommended page size: %d", opt.RecommendedPageSize)
+	} else if opt.ConvertPageSize && opt.RecommendedPageSize == 0 {
+		return fmt.Errorf("must specify recommended page size when converting page size")
 	}
 
 	// Ensure logger exists.
@@ -1388,79 +2413,212 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 		logPrefix = fmt.Sprintf("%s(%s)", db.Path(), r.Name())
 	}
 
-	// Ensure output path does not already exist (unless this is a dry run).
-	if !opt.DryRun {
-		if _, err := os.Stat(opt.OutputPath); err == nil {
-			return fmt.Errorf("cannot restore, output path already exists: %s", opt.OutputPath)
-		} else if err != nil && !os.IsNotExist(err) {
+	// Only report the plan on a dry run. No data is read or written.
+	if opt.DryRun {
+		plan, err := CalcRestorePlan(ctx, r, opt)
+		if err != nil {
 			return err
 		}
+		logRestorePlan(plan, opt, logger, logPrefix)
+		return nil
 	}
 
-	// Find lastest snapshot that occurs before timestamp.
-	minWALIndex, err := SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp)
-	if err != nil {
-		return fmt.Errorf("cannot find snapshot index for restore: %w", err)
+	// Prevent retention from deleting the generation during the restore.
+	defer acquireRestoreLease(r, opt.Generation)()
+
+	// Ensure output path does not already exist, unless overwriting.
+	if fi, err := os.Stat(opt.OutputPath); err == nil && !opt.Overwrite {
+		return fmt.Errorf("cannot restore, output path already exists: %s", opt.OutputPath)
+	} else if err == nil && !fi.Mode().IsRegular() {
+		return fmt.Errorf("cannot overwrite, output path is not a regular file: %s", opt.OutputPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	// Find the maximum WAL index that occurs before timestamp.
-	maxWALIndex, err := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp)
+	// Restoring to a marker requires evaluating the marker table as WAL is applied.
+	if opt.Marker != "" {
+		return restoreReplicaToMarker(ctx, r, opt, logger, logPrefix)
+	}
+
+	// Determine the snapshot & WAL files to apply.
+	minWALIndex, maxWALIndex, err := calcRestoreRange(ctx, r, &opt)
 	if err != nil {
-		return fmt.Errorf("cannot find max wal index for restore: %w", err)
+		return err
 	}
-	logger.Printf("%s: starting restore: generation %s, index %08x-%08x", logPrefix, opt.Generation, minWALIndex, maxWALIndex)
+
+	// Restoring to an exact position only applies part of the last WAL file.
+	if opt.Offset != 0 {
+		return restoreReplicaToOffset(ctx, r, opt, minWALIndex, logger, logPrefix)
+	}
+	reportRestorePlan(ctx, r, opt, minWALIndex, maxWALIndex, logger, logPrefix)
 
 	// Initialize starting position.
 	pos := Pos{Generation: opt.Generation, Index: minWALIndex}
-	tmpPath := opt.OutputPath + ".tmp"
+	tmpPath := restoreTempPath(opt, ".tmp")
+	defer func() { _ = removeDBFiles(tmpPath) }()
+	progress := newRestoreProgress(ctx, r, opt.Generation, minWALIndex, maxWALIndex, opt.Progress)
 
 	// Copy snapshot to output path.
 	logger.Printf("%s: restoring snapshot %s/%08x to %s", logPrefix, opt.Generation, minWALIndex, tmpPath)
-	if !opt.DryRun {
-		if err := restoreSnapshot(ctx, r, pos.Generation, pos.Index, tmpPath); err != nil {
-			return fmt.Errorf("cannot restore snapshot: %w", err)
-		}
+	if err := restoreSnapshot(ctx, r, pos.Generation, pos.Index, tmpPath); err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
 	}
+	progress.addSnapshot()
 
 	// Restore each WAL file until we reach our maximum index.
 	for index := minWALIndex; index <= maxWALIndex; index++ {
-		if !opt.DryRun {
-			if err = restoreWAL(ctx, r, opt.Generation, index, tmpPath); os.IsNotExist(err) && index == minWALIndex && index == maxWALIndex {
-				logger.Printf("%s: no wal available, snapshot only", logPrefix)
-				break // snapshot file only, ignore error
-			} else if err != nil {
-				return fmt.Errorf("cannot restore wal: %w", err)
+		err = restoreWAL(ctx, r, opt.Generation, index, tmpPath, opt.ValidateWALSalt)
+
+		// The last WAL file may not be readable yet on eventually consistent
+		// storage so retry a few times before failing the restore.
+		if errors.Is(err, os.ErrNotExist) && index == maxWALIndex && index != minWALIndex {
+			if maxWALIndex, err = retryRestoreWAL(ctx, r, opt, index, maxWALIndex, tmpPath, logger, logPrefix); ctx.Err() != nil {
+				return ctx.Err()
 			}
 		}
 
+		if errors.Is(err, os.ErrNotExist) && index == minWALIndex && index == maxWALIndex {
+			logger.Printf("%s: no wal available, snapshot only", logPrefix)
+			break // snapshot file only, ignore error
+		} else if err != nil && opt.FallbackOnCorruption && ctx.Err() == nil {
+			// Discard the failed WAL and keep the database as of the
+			// previous index. Report how much data was not restored.
+			if e := removeWALFiles(tmpPath); e != nil {
+				return fmt.Errorf("cannot remove failed wal: %w", e)
+			}
+			logger.Printf("%s: cannot restore wal %s/%08x, falling back to previous position: %s", logPrefix, opt.Generation, index, err)
+			logger.Printf("%s: data loss: restored through %s, %d wal file(s) not applied (%08x-%08x)", logPrefix, restoredThrough(minWALIndex, index), maxWALIndex-index+1, index, maxWALIndex)
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot restore wal: %w", err)
+		}
+
 		if opt.Verbose {
 			logger.Printf("%s: restored wal %s/%08x", logPrefix, opt.Generation, index)
 		}
+		progress.addWAL(index)
+	}
+
+	// Check page size & journal mode before moving the database into place.
+	if err := finalizeRestore(ctx, tmpPath, opt, logger, logPrefix); err != nil {
+		return err
 	}
 
 	// Copy file to final location.
-	logger.Printf("%s: renaming database from temporary location", logPrefix)
-	if !opt.DryRun {
-		if err := os.Rename(tmpPath, opt.OutputPath); err != nil {
-			return err
+	return installRestoredDB(ctx, tmpPath, opt, logger, logPrefix)
+}
+
+// retryRestoreWAL retries restoring the WAL file at index up to opt.WALRetryN
+// times. The WAL files of the generation are listed again before each retry
+// & the new maximum index to restore is returned, as files written after the
+// previous listing may have become visible too.
+func retryRestoreWAL(ctx context.Context, r Replica, opt RestoreOptions, index, maxWALIndex int, dbPath string, logger *log.Logger, logPrefix string) (int, error) {
+	err := error(os.ErrNotExist)
+	for i := 0; errors.Is(err, os.ErrNotExist) && i < opt.WALRetryN; i++ {
+		logger.Printf("%s: wal %s/%08x not found, retrying in %s", logPrefix, opt.Generation, index, opt.WALRetryDelay)
+		select {
+		case <-ctx.Done():
+			return maxWALIndex, ctx.Err()
+		case <-time.After(opt.WALRetryDelay):
 		}
+
+		if max, e := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp); e != nil {
+			return maxWALIndex, fmt.Errorf("cannot find max wal index for restore: %w", e)
+		} else if max > maxWALIndex {
+			maxWALIndex = max
+		}
+		err = restoreWAL(ctx, r, opt.Generation, index, dbPath, opt.ValidateWALSalt)
 	}
+	return maxWALIndex, err
+}
 
+// calcRestoreRange returns the index of the snapshot & the maximum WAL index
+// to restore with opt. If commit times are recorded, a timestamp is resolved to
+// the last commit before it by setting the index & offset of opt.
+func calcRestoreRange(ctx context.Context, r Replica, opt *RestoreOptions) (minWALIndex, maxWALIndex int, err error) {
+	// Restoring to an exact position uses the latest snapshot before it.
+	if opt.Offset != 0 {
+		if minWALIndex, err = snapshotIndexBefore(ctx, r, opt.Generation, opt.Index); err != nil {
+			return 0, 0, fmt.Errorf("cannot find snapshot index for restore: %w", err)
+		}
+		return minWALIndex, opt.Index, nil
+	}
+
+	// Find lastest snapshot that occurs before timestamp.
+	if minWALIndex, err = SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp); err != nil {
+		return 0, 0, fmt.Errorf("cannot find snapshot index for restore: %w", err)
+	}
+
+	// Find the maximum WAL index that occurs before timestamp.
+	if maxWALIndex, err = WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp); err != nil {
+		return 0, 0, fmt.Errorf("cannot find max wal index for restore: %w", err)
+	}
+
+	// Resolve the timestamp to the last commit before it, if recorded.
+	if !opt.Timestamp.IsZero() {
+		if index, offset, ok, err := commitOffsetAt(ctx, r, opt.Generation, maxWALIndex, opt.Timestamp); err != nil {
+			return 0, 0, fmt.Errorf("cannot read commit times: %w", err)
+		} else if ok {
+			opt.Index, opt.Offset = index, offset
+			return minWALIndex, index, nil
+		}
+	}
+	return minWALIndex, maxWALIndex, nil
+}
+
+// restoredThrough returns a description of the last position restored when
+// falling back from the WAL at failedIndex.
+func restoredThrough(minWALIndex, failedIndex int) string {
+	if failedIndex == minWALIndex {
+		return fmt.Sprintf("snapshot %08x", minWALIndex)
+	}
+	return fmt.Sprintf("wal %08x", failedIndex-1)
+}
+
+// removeWALFiles removes the WAL & shared memory files of a database.
+func removeWALFiles(dbPath string) error {
+	for _, filename := range []string{dbPath + "-wal", dbPath + "-shm"} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-func checksumFile(filename string) (uint64, error) {
+// integrityChecksumFile returns the hex-encoded checksum of a file using the
+// named integrity hash algorithm.
+func integrityChecksumFile(name, filename string) (string, error) {
+	h, err := NewIntegrityHash(name)
+	if err != nil {
+		return "", err
+	} else if err := hashFile(h, filename); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the contents of a file to h. The file is read through a
+// single fixed-size buffer so only ChecksumBufferSize bytes are allocated
+// regardless of the file size.
+func hashFile(h hash.Hash, filename string) error {
 	f, err := os.Open(filename)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	defer f.Close()
 
-	h := crc64.New(crc64.MakeTable(crc64.ISO))
-	if _, err := io.Copy(h, f); err != nil {
-		return 0, err
+	// Read directly instead of using io.Copy() as *os.File implements
+	// io.WriterTo which may bypass a caller-provided buffer.
+	buf := make([]byte, ChecksumBufferSize)
+	for {
+		n, err := f.Read(buf)
+		_, _ = h.Write(buf[:n])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
 	}
-	return h.Sum64(), nil
 }
 
 // CalcRestoreTarget returns a replica & generation to restore from based on opt criteria.
@@ -1471,28 +2629,36 @@ func (db *DB) CalcRestoreTarget(ctx context.Context, opt RestoreOptions) (Replic
 		stats      GenerationStats
 	}
 
-	for _, r := range db.Replicas {
-		// Skip replica if it does not match filter.
-		if opt.ReplicaName != "" && r.Name() != opt.ReplicaName {
-			continue
-		}
+	for _, parent := range db.ReplicaList() {
+		for _, r := range restoreCandidates(parent) {
+			// Skip replica if it does not match filter. Filtering by the name
+			// of a failover replica includes all of its clients.
+			if opt.ReplicaName != "" && r.Name() != opt.ReplicaName && parent.Name() != opt.ReplicaName {
+				continue
+			}
 
-		generation, stats, err := CalcReplicaRestoreTarget(ctx, r, opt)
-		if err != nil {
-			return nil, "", err
-		}
+			generation, stats, err := CalcReplicaRestoreTarget(ctx, r, opt)
+			if err != nil {
+				return nil, "", err
+			}
 
-		// Use the latest replica if we have multiple candidates.
-		if !stats.UpdatedAt.After(target.stats.UpdatedAt) {
-			continue
-		}
+			// Use the latest replica if we have multiple candidates.
+			if !stats.UpdatedAt.After(target.stats.UpdatedAt) {
+				continue
+			}
 
-		target.replica, target.generation, target.stats = r, generation, stats
+			target.replica, target.generation, target.stats = r, generation, stats
+		}
 	}
 	return target.replica, target.generation, nil
 }
 
 // CalcReplicaRestoreTarget returns a generation to restore from.
+//
+// If no generation is specified, the generation with the latest data is used
+// unless it has no snapshot to restore from, such as a generation whose first
+// snapshot is still uploading, in which case the next latest is used. Skipped
+// generations are logged to opt.Logger.
 func CalcReplicaRestoreTarget(ctx context.Context, r Replica, opt RestoreOptions) (generation string, stats GenerationStats, err error) {
 	var target struct {
 		generation string
@@ -1504,6 +2670,16 @@ func CalcReplicaRestoreTarget(ctx context.Context, r Replica, opt RestoreOptions
 		return "", stats, fmt.Errorf("cannot fetch generations: %w", err)
 	}
 
+	// Determine which generations have a snapshot to restore from.
+	var restorable map[string]struct{}
+	var skipped []string
+	var skippedAt []time.Time
+	if opt.Generation == "" {
+		if restorable, err = restorableGenerations(ctx, r, opt.Timestamp); err != nil {
+			return "", stats, err
+		}
+	}
+
 	// Search generations for one that contains the requested timestamp.
 	for _, generation := range generations {
 		// Skip generation if it does not match filter.
@@ -1524,6 +2700,14 @@ func CalcReplicaRestoreTarget(ctx context.Context, r Replica, opt RestoreOptions
 			}
 		}
 
+		// Skip if it cannot be restored, but report it if it has later data.
+		if restorable != nil {
+			if _, ok := restorable[generation]; !ok {
+				skipped, skippedAt = append(skipped, generation), append(skippedAt, stats.UpdatedAt)
+				continue
+			}
+		}
+
 		// Use the latest replica if we have multiple candidates.
 		if !stats.UpdatedAt.After(target.stats.UpdatedAt) {
 			continue
@@ -1533,9 +2717,339 @@ func CalcReplicaRestoreTarget(ctx context.Context, r Replica, opt RestoreOptions
 		target.stats = stats
 	}
 
+	// Report newer generations which were skipped in favor of the target.
+	if opt.Logger != nil {
+		for i, generation := range skipped {
+			if !skippedAt[i].After(target.stats.UpdatedAt) {
+				continue
+			} else if target.generation == "" {
+				opt.Logger.Printf("%s: skipping generation %s, no usable snapshot", r.Name(), generation)
+			} else {
+				opt.Logger.Printf("%s: skipping generation %s, no usable snapshot, using generation %s", r.Name(), generation, target.generation)
+			}
+		}
+	}
+
 	return target.generation, target.stats, nil
 }
 
+// restorableGenerations returns the set of generations in r with a snapshot
+// created at or before timestamp. If timestamp is zero, any snapshot is used.
+func restorableGenerations(ctx context.Context, r Replica, timestamp time.Time) (map[string]struct{}, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch snapshots: %w", err)
+	}
+
+	m := make(map[string]struct{})
+	for _, snapshot := range snapshots {
+		if !timestamp.IsZero() && snapshot.CreatedAt.After(timestamp) {
+			continue
+		}
+		m[snapshot.Generation] = struct{}{}
+	}
+	return m, nil
+}
+
+// finalizeRestore applies post-restore checks to the restored database at
+// filename before it is renamed to the output path.
+func finalizeRestore(ctx context.Context, filename string, opt RestoreOptions, logger *log.Logger, logPrefix string) error {
+	if err := checkRestorePageSize(ctx, filename, opt, logger, logPrefix); err != nil {
+		return err
+	}
+
+	if opt.Deterministic {
+		if err := normalizeDB(ctx, filename); err != nil {
+			return fmt.Errorf("cannot normalize database: %w", err)
+		}
+	}
+
+	if !opt.EnableWAL {
+		// The file format version bytes are set to 2 for WAL mode databases.
+		if hdr, err := readDBHeader(filename); err != nil {
+			return err
+		} else if hdr[18] != 2 || hdr[19] != 2 {
+			logger.Printf("%s: restored database is not in wal mode, run \"PRAGMA journal_mode = wal;\" before replicating", logPrefix)
+		}
+		return nil
+	}
+	if err := enableWAL(ctx, filename); err != nil {
+		return fmt.Errorf("cannot enable wal: %w", err)
+	}
+	return nil
+}
+
+// installRestoredDB moves the restored database at tmpPath to the output path.
+// The temporary file is in the same directory so the rename is atomic.
+//
+// If opt.Overwrite is set, the restored database is checked & fsynced before
+// it replaces an existing database so a failed restore never clobbers it. The
+// WAL & shared memory files of the existing database are removed first so
+// they are not applied to the restored database.
+func installRestoredDB(ctx context.Context, tmpPath string, opt RestoreOptions, logger *log.Logger, logPrefix string) error {
+	if opt.Validate {
+		if err := validateRestoredDB(ctx, tmpPath, opt.ValidateForeignKeys); err != nil {
+			return err
+		}
+		logger.Printf("%s: restored database passed integrity check", logPrefix)
+	}
+
+	if opt.Overwrite {
+		if err := verifyRestoredDB(ctx, tmpPath, logger, logPrefix); err != nil {
+			return fmt.Errorf("cannot verify restored database, existing database kept: %w", err)
+		} else if err := removeWALFiles(opt.OutputPath); err != nil {
+			return fmt.Errorf("cannot remove existing wal: %w", err)
+		}
+	}
+
+	logger.Printf("%s: renaming database from temporary location", logPrefix)
+	if err := moveRestoredDB(tmpPath, opt.OutputPath, logger, logPrefix); err != nil {
+		return err
+	}
+
+	if opt.Overwrite {
+		return syncDir(filepath.Dir(opt.OutputPath))
+	}
+	return nil
+}
+
+// restoreTempPath returns the path of a temporary file of a restore with
+// suffix appended to the output path's name. It is in opt.TempDir, if set.
+func restoreTempPath(opt RestoreOptions, suffix string) string {
+	if opt.TempDir == "" {
+		return opt.OutputPath + suffix
+	}
+	return filepath.Join(opt.TempDir, filepath.Base(opt.OutputPath)+suffix)
+}
+
+// moveRestoredDB renames the restored database at tmpPath to filename. If
+// tmpPath is on another filesystem, it is copied next to filename first so
+// filename is still replaced atomically.
+func moveRestoredDB(tmpPath, filename string, logger *log.Logger, logPrefix string) error {
+	if err := os.Rename(tmpPath, filename); err == nil || !isCrossDeviceError(err) {
+		return err
+	}
+
+	logger.Printf("%s: temporary directory is on another filesystem, copying database", logPrefix)
+	fi, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	copyPath := filename + ".tmp"
+	defer os.Remove(copyPath)
+	if err := copyFile(copyPath, tmpPath); err != nil {
+		return err
+	} else if err := os.Chmod(copyPath, fi.Mode()); err != nil {
+		return err
+	}
+	uid, gid := fileinfo(fi)
+	_ = os.Chown(copyPath, uid, gid)
+
+	if err := os.Rename(copyPath, filename); err != nil {
+		return err
+	}
+	return os.Remove(tmpPath)
+}
+
+// verifyRestoredDB fsyncs the restored database at filename & ensures it
+// passes a quick check. The CRC64 of the file is then computed & compared
+// against a second read so the renamed file is known to be what was checked.
+func verifyRestoredDB(ctx context.Context, filename string, logger *log.Logger, logPrefix string) error {
+	if err := fsyncFile(filename); err != nil {
+		return err
+	}
+
+	chksum0, err := restoredChecksum(filename)
+	if err != nil {
+		return err
+	}
+
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	var result string
+	if err := d.QueryRowContext(ctx, `PRAGMA quick_check;`).Scan(&result); err != nil {
+		return err
+	} else if result != "ok" {
+		return fmt.Errorf("quick check failed: %s", result)
+	} else if err := d.Close(); err != nil {
+		return err
+	}
+
+	if chksum1, err := restoredChecksum(filename); err != nil {
+		return err
+	} else if chksum0 != chksum1 {
+		return fmt.Errorf("checksum changed during verification: %016x <> %016x", chksum0, chksum1)
+	}
+	logger.Printf("%s: verified restored database, checksum=%016x", logPrefix, chksum0)
+	return nil
+}
+
+// validateRestoredDB runs "PRAGMA integrity_check" & optionally
+// "PRAGMA foreign_key_check" on the database at filename. Returns an error
+// wrapping ErrIntegrityCheckFailed with the first problems reported if either
+// check fails.
+func validateRestoredDB(ctx context.Context, filename string, foreignKeys bool) error {
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	var problems []string
+	n, err := queryIntegrityProblems(ctx, d, `PRAGMA integrity_check;`, &problems, func(rows *sql.Rows) (string, error) {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return "", err
+		} else if msg == "ok" {
+			return "", nil
+		}
+		return msg, nil
+	})
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+
+	if foreignKeys {
+		m, err := queryIntegrityProblems(ctx, d, `PRAGMA foreign_key_check;`, &problems, func(rows *sql.Rows) (string, error) {
+			var table, parent string
+			var rowid sql.NullInt64
+			var fkid int
+			if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("foreign key violation: table=%s rowid=%d parent=%s fkid=%d", table, rowid.Int64, parent, fkid), nil
+		})
+		if err != nil {
+			return fmt.Errorf("foreign key check: %w", err)
+		}
+		n += m
+	}
+
+	if n == 0 {
+		return d.Close()
+	} else if n > len(problems) {
+		problems = append(problems, fmt.Sprintf("and %d more", n-len(problems)))
+	}
+	return fmt.Errorf("%w: %s", ErrIntegrityCheckFailed, strings.Join(problems, "; "))
+}
+
+// queryIntegrityProblems runs the check query & appends the problems
+// returned by fn for each row to problems, up to maxIntegrityProblems in
+// total. Rows for which fn returns a blank string are ignored. Returns the
+// total number of problems found.
+func queryIntegrityProblems(ctx context.Context, d *sql.DB, query string, problems *[]string, fn func(*sql.Rows) (string, error)) (n int, err error) {
+	rows, err := d.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := fn(rows)
+		if err != nil {
+			return n, err
+		} else if msg == "" {
+			continue
+		}
+		if len(*problems) < maxIntegrityProblems {
+			*problems = append(*problems, msg)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, rows.Close()
+}
+
+// restoredChecksum returns the CRC64 of the file at filename.
+func restoredChecksum(filename string) (uint64, error) {
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if err := hashFile(h, filename); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// fsyncFile fsyncs the file at filename.
+func fsyncFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// enableWAL sets the journal mode of the database at filename to WAL so it
+// can be replicated once an application opens it.
+func enableWAL(ctx context.Context, filename string) error {
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	var mode string
+	if err := d.QueryRowContext(ctx, `PRAGMA journal_mode = wal;`).Scan(&mode); err != nil {
+		return err
+	} else if mode != "wal" {
+		return fmt.Errorf("unexpected journal mode: %s", mode)
+	}
+	return d.Close()
+}
+
+// normalizeDB rebuilds the database at filename into a canonical form with
+// "VACUUM INTO". The rebuilt copy is written back over the original file so
+// its ownership & permissions are kept.
+func normalizeDB(ctx context.Context, filename string) error {
+	tmpPath := filename + ".normalize"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if _, err := d.ExecContext(ctx, `VACUUM INTO ?`, tmpPath); err != nil {
+		return err
+	} else if err := d.Close(); err != nil {
+		return err
+	}
+
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	} else if err := dst.Sync(); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
 // restoreSnapshot copies a snapshot from the replica to a file.
 func restoreSnapshot(ctx context.Context, r Replica, generation string, index int, filename string) error {
 	// Determine the user/group & mode based on the DB, if available.
@@ -1556,13 +3070,7 @@ func restoreSnapshot(ctx context.Context, r Replica, generation string, index in
 	}
 	defer f.Close()
 
-	rd, err := r.SnapshotReader(ctx, generation, index)
-	if err != nil {
-		return err
-	}
-	defer rd.Close()
-
-	if _, err := io.Copy(f, rd); err != nil {
+	if err := writeSnapshotImage(ctx, r, generation, index, f); err != nil {
 		return err
 	}
 
@@ -1573,7 +3081,11 @@ func restoreSnapshot(ctx context.Context, r Replica, generation string, index in
 }
 
 // restoreWAL copies a WAL file from the replica to the local WAL and forces checkpoint.
-func restoreWAL(ctx context.Context, r Replica, generation string, index int, dbPath string) error {
+//
+// If validateSalt is true, every frame in the WAL file must match the salt of
+// the WAL header. Each index begins after a WAL restart so a salt change is
+// only legitimate between indexes and never between segments of one index.
+func restoreWAL(ctx context.Context, r Replica, generation string, index int, dbPath string, validateSalt bool) error {
 	// Determine the user/group & mode based on the DB, if available.
 	uid, gid, mode := -1, -1, os.FileMode(0600)
 	if db := r.DB(); db != nil {
@@ -1601,6 +3113,19 @@ func restoreWAL(ctx context.Context, r Replica, generation string, index int, db
 		return err
 	}
 
+	// Ensure all segments of the WAL file belong to the same salt lineage.
+	if validateSalt {
+		if err := verifyWALSalt(dbPath + "-wal"); err != nil {
+			return fmt.Errorf("generation=%s index=%08x: %w", generation, index, err)
+		}
+	}
+
+	return checkpointRestoredWAL(dbPath)
+}
+
+// checkpointRestoredWAL opens the database at dbPath and forces a truncating
+// checkpoint so its WAL is copied into the database file.
+func checkpointRestoredWAL(dbPath string) error {
 	// Open SQLite database and force a truncating checkpoint.
 	d, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
@@ -1618,6 +3143,33 @@ func restoreWAL(ctx context.Context, r Replica, generation string, index int, db
 	return d.Close()
 }
 
+// verifyWALSalt returns ErrWALSaltMismatch if any frame in the WAL file has a
+// salt which does not match the WAL header. A trailing partial frame is ignored.
+func verifyWALSalt(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return verifyWALSaltBytes(buf)
+}
+
+// verifyWALSaltBytes returns ErrWALSaltMismatch if any frame in wal has a
+// salt which does not match the WAL header.
+func verifyWALSaltBytes(wal []byte) error {
+	if len(wal) < WALHeaderSize {
+		return nil
+	}
+
+	salt := binary.BigEndian.Uint64(wal[16:])
+	frameSize := WALFrameHeaderSize + int(binary.BigEndian.Uint32(wal[8:]))
+	for off := WALHeaderSize; off+frameSize <= len(wal); off += frameSize {
+		if v := binary.BigEndian.Uint64(wal[off+8:]); v != salt {
+			return fmt.Errorf("%w: offset=%d salt=%016x, expected %016x", ErrWALSaltMismatch, off, v, salt)
+		}
+	}
+	return nil
+}
+
 // CRC64 returns a CRC-64 ISO checksum of the database and its current position.
 //
 // This function obtains a read lock so it prevents syncs from occurring until
@@ -1626,40 +3178,74 @@ func restoreWAL(ctx context.Context, r Replica, generation string, index int, db
 //
 // If dst is set, the database file is copied to that location before checksum.
 func (db *DB) CRC64() (uint64, Pos, error) {
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	pos, err := db.checksum(h)
+	if err != nil {
+		return 0, pos, err
+	}
+	return h.Sum64(), pos, nil
+}
+
+// AcquireUpload waits for an upload slot from the database's upload
+// scheduler using the database's priority. The returned function releases
+// the slot. Returns immediately if the database has no scheduler.
+func (db *DB) AcquireUpload(ctx context.Context) (release func(), err error) {
+	if db.UploadScheduler == nil {
+		return func() {}, nil
+	}
+	return db.UploadScheduler.Acquire(ctx, db.Priority)
+}
+
+// IntegrityChecksum returns the hex-encoded checksum of the database using
+// the IntegrityHash algorithm along with its current position.
+func (db *DB) IntegrityChecksum() (string, Pos, error) {
+	h, err := NewIntegrityHash(db.IntegrityHash)
+	if err != nil {
+		return "", Pos{}, err
+	}
+	pos, err := db.checksum(h)
+	if err != nil {
+		return "", pos, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), pos, nil
+}
+
+// checksum checkpoints the database & writes the database file to h.
+// Returns the position of the database at the time of the checksum.
+func (db *DB) checksum(h hash.Hash) (Pos, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	if err := db.init(); err != nil {
-		return 0, Pos{}, err
+		return Pos{}, err
 	} else if db.db == nil {
-		return 0, Pos{}, os.ErrNotExist
+		return Pos{}, os.ErrNotExist
 	}
 
 	generation, err := db.CurrentGeneration()
 	if err != nil {
-		return 0, Pos{}, fmt.Errorf("cannot find current generation: %w", err)
+		return Pos{}, fmt.Errorf("cannot find current generation: %w", err)
 	} else if generation == "" {
-		return 0, Pos{}, fmt.Errorf("no current generation")
+		return Pos{}, fmt.Errorf("no current generation")
 	}
 
 	// Force a RESTART checkpoint to ensure the database is at the start of the WAL.
-	if err := db.checkpointAndInit(generation, CheckpointModeRestart); err != nil {
-		return 0, Pos{}, err
+	if _, err := db.checkpointAndInit(db.ctx, generation, CheckpointModeRestart); err != nil {
+		return Pos{}, err
 	}
 
 	// Obtain current position. Clear the offset since we are only reading the
 	// DB and not applying the current WAL.
 	pos, err := db.Pos()
 	if err != nil {
-		return 0, pos, err
+		return pos, err
 	}
 	pos.Offset = 0
 
-	chksum, err := checksumFile(db.Path())
-	if err != nil {
-		return 0, pos, err
+	if err := hashFile(h, db.Path()); err != nil {
+		return pos, err
 	}
-	return chksum, pos, nil
+	return pos, nil
 }
 
 // RestoreOptions represents options for DB.Restore().
@@ -1668,6 +3254,12 @@ type RestoreOptions struct {
 	// If blank, the original DB path is used.
 	OutputPath string
 
+	// Directory of the temporary files written during the restore. If blank,
+	// they are written next to the output path. If the directory is on
+	// another filesystem, the restored database is copied next to the output
+	// path before it is renamed into place.
+	TempDir string
+
 	// Specific replica to restore from.
 	// If blank, all replicas are considered.
 	ReplicaName string
@@ -1680,14 +3272,80 @@ type RestoreOptions struct {
 	// Set to math.MaxInt64 to ignore index.
 	Index int
 
+	// If set, only the first Offset bytes of the WAL file at Index are
+	// applied so the database is restored to an exact position. Requires
+	// Index. If zero, the entire WAL file at Index is applied.
+	Offset int64
+
 	// Point-in-time to restore database.
 	// If zero, database restore to most recent state available.
 	Timestamp time.Time
 
-	// If true, no actual restore is performed.
-	// Only equivalent log output for a regular restore.
+	// If specified, restores to just after the commit which inserted the row
+	// with this name into the marker table. See MarkerTableName.
+	Marker string
+
+	// If true, no actual restore is performed. The restore plan is resolved
+	// with CalcRestorePlan & reported without reading or writing data.
 	DryRun bool
 
+	// Number of times to retry reading the last WAL file if it is not found
+	// and the delay between attempts. Recently written files may not be
+	// readable immediately on eventually consistent storage.
+	WALRetryN     int
+	WALRetryDelay time.Duration
+
+	// If set, called after the snapshot & each WAL file is applied.
+	Progress func(RestoreProgress)
+
+	// If set, called with the resolved source & target of the restore
+	// before any data is copied. The plan is also logged.
+	Plan func(RestorePlan)
+
+	// If true, each WAL file is checked to ensure all of its frames share the
+	// salt of its header. This detects segments from a different WAL lineage.
+	ValidateWALSalt bool
+
+	// If true, a WAL file which cannot be read or fails validation ends the
+	// restore at the last good position instead of failing. WAL files from
+	// the failed index onward are not applied & are reported in the log.
+	FallbackOnCorruption bool
+
+	// If set, a warning is logged when the restored database's page size
+	// differs from this value, such as the block size of the target
+	// filesystem. If ConvertPageSize is also set, the database is rebuilt
+	// with VACUUM to use the recommended page size.
+	RecommendedPageSize int
+	ConvertPageSize     bool
+
+	// If true, the restored database is set to WAL mode before it is moved
+	// to the output path so Litestream can track it once an application
+	// opens it. Otherwise, the PRAGMA to enable WAL mode is logged.
+	EnableWAL bool
+
+	// If true, the restored database is rebuilt with "VACUUM INTO" so
+	// freelist & unused page bytes left by applying WAL files are removed.
+	// Restores of the same backup then produce byte-identical files when
+	// using the same SQLite version.
+	Deterministic bool
+
+	// If true, the restored database is checked with "PRAGMA integrity_check"
+	// before it is moved to the output path & the restore fails if any
+	// problems are found. If ValidateForeignKeys is also set, foreign key
+	// constraints are checked with "PRAGMA foreign_key_check".
+	Validate            bool
+	ValidateForeignKeys bool
+
+	// If true, an existing database at the output path is replaced. The
+	// database is restored to a temporary file in the same directory which is
+	// verified before it is renamed over the existing database. The WAL &
+	// shared memory files of the existing database are removed.
+	Overwrite bool
+
+	// Format of the rows written by RestoreTable. Either TableFormatSQL or
+	// TableFormatCSV. Defaults to TableFormatSQL if blank.
+	TableFormat string
+
 	// Logging settings.
 	Logger  *log.Logger
 	Verbose bool
@@ -1696,7 +3354,11 @@ type RestoreOptions struct {
 // NewRestoreOptions returns a new instance of RestoreOptions with defaults.
 func NewRestoreOptions() RestoreOptions {
 	return RestoreOptions{
-		Index: math.MaxInt64,
+		Index:           math.MaxInt64,
+		WALRetryN:       DefaultRestoreWALRetryN,
+		WALRetryDelay:   DefaultRestoreWALRetryDelay,
+		ValidateWALSalt: true,
+		EnableWAL:       true,
 	}
 }
 
@@ -1751,6 +3413,34 @@ var (
 		Help:      "Number of sync errors that have occurred",
 	}, []string{"db"})
 
+	uninitializedNCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "uninitialized_count",
+		Help:      "Number of times the database was skipped for having no valid header",
+	}, []string{"db"})
+
+	fsyncNCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "fsync_count",
+		Help:      "Number of batched shadow WAL fsyncs",
+	}, []string{"db"})
+
+	lockDiagnosticNCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "lock_diagnostic_count",
+		Help:      "Number of times checkpoints were repeatedly busy",
+	}, []string{"db"})
+
+	tornFrameNCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "torn_frame_count",
+		Help:      "Number of syncs stopped before an incomplete WAL frame",
+	}, []string{"db"})
+
 	syncSecondsCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "litestream",
 		Subsystem: "db",
@@ -1758,6 +3448,20 @@ var (
 		Help:      "Time spent syncing shadow WAL, in seconds",
 	}, []string{"db"})
 
+	compressionRawBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "compression_raw_bytes",
+		Help:      "Lifetime number of bytes compressed by replicas, before compression",
+	}, []string{"db"})
+
+	compressionCompressedBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "db",
+		Name:      "compression_compressed_bytes",
+		Help:      "Lifetime number of bytes compressed by replicas, after compression",
+	}, []string{"db"})
+
 	checkpointNCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "litestream",
 		Subsystem: "db",
@@ -1,14 +1,27 @@
 package litestream_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestDB_Path(t *testing.T) {
@@ -113,6 +126,37 @@ func TestDB_UpdatedAt(t *testing.T) {
 	})
 }
 
+func TestDB_Open(t *testing.T) {
+	// Ensure SQLite auxiliary files cannot be opened as a primary database.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		suffix := suffix
+		t.Run("ErrAuxPath"+suffix, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db"+suffix)
+			db := litestream.NewDB(path)
+			db.MonitorInterval = 0
+			if err := db.Open(); err == nil {
+				t.Fatal("expected error")
+			} else if got, want := err.Error(), fmt.Sprintf("database path cannot be a sqlite %q file: %s", suffix, path); got != want {
+				t.Fatalf("unexpected error: %s", got)
+			}
+		})
+	}
+
+	// Ensure a file which is not a SQLite database is rejected.
+	t.Run("ErrNotSQLiteDatabase", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "db")
+		if err := ioutil.WriteFile(path, []byte("hello, world\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		db := litestream.NewDB(path)
+		db.MonitorInterval = 0
+		if err := db.Open(); !errors.Is(err, litestream.ErrNotSQLiteDatabase) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
 // Ensure we can compute a checksum on the real database.
 func TestDB_CRC64(t *testing.T) {
 	t.Run("ErrNotExist", func(t *testing.T) {
@@ -156,6 +200,60 @@ func TestDB_CRC64(t *testing.T) {
 			t.Fatal("expected different checksums after checkpoint")
 		}
 	})
+
+	// Ensure memory allocated while computing a checksum does not grow with
+	// the size of the database.
+	t.Run("BoundedMemory", func(t *testing.T) {
+		small := MustCRC64AllocBytes(t, 10)
+		large := MustCRC64AllocBytes(t, 4000)
+		if large > small+litestream.ChecksumBufferSize {
+			t.Fatalf("allocations grew with database size: small=%d large=%d", small, large)
+		}
+	})
+}
+
+func BenchmarkDB_CRC64(b *testing.B) {
+	for _, n := range []int{10, 1000, 4000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			db, sqldb := MustOpenDBs(b)
+			defer MustCloseDBs(b, db, sqldb)
+			MustInsertBlobs(b, sqldb, n)
+			if err := db.Sync(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := db.CRC64(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// MustCRC64AllocBytes returns the number of bytes allocated while computing
+// the checksum of a database containing n blobs.
+func MustCRC64AllocBytes(tb testing.TB, n int) uint64 {
+	tb.Helper()
+
+	db, sqldb := MustOpenDBs(tb)
+	defer MustCloseDBs(tb, db, sqldb)
+	MustInsertBlobs(tb, sqldb, n)
+	if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if _, _, err := db.CRC64(); err != nil {
+		tb.Fatal(err) // checkpoint into database file before measuring
+	}
+
+	var m0, m1 runtime.MemStats
+	runtime.ReadMemStats(&m0)
+	if _, _, err := db.CRC64(); err != nil {
+		tb.Fatal(err)
+	}
+	runtime.ReadMemStats(&m1)
+	return m1.TotalAlloc - m0.TotalAlloc
 }
 
 // Ensure we can sync the real WAL to the shadow WAL.
@@ -169,6 +267,151 @@ func TestDB_Sync(t *testing.T) {
 		}
 	})
 
+	// Ensure a generation name which already exists in a replica is
+	// regenerated instead of overwriting the existing generation.
+	t.Run("GenerationCollision", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		MustWriteGenerationFiles(t, r, "0000000000000001", 1, time.Now())
+
+		var n int
+		db.NewGenerationName = func() string {
+			n++
+			return fmt.Sprintf("%016x", n)
+		}
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if generation, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if got, want := generation, "0000000000000002"; got != want {
+			t.Fatalf("generation=%s, want %s", got, want)
+		} else if got, want := n, 2; got != want {
+			t.Fatalf("attempts=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure generation creation fails if a unique name cannot be found.
+	t.Run("ErrGenerationExists", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		MustWriteGenerationFiles(t, r, "0000000000000001", 1, time.Now())
+
+		var n int
+		db.NewGenerationName = func() string {
+			n++
+			return "0000000000000001"
+		}
+
+		if err := db.Sync(); !errors.Is(err, litestream.ErrGenerationExists) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := n, db.GenerationRetryN+1; got != want {
+			t.Fatalf("attempts=%d, want %d", got, want)
+		} else if generation, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if generation != "" {
+			t.Fatalf("unexpected generation: %s", generation)
+		}
+	})
+
+	// Ensure a file replaced by a non-SQLite file after open is not synced.
+	t.Run("ErrNotSQLiteDatabase", func(t *testing.T) {
+		for _, initializeEmpty := range []bool{false, true} {
+			path := filepath.Join(t.TempDir(), "db")
+			if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			db := MustOpenDBAt(t, path)
+			defer MustCloseDB(t, db)
+			db.InitializeEmpty = initializeEmpty
+
+			if err := ioutil.WriteFile(path, []byte("hello, world\n"), 0600); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); !errors.Is(err, litestream.ErrNotSQLiteDatabase) {
+				t.Fatalf("unexpected error: %v", err)
+			} else if generation, err := db.CurrentGeneration(); err != nil {
+				t.Fatal(err)
+			} else if generation != "" {
+				t.Fatalf("unexpected generation: %s", generation)
+			}
+		}
+	})
+
+	// Ensure a zero-length database does not start a generation until the
+	// application writes a valid header.
+	t.Run("Uninitialized", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "db")
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db := MustOpenDBAt(t, path)
+		defer MustCloseDB(t, db)
+		r := NewTestFileReplica(t, db)
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil || err.Error() != `no generation, waiting for data` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := db.PageSize(), 0; got != want {
+			t.Fatalf("PageSize()=%d, want %d", got, want)
+		} else if generation, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if generation != "" {
+			t.Fatalf("unexpected generation: %s", generation)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(snapshots) != 0 {
+			t.Fatalf("unexpected snapshots: %d", len(snapshots))
+		}
+
+		// Ensure the database file was left untouched.
+		if fi, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() != 0 {
+			t.Fatalf("unexpected database size: %d", fi.Size())
+		}
+
+		// Initialize database from the application.
+		sqldb := MustOpenSQLDB(t, path)
+		defer MustCloseSQLDB(t, sqldb)
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		MustSyncDBReplica(t, db, r)
+		if generation, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if generation == "" {
+			t.Fatal("expected generation")
+		} else if got, want := MustRestoreRowCount(t, r, generation), 0; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a zero-length database is initialized immediately if configured.
+	t.Run("InitializeEmpty", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "db")
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db := litestream.NewDB(path)
+		db.MonitorInterval, db.InitializeEmpty = 0, true
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if generation, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if generation == "" {
+			t.Fatal("expected generation")
+		}
+	})
+
 	// Ensure sync can successfully run on the initial sync.
 	t.Run("Initial", func(t *testing.T) {
 		db, sqldb := MustOpenDBs(t)
@@ -257,7 +500,7 @@ func TestDB_Sync(t *testing.T) {
 		}
 
 		// Checkpoint & fully close which should close WAL file.
-		if err := db.Checkpoint(litestream.CheckpointModeTruncate); err != nil {
+		if _, err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
 			t.Fatal(err)
 		} else if err := db.Close(); err != nil {
 			t.Fatal(err)
@@ -481,6 +724,73 @@ func TestDB_Sync(t *testing.T) {
 		}
 	})
 
+	// Ensure a partial frame appended to the shadow WAL by an interrupted
+	// write is truncated on startup & the generation is kept.
+	t.Run("PartialShadowWALFrameAppended", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shadowWALPath := db.ShadowWALPath(pos0.Generation, pos0.Index)
+		fi, err := os.Stat(shadowWALPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Close & append part of a frame to the shadow WAL.
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(shadowWALPath, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := f.Write(bytes.Repeat([]byte{0xFF}, litestream.WALFrameHeaderSize+100)); err != nil {
+			t.Fatal(err)
+		} else if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reopen managed database & ensure the partial frame is removed.
+		db = MustOpenDBAt(t, db.Path())
+		defer MustCloseDB(t, db)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := pos1, pos0; got != want {
+			t.Fatalf("Pos()=%s want %s", got, want)
+		} else if fi0, err := os.Stat(shadowWALPath); err != nil {
+			t.Fatal(err)
+		} else if got, want := fi0.Size(), fi.Size(); got != want {
+			t.Fatalf("Size()=%v, want %v", got, want)
+		}
+
+		// Ensure later frames are copied after the last complete frame.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := ioutil.ReadFile(shadowWALPath); err != nil {
+			t.Fatal(err)
+		} else if wal, err := ioutil.ReadFile(db.WALPath()); err != nil {
+			t.Fatal(err)
+		} else if len(buf) <= int(fi.Size()) || !bytes.Equal(buf, wal[:len(buf)]) {
+			t.Fatal("shadow wal does not match wal")
+		}
+	})
+
 	// Ensure DB can handle a generation directory with a missing shadow WAL.
 	t.Run("NoShadowWAL", func(t *testing.T) {
 		db, sqldb := MustOpenDBs(t)
@@ -524,6 +834,119 @@ func TestDB_Sync(t *testing.T) {
 		}
 	})
 
+	// Ensure a WAL restarted by another process starts a new generation.
+	t.Run("NewGeneration", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		pos0 := MustRestartWALExternally(t, db, sqldb, nil)
+
+		db = MustOpenDBAt(t, db.Path())
+		defer MustCloseDB(t, db)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos0.Generation == pos1.Generation {
+			t.Fatal("expected new generation")
+		}
+	})
+
+	// Ensure a single WAL restart by another process continues the generation
+	// with the next shadow WAL index if recovery is enabled.
+	t.Run("RecoverWALRestart", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		pos0 := MustRestartWALExternally(t, db, sqldb, r)
+
+		// Reopen with the same replica path.
+		db = litestream.NewDB(db.Path())
+		db.MonitorInterval = 0
+		db.WALDivergencePolicy = litestream.WALDivergencePolicyRecover
+		r = litestream.NewFileReplica(db, "", r.Path())
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+		MustSyncDBReplica(t, db, r)
+
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := pos1.Generation, pos0.Generation; got != want {
+			t.Fatalf("Generation=%s, want %s", got, want)
+		} else if got, want := pos1.Index, pos0.Index+1; got != want {
+			t.Fatalf("Index=%d, want %d", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos1.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a page size change while Litestream is not running starts a new
+	// generation with whole frames of the new page size.
+	t.Run("PageSizeChange", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Rebuild the database with a new page size on a single connection.
+		conn, err := sqldb.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range []string{
+			`PRAGMA journal_mode = DELETE;`,
+			`PRAGMA page_size = 8192;`,
+			`VACUUM;`,
+			`PRAGMA journal_mode = WAL;`,
+			`INSERT INTO foo (bar) VALUES ('bat');`,
+		} {
+			if _, err := conn.ExecContext(context.Background(), query); err != nil {
+				t.Fatalf("%s: %s", query, err)
+			}
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reopen with the same replica path.
+		db = litestream.NewDB(db.Path())
+		db.MonitorInterval = 0
+		r = litestream.NewFileReplica(db, "", r.Path())
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+		MustSyncDBReplica(t, db, r)
+
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos1.Generation == pos0.Generation {
+			t.Fatal("expected new generation")
+		} else if got, want := db.PageSize(), 8192; got != want {
+			t.Fatalf("PageSize()=%d, want %d", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos1.Generation), 2; got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
 	// Ensure DB checkpoints after minimum number of pages.
 	t.Run("MinCheckpointPageN", func(t *testing.T) {
 		db, sqldb := MustOpenDBs(t)
@@ -587,33 +1010,1655 @@ func TestDB_Sync(t *testing.T) {
 	})
 }
 
-// MustOpenDBs returns a new instance of a DB & associated SQL DB.
-func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
-	db := MustOpenDB(tb)
-	return db, MustOpenSQLDB(tb, db.Path())
-}
+// Ensure checkpoints use the configured checkpoint mode.
+func TestDB_Checkpoint(t *testing.T) {
+	// Ensure a manual checkpoint syncs pending frames to the shadow WAL before
+	// restarting the WAL & reports the number of frames checkpointed.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
 
-// MustCloseDBs closes db & sqldb and removes the parent directory.
-func MustCloseDBs(tb testing.TB, db *litestream.DB, sqldb *sql.DB) {
-	MustCloseDB(tb, db)
-	MustCloseSQLDB(tb, sqldb)
-}
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
 
-// MustOpenDB returns a new instance of a DB.
-func MustOpenDB(tb testing.TB) *litestream.DB {
-	dir := tb.TempDir()
-	return MustOpenDBAt(tb, filepath.Join(dir, "db"))
-}
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
 
-// MustOpenDBAt returns a new instance of a DB for a given path.
-func MustOpenDBAt(tb testing.TB, path string) *litestream.DB {
-	tb.Helper()
-	db := litestream.NewDB(path)
-	db.MonitorInterval = 0 // disable background goroutine
-	if err := db.Open(); err != nil {
-		tb.Fatal(err)
-	}
-	return db
+		// Insert rows without syncing so only a checkpoint copies them.
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n, err := db.Checkpoint(context.Background(), litestream.CheckpointModeRestart); err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			t.Fatal("expected frames to be checkpointed")
+		}
+
+		pos1, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := pos1.Index, pos0.Index+1; got != want {
+			t.Fatalf("index=%v, want %v", got, want)
+		}
+
+		MustSyncDBReplica(t, db, r)
+		if got, want := MustRestoreRowCount(t, r, pos1.Generation), 10; got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure an invalid checkpoint mode is rejected.
+	t.Run("ErrInvalidMode", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		if _, err := db.Checkpoint(context.Background(), "BOGUS"); err == nil || err.Error() != `invalid checkpoint mode: "BOGUS"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDB_CheckpointMode(t *testing.T) {
+	for _, mode := range []string{
+		litestream.CheckpointModePassive,
+		litestream.CheckpointModeFull,
+		litestream.CheckpointModeRestart,
+		litestream.CheckpointModeTruncate,
+	} {
+		mode := mode
+
+		// Ensure the minimum threshold checkpoint issues the configured mode.
+		t.Run(mode, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			db.CheckpointMode = mode
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			n := MustCheckpointCount(t, db, mode)
+
+			for i := 0; i < db.MinCheckpointPageN; i++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if got, want := MustCheckpointCount(t, db, mode), n+1; got != want {
+				t.Fatalf("checkpoint_count(%s)=%v, want %v", mode, got, want)
+			}
+		})
+	}
+
+	// Ensure the forced checkpoint restarts the WAL even if a weaker mode is set.
+	t.Run("Forced", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.CheckpointMode = litestream.CheckpointModeFull
+		db.MaxCheckpointPageN = db.MinCheckpointPageN
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		n := MustCheckpointCount(t, db, litestream.CheckpointModeRestart)
+
+		for i := 0; i < db.MaxCheckpointPageN; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCheckpointCount(t, db, litestream.CheckpointModeRestart), n+1; got != want {
+			t.Fatalf("checkpoint_count(RESTART)=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure an invalid checkpoint mode is rejected on open.
+	t.Run("ErrInvalid", func(t *testing.T) {
+		db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+		db.MonitorInterval = 0
+		db.CheckpointMode = "BOGUS"
+		if err := db.Open(); err == nil || err.Error() != `invalid checkpoint mode: "BOGUS"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// Ensure a partial or torn frame at the end of the WAL is not copied to the
+// shadow WAL and is picked up once the frame is completely written.
+func TestDB_TornFrame(t *testing.T) {
+	for _, chunkSize := range []int{0, 64 * 1024} {
+		chunkSize := chunkSize
+
+		t.Run(fmt.Sprint(chunkSize), func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			db.WALReadChunkSize = chunkSize
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			pos0, err := db.Pos()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Write a transaction & save the completed WAL.
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+			wal, err := ioutil.ReadFile(db.WALPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			frameSize := int64(db.PageSize() + litestream.WALFrameHeaderSize)
+			lastFrame := int64(len(wal)) - frameSize
+
+			// Remove the second half of the last frame to simulate a partial write.
+			if err := os.Truncate(db.WALPath(), lastFrame+(frameSize/2)); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if pos, err := db.Pos(); err != nil {
+				t.Fatal(err)
+			} else if pos != pos0 {
+				t.Fatalf("partial frame copied: pos=%s, want %s", pos, pos0)
+			}
+
+			// Zero the end of the last frame to simulate a torn write.
+			torn := make([]byte, len(wal))
+			copy(torn, wal)
+			for i := lastFrame + (frameSize / 2); i < int64(len(torn)); i++ {
+				torn[i] = 0
+			}
+			n := MustDBCounter(t, db, "litestream_db_torn_frame_count")
+			if err := ioutil.WriteFile(db.WALPath(), torn, 0600); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if pos, err := db.Pos(); err != nil {
+				t.Fatal(err)
+			} else if pos != pos0 {
+				t.Fatalf("torn frame copied: pos=%s, want %s", pos, pos0)
+			} else if got, want := MustDBCounter(t, db, "litestream_db_torn_frame_count"), n+1; got != want {
+				t.Fatalf("torn_frame_count=%v, want %v", got, want)
+			}
+
+			// Complete the frame & ensure the transaction is copied intact.
+			if err := ioutil.WriteFile(db.WALPath(), wal, 0600); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			shadowWALPath, err := db.CurrentShadowWALPath(pos0.Generation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shadow, err := ioutil.ReadFile(shadowWALPath)
+			if err != nil {
+				t.Fatal(err)
+			} else if got, want := int64(len(shadow)), int64(len(wal)); got != want {
+				t.Fatalf("shadow wal size=%d, want %d", got, want)
+			} else if !bytes.Equal(shadow[pos0.Offset:], wal[pos0.Offset:]) {
+				t.Fatal("shadow wal frames mismatch")
+			}
+		})
+	}
+}
+
+// Ensure frames written while a background checkpoint runs are captured &
+// replicated across WAL restarts.
+func TestDB_AsyncCheckpoint(t *testing.T) {
+	db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+	db.MonitorInterval = 0
+	db.MinCheckpointPageN = 10
+	db.AsyncCheckpoint = true
+	r := NewTestFileReplica(t, db)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	sqldb := MustOpenSQLDB(t, db.Path())
+	defer MustCloseDBs(t, db, sqldb)
+
+	// Use a single connection so the busy timeout applies to every write.
+	sqldb.SetMaxOpenConns(1)
+	if _, err := sqldb.Exec(`PRAGMA busy_timeout = 5000;`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	pos0, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write continuously until the syncs below are complete.
+	done, errc := make(chan struct{}), make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				errc <- nil
+				return
+			default:
+			}
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	// Sync until the WAL has been restarted several times.
+	timeout := time.After(10 * time.Second)
+	for {
+		MustSyncDBReplica(t, db, r)
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos.Index >= pos0.Index+3 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timeout waiting for wal restart")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Ensure no frames were missed by restoring every write.
+	if pos, err := db.Pos(); err != nil {
+		t.Fatal(err)
+	} else if pos.Generation != pos0.Generation {
+		t.Fatalf("generation=%s, want %s", pos.Generation, pos0.Generation)
+	} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+		t.Fatalf("restored rows=%d, want %d", got, want)
+	}
+}
+
+// Ensure changes to priority tables are synced immediately while other
+// changes wait for the monitor interval.
+func TestDB_PriorityTables(t *testing.T) {
+	db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+	db.MonitorInterval = 1 * time.Hour
+	db.PriorityInterval = 10 * time.Millisecond
+	db.PriorityTables = []string{"critical"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer MustCloseDB(t, db)
+	sqldb := MustOpenSQLDB(t, db.Path())
+	defer MustCloseSQLDB(t, sqldb)
+
+	if _, err := sqldb.Exec(`CREATE TABLE critical (x TEXT); CREATE TABLE other (x TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	pos0, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to a non-priority table should not be synced before the interval.
+	if _, err := sqldb.Exec(`INSERT INTO other (x) VALUES ('foo')`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if pos, err := db.Pos(); err != nil {
+		t.Fatal(err)
+	} else if pos != pos0 {
+		t.Fatalf("unexpected sync: %s", pos)
+	}
+
+	// Writes to a priority table should be synced almost immediately.
+	notify := db.PriorityNotify()
+	if _, err := sqldb.Exec(`INSERT INTO critical (x) VALUES ('bar')`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for priority sync")
+	}
+
+	pos1, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if pos1 == pos0 {
+		t.Fatal("expected sync")
+	}
+
+	// Grow the priority table so its b-tree has interior pages and ensure
+	// updates to a leaf page are also detected.
+	notify = db.PriorityNotify()
+	if _, err := sqldb.Exec(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 1000) INSERT INTO critical (x) SELECT printf('%0100d', i) FROM n`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for priority sync")
+	}
+
+	notify = db.PriorityNotify()
+	if _, err := sqldb.Exec(`UPDATE critical SET x = 'baz' WHERE rowid = 500`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for priority sync")
+	}
+}
+
+func TestDB_ReplicaLag(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+	if lag := db.ReplicaLag(r.Name()); lag != 0 {
+		t.Fatalf("unexpected lag after replica sync: %s", lag)
+	}
+
+	// Changes synced to the shadow WAL but not uploaded should accrue lag.
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if lag := db.ReplicaLag(r.Name()); lag < 10*time.Millisecond {
+		t.Fatalf("unexpected lag before replica sync: %s", lag)
+	}
+
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if lag := db.ReplicaLag(r.Name()); lag != 0 {
+		t.Fatalf("unexpected lag after replica sync: %s", lag)
+	}
+}
+
+func TestDB_Status(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	// Use a regular file as the destination of a second replica so it fails.
+	filename := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := litestream.NewFileReplica(db, "bad", filename)
+	bad.MonitorEnabled = false
+	db.Replicas = append(db.Replicas, bad)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+	if err := bad.Sync(context.Background()); err == nil {
+		t.Fatal("expected sync error")
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := db.Status()
+	if status.Path != db.Path() || status.Generation != pos.Generation || status.Index != pos.Index || status.Offset != pos.Offset {
+		t.Fatalf("unexpected status: %#v", status)
+	} else if status.PageSize != db.PageSize() {
+		t.Fatalf("page size=%d, want %d", status.PageSize, db.PageSize())
+	} else if len(status.Replicas) != 2 {
+		t.Fatalf("replicas=%d, want 2", len(status.Replicas))
+	}
+
+	if rs, lpos := status.Replicas[0], r.LastPos(); rs.Generation != lpos.Generation || rs.Index != lpos.Index || rs.Offset != lpos.Offset {
+		t.Fatalf("unexpected replica status: %#v", rs)
+	} else if rs.LastSnapshotAt == nil {
+		t.Fatal("expected last snapshot time")
+	} else if rs.LastSyncError != "" {
+		t.Fatalf("unexpected sync error: %s", rs.LastSyncError)
+	} else if rs.LagSeconds != 0 {
+		t.Fatalf("unexpected lag: %v", rs.LagSeconds)
+	}
+
+	if rs := status.Replicas[1]; rs.Generation != "" || rs.LastSnapshotAt != nil {
+		t.Fatalf("unexpected replica status: %#v", rs)
+	} else if rs.LastSyncError == "" {
+		t.Fatal("expected sync error")
+	}
+
+	if health := status.Health(time.Minute); health != "error" {
+		t.Fatalf("health=%s, want error", health)
+	} else if err := status.LastError(); !strings.HasPrefix(err, "bad: ") {
+		t.Fatalf("unexpected last error: %s", err)
+	}
+}
+
+func TestDBStatus_Health(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status litestream.DBStatus
+		maxLag time.Duration
+		want   string
+	}{
+		{"OK", litestream.DBStatus{Generation: "0123456789abcdef", Replicas: []litestream.ReplicaStatus{{LagSeconds: 1}}}, time.Minute, "ok"},
+		{"Untracked", litestream.DBStatus{}, time.Minute, "untracked"},
+		{"Error", litestream.DBStatus{Error: "marker"}, time.Minute, "error"},
+		{"Lagging", litestream.DBStatus{Generation: "0123456789abcdef", Replicas: []litestream.ReplicaStatus{{LagSeconds: 1}, {LagSeconds: 120}}}, time.Minute, "lagging"},
+		{"LagIgnored", litestream.DBStatus{Generation: "0123456789abcdef", Replicas: []litestream.ReplicaStatus{{LagSeconds: 120}}}, 0, "ok"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.status.Health(tt.maxLag); got != tt.want {
+				t.Fatalf("health=%s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDB_Shutdown(t *testing.T) {
+	// Ensure changes not yet copied to the shadow WAL are uploaded.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+
+		prev := r.LastPos()
+		if err := db.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos == prev {
+			t.Fatal("expected shutdown to sync pending changes")
+		} else if got := r.LastPos(); got != pos {
+			t.Fatalf("replica position=%s, want %s", got, pos)
+		}
+	})
+
+	// Ensure the context error is returned if a replica cannot be flushed
+	// before the deadline.
+	t.Run("ErrDeadline", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		// Use a regular file as the destination of the replica so it fails.
+		filename := filepath.Join(t.TempDir(), "file")
+		if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		r := litestream.NewFileReplica(db, "bad", filename)
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a shadow WAL file with only a header is not reported as unflushed.
+	t.Run("HeaderOnly", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		prev := r.LastPos()
+
+		// Stop syncing & write the header of the next shadow WAL file, as
+		// when a new file is started but has no frames yet.
+		if err := db.SoftClose(); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(db.ShadowWALPath(prev.Generation, prev.Index))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(db.ShadowWALPath(prev.Generation, prev.Index+1), buf[:litestream.WALHeaderSize], 0600); err != nil {
+			t.Fatal(err)
+		} else if err := db.SQLDB().Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.Shutdown(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDB_AddReplica(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		NewTestFileReplica(t, db)
+
+		r := litestream.NewFileReplica(db, "other", t.TempDir())
+		r.MonitorEnabled = false
+		if err := db.AddReplica(r); err != nil {
+			t.Fatal(err)
+		} else if db.Replica("other") != r {
+			t.Fatal("expected replica to be added")
+		}
+	})
+
+	t.Run("ErrDuplicateName", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		NewTestFileReplica(t, db)
+
+		r := litestream.NewFileReplica(db, "", t.TempDir())
+		if err := db.AddReplica(r); err == nil || err.Error() != `duplicate replica name: "file"` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if len(db.Replicas) != 1 {
+			t.Fatalf("len=%d, want 1", len(db.Replicas))
+		}
+	})
+}
+
+func TestDB_ReplaceReplica(t *testing.T) {
+	// Ensure pending changes are uploaded to the previous replica & the
+	// generation continues with the new replica.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		prev := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, prev)
+		generation, err := db.CurrentGeneration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewFileReplica(db, "", prev.Path())
+		r.MonitorEnabled = false
+		r.Retention = time.Hour
+		if err := db.ReplaceReplica(context.Background(), r); err != nil {
+			t.Fatal(err)
+		} else if db.Replica("file") != r {
+			t.Fatal("expected replica to be replaced")
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got := prev.LastPos(); got != pos {
+			t.Fatalf("previous replica position=%s, want %s", got, pos)
+		}
+
+		MustSyncDBReplica(t, db, r)
+		if got, err := db.CurrentGeneration(); err != nil {
+			t.Fatal(err)
+		} else if got != generation {
+			t.Fatalf("generation=%s, want %s", got, generation)
+		} else if got := r.LastPos(); got.Generation != generation || got.Index != pos.Index {
+			t.Fatalf("replica position=%s, want %s", got, pos)
+		}
+	})
+
+	t.Run("ErrNotFound", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		NewTestFileReplica(t, db)
+
+		r := litestream.NewFileReplica(db, "other", t.TempDir())
+		if err := db.ReplaceReplica(context.Background(), r); err == nil || err.Error() != `replica not found: "other"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure replicas can be reloaded while the database syncs & reports its
+	// status. Run with -race to detect unguarded access to the replica list.
+	t.Run("Concurrent", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+					t.Error(err)
+					return
+				} else if err := db.Sync(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if status := db.Status(); len(status.Replicas) == 0 {
+					t.Error("expected replica status")
+					return
+				}
+				db.Replica("file")
+			}
+		}()
+
+		dir := t.TempDir()
+		for i := 0; i < 10; i++ {
+			r := litestream.NewFileReplica(db, "", dir)
+			r.MonitorEnabled = false
+			if err := db.ReplaceReplica(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			other := litestream.NewFileReplica(db, "other", t.TempDir())
+			other.MonitorEnabled = false
+			if err := db.AddReplica(other); err != nil {
+				t.Fatal(err)
+			} else if err := db.RemoveReplica(context.Background(), "other"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(done)
+		wg.Wait()
+
+		if replicas := db.ReplicaList(); len(replicas) != 1 || replicas[0].Name() != "file" {
+			t.Fatalf("unexpected replicas: %v", replicas)
+		}
+	})
+}
+
+func TestDB_RemoveReplica(t *testing.T) {
+	// Ensure pending changes are uploaded before the replica is removed.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		other := litestream.NewFileReplica(db, "other", t.TempDir())
+		other.MonitorEnabled = false
+		db.Replicas = append(db.Replicas, other)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.RemoveReplica(context.Background(), "file"); err != nil {
+			t.Fatal(err)
+		} else if len(db.Replicas) != 1 || db.Replicas[0] != other {
+			t.Fatalf("unexpected replicas: %v", db.Replicas)
+		}
+
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got := r.LastPos(); got != pos {
+			t.Fatalf("replica position=%s, want %s", got, pos)
+		}
+	})
+
+	t.Run("ErrNotFound", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if err := db.RemoveReplica(context.Background(), "file"); err == nil || err.Error() != `replica not found: "file"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDB_ShadowWALCache(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r0 := NewTestFileReplica(t, db)
+	r1 := litestream.NewFileReplica(db, "other", t.TempDir())
+	r1.MonitorEnabled = false
+	db.Replicas = append(db.Replicas, r1)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r0)
+
+	// Sync the first replica after every write & the second only at the
+	// end so the replicas read the shared bytes at different positions.
+	for i := 0; i < 10; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r0)
+	}
+	if err := r1.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure a shared read returns the same bytes as the file on disk.
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(db.ShadowWALPath(pos.Generation, pos.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := db.ShadowWALReader(litestream.Pos{Generation: pos.Generation, Index: pos.Index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if other, err := ioutil.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(other, buf[:len(other)]) || int64(len(other)) != pos.Offset {
+		t.Fatalf("shadow wal mismatch: n=%d, offset=%d", len(other), pos.Offset)
+	}
+
+	for _, r := range []litestream.Replica{r0, r1} {
+		if n := MustRestoreRowCount(t, r, pos.Generation); n != 10 {
+			t.Fatalf("%s: row count=%d, want 10", r.Name(), n)
+		}
+	}
+}
+
+func TestRestoreReplica(t *testing.T) {
+	// Ensure restore fails clearly if a snapshot was written in a newer format.
+	t.Run("ErrUnsupportedFormatVersion", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(r.SnapshotPath(pos.Generation, 0), MustFutureFormatObject(t), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrUnsupportedFormatVersion) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure restore fails if a WAL file contains segments from different salt lineages.
+	t.Run("ErrWALSaltMismatch", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Append a copy of the last frame with a different salt to the replica
+		// WAL to simulate a second segment from another WAL lineage.
+		walPath := r.WALPath(pos.Generation, pos.Index)
+		buf, err := ioutil.ReadFile(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frameSize := litestream.WALFrameHeaderSize + int(binary.BigEndian.Uint32(buf[8:]))
+		frame := append([]byte{}, buf[len(buf)-frameSize:]...)
+		binary.BigEndian.PutUint64(frame[8:], binary.BigEndian.Uint64(frame[8:])+1)
+		if err := ioutil.WriteFile(walPath, append(buf, frame...), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrWALSaltMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if want := fmt.Sprintf("index=%08x", pos.Index); !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to contain %q: %s", want, err)
+		}
+
+		// Restore should succeed if validation is disabled as SQLite ignores
+		// frames which do not match the WAL header salt.
+		opt.ValidateWALSalt = false
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure restore retries if the last WAL file is briefly unavailable.
+	t.Run("RetryMissingWAL", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Roll over to a new WAL index so the last WAL is not the snapshot index.
+		for i := 0; i < db.MinCheckpointPageN; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos.Generation
+		opt.WALRetryDelay = 0
+
+		// Restore should fail if retries are disabled.
+		opt.OutputPath, opt.WALRetryN = filepath.Join(t.TempDir(), "db"), 0
+		fr := &missingWALReplica{FileReplica: r, index: pos.Index, n: 1}
+		if err := litestream.RestoreReplica(context.Background(), fr, opt); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Restore should succeed once the WAL file becomes available.
+		opt.OutputPath, opt.WALRetryN = filepath.Join(t.TempDir(), "db"), 2
+		fr = &missingWALReplica{FileReplica: r, index: pos.Index, n: 1}
+		if err := litestream.RestoreReplica(context.Background(), fr, opt); err != nil {
+			t.Fatal(err)
+		} else if fr.n != 0 {
+			t.Fatal("expected missing wal to be read")
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), db.MinCheckpointPageN+1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure WAL files which become visible while retrying are restored.
+	t.Run("RetryMissingWALRelist", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Roll over twice so two WAL indexes follow the snapshot index.
+		for j := 0; j < 2; j++ {
+			for i := 0; i < db.MinCheckpointPageN; i++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			MustSyncDBReplica(t, db, r)
+		}
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The last WAL file is not listed until the WAL before it is found missing.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), pos.Generation
+		opt.WALRetryN, opt.WALRetryDelay = 1, 0
+		fr := &missingWALReplica{FileReplica: r, index: pos.Index - 1, n: 1, hideLater: true}
+		if err := litestream.RestoreReplica(context.Background(), fr, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), 2*db.MinCheckpointPageN+1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure restore falls back to the last good position if the latest WAL
+	// file is corrupt and fallback is enabled.
+	t.Run("FallbackOnCorruption", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		for i := 0; i < 5; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Corrupt the latest WAL by appending a frame from another lineage.
+		walPath := r.WALPath(pos.Generation, pos.Index)
+		buf, err := ioutil.ReadFile(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frameSize := litestream.WALFrameHeaderSize + int(binary.BigEndian.Uint32(buf[8:]))
+		frame := append([]byte{}, buf[len(buf)-frameSize:]...)
+		binary.BigEndian.PutUint64(frame[8:], binary.BigEndian.Uint64(frame[8:])+1)
+		if err := ioutil.WriteFile(walPath, append(buf, frame...), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Restore should fail without fallback.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrWALSaltMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Restore should succeed with the data through the previous WAL.
+		opt.FallbackOnCorruption = true
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), db.MinCheckpointPageN; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if _, err := os.Stat(opt.OutputPath + "-wal"); !os.IsNotExist(err) {
+			t.Fatalf("expected failed wal to be removed: %v", err)
+		}
+	})
+
+	// Ensure a warning is logged when the restored page size differs from the
+	// recommended page size & the database is converted if requested.
+	t.Run("RecommendedPageSize", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		restore := func(pageSize int, convert bool) (string, string) {
+			var buf strings.Builder
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(t.TempDir(), "db")
+			opt.Generation = r.LastPos().Generation
+			opt.RecommendedPageSize, opt.ConvertPageSize = pageSize, convert
+			opt.Logger = log.New(&buf, "", 0)
+			if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			}
+			return opt.OutputPath, buf.String()
+		}
+
+		// Matching page size should not warn.
+		if _, output := restore(db.PageSize(), false); strings.Contains(output, "WARNING") {
+			t.Fatalf("unexpected warning: %s", output)
+		}
+
+		// Mismatched page size should warn but leave the database unchanged.
+		if path, output := restore(8192, false); !strings.Contains(output, fmt.Sprintf("WARNING: restored page size %d differs from recommended page size 8192", db.PageSize())) {
+			t.Fatalf("expected warning, got: %s", output)
+		} else if got, want := MustPageSize(t, path), db.PageSize(); got != want {
+			t.Fatalf("page size=%d, want %d", got, want)
+		}
+
+		// Conversion should rebuild the database with the recommended page size.
+		if path, _ := restore(8192, true); MustPageSize(t, path) != 8192 {
+			t.Fatalf("page size=%d, want 8192", MustPageSize(t, path))
+		} else if got, want := MustCountRows(t, path, "foo"), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Invalid page sizes should be rejected.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.RecommendedPageSize = 1000
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || err.Error() != `invalid recommended page size: 1000` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a snapshot taken in rollback journal mode is restored in WAL
+	// mode or the PRAGMA to enable it is logged.
+	t.Run("EnableWAL", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		r := NewTestFileReplica(t, db)
+
+		// Write an uncompressed rollback journal database as the only snapshot.
+		const generation = "0000000000000000"
+		src := filepath.Join(t.TempDir(), "src")
+		sqldb, err := sql.Open("sqlite3", src)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := os.MkdirAll(r.SnapshotDir(generation), 0777); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(strings.TrimSuffix(r.SnapshotPath(generation, 0), ".lz4"), buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		restore := func(enableWAL bool) ([]byte, string) {
+			var logs strings.Builder
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(t.TempDir(), "db")
+			opt.Generation = generation
+			opt.EnableWAL = enableWAL
+			opt.Logger = log.New(&logs, "", 0)
+			if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadFile(opt.OutputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf, logs.String()
+		}
+
+		// The file format version bytes are 2 for WAL mode & 1 for rollback.
+		if hdr, output := restore(true); hdr[18] != 2 || hdr[19] != 2 {
+			t.Fatalf("expected wal mode header, got %d/%d", hdr[18], hdr[19])
+		} else if strings.Contains(output, "PRAGMA") {
+			t.Fatalf("unexpected pragma hint: %s", output)
+		}
+
+		if hdr, output := restore(false); hdr[18] != 1 || hdr[19] != 1 {
+			t.Fatalf("expected rollback mode header, got %d/%d", hdr[18], hdr[19])
+		} else if !strings.Contains(output, `run "PRAGMA journal_mode = wal;" before replicating`) {
+			t.Fatalf("expected pragma hint, got: %s", output)
+		}
+	})
+
+	// Ensure deterministic restores of the same backup are byte-identical
+	// & have no free pages.
+	t.Run("Deterministic", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (?);`, strings.Repeat("x", 1000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Delete rows so the restored database has free pages.
+		if _, err := sqldb.Exec(`DELETE FROM foo WHERE rowid % 2 = 0;`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restore := func() [sha256.Size]byte {
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(t.TempDir(), "db")
+			opt.Generation = pos.Generation
+			opt.Deterministic = true
+			if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			}
+
+			buf, err := ioutil.ReadFile(opt.OutputPath)
+			if err != nil {
+				t.Fatal(err)
+			} else if n := binary.BigEndian.Uint32(buf[36:]); n != 0 {
+				t.Fatalf("freelist page count=%d, want 0", n)
+			} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), 50; got != want {
+				t.Fatalf("rows=%d, want %d", got, want)
+			}
+			return sha256.Sum256(buf)
+		}
+
+		if a, b := restore(), restore(); a != b {
+			t.Fatalf("restored hashes differ: %x != %x", a, b)
+		}
+	})
+
+	// Ensure the resolved source & target are reported before restoring.
+	t.Run("Plan", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var logs strings.Builder
+		var plans []litestream.RestorePlan
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		opt.Logger = log.New(&logs, "", 0)
+		opt.Plan = func(plan litestream.RestorePlan) {
+			// Ensure the plan is reported before any data is written.
+			if _, err := os.Stat(opt.OutputPath + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("expected no restored data before plan: %v", err)
+			}
+			plans = append(plans, plan)
+		}
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(plans), 1; got != want {
+			t.Fatalf("len(plans)=%d, want %d", got, want)
+		}
+
+		if got, want := plans[0], (litestream.RestorePlan{
+			ReplicaName:   "file",
+			ReplicaType:   "file",
+			ReplicaURL:    "file://" + r.Path(),
+			Generation:    pos.Generation,
+			SnapshotIndex: 0,
+			MaxIndex:      2,
+			ObjectN:       4,
+			WALSegmentN:   3,
+			SnapshotSize:  plans[0].SnapshotSize,
+			WALSize:       plans[0].WALSize,
+			Size:          plans[0].SnapshotSize + plans[0].WALSize,
+			OutputPath:    opt.OutputPath,
+		}); got != want {
+			t.Fatalf("plan=%#v, want %#v", got, want)
+		} else if plans[0].SnapshotSize <= 0 || plans[0].WALSize <= 0 {
+			t.Fatalf("unexpected sizes: snapshot=%d wal=%d", plans[0].SnapshotSize, plans[0].WALSize)
+		}
+
+		want := fmt.Sprintf("%s(file): restore plan: replica=file type=file url=file://%s generation=%s snapshot=00000000 wal=00000000-00000002 objects=4 segments=3 snapshot-size=%d wal-size=%d size=%d output=%s\n", db.Path(), r.Path(), pos.Generation, plans[0].SnapshotSize, plans[0].WALSize, plans[0].Size, opt.OutputPath)
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("expected plan in log, got: %s", logs.String())
+		}
+	})
+
+	// Ensure a dry run only reports the plan & validates its target.
+	t.Run("DryRun", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var plans []litestream.RestorePlan
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		opt.DryRun = true
+		opt.Plan = func(plan litestream.RestorePlan) { plans = append(plans, plan) }
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(plans), 1; got != want {
+			t.Fatalf("len(plans)=%d, want %d", got, want)
+		} else if plan := plans[0]; !plan.DryRun || plan.MaxIndex != 2 || plan.WALSegmentN != 3 {
+			t.Fatalf("unexpected plan: %#v", plan)
+		}
+
+		// Ensure no files are written.
+		if fis, err := ioutil.ReadDir(filepath.Dir(opt.OutputPath)); err != nil {
+			t.Fatal(err)
+		} else if len(fis) != 0 {
+			t.Fatalf("unexpected files: %d", len(fis))
+		}
+
+		// Ensure the generation is resolved if not specified.
+		opt.Generation = ""
+		if plan, err := litestream.CalcRestorePlan(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := plan.Generation, pos.Generation; got != want {
+			t.Fatalf("generation=%s, want %s", got, want)
+		}
+		opt.Generation = pos.Generation
+
+		// Ensure sizes only include the files up to the target index.
+		var snapshotSize, walSize int64
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(snapshots) != 1 {
+			t.Fatalf("len(snapshots)=%d, want 1", len(snapshots))
+		} else {
+			snapshotSize = snapshots[0].Size
+		}
+		if wals, err := r.WALs(context.Background()); err != nil {
+			t.Fatal(err)
+		} else {
+			for _, info := range wals {
+				if info.Index <= 1 {
+					walSize += info.Size
+				}
+			}
+		}
+		opt.Index = 1
+		if gotSnapshotSize, gotWALSize, segmentN, err := litestream.RestorePlanSize(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if gotSnapshotSize != snapshotSize || gotWALSize != walSize || segmentN != 2 {
+			t.Fatalf("sizes=%d/%d/%d, want %d/%d/2", gotSnapshotSize, gotWALSize, segmentN, snapshotSize, walSize)
+		}
+
+		// Ensure an index past the end of the generation is rejected.
+		opt.Index = 5
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "unable to locate index 5") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		opt.Index = math.MaxInt64
+
+		// Ensure a missing WAL file before the target is rejected.
+		if err := os.Remove(r.WALPath(pos.Generation, 1) + r.Codec.Ext); err != nil {
+			t.Fatal(err)
+		} else if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "wal 00000001 not found") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the restored database is checked before it is moved into place.
+	t.Run("Validate", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Foreign keys are not enforced by default so an orphan row is allowed.
+		if _, err := sqldb.Exec(`CREATE TABLE parent (id INTEGER PRIMARY KEY);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`CREATE TABLE child (id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES parent (id));`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO child (id, parent_id) VALUES (1, 100);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = r.LastPos().Generation
+		opt.Validate = true
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.ValidateForeignKeys = true
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrIntegrityCheckFailed) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !strings.Contains(err.Error(), "foreign key violation: table=child rowid=1 parent=parent") {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := os.Stat(opt.OutputPath); !os.IsNotExist(err) {
+			t.Fatalf("expected no output: %v", err)
+		}
+	})
+
+	// Ensure an existing database is only replaced when overwriting & is kept
+	// if the restore fails.
+	t.Run("Overwrite", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		// Write an existing database with sidecar files at the output path.
+		path := filepath.Join(t.TempDir(), "db")
+		if other, err := sql.Open("sqlite3", path); err != nil {
+			t.Fatal(err)
+		} else if _, err := other.Exec(`CREATE TABLE existing (x INTEGER);`); err != nil {
+			t.Fatal(err)
+		} else if err := other.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, filename := range []string{path + "-wal", path + "-shm"} {
+			if err := ioutil.WriteFile(filename, []byte("stale"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = path
+		opt.Generation = r.LastPos().Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "output path already exists") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		opt.Overwrite = true
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+		for _, filename := range []string{path + "-wal", path + "-shm"} {
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be removed: %v", filepath.Base(filename), err)
+			}
+		}
+		n := MustCountRows(t, db.Path(), "foo")
+		if got := MustCountRows(t, path, "foo"); got != n {
+			t.Fatalf("n=%d, want %d", got, n)
+		}
+
+		// A failed restore must leave the existing database in place.
+		if err := os.Remove(r.WALPath(opt.Generation, 1) + r.Codec.Ext); err != nil {
+			t.Fatal(err)
+		} else if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := MustCountRows(t, path, "foo"), n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure temporary files are written to & removed from the temp dir
+	// whether or not the restore succeeds.
+	t.Run("TempDir", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		assertEmptyDir := func(dir string) {
+			t.Helper()
+			if fis, err := ioutil.ReadDir(dir); err != nil {
+				t.Fatal(err)
+			} else if len(fis) != 0 {
+				t.Fatalf("unexpected file in %s: %s", dir, fis[0].Name())
+			}
+		}
+
+		outputDir := t.TempDir()
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(outputDir, "db")
+		opt.TempDir = t.TempDir()
+		opt.Generation = r.LastPos().Generation
+		opt.Logger = log.New(ioutil.Discard, "", 0)
+		opt.Plan = func(plan litestream.RestorePlan) {}
+		opt.Progress = func(p litestream.RestoreProgress) {
+			// Ensure nothing is written next to the output path while restoring.
+			if _, err := os.Stat(opt.OutputPath + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("expected no temporary file in output dir: %v", err)
+			}
+		}
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+		assertEmptyDir(opt.TempDir)
+
+		d := MustOpenSQLDB(t, opt.OutputPath)
+		var bar string
+		if err := d.QueryRow(`SELECT bar FROM foo`).Scan(&bar); err != nil {
+			t.Fatal(err)
+		} else if bar != "baz" {
+			t.Fatalf("bar=%q, want %q", bar, "baz")
+		}
+		MustCloseSQLDB(t, d)
+
+		// Ensure temporary files are removed if the restore fails.
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		if err := ioutil.WriteFile(r.SnapshotChecksumPath(opt.Generation, 0), []byte("0\n"), 0600); err != nil {
+			t.Fatal(err)
+		} else if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertEmptyDir(opt.TempDir)
+		assertEmptyDir(filepath.Dir(opt.OutputPath))
+
+		// Ensure temporary files are removed if the restore is canceled.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := litestream.RestoreReplica(ctx, r, opt); err == nil {
+			t.Fatal("expected error")
+		}
+		assertEmptyDir(opt.TempDir)
+		assertEmptyDir(filepath.Dir(opt.OutputPath))
+	})
+}
+
+func TestCalcReplicaRestoreTarget(t *testing.T) {
+	// Ensure a newer generation without a snapshot is skipped & reported.
+	t.Run("SkipNoSnapshot", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		pos := r.LastPos()
+
+		// Copy the WAL of the generation into a newer generation which has
+		// no snapshot, such as one whose snapshot upload was interrupted.
+		const other = "ffffffffffffffff"
+		if err := os.MkdirAll(r.WALDir(other), 0777); err != nil {
+			t.Fatal(err)
+		} else if buf, err := ioutil.ReadFile(r.WALPath(pos.Generation, pos.Index)); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(r.WALPath(other, pos.Index), buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+		updatedAt := time.Now().Add(time.Hour)
+		if err := os.Chtimes(r.WALPath(other, pos.Index), updatedAt, updatedAt); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		opt := litestream.NewRestoreOptions()
+		opt.Logger = log.New(&buf, "", 0)
+		if generation, _, err := litestream.CalcReplicaRestoreTarget(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if generation != pos.Generation {
+			t.Fatalf("generation=%s, want %s", generation, pos.Generation)
+		} else if got, want := buf.String(), fmt.Sprintf("file: skipping generation %s, no usable snapshot, using generation %s\n", other, pos.Generation); got != want {
+			t.Fatalf("log=%q, want %q", got, want)
+		}
+
+		// Ensure the generation can still be chosen explicitly.
+		opt.Generation = other
+		if generation, _, err := litestream.CalcReplicaRestoreTarget(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if generation != other {
+			t.Fatalf("generation=%s, want %s", generation, other)
+		}
+	})
+}
+
+// MustPageSize returns the page size of the database at path.
+func MustPageSize(tb testing.TB, path string) int {
+	tb.Helper()
+	d := MustOpenSQLDB(tb, path)
+	defer MustCloseSQLDB(tb, d)
+
+	var n int
+	if err := d.QueryRow(`PRAGMA page_size;`).Scan(&n); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+// missingWALReplica is a replica that reports the WAL at index as missing
+// for the first n reads to simulate eventually consistent storage. If
+// hideLater is set, WAL files after index are not listed until the WAL at
+// index is first reported missing.
+type missingWALReplica struct {
+	*litestream.FileReplica
+	index     int
+	n         int
+	hideLater bool
+}
+
+func (r *missingWALReplica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
+	wals, err := r.FileReplica.WALs(ctx)
+	if err != nil || !r.hideLater {
+		return wals, err
+	}
+
+	other := make([]*litestream.WALInfo, 0, len(wals))
+	for _, wal := range wals {
+		if wal.Index <= r.index {
+			other = append(other, wal)
+		}
+	}
+	return other, nil
+}
+
+func (r *missingWALReplica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	if index == r.index && r.n > 0 {
+		r.n--
+		r.hideLater = false
+		return nil, os.ErrNotExist
+	}
+	return r.FileReplica.WALReader(ctx, generation, index)
+}
+
+// MustOpenDBs returns a new instance of a DB & associated SQL DB.
+func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	db := MustOpenDB(tb)
+	return db, MustOpenSQLDB(tb, db.Path())
+}
+
+// MustCloseDBs closes db & sqldb and removes the parent directory.
+func MustCloseDBs(tb testing.TB, db *litestream.DB, sqldb *sql.DB) {
+	MustCloseDB(tb, db)
+	MustCloseSQLDB(tb, sqldb)
+}
+
+// MustOpenDB returns a new instance of a DB.
+func MustOpenDB(tb testing.TB) *litestream.DB {
+	dir := tb.TempDir()
+	return MustOpenDBAt(tb, filepath.Join(dir, "db"))
+}
+
+// MustOpenDBAt returns a new instance of a DB for a given path.
+func MustOpenDBAt(tb testing.TB, path string) *litestream.DB {
+	tb.Helper()
+	db := litestream.NewDB(path)
+	db.MonitorInterval = 0 // disable background goroutine
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
 }
 
 // MustCloseDB closes db and removes its parent directory.
@@ -645,3 +2690,64 @@ func MustCloseSQLDB(tb testing.TB, d *sql.DB) {
 		tb.Fatal(err)
 	}
 }
+
+// MustCheckpointCount returns the value of the checkpoint count metric for db & mode.
+func MustCheckpointCount(tb testing.TB, db *litestream.DB, mode string) float64 {
+	tb.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != "litestream_db_checkpoint_count" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, pair := range m.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels["db"] == db.Path() && labels["mode"] == mode {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// MustRestartWALExternally syncs a "foo" table to db and r, if not nil,
+// closes db, and then restarts the WAL from sqldb with more writes to
+// simulate another process checkpointing while Litestream is not running.
+// Returns the position before the restart.
+func MustRestartWALExternally(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *litestream.FileReplica) litestream.Pos {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		tb.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if r != nil {
+		if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Checkpoint & write so the WAL is restarted with new salts.
+	if _, err := sqldb.Exec(`PRAGMA wal_checkpoint(RESTART);`); err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('bat');`); err != nil {
+		tb.Fatal(err)
+	}
+	return pos
+}
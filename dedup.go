@@ -0,0 +1,136 @@
+package litestream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dedupDir returns the directory of deduplicated snapshot contents.
+func (r *FileReplica) dedupDir() string {
+	if r.DedupDir != "" {
+		return r.DedupDir
+	}
+	return filepath.Join(r.dst, "objects")
+}
+
+// dedupSnapshot replaces the snapshot at filename with a hard link to the
+// deduplicated file with the same contents, if one exists. Otherwise the
+// snapshot is linked into the dedup directory so later identical snapshots
+// can link to it. No-op if DedupSnapshots is false.
+func (r *FileReplica) dedupSnapshot(filename string) error {
+	if !r.DedupSnapshots {
+		return nil
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	sum, err := sha256File(filename)
+	if err != nil {
+		return err
+	}
+
+	objectPath := filepath.Join(r.dedupDir(), sum[:2], sum)
+	if err := mkdirAll(filepath.Dir(objectPath), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
+		return err
+	}
+
+	// Retry once if the existing file is pruned concurrently by another replica.
+	for i := 0; i < 2; i++ {
+		// Store the snapshot's contents if no snapshot has the same contents.
+		if err := os.Link(filename, objectPath); err == nil {
+			return nil
+		} else if !os.IsExist(err) {
+			return err
+		}
+
+		ofi, err := os.Stat(objectPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if os.SameFile(fi, ofi) {
+			return nil
+		} else if ofi.Size() != fi.Size() {
+			log.Printf("%s(%s): snapshot: dedup object size mismatch, keeping copy: %s", r.db.Path(), r.Name(), objectPath)
+			return nil
+		}
+
+		// Atomically replace the snapshot with a link to the existing contents.
+		tmpPath := filename + ".tmp"
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err := os.Link(objectPath, tmpPath); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if err := os.Rename(tmpPath, filename); err != nil {
+			return err
+		}
+		Tracef("%s(%s): snapshot: linked %s to %s", r.db.Path(), r.Name(), filepath.Base(filename), sum)
+		return nil
+	}
+	return nil
+}
+
+// pruneDedupObjects deletes deduplicated snapshot contents which are no
+// longer linked to any snapshot, including snapshots of other replicas
+// sharing the directory. Deleting a snapshot only removes its link so the
+// contents are kept until the last snapshot linking to them is deleted.
+// No-op if DedupSnapshots is false.
+func (r *FileReplica) pruneDedupObjects(ctx context.Context) error {
+	if !r.DedupSnapshots {
+		return nil
+	}
+
+	var filenames []string
+	var size int64
+	if err := filepath.Walk(r.dedupDir(), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		// Only the dedup directory links to the file. Link counts are not
+		// available on all platforms, in which case files are kept.
+		if fileLinkN(fi) == 1 {
+			filenames = append(filenames, path)
+			size += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := r.removeFiles(ctx, filenames); err != nil {
+		return err
+	}
+	if n := len(filenames); n > 0 {
+		log.Printf("%s(%s): retainer: deleting unlinked dedup objects; n=%d size=%d", r.db.Path(), r.Name(), n, size)
+	}
+	return nil
+}
+
+// sha256File returns the hex-encoded SHA-256 hash of a file's contents.
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,126 @@
+package litestream
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirArchiveExt is the file extension of databases included by ArchiveDir.
+const DirArchiveExt = ".db"
+
+// FindDBs returns the paths of all database files with a ".db" extension
+// within dir & its subdirectories, in lexical order. SQLite auxiliary files
+// and Litestream metadata directories are skipped.
+func FindDBs(dir string) ([]string, error) {
+	var paths []string
+	if err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.IsDir() && strings.HasSuffix(fi.Name(), MetaDirSuffix) {
+			return filepath.SkipDir
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		} else if filepath.Ext(path) != DirArchiveExt || ValidateDBPath(path) != nil {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// ArchiveDir writes a snapshot of every database found in dir by FindDBs to
+// w as a gzip-compressed tar archive. Each database is copied with VACUUM INTO
+// so it is consistent on its own, however snapshots are taken one at a time
+// so the archive is not a single point-in-time across databases. Entries are
+// named by their path relative to dir. Files without a SQLite header, such as
+// empty databases, are skipped. Returns the number of databases archived.
+func ArchiveDir(ctx context.Context, dir string, w io.Writer) (n int, err error) {
+	paths, err := FindDBs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "*-litestream-archive")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, path := range paths {
+		if _, err := readDBHeader(path); err != nil {
+			continue // not an initialized database
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return n, err
+		}
+		if err := archiveDirDB(ctx, tw, path, filepath.ToSlash(rel), filepath.Join(tmpdir, "db")); err != nil {
+			return n, fmt.Errorf("cannot archive %s: %w", rel, err)
+		}
+		n++
+	}
+
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, zw.Close()
+}
+
+// archiveDirDB backs up the database at path to tmpPath & writes it to tw.
+func archiveDirDB(ctx context.Context, tw *tar.Writer, path, name, tmpPath string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	d, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", path, BusyTimeout.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if _, err := d.ExecContext(ctx, `VACUUM INTO ?`, tmpPath); err != nil {
+		return fmt.Errorf("cannot backup database: %w", err)
+	} else if err := d.Close(); err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tfi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(fi.Mode().Perm()),
+		Size:    tfi.Size(),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	} else if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
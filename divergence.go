@@ -0,0 +1,164 @@
+package litestream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// WAL divergence policies.
+//
+// The real WAL diverges from the shadow WAL when it is restarted with new
+// salts by another process, such as while Litestream is not running, before
+// the end of the shadow WAL has been captured. The policy only affects a
+// restart which can be identified from the WAL headers. Any other divergence
+// always starts a new generation.
+const (
+	// Start a new generation. Frames written to the previous WAL after the
+	// last sync may be missing from the shadow WAL so a new snapshot is
+	// required to guarantee a consistent restore.
+	WALDivergencePolicyNewGeneration = "new-generation"
+
+	// Continue the generation with the next shadow WAL index if the real WAL
+	// was restarted exactly once since the shadow WAL. Frames written to the
+	// previous WAL after the last sync cannot be detected & are lost from the
+	// generation, so replicas should be validated after a recovery.
+	WALDivergencePolicyRecover = "recover"
+)
+
+// DefaultWALDivergencePolicy is the default policy for databases.
+const DefaultWALDivergencePolicy = WALDivergencePolicyNewGeneration
+
+// IsWALDivergencePolicy returns true if s is a valid WAL divergence policy.
+func IsWALDivergencePolicy(s string) bool {
+	switch s {
+	case WALDivergencePolicyNewGeneration, WALDivergencePolicyRecover:
+		return true
+	default:
+		return false
+	}
+}
+
+// DivergenceAction is the action a sync takes based on the state of the real
+// WAL relative to the shadow WAL.
+type DivergenceAction int
+
+const (
+	// Append new frames from the real WAL to the current shadow WAL.
+	DivergenceActionNone DivergenceAction = iota
+
+	// Start the next shadow WAL index from the start of the real WAL.
+	DivergenceActionRestart
+
+	// Start a new generation.
+	DivergenceActionNewGeneration
+)
+
+// String returns the name of the action.
+func (a DivergenceAction) String() string {
+	switch a {
+	case DivergenceActionNone:
+		return "none"
+	case DivergenceActionRestart:
+		return "restart"
+	case DivergenceActionNewGeneration:
+		return "new-generation"
+	default:
+		return fmt.Sprintf("DivergenceAction(%d)", int(a))
+	}
+}
+
+// WALDivergence is the result of comparing the real WAL to the shadow WAL.
+type WALDivergence struct {
+	Action DivergenceAction
+	Reason string // blank if Action is DivergenceActionNone
+}
+
+// WALState is the state of the real & shadow WAL observed at the start of a
+// sync. Fields which cannot be read are left as zero values.
+type WALState struct {
+	Generation      string // current generation, blank if none
+	Index           int    // current shadow WAL index
+	ShadowWALExists bool
+	ShadowWALSize   int64 // frame-aligned size of the shadow WAL
+	WALSize         int64 // size of the real WAL
+	PageSize        int   // page size the database is tracking, if known
+
+	// WAL headers. Only read if the shadow WAL contains a full header.
+	WALHeader       []byte
+	ShadowWALHeader []byte
+
+	// Last frame in the shadow WAL & the frame at the same offset in the
+	// real WAL. Only read if the shadow WAL contains a frame & the real WAL
+	// is at least as large as the shadow WAL.
+	WALFrame       []byte
+	ShadowWALFrame []byte
+}
+
+// CheckWALDivergence returns the action a sync takes for the given state &
+// WAL divergence policy. See WALDivergencePolicyNewGeneration for policies.
+func CheckWALDivergence(s *WALState, policy string) WALDivergence {
+	switch {
+	case s.Generation == "":
+		return newGenerationDivergence("no generation exists")
+	case s.Index >= MaxIndex:
+		return newGenerationDivergence("max index exceeded")
+	case !s.ShadowWALExists:
+		return newGenerationDivergence("no shadow wal")
+	case s.ShadowWALSize < WALHeaderSize:
+		return newGenerationDivergence("short shadow wal")
+	}
+
+	// A page size change, such as by a VACUUM with a new page_size while
+	// Litestream was not running, changes the size of every frame so frames
+	// of the real WAL cannot be appended to the shadow WAL.
+	if n := walHeaderPageSize(s.WALHeader); n != 0 {
+		if prev := walHeaderPageSize(s.ShadowWALHeader); prev != 0 && prev != n {
+			return newGenerationDivergence(fmt.Sprintf("page size changed from %d to %d", prev, n))
+		} else if s.PageSize != 0 && s.PageSize != n {
+			return newGenerationDivergence(fmt.Sprintf("page size changed from %d to %d", s.PageSize, n))
+		}
+	}
+
+	// A restart replaces the entire WAL so the size & contents of the real
+	// WAL are not compared to the shadow WAL when recovering from one.
+	restart := !bytes.Equal(s.WALHeader, s.ShadowWALHeader)
+	if restart && isRecoverableWALRestart(policy, s.WALHeader, s.ShadowWALHeader) {
+		return WALDivergence{Action: DivergenceActionRestart, Reason: "wal restarted by another process"}
+	}
+
+	switch {
+	case s.ShadowWALSize > s.WALSize:
+		return newGenerationDivergence("wal truncated by another process")
+	case restart && s.ShadowWALSize == WALHeaderSize:
+		return newGenerationDivergence("wal header only, mismatched")
+	case s.ShadowWALSize > WALHeaderSize && !bytes.Equal(s.WALFrame, s.ShadowWALFrame):
+		return newGenerationDivergence("wal overwritten by another process")
+	case restart:
+		return newGenerationDivergence("wal header mismatch")
+	}
+	return WALDivergence{Action: DivergenceActionNone}
+}
+
+func newGenerationDivergence(reason string) WALDivergence {
+	return WALDivergence{Action: DivergenceActionNewGeneration, Reason: reason}
+}
+
+// isRecoverableWALRestart returns true if the policy recovers from the real
+// WAL header hdr replacing the shadow WAL header prev.
+func isRecoverableWALRestart(policy string, hdr, prev []byte) bool {
+	return policy == WALDivergencePolicyRecover && isWALRestartOf(hdr, prev)
+}
+
+// isWALRestartOf returns true if hdr is the header SQLite writes when it
+// restarts the WAL with header prev. A restart increments the checkpoint
+// sequence number & the first salt.
+func isWALRestartOf(hdr, prev []byte) bool {
+	if len(hdr) < WALHeaderSize || len(prev) < WALHeaderSize {
+		return false
+	} else if !bytes.Equal(hdr[:12], prev[:12]) {
+		return false // magic, version, or page size changed
+	}
+	return binary.BigEndian.Uint32(hdr[12:]) == binary.BigEndian.Uint32(prev[12:])+1 &&
+		binary.BigEndian.Uint32(hdr[16:]) == binary.BigEndian.Uint32(prev[16:])+1
+}
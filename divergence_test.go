@@ -0,0 +1,176 @@
+package litestream_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestCheckWALDivergence(t *testing.T) {
+	const frameSize = 4096 + litestream.WALFrameHeaderSize
+	hdr := MustWALHeader(t, 1, 100)
+	frame := bytes.Repeat([]byte{1}, frameSize)
+
+	// newState returns the state of a shadow WAL in sync with the real WAL.
+	newState := func() *litestream.WALState {
+		return &litestream.WALState{
+			Generation:      "0123456789abcdef",
+			ShadowWALExists: true,
+			ShadowWALSize:   litestream.WALHeaderSize + frameSize,
+			WALSize:         litestream.WALHeaderSize + (2 * frameSize),
+			WALHeader:       hdr,
+			ShadowWALHeader: hdr,
+			WALFrame:        frame,
+			ShadowWALFrame:  frame,
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy string
+		state  func(s *litestream.WALState)
+		action litestream.DivergenceAction
+		reason string
+	}{
+		{
+			name:   "OK",
+			state:  func(s *litestream.WALState) {},
+			action: litestream.DivergenceActionNone,
+		},
+		{
+			name:   "NoGeneration",
+			state:  func(s *litestream.WALState) { s.Generation = "" },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "no generation exists",
+		},
+		{
+			name:   "MaxIndex",
+			state:  func(s *litestream.WALState) { s.Index = litestream.MaxIndex },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "max index exceeded",
+		},
+		{
+			name:   "NoShadowWAL",
+			state:  func(s *litestream.WALState) { s.ShadowWALExists, s.ShadowWALSize = false, 0 },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "no shadow wal",
+		},
+		{
+			name:   "ShortShadowWAL",
+			state:  func(s *litestream.WALState) { s.ShadowWALSize = litestream.WALHeaderSize - 1 },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "short shadow wal",
+		},
+		{
+			name: "Truncated",
+			state: func(s *litestream.WALState) {
+				s.WALSize, s.WALFrame, s.ShadowWALFrame = litestream.WALHeaderSize, nil, frame
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal truncated by another process",
+		},
+		{
+			name: "HeaderOnlyMismatch",
+			state: func(s *litestream.WALState) {
+				s.ShadowWALSize, s.WALHeader = litestream.WALHeaderSize, MustWALHeader(t, 5, 200)
+				s.WALFrame, s.ShadowWALFrame = nil, nil
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal header only, mismatched",
+		},
+		{
+			name:   "Overwritten",
+			state:  func(s *litestream.WALState) { s.WALFrame = bytes.Repeat([]byte{2}, frameSize) },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal overwritten by another process",
+		},
+		{
+			name:   "HeaderMismatch",
+			state:  func(s *litestream.WALState) { s.WALHeader = MustWALHeader(t, 5, 200) },
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal header mismatch",
+		},
+
+		{
+			name: "PageSizeChanged",
+			state: func(s *litestream.WALState) {
+				s.WALHeader = MustWALHeader(t, 1, 100)
+				binary.BigEndian.PutUint32(s.WALHeader[8:], 8192)
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "page size changed from 4096 to 8192",
+		},
+		{
+			name: "TrackedPageSizeChanged",
+			state: func(s *litestream.WALState) {
+				s.PageSize = 8192
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "page size changed from 8192 to 4096",
+		},
+
+		// A restart starts a new generation by default.
+		{
+			name: "NewGeneration",
+			state: func(s *litestream.WALState) {
+				s.WALHeader, s.WALFrame = MustWALHeader(t, 2, 101), bytes.Repeat([]byte{2}, frameSize)
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal overwritten by another process",
+		},
+
+		// A single restart is recovered regardless of the real WAL size.
+		{
+			name:   "Recover",
+			policy: litestream.WALDivergencePolicyRecover,
+			state: func(s *litestream.WALState) {
+				s.WALHeader, s.WALSize, s.WALFrame = MustWALHeader(t, 2, 101), litestream.WALHeaderSize, nil
+			},
+			action: litestream.DivergenceActionRestart,
+			reason: "wal restarted by another process",
+		},
+
+		// Multiple restarts may have discarded whole WALs so they still
+		// start a new generation.
+		{
+			name:   "RecoverMultipleRestarts",
+			policy: litestream.WALDivergencePolicyRecover,
+			state: func(s *litestream.WALState) {
+				s.WALHeader, s.WALFrame = MustWALHeader(t, 3, 102), bytes.Repeat([]byte{2}, frameSize)
+			},
+			action: litestream.DivergenceActionNewGeneration,
+			reason: "wal overwritten by another process",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			if policy == "" {
+				policy = litestream.DefaultWALDivergencePolicy
+			}
+
+			s := newState()
+			tt.state(s)
+			if d := litestream.CheckWALDivergence(s, policy); d.Action != tt.action {
+				t.Fatalf("Action=%s, want %s", d.Action, tt.action)
+			} else if d.Reason != tt.reason {
+				t.Fatalf("Reason=%q, want %q", d.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+// MustWALHeader returns a WAL header with a given checkpoint sequence number
+// & first salt.
+func MustWALHeader(tb testing.TB, ckpt, salt uint32) []byte {
+	tb.Helper()
+	hdr := make([]byte, litestream.WALHeaderSize)
+	binary.BigEndian.PutUint32(hdr[0:], 0x377f0682)
+	binary.BigEndian.PutUint32(hdr[4:], 3007000)
+	binary.BigEndian.PutUint32(hdr[8:], 4096)
+	binary.BigEndian.PutUint32(hdr[12:], ckpt)
+	binary.BigEndian.PutUint32(hdr[16:], salt)
+	binary.BigEndian.PutUint32(hdr[20:], salt*7)
+	return hdr
+}
@@ -0,0 +1,197 @@
+package litestream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestName is the name of the manifest file in a downloaded backup bundle.
+const ManifestName = "manifest.json"
+
+// Manifest describes the contents of a backup bundle created by Download.
+type Manifest struct {
+	Replica       string    `json:"replica"`
+	Generation    string    `json:"generation"`
+	SnapshotIndex int       `json:"snapshot_index"`
+	MaxWALIndex   int       `json:"max_wal_index"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Backup format version of the bundle. Manifests written before the
+	// version was recorded are FormatVersion1.
+	FormatVersion int `json:"format_version,omitempty"`
+
+	// Checksums of each file in the bundle keyed by slash-separated path
+	// relative to the bundle directory. Checksums are computed over the
+	// stored (compressed) file using the IntegrityHash algorithm.
+	IntegrityHash string            `json:"integrity_hash,omitempty"`
+	Checksums     map[string]string `json:"checksums,omitempty"`
+}
+
+// ReadManifest reads the manifest from a backup bundle directory.
+func ReadManifest(dir string) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+
+	// Refuse bundles written in a newer format before reading any files.
+	if m.FormatVersion == 0 {
+		m.FormatVersion = FormatVersion1
+	} else if m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("manifest: %w: %d, this version of litestream reads up to version %d; upgrade litestream to read this backup", ErrUnsupportedFormatVersion, m.FormatVersion, FormatVersion)
+	}
+	return &m, nil
+}
+
+// VerifyManifest returns an error if any file listed in the manifest's
+// checksums is missing from dir or does not match its checksum.
+func VerifyManifest(dir string, m *Manifest) error {
+	for name, want := range m.Checksums {
+		got, err := integrityChecksumFile(m.IntegrityHash, filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("cannot verify %s: %w", name, err)
+		} else if got != want {
+			return fmt.Errorf("%s: %w", name, ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// Download copies the minimal set of files required to restore the latest
+// generation of r to its latest position into dir. This is the latest snapshot
+// and all WAL files after it. The bundle uses the same layout as a file replica
+// so it can be restored offline by using a FileReplica with dir as its path.
+// Each file's checksum is recorded in the manifest using the named integrity hash.
+//
+// The manifest is written last so a bundle without one is incomplete.
+func Download(ctx context.Context, r Replica, dir, integrityHash string) (*Manifest, error) {
+	if _, err := NewIntegrityHash(integrityHash); err != nil {
+		return nil, err
+	}
+
+	generation, _, err := CalcReplicaRestoreTarget(ctx, r, NewRestoreOptions())
+	if err != nil {
+		return nil, err
+	} else if generation == "" {
+		return nil, fmt.Errorf("no generation available")
+	}
+
+	snapshotIndex, err := SnapshotIndexAt(ctx, r, generation, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot find snapshot index: %w", err)
+	}
+	maxWALIndex, err := WALIndexAt(ctx, r, generation, math.MaxInt64, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot find max wal index: %w", err)
+	}
+
+	bundle := NewFileReplica(nil, "", dir)
+	checksums := make(map[string]string)
+	addChecksum := func(filename string) error {
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		checksums[filepath.ToSlash(rel)], err = integrityChecksumFile(integrityHash, filename)
+		return err
+	}
+
+	// Copy snapshot to the bundle.
+	rd, err := snapshotImageReader(ctx, r, generation, snapshotIndex)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot: %w", err)
+	}
+	defer rd.Close()
+
+	snapshotPath := bundle.SnapshotPath(generation, snapshotIndex)
+	if err := downloadFile(rd, snapshotPath); err != nil {
+		return nil, fmt.Errorf("cannot download snapshot %s/%08x: %w", generation, snapshotIndex, err)
+	} else if err := rd.Close(); err != nil {
+		return nil, err
+	} else if err := addChecksum(snapshotPath); err != nil {
+		return nil, err
+	}
+
+	// Copy each WAL file from the snapshot index to the max index.
+	for index := snapshotIndex; index <= maxWALIndex; index++ {
+		rd, err := r.WALReader(ctx, generation, index)
+		if os.IsNotExist(err) && index == snapshotIndex && index == maxWALIndex {
+			break // snapshot only, no wal available
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot open wal %s/%08x: %w", generation, index, err)
+		}
+
+		walPath := bundle.WALPath(generation, index) + LookupCodec(DefaultCompression).Ext
+		err = downloadFile(rd, walPath)
+		if e := rd.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot download wal %s/%08x: %w", generation, index, err)
+		} else if err := addChecksum(walPath); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &Manifest{
+		Replica:       r.Name(),
+		Generation:    generation,
+		SnapshotIndex: snapshotIndex,
+		MaxWALIndex:   maxWALIndex,
+		CreatedAt:     time.Now().UTC(),
+		FormatVersion: FormatVersion,
+		IntegrityHash: integrityHash,
+		Checksums:     checksums,
+	}
+
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	} else if err := ioutil.WriteFile(filepath.Join(dir, ManifestName), buf, 0666); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// downloadFile writes the contents of rd to filename as a compressed object.
+// Data is written to a temporary file and atomically moved into place.
+func downloadFile(rd io.Reader, filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw, err := NewObjectWriter(f, LookupCodec(DefaultCompression), DefaultCompressionWorkers)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+
+	if _, err := io.Copy(zw, rd); err != nil {
+		return err
+	} else if err := zw.Close(); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
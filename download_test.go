@@ -0,0 +1,161 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestDownload(t *testing.T) {
+	// Ensure a downloaded bundle can be restored offline to the latest position.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Write enough to roll over to a new WAL index so multiple WAL files are required.
+		for i := 0; i < db.MinCheckpointPageN; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(t.TempDir(), "bundle")
+		m, err := litestream.Download(context.Background(), r, dir, litestream.IntegrityHashCRC64)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := m.Generation, pos.Generation; got != want {
+			t.Fatalf("Generation=%s, want %s", got, want)
+		} else if got, want := m.MaxWALIndex, pos.Index; got != want {
+			t.Fatalf("MaxWALIndex=%d, want %d", got, want)
+		} else if m.SnapshotIndex >= m.MaxWALIndex {
+			t.Fatalf("expected multiple wal files: %d-%d", m.SnapshotIndex, m.MaxWALIndex)
+		}
+
+		// Ensure manifest is persisted to the bundle.
+		if other, err := litestream.ReadManifest(dir); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other, m) {
+			t.Fatalf("unexpected manifest: %#v", other)
+		}
+
+		// Restore from the bundle without access to the original replica.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = m.Generation
+		if err := litestream.RestoreReplica(context.Background(), litestream.NewFileReplica(nil, "", dir), opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), db.MinCheckpointPageN+1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+	// Ensure bundle checksums round trip with each integrity hash and detect
+	// files which have been modified after download.
+	for _, integrityHash := range []string{litestream.IntegrityHashCRC64, litestream.IntegrityHashSHA256} {
+		integrityHash := integrityHash
+		t.Run("IntegrityHash/"+integrityHash, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			r := NewTestFileReplica(t, db)
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			}
+			MustSyncDBReplica(t, db, r)
+
+			dir := filepath.Join(t.TempDir(), "bundle")
+			if _, err := litestream.Download(context.Background(), r, dir, integrityHash); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := litestream.ReadManifest(dir)
+			if err != nil {
+				t.Fatal(err)
+			} else if got, want := m.IntegrityHash, integrityHash; got != want {
+				t.Fatalf("IntegrityHash=%s, want %s", got, want)
+			} else if len(m.Checksums) == 0 {
+				t.Fatal("expected checksums")
+			} else if err := litestream.VerifyManifest(dir, m); err != nil {
+				t.Fatal(err)
+			}
+
+			// Tamper with the snapshot & ensure verification fails.
+			snapshotPath := litestream.NewFileReplica(nil, "", dir).SnapshotPath(m.Generation, m.SnapshotIndex)
+			buf, err := ioutil.ReadFile(snapshotPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf[len(buf)-1] ^= 0xFF
+			if err := ioutil.WriteFile(snapshotPath, buf, 0600); err != nil {
+				t.Fatal(err)
+			} else if err := litestream.VerifyManifest(dir, m); !errors.Is(err, litestream.ErrChecksumMismatch) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// Ensure an unsupported integrity hash is rejected before downloading.
+	t.Run("ErrInvalidIntegrityHash", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		dir := filepath.Join(t.TempDir(), "bundle")
+		if _, err := litestream.Download(context.Background(), r, dir, "md5"); err == nil || err.Error() != `invalid integrity hash: "md5"` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatal("expected no bundle directory")
+		}
+	})
+}
+
+func TestReadManifest(t *testing.T) {
+	// Ensure a manifest without a format version is read as the first version.
+	t.Run("NoFormatVersion", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, litestream.ManifestName), []byte(`{"generation":"0123456789abcdef"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if m, err := litestream.ReadManifest(dir); err != nil {
+			t.Fatal(err)
+		} else if got, want := m.FormatVersion, litestream.FormatVersion1; got != want {
+			t.Fatalf("FormatVersion=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a bundle written in a newer format is refused.
+	t.Run("ErrUnsupportedFormatVersion", func(t *testing.T) {
+		dir := t.TempDir()
+		buf := []byte(fmt.Sprintf(`{"generation":"0123456789abcdef","format_version":%d}`, litestream.FormatVersion+1))
+		if err := ioutil.WriteFile(filepath.Join(dir, litestream.ManifestName), buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := litestream.ReadManifest(dir); !errors.Is(err, litestream.ErrUnsupportedFormatVersion) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
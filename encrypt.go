@@ -0,0 +1,162 @@
+package litestream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// EncryptionExt is appended to the names of objects encrypted with age, after
+// the extension of the codec used to compress them (e.g. ".snapshot.lz4.age").
+const EncryptionExt = ".age"
+
+// Encryption encrypts snapshot & WAL objects with age between the compression
+// codec & the replica's storage. New objects are encrypted to the recipients
+// & encrypted objects are decrypted with the identities.
+//
+// Identities hold private key material so an Encryption never formats its
+// keys when printed.
+type Encryption struct {
+	Recipients []age.Recipient
+	Identities []age.Identity
+}
+
+// NewEncryption returns an Encryption for the given age recipient public keys
+// & identity file. The identity file may itself be encrypted with passphrase,
+// such as with "age -p". Either may be blank, but an Encryption without
+// recipients cannot encrypt & one without identities cannot decrypt.
+func NewEncryption(recipients []string, identityPath, passphrase string) (*Encryption, error) {
+	e := &Encryption{}
+	for _, s := range recipients {
+		a, err := age.ParseRecipients(strings.NewReader(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient: %w", err)
+		}
+		e.Recipients = append(e.Recipients, a...)
+	}
+
+	if identityPath != "" {
+		identities, err := parseAgeIdentityFile(identityPath, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		e.Identities = identities
+	}
+	return e, nil
+}
+
+// parseAgeIdentityFile returns the identities in an age identity file. Parse
+// errors do not include the underlying error as it may contain key material.
+func parseAgeIdentityFile(filename, passphrase string) ([]age.Identity, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open age identity file: %w", err)
+	}
+	defer f.Close()
+
+	// Decrypt the identity file first if it is encrypted, armored or not.
+	var rd io.Reader = bufio.NewReader(f)
+	if buf, _ := rd.(*bufio.Reader).Peek(64); bytes.HasPrefix(buf, []byte("age-encryption.org/")) || bytes.HasPrefix(buf, []byte(armor.Header)) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("age identity file is encrypted, passphrase required: %s", filename)
+		}
+		if bytes.HasPrefix(buf, []byte(armor.Header)) {
+			rd = armor.NewReader(rd)
+		}
+
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		} else if rd, err = age.Decrypt(rd, identity); err != nil {
+			return nil, fmt.Errorf("cannot decrypt age identity file: %s: %w", filename, err)
+		}
+	}
+
+	identities, err := age.ParseIdentities(rd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity file: %s", filename)
+	}
+	return identities, nil
+}
+
+// CanEncrypt returns true if e has recipients to encrypt new objects to.
+func (e *Encryption) CanEncrypt() bool {
+	return e != nil && len(e.Recipients) > 0
+}
+
+// String returns a description of e which does not include key material.
+func (e *Encryption) String() string {
+	if e == nil {
+		return "none"
+	}
+	return fmt.Sprintf("age(recipients=%d, identities=%d)", len(e.Recipients), len(e.Identities))
+}
+
+// GoString returns the same description as String so %#v does not print keys.
+func (e *Encryption) GoString() string { return e.String() }
+
+// Codec returns a codec which compresses with c & then encrypts the
+// compressed data. Its extension is the extension of c with EncryptionExt.
+func (e *Encryption) Codec(c *Codec) *Codec {
+	return &Codec{
+		Name: c.Name,
+		Ext:  c.Ext + EncryptionExt,
+		NewWriter: func(w io.Writer, workers int) (io.WriteCloser, error) {
+			if !e.CanEncrypt() {
+				return nil, fmt.Errorf("age recipient required to encrypt")
+			}
+			ew, err := age.Encrypt(w, e.Recipients...)
+			if err != nil {
+				return nil, err
+			}
+			zw, err := c.NewWriter(ew, workers)
+			if err != nil {
+				return nil, err
+			}
+			return &encryptWriter{WriteCloser: zw, ew: ew}, nil
+		},
+		NewReader: func(r io.Reader, workers int) (io.Reader, error) {
+			if e == nil || len(e.Identities) == 0 {
+				return nil, ErrIdentityRequired
+			}
+			dr, err := age.Decrypt(r, e.Identities...)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decrypt: %w", err)
+			}
+			return c.NewReader(dr, workers)
+		},
+	}
+}
+
+// encryptWriter closes the compressor & then the encryptor so all compressed
+// data is encrypted & flushed.
+type encryptWriter struct {
+	io.WriteCloser
+	ew io.WriteCloser
+}
+
+func (w *encryptWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.ew.Close()
+}
+
+// ObjectCodec returns the codec for a snapshot or WAL object by the extension
+// following the snapshot or WAL extension, such as ".lz4" or ".lz4.age".
+// Encrypted objects are decrypted with the identities of e, which may be nil;
+// reading them fails with ErrIdentityRequired if e has no identities.
+// Returns nil if no codec is registered for the extension.
+func ObjectCodec(ext string, e *Encryption) *Codec {
+	c := CodecByExt(strings.TrimSuffix(ext, EncryptionExt))
+	if c == nil || !strings.HasSuffix(ext, EncryptionExt) {
+		return c
+	}
+	return e.Codec(c)
+}
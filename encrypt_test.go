@@ -0,0 +1,156 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/benbjohnson/litestream"
+)
+
+func TestFileReplica_Encryption(t *testing.T) {
+	// Ensure snapshots & WAL segments are encrypted on write & decrypted on
+	// restore with the identity file.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		identity := MustGenerateAgeIdentity(t)
+
+		r := NewTestFileReplica(t, db)
+		r.Codec = litestream.LookupCodec(litestream.CompressionLZ4)
+		r.Encryption = MustNewEncryption(t, identity)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext := r.Codec.Ext + litestream.EncryptionExt
+		for _, filename := range []string{
+			filepath.Join(r.SnapshotDir(pos.Generation), "00000000"+litestream.SnapshotExt+ext),
+			r.WALPath(pos.Generation, pos.Index-1) + ext,
+		} {
+			if buf, err := ioutil.ReadFile(filename); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Contains(buf, []byte("age-encryption.org/")) {
+				t.Fatalf("file not encrypted: %s", filename)
+			}
+		}
+
+		if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure restoring encrypted files without an identity fails.
+	t.Run("ErrIdentityRequired", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		r := NewTestFileReplica(t, db)
+		e := MustNewEncryption(t, MustGenerateAgeIdentity(t))
+		e.Identities = nil
+		r.Encryption = e
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, enc := range []*litestream.Encryption{e, nil} {
+			r.Encryption = enc
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(t.TempDir(), "db")
+			opt.Generation = pos.Generation
+			if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrIdentityRequired) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+}
+
+func TestNewEncryption(t *testing.T) {
+	// Ensure an identity file encrypted with a passphrase can be read.
+	t.Run("Passphrase", func(t *testing.T) {
+		identity := MustGenerateAgeIdentity(t)
+
+		recipient, err := age.NewScryptRecipient("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipient.SetWorkFactor(10)
+
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, recipient)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := w.Write([]byte(identity.String() + "\n")); err != nil {
+			t.Fatal(err)
+		} else if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), "key.txt.age")
+		if err := ioutil.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if e, err := litestream.NewEncryption(nil, filename, "secret"); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(e.Identities), 1; got != want {
+			t.Fatalf("identities=%d, want %d", got, want)
+		}
+
+		if _, err := litestream.NewEncryption(nil, filename, ""); err == nil || !strings.Contains(err.Error(), "passphrase required") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure key material is never formatted with an encryption.
+	t.Run("String", func(t *testing.T) {
+		identity := MustGenerateAgeIdentity(t)
+		e := MustNewEncryption(t, identity)
+		if s := e.String(); strings.Contains(s, identity.String()) || strings.Contains(s, identity.Recipient().String()) {
+			t.Fatalf("key material in string: %s", s)
+		}
+	})
+}
+
+// MustGenerateAgeIdentity returns a new X25519 age identity.
+func MustGenerateAgeIdentity(tb testing.TB) *age.X25519Identity {
+	tb.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return identity
+}
+
+// MustNewEncryption returns an encryption to & from identity using an
+// identity file written to a temporary directory.
+func MustNewEncryption(tb testing.TB, identity *age.X25519Identity) *litestream.Encryption {
+	tb.Helper()
+	filename := filepath.Join(tb.TempDir(), "key.txt")
+	if err := ioutil.WriteFile(filename, []byte(identity.String()+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	e, err := litestream.NewEncryption([]string{identity.Recipient().String()}, filename, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return e
+}
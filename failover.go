@@ -0,0 +1,418 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultFailoverErrorN is the default number of consecutive sync errors of a
+// failover client after which the next client is also written.
+const DefaultFailoverErrorN = 3
+
+var _ Replica = (*FailoverReplica)(nil)
+var _ CommitTimeReader = (*FailoverReplica)(nil)
+
+// Syncer is implemented by replicas which can be synced on demand, such as
+// the clients of a FailoverReplica.
+type Syncer interface {
+	Sync(ctx context.Context) error
+}
+
+// FailoverReplica is a replica which writes to the first of an ordered list
+// of clients, the primary, & only writes to the next client while the
+// previous client is failing, such as to a bucket in a second region while
+// the first region is unreachable. The primary is synced on every sync so it
+// is caught up once it recovers. Each client tracks its own position.
+//
+// Reads use the primary. Clients can be read directly, such as to restore
+// from the secondary, by passing their names to DB.Replica or RestoreOptions.
+type FailoverReplica struct {
+	db   *DB
+	name string
+
+	syncMu sync.Mutex   // serializes syncs
+	mu     sync.RWMutex // protects errNs
+	errNs  []int        // consecutive sync errors by client
+
+	wg     sync.WaitGroup
+	cancel func()
+
+	// Ordered list of clients, starting with the primary. Clients must
+	// implement Syncer & are synced by the failover replica so they should
+	// not be started. Validation & continuity checks of clients are not run.
+	Clients []Replica
+
+	// Number of consecutive sync errors of a client after which the next
+	// client is also written. Defaults to DefaultFailoverErrorN.
+	FailoverErrorN int
+
+	// Minimum time between syncs with the shadow WAL.
+	SyncInterval time.Duration
+
+	// Time between retention checks of the clients being written.
+	RetentionCheckInterval time.Duration
+
+	// If true, replica monitors database for changes automatically.
+	// Set to false if replica is being used synchronously (such as in tests).
+	MonitorEnabled bool
+}
+
+// NewFailoverReplica returns a new instance of FailoverReplica.
+func NewFailoverReplica(db *DB, name string, clients ...Replica) *FailoverReplica {
+	return &FailoverReplica{
+		db:     db,
+		name:   name,
+		cancel: func() {},
+
+		Clients:                clients,
+		FailoverErrorN:         DefaultFailoverErrorN,
+		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		MonitorEnabled:         true,
+	}
+}
+
+// Name returns the name of the replica. Returns the type if no name set.
+func (r *FailoverReplica) Name() string {
+	if r.name == "" {
+		return r.Type()
+	}
+	return r.name
+}
+
+// Type returns the type of replica.
+func (r *FailoverReplica) Type() string { return "failover" }
+
+// DB returns the parent database reference.
+func (r *FailoverReplica) DB() *DB { return r.db }
+
+// primary returns the first client.
+func (r *FailoverReplica) primary() Replica { return r.Clients[0] }
+
+// errN returns the number of consecutive sync errors of the client at i.
+func (r *FailoverReplica) errN(i int) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if i >= len(r.errNs) {
+		return 0
+	}
+	return r.errNs[i]
+}
+
+// markSyncResult records the result of a sync of the client at i & returns
+// its number of consecutive errors before the sync.
+func (r *FailoverReplica) markSyncResult(i int, err error) (prevN int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errNs) != len(r.Clients) {
+		r.errNs = make([]int, len(r.Clients))
+	}
+
+	prevN = r.errNs[i]
+	if err == nil {
+		r.errNs[i] = 0
+	} else {
+		r.errNs[i]++
+	}
+	return prevN
+}
+
+// failoverErrorN returns the number of sync errors before failing over.
+func (r *FailoverReplica) failoverErrorN() int {
+	if r.FailoverErrorN <= 0 {
+		return DefaultFailoverErrorN
+	}
+	return r.FailoverErrorN
+}
+
+// ActiveN returns the number of clients being written, starting with the
+// primary. A client is written while every client before it is failing.
+func (r *FailoverReplica) ActiveN() int {
+	n := 1
+	for n < len(r.Clients) && r.errN(n-1) >= r.failoverErrorN() {
+		n++
+	}
+	return n
+}
+
+// LastPos returns the lowest position of the clients being written so the
+// database keeps the shadow WAL each of them has yet to upload. Returns a
+// zero position if the clients are replicating different generations.
+func (r *FailoverReplica) LastPos() Pos {
+	var min Pos
+	for i, c := range r.Clients[:r.ActiveN()] {
+		pos := c.LastPos()
+		if i == 0 {
+			min = pos
+		} else if pos.Generation != min.Generation {
+			return Pos{}
+		} else if pos.Index < min.Index || (pos.Index == min.Index && pos.Offset < min.Offset) {
+			min = pos
+		}
+	}
+	return min
+}
+
+// Start starts replication in a background goroutine.
+func (r *FailoverReplica) Start(ctx context.Context) {
+	// Ignore if replica is being used sychronously.
+	if !r.MonitorEnabled {
+		return
+	}
+
+	// Stop previous replication.
+	r.Stop()
+
+	// Wrap context with cancelation.
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	// Start goroutine to replicate data.
+	r.wg.Add(2)
+	go func() { defer r.wg.Done(); r.monitor(ctx) }()
+	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+}
+
+// Stop cancels any outstanding replication, including background snapshots
+// of the clients, and blocks until finished.
+func (r *FailoverReplica) Stop() {
+	r.cancel()
+	r.wg.Wait()
+	for _, c := range r.Clients {
+		c.Stop()
+	}
+}
+
+// Close releases the resources held by the clients, such as shared clients.
+func (r *FailoverReplica) Close() (err error) {
+	for _, c := range r.Clients {
+		if cc, ok := c.(io.Closer); ok {
+			if e := cc.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// ReloadCredentials reloads the credentials of each client which supports it.
+func (r *FailoverReplica) ReloadCredentials() (err error) {
+	for _, c := range r.Clients {
+		if cc, ok := c.(interface{ ReloadCredentials() error }); ok {
+			if e := cc.ReloadCredentials(); e != nil && err == nil {
+				err = fmt.Errorf("%s: %w", c.Name(), e)
+			}
+		}
+	}
+	return err
+}
+
+// monitor runs in a separate goroutine and continuously replicates the DB.
+func (r *FailoverReplica) monitor(ctx context.Context) {
+	// Copy pending changes once replication stops.
+	defer r.flush()
+
+	// Enforce a minimum time between synchronization, if set.
+	var tick <-chan time.Time
+	if r.SyncInterval > 0 {
+		ticker := time.NewTicker(r.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// Continuously check for new data to replicate.
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+	priority := r.db.PriorityNotify()
+
+	var resume <-chan time.Time
+	for initial := true; ; initial = false {
+		// Wait for the sync interval unless a change to a priority table
+		// needs to be copied immediately.
+		if !initial && tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-priority:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		case <-resume:
+		}
+
+		// Fetch new notify channels before replicating data.
+		notify, priority = r.db.Notify(), r.db.PriorityNotify()
+		resume = nil
+
+		// Catch up once the maintenance window ends even if nothing changes.
+		if d := r.db.MaintenanceRemaining(); d > 0 {
+			resume = time.After(d)
+		}
+
+		if err := r.Sync(ctx); err != nil {
+			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
+			continue
+		}
+	}
+}
+
+// flush syncs changes which have not been replicated yet after the monitor stops.
+func (r *FailoverReplica) flush() {
+	if pos, err := r.db.Pos(); err != nil || pos.IsZero() || pos == r.LastPos() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownSyncTimeout)
+	defer cancel()
+	if err := r.Sync(ctx); err != nil {
+		log.Printf("%s(%s): shutdown sync error: %s", r.db.Path(), r.Name(), err)
+	}
+}
+
+// retainer runs in a separate goroutine and handles retention.
+func (r *FailoverReplica) retainer(ctx context.Context) {
+	// Exit if retention is only run on demand.
+	if r.RetentionCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.RetentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.RunRetention(ctx); err != nil {
+				log.Printf("%s(%s): retainer error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// Sync syncs the primary & then each following client only while the client
+// before it has failed at least FailoverErrorN consecutive syncs. A client
+// written for the first time, or after falling behind, uploads its backlog
+// from its own position. Returns nil once any client syncs successfully.
+func (r *FailoverReplica) Sync(ctx context.Context) (err error) {
+	// Changes to the shadow WAL before this time are uploaded by a successful sync.
+	startTime := time.Now()
+	defer func() { r.db.MarkReplicaSyncResult(r.Name(), err) }()
+
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	if len(r.Clients) == 0 {
+		return fmt.Errorf("no failover clients")
+	}
+
+	for i, c := range r.Clients {
+		s, ok := c.(Syncer)
+		if !ok {
+			return fmt.Errorf("failover client %q cannot be synced", c.Name())
+		}
+
+		e := s.Sync(ctx)
+		prevN := r.markSyncResult(i, e)
+		if e == nil {
+			if prevN >= r.failoverErrorN() {
+				log.Printf("%s(%s): client %q recovered after %d errors", r.db.Path(), r.Name(), c.Name(), prevN)
+			}
+			r.db.MarkReplicaSynced(r.Name(), startTime)
+			return nil
+		}
+
+		err = fmt.Errorf("%s: %w", c.Name(), e)
+		if n := prevN + 1; n < r.failoverErrorN() {
+			return err
+		} else if n == r.failoverErrorN() && i+1 < len(r.Clients) {
+			log.Printf("%s(%s): client %q failed %d consecutive syncs, failing over to %q: %s", r.db.Path(), r.Name(), c.Name(), n, r.Clients[i+1].Name(), e)
+		}
+	}
+	return err
+}
+
+// RunRetention enforces retention on each client being written & returns the
+// combined summary of deleted files. Retention of other clients is enforced
+// the next time they are written.
+func (r *FailoverReplica) RunRetention(ctx context.Context) (result RetentionResult, err error) {
+	for _, c := range r.Clients[:r.ActiveN()] {
+		other, err := c.RunRetention(ctx)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", c.Name(), err)
+		}
+
+		result.Generations = append(result.Generations, other.Generations...)
+		result.SnapshotN += other.SnapshotN
+		result.WALN += other.WALN
+		result.Size += other.Size
+		result.Snapshotted = result.Snapshotted || other.Snapshotted
+	}
+	return result, nil
+}
+
+// CalcPos returns the position of the primary for a generation.
+func (r *FailoverReplica) CalcPos(ctx context.Context, generation string) (Pos, error) {
+	return r.primary().CalcPos(ctx, generation)
+}
+
+// Generations returns the generations of the primary.
+func (r *FailoverReplica) Generations(ctx context.Context) ([]string, error) {
+	return r.primary().Generations(ctx)
+}
+
+// GenerationStats returns stats for a generation of the primary.
+func (r *FailoverReplica) GenerationStats(ctx context.Context, generation string) (GenerationStats, error) {
+	return r.primary().GenerationStats(ctx, generation)
+}
+
+// Snapshots returns the snapshots of the primary.
+func (r *FailoverReplica) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
+	return r.primary().Snapshots(ctx)
+}
+
+// WALs returns the WAL files of the primary.
+func (r *FailoverReplica) WALs(ctx context.Context) ([]*WALInfo, error) {
+	return r.primary().WALs(ctx)
+}
+
+// SnapshotReader returns a reader for a snapshot of the primary.
+func (r *FailoverReplica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.primary().SnapshotReader(ctx, generation, index)
+}
+
+// WALReader returns a reader for a WAL file of the primary.
+func (r *FailoverReplica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.primary().WALReader(ctx, generation, index)
+}
+
+// CommitTimes returns the commit time index of a WAL file of the primary.
+// Returns os.ErrNotExist if the primary does not store commit time indexes.
+func (r *FailoverReplica) CommitTimes(ctx context.Context, generation string, index int) ([]CommitTime, error) {
+	cr, ok := r.primary().(CommitTimeReader)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return cr.CommitTimes(ctx, generation, index)
+}
+
+// restoreCandidates returns the replicas a restore can read from r. The
+// clients of a failover replica are returned so a restore can use the
+// client with the latest data.
+func restoreCandidates(r Replica) []Replica {
+	if fr, ok := r.(*FailoverReplica); ok {
+		return fr.Clients
+	}
+	return []Replica{r}
+}
@@ -0,0 +1,113 @@
+package litestream_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestFailoverReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	// Use a regular file as the destination of the primary so it fails.
+	filename := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(filename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	primary := litestream.NewFileReplica(db, "primary", filename)
+	secondary := litestream.NewFileReplica(db, "secondary", t.TempDir())
+	r := litestream.NewFailoverReplica(db, "failover", primary, secondary)
+	r.FailoverErrorN = 2
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure the secondary is not written until the primary fails enough syncs.
+	if err := r.Sync(context.Background()); err == nil {
+		t.Fatal("expected sync error")
+	} else if pos := secondary.LastPos(); !pos.IsZero() {
+		t.Fatalf("unexpected secondary position: %s", pos)
+	} else if n := r.ActiveN(); n != 1 {
+		t.Fatalf("ActiveN=%d, want 1", n)
+	}
+
+	// Ensure the secondary is caught up once the primary fails over.
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if n := r.ActiveN(); n != 2 {
+		t.Fatalf("ActiveN=%d, want 2", n)
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if got := secondary.LastPos(); got != pos {
+		t.Fatalf("secondary position=%s, want %s", got, pos)
+	} else if lag := db.ReplicaLag(r.Name()); lag != 0 {
+		t.Fatalf("unexpected lag: %s", lag)
+	}
+
+	// Ensure clients can be looked up & restored from by name.
+	if other := db.Replica("secondary"); other != secondary {
+		t.Fatalf("unexpected replica: %#v", other)
+	} else if other, generation, err := db.CalcRestoreTarget(context.Background(), litestream.RestoreOptions{ReplicaName: "secondary"}); err != nil {
+		t.Fatal(err)
+	} else if other != secondary {
+		t.Fatalf("unexpected restore replica: %#v", other)
+	} else if generation != pos.Generation {
+		t.Fatalf("generation=%s, want %s", generation, pos.Generation)
+	}
+
+	// Ensure the primary is caught up once it recovers & the secondary is
+	// no longer written.
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if n := r.ActiveN(); n != 1 {
+		t.Fatalf("ActiveN=%d, want 1", n)
+	}
+
+	prev := pos
+	if pos, err = db.Pos(); err != nil {
+		t.Fatal(err)
+	} else if got := primary.LastPos(); got != pos {
+		t.Fatalf("primary position=%s, want %s", got, pos)
+	} else if got := r.LastPos(); got != pos {
+		t.Fatalf("failover position=%s, want %s", got, pos)
+	} else if got := secondary.LastPos(); got != prev {
+		t.Fatalf("secondary position=%s, want %s", got, prev)
+	}
+}
+
+// Ensure changes to priority tables are written to the active clients without
+// waiting for the sync interval.
+func TestFailoverReplica_PriorityTables(t *testing.T) {
+	db, sqldb := MustOpenPriorityDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	primary := litestream.NewFileReplica(db, "primary", t.TempDir())
+	r := litestream.NewFailoverReplica(db, "failover", primary)
+	r.SyncInterval = time.Hour
+	db.Replicas = []litestream.Replica{r}
+
+	MustReplicatePriorityChange(t, db, sqldb, r)
+	if got, want := primary.LastPos(), r.LastPos(); got != want {
+		t.Fatalf("primary pos=%s, want %s", got, want)
+	}
+}
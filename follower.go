@@ -0,0 +1,171 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Default follower settings.
+const (
+	DefaultFollowInterval = 1 * time.Second
+)
+
+// Follower continuously restores a database from a replica. It performs an
+// initial restore of the latest generation and then polls the replica for new
+// WAL files and applies them to the output database. If the replica starts a
+// new generation then the database is fully restored from the new generation.
+//
+// Applications may read the output database while the follower runs, however,
+// it should only be opened in read-only mode as the follower overwrites the
+// database and its WAL during each apply.
+type Follower struct {
+	r    Replica
+	path string // output path
+
+	pos  Pos      // last applied generation & index, offset is not tracked
+	info *WALInfo // listing of last applied WAL file, if any
+
+	// Time between polls of the replica for new WAL files.
+	Interval time.Duration
+}
+
+// NewFollower returns a new instance of Follower that restores to path.
+func NewFollower(r Replica, path string) *Follower {
+	return &Follower{
+		r:        r,
+		path:     path,
+		Interval: DefaultFollowInterval,
+	}
+}
+
+// Path returns the output path of the restored database.
+func (f *Follower) Path() string {
+	return f.path
+}
+
+// Pos returns the generation & index of the last applied WAL file.
+// Returns a zero value if no restore has occurred yet.
+func (f *Follower) Pos() Pos {
+	return f.pos
+}
+
+// Run syncs the follower with the replica every interval until ctx is canceled.
+func (f *Follower) Run(ctx context.Context) error {
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+
+	for initial := true; ; initial = false {
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+
+		if err := f.Sync(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("%s(%s): follow error: %s", f.path, f.r.Name(), err)
+		}
+	}
+}
+
+// Sync restores the latest generation from the replica if the generation has
+// changed and then applies any new WAL files available on the replica.
+func (f *Follower) Sync(ctx context.Context) error {
+	generation, _, err := CalcReplicaRestoreTarget(ctx, f.r, NewRestoreOptions())
+	if err != nil {
+		return err
+	} else if generation == "" {
+		Tracef("%s(%s): follow: no generation available, waiting for data", f.path, f.r.Name())
+		return nil
+	}
+
+	// Perform a full restore if this is the initial sync or if the replica has
+	// started a new generation since the WAL files are not compatible.
+	if generation != f.pos.Generation {
+		return f.restore(ctx, generation)
+	}
+	return f.applyWAL(ctx, f.path)
+}
+
+// restore performs a full restore of generation into a temporary file, applies
+// any available WAL files, and then atomically moves it to the output path.
+func (f *Follower) restore(ctx context.Context, generation string) error {
+	index, err := SnapshotIndexAt(ctx, f.r, generation, time.Time{})
+	if err != nil {
+		return fmt.Errorf("cannot find snapshot index: %w", err)
+	}
+
+	tmpPath := f.path + ".tmp"
+	if err := restoreSnapshot(ctx, f.r, generation, index, tmpPath); err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	// Track position separately until the file has been moved into place so
+	// an error does not leave the follower with a position for a temp file.
+	prevPos, prevInfo := f.pos, f.info
+	f.pos, f.info = Pos{Generation: generation, Index: index}, nil
+	if err := f.applyWAL(ctx, tmpPath); err != nil {
+		f.pos, f.info = prevPos, prevInfo
+		return err
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		f.pos, f.info = prevPos, prevInfo
+		return err
+	}
+
+	log.Printf("%s(%s): follow: restored generation %s, index %08x", f.path, f.r.Name(), generation, f.pos.Index)
+	return nil
+}
+
+// applyWAL applies WAL files from the current index onward to the database at
+// dbPath. WAL files for the current index are reapplied if they have changed
+// since they grow until the primary database starts a new index. Applying
+// stops at the first missing index so out-of-order uploads are waited on.
+func (f *Follower) applyWAL(ctx context.Context, dbPath string) error {
+	wals, err := f.r.WALs(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list wal files: %w", err)
+	}
+
+	m := make(map[int]*WALInfo)
+	maxIndex := -1
+	for _, info := range wals {
+		if info.Generation != f.pos.Generation {
+			continue
+		}
+		m[info.Index] = info
+		if info.Index > maxIndex {
+			maxIndex = info.Index
+		}
+	}
+
+	index := f.pos.Index
+	for ; index <= maxIndex; index++ {
+		info := m[index]
+		if info == nil {
+			log.Printf("%s(%s): follow: waiting for wal %s/%08x, highest index is %08x", f.path, f.r.Name(), f.pos.Generation, index, maxIndex)
+			break
+		}
+
+		// Skip the current index if it has not changed since it was applied.
+		if index == f.pos.Index && f.info != nil && info.Size == f.info.Size && info.CreatedAt.Equal(f.info.CreatedAt) {
+			continue
+		}
+
+		if err := restoreWAL(ctx, f.r, f.pos.Generation, index, dbPath, true); err != nil {
+			return fmt.Errorf("cannot apply wal %s/%08x: %w", f.pos.Generation, index, err)
+		}
+		f.pos.Index, f.info = index, info
+
+		Tracef("%s(%s): follow: applied wal %s/%08x", f.path, f.r.Name(), f.pos.Generation, index)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package litestream_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestFollower_Sync(t *testing.T) {
+	// Ensure a follower can track a producing replica across WAL changes,
+	// WAL index rollovers, and new generations.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Follow the replica path without a reference to the source DB.
+		f := litestream.NewFollower(litestream.NewFileReplica(nil, "", r.Path()), filepath.Join(t.TempDir(), "db"))
+
+		// Sync with no data available should be a no-op.
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !f.Pos().IsZero() {
+			t.Fatalf("unexpected pos: %s", f.Pos())
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Initial sync should perform a full restore.
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, f.Path(), "foo"), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+		pos0 := f.Pos()
+
+		// Additional writes to the same WAL index should be applied.
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, f.Path(), "foo"), 11; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if got, want := f.Pos(), pos0; got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+
+		// Write enough to checkpoint & roll over to a new WAL index.
+		for i := 0; i < db.MinCheckpointPageN; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, f.Path(), "foo"), 12+db.MinCheckpointPageN; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if pos := f.Pos(); pos.Generation != pos0.Generation {
+			t.Fatalf("unexpected generation: %s", pos.Generation)
+		} else if pos.Index <= pos0.Index {
+			t.Fatalf("expected index to advance: %d", pos.Index)
+		}
+
+		// Truncate the WAL & reopen which forces a new generation on the primary.
+		if _, err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		} else if err := db.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db = MustOpenDBAt(t, db.Path())
+		defer MustCloseDB(t, db)
+		sqldb = MustOpenSQLDB(t, db.Path())
+		defer MustCloseSQLDB(t, sqldb)
+
+		r = litestream.NewFileReplica(db, "", r.Path())
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Follower should fully restore from the new generation.
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, f.Path(), "foo"), 13+db.MinCheckpointPageN; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if pos := f.Pos(); pos.Generation == pos0.Generation {
+			t.Fatal("expected new generation")
+		}
+	})
+}
+
+// MustSyncDBReplica syncs the database to the shadow WAL and then to the replica.
+func MustSyncDBReplica(tb testing.TB, db *litestream.DB, r *litestream.FileReplica) {
+	tb.Helper()
+	if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustCountRows returns the number of rows in a table of the database at path.
+func MustCountRows(tb testing.TB, path, table string) int {
+	tb.Helper()
+	d, err := sql.Open("sqlite3", path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer d.Close()
+
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(1) FROM ` + table).Scan(&n); err != nil {
+		tb.Fatal(err)
+	} else if err := d.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package litestream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Backup format versions. Snapshot & WAL objects begin with a header
+// identifying the format of the data that follows so a version of
+// Litestream refuses objects written in a newer format instead of misreading
+// them. Objects written before the header was added are FormatVersion1.
+const (
+	// Raw snapshot or WAL bytes compressed with the codec identified by
+	// the object's extension.
+	FormatVersion1 = 1
+
+	// FormatVersion is the version written by this version of Litestream and
+	// the highest version it can read.
+	FormatVersion = FormatVersion1
+)
+
+// FormatHeaderSize is the size of the format header, in bytes.
+const FormatHeaderSize = 8
+
+// formatMagic identifies the format header. It cannot be mistaken for the
+// lz4 frame magic or SQLite headers that begin objects written without one.
+var formatMagic = []byte("LSFV")
+
+// WriteFormatHeader writes the header for FormatVersion to w.
+func WriteFormatHeader(w io.Writer) error {
+	hdr := make([]byte, FormatHeaderSize)
+	copy(hdr, formatMagic)
+	binary.BigEndian.PutUint32(hdr[4:], FormatVersion)
+	_, err := w.Write(hdr)
+	return err
+}
+
+// ReadFormatHeader returns the format version of the object in rd and a
+// reader positioned after the header. Objects without a header are reported
+// as FormatVersion1. Returns ErrUnsupportedFormatVersion if the object was
+// written in a format newer than FormatVersion.
+func ReadFormatHeader(rd io.Reader) (version int, r io.Reader, err error) {
+	br := bufio.NewReader(rd)
+	hdr, err := br.Peek(FormatHeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	} else if !bytes.HasPrefix(hdr, formatMagic) {
+		return FormatVersion1, br, nil
+	} else if len(hdr) < FormatHeaderSize {
+		return 0, nil, fmt.Errorf("short format header")
+	}
+
+	version = int(binary.BigEndian.Uint32(hdr[4:]))
+	if version < FormatVersion1 || version > FormatVersion {
+		return 0, nil, fmt.Errorf("%w: %d, this version of litestream reads up to version %d; upgrade litestream to read this backup", ErrUnsupportedFormatVersion, version, FormatVersion)
+	} else if _, err := br.Discard(FormatHeaderSize); err != nil {
+		return 0, nil, err
+	}
+	return version, br, nil
+}
+
+// NewObjectWriter writes the format header to w and returns a writer which
+// compresses data into w with codec c using up to workers goroutines. The
+// returned writer must be closed to flush the compressed data.
+func NewObjectWriter(w io.Writer, c *Codec, workers int) (io.WriteCloser, error) {
+	if err := WriteFormatHeader(w); err != nil {
+		return nil, err
+	}
+	return c.NewWriter(w, workers)
+}
+
+// NewObjectReader reads the format header from rd and returns a reader of the
+// object data decompressed with codec c using up to workers goroutines. If
+// the returned reader is an io.Closer, it must be closed to release the
+// resources of the codec; closing it does not close rd.
+//
+// If c is nil, or c has magic bytes which do not begin the data, then the
+// registered codec whose magic bytes begin the data is used instead so
+// objects whose extension was lost or changed, such as by copying between
+// buckets, can still be restored. Codecs without magic bytes, such as "none"
+// & encrypted codecs, are always used as given.
+func NewObjectReader(rd io.Reader, c *Codec, workers int) (io.Reader, error) {
+	version, rd, err := ReadFormatHeader(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case FormatVersion1:
+		br := bufio.NewReader(rd)
+		if c == nil || (len(c.Magic) != 0 && !hasMagic(br, c.Magic)) {
+			if c = sniffCodec(br); c == nil {
+				return nil, fmt.Errorf("cannot detect codec")
+			}
+		}
+		return c.NewReader(br, workers)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedFormatVersion, version)
+	}
+}
+
+// closeReader closes r if it is an io.Closer, such as a codec reader.
+func closeReader(r io.Reader) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// sniffCodec returns the registered codec whose magic bytes begin the data in
+// br. Codecs without magic bytes are never matched. Returns nil if no codec
+// matches.
+func sniffCodec(br *bufio.Reader) *Codec {
+	for _, c := range Codecs() {
+		if len(c.Magic) != 0 && hasMagic(br, c.Magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// hasMagic returns true if the data in br begins with magic.
+func hasMagic(br *bufio.Reader, magic []byte) bool {
+	buf, _ := br.Peek(len(magic))
+	return bytes.Equal(buf, magic)
+}
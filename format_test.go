@@ -0,0 +1,152 @@
+package litestream_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestNewObjectReader(t *testing.T) {
+	// Ensure an object written with the current format is read back.
+	t.Run("FormatVersion1", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw, err := litestream.NewObjectWriter(&buf, litestream.LookupCodec(litestream.CompressionLZ4), 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := zw.Write([]byte("SQLite format 3\x00")); err != nil {
+			t.Fatal(err)
+		} else if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if version, _, err := litestream.ReadFormatHeader(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		} else if got, want := version, litestream.FormatVersion1; got != want {
+			t.Fatalf("version=%d, want %d", got, want)
+		}
+
+		if rd, err := litestream.NewObjectReader(&buf, litestream.LookupCodec(litestream.CompressionLZ4), 1); err != nil {
+			t.Fatal(err)
+		} else if b, err := ioutil.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(b), "SQLite format 3\x00"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure an object written before the format header existed is read as
+	// the first format version.
+	t.Run("NoHeader", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := lz4.NewWriter(&buf)
+		if _, err := zw.Write([]byte("SQLite format 3\x00")); err != nil {
+			t.Fatal(err)
+		} else if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if version, _, err := litestream.ReadFormatHeader(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		} else if got, want := version, litestream.FormatVersion1; got != want {
+			t.Fatalf("version=%d, want %d", got, want)
+		}
+
+		if rd, err := litestream.NewObjectReader(&buf, litestream.LookupCodec(litestream.CompressionLZ4), 1); err != nil {
+			t.Fatal(err)
+		} else if b, err := ioutil.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(b), "SQLite format 3\x00"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure the codec is detected from the object data when the codec of
+	// the object's extension is unknown or its magic bytes do not match.
+	t.Run("SniffCodec", func(t *testing.T) {
+		for _, name := range []string{litestream.CompressionLZ4, litestream.CompressionGzip, litestream.CompressionZstd} {
+			t.Run(name, func(t *testing.T) {
+				buf := MustObject(t, litestream.LookupCodec(name), "SQLite format 3\x00")
+
+				// A blank name looks up no codec, as for an unknown extension.
+				for _, other := range []string{"", litestream.CompressionLZ4, litestream.CompressionGzip, litestream.CompressionZstd} {
+					if rd, err := litestream.NewObjectReader(bytes.NewReader(buf), litestream.LookupCodec(other), 1); err != nil {
+						t.Fatal(err)
+					} else if b, err := ioutil.ReadAll(rd); err != nil {
+						t.Fatalf("read with %q codec: %s", other, err)
+					} else if got, want := string(b), "SQLite format 3\x00"; got != want {
+						t.Fatalf("data=%q, want %q", got, want)
+					}
+				}
+			})
+		}
+	})
+
+	// Ensure codecs without magic bytes are used even if the data begins with
+	// the magic bytes of another codec.
+	t.Run("NoSniffWithoutMagic", func(t *testing.T) {
+		zstd := litestream.LookupCodec(litestream.CompressionZstd)
+		for _, name := range []string{litestream.CompressionNone, "xor-test"} {
+			t.Run(name, func(t *testing.T) {
+				c := litestream.LookupCodec(name)
+				data := string(MustObject(t, zstd, "SQLite format 3\x00")[litestream.FormatHeaderSize:])
+				buf := MustObject(t, c, data)
+
+				if rd, err := litestream.NewObjectReader(bytes.NewReader(buf), c, 1); err != nil {
+					t.Fatal(err)
+				} else if b, err := ioutil.ReadAll(rd); err != nil {
+					t.Fatal(err)
+				} else if got, want := string(b), data; got != want {
+					t.Fatalf("data=%q, want %q", got, want)
+				}
+			})
+		}
+	})
+
+	// Ensure an object is refused if it has no known codec.
+	t.Run("ErrUnknownCodec", func(t *testing.T) {
+		buf := MustObject(t, litestream.LookupCodec(litestream.CompressionNone), "SQLite format 3\x00")
+		if _, err := litestream.NewObjectReader(bytes.NewReader(buf), nil, 1); err == nil || err.Error() != "cannot detect codec" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure an object written in a newer format is refused.
+	t.Run("ErrUnsupportedFormatVersion", func(t *testing.T) {
+		if _, err := litestream.NewObjectReader(bytes.NewReader(MustFutureFormatObject(t)), litestream.LookupCodec(litestream.CompressionLZ4), 1); !errors.Is(err, litestream.ErrUnsupportedFormatVersion) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustObject returns data written as an object compressed with codec c.
+func MustObject(tb testing.TB, c *litestream.Codec, data string) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	zw, err := litestream.NewObjectWriter(&buf, c, 1)
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := zw.Write([]byte(data)); err != nil {
+		tb.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// MustFutureFormatObject returns an object with a format header for the
+// version after FormatVersion followed by data this version cannot parse.
+func MustFutureFormatObject(tb testing.TB) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	if err := litestream.WriteFormatHeader(&buf); err != nil {
+		tb.Fatal(err)
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[4:], litestream.FormatVersion+1)
+	return append(b, "future data"...)
+}
@@ -0,0 +1,107 @@
+package litestream
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FileSystem is the set of file operations a DB uses to read the WAL & to
+// manage its shadow WAL, generation name files & meta directory permissions.
+// It can be replaced in tests to simulate partial writes, missing files &
+// permission errors.
+//
+// Directory creation, snapshots & restores always use the os package.
+type FileSystem interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Truncate(name string, size int64) error
+	Remove(name string) error
+	Chmod(name string, mode os.FileMode) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// File is an open file returned by a FileSystem. It is implemented by *os.File.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// OSFileSystem is a FileSystem backed by the os package. It is used by a DB
+// if no FileSystem is set.
+type OSFileSystem struct{}
+
+// Open opens the named file for reading.
+func (OSFileSystem) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file with the given flags & permissions.
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat returns file info for the named file.
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// Rename moves oldpath to newpath.
+func (OSFileSystem) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+// Truncate changes the size of the named file.
+func (OSFileSystem) Truncate(name string, size int64) error { return os.Truncate(name, size) }
+
+// Remove removes the named file.
+func (OSFileSystem) Remove(name string) error { return os.Remove(name) }
+
+// Chmod changes the mode of the named file.
+func (OSFileSystem) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+
+// ReadDir returns the entries of dirname sorted by name.
+func (OSFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+
+// fs returns the file system used by the database.
+func (db *DB) fs() FileSystem {
+	if db.FS == nil {
+		return OSFileSystem{}
+	}
+	return db.FS
+}
+
+// readFile returns the contents of filename read from fsys.
+func readFile(fsys FileSystem, filename string) ([]byte, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFile writes data to filename on fsys, creating it with perm if needed.
+func writeFile(fsys FileSystem, filename string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
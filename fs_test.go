@@ -0,0 +1,228 @@
+package litestream_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestDB_FS(t *testing.T) {
+	// Ensure a sync fails while the shadow WAL cannot be opened & recovers in
+	// the same generation once it can.
+	t.Run("ErrPermission", func(t *testing.T) {
+		fsys := &FaultFileSystem{}
+		db, sqldb := MustOpenDBsWithFS(t, fsys)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fsys.OpenFileFunc = func(name string, flag int, perm os.FileMode) (litestream.File, error) {
+			if isShadowWALWrite(name, flag) {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+			}
+			return litestream.OSFileSystem{}.OpenFile(name, flag, perm)
+		}
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fsys.OpenFileFunc = nil
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos1.Generation != pos0.Generation {
+			t.Fatal("expected same generation")
+		} else if pos1.Offset <= pos0.Offset {
+			t.Fatalf("offset=%d, want > %d", pos1.Offset, pos0.Offset)
+		}
+		MustShadowWALMatchWAL(t, db)
+	})
+
+	// Ensure a frame partially written to the shadow WAL is truncated when the
+	// database is reopened & the generation is kept.
+	t.Run("PartialWrite", func(t *testing.T) {
+		fsys := &FaultFileSystem{}
+		db, sqldb := MustOpenDBsWithFS(t, fsys)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only write part of the next frame before failing.
+		fsys.OpenFileFunc = func(name string, flag int, perm os.FileMode) (litestream.File, error) {
+			f, err := litestream.OSFileSystem{}.OpenFile(name, flag, perm)
+			if err != nil || !isShadowWALWrite(name, flag) {
+				return f, err
+			}
+			return &partialFile{File: f, n: litestream.WALFrameHeaderSize + 100}, nil
+		}
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err == nil {
+			t.Fatal("expected error")
+		}
+
+		if fi, err := os.Stat(db.ShadowWALPath(pos0.Generation, pos0.Index)); err != nil {
+			t.Fatal(err)
+		} else if got, want := fi.Size(), pos0.Offset+litestream.WALFrameHeaderSize+100; got != want {
+			t.Fatalf("size=%d, want %d", got, want)
+		}
+
+		// Reopen without faults & ensure the shadow WAL is recovered.
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = MustOpenDBAt(t, db.Path())
+		defer MustCloseDB(t, db)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos1.Generation != pos0.Generation {
+			t.Fatal("expected same generation")
+		} else if pos1.Offset <= pos0.Offset {
+			t.Fatalf("offset=%d, want > %d", pos1.Offset, pos0.Offset)
+		}
+		MustShadowWALMatchWAL(t, db)
+	})
+
+	// Ensure the meta directory mode is set through the file system.
+	t.Run("Chmod", func(t *testing.T) {
+		fsys := &FaultFileSystem{}
+		db, sqldb := MustOpenDBsWithFS(t, fsys)
+		defer MustCloseDBs(t, db, sqldb)
+		db.DirMode = 0700
+
+		var names []string
+		fsys.ChmodFunc = func(name string, mode os.FileMode) error {
+			if mode != 0700 {
+				t.Fatalf("mode=%o, want %o", mode, 0700)
+			}
+			names = append(names, name)
+			return &os.PathError{Op: "chmod", Path: name, Err: os.ErrPermission}
+		}
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := names, []string{db.MetaPath()}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("names=%v, want %v", got, want)
+		}
+
+		fsys.ChmodFunc = nil
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FaultFileSystem is a file system which can be configured to fail or alter
+// files opened for writing & to fail mode changes.
+type FaultFileSystem struct {
+	litestream.OSFileSystem
+
+	OpenFileFunc func(name string, flag int, perm os.FileMode) (litestream.File, error)
+	ChmodFunc    func(name string, mode os.FileMode) error
+}
+
+// OpenFile calls OpenFileFunc, if set.
+func (fsys *FaultFileSystem) OpenFile(name string, flag int, perm os.FileMode) (litestream.File, error) {
+	if fsys.OpenFileFunc != nil {
+		return fsys.OpenFileFunc(name, flag, perm)
+	}
+	return fsys.OSFileSystem.OpenFile(name, flag, perm)
+}
+
+// Chmod calls ChmodFunc, if set.
+func (fsys *FaultFileSystem) Chmod(name string, mode os.FileMode) error {
+	if fsys.ChmodFunc != nil {
+		return fsys.ChmodFunc(name, mode)
+	}
+	return fsys.OSFileSystem.Chmod(name, mode)
+}
+
+// partialFile writes at most n bytes before returning io.ErrShortWrite.
+type partialFile struct {
+	litestream.File
+	n int
+}
+
+func (f *partialFile) Write(p []byte) (int, error) {
+	if len(p) <= f.n {
+		f.n -= len(p)
+		return f.File.Write(p)
+	}
+	n, err := f.File.Write(p[:f.n])
+	f.n = 0
+	if err != nil {
+		return n, err
+	}
+	return n, io.ErrShortWrite
+}
+
+// isShadowWALWrite returns true if name is a shadow WAL opened for copying.
+func isShadowWALWrite(name string, flag int) bool {
+	return flag == os.O_RDWR && strings.HasSuffix(name, litestream.WALExt)
+}
+
+// MustOpenDBsWithFS returns a new DB using fsys & a SQL database to write it.
+func MustOpenDBsWithFS(tb testing.TB, fsys litestream.FileSystem) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	db.FS = fsys
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return db, MustOpenSQLDB(tb, db.Path())
+}
+
+// MustShadowWALMatchWAL fails if the current shadow WAL is not a copy of the
+// start of the WAL.
+func MustShadowWALMatchWAL(tb testing.TB, db *litestream.DB) {
+	tb.Helper()
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(db.ShadowWALPath(pos.Generation, pos.Index))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	wal, err := ioutil.ReadFile(db.WALPath())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(buf) > len(wal) || !bytes.Equal(buf, wal[:len(buf)]) {
+		tb.Fatal("shadow wal does not match wal")
+	}
+}
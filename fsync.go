@@ -0,0 +1,107 @@
+package litestream
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fsyncState tracks the position of the shadow WAL known to be on stable
+// storage when fsyncs are batched by DB.FsyncInterval.
+type fsyncState struct {
+	mu   sync.Mutex
+	pos  Pos   // durable shadow WAL position
+	last int64 // unix nano time of the last batched fsync
+}
+
+// shadowWALSyncMode returns the fsync policy used when copying to the shadow
+// WAL. Per-copy fsyncs are disabled when fsyncs are batched by interval.
+func (db *DB) shadowWALSyncMode() string {
+	if db.FsyncInterval > 0 {
+		return ShadowWALSyncNone
+	}
+	return db.ShadowWALSync
+}
+
+// markDurable advances the durable position of the shadow WAL to pos.
+func (db *DB) markDurable(pos Pos) {
+	db.fsync.mu.Lock()
+	defer db.fsync.mu.Unlock()
+
+	cur := db.fsync.pos
+	if pos.Generation != cur.Generation || pos.Index > cur.Index || (pos.Index == cur.Index && pos.Offset > cur.Offset) {
+		db.fsync.pos = pos
+	}
+}
+
+// durableOffset returns the end of the fsynced data of the shadow WAL at pos.
+// Returns false if all data at pos can be read, such as when fsyncs are not
+// batched or when pos is in an index completed before the durable position.
+func (db *DB) durableOffset(pos Pos) (int64, bool) {
+	if db.FsyncInterval <= 0 {
+		return 0, false
+	}
+
+	db.fsync.mu.Lock()
+	defer db.fsync.mu.Unlock()
+
+	switch durable := db.fsync.pos; {
+	case pos.Generation != durable.Generation || pos.Index > durable.Index:
+		return 0, true // nothing fsynced yet
+	case pos.Index == durable.Index:
+		return durable.Offset, true
+	default:
+		return 0, false // fsynced before checkpoint or restart
+	}
+}
+
+// fsyncIfDue fsyncs the current shadow WAL of generation, along with the
+// shadow WAL & meta directories, if FsyncInterval has elapsed since the last
+// batched fsync. Replicas can upload up to the new durable position afterward.
+func (db *DB) fsyncIfDue(generation string) error {
+	if db.FsyncInterval <= 0 || generation == "" {
+		return nil
+	}
+
+	now := db.now().UnixNano()
+	db.fsync.mu.Lock()
+	due := db.fsync.last == 0 || now-db.fsync.last >= int64(db.FsyncInterval)
+	db.fsync.mu.Unlock()
+	if !due {
+		return nil
+	}
+
+	index, _, err := db.CurrentShadowWALIndex(generation)
+	if err != nil {
+		return err
+	}
+	filename := db.ShadowWALPath(generation, index)
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{filepath.Dir(filename), db.MetaPath()} {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	db.fsyncNCounter.Inc()
+
+	db.markDurable(Pos{Generation: generation, Index: index, Offset: frameAlign(fi.Size(), db.pageSize)})
+	db.fsync.mu.Lock()
+	db.fsync.last = now
+	db.fsync.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,192 @@
+package litestream_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDB_FsyncInterval(t *testing.T) {
+	// Ensure fsyncs are issued at most once per interval.
+	t.Run("Frequency", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		db.Now = func() time.Time { return now }
+		db.FsyncInterval = 10 * time.Second
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Sync every second for 25 seconds. Fsyncs occur at 0s, 10s & 20s.
+		n := MustDBCounter(t, db, "litestream_db_fsync_count")
+		for i := 0; i < 25; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(1 * time.Second)
+		}
+		if got, want := MustDBCounter(t, db, "litestream_db_fsync_count")-n, 3.0; got != want {
+			t.Fatalf("fsync count=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure replicas only upload frames which have been fsynced.
+	t.Run("UploadDurable", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		db.Now = func() time.Time { return now }
+		db.FsyncInterval = 10 * time.Second
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		durable := r.LastPos()
+
+		// Write within the interval. The replica should not advance.
+		now = now.Add(1 * time.Second)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if pos == durable {
+			t.Fatal("expected database position to advance")
+		} else if got, want := r.LastPos(), durable; got != want {
+			t.Fatalf("replica pos=%s, want %s", got, want)
+		}
+
+		// Once the interval elapses, the replica should catch up.
+		now = now.Add(10 * time.Second)
+		MustSyncDBReplica(t, db, r)
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("replica pos=%s, want %s", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a checkpoint makes the previous index durable immediately.
+	t.Run("Checkpoint", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		db.Now = func() time.Time { return now }
+		db.FsyncInterval = time.Hour
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		// Rows up to the checkpoint are uploaded. The row written after the
+		// checkpoint is not fsynced yet.
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustRestoreRowCount(t, r, r.LastPos().Generation), db.MinCheckpointPageN; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure the shadow WAL is fsynced before a WAL restart starts the next
+	// index as it is never fsynced by the interval afterward.
+	t.Run("Restart", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		pos0 := MustRestartWALExternally(t, db, sqldb, r)
+
+		var synced []string
+		fsys := &FaultFileSystem{}
+		fsys.OpenFileFunc = func(name string, flag int, perm os.FileMode) (litestream.File, error) {
+			f, err := litestream.OSFileSystem{}.OpenFile(name, flag, perm)
+			if err != nil {
+				return nil, err
+			}
+			return &syncRecorderFile{File: f, synced: &synced}, nil
+		}
+
+		// Reopen with batched fsyncs & no per-copy fsyncs.
+		db = litestream.NewDB(db.Path())
+		db.MonitorInterval = 0
+		db.WALDivergencePolicy = litestream.WALDivergencePolicyRecover
+		db.ShadowWALSync = litestream.ShadowWALSyncNone
+		db.FsyncInterval = time.Hour
+		db.FS = fsys
+		r = litestream.NewFileReplica(db, "", r.Path())
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+		MustSyncDBReplica(t, db, r)
+
+		if pos1, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := pos1.Index, pos0.Index+1; got != want {
+			t.Fatalf("Index=%d, want %d", got, want)
+		}
+
+		filename := db.ShadowWALPath(pos0.Generation, pos0.Index)
+		var ok bool
+		for _, name := range synced {
+			ok = ok || name == filename
+		}
+		if !ok {
+			t.Fatalf("expected fsync of %s, got %v", filename, synced)
+		}
+	})
+}
+
+// syncRecorderFile records the name of the file each time it is fsynced.
+type syncRecorderFile struct {
+	litestream.File
+	synced *[]string
+}
+
+func (f *syncRecorderFile) Sync() error {
+	*f.synced = append(*f.synced, f.Name())
+	return f.File.Sync()
+}
+
+// MustDBCounter returns the value of a database counter metric for db.
+func MustDBCounter(tb testing.TB, db *litestream.DB, name string) float64 {
+	tb.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == "db" && pair.GetValue() == db.Path() {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,249 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/benbjohnson/litestream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCS replica default settings.
+const (
+	DefaultSyncInterval = 10 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+
+	DefaultCompressionWorkers = 1
+
+	DefaultDeleteConcurrency = 4
+
+	DefaultDeleteBatchSize = 100
+
+	DefaultUserAgent = "litestream"
+)
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.ObjectWriter = (*Replica)(nil)
+var _ litestream.CommitTimeReader = (*Replica)(nil)
+var _ litestream.ReplicaWriter = (*Replica)(nil)
+var _ litestream.ObjectClient = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to a Google Cloud Storage bucket.
+// Objects are named with the same layout as S3 replicas.
+//
+// GCS deletes one object per request. Objects are split into batches of
+// DeleteBatchSize & at most DeleteConcurrency batches are deleted concurrently.
+type Replica struct {
+	*litestream.ObjectReplica
+
+	mu     sync.Mutex
+	client *storage.Client       // gcs client
+	bkt    *storage.BucketHandle // handle to Bucket
+
+	// Path to a service account key file. If blank, Application Default
+	// Credentials are used, such as GKE workload identity.
+	CredentialsFile string
+
+	// GCS bucket information
+	Bucket string
+
+	// URL of the GCS JSON API, such as the URL of an emulator. Uses the
+	// default endpoint if blank.
+	Endpoint string
+
+	// User-Agent header sent with every request so storage providers can
+	// attribute traffic.
+	UserAgent string
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		UserAgent: DefaultUserAgent,
+	}
+
+	r.ObjectReplica = litestream.NewObjectReplica(db, name, r, operationTotalCounterVec, operationBytesCounterVec)
+	r.SyncInterval = DefaultSyncInterval
+	r.Retention = DefaultRetention
+	r.RetentionCheckInterval = DefaultRetentionCheckInterval
+	r.CompressionWorkers = DefaultCompressionWorkers
+	r.DeleteConcurrency = DefaultDeleteConcurrency
+	r.DeleteBatchSize = DefaultDeleteBatchSize
+
+	return r
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "gcs"
+}
+
+// URL returns the location of the replica as a "gs" URL.
+func (r *Replica) URL() string {
+	return (&url.URL{Scheme: "gs", Host: r.Bucket, Path: path.Join("/", r.Path)}).String()
+}
+
+// Init initializes the GCS client. No-op if already initialized. Credentials
+// are read from CredentialsFile, if set, or found using Application Default
+// Credentials, such as the service account attached by GKE workload identity.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil {
+		return nil
+	}
+
+	if r.Bucket == "" {
+		return fmt.Errorf("gcs bucket required")
+	}
+
+	opts := []option.ClientOption{option.WithUserAgent(r.UserAgent)}
+	if r.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(r.CredentialsFile))
+	}
+	if r.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(r.Endpoint))
+	}
+
+	// The client refreshes tokens with the context it is created with so it
+	// must outlive the context of the first request.
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("cannot create gcs client: %w", err)
+	}
+	r.client = client
+	r.bkt = client.Bucket(r.Bucket)
+	return nil
+}
+
+// ListObjects calls fn for each object whose name begins with prefix. Common
+// prefixes below the prefix are passed as directories. GCS lists common
+// prefixes after objects so they are merged back into name order.
+func (r *Replica) ListObjects(ctx context.Context, prefix string, fn func(litestream.ObjectInfo) error) error {
+	var objs []litestream.ObjectInfo
+	it := r.bkt.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return wrapError(err)
+		}
+
+		if attrs.Prefix != "" {
+			objs = append(objs, litestream.ObjectInfo{Key: strings.TrimSuffix(attrs.Prefix, "/"), IsDir: true})
+			continue
+		}
+		objs = append(objs, litestream.ObjectInfo{
+			Key:      attrs.Name,
+			Size:     attrs.Size,
+			ModTime:  attrs.Updated.UTC(),
+			Metadata: attrs.Metadata,
+		})
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+
+	for _, obj := range objs {
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutObject uploads the contents of rd to key. The upload is aborted if rd
+// returns an error. GCS sets the modification time of objects so opts.ModTime
+// is ignored.
+func (r *Replica) PutObject(ctx context.Context, key string, rd io.Reader, opts litestream.PutOptions) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := r.bkt.Object(key).NewWriter(ctx)
+	w.Metadata = opts.Metadata
+	n, err := io.Copy(w, litestream.NewThrottledReader(ctx, rd, opts.Limiter))
+	if err != nil {
+		return n, wrapError(err) // canceling the context aborts the upload
+	} else if err := w.Close(); err != nil {
+		return n, wrapError(err)
+	}
+	return n, nil
+}
+
+// GetObject returns a reader for the object at key. Object metadata is only
+// returned by ListObjects.
+func (r *Replica) GetObject(ctx context.Context, key string) (io.ReadCloser, litestream.ObjectInfo, error) {
+	rd, err := r.bkt.Object(key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, litestream.ObjectInfo{}, os.ErrNotExist
+	} else if err != nil {
+		return nil, litestream.ObjectInfo{}, wrapError(err)
+	}
+	return rd, litestream.ObjectInfo{Key: key, Size: rd.Attrs.Size, ModTime: rd.Attrs.LastModified}, nil
+}
+
+// DeleteObjects deletes each object with a separate request. Objects already
+// deleted, such as by a previous failed run, are ignored.
+func (r *Replica) DeleteObjects(ctx context.Context, objs []litestream.ObjectInfo) error {
+	for _, obj := range objs {
+		if err := r.bkt.Object(obj.Key).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// statusError wraps an error returned by the GCS API with its HTTP status
+// code so only server errors & rate limiting are retried.
+type statusError struct {
+	err  error
+	code int
+}
+
+func (e *statusError) Error() string   { return e.err.Error() }
+func (e *statusError) Unwrap() error   { return e.err }
+func (e *statusError) StatusCode() int { return e.code }
+
+// wrapError returns err with the status code of the GCS API error it wraps,
+// if any. See litestream.IsRetryableError.
+func wrapError(err error) error {
+	var e *googleapi.Error
+	if errors.As(err, &e) {
+		return &statusError{err: err, code: e.Code}
+	}
+	return err
+}
+
+// GCS metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "gcs",
+		Name:      "operation_total",
+		Help:      "The number of GCS operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "gcs",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by GCS operations",
+	}, []string{"db", "name", "type"})
+)
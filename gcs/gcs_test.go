@@ -0,0 +1,366 @@
+package gcs_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/gcs"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if generations, err := r.Generations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(generations) != 1 || generations[0] != pos.Generation {
+		t.Fatalf("Generations()=%v, want [%s]", generations, pos.Generation)
+	}
+
+	// Ensure the database is restored from the stored objects.
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(t.TempDir(), "db")
+	opt.Generation = pos.Generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var n int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatalf("n=%d, want 5", n)
+	}
+}
+
+func TestReplica_RunRetention(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a generation whose only snapshot is older than the retention.
+	const generation = "0000000000000001"
+	s.SetNow(time.Now().Add(-2 * r.Retention))
+	if err := r.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetNow(time.Time{})
+
+	if result, err := r.RunRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(result.Generations) != 1 || result.Generations[0] != generation {
+		t.Fatalf("Generations=%v, want [%s]", result.Generations, generation)
+	}
+
+	if names := s.Names(r.GenerationDir(generation) + "/"); len(names) != 0 {
+		t.Fatalf("unexpected objects: %v", names)
+	} else if names := s.Names(r.GenerationDir(r.LastPos().Generation) + "/"); len(names) == 0 {
+		t.Fatal("expected objects in replicating generation")
+	}
+}
+
+func TestReplica_Init(t *testing.T) {
+	// Ensure a bucket is required.
+	t.Run("ErrBucketRequired", func(t *testing.T) {
+		r := gcs.NewReplica(nil, "")
+		if err := r.Init(context.Background()); err == nil || err.Error() != `gcs bucket required` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure API errors are returned with their status code.
+	t.Run("ErrStatus", func(t *testing.T) {
+		s := NewServer(t)
+		s.Fail = true
+		r := NewTestReplica(t, nil, s)
+
+		_, err := r.Generations(context.Background())
+		if e, ok := err.(interface{ StatusCode() int }); !ok || e.StatusCode() != http.StatusForbidden {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// NewTestReplica returns a replica for db which stores objects on s.
+func NewTestReplica(tb testing.TB, db *litestream.DB, s *Server) *gcs.Replica {
+	tb.Helper()
+
+	// The emulator host disables authentication & reads objects over HTTP.
+	prev, ok := os.LookupEnv("STORAGE_EMULATOR_HOST")
+	if err := os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(s.URL, "http://")); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if ok {
+			os.Setenv("STORAGE_EMULATOR_HOST", prev)
+		} else {
+			os.Unsetenv("STORAGE_EMULATOR_HOST")
+		}
+	})
+
+	r := gcs.NewReplica(db, "")
+	r.Bucket = "bkt"
+	r.Path = "backups"
+	r.Endpoint = s.URL + "/storage/v1/"
+	r.MonitorEnabled = false
+	return r
+}
+
+// MustOpenDBs returns a new instance of a DB & associated SQL DB. Both are
+// closed when the test ends.
+func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return db, sqldb
+}
+
+// Server is a fake GCS server which implements the JSON API calls used by the
+// replica & stores objects in memory.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]*serverObject
+	now     time.Time // upload time, if set
+
+	// If true, every request fails as forbidden.
+	Fail bool
+}
+
+type serverObject struct {
+	Name     string
+	Data     []byte
+	Metadata map[string]string
+	Updated  time.Time
+}
+
+func (o *serverObject) json() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":     "storage#object",
+		"bucket":   "bkt",
+		"name":     o.Name,
+		"size":     strconv.Itoa(len(o.Data)),
+		"updated":  o.Updated.Format(time.RFC3339Nano),
+		"metadata": o.Metadata,
+	}
+}
+
+// NewServer returns a running fake GCS server which is closed when the test ends.
+func NewServer(tb testing.TB) *Server {
+	s := &Server{objects: make(map[string]*serverObject)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// SetNow sets the update time of new objects. Uses the current time if zero.
+func (s *Server) SetNow(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = t
+}
+
+// Names returns the sorted names of all objects beginning with prefix.
+func (s *Server) Names(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Fail {
+		writeError(w, http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path = strings.TrimPrefix(r.URL.Path, "/storage/v1"); {
+	case r.Method == "GET" && r.URL.Path == "/b/bkt/o":
+		s.list(w, r)
+	case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bkt/o":
+		s.upload(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/b/bkt/o/"):
+		name := strings.TrimPrefix(r.URL.Path, "/b/bkt/o/")
+		if s.objects[name] == nil {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/bkt/"):
+		obj := s.objects[strings.TrimPrefix(r.URL.Path, "/bkt/")]
+		if obj == nil {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+		_, _ = w.Write(obj.Data)
+	default:
+		writeError(w, http.StatusBadRequest)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+
+	items, prefixes := make([]interface{}, 0), make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range s.sortedNames() {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				if p := name[:len(prefix)+i+1]; !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		items = append(items, s.objects[name].json())
+	}
+	writeJSON(w, map[string]interface{}{"kind": "storage#objects", "items": items, "prefixes": prefixes})
+}
+
+func (s *Server) sortedNames() []string {
+	names := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upload stores an object sent as a multipart upload of its JSON attributes
+// followed by its contents.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var attrs struct {
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	} else if err := json.NewDecoder(part).Decode(&attrs); err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	updated := s.now
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	obj := &serverObject{Name: attrs.Name, Data: data, Metadata: attrs.Metadata, Updated: updated.UTC()}
+	s.objects[obj.Name] = obj
+	writeJSON(w, obj.json())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": http.StatusText(status)},
+	})
+}
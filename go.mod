@@ -3,10 +3,19 @@ module github.com/benbjohnson/litestream
 go 1.15
 
 require (
+	cloud.google.com/go/storage v1.15.0
+	filippo.io/age v1.0.0-rc.1
 	github.com/aws/aws-sdk-go v1.27.0
 	github.com/davecgh/go-spew v1.1.1
+	github.com/klauspost/compress v1.13.6
+	github.com/kurin/blazer v0.5.3
 	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/pierrec/lz4/v4 v4.1.3
+	github.com/pkg/sftp v1.13.0
 	github.com/prometheus/client_golang v1.9.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20210903071746-97244b99971b // indirect
+	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b // indirect
+	google.golang.org/api v0.45.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,133 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+)
+
+// DefaultRestoreGroupConcurrency is the default number of group members
+// restored at the same time.
+const DefaultRestoreGroupConcurrency = 4
+
+// IncompleteRestoreSuffix is appended to a group member's output path while
+// the group is being restored.
+const IncompleteRestoreSuffix = ".incomplete"
+
+// RestoreGroupMember represents a database restored as part of a group.
+type RestoreGroupMember struct {
+	Replica Replica
+	Options RestoreOptions
+}
+
+// RestoreGroup restores a group of related databases, such as databases
+// attached to one another, to a common timestamp. If timestamp is zero, each
+// member is restored to its latest position. Up to concurrency members are
+// downloaded at a time while each member applies its WAL files serially.
+//
+// Members are restored next to their output path with IncompleteRestoreSuffix
+// and are only moved into place once every member succeeds. If any member
+// fails, the remaining members are canceled & all incomplete files are
+// removed so no output is left for the group.
+func RestoreGroup(ctx context.Context, members []RestoreGroupMember, timestamp time.Time, concurrency int) (err error) {
+	// Validate output paths before restoring any member.
+	m := make(map[string]struct{})
+	for _, member := range members {
+		path := member.Options.OutputPath
+		if path == "" {
+			return fmt.Errorf("output path required for group member")
+		} else if member.Options.DryRun {
+			return fmt.Errorf("cannot perform dry run when restoring group: %s", path)
+		} else if _, ok := m[path]; ok {
+			return fmt.Errorf("duplicate output path in group: %s", path)
+		} else if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("cannot restore, output path already exists: %s", path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		m[path] = struct{}{}
+	}
+
+	// Remove incomplete files from an interrupted restore & ensure incomplete
+	// files are cleaned up if any member fails.
+	if err := removeIncompleteRestores(members); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = removeIncompleteRestores(members)
+		}
+	}()
+
+	if err := internal.ParallelBatches(ctx, concurrency, len(members), 1, func(ctx context.Context, i, j int) error {
+		member := members[i]
+		opt := member.Options
+		opt.Timestamp = timestamp
+		opt.OutputPath += IncompleteRestoreSuffix
+
+		// Determine generation at the group's timestamp, if not specified.
+		if opt.Generation == "" {
+			generation, err := calcGroupRestoreTarget(ctx, member.Replica, opt)
+			if err != nil {
+				return fmt.Errorf("%s: %w", member.Options.OutputPath, err)
+			} else if generation == "" {
+				return fmt.Errorf("%s: no matching backups found", member.Options.OutputPath)
+			}
+			opt.Generation = generation
+		}
+
+		if err := RestoreReplica(ctx, member.Replica, opt); err != nil {
+			return fmt.Errorf("%s: %w", member.Options.OutputPath, err)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("cannot restore group: %w", err)
+	}
+
+	// Move members into place once all members are restored.
+	for _, member := range members {
+		if err := os.Rename(member.Options.OutputPath+IncompleteRestoreSuffix, member.Options.OutputPath); err != nil {
+			return fmt.Errorf("cannot rename group member, group partially restored: %w", err)
+		}
+	}
+	return nil
+}
+
+// calcGroupRestoreTarget returns the generation to restore a group member from.
+// Members are often idle so a member whose latest generation ended before the
+// group's timestamp is restored to its latest position.
+func calcGroupRestoreTarget(ctx context.Context, r Replica, opt RestoreOptions) (string, error) {
+	generation, _, err := CalcReplicaRestoreTarget(ctx, r, opt)
+	if err != nil || generation != "" || opt.Timestamp.IsZero() {
+		return generation, err
+	}
+
+	latest := opt
+	latest.Timestamp = time.Time{}
+	generation, stats, err := CalcReplicaRestoreTarget(ctx, r, latest)
+	if err != nil {
+		return "", err
+	} else if generation == "" || stats.UpdatedAt.After(opt.Timestamp) {
+		return "", nil
+	}
+	return generation, nil
+}
+
+// removeIncompleteRestores removes the incomplete & temporary files for each
+// group member, including any WAL & SHM files.
+func removeIncompleteRestores(members []RestoreGroupMember) error {
+	for _, member := range members {
+		path := member.Options.OutputPath + IncompleteRestoreSuffix
+		for _, filename := range []string{path, path + ".tmp"} {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			} else if err := removeWALFiles(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
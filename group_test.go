@@ -0,0 +1,116 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreGroup(t *testing.T) {
+	// setup returns a 3-member group with a different number of rows in
+	// each member & the directory the members are restored into.
+	setup := func(t *testing.T) ([]litestream.RestoreGroupMember, string) {
+		dir := t.TempDir()
+
+		var members []litestream.RestoreGroupMember
+		for i, name := range []string{"a", "b", "c"} {
+			db, sqldb := MustOpenDBs(t)
+			t.Cleanup(func() { MustCloseDBs(t, db, sqldb) })
+			r := NewTestFileReplica(t, db)
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			}
+			MustSyncDBReplica(t, db, r)
+			MustRollWALIndex(t, db, sqldb, r)
+			for j := 0; j < i; j++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			MustSyncDBReplica(t, db, r)
+
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(dir, name)
+			members = append(members, litestream.RestoreGroupMember{Replica: r, Options: opt})
+		}
+		return members, dir
+	}
+
+	// Ensure all members are restored to the common timestamp.
+	t.Run("OK", func(t *testing.T) {
+		members, dir := setup(t)
+		if err := litestream.RestoreGroup(context.Background(), members, time.Now(), 2); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, member := range members {
+			db := member.Replica.DB()
+			if got, want := MustCountRows(t, member.Options.OutputPath, "foo"), db.MinCheckpointPageN+1+i; got != want {
+				t.Fatalf("%s: n=%d, want %d", member.Options.OutputPath, got, want)
+			}
+		}
+
+		// Only restored databases should remain in the output directory.
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fis {
+			if ext := filepath.Ext(fi.Name()); ext == litestream.IncompleteRestoreSuffix || ext == ".tmp" {
+				t.Fatalf("unexpected file: %s", fi.Name())
+			}
+		}
+	})
+
+	// Ensure a failing member leaves no output for any member of the group.
+	t.Run("MemberFailure", func(t *testing.T) {
+		members, dir := setup(t)
+
+		// Report the latest WAL of the second member as permanently missing.
+		r := members[1].Replica.(*litestream.FileReplica)
+		pos := r.LastPos()
+		members[1].Replica = &missingWALReplica{FileReplica: r, index: pos.Index, n: 1 << 30}
+		members[1].Options.WALRetryN = 0
+
+		if err := litestream.RestoreGroup(context.Background(), members, time.Time{}, 3); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if fis, err := ioutil.ReadDir(dir); err != nil {
+			t.Fatal(err)
+		} else if len(fis) != 0 {
+			var names []string
+			for _, fi := range fis {
+				names = append(names, fi.Name())
+			}
+			t.Fatalf("expected no files in output directory, got %v", names)
+		}
+
+		// The group can be restored again once the member is available.
+		members[1].Replica = r
+		if err := litestream.RestoreGroup(context.Background(), members, time.Time{}, 3); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure existing output paths are rejected before restoring any member.
+	t.Run("ErrOutputExists", func(t *testing.T) {
+		members, dir := setup(t)
+		if err := ioutil.WriteFile(members[2].Options.OutputPath, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := litestream.RestoreGroup(context.Background(), members, time.Time{}, 3); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+			t.Fatalf("expected no output for first member: %v", err)
+		}
+	})
+}
@@ -0,0 +1,33 @@
+package litestream
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// ReportSnapshot is called by a replica after it has written a snapshot.
+// Calls OnSnapshot, if set, in a separate goroutine.
+func (db *DB) ReportSnapshot(info SnapshotInfo) {
+	if fn := db.OnSnapshot; fn != nil {
+		go db.runHook("snapshot", func() { fn(info) })
+	}
+}
+
+// ReportGeneration is called by a replica after it has written the first
+// snapshot of a generation. Calls OnGeneration, if set, in a separate goroutine.
+func (db *DB) ReportGeneration(replica, generation string) {
+	if fn := db.OnGeneration; fn != nil {
+		go db.runHook("generation", func() { fn(replica, generation) })
+	}
+}
+
+// runHook calls fn & logs, rather than propagates, a panic so a failing
+// handler cannot stop the process.
+func (db *DB) runHook(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s: %s handler panic: %v\n%s", db.path, name, r, debug.Stack())
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,67 @@
+package litestream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestDB_OnSnapshot(t *testing.T) {
+	// Ensure handlers are called after the first snapshot of a generation &
+	// a panicking handler is recovered.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		snapshots := make(chan litestream.SnapshotInfo, 1)
+		generations := make(chan string, 1)
+		db.OnSnapshot = func(info litestream.SnapshotInfo) {
+			snapshots <- info
+			panic("marker")
+		}
+		db.OnGeneration = func(replica, generation string) {
+			generations <- generation
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		pos := r.LastPos()
+
+		select {
+		case info := <-snapshots:
+			if info.Replica != r.Name() || info.Generation != pos.Generation || info.Index != pos.Index {
+				t.Fatalf("unexpected snapshot: %#v", info)
+			} else if info.Size == 0 {
+				t.Fatal("expected snapshot size")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for snapshot handler")
+		}
+
+		select {
+		case generation := <-generations:
+			if generation != pos.Generation {
+				t.Fatalf("generation=%s, want %s", generation, pos.Generation)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for generation handler")
+		}
+
+		// Ensure later syncs without a snapshot do not call handlers.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		select {
+		case info := <-snapshots:
+			t.Fatalf("unexpected snapshot: %#v", info)
+		case generation := <-generations:
+			t.Fatalf("unexpected generation: %s", generation)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,590 @@
+package litestream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MaxSnapshotLayerN is the maximum number of incremental snapshot layers on
+// top of a full snapshot. The next snapshot after the last layer is full so
+// restores never apply more than this many layers.
+const MaxSnapshotLayerN = 16
+
+// snapshotLayerMagic begins each incremental snapshot layer. Full snapshots
+// begin with the SQLite header instead.
+const snapshotLayerMagic = "LSLAYER1"
+
+// Sizes of the header & trailer of an incremental snapshot layer. The header
+// is the magic followed by the base snapshot index, the page size, the page
+// count of the database & the number of pages in the layer. The trailer is
+// the CRC64 of the database image after applying the layer followed by the
+// CRC64 of all preceding bytes of the layer.
+const (
+	snapshotLayerHeaderSize  = len(snapshotLayerMagic) + 16
+	snapshotLayerTrailerSize = 16
+)
+
+// pageLogState tracks the pages written by the frames copied into each shadow
+// WAL file so a replica's next snapshot can store only the pages changed since
+// its last snapshot. Pages are only tracked for files observed from their
+// first frame since the database was opened.
+type pageLogState struct {
+	mu         sync.Mutex
+	generation string
+	indexes    map[int]map[uint32]struct{} // written pages, by shadow WAL index
+	bases      map[string]snapshotBase     // last snapshot written, by replica name
+}
+
+// snapshotBase is the last snapshot written by a replica in this process.
+type snapshotBase struct {
+	generation string
+	index      int
+	layerN     int // number of layers on top of the full snapshot
+}
+
+// reset discards all tracking if the generation has changed.
+func (s *pageLogState) reset(generation string) {
+	if s.generation == generation {
+		return
+	}
+	s.generation = generation
+	s.indexes = make(map[int]map[uint32]struct{})
+	s.bases = make(map[string]snapshotBase)
+}
+
+// prune discards tracked pages before the last snapshot of every replica. A
+// replica without a snapshot takes a full snapshot at the current index or
+// later so pages before index are discarded too.
+func (s *pageLogState) prune(index int) {
+	min := index
+	for _, b := range s.bases {
+		if b.index < min {
+			min = b.index
+		}
+	}
+	for i := range s.indexes {
+		if i < min {
+			delete(s.indexes, i)
+		}
+	}
+}
+
+// recordPages records pages written by frames copied into the shadow WAL file
+// at filename. The copy began at offset so the file is only tracked if the
+// copy began at its first frame or its earlier frames were tracked.
+func (db *DB) recordPages(filename string, offset int64, pgnos []uint32) {
+	if !db.IncrementalSnapshots {
+		return
+	}
+
+	index, _, _, err := ParseWALPath(filepath.Base(filename))
+	if err != nil {
+		return
+	}
+	generation := filepath.Base(filepath.Dir(filepath.Dir(filename)))
+
+	db.pages.mu.Lock()
+	defer db.pages.mu.Unlock()
+	db.pages.reset(generation)
+
+	m := db.pages.indexes[index]
+	if m == nil {
+		if offset > WALHeaderSize {
+			return // earlier frames not observed
+		}
+		m = make(map[uint32]struct{})
+		db.pages.indexes[index] = m
+	}
+	for _, pgno := range pgnos {
+		m[pgno] = struct{}{}
+	}
+	db.pages.prune(index)
+}
+
+// changedPages returns the sorted pages written to the shadow WAL of a
+// generation from index min through max. Returns false if any file in the
+// range was not tracked from its first frame.
+func (db *DB) changedPages(generation string, min, max int) ([]uint32, bool) {
+	db.pages.mu.Lock()
+	defer db.pages.mu.Unlock()
+
+	if db.pages.generation != generation {
+		return nil, false
+	}
+
+	set := make(map[uint32]struct{})
+	for index := min; index <= max; index++ {
+		m, ok := db.pages.indexes[index]
+		if !ok {
+			return nil, false
+		}
+		for pgno := range m {
+			set[pgno] = struct{}{}
+		}
+	}
+
+	pgnos := make([]uint32, 0, len(set))
+	for pgno := range set {
+		pgnos = append(pgnos, pgno)
+	}
+	sort.Slice(pgnos, func(i, j int) bool { return pgnos[i] < pgnos[j] })
+	return pgnos, true
+}
+
+// setSnapshotBase records the last snapshot written by a replica & discards
+// tracked pages which no replica's next snapshot can be based on.
+func (db *DB) setSnapshotBase(replica string, base snapshotBase) {
+	db.pages.mu.Lock()
+	defer db.pages.mu.Unlock()
+	db.pages.reset(base.generation)
+	db.pages.bases[replica] = base
+	db.pages.prune(base.index)
+}
+
+// snapshotBaseOf returns the last snapshot written by a replica.
+func (db *DB) snapshotBaseOf(replica, generation string) (snapshotBase, bool) {
+	db.pages.mu.Lock()
+	defer db.pages.mu.Unlock()
+
+	base, ok := db.pages.bases[replica]
+	if !ok || base.generation != generation {
+		return snapshotBase{}, false
+	}
+	return base, true
+}
+
+// SnapshotSource is the contents of a new snapshot of a database file. It
+// is either the entire file or, if incremental snapshots are enabled, a layer
+// of the pages changed since the replica's last snapshot.
+type SnapshotSource struct {
+	io.Reader
+
+	// Total number of bytes read from the source.
+	Size int64
+
+	// Index of the snapshot a layer is applied to & the number of pages in
+	// the layer. BaseIndex is -1 for full snapshots.
+	BaseIndex int
+	PageN     int
+
+	db         *DB
+	replica    string
+	generation string
+	index      int
+	layerN     int
+}
+
+// NewSnapshotSource returns the contents of a snapshot of the database at
+// the given generation & index for the named replica. The database file, f,
+// must be read while holding a read transaction & positioned at its start.
+//
+// A layer is returned if incremental snapshots are enabled, the replica's
+// last snapshot was written by this process & the pages written since then
+// are known. Otherwise, or if layering would not save space, f is returned.
+func (db *DB) NewSnapshotSource(f *os.File, replica, generation string, index int) (*SnapshotSource, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	src := &SnapshotSource{
+		Reader:     f,
+		Size:       fi.Size(),
+		BaseIndex:  -1,
+		db:         db,
+		replica:    replica,
+		generation: generation,
+		index:      index,
+	}
+	if !db.IncrementalSnapshots || db.pageSize == 0 {
+		return src, nil
+	}
+
+	base, ok := db.snapshotBaseOf(replica, generation)
+	if !ok || base.index >= index || base.layerN >= MaxSnapshotLayerN {
+		return src, nil
+	}
+	pgnos, ok := db.changedPages(generation, base.index, index)
+	if !ok {
+		return src, nil
+	}
+
+	// Ignore pages past the end of a truncated database. A layer of more
+	// than half of the pages is not worth applying over a full snapshot.
+	pageN := uint32(fi.Size() / int64(db.pageSize))
+	for len(pgnos) > 0 && pgnos[len(pgnos)-1] > pageN {
+		pgnos = pgnos[:len(pgnos)-1]
+	}
+	if len(pgnos) > int(pageN)/2 {
+		return src, nil
+	}
+
+	src.Reader = newSnapshotLayerReader(f, base.index, db.pageSize, pageN, pgnos)
+	src.Size = int64(snapshotLayerHeaderSize + len(pgnos)*(4+db.pageSize) + snapshotLayerTrailerSize)
+	src.BaseIndex, src.PageN = base.index, len(pgnos)
+	src.layerN = base.layerN + 1
+	return src, nil
+}
+
+// IsLayer returns true if the source is an incremental snapshot layer.
+func (s *SnapshotSource) IsLayer() bool { return s.BaseIndex >= 0 }
+
+// Commit records the snapshot as written by the replica so its next snapshot
+// can be layered on top of it. Must only be called once the snapshot has been
+// written successfully.
+func (s *SnapshotSource) Commit() {
+	if !s.db.IncrementalSnapshots {
+		return
+	}
+	s.db.setSnapshotBase(s.replica, snapshotBase{generation: s.generation, index: s.index, layerN: s.layerN})
+}
+
+// snapshotLayerReader encodes an incremental snapshot layer while reading
+// the entire database file so the checksum of the image can be computed.
+type snapshotLayerReader struct {
+	f        io.Reader
+	pageSize int
+	pageN    uint32
+	pgnos    []uint32 // remaining pages to include in the layer
+
+	pgno  uint32 // last page read from f
+	page  []byte
+	image hash.Hash64 // checksum of every page read from f
+	layer hash.Hash64 // checksum of every byte of the layer
+	buf   bytes.Buffer
+	done  bool
+}
+
+func newSnapshotLayerReader(f io.Reader, baseIndex, pageSize int, pageN uint32, pgnos []uint32) *snapshotLayerReader {
+	r := &snapshotLayerReader{
+		f:        f,
+		pageSize: pageSize,
+		pageN:    pageN,
+		pgnos:    pgnos,
+		page:     make([]byte, pageSize),
+		image:    crc64.New(crc64.MakeTable(crc64.ISO)),
+		layer:    crc64.New(crc64.MakeTable(crc64.ISO)),
+	}
+
+	hdr := make([]byte, snapshotLayerHeaderSize)
+	copy(hdr, snapshotLayerMagic)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(baseIndex))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(pageSize))
+	binary.BigEndian.PutUint32(hdr[16:], pageN)
+	binary.BigEndian.PutUint32(hdr[20:], uint32(len(pgnos)))
+	r.write(hdr)
+	return r
+}
+
+func (r *snapshotLayerReader) write(b []byte) {
+	_, _ = r.layer.Write(b)
+	_, _ = r.buf.Write(b)
+}
+
+func (r *snapshotLayerReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		// Write the trailer once every page of the database has been read.
+		if r.pgno == r.pageN {
+			trailer := make([]byte, snapshotLayerTrailerSize)
+			binary.BigEndian.PutUint64(trailer[0:], r.image.Sum64())
+			r.write(trailer[:8])
+			binary.BigEndian.PutUint64(trailer[8:], r.layer.Sum64())
+			_, _ = r.buf.Write(trailer[8:])
+			r.done = true
+			break
+		}
+
+		if _, err := io.ReadFull(r.f, r.page); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		r.pgno++
+		_, _ = r.image.Write(r.page)
+
+		if len(r.pgnos) > 0 && r.pgnos[0] == r.pgno {
+			var pgno [4]byte
+			binary.BigEndian.PutUint32(pgno[:], r.pgno)
+			r.write(pgno[:])
+			r.write(r.page)
+			r.pgnos = r.pgnos[1:]
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// snapshotLayerHeader is the decoded header of an incremental snapshot layer.
+type snapshotLayerHeader struct {
+	baseIndex int
+	pageSize  int
+	pageN     uint32
+	n         int // number of pages in the layer
+}
+
+// readSnapshotLayerHeader decodes the header of a snapshot layer from hdr.
+// Returns false if hdr is the start of a full snapshot.
+func readSnapshotLayerHeader(hdr []byte) (snapshotLayerHeader, bool) {
+	if len(hdr) < snapshotLayerHeaderSize || string(hdr[:len(snapshotLayerMagic)]) != snapshotLayerMagic {
+		return snapshotLayerHeader{}, false
+	}
+	return snapshotLayerHeader{
+		baseIndex: int(binary.BigEndian.Uint32(hdr[8:])),
+		pageSize:  int(binary.BigEndian.Uint32(hdr[12:])),
+		pageN:     binary.BigEndian.Uint32(hdr[16:]),
+		n:         int(binary.BigEndian.Uint32(hdr[20:])),
+	}, true
+}
+
+// SnapshotBaseIndex returns the index of the snapshot a snapshot is layered
+// on. Returns -1 if the snapshot is a full snapshot.
+func SnapshotBaseIndex(ctx context.Context, r Replica, generation string, index int) (int, error) {
+	rd, err := openSnapshot(ctx, r, generation, index)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	hdr := make([]byte, snapshotLayerHeaderSize)
+	if _, err := io.ReadFull(rd, hdr); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	if h, ok := readSnapshotLayerHeader(hdr); ok {
+		return h.baseIndex, nil
+	}
+	return -1, nil
+}
+
+// RetainSnapshotBases returns retained along with every snapshot in snapshots
+// which the oldest retained snapshot of a generation is layered on, directly
+// or through other layers, so retention never deletes the base of a layer.
+//
+// An unreadable snapshot is an error if the database of r has incremental
+// snapshots enabled. Otherwise it is assumed to be a full snapshot so that
+// retention of replicas without layers is unaffected by corrupt snapshots.
+func RetainSnapshotBases(ctx context.Context, r Replica, snapshots, retained []*SnapshotInfo) ([]*SnapshotInfo, error) {
+	strict := r.DB() != nil && r.DB().IncrementalSnapshots
+
+	generations := make(map[string]struct{})
+	for _, snapshot := range retained {
+		generations[snapshot.Generation] = struct{}{}
+	}
+
+	other := append([]*SnapshotInfo(nil), retained...)
+	for generation := range generations {
+		snapshot := FindMinSnapshotByGeneration(retained, generation)
+		for {
+			baseIndex, err := SnapshotBaseIndex(ctx, r, generation, snapshot.Index)
+			if err != nil && strict {
+				return nil, fmt.Errorf("cannot read snapshot %s/%08x: %w", generation, snapshot.Index, err)
+			} else if err != nil || baseIndex < 0 {
+				break
+			}
+
+			var base *SnapshotInfo
+			for _, s := range snapshots {
+				if s.Generation == generation && s.Index == baseIndex {
+					base = s
+					break
+				}
+			}
+			if base == nil {
+				break // base already missing, nothing to retain
+			}
+			other, snapshot = append(other, base), base
+		}
+	}
+	return other, nil
+}
+
+// writeSnapshotImage writes the database image of a snapshot to f. Layers are
+// applied on top of the image of their base snapshot & the resulting image
+// is verified against the checksum stored in the layer.
+func writeSnapshotImage(ctx context.Context, r Replica, generation string, index int, f *os.File) error {
+	return writeSnapshotImageN(ctx, r, generation, index, f, true, 0)
+}
+
+func writeSnapshotImageN(ctx context.Context, r Replica, generation string, index int, f *os.File, verify bool, depth int) error {
+	// Copy full snapshots directly to the file.
+	hdr, ok, err := copyFullSnapshot(ctx, r, generation, index, f)
+	if err != nil || !ok {
+		return err
+	}
+
+	// Write the base image first. Bases always precede their layers so
+	// a chain of layers always ends at a full snapshot.
+	if hdr.baseIndex >= index || depth >= MaxSnapshotLayerN {
+		return fmt.Errorf("snapshot %s/%08x: invalid base %08x: %w", generation, index, hdr.baseIndex, ErrSnapshotLayerCorrupt)
+	} else if err := writeSnapshotImageN(ctx, r, generation, hdr.baseIndex, f, false, depth+1); err != nil {
+		return fmt.Errorf("snapshot base %s/%08x: %w", generation, hdr.baseIndex, err)
+	}
+
+	rd, err := openSnapshot(ctx, r, generation, index)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	imageChecksum, err := applySnapshotLayer(f, bufio.NewReader(rd))
+	if err != nil {
+		return fmt.Errorf("snapshot %s/%08x: %w", generation, index, err)
+	} else if !verify {
+		return nil
+	}
+
+	// Ensure the image matches the database the layer was taken from.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	} else if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	} else if h.Sum64() != imageChecksum {
+		return fmt.Errorf("snapshot %s/%08x: image checksum mismatch: %016x != %016x: %w", generation, index, h.Sum64(), imageChecksum, ErrSnapshotLayerCorrupt)
+	}
+	return nil
+}
+
+// copyFullSnapshot copies a snapshot to f if it is a full snapshot. Otherwise
+// returns the header of the layer & true without writing to f.
+func copyFullSnapshot(ctx context.Context, r Replica, generation string, index int, f *os.File) (snapshotLayerHeader, bool, error) {
+	rd, err := openSnapshot(ctx, r, generation, index)
+	if err != nil {
+		return snapshotLayerHeader{}, false, err
+	}
+	defer rd.Close()
+
+	brd := bufio.NewReader(rd)
+	buf, _ := brd.Peek(snapshotLayerHeaderSize)
+	if hdr, ok := readSnapshotLayerHeader(buf); ok {
+		return hdr, true, nil
+	}
+	_, err = io.Copy(f, brd)
+	return snapshotLayerHeader{}, false, err
+}
+
+// applySnapshotLayer writes the pages of a layer to the database image in f
+// & truncates the image to the page count of the layer. Returns the checksum
+// of the resulting image stored in the layer.
+func applySnapshotLayer(f *os.File, rd io.Reader) (imageChecksum uint64, err error) {
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	trd := io.TeeReader(rd, h)
+
+	buf := make([]byte, snapshotLayerHeaderSize)
+	if _, err := io.ReadFull(trd, buf); err != nil {
+		return 0, fmt.Errorf("read layer header: %w", err)
+	}
+	hdr, ok := readSnapshotLayerHeader(buf)
+	if !ok || hdr.pageSize <= 0 {
+		return 0, fmt.Errorf("invalid layer header: %w", ErrSnapshotLayerCorrupt)
+	}
+
+	page := make([]byte, 4+hdr.pageSize)
+	for i := 0; i < hdr.n; i++ {
+		if _, err := io.ReadFull(trd, page); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("short layer: %w", ErrSnapshotLayerCorrupt)
+		} else if err != nil {
+			return 0, err
+		}
+
+		pgno := binary.BigEndian.Uint32(page)
+		if pgno == 0 || pgno > hdr.pageN {
+			return 0, fmt.Errorf("invalid layer page %d: %w", pgno, ErrSnapshotLayerCorrupt)
+		} else if _, err := f.WriteAt(page[4:], int64(pgno-1)*int64(hdr.pageSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	trailer := make([]byte, snapshotLayerTrailerSize)
+	if _, err := io.ReadFull(trd, trailer[:8]); err != nil {
+		return 0, fmt.Errorf("short layer: %w", ErrSnapshotLayerCorrupt)
+	} else if _, err := io.ReadFull(rd, trailer[8:]); err != nil {
+		return 0, fmt.Errorf("short layer: %w", ErrSnapshotLayerCorrupt)
+	} else if v := binary.BigEndian.Uint64(trailer[8:]); v != h.Sum64() {
+		return 0, fmt.Errorf("layer checksum mismatch: %016x != %016x: %w", h.Sum64(), v, ErrSnapshotLayerCorrupt)
+	}
+
+	if err := f.Truncate(int64(hdr.pageN) * int64(hdr.pageSize)); err != nil {
+		return 0, err
+	} else if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(trailer[:8]), nil
+}
+
+// openSnapshot returns a reader of a snapshot which serves reads of any size.
+// The snapshot is copied through a pipe as some decompressors, such as lz4,
+// are only reliably read in whole blocks.
+func openSnapshot(ctx context.Context, r Replica, generation string, index int) (io.ReadCloser, error) {
+	rd, err := r.SnapshotReader(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, rd)
+		_ = rd.Close()
+		_ = pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// snapshotImageReader returns a reader for the database image of a snapshot.
+// Full snapshots are read directly from the replica. Layers are applied to
+// their base in a temporary file which is removed when the reader is closed.
+func snapshotImageReader(ctx context.Context, r Replica, generation string, index int) (io.ReadCloser, error) {
+	rd, err := openSnapshot(ctx, r, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	brd := bufio.NewReader(rd)
+	if buf, _ := brd.Peek(snapshotLayerHeaderSize); !bytes.HasPrefix(buf, []byte(snapshotLayerMagic)) {
+		return &snapshotImageFile{Reader: brd, close: rd.Close}, nil
+	} else if err := rd.Close(); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "litestream-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() error {
+		err := f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := writeSnapshotImage(ctx, r, generation, index, f); err != nil {
+		_ = cleanup()
+		return nil, err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = cleanup()
+		return nil, err
+	}
+	return &snapshotImageFile{Reader: f, close: cleanup}, nil
+}
+
+// snapshotImageFile is a reader of a snapshot image with a custom close.
+type snapshotImageFile struct {
+	io.Reader
+	close func() error
+}
+
+func (f *snapshotImageFile) Close() error { return f.close() }
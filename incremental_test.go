@@ -0,0 +1,182 @@
+package litestream_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestFileReplica_IncrementalSnapshots(t *testing.T) {
+	// Ensure a snapshot after the first contains only the changed pages and
+	// restores on top of its base, which retention keeps.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb, r, base, pos := MustOpenIncrementalReplica(t, true)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if baseIndex, err := litestream.SnapshotBaseIndex(context.Background(), r, pos.Generation, pos.Index); err != nil {
+			t.Fatal(err)
+		} else if baseIndex != base {
+			t.Fatalf("base index=%d, want %d", baseIndex, base)
+		}
+
+		full, err := os.Stat(r.SnapshotPath(pos.Generation, base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := os.Stat(r.SnapshotPath(pos.Generation, pos.Index))
+		if err != nil {
+			t.Fatal(err)
+		} else if layer.Size() >= full.Size()/2 {
+			t.Fatalf("layer size=%d, full size=%d", layer.Size(), full.Size())
+		}
+
+		if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure only full snapshots are written by default.
+	t.Run("Disabled", func(t *testing.T) {
+		db, sqldb, r, _, pos := MustOpenIncrementalReplica(t, false)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if baseIndex, err := litestream.SnapshotBaseIndex(context.Background(), r, pos.Generation, pos.Index); err != nil {
+			t.Fatal(err)
+		} else if baseIndex != -1 {
+			t.Fatalf("base index=%d, want -1", baseIndex)
+		}
+	})
+
+	// Ensure restore fails if a page of a layer is corrupt.
+	t.Run("ErrCorruptLayer", func(t *testing.T) {
+		db, sqldb, r, _, pos := MustOpenIncrementalReplica(t, true)
+		defer MustCloseDBs(t, db, sqldb)
+
+		MustRewriteSnapshot(t, r, pos.Generation, pos.Index, func(buf []byte) { buf[len(buf)-100] ^= 0xFF })
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrSnapshotLayerCorrupt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure restore fails if the base of a layer does not match the
+	// database the layer was taken from.
+	t.Run("ErrCorruptBase", func(t *testing.T) {
+		db, sqldb, r, base, pos := MustOpenIncrementalReplica(t, true)
+		defer MustCloseDBs(t, db, sqldb)
+
+		MustRewriteSnapshot(t, r, pos.Generation, base, func(buf []byte) { buf[len(buf)/2] ^= 0xFF })
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrSnapshotLayerCorrupt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenIncrementalReplica opens a database with a full snapshot of its
+// checkpointed contents at the returned base index & a second snapshot, each
+// taken by retention, at the returned position.
+func MustOpenIncrementalReplica(tb testing.TB, incremental bool) (*litestream.DB, *sql.DB, *litestream.FileReplica, int, litestream.Pos) {
+	tb.Helper()
+
+	db, sqldb := MustOpenDBs(tb)
+	db.IncrementalSnapshots = incremental
+	r := NewTestFileReplica(tb, db)
+	r.Codec = litestream.LookupCodec(litestream.CompressionGzip)
+	r.Retention = time.Nanosecond
+
+	MustInsertBlobs(tb, sqldb, 100)
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	MustSyncDBReplica(tb, db, r)
+
+	var base int
+	for i := 0; i < 2; i++ {
+		MustRollWALIndex(tb, db, sqldb, r)
+		if result, err := r.RunRetention(context.Background()); err != nil {
+			tb.Fatal(err)
+		} else if !result.Snapshotted {
+			tb.Fatal("expected snapshot")
+		}
+
+		if i == 0 {
+			pos, err := db.Pos()
+			if err != nil {
+				tb.Fatal(err)
+			}
+			base = pos.Index
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	} else if pos.Index == base {
+		tb.Fatal("expected new wal index")
+	}
+	return db, sqldb, r, base, pos
+}
+
+// MustRewriteSnapshot rewrites the contents of a snapshot after fn is called
+// on its decompressed contents. The modification time is kept so restores
+// choose the same snapshot & the checksum is updated so restores read the
+// rewritten contents.
+func MustRewriteSnapshot(tb testing.TB, r *litestream.FileReplica, generation string, index int, fn func([]byte)) {
+	tb.Helper()
+
+	fi, err := os.Stat(r.SnapshotPath(generation, index))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	rd, err := r.SnapshotReader(context.Background(), generation, index)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := rd.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	fn(buf)
+
+	f, err := os.Create(r.SnapshotPath(generation, index))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	zw, err := litestream.NewObjectWriter(f, r.Codec, 1)
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := zw.Write(buf); err != nil {
+		tb.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		tb.Fatal(err)
+	} else if err := os.Chtimes(f.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		tb.Fatal(err)
+	}
+
+	cw := litestream.NewChecksumWriter()
+	_, _ = cw.Write(buf)
+	if err := ioutil.WriteFile(r.SnapshotChecksumPath(generation, index), []byte(cw.Checksum()+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
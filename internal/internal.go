@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"context"
 	"io"
+	"sync"
 )
 
 // ReadCloser wraps a reader to also attach a separate closer.
@@ -30,3 +32,75 @@ func (r *ReadCloser) Close() error {
 	}
 	return r.c.Close()
 }
+
+// ReadCounter wraps an io.Reader and counts the total number of bytes read.
+type ReadCounter struct {
+	r io.Reader
+	n int64
+}
+
+// NewReadCounter returns a new instance of ReadCounter that wraps r.
+func NewReadCounter(r io.Reader) *ReadCounter {
+	return &ReadCounter{r: r}
+}
+
+// Read reads from the underlying reader into p and adds the bytes read to the counter.
+func (r *ReadCounter) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// N returns the total number of bytes read.
+func (r *ReadCounter) N() int64 { return r.n }
+
+// ParallelBatches splits n items into contiguous batches of up to size items
+// and calls fn with the [i, j) range of each batch. At most workers calls run
+// concurrently. If any call fails, the context passed to remaining calls is
+// canceled, no new batches are started, and the first error is returned.
+func ParallelBatches(ctx context.Context, workers, n, size int, fn func(ctx context.Context, i, j int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, workers)
+
+	for i := 0; i < n; i += size {
+		j := i + size
+		if j > n {
+			j = n
+		}
+
+		// Wait for an available worker or stop starting batches on error.
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i, j int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(ctx, i, j); err != nil {
+				once.Do(func() { firstErr = err; cancel() })
+			}
+		}(i, j)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -41,4 +41,56 @@ var (
 		Name:      "validation_total",
 		Help:      "The number of validations performed",
 	}, []string{"db", "name", "status"})
+
+	ReplicaSnapshotAgeGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_age_seconds",
+		Help:      "The age of the latest snapshot in the current generation",
+	}, []string{"db", "name"})
+
+	ReplicaSnapshotWALCountGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_wal_count",
+		Help:      "The number of WAL indices after the latest snapshot",
+	}, []string{"db", "name"})
+
+	ReplicaWALGapTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "wal_gap_total",
+		Help:      "The number of continuity checks which found a missing WAL index",
+	}, []string{"db", "name"})
+
+	ReplicaLagSecondsGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "lag_seconds",
+		Help:      "The age of the oldest WAL change not yet uploaded by the replica",
+	}, []string{"db", "name"})
+)
+
+// Replica compression metrics.
+var (
+	ReplicaCompressionInputBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "compression_input_bytes",
+		Help:      "The number of uncompressed bytes written to the compressor",
+	}, []string{"db", "name"})
+
+	ReplicaCompressionOutputBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "compression_output_bytes",
+		Help:      "The number of compressed bytes written by the compressor",
+	}, []string{"db", "name"})
+
+	ReplicaCompressionRatioGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "compression_ratio",
+		Help:      "The average ratio of uncompressed to compressed bytes",
+	}, []string{"db", "name"})
 )
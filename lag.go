@@ -0,0 +1,70 @@
+package litestream
+
+import (
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// markWALChanged records t as the time of the oldest change not yet uploaded
+// by each replica which has uploaded all previous changes.
+func (db *DB) markWALChanged(t time.Time) {
+	db.lagMu.Lock()
+	defer db.lagMu.Unlock()
+
+	if db.lagPending == nil {
+		db.lagPending = make(map[string]time.Time)
+	}
+	for _, r := range db.ReplicaList() {
+		if _, ok := db.lagPending[r.Name()]; !ok {
+			db.lagPending[r.Name()] = t
+		}
+	}
+}
+
+// MarkReplicaSynced is called by a replica after it has uploaded every change
+// to the shadow WAL made before start, the time its sync began. Changes made
+// after start remain pending until a later sync.
+func (db *DB) MarkReplicaSynced(name string, start time.Time) {
+	db.lagMu.Lock()
+	defer db.lagMu.Unlock()
+
+	if t, ok := db.lagPending[name]; ok && !t.After(start) {
+		delete(db.lagPending, name)
+	}
+	db.replicaLagGauge(name).Set(db.replicaLag(name, time.Now()).Seconds())
+}
+
+// ReplicaLag returns how long the oldest change to the shadow WAL has been
+// waiting to be uploaded by the named replica. Returns zero if the replica
+// has uploaded all changes.
+func (db *DB) ReplicaLag(name string) time.Duration {
+	db.lagMu.Lock()
+	defer db.lagMu.Unlock()
+	return db.replicaLag(name, time.Now())
+}
+
+func (db *DB) replicaLag(name string, now time.Time) time.Duration {
+	t, ok := db.lagPending[name]
+	if !ok || now.Before(t) {
+		return 0
+	}
+	return now.Sub(t)
+}
+
+// updateReplicaLagMetrics sets the lag gauge of each replica so the lag of a
+// stalled replica continues to grow between its syncs.
+func (db *DB) updateReplicaLagMetrics() {
+	db.lagMu.Lock()
+	defer db.lagMu.Unlock()
+
+	now := time.Now()
+	for _, r := range db.ReplicaList() {
+		db.replicaLagGauge(r.Name()).Set(db.replicaLag(r.Name(), now).Seconds())
+	}
+}
+
+func (db *DB) replicaLagGauge(name string) prometheus.Gauge {
+	return internal.ReplicaLagSecondsGaugeVec.WithLabelValues(db.path, name)
+}
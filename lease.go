@@ -0,0 +1,54 @@
+package litestream
+
+import (
+	"sync"
+)
+
+// restoreLeases counts the restores in progress for each replica generation
+// within the process. Retention skips leased generations so files are not
+// deleted while a restore is reading them.
+var restoreLeases = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// acquireRestoreLease marks the generation of a replica as being restored
+// until the returned function is called. A blank generation leases every
+// generation of the replica.
+func acquireRestoreLease(r Replica, generation string) (release func()) {
+	key := restoreLeaseKey(r, generation)
+
+	restoreLeases.Lock()
+	restoreLeases.m[key]++
+	restoreLeases.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			restoreLeases.Lock()
+			defer restoreLeases.Unlock()
+			if restoreLeases.m[key]--; restoreLeases.m[key] <= 0 {
+				delete(restoreLeases.m, key)
+			}
+		})
+	}
+}
+
+// IsGenerationRestoring returns true if a restore of the replica's generation
+// is in progress within this process. Restores in other processes, such as a
+// separate "litestream restore" command, are not tracked.
+func IsGenerationRestoring(r Replica, generation string) bool {
+	restoreLeases.Lock()
+	defer restoreLeases.Unlock()
+	return restoreLeases.m[restoreLeaseKey(r, generation)] > 0 || restoreLeases.m[restoreLeaseKey(r, "")] > 0
+}
+
+// restoreLeaseKey returns the lease key for a generation. Replicas are keyed
+// by URL so separate instances of the same replica share leases.
+func restoreLeaseKey(r Replica, generation string) string {
+	id := r.Type() + ":" + r.Name()
+	if u, ok := r.(interface{ URL() string }); ok {
+		id = u.URL()
+	}
+	return id + "\x00" + generation
+}
@@ -1,14 +1,18 @@
 package litestream
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc64"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -34,10 +38,68 @@ const (
 	CheckpointModeTruncate = "TRUNCATE"
 )
 
+// IsCheckpointMode returns true if s is a valid SQLite checkpoint mode.
+func IsCheckpointMode(s string) bool {
+	switch s {
+	case CheckpointModePassive, CheckpointModeFull, CheckpointModeRestart, CheckpointModeTruncate:
+		return true
+	default:
+		return false
+	}
+}
+
+// Integrity hash algorithms. CRC64 is fast but only detects accidental
+// corruption while SHA-256 also protects against tampering.
+const (
+	IntegrityHashCRC64  = "crc64"
+	IntegrityHashSHA256 = "sha256"
+)
+
+// NewIntegrityHash returns a new hash for the named integrity hash algorithm.
+func NewIntegrityHash(name string) (hash.Hash, error) {
+	switch name {
+	case IntegrityHashCRC64:
+		return crc64.New(crc64.MakeTable(crc64.ISO)), nil
+	case IntegrityHashSHA256:
+		return sha256.New(), nil
+	case "blake3":
+		return nil, fmt.Errorf("integrity hash not supported by this build: %q", name)
+	default:
+		return nil, fmt.Errorf("invalid integrity hash: %q", name)
+	}
+}
+
+// ValidateDBPath returns an error if path refers to a SQLite WAL, shared
+// memory, or rollback journal file instead of a database file.
+func ValidateDBPath(path string) error {
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if strings.HasSuffix(path, suffix) {
+			return fmt.Errorf("database path cannot be a sqlite %q file: %s", suffix, path)
+		}
+	}
+	return nil
+}
+
 // Litestream errors.
 var (
 	ErrNoSnapshots      = errors.New("no snapshots available")
+	ErrBeforeSnapshots  = errors.New("timestamp before earliest snapshot")
 	ErrChecksumMismatch = errors.New("invalid replica, checksum mismatch")
+	ErrWALSaltMismatch  = errors.New("wal salt mismatch")
+	ErrWALGap           = errors.New("wal index gap")
+	ErrSnapshotStale    = errors.New("snapshot is stale")
+	ErrReplicaBehind    = errors.New("replica behind local position")
+	ErrReplicaAhead     = errors.New("replica ahead of local position")
+
+	ErrNotSQLiteDatabase = errors.New("not a sqlite database")
+	ErrGenerationExists  = errors.New("generation already exists")
+	ErrGenerationChanged = errors.New("generation changed")
+	ErrTableNotFound     = errors.New("table not found")
+
+	ErrUnsupportedFormatVersion = errors.New("unsupported backup format version")
+	ErrIdentityRequired         = errors.New("age identity required to decrypt encrypted object")
+	ErrSnapshotLayerCorrupt     = errors.New("corrupt incremental snapshot layer")
+	ErrIntegrityCheckFailed     = errors.New("integrity check failed")
 )
 
 // SnapshotInfo represents file information about a snapshot.
@@ -61,6 +123,29 @@ func FilterSnapshotsAfter(a []*SnapshotInfo, t time.Time) []*SnapshotInfo {
 	return other
 }
 
+// RetainedSnapshots returns the snapshots kept by a retention policy: those
+// created within retention of now along with the n most recent snapshots.
+// A snapshot is kept if either rule retains it. Either rule is disabled if
+// zero but the duration is always applied if both are zero.
+func RetainedSnapshots(a []*SnapshotInfo, now time.Time, retention time.Duration, n int) []*SnapshotInfo {
+	if n <= 0 {
+		return FilterSnapshotsAfter(a, now.Add(-retention))
+	}
+
+	// Sort a copy from newest to oldest to find the most recent snapshots.
+	sorted := make([]*SnapshotInfo, len(a))
+	copy(sorted, a)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreatedAt.After(sorted[j].CreatedAt) })
+
+	other := make([]*SnapshotInfo, 0, len(a))
+	for i, snapshot := range sorted {
+		if i < n || (retention > 0 && !snapshot.CreatedAt.Before(now.Add(-retention))) {
+			other = append(other, snapshot)
+		}
+	}
+	return other
+}
+
 // FindMinSnapshotByGeneration finds the snapshot with the lowest index in a generation.
 func FindMinSnapshotByGeneration(a []*SnapshotInfo, generation string) *SnapshotInfo {
 	var min *SnapshotInfo
@@ -139,8 +224,8 @@ func rollback(tx *sql.Tx) error {
 }
 
 // readWALHeader returns the header read from a WAL file.
-func readWALHeader(filename string) ([]byte, error) {
-	f, err := os.Open(filename)
+func readWALHeader(fsys FileSystem, filename string) ([]byte, error) {
+	f, err := fsys.Open(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -151,9 +236,18 @@ func readWALHeader(filename string) ([]byte, error) {
 	return buf[:n], err
 }
 
+// walHeaderPageSize returns the page size stored in a WAL header. Returns
+// zero if the header is incomplete.
+func walHeaderPageSize(hdr []byte) int {
+	if len(hdr) < WALHeaderSize {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(hdr[8:]))
+}
+
 // readFileAt reads a slice from a file.
-func readFileAt(filename string, offset, n int64) ([]byte, error) {
-	f, err := os.Open(filename)
+func readFileAt(fsys FileSystem, filename string, offset, n int64) ([]byte, error) {
+	f, err := fsys.Open(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -197,7 +291,8 @@ func IsGenerationName(s string) bool {
 
 // IsSnapshotPath returns true if s is a path to a snapshot file.
 func IsSnapshotPath(s string) bool {
-	return snapshotPathRegex.MatchString(s)
+	_, _, err := ParseSnapshotPath(s)
+	return err == nil
 }
 
 // ParseSnapshotPath returns the index for the snapshot.
@@ -206,7 +301,7 @@ func ParseSnapshotPath(s string) (index int, ext string, err error) {
 	s = filepath.Base(s)
 
 	a := snapshotPathRegex.FindStringSubmatch(s)
-	if a == nil {
+	if a == nil || !isObjectCodecExt(strings.TrimPrefix(a[2], SnapshotExt)) {
 		return 0, "", fmt.Errorf("invalid snapshot path: %s", s)
 	}
 
@@ -214,11 +309,12 @@ func ParseSnapshotPath(s string) (index int, ext string, err error) {
 	return int(i64), a[2], nil
 }
 
-var snapshotPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(.snapshot(?:.lz4)?)$`)
+var snapshotPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(\.snapshot(?:\.[0-9a-z]+)?(?:\.age)?)$`)
 
 // IsWALPath returns true if s is a path to a WAL file.
 func IsWALPath(s string) bool {
-	return walPathRegex.MatchString(s)
+	_, _, _, err := ParseWALPath(s)
+	return err == nil
 }
 
 // ParseWALPath returns the index & offset for the WAL file.
@@ -227,7 +323,7 @@ func ParseWALPath(s string) (index int, offset int64, ext string, err error) {
 	s = filepath.Base(s)
 
 	a := walPathRegex.FindStringSubmatch(s)
-	if a == nil {
+	if a == nil || !isObjectCodecExt(strings.TrimPrefix(a[3], WALExt)) {
 		return 0, 0, "", fmt.Errorf("invalid wal path: %s", s)
 	}
 
@@ -249,7 +345,13 @@ func FormatWALPathWithOffset(index int, offset int64) string {
 	return fmt.Sprintf("%08x_%08x%s", index, offset, WALExt)
 }
 
-var walPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(?:_([0-9a-f]{8}))?(.wal(?:.lz4)?)$`)
+var walPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(?:_([0-9a-f]{8}))?(\.wal(?:\.[0-9a-z]+)?(?:\.age)?)$`)
+
+// isObjectCodecExt returns true if ext is the extension of a registered codec,
+// optionally followed by EncryptionExt.
+func isObjectCodecExt(ext string) bool {
+	return ObjectCodec(ext, nil) != nil
+}
 
 // isHexChar returns true if ch is a lowercase hex character.
 func isHexChar(ch rune) bool {
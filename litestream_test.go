@@ -1,11 +1,18 @@
 package litestream_test
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -40,6 +47,92 @@ func TestChecksum(t *testing.T) {
 	})
 }
 
+func TestParallelBatches(t *testing.T) {
+	// Ensure items are split into batches of at most the given size.
+	t.Run("OK", func(t *testing.T) {
+		var mu sync.Mutex
+		var batches [][2]int
+		if err := internal.ParallelBatches(context.Background(), 3, 2500, 1000, func(ctx context.Context, i, j int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, [2]int{i, j})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(batches), 3; got != want {
+			t.Fatalf("batches=%d, want %d", got, want)
+		}
+
+		var n int
+		for _, b := range batches {
+			if b[1]-b[0] > 1000 {
+				t.Fatalf("batch too large: %v", b)
+			}
+			n += b[1] - b[0]
+		}
+		if n != 2500 {
+			t.Fatalf("n=%d, want 2500", n)
+		}
+	})
+
+	// Ensure no more than workers batches run at the same time.
+	t.Run("Bound", func(t *testing.T) {
+		var mu sync.Mutex
+		var active, maxActive int
+		release := make(chan struct{})
+		started := make(chan struct{}, 100)
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- internal.ParallelBatches(context.Background(), 4, 100, 1, func(ctx context.Context, i, j int) error {
+				mu.Lock()
+				if active++; active > maxActive {
+					maxActive = active
+				}
+				mu.Unlock()
+				started <- struct{}{}
+
+				<-release
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return nil
+			})
+		}()
+
+		// Wait for the pool to fill and then let all batches complete.
+		for i := 0; i < 4; i++ {
+			<-started
+		}
+		close(release)
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		} else if maxActive != 4 {
+			t.Fatalf("max concurrent=%d, want 4", maxActive)
+		}
+	})
+
+	// Ensure the first error is returned & remaining batches are not started.
+	t.Run("Error", func(t *testing.T) {
+		errMarker := errors.New("marker")
+		var mu sync.Mutex
+		var n int
+		if err := internal.ParallelBatches(context.Background(), 1, 100, 1, func(ctx context.Context, i, j int) error {
+			mu.Lock()
+			n++
+			mu.Unlock()
+			if i == 10 {
+				return errMarker
+			}
+			return nil
+		}); err != errMarker {
+			t.Fatalf("unexpected error: %v", err)
+		} else if n > 12 {
+			t.Fatalf("expected batches to stop after error: n=%d", n)
+		}
+	})
+}
+
 func MustDecodeHexString(s string) []byte {
 	b, err := hex.DecodeString(s)
 	if err != nil {
@@ -47,3 +140,37 @@ func MustDecodeHexString(s string) []byte {
 	}
 	return b
 }
+
+func TestRetainedSnapshots(t *testing.T) {
+	now := time.Now()
+	a := []*litestream.SnapshotInfo{
+		{Generation: "0000000000000001", Index: 0, CreatedAt: now.Add(-3 * time.Hour)},
+		{Generation: "0000000000000002", Index: 0, CreatedAt: now.Add(-2 * time.Hour)},
+		{Generation: "0000000000000002", Index: 1, CreatedAt: now.Add(-1 * time.Hour)},
+	}
+
+	indexOf := func(a []*litestream.SnapshotInfo) (other []string) {
+		for _, s := range a {
+			other = append(other, fmt.Sprintf("%s/%d", s.Generation, s.Index))
+		}
+		return other
+	}
+
+	for _, tt := range []struct {
+		name      string
+		retention time.Duration
+		n         int
+		want      []string
+	}{
+		{"Duration", 90 * time.Minute, 0, []string{"0000000000000002/1"}},
+		{"Count", 0, 2, []string{"0000000000000002/1", "0000000000000002/0"}},
+		{"DurationRetainsMore", 4 * time.Hour, 1, []string{"0000000000000002/1", "0000000000000002/0", "0000000000000001/0"}},
+		{"CountRetainsMore", 90 * time.Minute, 2, []string{"0000000000000002/1", "0000000000000002/0"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexOf(litestream.RetainedSnapshots(a, now, tt.retention, tt.n)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("snapshots=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
 // +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
 
 package litestream
 
 import (
+	"errors"
 	"os"
 	"syscall"
 )
@@ -13,6 +15,31 @@ func fileinfo(fi os.FileInfo) (uid, gid int) {
 	return int(stat.Uid), int(stat.Gid)
 }
 
+// fileLinkN returns the number of hard links to a file.
+func fileLinkN(fi os.FileInfo) int {
+	return int(fi.Sys().(*syscall.Stat_t).Nlink)
+}
+
+// isCrossDeviceError returns true if err is from renaming a file to
+// another filesystem.
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
 func fixRootDirectory(p string) string {
 	return p
 }
+
+// syncDir fsyncs a directory so new & renamed entries are durable.
+func syncDir(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
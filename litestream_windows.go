@@ -1,9 +1,12 @@
+//go:build windows
 // +build windows
 
 package litestream
 
 import (
+	"errors"
 	"os"
+	"syscall"
 )
 
 // fileinfo returns syscall fields from a FileInfo object.
@@ -11,6 +14,17 @@ func fileinfo(fi os.FileInfo) (uid, gid int) {
 	return -1, -1
 }
 
+// fileLinkN returns -1 as the number of hard links is not available.
+func fileLinkN(fi os.FileInfo) int {
+	return -1
+}
+
+// isCrossDeviceError returns true if err is from moving a file to another
+// volume, which returns ERROR_NOT_SAME_DEVICE.
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, syscall.Errno(17))
+}
+
 // fixRootDirectory is copied from the standard library for use with mkdirAll()
 func fixRootDirectory(p string) string {
 	if len(p) == len(`\\?\c:`) {
@@ -20,3 +34,8 @@ func fixRootDirectory(p string) string {
 	}
 	return p
 }
+
+// syncDir is a no-op as directories cannot be fsynced on Windows.
+func syncDir(path string) error {
+	return nil
+}
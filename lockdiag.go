@@ -0,0 +1,169 @@
+package litestream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// DefaultCheckpointBusyN is the default number of consecutive busy
+// checkpoints before a lock diagnostic is produced.
+const DefaultCheckpointBusyN = 3
+
+// walIndexVersion is the version stored at the start of the WAL index.
+const walIndexVersion = 3007000
+
+// LockDiagnostic describes why checkpoints of a database are not completing.
+// It is produced once per streak of busy checkpoints.
+type LockDiagnostic struct {
+	Path  string // database path
+	Mode  string // checkpoint mode
+	BusyN int    // consecutive busy checkpoints
+
+	// Results of the last "PRAGMA wal_checkpoint".
+	Busy          bool
+	LogN          int // total frames in the WAL
+	CheckpointedN int // frames copied into the database
+
+	// WAL index state read from the shared memory file. Read marks are the
+	// frames each reader slot has pinned. Nil if unavailable.
+	WALIndex *WALIndexState
+
+	// Processes with the database, WAL, or shared memory file open. Only
+	// supported on Linux. Includes the current process.
+	Holders   []FileHolder
+	HolderErr error
+}
+
+// String returns a single-line summary of the diagnostic.
+func (d *LockDiagnostic) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "checkpoint busy %d times: mode=%s busy=%v log=%d checkpointed=%d", d.BusyN, d.Mode, d.Busy, d.LogN, d.CheckpointedN)
+
+	if d.WALIndex != nil {
+		fmt.Fprintf(&buf, " mxframe=%d backfill=%d readmarks=%v", d.WALIndex.MaxFrame, d.WALIndex.Backfill, d.WALIndex.ReadMarks)
+	}
+
+	if d.HolderErr != nil {
+		fmt.Fprintf(&buf, " holders=unknown (%s)", d.HolderErr)
+	} else if len(d.Holders) > 0 {
+		a := make([]string, len(d.Holders))
+		for i, h := range d.Holders {
+			a[i] = h.String()
+		}
+		fmt.Fprintf(&buf, " holders=%s", strings.Join(a, ","))
+	}
+	return buf.String()
+}
+
+// WALIndexState is the checkpoint state of the WAL index (-shm) file.
+type WALIndexState struct {
+	MaxFrame  uint32    // last valid frame in the WAL
+	Backfill  uint32    // frames copied into the database
+	ReadMarks [5]uint32 // frame pinned by each reader slot
+}
+
+// readWALIndexState reads the checkpoint state from a WAL index file.
+// The index is stored in native byte order so the version is used to
+// determine the order.
+func readWALIndexState(filename string) (*WALIndexState, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, 120)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(b[0:]) == walIndexVersion:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(b[0:]) == walIndexVersion:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown wal index version")
+	}
+
+	s := &WALIndexState{
+		MaxFrame: order.Uint32(b[16:]),
+		Backfill: order.Uint32(b[96:]),
+	}
+	for i := range s.ReadMarks {
+		s.ReadMarks[i] = order.Uint32(b[100+(i*4):])
+	}
+	return s, nil
+}
+
+// FileHolder is a process with one or more database files open.
+type FileHolder struct {
+	PID     int
+	Command string
+	Files   []string
+}
+
+// String returns the holder as "command[pid]".
+func (h FileHolder) String() string {
+	s := fmt.Sprintf("%s[%d]", h.Command, h.PID)
+	if h.PID == os.Getpid() {
+		s += "(self)"
+	}
+	return s
+}
+
+// trackCheckpointBusy updates the busy checkpoint streak with the result of
+// a checkpoint. A diagnostic is produced when the streak reaches the
+// threshold. Must be called while holding the database lock.
+func (db *DB) trackCheckpointBusy(mode string, row [3]int) {
+	// A checkpoint is busy if it could not run or if a reader prevented
+	// some frames from being copied into the database.
+	if row[0] == 0 && row[2] >= row[1] {
+		if db.checkpointBusyN >= db.checkpointBusyThreshold() {
+			log.Printf("%s: checkpoint no longer busy after %d attempts", db.path, db.checkpointBusyN)
+		}
+		db.checkpointBusyN = 0
+		return
+	}
+
+	db.checkpointBusyN++
+	if db.checkpointBusyN != db.checkpointBusyThreshold() {
+		return
+	}
+
+	d := &LockDiagnostic{
+		Path:          db.path,
+		Mode:          mode,
+		BusyN:         db.checkpointBusyN,
+		Busy:          row[0] != 0,
+		LogN:          row[1],
+		CheckpointedN: row[2],
+	}
+
+	var err error
+	if d.WALIndex, err = readWALIndexState(db.SHMPath()); err != nil {
+		log.Printf("%s: cannot read wal index: %s", db.path, err)
+	}
+	d.Holders, d.HolderErr = findFileHolders([]string{db.path, db.WALPath(), db.SHMPath()})
+
+	log.Printf("%s: %s", db.path, d)
+	db.lockDiagnosticNCounter.Inc()
+
+	if db.OnLockDiagnostic != nil {
+		db.OnLockDiagnostic(d)
+	}
+}
+
+// checkpointBusyThreshold returns the number of consecutive busy checkpoints
+// before a diagnostic is produced.
+func (db *DB) checkpointBusyThreshold() int {
+	if db.CheckpointBusyN > 0 {
+		return db.CheckpointBusyN
+	}
+	return DefaultCheckpointBusyN
+}
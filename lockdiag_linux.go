@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package litestream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// findFileHolders returns the processes which have any of paths open by
+// scanning the file descriptors in /proc. Processes which cannot be
+// inspected, such as those owned by other users, are skipped.
+func findFileHolders(paths []string) ([]FileHolder, error) {
+	m := make(map[string]string)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		m[abs] = path
+		if real, err := filepath.EvalSymlinks(abs); err == nil {
+			m[real] = path
+		}
+	}
+
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var holders []FileHolder
+	for _, fi := range fis {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", fi.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		files := make(map[string]struct{})
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			} else if path, ok := m[target]; ok {
+				files[path] = struct{}{}
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		h := FileHolder{PID: pid}
+		if b, err := ioutil.ReadFile(filepath.Join("/proc", fi.Name(), "comm")); err == nil {
+			h.Command = strings.TrimSpace(string(b))
+		}
+		for path := range files {
+			h.Files = append(h.Files, path)
+		}
+		sort.Strings(h.Files)
+		holders = append(holders, h)
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+
+	return holders, nil
+}
@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package litestream_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// Ensure a diagnostic identifying the lock holders is produced when a
+// long-running reader keeps checkpoints from completing.
+func TestDB_CheckpointBusy(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	var diags []*litestream.LockDiagnostic
+	db.CheckpointBusyN = 2
+	db.OnLockDiagnostic = func(d *litestream.LockDiagnostic) { diags = append(diags, d) }
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold a read transaction so later frames cannot be checkpointed.
+	tx, err := sqldb.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if _, err := db.Checkpoint(context.Background(), litestream.CheckpointModePassive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only one diagnostic is produced per streak.
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("len(diags)=%d, want %d", got, want)
+	}
+
+	d := diags[0]
+	if got, want := d.BusyN, 2; got != want {
+		t.Fatalf("BusyN=%d, want %d", got, want)
+	} else if d.CheckpointedN >= d.LogN {
+		t.Fatalf("expected incomplete checkpoint: log=%d checkpointed=%d", d.LogN, d.CheckpointedN)
+	} else if d.WALIndex == nil {
+		t.Fatal("expected wal index state")
+	} else if d.HolderErr != nil {
+		t.Fatal(d.HolderErr)
+	}
+
+	var found bool
+	for _, h := range d.Holders {
+		if h.PID == os.Getpid() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("current process not found in holders: %v", d.Holders)
+	}
+
+	// Releasing the reader allows the checkpoint to complete & resets the streak.
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Checkpoint(context.Background(), litestream.CheckpointModePassive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("len(diags)=%d, want %d", got, want)
+	}
+}
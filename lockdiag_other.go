@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package litestream
+
+import "errors"
+
+// findFileHolders is not supported on this platform.
+func findFileHolders(paths []string) ([]FileHolder, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,120 @@
+package litestream
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow represents a daily time range during which replica
+// uploads are paused. Changes are still captured in the shadow WAL and are
+// uploaded once the window ends. Windows which end before they start wrap
+// past midnight (e.g. "23:00-02:00").
+type MaintenanceWindow struct {
+	Start time.Duration // offset from midnight
+	End   time.Duration // offset from midnight
+}
+
+// ParseMaintenanceWindow parses a window in "HH:MM-HH:MM" format.
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	a := strings.SplitN(s, "-", 2)
+	if len(a) != 2 {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window, expected HH:MM-HH:MM: %q", s)
+	}
+
+	var w MaintenanceWindow
+	var err error
+	if w.Start, err = parseTimeOfDay(strings.TrimSpace(a[0])); err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window start: %q", s)
+	} else if w.End, err = parseTimeOfDay(strings.TrimSpace(a[1])); err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window end: %q", s)
+	} else if w.Start == w.End {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window must not be empty: %q", s)
+	}
+	return w, nil
+}
+
+// parseTimeOfDay returns the offset from midnight for a "HH:MM" string.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String returns the window in "HH:MM-HH:MM" format.
+func (w MaintenanceWindow) String() string {
+	return fmt.Sprintf("%s-%s", formatTimeOfDay(w.Start), formatTimeOfDay(w.End))
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+// Remaining returns the time until the window ends if t is inside the window.
+// Returns zero if t is outside the window. The time of day is evaluated in
+// t's location.
+func (w MaintenanceWindow) Remaining(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+
+	switch {
+	case w.Start < w.End && tod >= w.Start && tod < w.End:
+		return w.End - tod
+	case w.Start > w.End && tod >= w.Start:
+		return 24*time.Hour - tod + w.End // wraps past midnight
+	case w.Start > w.End && tod < w.End:
+		return w.End - tod
+	default:
+		return 0
+	}
+}
+
+// DeferRetention returns true if retention for the replica named name must
+// wait for the current maintenance window to end. It is called when no
+// snapshots are retained: retention must upload a new snapshot before it
+// deletes anything & snapshots are not uploaded during a window.
+func (db *DB) DeferRetention(name string) bool {
+	d := db.MaintenanceRemaining()
+	if d <= 0 {
+		return false
+	}
+	log.Printf("%s(%s): retainer: maintenance window, deferring retention for %s", db.path, name, d.Round(time.Second))
+	return true
+}
+
+// now returns the current time from the database's clock.
+func (db *DB) now() time.Time {
+	if db.Now != nil {
+		return db.Now()
+	}
+	return time.Now()
+}
+
+// MaintenanceRemaining returns the time until the current maintenance window
+// ends. Returns zero if uploads are not paused. Logs when the database enters
+// or leaves a window.
+func (db *DB) MaintenanceRemaining() time.Duration {
+	t := db.now()
+
+	var remaining time.Duration
+	for _, w := range db.MaintenanceWindows {
+		if d := w.Remaining(t); d > remaining {
+			remaining = d
+		}
+	}
+
+	db.maintenanceMu.Lock()
+	defer db.maintenanceMu.Unlock()
+	if paused := remaining > 0; paused != db.maintenancePaused {
+		db.maintenancePaused = paused
+		if paused {
+			log.Printf("%s: maintenance window started, uploads paused for %s", db.path, remaining.Round(time.Second))
+		} else {
+			log.Printf("%s: maintenance window ended, resuming uploads", db.path)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,129 @@
+package litestream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		if w, err := litestream.ParseMaintenanceWindow("01:30-03:00"); err != nil {
+			t.Fatal(err)
+		} else if got, want := w, (litestream.MaintenanceWindow{Start: 90 * time.Minute, End: 3 * time.Hour}); got != want {
+			t.Fatalf("window=%#v, want %#v", got, want)
+		} else if got, want := w.String(), "01:30-03:00"; got != want {
+			t.Fatalf("String()=%q, want %q", got, want)
+		}
+	})
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		for _, s := range []string{"", "01:00", "1am-2am", "01:00-25:00", "02:00-02:00"} {
+			if _, err := litestream.ParseMaintenanceWindow(s); err == nil {
+				t.Fatalf("expected error for %q", s)
+			}
+		}
+	})
+}
+
+func TestMaintenanceWindow_Remaining(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2000, 1, 1, hour, min, 0, 0, time.UTC) }
+
+	w := litestream.MaintenanceWindow{Start: 1 * time.Hour, End: 3 * time.Hour}
+	if got, want := w.Remaining(at(0, 59)), time.Duration(0); got != want {
+		t.Fatalf("before=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(1, 0)), 2*time.Hour; got != want {
+		t.Fatalf("start=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(2, 30)), 30*time.Minute; got != want {
+		t.Fatalf("inside=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(3, 0)), time.Duration(0); got != want {
+		t.Fatalf("end=%s, want %s", got, want)
+	}
+
+	// Ensure windows can wrap past midnight.
+	w = litestream.MaintenanceWindow{Start: 23 * time.Hour, End: 2 * time.Hour}
+	if got, want := w.Remaining(at(22, 0)), time.Duration(0); got != want {
+		t.Fatalf("before=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(23, 30)), 150*time.Minute; got != want {
+		t.Fatalf("before midnight=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(1, 0)), 1*time.Hour; got != want {
+		t.Fatalf("after midnight=%s, want %s", got, want)
+	} else if got, want := w.Remaining(at(2, 0)), time.Duration(0); got != want {
+		t.Fatalf("end=%s, want %s", got, want)
+	}
+}
+
+func TestDB_DeferRetention(t *testing.T) {
+	db := MustOpenDB(t)
+	defer MustCloseDB(t, db)
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+	db.MaintenanceWindows = []litestream.MaintenanceWindow{{Start: 1 * time.Hour, End: 3 * time.Hour}}
+
+	if db.DeferRetention("file") {
+		t.Fatal("expected retention outside window")
+	}
+	now = now.Add(2 * time.Hour)
+	if !db.DeferRetention("file") {
+		t.Fatal("expected retention to be deferred inside window")
+	}
+	now = now.Add(1 * time.Hour)
+	if db.DeferRetention("file") {
+		t.Fatal("expected retention once window ends")
+	}
+}
+
+func TestDB_MaintenanceWindow(t *testing.T) {
+	// Ensure uploads pause inside the window, restores use the last uploaded
+	// position, and the replica catches up after the window ends.
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+	db.MaintenanceWindows = []litestream.MaintenanceWindow{{Start: 1 * time.Hour, End: 3 * time.Hour}}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('before');`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+	pos0 := r.LastPos()
+
+	// Move clock into the window & write more data.
+	now = now.Add(2 * time.Hour)
+	if got, want := db.MaintenanceRemaining(), 1*time.Hour; got != want {
+		t.Fatalf("remaining=%s, want %s", got, want)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('during');`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	MustSyncDBReplica(t, db, r)
+
+	if got, want := r.LastPos(), pos0; got != want {
+		t.Fatalf("pos=%s, want %s", got, want)
+	} else if got, want := MustRestoreRowCount(t, r, pos0.Generation), 1; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	}
+
+	// Move clock past the window and ensure the replica catches up.
+	now = now.Add(1 * time.Hour)
+	if got := db.MaintenanceRemaining(); got != 0 {
+		t.Fatalf("remaining=%s, want 0", got)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	if dpos, err := db.Pos(); err != nil {
+		t.Fatal(err)
+	} else if got, want := r.LastPos(), dpos; got != want {
+		t.Fatalf("pos=%s, want %s", got, want)
+	} else if got, want := MustRestoreRowCount(t, r, pos0.Generation), 11; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	}
+}
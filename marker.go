@@ -0,0 +1,193 @@
+package litestream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MarkerTableName is the name of the table applications write named recovery
+// points into. Each row has a unique "name" and a "created_at" column.
+const MarkerTableName = "litestream_markers"
+
+// restoreReplicaToMarker restores the earliest snapshot of the generation and
+// applies WAL files until the commit which first makes the named marker row
+// visible. Markers are assumed to not be deleted once they are inserted.
+func restoreReplicaToMarker(ctx context.Context, r Replica, opt RestoreOptions, logger *log.Logger, logPrefix string) error {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Restore from the earliest snapshot as later snapshots may already
+	// include the marker & subsequent writes.
+	minWALIndex := -1
+	for _, info := range snapshots {
+		if info.Generation == opt.Generation && (minWALIndex == -1 || info.Index < minWALIndex) {
+			minWALIndex = info.Index
+		}
+	}
+	if minWALIndex == -1 {
+		return fmt.Errorf("cannot find snapshot index for restore: %w", ErrNoSnapshots)
+	}
+
+	maxWALIndex, err := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp)
+	if err != nil {
+		return fmt.Errorf("cannot find max wal index for restore: %w", err)
+	}
+	reportRestorePlan(ctx, r, opt, minWALIndex, maxWALIndex, logger, logPrefix)
+
+	tmpPath := restoreTempPath(opt, ".tmp")
+	scratchPath := restoreTempPath(opt, ".marker.tmp")
+	defer func() { _ = removeDBFiles(tmpPath) }()
+	defer removeDBFiles(scratchPath)
+
+	logger.Printf("%s: restoring snapshot %s/%08x to %s", logPrefix, opt.Generation, minWALIndex, tmpPath)
+	if err := restoreSnapshot(ctx, r, opt.Generation, minWALIndex, tmpPath); err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+
+	if found, err := hasMarker(tmpPath, opt.Marker); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("marker %q exists in earliest snapshot %s/%08x", opt.Marker, opt.Generation, minWALIndex)
+	}
+
+	for index := minWALIndex; index <= maxWALIndex; index++ {
+		wal, err := readReplicaWAL(ctx, r, opt.Generation, index)
+		if os.IsNotExist(err) && index == minWALIndex && index == maxWALIndex {
+			break // snapshot only
+		} else if err != nil {
+			return fmt.Errorf("cannot read wal %s/%08x: %w", opt.Generation, index, err)
+		}
+
+		if opt.ValidateWALSalt {
+			if err := verifyWALSaltBytes(wal); err != nil {
+				return fmt.Errorf("generation=%s index=%08x: %w", opt.Generation, index, err)
+			}
+		}
+
+		// Find the first commit in this WAL file where the marker exists.
+		offsets := walCommitOffsets(wal)
+		var checkErr error
+		i := sort.Search(len(offsets), func(i int) bool {
+			if checkErr != nil {
+				return true
+			}
+			found, err := hasMarkerAt(tmpPath, scratchPath, wal[:offsets[i]], opt.Marker)
+			if err != nil {
+				checkErr = err
+			}
+			return found
+		})
+		if checkErr != nil {
+			return fmt.Errorf("cannot check marker in wal %s/%08x: %w", opt.Generation, index, checkErr)
+		}
+
+		// Apply the whole WAL if the marker was not found in it. Otherwise
+		// apply up to the marker's commit and stop.
+		if i == len(offsets) {
+			if err := applyWALBytes(tmpPath, wal); err != nil {
+				return fmt.Errorf("cannot restore wal: %w", err)
+			}
+			if opt.Verbose {
+				logger.Printf("%s: restored wal %s/%08x", logPrefix, opt.Generation, index)
+			}
+			continue
+		}
+
+		if err := applyWALBytes(tmpPath, wal[:offsets[i]]); err != nil {
+			return fmt.Errorf("cannot restore wal: %w", err)
+		}
+		logger.Printf("%s: found marker %q in wal %s/%08x at offset %d", logPrefix, opt.Marker, opt.Generation, index, offsets[i])
+
+		if err := finalizeRestore(ctx, tmpPath, opt, logger, logPrefix); err != nil {
+			return err
+		}
+		return installRestoredDB(ctx, tmpPath, opt, logger, logPrefix)
+	}
+
+	return fmt.Errorf("marker not found: %q", opt.Marker)
+}
+
+// readReplicaWAL returns the full contents of a WAL file from the replica.
+func readReplicaWAL(ctx context.Context, r Replica, generation string, index int) ([]byte, error) {
+	rd, err := r.WALReader(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// walCommitOffsets returns the offset after each commit frame in a WAL file.
+func walCommitOffsets(wal []byte) []int {
+	if len(wal) < WALHeaderSize {
+		return nil
+	}
+
+	var offsets []int
+	frameSize := WALFrameHeaderSize + int(binary.BigEndian.Uint32(wal[8:]))
+	for off := WALHeaderSize; off+frameSize <= len(wal); off += frameSize {
+		if commit := binary.BigEndian.Uint32(wal[off+4:]); commit != 0 {
+			offsets = append(offsets, off+frameSize)
+		}
+	}
+	return offsets
+}
+
+// hasMarkerAt returns true if the marker exists after applying wal to a copy
+// of the database at dbPath. The copy is written to scratchPath so checking
+// does not modify the original database.
+func hasMarkerAt(dbPath, scratchPath string, wal []byte, name string) (bool, error) {
+	if err := removeDBFiles(scratchPath); err != nil {
+		return false, err
+	} else if err := copyFile(scratchPath, dbPath); err != nil {
+		return false, err
+	} else if err := ioutil.WriteFile(scratchPath+"-wal", wal, 0600); err != nil {
+		return false, err
+	}
+	return hasMarker(scratchPath, name)
+}
+
+// hasMarker returns true if the marker table in the database contains name.
+// Returns false if the marker table does not exist.
+func hasMarker(dbPath, name string) (bool, error) {
+	d, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer d.Close()
+
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(1) FROM `+MarkerTableName+` WHERE name = ?`, name).Scan(&n); err != nil && strings.Contains(err.Error(), "no such table") {
+		return false, d.Close()
+	} else if err != nil {
+		return false, err
+	}
+	return n > 0, d.Close()
+}
+
+// applyWALBytes writes wal as the WAL of the database at dbPath & checkpoints it.
+func applyWALBytes(dbPath string, wal []byte) error {
+	if err := ioutil.WriteFile(dbPath+"-wal", wal, 0600); err != nil {
+		return err
+	}
+	return checkpointRestoredWAL(dbPath)
+}
+
+// removeDBFiles removes a database file and its WAL & shared memory files.
+func removeDBFiles(dbPath string) error {
+	for _, filename := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
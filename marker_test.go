@@ -0,0 +1,87 @@
+package litestream_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreReplica_Marker(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`CREATE TABLE litestream_markers (name TEXT PRIMARY KEY, created_at TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Insert rows & markers, recording the row count at each marker.
+	counts := make(map[string]int)
+	insertN := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mark := func(name string) {
+		if _, err := sqldb.Exec(`INSERT INTO litestream_markers (name, created_at) VALUES (?, datetime('now'));`, name); err != nil {
+			t.Fatal(err)
+		}
+		counts[name] = MustCountRows(t, db.Path(), "foo")
+	}
+
+	insertN(5)
+	mark("a")
+	insertN(3)
+	mark("b")
+	insertN(2)
+	MustSyncDBReplica(t, db, r)
+
+	// Roll over to a new WAL index so the last marker is in a later WAL file.
+	MustRollWALIndex(t, db, sqldb, r)
+	insertN(4)
+	mark("c")
+	insertN(7)
+	MustSyncDBReplica(t, db, r)
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if pos.Index == 0 {
+		t.Fatal("expected multiple wal indices")
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		i, name := i, name
+		t.Run(name, func(t *testing.T) {
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(t.TempDir(), "db")
+			opt.Generation = pos.Generation
+			opt.Marker = name
+			if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), counts[name]; got != want {
+				t.Fatalf("n=%d, want %d", got, want)
+			} else if got, want := MustCountRows(t, opt.OutputPath, "litestream_markers"), i+1; got != want {
+				t.Fatalf("markers=%d, want %d", got, want)
+			}
+		})
+	}
+
+	// Ensure an unknown marker returns an error.
+	t.Run("ErrNotFound", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		opt.Marker = "z"
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || err.Error() != `marker not found: "z"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
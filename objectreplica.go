@@ -0,0 +1,1699 @@
+package litestream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Object types passed to ObjectClient.PutObject so stores can apply
+// per-type settings, such as storage classes.
+const (
+	ObjectTypeSnapshot = "snapshot"
+	ObjectTypeWAL      = "wal"
+)
+
+// ChecksumMetadataKey is the object metadata key for the checksum of a WAL
+// segment. Clients must return metadata keys in lowercase.
+const ChecksumMetadataKey = "litestream-checksum"
+
+// ObjectClient is the transport used by an ObjectReplica to store files in an
+// object store or on a remote server. Keys are slash-separated paths.
+type ObjectClient interface {
+	// String identifier for the type of replica ("s3", "gcs", etc).
+	Type() string
+
+	// Returns the location of the replica as a URL.
+	URL() string
+
+	// Connects to the store. No-op if already connected.
+	Init(ctx context.Context) error
+
+	// Calls fn for each object whose key begins with prefix, in key order.
+	// Objects below the next slash after the prefix are not listed; each
+	// such directory is passed once with IsDir set. Lists no objects if the
+	// prefix does not exist.
+	ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+
+	// Uploads the contents of rd to key, replacing any existing object. The
+	// upload is aborted if rd returns an error. Returns the bytes uploaded.
+	PutObject(ctx context.Context, key string, rd io.Reader, opts PutOptions) (int64, error)
+
+	// Returns a reader for the object at key & its info. Returns
+	// os.ErrNotExist if the object does not exist.
+	GetObject(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+
+	// Deletes objects. Objects which do not exist are ignored.
+	DeleteObjects(ctx context.Context, objs []ObjectInfo) error
+}
+
+// ObjectVersionLister is implemented by clients of stores which keep the
+// previous versions of replaced objects. Retention deletes every version.
+type ObjectVersionLister interface {
+	// Calls fn for every version of each object whose key begins with
+	// prefix, including objects below the next slash.
+	ListObjectVersions(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectDirRemover is implemented by clients of stores with directories
+// which are not removed along with their last object.
+type ObjectDirRemover interface {
+	// Removes dir if it is empty. No-op if dir does not exist.
+	RemoveDir(ctx context.Context, dir string) error
+}
+
+// ObjectInfo describes an object returned by an ObjectClient.
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	ModTime  time.Time
+	IsDir    bool
+	Metadata map[string]string // only set if returned by the store
+
+	// Identifies a single version of the object in stores which keep the
+	// previous versions of replaced objects. Deleting an object with a
+	// version only deletes that version.
+	Version string
+}
+
+// PutOptions represents options for uploading an object.
+type PutOptions struct {
+	// Type of object, such as ObjectTypeSnapshot. Blank for other objects.
+	Type string
+
+	// Metadata stored with the object, if the store supports metadata.
+	Metadata map[string]string
+
+	// Modification time of the object, if the store allows it to be set.
+	// The upload time is used if zero.
+	ModTime time.Time
+
+	// Limits the upload rate, if not nil.
+	Limiter *RateLimiter
+
+	// Size of the uncompressed contents of a snapshot, if known. Stores may
+	// use it to choose how the object is uploaded.
+	SourceSize int64
+}
+
+// ObjectReplica is a replica which replicates a DB to an object store, or a
+// similar remote store, through an ObjectClient. It implements the sync,
+// snapshot, retention & restore logic shared by the replica types of each
+// store; the client only moves objects.
+type ObjectReplica struct {
+	db     *DB          // source database
+	name   string       // replica name, optional
+	client ObjectClient // store transport
+
+	mu          sync.RWMutex
+	snapshotMu  sync.Mutex
+	retentionMu sync.Mutex // serializes retention runs
+	pos         Pos        // last position
+	snapshotSeq int        // last snapshot request handled
+
+	wg     sync.WaitGroup
+	cancel func()
+
+	snapshotTotalGauge          prometheus.Gauge
+	walBytesCounter             prometheus.Counter
+	walIndexGauge               prometheus.Gauge
+	walOffsetGauge              prometheus.Gauge
+	putOperationTotalCounter    prometheus.Counter
+	putOperationBytesCounter    prometheus.Counter
+	getOperationTotalCounter    prometheus.Counter
+	getOperationBytesCounter    prometheus.Counter
+	listOperationTotalCounter   prometheus.Counter
+	deleteOperationTotalCounter prometheus.Counter
+
+	compressionStats *CompressionStats
+	limiter          *RateLimiter // upload limiter, nil if unlimited
+	limiterInit      bool         // true once limiter is created
+
+	// WAL replicated since the latest snapshot.
+	walThreshold WALThreshold
+
+	// Path within the store that the replica writes to.
+	Path string
+
+	// Minimum time between syncs with the shadow WAL. Changes to a shadow
+	// WAL file during the interval are uploaded as a single segment so
+	// longer intervals reduce the number of uploads. Pending changes are
+	// uploaded when replication stops.
+	SyncInterval time.Duration
+
+	// Time to keep snapshots and related WAL files.
+	// Database is snapshotted after interval and older WAL files are discarded.
+	Retention time.Duration
+
+	// Number of most recent snapshots, and their WAL files, to keep regardless
+	// of age. Snapshots kept by either Retention or this count are retained.
+	// Disabled if zero.
+	RetentionSnapshotN int
+
+	// Maximum number of generations to keep. After retention is enforced,
+	// the oldest generations beyond this count are deleted. The active &
+	// replicating generations are never deleted. Disabled if zero.
+	MaxGenerations int
+
+	// Time between retention checks.
+	RetentionCheckInterval time.Duration
+
+	// Time between validation checks.
+	ValidationInterval time.Duration
+
+	// Thresholds for warning that the latest snapshot is stale, checked after
+	// each retention check. Disabled if zero.
+	SnapshotWarnAge  time.Duration
+	SnapshotWarnWALN int
+
+	// Thresholds of WAL files & raw WAL bytes replicated since the latest
+	// snapshot after which a new snapshot is taken in the background. This
+	// limits the WAL applied by a restore. Disabled if zero.
+	SnapshotAfterWALN     int
+	SnapshotAfterWALBytes int64
+
+	// Time between WAL continuity checks. Disabled if zero.
+	ContinuityCheckInterval time.Duration
+
+	// Policy applied when the replica's position is inconsistent with the
+	// local database position when it is recalculated, such as on startup.
+	// See ConsistencyPolicyError for policies.
+	ConsistencyPolicy string
+
+	// Maximum number of goroutines used to compress a single snapshot or WAL
+	// segment. If zero or negative, one goroutine per CPU is used.
+	CompressionWorkers int
+
+	// Codec used to compress new snapshot & WAL objects. Existing objects are
+	// read with the codec registered for their extension. Defaults to lz4.
+	Codec *Codec
+
+	// If set, new snapshot & WAL objects are encrypted with age after they are
+	// compressed & encrypted objects are decrypted when read. Commit time
+	// indexes & other objects are not encrypted.
+	Encryption *Encryption
+
+	// Maximum size, in bytes, of each WAL segment object. Larger segments are
+	// split on frame boundaries so a failed upload only re-sends one chunk.
+	// Disabled if zero.
+	WALChunkSize int
+
+	// Number of segments of a WAL file after which the segments are merged
+	// into a single segment on each retention check. Reduces the objects
+	// listed & downloaded for databases with many small commits. The latest
+	// WAL file of each generation is not merged. Disabled if zero.
+	CompactMinSegments int
+
+	// Number of times a failed WAL chunk upload is retried & the backoff
+	// between retries. Only retryable errors, such as server errors &
+	// timeouts, are retried. See RetryPolicy.
+	WALChunkRetryN         int
+	WALChunkInitialBackoff time.Duration
+	WALChunkMaxBackoff     time.Duration
+
+	// Maximum number of WAL segments uploaded at once. The replica position
+	// only advances through segments uploaded before a failed segment.
+	SyncConcurrency int
+
+	// Maximum number of bytes per second uploaded by the replica. The limit
+	// is shared by all snapshot & WAL uploads of the replica. Unlimited if zero.
+	MaxUploadBytesPerSecond int
+
+	// Objects are deleted in batches of DeleteBatchSize & at most
+	// DeleteConcurrency batches are deleted concurrently when enforcing
+	// retention.
+	DeleteConcurrency int
+	DeleteBatchSize   int
+
+	// If true, replica monitors database for changes automatically.
+	// Set to false if replica is being used synchronously (such as in tests).
+	MonitorEnabled bool
+}
+
+// NewObjectReplica returns a new instance of ObjectReplica which stores
+// objects using client. Operations are counted by type in the total & bytes
+// counter vectors, which are labeled by database, replica name & type.
+func NewObjectReplica(db *DB, name string, client ObjectClient, operationTotalCounterVec, operationBytesCounterVec *prometheus.CounterVec) *ObjectReplica {
+	r := &ObjectReplica{
+		db:     db,
+		name:   name,
+		client: client,
+		cancel: func() {},
+
+		Retention:              DefaultRetention,
+		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		ConsistencyPolicy:      DefaultConsistencyPolicy,
+		CompressionWorkers:     DefaultCompressionWorkers,
+		Codec:                  LookupCodec(DefaultCompression),
+		DeleteConcurrency:      DefaultDeleteConcurrency,
+		WALChunkRetryN:         DefaultWALChunkRetryN,
+		WALChunkInitialBackoff: DefaultWALChunkInitialBackoff,
+		WALChunkMaxBackoff:     DefaultWALChunkMaxBackoff,
+		SyncConcurrency:        DefaultSyncConcurrency,
+
+		MonitorEnabled: true,
+	}
+
+	var dbPath string
+	if db != nil {
+		dbPath = db.Path()
+	}
+	r.snapshotTotalGauge = internal.ReplicaSnapshotTotalGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
+	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.putOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.putOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.getOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.getOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.listOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "LIST")
+	r.deleteOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "DELETE")
+	r.compressionStats = NewCompressionStats(db, r.Name())
+
+	return r
+}
+
+// Name returns the name of the replica. Returns the type if no name set.
+func (r *ObjectReplica) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.Type()
+}
+
+// Type returns the type of replica.
+func (r *ObjectReplica) Type() string {
+	return r.client.Type()
+}
+
+// URL returns the location of the replica.
+func (r *ObjectReplica) URL() string {
+	return r.client.URL()
+}
+
+// DB returns the parent database reference.
+func (r *ObjectReplica) DB() *DB {
+	return r.db
+}
+
+// lastSnapshotSeq returns the last snapshot request handled by the replica.
+func (r *ObjectReplica) lastSnapshotSeq() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotSeq
+}
+
+// LastPos returns the last successfully replicated position.
+func (r *ObjectReplica) LastPos() Pos {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pos
+}
+
+// CompressionStats returns the compression ratio stats for the replica.
+func (r *ObjectReplica) CompressionStats() *CompressionStats {
+	return r.compressionStats
+}
+
+// GenerationDir returns the path to a generation's root directory.
+func (r *ObjectReplica) GenerationDir(generation string) string {
+	return path.Join(r.Path, "generations", generation)
+}
+
+// SnapshotDir returns the path to a generation's snapshot directory.
+func (r *ObjectReplica) SnapshotDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "snapshots")
+}
+
+// SnapshotPath returns the path to a snapshot file written with the replica's codec.
+func (r *ObjectReplica) SnapshotPath(generation string, index int) string {
+	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, SnapshotExt, r.codec().Ext))
+}
+
+// codec returns the codec used to write new objects.
+func (r *ObjectReplica) codec() *Codec {
+	c := r.Codec
+	if c == nil {
+		c = LookupCodec(DefaultCompression)
+	}
+	if r.Encryption.CanEncrypt() {
+		return r.Encryption.Codec(c)
+	}
+	return c
+}
+
+// MaxSnapshotIndex returns the highest index for the snapshots.
+func (r *ObjectReplica) MaxSnapshotIndex(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	index := -1
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation {
+			continue
+		} else if index == -1 || snapshot.Index > index {
+			index = snapshot.Index
+		}
+	}
+	if index == -1 {
+		return 0, fmt.Errorf("no snapshots found")
+	}
+	return index, nil
+}
+
+// WALDir returns the path to a generation's WAL directory
+func (r *ObjectReplica) WALDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "wal")
+}
+
+// CommitTimesPath returns the path to the commit time index of a WAL file.
+func (r *ObjectReplica) CommitTimesPath(generation string, index int) string {
+	return path.Join(r.WALDir(generation), FormatCommitTimesPath(index))
+}
+
+// SnapshotChecksumPath returns the path to the checksum of a snapshot.
+func (r *ObjectReplica) SnapshotChecksumPath(generation string, index int) string {
+	return path.Join(r.SnapshotDir(generation), FormatSnapshotChecksumPath(index))
+}
+
+// listObjects calls fn for each object whose key begins with prefix.
+func (r *ObjectReplica) listObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	r.listOperationTotalCounter.Inc()
+	return r.client.ListObjects(ctx, prefix, fn)
+}
+
+// putObject uploads the contents of rd to key. Returns the bytes uploaded.
+func (r *ObjectReplica) putObject(ctx context.Context, key string, rd io.Reader, opts PutOptions) (int64, error) {
+	n, err := r.client.PutObject(ctx, key, rd, opts)
+	if err != nil {
+		return n, err
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n))
+	return n, nil
+}
+
+// getObject returns a reader for the object at key & its info.
+// Returns os.ErrNotExist if the object does not exist.
+func (r *ObjectReplica) getObject(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := r.client.GetObject(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	r.getOperationTotalCounter.Inc()
+	r.getOperationBytesCounter.Add(float64(info.Size))
+	return body, info, nil
+}
+
+// Generations returns a list of available generation names.
+func (r *ObjectReplica) Generations(ctx context.Context) ([]string, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	if err := r.listObjects(ctx, path.Join(r.Path, "generations")+"/", func(obj ObjectInfo) error {
+		if name := path.Base(obj.Key); obj.IsDir && IsGenerationName(name) {
+			generations = append(generations, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return generations, nil
+}
+
+// GenerationStats returns stats for a generation.
+func (r *ObjectReplica) GenerationStats(ctx context.Context, generation string) (stats GenerationStats, err error) {
+	if err := r.Init(ctx); err != nil {
+		return stats, err
+	}
+
+	// Determine stats for all snapshots.
+	n, min, max, err := r.fileStats(ctx, r.SnapshotDir(generation), IsSnapshotPath)
+	if err != nil {
+		return stats, err
+	}
+	stats.SnapshotN = n
+	stats.CreatedAt, stats.UpdatedAt = min, max
+
+	// Update stats if we have WAL files.
+	n, min, max, err = r.fileStats(ctx, r.WALDir(generation), IsWALPath)
+	if err != nil {
+		return stats, err
+	} else if n == 0 {
+		return stats, nil
+	}
+
+	stats.WALN = n
+	if stats.CreatedAt.IsZero() || min.Before(stats.CreatedAt) {
+		stats.CreatedAt = min
+	}
+	if stats.UpdatedAt.IsZero() || max.After(stats.UpdatedAt) {
+		stats.UpdatedAt = max
+	}
+	return stats, nil
+}
+
+// fileStats returns the number & time range of objects in dir whose names match.
+func (r *ObjectReplica) fileStats(ctx context.Context, dir string, match func(string) bool) (n int, min, max time.Time, err error) {
+	if err := r.listObjects(ctx, dir+"/", func(obj ObjectInfo) error {
+		if obj.IsDir || !match(path.Base(obj.Key)) {
+			return nil
+		}
+
+		n++
+		if min.IsZero() || obj.ModTime.Before(min) {
+			min = obj.ModTime
+		}
+		if max.IsZero() || obj.ModTime.After(max) {
+			max = obj.ModTime
+		}
+		return nil
+	}); err != nil {
+		return n, min, max, err
+	}
+	return n, min, max, nil
+}
+
+// Snapshots returns a list of available snapshots in the replica.
+func (r *ObjectReplica) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*SnapshotInfo
+	for _, generation := range generations {
+		if err := r.listObjects(ctx, r.SnapshotDir(generation)+"/", func(obj ObjectInfo) error {
+			key := path.Base(obj.Key)
+			index, _, err := ParseSnapshotPath(key)
+			if obj.IsDir || err != nil {
+				return nil
+			}
+
+			infos = append(infos, &SnapshotInfo{
+				Name:       key,
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Size:       obj.Size,
+				CreatedAt:  obj.ModTime,
+			})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// WALs returns a list of available WAL files in the replica.
+func (r *ObjectReplica) WALs(ctx context.Context) ([]*WALInfo, error) {
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*WALInfo
+	for _, generation := range generations {
+		var prev *WALInfo
+		if err := r.listObjects(ctx, r.WALDir(generation)+"/", func(obj ObjectInfo) error {
+			key := path.Base(obj.Key)
+			index, offset, _, err := ParseWALPath(key)
+			if obj.IsDir || err != nil {
+				return nil
+			}
+
+			// Update previous record if generation & index match.
+			if prev != nil && prev.Index == index {
+				prev.Size += obj.Size
+				prev.CreatedAt = obj.ModTime
+				return nil
+			}
+
+			// Append new WAL record and keep reference to append additional
+			// size for segmented WAL files.
+			prev = &WALInfo{
+				Name:       key,
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Offset:     offset,
+				Size:       obj.Size,
+				CreatedAt:  obj.ModTime,
+			}
+			infos = append(infos, prev)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// Start starts replication for a given generation.
+func (r *ObjectReplica) Start(ctx context.Context) {
+	// Ignore if replica is being used sychronously.
+	if !r.MonitorEnabled {
+		return
+	}
+
+	// Stop previous replication.
+	r.Stop()
+
+	// Wrap context with cancelation.
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	// Start goroutines to manage replica data.
+	r.wg.Add(4)
+	go func() { defer r.wg.Done(); r.monitor(ctx) }()
+	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.validator(ctx) }()
+	go func() { defer r.wg.Done(); r.continuityChecker(ctx) }()
+}
+
+// Stop cancels any outstanding replication and blocks until finished.
+func (r *ObjectReplica) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// monitor runs in a separate goroutine and continuously replicates the DB.
+func (r *ObjectReplica) monitor(ctx context.Context) {
+	// Upload pending changes once replication stops.
+	defer r.flush()
+
+	ticker := time.NewTicker(r.SyncInterval)
+	defer ticker.Stop()
+
+	// Continuously check for new data to replicate.
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+	priority := r.db.PriorityNotify()
+
+	var resume <-chan time.Time
+	for initial := true; ; initial = false {
+		// Enforce a minimum time between synchronization unless a change
+		// to a priority table needs to be uploaded immediately.
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-priority:
+			}
+		}
+
+		// Wait for changes to the database.
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		case <-resume:
+		}
+
+		// Fetch new notify channels before replicating data.
+		notify, priority = r.db.Notify(), r.db.PriorityNotify()
+		resume = nil
+
+		// Catch up once the maintenance window ends even if nothing changes.
+		if d := r.db.MaintenanceRemaining(); d > 0 {
+			resume = time.After(d)
+		}
+
+		// Synchronize the shadow wal into the replication directory.
+		if err := r.Sync(ctx); err != nil {
+			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
+			continue
+		}
+	}
+}
+
+// flush uploads changes which have not been replicated yet, such as changes
+// batched by SyncInterval, after the monitor stops.
+func (r *ObjectReplica) flush() {
+	if pos, err := r.db.Pos(); err != nil || pos.IsZero() || pos == r.LastPos() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownSyncTimeout)
+	defer cancel()
+	if err := r.Sync(ctx); err != nil {
+		log.Printf("%s(%s): shutdown sync error: %s", r.db.Path(), r.Name(), err)
+	}
+}
+
+// retainer runs in a separate goroutine and handles retention.
+func (r *ObjectReplica) retainer(ctx context.Context) {
+	// Exit if retention is only run on demand.
+	if r.RetentionCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.RetentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.EnforceRetention(ctx); err != nil {
+				log.Printf("%s(%s): retain error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+
+			if _, err := r.CompactWAL(ctx); err != nil {
+				log.Printf("%s(%s): compaction error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+
+			if err := CheckSnapshotStaleness(ctx, r, r.SnapshotWarnAge, r.SnapshotWarnWALN); err != nil {
+				log.Printf("%s(%s): snapshot check error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// validator runs in a separate goroutine and handles periodic validation.
+func (r *ObjectReplica) validator(ctx context.Context) {
+	// Initialize counters since validation occurs infrequently.
+	for _, status := range []string{"ok", "error"} {
+		internal.ReplicaValidationTotalCounterVec.WithLabelValues(r.db.Path(), r.Name(), status).Add(0)
+	}
+
+	if r.ValidationInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ValidationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ValidateReplica(ctx, r); err != nil {
+				log.Printf("%s(%s): validation error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// continuityChecker runs in a separate goroutine and periodically verifies
+// that the current generation has no missing WAL indices.
+func (r *ObjectReplica) continuityChecker(ctx context.Context) {
+	if r.ContinuityCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ContinuityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := CheckWALContinuity(ctx, r); err != nil {
+				log.Printf("%s(%s): continuity check error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// CalcPos returns the position for the replica for the current generation.
+// Returns a zero value if there is no active generation.
+func (r *ObjectReplica) CalcPos(ctx context.Context, generation string) (pos Pos, err error) {
+	if err := r.Init(ctx); err != nil {
+		return pos, err
+	}
+
+	pos.Generation = generation
+
+	// Find maximum snapshot index.
+	if pos.Index, err = r.MaxSnapshotIndex(generation); err != nil {
+		return Pos{}, err
+	}
+
+	index := -1
+	var offset int64
+	if err := r.listObjects(ctx, r.WALDir(generation)+"/", func(obj ObjectInfo) error {
+		idx, off, _, err := ParseWALPath(path.Base(obj.Key))
+		if obj.IsDir || err != nil {
+			return nil // invalid wal filename
+		}
+
+		if index == -1 || idx > index {
+			index, offset = idx, 0 // start tracking new wal
+		} else if idx == index && off > offset {
+			offset = off // update offset
+		}
+		return nil
+	}); err != nil {
+		return Pos{}, err
+	}
+	if index == -1 {
+		return pos, nil // no wal files
+	}
+	pos.Index = index
+	pos.Offset = offset
+
+	return pos, nil
+}
+
+// snapshot copies the entire database to the replica path.
+func (r *ObjectReplica) snapshot(ctx context.Context, generation string, index int) error {
+	// Acquire a read lock on the database during snapshot to prevent checkpoints.
+	tx, err := r.db.SQLDB().Begin()
+	if err != nil {
+		return err
+	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Open database file handle.
+	f, err := os.Open(r.db.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Snapshot only changed pages if incremental snapshots are enabled.
+	src, err := r.db.NewSnapshotSource(f, r.Name(), generation, index)
+	if err != nil {
+		return err
+	}
+
+	release, err := r.db.AcquireUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	snapshotPath := r.SnapshotPath(generation, index)
+	startTime := time.Now()
+
+	n, err := r.writeSnapshot(ctx, generation, index, src, PutOptions{SourceSize: src.Size})
+	if err != nil {
+		return err
+	}
+	r.compressionStats.Add(src.Size, n)
+
+	src.Commit()
+	r.db.MarkReplicaSnapshotted(r.Name(), time.Now())
+	r.db.ReportSnapshot(SnapshotInfo{
+		Name:       path.Base(snapshotPath),
+		Replica:    r.Name(),
+		Generation: generation,
+		Index:      index,
+		Size:       n,
+		CreatedAt:  time.Now().UTC(),
+	})
+	r.walThreshold.Reset(generation, index)
+
+	if src.IsLayer() {
+		log.Printf("%s(%s): snapshot: creating %s/%08x base=%08x pages=%d t=%s", r.db.Path(), r.Name(), generation, index, src.BaseIndex, src.PageN, time.Since(startTime))
+	} else {
+		log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+	}
+
+	return nil
+}
+
+// writeSnapshot compresses & uploads the snapshot of generation at index from
+// rd followed by the checksum of its uncompressed contents. Returns the size
+// of the uploaded snapshot.
+func (r *ObjectReplica) writeSnapshot(ctx context.Context, generation string, index int, rd io.Reader, opts PutOptions) (int64, error) {
+	// Close the reader on return so the compressor does not block on a
+	// failed or cancelled upload, such as one waiting on the upload limiter.
+	cw := NewChecksumWriter()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		zw, err := NewObjectWriter(pw, r.codec(), r.CompressionWorkers)
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(zw, io.TeeReader(rd, cw)); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(zw.Close())
+	}()
+
+	opts.Type, opts.Limiter = ObjectTypeSnapshot, r.limiter
+	n, err := r.putObject(ctx, r.SnapshotPath(generation, index), pr, opts)
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := r.putObject(ctx, r.SnapshotChecksumPath(generation, index), strings.NewReader(cw.Checksum()+"\n"), PutOptions{Type: ObjectTypeSnapshot}); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// snapshotN returns the number of snapshots for a generation.
+func (r *ObjectReplica) snapshotN(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, snapshot := range snapshots {
+		if snapshot.Generation == generation {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Init connects the client to the store. No-op if already connected.
+func (r *ObjectReplica) Init(ctx context.Context) error {
+	if err := r.client.Init(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.limiterInit {
+		r.limiter, r.limiterInit = NewRateLimiter(r.MaxUploadBytesPerSecond), true
+	}
+	return nil
+}
+
+// Sync replays data from the shadow WAL and uploads it to the store.
+func (r *ObjectReplica) Sync(ctx context.Context) (err error) {
+	// Changes to the shadow WAL before this time are uploaded by a successful sync.
+	startTime := time.Now()
+	defer func() { r.db.MarkReplicaSyncResult(r.Name(), err) }()
+
+	// Clear last position if if an error occurs during sync. The position is
+	// kept after a failed WAL upload as it only includes uploaded segments.
+	defer func() {
+		var uploadErr *WALUploadError
+		if err != nil && !errors.As(err, &uploadErr) {
+			r.mu.Lock()
+			r.pos = Pos{}
+			r.mu.Unlock()
+		}
+	}()
+
+	// Connect to the store, if necessary.
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Find current position of database.
+	dpos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if dpos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	generation := dpos.Generation
+
+	// Skip uploading during a maintenance window. The shadow WAL is retained
+	// until the replica catches up after the window ends. Uploads are also
+	// skipped while replication is paused.
+	if r.db.MaintenanceRemaining() > 0 || r.db.Paused() {
+		return nil
+	}
+
+	// Calculate position if we don't have a previous position or if the generation changes.
+	// Ensure sync & retainer do not snapshot at the same time.
+	if lastPos := r.LastPos(); lastPos.IsZero() || lastPos.Generation != generation {
+		if err := func() error {
+			r.snapshotMu.Lock()
+			defer r.snapshotMu.Unlock()
+
+			// Create snapshot if no snapshots exist for generation.
+			if n, err := r.snapshotN(generation); err != nil {
+				return err
+			} else if n == 0 {
+				if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+					return err
+				}
+				r.snapshotTotalGauge.Set(1.0)
+				r.db.ReportGeneration(r.Name(), generation)
+			} else {
+				r.snapshotTotalGauge.Set(float64(n))
+			}
+
+			// Determine position, if necessary.
+			pos, err := r.CalcPos(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("cannot determine replica position: %s", err)
+			}
+
+			// Ensure the replica can resume from its position.
+			if pos, err = ReconcileReplicaPos(ctx, r, r.ConsistencyPolicy, dpos, pos, r.snapshot); err != nil {
+				return err
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.pos = pos
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Create snapshot if the database has requested a new snapshot since
+	// the last sync, such as after a schema change.
+	if seq, reason := r.db.SnapshotRequest(); seq > r.lastSnapshotSeq() {
+		if err := func() error {
+			r.snapshotMu.Lock()
+			defer r.snapshotMu.Unlock()
+
+			if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+				return err
+			}
+			log.Printf("%s(%s): snapshot: reason=%s", r.db.Path(), r.Name(), reason)
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.snapshotSeq = seq
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Read all WAL files since the last position.
+	for {
+		if err = r.syncWAL(ctx); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.db.MarkReplicaSynced(r.Name(), startTime)
+
+	r.snapshotAfterWAL(ctx)
+
+	return nil
+}
+
+// snapshotAfterWAL starts a snapshot in the background if the WAL replicated
+// since the latest snapshot exceeds SnapshotAfterWALN or SnapshotAfterWALBytes.
+// WAL uploads continue while the snapshot is uploaded.
+func (r *ObjectReplica) snapshotAfterWAL(ctx context.Context) {
+	pos := r.LastPos()
+	if !r.walThreshold.Begin(pos, r.SnapshotAfterWALN, r.SnapshotAfterWALBytes) {
+		return
+	}
+	n, size := r.walThreshold.Stats(pos)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.walThreshold.End()
+
+		// Ensure sync & retainer do not snapshot at the same time.
+		r.snapshotMu.Lock()
+		defer r.snapshotMu.Unlock()
+
+		if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+			log.Printf("%s(%s): snapshot error: reason=%s: %s", r.db.Path(), r.Name(), SnapshotReasonWALThreshold, err)
+			return
+		}
+		r.walThreshold.Reset(pos.Generation, pos.Index)
+		log.Printf("%s(%s): snapshot: reason=%s files=%d bytes=%d", r.db.Path(), r.Name(), SnapshotReasonWALThreshold, n, size)
+	}()
+}
+
+func (r *ObjectReplica) syncWAL(ctx context.Context) (err error) {
+	// Read pending data from up to one shadow WAL file per concurrent upload.
+	// Each file is split into frame-aligned chunks so a failed upload only
+	// re-sends the failed chunk. Each chunk is stored as a segment at its
+	// own offset.
+	lastPos := r.LastPos()
+	generation := lastPos.Generation
+	chunks, err := r.db.PendingWALChunks(lastPos, r.SyncConcurrency, r.WALChunkSize)
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+
+	release, err := r.db.AcquireUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	n, uploadErr := UploadWALChunks(ctx, chunks, r.walChunkRetryPolicy(), r.SyncConcurrency, func(ctx context.Context, chunk WALChunk) error {
+		return r.uploadWALChunk(ctx, generation, chunk.Index, chunk, time.Time{})
+	})
+
+	// Upload commit times & save the position of each WAL file in order, only
+	// through the segments uploaded before any failed segment.
+	for _, pos := range WALChunkEnds(generation, chunks[:n]) {
+		if err := r.syncCommitTimes(ctx, pos); err != nil {
+			return &WALUploadError{Err: fmt.Errorf("cannot sync commit times: %w", err)}
+		}
+
+		r.mu.Lock()
+		r.pos = pos
+		r.mu.Unlock()
+
+		// Track current position.
+		r.walIndexGauge.Set(float64(pos.Index))
+		r.walOffsetGauge.Set(float64(pos.Offset))
+	}
+
+	// Track raw bytes processed.
+	for _, chunk := range chunks[:n] {
+		r.walBytesCounter.Add(float64(len(chunk.Data))) // raw bytes
+		r.walThreshold.Add(int64(len(chunk.Data)))
+	}
+
+	if uploadErr != nil {
+		return &WALUploadError{Err: uploadErr}
+	}
+	return nil
+}
+
+// walChunkRetryPolicy returns the policy for retrying failed WAL chunk uploads.
+func (r *ObjectReplica) walChunkRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     r.WALChunkRetryN,
+		InitialBackoff: r.WALChunkInitialBackoff,
+		MaxBackoff:     r.WALChunkMaxBackoff,
+		OnRetry: func(err error, attempt int, delay time.Duration) {
+			log.Printf("%s(%s): WARNING: wal upload failed, retrying in %s: attempt=%d/%d err=%s", r.db.Path(), r.Name(), delay.Round(time.Millisecond), attempt, r.WALChunkRetryN, err)
+		},
+	}
+}
+
+// uploadWALChunk compresses & uploads a single WAL chunk as a segment. The
+// checksum of the raw chunk is stored in the object metadata so it can be
+// validated when the segments are reassembled.
+func (r *ObjectReplica) uploadWALChunk(ctx context.Context, generation string, index int, chunk WALChunk, modTime time.Time) error {
+	var buf bytes.Buffer
+	zw, err := NewObjectWriter(&buf, r.codec(), r.CompressionWorkers)
+	if err != nil {
+		return err
+	} else if _, err := zw.Write(chunk.Data); err != nil {
+		return err
+	} else if err := zw.Close(); err != nil {
+		return err
+	}
+
+	r.compressionStats.Add(int64(len(chunk.Data)), int64(buf.Len()))
+
+	// Build a WAL path with the index/offset as well as size so we can ensure
+	// that files are contiguous without having to decompress.
+	walPath := path.Join(
+		r.WALDir(generation),
+		FormatWALPathWithOffset(index, chunk.Offset)+r.codec().Ext,
+	)
+
+	_, err = r.putObject(ctx, walPath, bytes.NewReader(buf.Bytes()), PutOptions{
+		Type:     ObjectTypeWAL,
+		Metadata: map[string]string{ChecksumMetadataKey: chunk.Checksum()},
+		ModTime:  modTime,
+		Limiter:  r.limiter,
+	})
+	return err
+}
+
+// syncCommitTimes uploads the commit times recorded for the WAL at pos through
+// its offset, if the database records commit times. Each upload replaces the
+// previous commit time index of the WAL file.
+func (r *ObjectReplica) syncCommitTimes(ctx context.Context, pos Pos) error {
+	a, err := r.db.ShadowCommitTimes(pos.Generation, pos.Index, pos.Offset)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return r.uploadCommitTimes(ctx, pos.Generation, pos.Index, a)
+}
+
+// uploadCommitTimes uploads the commit time index of the WAL at index.
+func (r *ObjectReplica) uploadCommitTimes(ctx context.Context, generation string, index int, a []CommitTime) error {
+	_, err := r.putObject(ctx, r.CommitTimesPath(generation, index), bytes.NewReader(EncodeCommitTimes(a)), PutOptions{Type: ObjectTypeWAL})
+	return err
+}
+
+// CommitTimes returns the commit time index of a WAL file.
+// Returns os.ErrNotExist if the WAL file has no commit time index.
+func (r *ObjectReplica) CommitTimes(ctx context.Context, generation string, index int) ([]CommitTime, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	body, _, err := r.getObject(ctx, r.CommitTimesPath(generation, index))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ReadCommitTimes(body)
+}
+
+// snapshotChecksum returns the checksum uploaded with a snapshot.
+// Returns os.ErrNotExist if the snapshot has no checksum.
+func (r *ObjectReplica) snapshotChecksum(ctx context.Context, generation string, index int) (string, error) {
+	body, _, err := r.getObject(ctx, r.SnapshotChecksumPath(generation, index))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// SnapshotReader returns a reader for snapshot data at the given generation/index.
+func (r *ObjectReplica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Find the snapshot object as it may have been written with any codec.
+	key, codec, err := r.snapshotKey(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, err := r.getObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress the snapshot file. Closing the reader closes the codec
+	// reader & then the object body.
+	zr, err := NewObjectReader(body, codec, r.CompressionWorkers)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("snapshot %s/%08x: %w", generation, index, err)
+	}
+	rc := internal.NewReadCloser(zr, body)
+
+	// Verify the uncompressed contents if a checksum was uploaded with the
+	// snapshot. Snapshots written by older versions have no checksum.
+	checksum, err := r.snapshotChecksum(ctx, generation, index)
+	if os.IsNotExist(err) {
+		return rc, nil
+	} else if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return internal.NewReadCloser(NewChecksumReader(zr, checksum, fmt.Sprintf("snapshot %s/%08x", generation, index)), rc), nil
+}
+
+// snapshotKey returns the key & codec of the snapshot at the given index.
+// Returns os.ErrNotExist if no snapshot is found.
+func (r *ObjectReplica) snapshotKey(ctx context.Context, generation string, index int) (key string, codec *Codec, err error) {
+	if err := r.listObjects(ctx, path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s", index, SnapshotExt)), func(obj ObjectInfo) error {
+		if key != "" || obj.IsDir {
+			return nil
+		}
+		idx, ext, err := ParseSnapshotPath(path.Base(obj.Key))
+		if err != nil || idx != index {
+			return nil
+		}
+		key, codec = obj.Key, ObjectCodec(strings.TrimPrefix(ext, SnapshotExt), r.Encryption)
+		return nil
+	}); err != nil {
+		return "", nil, err
+	} else if key == "" {
+		return "", nil, os.ErrNotExist
+	}
+	return key, codec, nil
+}
+
+// WALReader returns a reader for WAL data at the given index.
+// Returns os.ErrNotExist if no matching index is found.
+func (r *ObjectReplica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Collect all segments for the index. Stores which list object metadata
+	// return segment checksums without reading each object's metadata.
+	var objs []ObjectInfo
+	if err := r.listObjects(ctx, path.Join(r.WALDir(generation), fmt.Sprintf("%08x_", index)), func(obj ObjectInfo) error {
+		if _, _, _, err := ParseWALPath(path.Base(obj.Key)); !obj.IsDir && err == nil {
+			objs = append(objs, obj)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	} else if len(objs) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Download each segment and concatenate into a buffer.
+	var buf bytes.Buffer
+	var offset int64
+	for _, obj := range objs {
+		// Ensure offset is correct as we copy segments into buffer. Segments
+		// already merged by compaction are skipped until they are deleted.
+		name := path.Base(obj.Key)
+		_, off, ext, _ := ParseWALPath(name)
+		if off < offset {
+			continue
+		} else if off != offset {
+			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at remote offset %d, expected offset %d", generation, index, off, offset)
+		}
+
+		if err := func() error {
+			body, info, err := r.getObject(ctx, obj.Key)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+
+			codec := ObjectCodec(strings.TrimPrefix(ext, WALExt), r.Encryption)
+			zr, err := NewObjectReader(body, codec, r.CompressionWorkers)
+			if err != nil {
+				return fmt.Errorf("wal segment %s: %w", name, err)
+			}
+			defer closeReader(zr)
+
+			start := buf.Len()
+			n, err := io.Copy(&buf, zr)
+			if err != nil {
+				return err
+			}
+			offset += n
+
+			// Validate segment checksum, if one was stored on upload.
+			chksum := obj.Metadata[ChecksumMetadataKey]
+			if chksum == "" {
+				chksum = info.Metadata[ChecksumMetadataKey]
+			}
+			if chksum != "" && ChecksumWALChunk(buf.Bytes()[start:]) != chksum {
+				return fmt.Errorf("wal segment %s: %w", name, ErrChecksumMismatch)
+			}
+			return nil
+		}(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ioutil.NopCloser(&buf), nil
+}
+
+// WriteObject uploads the contents of rd to key, relative to the replica path.
+// Objects are stored with the settings of snapshots, such as storage classes.
+func (r *ObjectReplica) WriteObject(ctx context.Context, key string, rd io.Reader) error {
+	if err := ValidateObjectKey(key); err != nil {
+		return err
+	} else if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	_, err := r.putObject(ctx, path.Join(r.Path, key), rd, PutOptions{Type: ObjectTypeSnapshot})
+	return err
+}
+
+// WriteSnapshot compresses & uploads the snapshot of generation at index from
+// rd along with its checksum. The modification time of the snapshot is set to
+// createdAt if the store allows it.
+func (r *ObjectReplica) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	_, err := r.writeSnapshot(ctx, generation, index, rd, PutOptions{ModTime: createdAt})
+	return err
+}
+
+// WriteWAL uploads the WAL file of generation at index from rd as a single
+// segment. The modification time of the segment is set to createdAt if the
+// store allows it.
+func (r *ObjectReplica) WriteWAL(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	return r.uploadWALChunk(ctx, generation, index, WALChunk{Index: index, Data: data}, createdAt)
+}
+
+// WriteCommitTimes uploads the commit time index of the WAL file of
+// generation at index.
+func (r *ObjectReplica) WriteCommitTimes(ctx context.Context, generation string, index int, a []CommitTime) error {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+	return r.uploadCommitTimes(ctx, generation, index, a)
+}
+
+// EnforceRetention forces a new snapshot once the retention interval has passed.
+// Older snapshots and WAL files are then removed.
+func (r *ObjectReplica) EnforceRetention(ctx context.Context) (err error) {
+	_, err = r.RunRetention(ctx)
+	return err
+}
+
+// RunRetention enforces retention & returns a summary of the deleted files.
+// It is safe to call while the replica is syncing. The generation of the
+// database & the generation being replicated are never deleted. A new
+// snapshot is only created if the database has been opened.
+func (r *ObjectReplica) RunRetention(ctx context.Context) (result RetentionResult, err error) {
+	if err := r.Init(ctx); err != nil {
+		return result, err
+	}
+
+	r.retentionMu.Lock()
+	defer r.retentionMu.Unlock()
+
+	// Ensure sync & retainer do not snapshot at the same time.
+	var pos Pos
+	var snapshots []*SnapshotInfo
+	if err := func() (err error) {
+		r.snapshotMu.Lock()
+		defer r.snapshotMu.Unlock()
+
+		// Find current position of database.
+		pos, err = r.db.Pos()
+		if err != nil {
+			return fmt.Errorf("cannot determine current generation: %w", err)
+		} else if pos.IsZero() {
+			return fmt.Errorf("no generation, waiting for data")
+		}
+
+		// Obtain list of snapshots that are within the retention period.
+		all, err := r.Snapshots(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot obtain snapshot list: %w", err)
+		}
+		snapshots = RetainedSnapshots(all, time.Now(), r.Retention, r.RetentionSnapshotN)
+
+		// If no retained snapshots exist, create a new snapshot.
+		if len(snapshots) == 0 && r.db.SQLDB() != nil {
+			if r.db.DeferRetention(r.Name()) {
+				result.Deferred = true
+				return nil
+			}
+			if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+				return fmt.Errorf("cannot snapshot: %w", err)
+			}
+			snapshots = append(snapshots, &SnapshotInfo{Generation: pos.Generation, Index: pos.Index})
+			result.Snapshotted = true
+		}
+
+		// Keep the snapshots which retained incremental snapshots build on.
+		if snapshots, err = RetainSnapshotBases(ctx, r, all, snapshots); err != nil {
+			return fmt.Errorf("cannot find snapshot bases: %w", err)
+		}
+
+		return nil
+	}(); err != nil {
+		return result, err
+	} else if result.Deferred {
+		return result, nil
+	}
+
+	// Loop over generations and delete unretained snapshots & WAL files.
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return result, fmt.Errorf("cannot obtain generations: %w", err)
+	}
+	for _, generation := range generations {
+		// Skip generations which are being restored.
+		if IsGenerationRestoring(r, generation) {
+			log.Printf("%s(%s): retainer: skipping generation %q, restore in progress", r.db.Path(), r.Name(), generation)
+			continue
+		}
+
+		// Find earliest retained snapshot for this generation.
+		snapshot := FindMinSnapshotByGeneration(snapshots, generation)
+
+		// Never delete the active or replicating generation, even if its
+		// snapshots are not retained.
+		if snapshot == nil && (generation == pos.Generation || generation == r.LastPos().Generation) {
+			continue
+		}
+
+		// Delete generations if it has no snapshots being retained.
+		if snapshot == nil {
+			if err := r.deleteGenerationBefore(ctx, generation, -1, &result); err != nil {
+				return result, fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
+			}
+			result.Generations = append(result.Generations, generation)
+			continue
+		}
+
+		// Otherwise delete all snapshots & WAL files before a lowest retained index.
+		if err := r.deleteGenerationBefore(ctx, generation, snapshot.Index, &result); err != nil {
+			return result, fmt.Errorf("cannot delete generation %q files before index %d: %w", generation, snapshot.Index, err)
+		}
+	}
+
+	// Delete the oldest generations beyond the maximum generation count.
+	if err := r.pruneGenerations(ctx, pos, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// pruneGenerations deletes the oldest generations beyond MaxGenerations. The
+// generation of the database at pos & the replicating generation are kept.
+func (r *ObjectReplica) pruneGenerations(ctx context.Context, pos Pos, result *RetentionResult) error {
+	excess, err := ExcessGenerations(ctx, r, r.MaxGenerations, pos.Generation, r.LastPos().Generation)
+	if err != nil {
+		return fmt.Errorf("cannot find excess generations: %w", err)
+	}
+
+	for _, g := range excess {
+		size := result.Size
+		if err := r.deleteGenerationBefore(ctx, g.Generation, -1, result); err != nil {
+			return fmt.Errorf("cannot delete generation %q: %w", g.Generation, err)
+		}
+		result.Generations = append(result.Generations, g.Generation)
+		log.Printf("%s(%s): retainer: pruned generation %q beyond max generations; age=%s size=%d", r.db.Path(), r.Name(), g.Generation, g.Age(time.Now()).Round(time.Second), result.Size-size)
+	}
+	return nil
+}
+
+// CompactWAL merges the segments of each WAL file with at least
+// CompactMinSegments segments into a single segment. Returns the number of
+// segments replaced. No-op if CompactMinSegments is zero.
+func (r *ObjectReplica) CompactWAL(ctx context.Context) (n int, err error) {
+	if r.CompactMinSegments <= 0 {
+		return 0, nil
+	} else if err := r.Init(ctx); err != nil {
+		return 0, err
+	}
+
+	// Ensure retention does not delete WAL files while they are merged.
+	r.retentionMu.Lock()
+	defer r.retentionMu.Unlock()
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot obtain generations: %w", err)
+	}
+	for _, generation := range generations {
+		if IsGenerationRestoring(r, generation) {
+			continue
+		}
+
+		var keys []string
+		objs := make(map[string]ObjectInfo)
+		if err := r.listObjects(ctx, r.WALDir(generation)+"/", func(obj ObjectInfo) error {
+			if !obj.IsDir {
+				keys = append(keys, obj.Key)
+				objs[obj.Key] = obj
+			}
+			return nil
+		}); err != nil {
+			return n, err
+		}
+
+		for index, segments := range CompactableWAL(keys, r.CompactMinSegments) {
+			a := make([]ObjectInfo, len(segments))
+			for i, key := range segments {
+				a[i] = objs[key]
+			}
+			if err := r.compactWALFile(ctx, generation, index, a); err != nil {
+				return n, fmt.Errorf("cannot compact wal %s/%08x: %w", generation, index, err)
+			}
+			n += len(segments)
+		}
+	}
+	return n, nil
+}
+
+// compactWALFile uploads the contents of a WAL file as a single segment &
+// deletes its previous segments.
+func (r *ObjectReplica) compactWALFile(ctx context.Context, generation string, index int, segments []ObjectInfo) error {
+	rd, err := r.WALReader(ctx, generation, index)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	} else if err := rd.Close(); err != nil {
+		return err
+	}
+
+	if err := r.uploadWALChunk(ctx, generation, index, WALChunk{Index: index, Data: data}, time.Time{}); err != nil {
+		return err
+	}
+
+	// Delete all other segments, including the first segment if it was
+	// written with a different codec. If the codec is unchanged, the first
+	// segment was replaced so only its previous version, if the store keeps
+	// versions, is deleted.
+	merged := path.Join(r.WALDir(generation), FormatWALPathWithOffset(index, 0)+r.codec().Ext)
+	var objs []ObjectInfo
+	for _, obj := range segments {
+		if obj.Key != merged || obj.Version != "" {
+			objs = append(objs, obj)
+		}
+	}
+	if err := r.deleteObjects(ctx, objs); err != nil {
+		return err
+	}
+
+	log.Printf("%s(%s): retainer: compacted wal %s/%08x segments=%d size=%d", r.db.Path(), r.Name(), generation, index, len(segments), len(data))
+	return nil
+}
+
+// deleteObjects deletes objs in batches of DeleteBatchSize using at most
+// DeleteConcurrency concurrent workers.
+func (r *ObjectReplica) deleteObjects(ctx context.Context, objs []ObjectInfo) error {
+	return internal.ParallelBatches(ctx, r.DeleteConcurrency, len(objs), r.DeleteBatchSize, func(ctx context.Context, i, j int) error {
+		if err := r.client.DeleteObjects(ctx, objs[i:j]); err != nil {
+			return err
+		}
+		r.deleteOperationTotalCounter.Add(float64(j - i))
+		return nil
+	})
+}
+
+// deleteGenerationBefore deletes the snapshot & WAL files of a generation
+// before index, or all files if index is -1. Every version of each file is
+// deleted in stores which keep versions.
+func (r *ObjectReplica) deleteGenerationBefore(ctx context.Context, generation string, index int, result *RetentionResult) (err error) {
+	var objs []ObjectInfo
+	var snapshotN, walN int
+	var size int64
+	fn := func(obj ObjectInfo) error {
+		key := path.Base(obj.Key)
+		snapshotIdx, _, snapshotErr := ParseSnapshotPath(key)
+		walIdx, _, _, walErr := ParseWALPath(key)
+
+		// Skip snapshots or WALs that are after the search index unless -1.
+		if index != -1 {
+			if snapshotErr == nil && snapshotIdx >= index {
+				return nil
+			} else if walErr == nil && walIdx >= index {
+				return nil
+			} else if idx, err := ParseCommitTimesPath(key); err == nil && idx >= index {
+				return nil
+			} else if idx, err := ParseSnapshotChecksumPath(key); err == nil && idx >= index {
+				return nil
+			}
+		}
+
+		objs = append(objs, obj)
+		size += obj.Size
+		if snapshotErr == nil {
+			snapshotN++
+		} else if walErr == nil {
+			walN++
+		}
+		return nil
+	}
+
+	// Collect all objects for the generation.
+	if vl, ok := r.client.(ObjectVersionLister); ok {
+		r.listOperationTotalCounter.Inc()
+		err = vl.ListObjectVersions(ctx, r.GenerationDir(generation)+"/", fn)
+	} else {
+		err = r.walkObjects(ctx, r.GenerationDir(generation)+"/", fn)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Objects already deleted, such as by a previous failed run, are ignored.
+	if err := r.deleteObjects(ctx, objs); err != nil {
+		return err
+	}
+
+	// Remove directories which no longer have any files.
+	if dr, ok := r.client.(ObjectDirRemover); ok {
+		for _, dir := range []string{r.SnapshotDir(generation), r.WALDir(generation), r.GenerationDir(generation)} {
+			if err := dr.RemoveDir(ctx, dir); err != nil {
+				return fmt.Errorf("cannot remove empty directory: %w", err)
+			}
+		}
+	}
+
+	log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, len(objs))
+	result.SnapshotN += snapshotN
+	result.WALN += walN
+	result.Size += size
+
+	return nil
+}
+
+// walkObjects calls fn for each object whose key begins with prefix,
+// including objects in subdirectories.
+func (r *ObjectReplica) walkObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	var dirs []string
+	if err := r.listObjects(ctx, prefix, func(obj ObjectInfo) error {
+		if obj.IsDir {
+			dirs = append(dirs, obj.Key)
+			return nil
+		}
+		return fn(obj)
+	}); err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := r.walkObjects(ctx, strings.TrimSuffix(dir, "/")+"/", fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
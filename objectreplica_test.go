@@ -0,0 +1,282 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestObjectReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r, _ := NewTestObjectReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ensure the WAL index is recalculated from the stored objects.
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := r.LastPos(), pos; got != want {
+		t.Fatalf("LastPos()=%v, want %v", got, want)
+	} else if calcPos, err := r.CalcPos(context.Background(), pos.Generation); err != nil {
+		t.Fatal(err)
+	} else if got, want := calcPos.Index, pos.Index; got != want {
+		t.Fatalf("CalcPos().Index=%v, want %v", got, want)
+	}
+
+	if generations, err := r.Generations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := generations, []string{pos.Generation}; !equalStrings(got, want) {
+		t.Fatalf("Generations()=%v, want %v", got, want)
+	}
+
+	if got, want := MustRestoreRowCount(t, r, pos.Generation), 10; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	}
+}
+
+func TestObjectReplica_WALReader(t *testing.T) {
+	// Ensure segments are validated against the checksum stored on upload.
+	t.Run("ErrChecksumMismatch", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r, client := NewTestObjectReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		pos := r.LastPos()
+
+		// Store a different checksum for each segment of the WAL file.
+		client.mu.Lock()
+		for key, obj := range client.objects {
+			if strings.HasPrefix(key, r.WALDir(pos.Generation)+"/") {
+				obj.metadata[litestream.ChecksumMetadataKey] = "0000000000000000"
+			}
+		}
+		client.mu.Unlock()
+
+		if _, err := r.WALReader(context.Background(), pos.Generation, pos.Index); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a missing WAL file is reported as not existing.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r, _ := NewTestObjectReplica(t, db)
+
+		if _, err := r.WALReader(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestObjectReplica_RunRetention(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r, client := NewTestObjectReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a generation whose only snapshot is older than the retention.
+	const generation = "0000000000000001"
+	createdAt := time.Now().Add(-2 * r.Retention)
+	if err := r.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data"), createdAt); err != nil {
+		t.Fatal(err)
+	} else if err := r.WriteWAL(context.Background(), generation, 0, bytes.NewReader(make([]byte, 32)), createdAt); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.RunRetention(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := result.Generations, []string{generation}; !equalStrings(got, want) {
+		t.Fatalf("Generations=%v, want %v", got, want)
+	} else if got, want := result.SnapshotN, 1; got != want {
+		t.Fatalf("SnapshotN=%d, want %d", got, want)
+	} else if got, want := result.WALN, 1; got != want {
+		t.Fatalf("WALN=%d, want %d", got, want)
+	}
+
+	// Ensure only the objects of the expired generation are deleted.
+	if keys := client.Keys(r.GenerationDir(generation) + "/"); len(keys) != 0 {
+		t.Fatalf("unexpected objects: %v", keys)
+	} else if keys := client.Keys(r.GenerationDir(r.LastPos().Generation) + "/"); len(keys) == 0 {
+		t.Fatal("expected objects in replicating generation")
+	}
+}
+
+// NewTestObjectReplica returns an object replica for db which stores objects
+// in memory.
+func NewTestObjectReplica(tb testing.TB, db *litestream.DB) (*litestream.ObjectReplica, *memObjectClient) {
+	tb.Helper()
+
+	client := newMemObjectClient()
+	r := litestream.NewObjectReplica(db, "", client,
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "operation_total"}, []string{"db", "name", "type"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "operation_bytes"}, []string{"db", "name", "type"}),
+	)
+	r.Path = "backups"
+	r.MonitorEnabled = false
+	return r, client
+}
+
+// memObjectClient is an ObjectClient which stores objects in memory.
+type memObjectClient struct {
+	mu      sync.Mutex
+	objects map[string]*memObject
+}
+
+type memObject struct {
+	data     []byte
+	modTime  time.Time
+	metadata map[string]string
+}
+
+func newMemObjectClient() *memObjectClient {
+	return &memObjectClient{objects: make(map[string]*memObject)}
+}
+
+func (c *memObjectClient) Type() string { return "mem" }
+
+func (c *memObjectClient) URL() string { return "mem://" }
+
+func (c *memObjectClient) Init(ctx context.Context) error { return nil }
+
+// Keys returns the sorted keys of all objects beginning with prefix.
+func (c *memObjectClient) Keys(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for key := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *memObjectClient) ListObjects(ctx context.Context, prefix string, fn func(litestream.ObjectInfo) error) error {
+	c.mu.Lock()
+	var infos []litestream.ObjectInfo
+	dirs := make(map[string]bool)
+	for key, obj := range c.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		// Collapse objects below the next slash into a single directory.
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			dir := key[:len(prefix)+i]
+			if !dirs[dir] {
+				dirs[dir] = true
+				infos = append(infos, litestream.ObjectInfo{Key: dir, IsDir: true})
+			}
+			continue
+		}
+
+		infos = append(infos, litestream.ObjectInfo{
+			Key:      key,
+			Size:     int64(len(obj.data)),
+			ModTime:  obj.modTime,
+			Metadata: copyMetadata(obj.metadata),
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memObjectClient) PutObject(ctx context.Context, key string, rd io.Reader, opts litestream.PutOptions) (int64, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return 0, err
+	}
+
+	modTime := opts.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[key] = &memObject{data: data, modTime: modTime.UTC(), metadata: copyMetadata(opts.Metadata)}
+	return int64(len(data)), nil
+}
+
+func (c *memObjectClient) GetObject(ctx context.Context, key string) (io.ReadCloser, litestream.ObjectInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := c.objects[key]
+	if obj == nil {
+		return nil, litestream.ObjectInfo{}, os.ErrNotExist
+	}
+	info := litestream.ObjectInfo{
+		Key:      key,
+		Size:     int64(len(obj.data)),
+		ModTime:  obj.modTime,
+		Metadata: copyMetadata(obj.metadata),
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), info, nil
+}
+
+func (c *memObjectClient) DeleteObjects(ctx context.Context, objs []litestream.ObjectInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, obj := range objs {
+		delete(c.objects, obj.Key)
+	}
+	return nil
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	other := make(map[string]string, len(m))
+	for k, v := range m {
+		other[k] = v
+	}
+	return other
+}
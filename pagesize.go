@@ -0,0 +1,110 @@
+package litestream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// isValidPageSize returns true if n is a page size supported by SQLite.
+func isValidPageSize(n int) bool {
+	return n >= 512 && n <= 65536 && n&(n-1) == 0
+}
+
+// readDBHeader returns the 100-byte header of a database file.
+func readDBHeader(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 100)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, err
+	} else if string(hdr[:len(sqliteHeader)]) != sqliteHeader {
+		return nil, fmt.Errorf("not a sqlite database")
+	}
+	return hdr, nil
+}
+
+// readPageSize returns the page size stored in the header of a database file.
+func readPageSize(filename string) (int, error) {
+	hdr, err := readDBHeader(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(hdr[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	return pageSize, nil
+}
+
+// checkRestorePageSize compares the page size of a restored database against
+// opt.RecommendedPageSize. A mismatch is only reported unless
+// opt.ConvertPageSize is set, in which case the database is rebuilt with the
+// recommended page size.
+func checkRestorePageSize(ctx context.Context, filename string, opt RestoreOptions, logger *log.Logger, logPrefix string) error {
+	if opt.RecommendedPageSize == 0 {
+		return nil
+	}
+
+	pageSize, err := readPageSize(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read page size: %w", err)
+	} else if pageSize == opt.RecommendedPageSize {
+		return nil
+	}
+	logger.Printf("%s: WARNING: restored page size %d differs from recommended page size %d", logPrefix, pageSize, opt.RecommendedPageSize)
+
+	if !opt.ConvertPageSize {
+		return nil
+	}
+	if err := convertPageSize(ctx, filename, opt.RecommendedPageSize); err != nil {
+		return fmt.Errorf("cannot convert page size: %w", err)
+	}
+	logger.Printf("%s: converted page size from %d to %d", logPrefix, pageSize, opt.RecommendedPageSize)
+	return nil
+}
+
+// convertPageSize rebuilds the database with a new page size using VACUUM.
+// The page size of a WAL mode database cannot be changed so the journal mode
+// is switched to DELETE during the rebuild and restored afterward.
+func convertPageSize(ctx context.Context, filename string, pageSize int) error {
+	d, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Pragmas apply per connection so all statements must share one.
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var journalMode string
+	if err := conn.QueryRowContext(ctx, `PRAGMA journal_mode;`).Scan(&journalMode); err != nil {
+		return fmt.Errorf("read journal mode: %w", err)
+	} else if _, err := conn.ExecContext(ctx, `PRAGMA journal_mode = delete;`); err != nil {
+		return fmt.Errorf("disable wal: %w", err)
+	} else if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA page_size = %d;`, pageSize)); err != nil {
+		return fmt.Errorf("set page size: %w", err)
+	} else if _, err := conn.ExecContext(ctx, `VACUUM;`); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	} else if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA journal_mode = %s;`, journalMode)); err != nil {
+		return fmt.Errorf("restore journal mode: %w", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,86 @@
+package litestream
+
+import (
+	"log"
+	"time"
+)
+
+// pauseState tracks whether replication of a database has been paused.
+type pauseState struct {
+	paused    bool
+	pausedAt  time.Time
+	discarded bool // true if unreplicated shadow WAL was removed while paused
+	reason    string
+}
+
+// Pause stops replicas from uploading changes until Resume is called. The
+// database can still be written & the shadow WAL is still synced so SQLite
+// can checkpoint, however, shadow WAL files are no longer kept until they are
+// replicated. If any are discarded, a new generation is started on resume &
+// replicas take a new snapshot instead of uploading the intermediate WAL.
+//
+// WARNING: changes made while replication is paused are not durable. They are
+// only stored on the local disk & are lost if it fails before replication
+// resumes & the replicas have caught up.
+func (db *DB) Pause() {
+	db.pauseMu.Lock()
+	defer db.pauseMu.Unlock()
+
+	if db.pause.paused {
+		return
+	}
+	db.pause = pauseState{paused: true, pausedAt: time.Now(), reason: db.pause.reason}
+	log.Printf("%s: WARNING: replication paused, changes are not durable until replication resumes", db.path)
+}
+
+// Resume restarts uploads after Pause. If shadow WAL was discarded while
+// paused, the next sync starts a new generation & notifies replicas.
+// Otherwise, replicas are notified so they upload the changes retained during
+// the pause immediately.
+func (db *DB) Resume() {
+	db.pauseMu.Lock()
+	if !db.pause.paused {
+		db.pauseMu.Unlock()
+		return
+	}
+	d := time.Since(db.pause.pausedAt).Round(time.Second)
+	if db.pause.discarded {
+		db.pause = pauseState{reason: "replication resumed after unreplicated wal was discarded"}
+		db.pauseMu.Unlock()
+		log.Printf("%s: replication resumed after %s, starting new generation", db.path, d)
+		return
+	}
+	db.pause = pauseState{reason: db.pause.reason}
+	db.pauseMu.Unlock()
+	log.Printf("%s: replication resumed after %s", db.path, d)
+
+	db.mu.Lock()
+	close(db.notify)
+	db.notify = make(chan struct{})
+	db.mu.Unlock()
+}
+
+// Paused returns true if replication has been paused by Pause.
+func (db *DB) Paused() bool {
+	db.pauseMu.Lock()
+	defer db.pauseMu.Unlock()
+	return db.pause.paused
+}
+
+// markPauseDiscarded records that shadow WAL files which have not been
+// replicated were removed while replication was paused.
+func (db *DB) markPauseDiscarded() {
+	db.pauseMu.Lock()
+	defer db.pauseMu.Unlock()
+	db.pause.discarded = true
+}
+
+// resumeGenerationReason returns the reason a new generation must be started
+// after replication resumed, if any, & clears it.
+func (db *DB) resumeGenerationReason() string {
+	db.pauseMu.Lock()
+	defer db.pauseMu.Unlock()
+	reason := db.pause.reason
+	db.pause.reason = ""
+	return reason
+}
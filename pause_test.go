@@ -0,0 +1,86 @@
+package litestream_test
+
+import (
+	"testing"
+)
+
+func TestDB_Pause(t *testing.T) {
+	// Ensure uploads stop while paused & the replica catches up from the
+	// retained shadow WAL after resuming.
+	t.Run("Retained", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		pos0 := r.LastPos()
+
+		db.Pause()
+		if !db.Paused() {
+			t.Fatal("expected paused")
+		} else if !db.Status().Paused {
+			t.Fatal("expected paused status")
+		}
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if got, want := r.LastPos(), pos0; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+
+		db.Resume()
+		if db.Paused() {
+			t.Fatal("expected resumed")
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		} else if pos.Generation != pos0.Generation {
+			t.Fatalf("generation=%s, want %s", pos.Generation, pos0.Generation)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure unreplicated shadow WAL is discarded while paused & a new
+	// generation is started after resuming.
+	t.Run("Discarded", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		pos0 := r.LastPos()
+
+		db.Pause()
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		if _, err := db.ShadowWALReader(pos0); err == nil {
+			t.Fatal("expected shadow wal to be discarded")
+		}
+
+		db.Resume()
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Generation == pos0.Generation {
+			t.Fatal("expected new generation")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
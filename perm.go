@@ -0,0 +1,61 @@
+package litestream
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// metaFileMode returns the permissions of files created in the meta directory.
+func (db *DB) metaFileMode() os.FileMode {
+	if db.FileMode != 0 {
+		return db.FileMode
+	}
+	return db.mode
+}
+
+// metaDirMode returns the permissions of directories created in the meta
+// directory, including the meta directory itself.
+func (db *DB) metaDirMode() os.FileMode {
+	if db.DirMode != 0 {
+		return db.DirMode
+	}
+	return db.dirmode
+}
+
+// mkdirMeta creates dir & any missing parents with the meta directory
+// permissions. If DirMode is set, it is applied to each created directory
+// regardless of the umask.
+func (db *DB) mkdirMeta(dir string) error {
+	// Find the directories which will be created before creating them.
+	var dirs []string
+	if db.DirMode != 0 {
+		for p := dir; ; p = filepath.Dir(p) {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				break
+			}
+			dirs = append(dirs, p)
+			if filepath.Dir(p) == p {
+				break
+			}
+		}
+	}
+
+	if err := mkdirAll(dir, db.metaDirMode(), db.diruid, db.dirgid); err != nil {
+		return err
+	}
+	for _, p := range dirs {
+		if err := os.Chmod(p, db.DirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chmodMeta sets the permissions of a file created in the meta directory to
+// FileMode, if set, so they do not depend on the umask.
+func (db *DB) chmodMeta(filename string) error {
+	if db.FileMode == 0 {
+		return nil
+	}
+	return os.Chmod(filename, db.FileMode)
+}
@@ -0,0 +1,73 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package litestream_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDB_FileMode(t *testing.T) {
+	// Ensure meta directories & shadow WAL files get the configured
+	// permissions regardless of the umask.
+	t.Run("OK", func(t *testing.T) {
+		defer syscall.Umask(syscall.Umask(0077))
+
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.FileMode, db.DirMode = 0640, 0750
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for filename, want := range map[string]os.FileMode{
+			db.MetaPath(): 0750,
+			filepath.Join(db.MetaPath(), "generations"): 0750,
+			db.GenerationPath(pos.Generation):           0750,
+			db.GenerationNamePath():                     0640,
+			db.ShadowWALPath(pos.Generation, pos.Index): 0640,
+		} {
+			if fi, err := os.Stat(filename); err != nil {
+				t.Fatal(err)
+			} else if got := fi.Mode().Perm(); got != want {
+				t.Fatalf("%s: mode=%o, want %o", filename, got, want)
+			}
+		}
+	})
+
+	// Ensure a meta directory created with looser permissions is restricted
+	// when the database is initialized.
+	t.Run("ExistingMetaDir", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.DirMode = 0700
+
+		if err := os.Mkdir(db.MetaPath(), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chmod(db.MetaPath(), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fi, err := os.Stat(db.MetaPath()); err != nil {
+			t.Fatal(err)
+		} else if got := fi.Mode().Perm(); got != 0700 {
+			t.Fatalf("mode=%o, want 700", got)
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// RestorePlan describes the resolved source & target of a restore. It is
+// reported before any data is copied so an incorrect source can be caught.
+type RestorePlan struct {
+	// Replica the restore reads from. URL is blank if the replica type
+	// cannot report its location.
+	ReplicaName string
+	ReplicaType string
+	ReplicaURL  string
+
+	// Resolved position. WAL files from SnapshotIndex through MaxIndex are
+	// applied after the snapshot at SnapshotIndex. If Offset is set, only
+	// the first Offset bytes of the WAL file at MaxIndex are applied.
+	Generation    string
+	SnapshotIndex int
+	MaxIndex      int
+	Offset        int64
+
+	// Requested point-in-time or marker, if any.
+	Timestamp time.Time
+	Marker    string
+
+	// Estimated number of snapshot & WAL objects to download, the number
+	// of which are WAL segments, and their sizes, in bytes, as stored in
+	// the replica. Size is the total of SnapshotSize & WALSize. Zero if
+	// unknown.
+	ObjectN      int
+	WALSegmentN  int
+	SnapshotSize int64
+	WALSize      int64
+	Size         int64
+
+	OutputPath string
+	DryRun     bool
+}
+
+// String returns the plan as a single line of key/value pairs.
+func (p *RestorePlan) String() string {
+	a := []string{
+		fmt.Sprintf("replica=%s", p.ReplicaName),
+		fmt.Sprintf("type=%s", p.ReplicaType),
+	}
+	if p.ReplicaURL != "" {
+		a = append(a, fmt.Sprintf("url=%s", p.ReplicaURL))
+	}
+	a = append(a,
+		fmt.Sprintf("generation=%s", p.Generation),
+		fmt.Sprintf("snapshot=%08x", p.SnapshotIndex),
+		fmt.Sprintf("wal=%08x-%08x", p.SnapshotIndex, p.MaxIndex),
+	)
+	if p.Offset != 0 {
+		a = append(a, fmt.Sprintf("offset=%d", p.Offset))
+	}
+	if !p.Timestamp.IsZero() {
+		a = append(a, fmt.Sprintf("timestamp=%s", p.Timestamp.Format(time.RFC3339Nano)))
+	}
+	if p.Marker != "" {
+		a = append(a, fmt.Sprintf("marker=%q", p.Marker))
+	}
+	a = append(a,
+		fmt.Sprintf("objects=%d", p.ObjectN),
+		fmt.Sprintf("segments=%d", p.WALSegmentN),
+		fmt.Sprintf("snapshot-size=%d", p.SnapshotSize),
+		fmt.Sprintf("wal-size=%d", p.WALSize),
+		fmt.Sprintf("size=%d", p.Size),
+		fmt.Sprintf("output=%s", p.OutputPath),
+	)
+	if p.DryRun {
+		a = append(a, "dry-run=true")
+	}
+	return "restore plan: " + strings.Join(a, " ")
+}
+
+// CalcRestorePlan resolves the snapshot & WAL files which a restore with opt
+// would apply without restoring any data. Only the replica's listings & commit
+// time indexes are read. The generation is chosen the same way as
+// CalcReplicaRestoreTarget if not specified.
+//
+// Returns an error if the requested index, offset or timestamp cannot be
+// reached, such as when a WAL file before it is missing.
+func CalcRestorePlan(ctx context.Context, r Replica, opt RestoreOptions) (RestorePlan, error) {
+	if opt.Marker != "" {
+		return RestorePlan{}, fmt.Errorf("cannot plan restore to marker")
+	}
+
+	// Determine generation, if not specified.
+	if opt.Generation == "" {
+		generation, _, err := CalcReplicaRestoreTarget(ctx, r, opt)
+		if err != nil {
+			return RestorePlan{}, err
+		} else if generation == "" {
+			return RestorePlan{}, fmt.Errorf("no matching backups found")
+		}
+		opt.Generation = generation
+	}
+
+	minIndex, maxIndex, err := calcRestoreRange(ctx, r, &opt)
+	if err != nil {
+		return RestorePlan{}, err
+	}
+
+	plan, missing, err := newRestorePlan(ctx, r, opt, minIndex, maxIndex)
+	if err != nil {
+		return plan, err
+	} else if missing != -1 {
+		return plan, fmt.Errorf("cannot restore to %s/%08x, wal %08x not found", opt.Generation, maxIndex, missing)
+	}
+	return plan, nil
+}
+
+// RestorePlanSize returns the number of bytes a restore with opt would
+// download from the snapshot & WAL files of r, as stored in the replica, and
+// the number of WAL segments. Sizes are read from the replica's listings, as
+// with CalcRestorePlan, so no data is downloaded. The whole of the last WAL
+// file is included when restoring to an offset or a commit within it. The
+// base snapshots of an incremental snapshot are not included.
+func RestorePlanSize(ctx context.Context, r Replica, opt RestoreOptions) (snapshotSize, walSize int64, segmentN int, err error) {
+	plan, err := CalcRestorePlan(ctx, r, opt)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return plan.SnapshotSize, plan.WALSize, plan.WALSegmentN, nil
+}
+
+// newRestorePlan returns the plan for restoring the generation from minIndex
+// through maxIndex with the objects listed by the replica. Also returns the
+// first WAL index in the range which has no segments, or -1 if none.
+func newRestorePlan(ctx context.Context, r Replica, opt RestoreOptions, minIndex, maxIndex int) (_ RestorePlan, missing int, err error) {
+	plan := RestorePlan{
+		ReplicaName:   r.Name(),
+		ReplicaType:   r.Type(),
+		Generation:    opt.Generation,
+		SnapshotIndex: minIndex,
+		MaxIndex:      maxIndex,
+		Offset:        opt.Offset,
+		Timestamp:     opt.Timestamp,
+		Marker:        opt.Marker,
+		OutputPath:    opt.OutputPath,
+		DryRun:        opt.DryRun,
+	}
+	if u, ok := r.(interface{ URL() string }); ok {
+		plan.ReplicaURL = u.URL()
+	}
+
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return plan, -1, err
+	}
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return plan, -1, err
+	}
+
+	for _, info := range snapshots {
+		if info.Generation == opt.Generation && info.Index == minIndex {
+			plan.ObjectN, plan.SnapshotSize = plan.ObjectN+1, plan.SnapshotSize+info.Size
+		}
+	}
+
+	found := make(map[int]bool)
+	for _, info := range wals {
+		if info.Generation == opt.Generation && info.Index >= minIndex && info.Index <= maxIndex {
+			plan.ObjectN, plan.WALSegmentN, plan.WALSize = plan.ObjectN+1, plan.WALSegmentN+1, plan.WALSize+info.Size
+			found[info.Index] = true
+		}
+	}
+	plan.Size = plan.SnapshotSize + plan.WALSize
+
+	// A snapshot-only restore or one which stops at the WAL header of the
+	// last file does not require the last WAL file.
+	missing = -1
+	for index := minIndex; index <= maxIndex && missing == -1; index++ {
+		if found[index] || (index == maxIndex && (minIndex == maxIndex || opt.Offset == WALHeaderSize)) {
+			continue
+		}
+		missing = index
+	}
+	return plan, missing, nil
+}
+
+// reportRestorePlan builds the plan for restoring the generation from
+// minIndex through maxIndex, logs it & passes it to opt.Plan, if set.
+// Object counts are left as zero if the replica cannot be listed.
+func reportRestorePlan(ctx context.Context, r Replica, opt RestoreOptions, minIndex, maxIndex int, logger *log.Logger, logPrefix string) {
+	plan, _, err := newRestorePlan(ctx, r, opt, minIndex, maxIndex)
+	if err != nil {
+		logger.Printf("%s: cannot estimate restore size: %s", logPrefix, err)
+		plan.ObjectN, plan.WALSegmentN = 0, 0
+		plan.SnapshotSize, plan.WALSize, plan.Size = 0, 0, 0
+	}
+	logRestorePlan(plan, opt, logger, logPrefix)
+}
+
+// logRestorePlan logs plan & passes it to opt.Plan, if set.
+func logRestorePlan(plan RestorePlan, opt RestoreOptions, logger *log.Logger, logPrefix string) {
+	logger.Printf("%s: %s", logPrefix, &plan)
+	if opt.Plan != nil {
+		opt.Plan(plan)
+	}
+}
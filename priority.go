@@ -0,0 +1,268 @@
+package litestream
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// B-tree page types. See: https://www.sqlite.org/fileformat.html#b_tree_pages
+const (
+	btreeInteriorIndexPage = 0x02
+	btreeInteriorTablePage = 0x05
+	btreeLeafIndexPage     = 0x0a
+	btreeLeafTablePage     = 0x0d
+)
+
+// priorityState tracks committed WAL frames that have been checked for
+// changes to priority tables since the WAL was last restarted. It is only
+// accessed by the monitor goroutine so it is not protected by the DB lock.
+type priorityState struct {
+	salt   uint64           // salt of WAL header
+	offset int64            // offset after last checked commit
+	frames map[uint32]int64 // latest frame offset by page number
+
+	// B-tree pages of the priority tables & the subset of root & interior
+	// pages. Rebuilt only when the shape of a b-tree may have changed.
+	pages    map[uint32]struct{}
+	interior map[uint32]struct{}
+}
+
+// PriorityNotify returns a channel that closes after a change to one of the
+// priority tables has been synced to the shadow WAL. Replicas which delay
+// between syncs can use this to upload priority changes immediately.
+func (db *DB) PriorityNotify() <-chan struct{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.priorityNotify
+}
+
+// priorityTablesChanged returns true if a newly committed WAL frame contains
+// a page belonging to one of the priority tables.
+//
+// Pages are mapped to tables by walking each table's b-tree, which is only
+// repeated when a committed frame rewrites a root or interior page of a
+// priority table or the first page of the database. Splitting, merging or
+// freeing b-tree pages always rewrites the parent page & schema changes
+// rewrite the first page so other frames are matched against the cached
+// pages. Overflow pages are not tracked as changing a row also writes its
+// leaf page. The DB lock is not held while reading so syncs are not blocked.
+func (db *DB) priorityTablesChanged() (bool, error) {
+	db.mu.RLock()
+	sqldb, pageSize := db.db, db.pageSize
+	db.mu.RUnlock()
+
+	// Ignore if the database has not been initialized yet.
+	if sqldb == nil || pageSize == 0 || len(db.PriorityTables) == 0 {
+		return false, nil
+	}
+
+	f, err := os.Open(db.WALPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Frames already copied to the shadow WAL do not need an immediate sync.
+	// Offsets only match if the shadow WAL shares the salt of the real WAL.
+	var syncedSalt uint64
+	var syncedOffset int64
+	if pos, err := db.Pos(); err != nil {
+		return false, err
+	} else if !pos.IsZero() {
+		if hdr, err := readWALHeader(db.fs(), db.ShadowWALPath(pos.Generation, pos.Index)); err == nil && len(hdr) == WALHeaderSize {
+			syncedSalt, syncedOffset = binary.BigEndian.Uint64(hdr[16:]), pos.Offset
+		}
+	}
+
+	pgnos, err := db.readPriorityFrames(f, pageSize, syncedSalt, syncedOffset)
+	if err != nil {
+		return false, fmt.Errorf("read wal frames: %w", err)
+	} else if len(pgnos) == 0 {
+		return false, nil
+	}
+
+	state := &db.priority
+	rebuild := state.pages == nil
+	for _, pgno := range pgnos {
+		if _, ok := state.interior[pgno]; ok || pgno == 1 {
+			rebuild = true
+			break
+		}
+	}
+	if rebuild {
+		if err := db.loadPriorityPages(sqldb, f, pageSize); err != nil {
+			state.pages, state.interior = nil, nil
+			return false, fmt.Errorf("priority pages: %w", err)
+		}
+	}
+
+	for _, pgno := range pgnos {
+		if _, ok := state.pages[pgno]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readPriorityFrames reads WAL frame headers committed since the last check
+// and returns the page numbers of those not yet synced to the shadow WAL.
+// Tracking is reset if the WAL has restarted. Frames checkpointed before they
+// were checked are never seen so the cached b-tree pages are reset too.
+func (db *DB) readPriorityFrames(f *os.File, pageSize int, syncedSalt uint64, syncedOffset int64) ([]uint32, error) {
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil // empty or partial header
+	} else if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &db.priority
+	salt := binary.BigEndian.Uint64(hdr[16:])
+	if state.frames == nil || salt != state.salt || fi.Size() < state.offset {
+		*state = priorityState{salt: salt, offset: WALHeaderSize, frames: make(map[uint32]int64)}
+	}
+	if salt != syncedSalt {
+		syncedOffset = 0
+	}
+
+	var pgnos, pending []uint32
+	var pendingOffsets []int64
+	frameHdr := make([]byte, WALFrameHeaderSize)
+	frameSize := int64(WALFrameHeaderSize + pageSize)
+	for offset := state.offset; offset+frameSize <= fi.Size(); offset += frameSize {
+		if _, err := f.ReadAt(frameHdr, offset); err != nil {
+			return nil, err
+		} else if binary.BigEndian.Uint64(frameHdr[8:]) != state.salt {
+			break // frame from previous WAL, stop reading
+		}
+
+		pending = append(pending, binary.BigEndian.Uint32(frameHdr[0:]))
+		pendingOffsets = append(pendingOffsets, offset)
+
+		// Only track frames once their transaction has committed.
+		if commit := binary.BigEndian.Uint32(frameHdr[4:]); commit != 0 {
+			for i, pgno := range pending {
+				state.frames[pgno] = pendingOffsets[i]
+				if pendingOffsets[i] >= syncedOffset {
+					pgnos = append(pgnos, pgno)
+				}
+			}
+			pending, pendingOffsets = pending[:0], pendingOffsets[:0]
+			state.offset = offset + frameSize
+		}
+	}
+	return pgnos, nil
+}
+
+// loadPriorityPages walks the b-trees of the priority tables & caches their
+// pages in the priority state.
+func (db *DB) loadPriorityPages(sqldb *sql.DB, f *os.File, pageSize int) error {
+	args := make([]interface{}, len(db.PriorityTables))
+	for i := range db.PriorityTables {
+		args[i] = db.PriorityTables[i]
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+	rows, err := sqldb.Query(`SELECT rootpage FROM sqlite_master WHERE type = 'table' AND rootpage > 0 AND name IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var roots []uint32
+	for rows.Next() {
+		var root uint32
+		if err := rows.Scan(&root); err != nil {
+			return err
+		}
+		roots = append(roots, root)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	dbFile, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer dbFile.Close()
+
+	pages, interior := make(map[uint32]struct{}), make(map[uint32]struct{})
+	buf := make([]byte, pageSize)
+	for _, root := range roots {
+		interior[root] = struct{}{} // splitting a leaf root rewrites it
+		if err := db.walkBTree(dbFile, f, root, buf, pages, interior); err != nil {
+			return err
+		}
+	}
+	db.priority.pages, db.priority.interior = pages, interior
+	return nil
+}
+
+// walkBTree adds pgno & all of its descendant b-tree pages to pages. Interior
+// pages are also added to interior.
+func (db *DB) walkBTree(dbFile, walFile *os.File, pgno uint32, buf []byte, pages, interior map[uint32]struct{}) error {
+	if _, ok := pages[pgno]; ok || pgno == 0 {
+		return nil // already visited or invalid
+	}
+	pages[pgno] = struct{}{}
+
+	if err := db.readPriorityPage(dbFile, walFile, pgno, buf); err != nil {
+		return fmt.Errorf("read page %d: %w", pgno, err)
+	}
+
+	// The first page is prefixed by the database file header.
+	hdr := buf
+	if pgno == 1 {
+		hdr = buf[100:]
+	}
+
+	switch hdr[0] {
+	case btreeLeafTablePage, btreeLeafIndexPage:
+		return nil
+	case btreeInteriorTablePage, btreeInteriorIndexPage:
+		interior[pgno] = struct{}{}
+	default:
+		return fmt.Errorf("invalid b-tree page type: pgno=%d type=%x", pgno, hdr[0])
+	}
+
+	// Collect children first as walking overwrites the page buffer.
+	cellN := int(binary.BigEndian.Uint16(hdr[3:]))
+	children := make([]uint32, 0, cellN+1)
+	for i := 0; i < cellN; i++ {
+		off := int(binary.BigEndian.Uint16(hdr[12+(i*2):]))
+		if off+4 > len(buf) {
+			return fmt.Errorf("invalid cell offset: pgno=%d offset=%d", pgno, off)
+		}
+		children = append(children, binary.BigEndian.Uint32(buf[off:]))
+	}
+	children = append(children, binary.BigEndian.Uint32(hdr[8:]))
+
+	for _, child := range children {
+		if err := db.walkBTree(dbFile, walFile, child, buf, pages, interior); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPriorityPage reads the latest committed version of a page into buf.
+func (db *DB) readPriorityPage(dbFile, walFile *os.File, pgno uint32, buf []byte) error {
+	if offset, ok := db.priority.frames[pgno]; ok {
+		_, err := walFile.ReadAt(buf, offset+WALFrameHeaderSize)
+		return err
+	}
+	_, err := dbFile.ReadAt(buf, int64(pgno-1)*int64(len(buf)))
+	return err
+}
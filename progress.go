@@ -0,0 +1,150 @@
+package litestream
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultRateSmoothing is the default weight of new samples in a RateEstimator.
+const DefaultRateSmoothing = 0.3
+
+// RestoreProgress represents the progress of a restore after a file is applied.
+type RestoreProgress struct {
+	// Number of bytes applied & total number of bytes to apply. Sizes are
+	// based on the files as stored in the replica. Total is zero if unknown.
+	DoneBytes  int64
+	TotalBytes int64
+
+	// Moving average of the download & apply rate, in bytes per second.
+	Rate float64
+
+	// Estimated time until the restore is complete. Zero if unknown.
+	ETA time.Duration
+}
+
+// RateEstimator computes an exponentially weighted moving average of a
+// byte rate so that estimates adapt as the rate changes.
+type RateEstimator struct {
+	rate float64
+	ok   bool
+
+	// Weight of each new sample, between 0 and 1. Higher values adapt to
+	// changes in rate more quickly but produce noisier estimates.
+	Smoothing float64
+}
+
+// NewRateEstimator returns a new instance of RateEstimator.
+func NewRateEstimator() *RateEstimator {
+	return &RateEstimator{Smoothing: DefaultRateSmoothing}
+}
+
+// Add adds a sample of n bytes processed over duration d.
+// Samples with a non-positive duration are ignored.
+func (e *RateEstimator) Add(n int64, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	sample := float64(n) / d.Seconds()
+	if !e.ok {
+		e.rate, e.ok = sample, true
+		return
+	}
+	e.rate = (e.Smoothing * sample) + ((1 - e.Smoothing) * e.rate)
+}
+
+// Rate returns the current estimated rate in bytes per second.
+func (e *RateEstimator) Rate() float64 {
+	return e.rate
+}
+
+// ETA returns the estimated time to process remaining bytes.
+// Returns false if no samples have been added or the rate is zero.
+func (e *RateEstimator) ETA(remaining int64) (time.Duration, bool) {
+	if !e.ok || e.rate <= 0 || remaining < 0 {
+		return 0, false
+	}
+	return time.Duration(float64(remaining) / e.rate * float64(time.Second)), true
+}
+
+// restoreProgress tracks restore progress & reports it to a callback.
+type restoreProgress struct {
+	fn        func(RestoreProgress)
+	estimator *RateEstimator
+	t         time.Time
+	done      int64
+	total     int64
+
+	snapshotSize int64         // stored size of snapshot
+	walSizes     map[int]int64 // stored size of WAL by index
+}
+
+// newRestoreProgress returns a progress tracker for restoring generation from
+// the snapshot at minIndex through the WAL at maxIndex. Returns nil if fn is nil.
+// The total size is unknown if the replica listings fail.
+func newRestoreProgress(ctx context.Context, r Replica, generation string, minIndex, maxIndex int, fn func(RestoreProgress)) *restoreProgress {
+	if fn == nil {
+		return nil
+	}
+
+	p := &restoreProgress{fn: fn, estimator: NewRateEstimator(), t: time.Now()}
+
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return p
+	}
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return p
+	}
+
+	var snapshotSize int64
+	walSizes := make(map[int]int64)
+	for _, info := range snapshots {
+		if info.Generation == generation && info.Index == minIndex {
+			snapshotSize = info.Size
+		}
+	}
+	for _, info := range wals {
+		if info.Generation == generation && info.Index >= minIndex && info.Index <= maxIndex {
+			walSizes[info.Index] += info.Size // s3 may store multiple segments per index
+		}
+	}
+
+	p.snapshotSize, p.walSizes = snapshotSize, walSizes
+	p.total = snapshotSize
+	for _, n := range walSizes {
+		p.total += n
+	}
+	return p
+}
+
+// addSnapshot records that the snapshot has been applied and reports progress.
+func (p *restoreProgress) addSnapshot() {
+	if p == nil {
+		return
+	}
+	p.add(p.snapshotSize)
+}
+
+// addWAL records that the WAL at index has been applied and reports progress.
+func (p *restoreProgress) addWAL(index int) {
+	if p == nil {
+		return
+	}
+	p.add(p.walSizes[index])
+}
+
+// add records that n bytes have been applied and reports progress.
+func (p *restoreProgress) add(n int64) {
+	now := time.Now()
+	p.estimator.Add(n, now.Sub(p.t))
+	p.t, p.done = now, p.done+n
+
+	// Only report an ETA when the total size is known.
+	progress := RestoreProgress{DoneBytes: p.done, TotalBytes: p.total, Rate: p.estimator.Rate()}
+	if p.total > 0 {
+		progress.ETA, _ = p.estimator.ETA(p.total - p.done)
+	}
+	p.fn(progress)
+}
@@ -0,0 +1,100 @@
+package litestream_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRateEstimator(t *testing.T) {
+	// Ensure the ETA is computed from a known constant rate.
+	t.Run("Constant", func(t *testing.T) {
+		e := litestream.NewRateEstimator()
+		for i := 0; i < 5; i++ {
+			e.Add(100, time.Second)
+		}
+
+		if got, want := e.Rate(), 100.0; got != want {
+			t.Fatalf("Rate()=%v, want %v", got, want)
+		} else if eta, ok := e.ETA(500); !ok {
+			t.Fatal("expected eta")
+		} else if got, want := eta, 5*time.Second; got != want {
+			t.Fatalf("ETA()=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure the estimate adapts as the rate changes.
+	t.Run("Adapt", func(t *testing.T) {
+		e := litestream.NewRateEstimator()
+		e.Add(100, time.Second)
+
+		prev, _ := e.ETA(1000)
+		for i := 0; i < 20; i++ {
+			e.Add(400, time.Second)
+			if eta, _ := e.ETA(1000); eta >= prev {
+				t.Fatalf("expected eta to decrease: %s >= %s", eta, prev)
+			} else {
+				prev = eta
+			}
+		}
+
+		if eta, _ := e.ETA(1000); eta < 2500*time.Millisecond || eta > 2600*time.Millisecond {
+			t.Fatalf("expected eta to converge near 2.5s: %s", eta)
+		}
+	})
+
+	// Ensure no ETA is reported before any samples are added.
+	t.Run("NoSamples", func(t *testing.T) {
+		if _, ok := litestream.NewRateEstimator().ETA(100); ok {
+			t.Fatal("expected no eta")
+		}
+	})
+
+	// Ensure samples without elapsed time are ignored.
+	t.Run("ZeroDuration", func(t *testing.T) {
+		e := litestream.NewRateEstimator()
+		e.Add(100, 0)
+		if _, ok := e.ETA(100); ok {
+			t.Fatal("expected no eta")
+		}
+	})
+}
+
+func TestRestoreReplica_Progress(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a []litestream.RestoreProgress
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(t.TempDir(), "db")
+	opt.Generation = pos.Generation
+	opt.Progress = func(p litestream.RestoreProgress) { a = append(a, p) }
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expect progress after the snapshot & the single WAL file.
+	if got, want := len(a), 2; got != want {
+		t.Fatalf("len=%d, want %d", got, want)
+	} else if a[1].TotalBytes == 0 {
+		t.Fatal("expected total size")
+	} else if got, want := a[1].DoneBytes, a[1].TotalBytes; got != want {
+		t.Fatalf("DoneBytes=%d, want %d", got, want)
+	} else if a[0].DoneBytes >= a[1].DoneBytes {
+		t.Fatalf("expected progress to increase: %d >= %d", a[0].DoneBytes, a[1].DoneBytes)
+	}
+}
@@ -0,0 +1,75 @@
+package litestream
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// ExcessGeneration is a generation selected for deletion by ExcessGenerations.
+type ExcessGeneration struct {
+	Generation string
+	Stats      GenerationStats
+}
+
+// Age returns the time since the generation's earliest snapshot, or since its
+// latest update if it has no snapshots.
+func (g ExcessGeneration) Age(now time.Time) time.Duration {
+	t := g.Stats.CreatedAt
+	if t.IsZero() {
+		t = g.Stats.UpdatedAt
+	}
+	return now.Sub(t)
+}
+
+// ExcessGenerations returns the generations of r to delete so that at most
+// maxN generations remain, oldest first. Generations are ordered by their
+// latest update. Generations in keep, such as the active generation, and
+// generations being restored are never returned but count toward maxN.
+// Returns nil if maxN is zero.
+func ExcessGenerations(ctx context.Context, r Replica, maxN int, keep ...string) ([]ExcessGeneration, error) {
+	if maxN <= 0 {
+		return nil, nil
+	}
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]struct{})
+	for _, generation := range keep {
+		kept[generation] = struct{}{}
+	}
+
+	// Count kept generations & collect the stats of all other generations.
+	n := 0
+	var a []ExcessGeneration
+	for _, generation := range generations {
+		if _, ok := kept[generation]; ok || IsGenerationRestoring(r, generation) {
+			n++
+			continue
+		}
+
+		stats, err := r.GenerationStats(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, ExcessGeneration{Generation: generation, Stats: stats})
+	}
+
+	// Keep the most recently updated generations in the remaining slots.
+	sort.SliceStable(a, func(i, j int) bool { return a[i].Stats.UpdatedAt.After(a[j].Stats.UpdatedAt) })
+	if slots := maxN - n; slots > 0 {
+		if slots >= len(a) {
+			return nil, nil
+		}
+		a = a[slots:]
+	}
+
+	// Return oldest first.
+	for i, j := 0, len(a)-1; i < j; i, j = i+1, j-1 {
+		a[i], a[j] = a[j], a[i]
+	}
+	return a, nil
+}
@@ -0,0 +1,87 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Consistency policies applied when a replica's position does not match the
+// local position of the database.
+const (
+	// Replicate without checking the replica's position.
+	ConsistencyPolicyNone = "none"
+
+	// Stop replicating & report an error until an operator intervenes.
+	ConsistencyPolicyError = "error"
+
+	// Snapshot a replica which is behind at the current position so
+	// replication can resume. Replicas which are ahead are still reported as
+	// an error as they contain data this database did not write.
+	ConsistencyPolicyRepair = "repair"
+)
+
+// DefaultConsistencyPolicy is the default policy for replicas.
+const DefaultConsistencyPolicy = ConsistencyPolicyError
+
+// IsConsistencyPolicy returns true if s is a valid consistency policy.
+func IsConsistencyPolicy(s string) bool {
+	switch s {
+	case ConsistencyPolicyNone, ConsistencyPolicyError, ConsistencyPolicyRepair:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckReplicaPos verifies that a replica's position, rpos, is consistent with
+// the database's local position, dpos, within the same generation. A replica
+// may lag behind as long as the shadow WAL still holds the data to catch up.
+// Returns an error wrapping ErrReplicaBehind if that data has been removed,
+// such as when the replica was rolled back or replaced, or ErrReplicaAhead if
+// the replica holds data the database has not written.
+func CheckReplicaPos(db *DB, dpos, rpos Pos) error {
+	if rpos.Index > dpos.Index || (rpos.Index == dpos.Index && rpos.Offset > dpos.Offset) {
+		return fmt.Errorf("%w: replica=%s local=%s", ErrReplicaAhead, rpos, dpos)
+	} else if rpos == dpos {
+		return nil
+	}
+
+	// Ensure the shadow WAL the replica resumes from is still available.
+	fi, err := os.Stat(db.ShadowWALPath(rpos.Generation, rpos.Index))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: replica=%s local=%s, shadow wal %08x no longer available", ErrReplicaBehind, rpos, dpos, rpos.Index)
+	} else if err != nil {
+		return err
+	} else if fi.Size() < rpos.Offset {
+		return fmt.Errorf("%w: replica=%s local=%s, shadow wal %08x is only %d bytes", ErrReplicaAhead, rpos, dpos, rpos.Index, fi.Size())
+	}
+	return nil
+}
+
+// ReconcileReplicaPos checks the calculated position of replica r against the
+// database position & applies policy if they are inconsistent. Returns the
+// position to resume replication from. Repairs are performed by calling
+// snapshot at the database's current index.
+func ReconcileReplicaPos(ctx context.Context, r Replica, policy string, dpos, rpos Pos, snapshot func(ctx context.Context, generation string, index int) error) (Pos, error) {
+	if policy == ConsistencyPolicyNone {
+		return rpos, nil
+	}
+
+	db := r.DB()
+	err := CheckReplicaPos(db, dpos, rpos)
+	if err == nil {
+		return rpos, nil
+	} else if policy != ConsistencyPolicyRepair || !errors.Is(err, ErrReplicaBehind) {
+		log.Printf("%s(%s): CRITICAL: replica inconsistent, operator intervention required: %s", db.Path(), r.Name(), err)
+		return Pos{}, err
+	}
+
+	log.Printf("%s(%s): %s, repairing with new snapshot at index %08x", db.Path(), r.Name(), err, dpos.Index)
+	if err := snapshot(ctx, dpos.Generation, dpos.Index); err != nil {
+		return Pos{}, fmt.Errorf("cannot repair replica: %w", err)
+	}
+	return Pos{Generation: dpos.Generation, Index: dpos.Index}, nil
+}
@@ -0,0 +1,167 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestFileReplica_ConsistencyPolicy(t *testing.T) {
+	// setup replicates n WAL indices & returns a database along with a copy
+	// of the replica's directory taken after backupN indices.
+	setup := func(t *testing.T, n, backupN int) (*litestream.DB, *litestream.FileReplica, string, func()) {
+		db, sqldb := MustOpenDBs(t)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		backup := filepath.Join(t.TempDir(), "backup")
+		for i := 0; i < n; i++ {
+			if i == backupN {
+				MustCopyDir(t, r.Path(), backup)
+			}
+			MustRollWALIndex(t, db, sqldb, r)
+		}
+		return db, r, backup, func() { MustCloseDBs(t, db, sqldb) }
+	}
+
+	// reopen returns a fresh replica at the same path so its position is
+	// recalculated on the next sync, as it is on startup.
+	reopen := func(t *testing.T, db *litestream.DB, r *litestream.FileReplica) *litestream.FileReplica {
+		other := litestream.NewFileReplica(db, "", r.Path())
+		other.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{other}
+		return other
+	}
+
+	// rollback replaces the replica's files with backup & reopens it.
+	rollback := func(t *testing.T, db *litestream.DB, r *litestream.FileReplica, backup string) *litestream.FileReplica {
+		if err := os.RemoveAll(r.Path()); err != nil {
+			t.Fatal(err)
+		}
+		MustCopyDir(t, backup, r.Path())
+		return reopen(t, db, r)
+	}
+
+	// Ensure a replica which is behind but can catch up from the shadow WAL
+	// resumes replication.
+	t.Run("Behind", func(t *testing.T) {
+		db, r, backup, teardown := setup(t, 3, 2)
+		defer teardown()
+		r = rollback(t, db, r, backup)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure a replica rolled back past the retained shadow WAL is reported
+	// or repaired with a new snapshot, depending on policy.
+	t.Run("RolledBack", func(t *testing.T) {
+		db, r, backup, teardown := setup(t, 3, 1)
+		defer teardown()
+		r = rollback(t, db, r, backup)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(db.ShadowWALPath(pos.Generation, 1)); !os.IsNotExist(err) {
+			t.Fatalf("expected shadow wal to be removed: %v", err)
+		}
+
+		if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrReplicaBehind) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrReplicaBehind) {
+			t.Fatalf("expected error to persist: %v", err)
+		}
+
+		r.ConsistencyPolicy = litestream.ConsistencyPolicyRepair
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), 3*(db.MinCheckpointPageN+1); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a replica holding WAL data the database did not write is
+	// reported regardless of policy.
+	t.Run("Ahead", func(t *testing.T) {
+		db, r, _, teardown := setup(t, 1, -1)
+		defer teardown()
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(r.WALPath(pos.Generation, pos.Index+1), make([]byte, litestream.WALHeaderSize), 0600); err != nil {
+			t.Fatal(err)
+		}
+		r = reopen(t, db, r)
+
+		for _, policy := range []string{litestream.ConsistencyPolicyError, litestream.ConsistencyPolicyRepair} {
+			r.ConsistencyPolicy = policy
+			if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrReplicaAhead) {
+				t.Fatalf("policy=%s: unexpected error: %v", policy, err)
+			}
+		}
+	})
+
+	// Ensure checks can be disabled.
+	t.Run("None", func(t *testing.T) {
+		db, r, _, teardown := setup(t, 1, -1)
+		defer teardown()
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(r.WALPath(pos.Generation, pos.Index+1), make([]byte, litestream.WALHeaderSize), 0600); err != nil {
+			t.Fatal(err)
+		}
+		r = reopen(t, db, r)
+
+		r.ConsistencyPolicy = litestream.ConsistencyPolicyNone
+		if err := r.Sync(context.Background()); errors.Is(err, litestream.ErrReplicaAhead) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustCopyDir recursively copies the files in src to dst.
+func MustCopyDir(tb testing.TB, src, dst string) {
+	tb.Helper()
+	if err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), buf, fi.Mode())
+	}); err != nil {
+		tb.Fatal(err)
+	}
+}
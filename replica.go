@@ -8,14 +8,17 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/litestream/internal"
-	"github.com/pierrec/lz4/v4"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -60,6 +63,24 @@ type Replica interface {
 
 	// Returns a reader for WAL data at the given position.
 	WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error)
+
+	// Enforces retention immediately & returns a summary of deleted files.
+	RunRetention(ctx context.Context) (RetentionResult, error)
+}
+
+// RetentionResult summarizes the files deleted when enforcing retention.
+type RetentionResult struct {
+	Generations []string // generations deleted entirely
+	SnapshotN   int      // number of snapshot files deleted
+	WALN        int      // number of WAL files deleted
+	Size        int64    // total bytes reclaimed
+
+	// True if a snapshot was created because no snapshots were retained.
+	Snapshotted bool
+
+	// True if nothing was deleted because no snapshots were retained & a
+	// snapshot could not be created during a maintenance window.
+	Deferred bool
 }
 
 // GenerationStats represents high level stats for a single generation.
@@ -77,9 +98,17 @@ type GenerationStats struct {
 const (
 	DefaultRetention              = 24 * time.Hour
 	DefaultRetentionCheckInterval = 1 * time.Hour
+	DefaultCompressionWorkers     = 1
+	DefaultDeleteConcurrency      = 4
+
+	// Maximum time spent uploading pending changes once replication stops.
+	DefaultShutdownSyncTimeout = 30 * time.Second
 )
 
 var _ Replica = (*FileReplica)(nil)
+var _ ObjectWriter = (*FileReplica)(nil)
+var _ CommitTimeReader = (*FileReplica)(nil)
+var _ ReplicaWriter = (*FileReplica)(nil)
 
 // FileReplica is a replica that replicates a DB to a local file path.
 type FileReplica struct {
@@ -87,8 +116,11 @@ type FileReplica struct {
 	name string // replica name, optional
 	dst  string // destination path
 
-	mu  sync.RWMutex
-	pos Pos // last position
+	mu          sync.RWMutex
+	pos         Pos // last position
+	snapshotSeq int // last snapshot request handled
+
+	retentionMu sync.Mutex // serializes retention runs & wal compression
 
 	wg     sync.WaitGroup
 	cancel func()
@@ -98,16 +130,85 @@ type FileReplica struct {
 	walIndexGauge      prometheus.Gauge
 	walOffsetGauge     prometheus.Gauge
 
+	compressionStats *CompressionStats
+
+	// WAL replicated since the latest snapshot.
+	walThreshold WALThreshold
+
 	// Time to keep snapshots and related WAL files.
 	// Database is snapshotted after interval and older WAL files are discarded.
 	Retention time.Duration
 
+	// Number of most recent snapshots, and their WAL files, to keep regardless
+	// of age. Snapshots kept by either Retention or this count are retained.
+	// Disabled if zero.
+	RetentionSnapshotN int
+
+	// Maximum number of generations to keep. After retention is enforced,
+	// the oldest generations beyond this count are deleted. The active &
+	// replicating generations are never deleted. Disabled if zero.
+	MaxGenerations int
+
 	// Time between checks for retention.
 	RetentionCheckInterval time.Duration
 
+	// Minimum time between syncs with the shadow WAL. Changes to a shadow
+	// WAL file during the interval are copied together & any pending changes
+	// are copied when replication stops. If zero, each change is copied as
+	// soon as the database detects it.
+	SyncInterval time.Duration
+
 	// Time between validation checks.
 	ValidationInterval time.Duration
 
+	// Thresholds for warning that the latest snapshot is stale, checked after
+	// each retention check. Disabled if zero.
+	SnapshotWarnAge  time.Duration
+	SnapshotWarnWALN int
+
+	// Thresholds of WAL files & raw WAL bytes replicated since the latest
+	// snapshot after which a new snapshot is taken in the background. This
+	// limits the WAL applied by a restore. Disabled if zero.
+	SnapshotAfterWALN     int
+	SnapshotAfterWALBytes int64
+
+	// Time between WAL continuity checks. Disabled if zero.
+	ContinuityCheckInterval time.Duration
+
+	// Policy applied when the replica's position is inconsistent with the
+	// local database position when it is recalculated, such as on startup.
+	// See ConsistencyPolicyError for policies.
+	ConsistencyPolicy string
+
+	// Maximum number of goroutines used to compress a single snapshot or WAL
+	// file. Files are lz4 frames of independently compressed blocks so this
+	// is also used to decompress snapshot blocks in parallel during restore.
+	// If zero or negative, one goroutine per CPU is used.
+	CompressionWorkers int
+
+	// Codec used to compress new snapshot & WAL files. Existing files are
+	// read with the codec registered for their extension. Defaults to lz4.
+	Codec *Codec
+
+	// If set, new snapshot & WAL files are encrypted with age after they are
+	// compressed & encrypted files are decrypted when read. Commit time
+	// indexes & other files are not encrypted.
+	Encryption *Encryption
+
+	// Maximum number of files deleted concurrently when enforcing retention.
+	DeleteConcurrency int
+
+	// If true, snapshots with identical contents are stored once by hard
+	// linking each snapshot to a file named by its SHA-256 hash in
+	// DedupDir. Files in DedupDir are deleted by retention once no snapshot
+	// links to them. Encrypted snapshots are never identical.
+	DedupSnapshots bool
+
+	// Directory of deduplicated snapshot contents. It must be on the same
+	// filesystem as the replica & can be shared by replicas of other
+	// databases. Defaults to the "objects" directory in the replica path.
+	DedupDir string
+
 	// If true, replica monitors database for changes automatically.
 	// Set to false if replica is being used synchronously (such as in tests).
 	MonitorEnabled bool
@@ -123,6 +224,10 @@ func NewFileReplica(db *DB, name, dst string) *FileReplica {
 
 		Retention:              DefaultRetention,
 		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		ConsistencyPolicy:      DefaultConsistencyPolicy,
+		CompressionWorkers:     DefaultCompressionWorkers,
+		Codec:                  LookupCodec(DefaultCompression),
+		DeleteConcurrency:      DefaultDeleteConcurrency,
 		MonitorEnabled:         true,
 	}
 
@@ -134,6 +239,7 @@ func NewFileReplica(db *DB, name, dst string) *FileReplica {
 	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
 	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
 	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.compressionStats = NewCompressionStats(db, r.Name())
 
 	return r
 }
@@ -161,6 +267,18 @@ func (r *FileReplica) Path() string {
 	return r.dst
 }
 
+// URL returns the location of the replica as a "file" URL.
+func (r *FileReplica) URL() string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(r.dst)}).String()
+}
+
+// lastSnapshotSeq returns the last snapshot request handled by the replica.
+func (r *FileReplica) lastSnapshotSeq() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotSeq
+}
+
 // LastPos returns the last successfully replicated position.
 func (r *FileReplica) LastPos() Pos {
 	r.mu.RLock()
@@ -168,6 +286,11 @@ func (r *FileReplica) LastPos() Pos {
 	return r.pos
 }
 
+// CompressionStats returns the compression ratio stats for the replica.
+func (r *FileReplica) CompressionStats() *CompressionStats {
+	return r.compressionStats
+}
+
 // GenerationDir returns the path to a generation's root directory.
 func (r *FileReplica) GenerationDir(generation string) string {
 	return filepath.Join(r.dst, "generations", generation)
@@ -178,9 +301,21 @@ func (r *FileReplica) SnapshotDir(generation string) string {
 	return filepath.Join(r.GenerationDir(generation), "snapshots")
 }
 
-// SnapshotPath returns the path to a snapshot file.
+// SnapshotPath returns the path to a snapshot file written with the replica's codec.
 func (r *FileReplica) SnapshotPath(generation string, index int) string {
-	return filepath.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x.snapshot.lz4", index))
+	return filepath.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, SnapshotExt, r.codec().Ext))
+}
+
+// codec returns the codec used to write new files.
+func (r *FileReplica) codec() *Codec {
+	c := r.Codec
+	if c == nil {
+		c = LookupCodec(DefaultCompression)
+	}
+	if r.Encryption.CanEncrypt() {
+		return r.Encryption.Codec(c)
+	}
+	return c
 }
 
 // MaxSnapshotIndex returns the highest index for the snapshots.
@@ -214,6 +349,21 @@ func (r *FileReplica) WALPath(generation string, index int) string {
 	return filepath.Join(r.WALDir(generation), fmt.Sprintf("%08x.wal", index))
 }
 
+// SnapshotChecksumPath returns the path to the checksum of a snapshot file.
+func (r *FileReplica) SnapshotChecksumPath(generation string, index int) string {
+	return filepath.Join(r.SnapshotDir(generation), FormatSnapshotChecksumPath(index))
+}
+
+// WALChecksumPath returns the path to the checksum of a WAL file.
+func (r *FileReplica) WALChecksumPath(generation string, index int) string {
+	return filepath.Join(r.WALDir(generation), FormatWALChecksumPath(index))
+}
+
+// CommitTimesPath returns the path to the commit time index of a WAL file.
+func (r *FileReplica) CommitTimesPath(generation string, index int) string {
+	return filepath.Join(r.WALDir(generation), FormatCommitTimesPath(index))
+}
+
 // Generations returns a list of available generation names.
 func (r *FileReplica) Generations(ctx context.Context) ([]string, error) {
 	fis, err := ioutil.ReadDir(filepath.Join(r.dst, "generations"))
@@ -402,10 +552,11 @@ func (r *FileReplica) Start(ctx context.Context) {
 	ctx, r.cancel = context.WithCancel(ctx)
 
 	// Start goroutine to replicate data.
-	r.wg.Add(3)
+	r.wg.Add(4)
 	go func() { defer r.wg.Done(); r.monitor(ctx) }()
 	go func() { defer r.wg.Done(); r.retainer(ctx) }()
 	go func() { defer r.wg.Done(); r.validator(ctx) }()
+	go func() { defer r.wg.Done(); r.continuityChecker(ctx) }()
 }
 
 // Stop cancels any outstanding replication and blocks until finished.
@@ -421,20 +572,51 @@ func (r *FileReplica) monitor(ctx context.Context) {
 		log.Printf("%s(%s): monitor: cannot remove tmp files: %s", r.db.Path(), r.Name(), err)
 	}
 
+	// Copy pending changes once replication stops.
+	defer r.flush()
+
+	// Enforce a minimum time between synchronization, if set.
+	var tick <-chan time.Time
+	if r.SyncInterval > 0 {
+		ticker := time.NewTicker(r.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
 	// Continuously check for new data to replicate.
 	ch := make(chan struct{})
 	close(ch)
 	var notify <-chan struct{} = ch
+	priority := r.db.PriorityNotify()
+
+	var resume <-chan time.Time
+	for initial := true; ; initial = false {
+		// Wait for the sync interval unless a change to a priority table
+		// needs to be copied immediately.
+		if !initial && tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-priority:
+			}
+		}
 
-	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-notify:
+		case <-resume:
 		}
 
-		// Fetch new notify channel before replicating data.
-		notify = r.db.Notify()
+		// Fetch new notify channels before replicating data.
+		notify, priority = r.db.Notify(), r.db.PriorityNotify()
+		resume = nil
+
+		// Catch up once the maintenance window ends even if nothing changes.
+		if d := r.db.MaintenanceRemaining(); d > 0 {
+			resume = time.After(d)
+		}
 
 		// Synchronize the shadow wal into the replication directory.
 		if err := r.Sync(ctx); err != nil {
@@ -444,8 +626,27 @@ func (r *FileReplica) monitor(ctx context.Context) {
 	}
 }
 
+// flush syncs changes which have not been replicated yet, such as changes
+// batched by SyncInterval, after the monitor stops.
+func (r *FileReplica) flush() {
+	if pos, err := r.db.Pos(); err != nil || pos.IsZero() || pos == r.LastPos() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownSyncTimeout)
+	defer cancel()
+	if err := r.Sync(ctx); err != nil {
+		log.Printf("%s(%s): shutdown sync error: %s", r.db.Path(), r.Name(), err)
+	}
+}
+
 // retainer runs in a separate goroutine and handles retention.
 func (r *FileReplica) retainer(ctx context.Context) {
+	// Exit if retention is only run on demand.
+	if r.RetentionCheckInterval <= 0 {
+		return
+	}
+
 	ticker := time.NewTicker(r.RetentionCheckInterval)
 	defer ticker.Stop()
 
@@ -458,6 +659,11 @@ func (r *FileReplica) retainer(ctx context.Context) {
 				log.Printf("%s(%s): retainer error: %s", r.db.Path(), r.Name(), err)
 				continue
 			}
+
+			if err := CheckSnapshotStaleness(ctx, r, r.SnapshotWarnAge, r.SnapshotWarnWALN); err != nil {
+				log.Printf("%s(%s): snapshot check error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
 		}
 	}
 }
@@ -490,6 +696,29 @@ func (r *FileReplica) validator(ctx context.Context) {
 	}
 }
 
+// continuityChecker runs in a separate goroutine and periodically verifies
+// that the current generation has no missing WAL indices.
+func (r *FileReplica) continuityChecker(ctx context.Context) {
+	if r.ContinuityCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ContinuityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := CheckWALContinuity(ctx, r); err != nil {
+				log.Printf("%s(%s): continuity check error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
 // CalcPos returns the position for the replica for the current generation.
 // Returns a zero value if there is no active generation.
 func (r *FileReplica) CalcPos(ctx context.Context, generation string) (pos Pos, err error) {
@@ -549,15 +778,58 @@ func (r *FileReplica) snapshot(ctx context.Context, generation string, index int
 		return nil
 	}
 
+	release, err := r.db.AcquireUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	startTime := time.Now()
 
-	if err := mkdirAll(filepath.Dir(snapshotPath), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
+	f, err := os.Open(r.db.Path())
+	if err != nil {
 		return err
-	} else if err := compressFile(r.db.Path(), snapshotPath, r.db.uid, r.db.gid); err != nil {
+	}
+	defer f.Close()
+
+	// Snapshot only changed pages if incremental snapshots are enabled.
+	src, err := r.db.NewSnapshotSource(f, r.Name(), generation, index)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+	cw := NewChecksumWriter()
+	if err := mkdirAll(filepath.Dir(snapshotPath), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
+		return err
+	} else if err := compressReader(io.TeeReader(src, cw), snapshotPath, r.db.mode, r.db.uid, r.db.gid, r.codec(), r.CompressionWorkers); err != nil {
+		return err
+	} else if err := r.dedupSnapshot(snapshotPath); err != nil {
+		return fmt.Errorf("cannot dedup snapshot: %w", err)
+	} else if err := r.writeSnapshotChecksum(generation, index, cw.Checksum()); err != nil {
+		return fmt.Errorf("cannot write snapshot checksum: %w", err)
+	}
+	var size int64
+	if fi, err := os.Stat(snapshotPath); err == nil {
+		size = fi.Size()
+		r.compressionStats.Add(src.Size, size)
+	}
+	src.Commit()
+	r.db.MarkReplicaSnapshotted(r.Name(), time.Now())
+	r.db.ReportSnapshot(SnapshotInfo{
+		Name:       filepath.Base(snapshotPath),
+		Replica:    r.Name(),
+		Generation: generation,
+		Index:      index,
+		Size:       size,
+		CreatedAt:  time.Now().UTC(),
+	})
+	r.walThreshold.Reset(generation, index)
+
+	if src.IsLayer() {
+		log.Printf("%s(%s): snapshot: creating %s/%08x base=%08x pages=%d t=%s", r.db.Path(), r.Name(), generation, index, src.BaseIndex, src.PageN, time.Since(startTime))
+	} else {
+		log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+	}
 	return nil
 }
 
@@ -581,6 +853,10 @@ func (r *FileReplica) snapshotN(generation string) (int, error) {
 
 // Sync replays data from the shadow WAL into the file replica.
 func (r *FileReplica) Sync(ctx context.Context) (err error) {
+	// Changes to the shadow WAL before this time are uploaded by a successful sync.
+	startTime := time.Now()
+	defer func() { r.db.MarkReplicaSyncResult(r.Name(), err) }()
+
 	// Clear last position if if an error occurs during sync.
 	defer func() {
 		if err != nil {
@@ -601,7 +877,16 @@ func (r *FileReplica) Sync(ctx context.Context) (err error) {
 
 	Tracef("%s(%s): replica sync: db.pos=%s", r.db.Path(), r.Name(), dpos)
 
-	// Create snapshot if no snapshots exist for generation.
+	// Skip uploading during a maintenance window. The shadow WAL is retained
+	// until the replica catches up after the window ends. Uploads are also
+	// skipped while replication is paused.
+	if r.db.MaintenanceRemaining() > 0 || r.db.Paused() {
+		return nil
+	}
+
+	// Create snapshot if no snapshots exist for generation or if the
+	// database has requested a new snapshot since the last sync.
+	seq, reason := r.db.SnapshotRequest()
 	if n, err := r.snapshotN(generation); err != nil {
 		return err
 	} else if n == 0 {
@@ -609,10 +894,21 @@ func (r *FileReplica) Sync(ctx context.Context) (err error) {
 			return err
 		}
 		r.snapshotTotalGauge.Set(1.0)
+		r.db.ReportGeneration(r.Name(), generation)
+	} else if seq > r.lastSnapshotSeq() {
+		if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+			return err
+		}
+		log.Printf("%s(%s): snapshot: reason=%s", r.db.Path(), r.Name(), reason)
+		r.snapshotTotalGauge.Set(float64(n + 1))
 	} else {
 		r.snapshotTotalGauge.Set(float64(n))
 	}
 
+	r.mu.Lock()
+	r.snapshotSeq = seq
+	r.mu.Unlock()
+
 	// Determine position, if necessary.
 	if r.LastPos().Generation != generation {
 		pos, err := r.CalcPos(ctx, generation)
@@ -620,6 +916,11 @@ func (r *FileReplica) Sync(ctx context.Context) (err error) {
 			return fmt.Errorf("cannot determine replica position: %s", err)
 		}
 
+		// Ensure the replica can resume from its position.
+		if pos, err = ReconcileReplicaPos(ctx, r, r.ConsistencyPolicy, dpos, pos, r.snapshot); err != nil {
+			return err
+		}
+
 		Tracef("%s(%s): replica sync: calc new pos: %s", r.db.Path(), r.Name(), pos)
 		r.mu.Lock()
 		r.pos = pos
@@ -642,9 +943,37 @@ func (r *FileReplica) Sync(ctx context.Context) (err error) {
 		}
 	}
 
+	r.db.MarkReplicaSynced(r.Name(), startTime)
+
+	r.snapshotAfterWAL(ctx)
+
 	return nil
 }
 
+// snapshotAfterWAL starts a snapshot in the background if the WAL replicated
+// since the latest snapshot exceeds SnapshotAfterWALN or SnapshotAfterWALBytes.
+// WAL replication continues while the snapshot is taken.
+func (r *FileReplica) snapshotAfterWAL(ctx context.Context) {
+	pos := r.LastPos()
+	if !r.walThreshold.Begin(pos, r.SnapshotAfterWALN, r.SnapshotAfterWALBytes) {
+		return
+	}
+	n, size := r.walThreshold.Stats(pos)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.walThreshold.End()
+
+		if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+			log.Printf("%s(%s): snapshot error: reason=%s: %s", r.db.Path(), r.Name(), SnapshotReasonWALThreshold, err)
+			return
+		}
+		r.walThreshold.Reset(pos.Generation, pos.Index)
+		log.Printf("%s(%s): snapshot: reason=%s files=%d bytes=%d", r.db.Path(), r.Name(), SnapshotReasonWALThreshold, n, size)
+	}()
+}
+
 func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 	rd, err := r.db.ShadowWALReader(r.LastPos())
 	if err == io.EOF {
@@ -654,6 +983,12 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 	}
 	defer rd.Close()
 
+	release, err := r.db.AcquireUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	// Ensure parent directory exists for WAL file.
 	filename := r.WALPath(rd.Pos().Generation, rd.Pos().Index)
 	if err := mkdirAll(filepath.Dir(filename), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
@@ -673,6 +1008,12 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 		return err
 	}
 
+	// Extend the checksum of the WAL file with the copied bytes.
+	cw, err := r.walChecksumWriter(rd.Pos().Generation, rd.Pos().Index, rd.Pos().Offset)
+	if err != nil {
+		return fmt.Errorf("wal checksum: %w", err)
+	}
+
 	// Copy header if at offset zero.
 	var psalt uint64 // previous salt value
 	if pos := rd.Pos(); pos.Offset == 0 {
@@ -687,7 +1028,9 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 		if err != nil {
 			return err
 		}
+		_, _ = cw.Write(buf)
 		r.walBytesCounter.Add(float64(n))
+		r.walThreshold.Add(int64(n))
 	}
 
 	// Copy frames.
@@ -713,13 +1056,22 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 		if err != nil {
 			return err
 		}
+		_, _ = cw.Write(buf)
 		r.walBytesCounter.Add(float64(n))
+		r.walThreshold.Add(int64(n))
 	}
 
 	if err := w.Sync(); err != nil {
 		return err
 	} else if err := w.Close(); err != nil {
 		return err
+	} else if err := writeFileAtomic(r.WALChecksumPath(rd.Pos().Generation, rd.Pos().Index), EncodeWALChecksum(cw.Checksum(), rd.Pos().Offset), r.db.mode, r.db.uid, r.db.gid); err != nil {
+		return fmt.Errorf("cannot write wal checksum: %w", err)
+	}
+
+	// Copy commit times of the replicated frames.
+	if err := r.syncCommitTimes(rd.Pos()); err != nil {
+		return fmt.Errorf("cannot sync commit times: %w", err)
 	}
 
 	// Save last replicated position.
@@ -734,8 +1086,85 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 	return nil
 }
 
-// compress compresses all WAL files before the current one.
+// syncCommitTimes writes the commit times recorded for the WAL at pos through
+// its offset, if the database records commit times.
+func (r *FileReplica) syncCommitTimes(pos Pos) error {
+	a, err := r.db.ShadowCommitTimes(pos.Generation, pos.Index, pos.Offset)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	filename := r.CommitTimesPath(pos.Generation, pos.Index)
+	if err := ioutil.WriteFile(filename+".tmp", EncodeCommitTimes(a), r.db.mode); err != nil {
+		return err
+	}
+	_ = os.Chown(filename+".tmp", r.db.uid, r.db.gid)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// walChecksumWriter returns a checksum writer for the WAL file at index which
+// continues from the checksum of its first offset bytes. The checksum is
+// recalculated from the WAL file if its checksum file is missing or covers a
+// different size, such as after a crash between writing the two files.
+func (r *FileReplica) walChecksumWriter(generation string, index int, offset int64) (*ChecksumWriter, error) {
+	if offset == 0 {
+		return NewChecksumWriter(), nil
+	}
+
+	if buf, err := ioutil.ReadFile(r.WALChecksumPath(generation, index)); err == nil {
+		if checksum, size, err := DecodeWALChecksum(buf); err == nil && size == offset {
+			if cw, err := resumeChecksumWriter(checksum); err == nil {
+				return cw, nil
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.Open(r.WALPath(generation, index))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cw := NewChecksumWriter()
+	if _, err := io.CopyN(cw, f, offset); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// writeSnapshotChecksum atomically writes the checksum of a snapshot file.
+func (r *FileReplica) writeSnapshotChecksum(generation string, index int, checksum string) error {
+	filename := r.SnapshotChecksumPath(generation, index)
+	if err := ioutil.WriteFile(filename+".tmp", []byte(checksum+"\n"), r.db.mode); err != nil {
+		return err
+	}
+	_ = os.Chown(filename+".tmp", r.db.uid, r.db.gid)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// CommitTimes returns the commit time index of a WAL file.
+// Returns os.ErrNotExist if the WAL file has no commit time index.
+func (r *FileReplica) CommitTimes(ctx context.Context, generation string, index int) ([]CommitTime, error) {
+	f, err := os.Open(r.CommitTimesPath(generation, index))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCommitTimes(f)
+}
+
+// compress compresses all WAL files before the current one. WAL files are
+// left as-is if the replica's codec does not compress.
 func (r *FileReplica) compress(ctx context.Context, generation string) error {
+	codec := r.codec()
+	if codec.Ext == "" {
+		return nil
+	}
+
 	filenames, err := filepath.Glob(filepath.Join(r.WALDir(generation), "*.wal"))
 	if err != nil {
 		return err
@@ -747,6 +1176,10 @@ func (r *FileReplica) compress(ctx context.Context, generation string) error {
 	sort.Strings(filenames)
 	filenames = filenames[:len(filenames)-1]
 
+	// Prevent retention from deleting files while they are compressed.
+	r.retentionMu.Lock()
+	defer r.retentionMu.Unlock()
+
 	// Compress each file from oldest to newest.
 	for _, filename := range filenames {
 		select {
@@ -755,10 +1188,18 @@ func (r *FileReplica) compress(ctx context.Context, generation string) error {
 		default:
 		}
 
-		dst := filename + ".lz4"
-		if err := compressFile(filename, dst, r.db.uid, r.db.gid); err != nil {
+		// Skip files removed by retention since they were listed.
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+
+		dst := filename + codec.Ext
+		if err := compressFile(filename, dst, r.db.uid, r.db.gid, codec, r.CompressionWorkers); err != nil {
 			return err
-		} else if err := os.Remove(filename); err != nil {
+		}
+		r.trackCompression(filename, dst)
+
+		if err := os.Remove(filename); err != nil {
 			return err
 		}
 	}
@@ -766,6 +1207,20 @@ func (r *FileReplica) compress(ctx context.Context, generation string) error {
 	return nil
 }
 
+// trackCompression records the compression ratio of src compressed into dst.
+// Sizes are ignored if either file cannot be stat'd.
+func (r *FileReplica) trackCompression(src, dst string) {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		return
+	}
+	r.compressionStats.Add(sfi.Size(), dfi.Size())
+}
+
 // SnapshotReader returns a reader for snapshot data at the given generation/index.
 // Returns os.ErrNotExist if no matching index is found.
 func (r *FileReplica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
@@ -782,18 +1237,32 @@ func (r *FileReplica) SnapshotReader(ctx context.Context, generation string, ind
 			continue
 		}
 
-		// Open & return the file handle if uncompressed.
+		codec := ObjectCodec(strings.TrimPrefix(ext, SnapshotExt), r.Encryption)
+		assert(codec != nil, "invalid snapshot extension")
+
+		// Wrap in a decompressing reader for the codec of the extension and
+		// return with wrapper to ensure that the codec reader & the
+		// underlying file are closed.
 		f, err := os.Open(filepath.Join(dir, fi.Name()))
 		if err != nil {
 			return nil, err
-		} else if ext == ".snapshot" {
-			return f, nil // not compressed, return as-is.
 		}
-		assert(ext == ".snapshot.lz4", "invalid snapshot extension")
-
-		// If compressed, wrap in an lz4 reader and return with wrapper to
-		// ensure that the underlying file is closed.
-		return internal.NewReadCloser(lz4.NewReader(f), f), nil
+		zr, err := NewObjectReader(f, codec, r.CompressionWorkers)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("snapshot %s/%08x: %w", generation, index, err)
+		}
+		rc := internal.NewReadCloser(zr, f)
+
+		// Verify the contents against the stored checksum, if one exists.
+		// Snapshots written by earlier versions have no checksum.
+		if buf, err := ioutil.ReadFile(r.SnapshotChecksumPath(generation, index)); err == nil {
+			return internal.NewReadCloser(NewChecksumReader(zr, string(buf), fmt.Sprintf("snapshot %s/%08x", generation, index)), rc), nil
+		} else if !os.IsNotExist(err) {
+			rc.Close()
+			return nil, err
+		}
+		return rc, nil
 	}
 	return nil, os.ErrNotExist
 }
@@ -801,6 +1270,35 @@ func (r *FileReplica) SnapshotReader(ctx context.Context, generation string, ind
 // WALReader returns a reader for WAL data at the given index.
 // Returns os.ErrNotExist if no matching index is found.
 func (r *FileReplica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	rc, err := r.openWAL(generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the uncompressed contents if a checksum was written with the
+	// WAL file. The checksum file is read after the WAL file is opened so it
+	// never covers more bytes than are read. WAL files written by older
+	// versions have no checksum.
+	buf, err := ioutil.ReadFile(r.WALChecksumPath(generation, index))
+	if os.IsNotExist(err) {
+		return rc, nil
+	} else if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	name := fmt.Sprintf("wal %s/%08x", generation, index)
+	checksum, size, err := DecodeWALChecksum(buf)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return internal.NewReadCloser(NewWALChecksumReader(rc, checksum, size, name), rc), nil
+}
+
+// openWAL returns a reader for the uncompressed contents of the WAL file at
+// the given generation/index. Returns os.ErrNotExist if no file is found.
+func (r *FileReplica) openWAL(generation string, index int) (io.ReadCloser, error) {
 	filename := r.WALPath(generation, index)
 
 	// Attempt to read uncompressed file first.
@@ -811,74 +1309,418 @@ func (r *FileReplica) WALReader(ctx context.Context, generation string, index in
 		return nil, err
 	}
 
-	// Otherwise read the compressed file. Return error if file doesn't exist.
-	f, err = os.Open(filename + ".lz4")
+	// Otherwise read the file compressed with any registered codec.
+	// Return error if no file exists.
+	codec, err := r.walCodec(filename)
 	if err != nil {
 		return nil, err
 	}
+	if f, err = os.Open(filename + codec.Ext); err != nil {
+		return nil, err
+	}
+
+	// Wrap in a decompressing reader and return with wrapper to ensure that
+	// the underlying file is closed.
+	zr, err := NewObjectReader(f, codec, r.CompressionWorkers)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("wal %s/%08x: %w", generation, index, err)
+	}
+	return internal.NewReadCloser(zr, f), nil
+}
+
+// walCodec returns the codec of the compressed or encrypted WAL file for the
+// uncompressed WAL path filename. Returns os.ErrNotExist if no such file exists.
+func (r *FileReplica) walCodec(filename string) (*Codec, error) {
+	for _, codec := range Codecs() {
+		for _, ext := range []string{codec.Ext, codec.Ext + EncryptionExt} {
+			if ext == "" {
+				continue
+			} else if _, err := os.Stat(filename + ext); err == nil {
+				return ObjectCodec(ext, r.Encryption), nil
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+}
+
+// WriteObject writes the contents of rd to key, relative to the replica path.
+// Data is written to a temporary file and then atomically moved into place.
+func (r *FileReplica) WriteObject(ctx context.Context, key string, rd io.Reader) (err error) {
+	if err := ValidateObjectKey(key); err != nil {
+		return err
+	}
+	filename := filepath.Join(r.dst, filepath.FromSlash(key))
+
+	mode, dirmode, uid, gid := r.fileModes()
+	if err := mkdirAll(filepath.Dir(filename), dirmode, uid, gid); err != nil {
+		return err
+	}
+
+	tmpPath := filename + ".tmp"
+	f, err := createFile(tmpPath, mode, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := io.Copy(f, rd); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filename)
+}
+
+// WriteSnapshot compresses the snapshot of generation at index from rd into
+// the replica along with its checksum. The modification time of the snapshot
+// is set to createdAt, if not zero.
+func (r *FileReplica) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error {
+	filename := r.SnapshotPath(generation, index)
+	mode, dirmode, uid, gid := r.fileModes()
+	if err := mkdirAll(filepath.Dir(filename), dirmode, uid, gid); err != nil {
+		return err
+	}
+
+	cw := NewChecksumWriter()
+	if err := compressReader(io.TeeReader(rd, cw), filename, mode, uid, gid, r.codec(), r.CompressionWorkers); err != nil {
+		return err
+	} else if err := writeFileAtomic(r.SnapshotChecksumPath(generation, index), []byte(cw.Checksum()+"\n"), mode, uid, gid); err != nil {
+		return fmt.Errorf("cannot write snapshot checksum: %w", err)
+	}
+	return setModTime(filename, createdAt)
+}
+
+// WriteWAL compresses the WAL file of generation at index from rd into the
+// replica along with its checksum. Any uncompressed copy of the WAL file is removed. The modification
+// time of the WAL file is set to createdAt, if not zero.
+func (r *FileReplica) WriteWAL(ctx context.Context, generation string, index int, rd io.Reader, createdAt time.Time) error {
+	filename := r.WALPath(generation, index)
+	mode, dirmode, uid, gid := r.fileModes()
+	if err := mkdirAll(filepath.Dir(filename), dirmode, uid, gid); err != nil {
+		return err
+	}
 
-	// If compressed, wrap in an lz4 reader and return with wrapper to
-	// ensure that the underlying file is closed.
-	return internal.NewReadCloser(lz4.NewReader(f), f), nil
+	codec := r.codec()
+	cw := NewChecksumWriter()
+	rc := internal.NewReadCounter(io.TeeReader(rd, cw))
+	if err := compressReader(rc, filename+codec.Ext, mode, uid, gid, codec, r.CompressionWorkers); err != nil {
+		return err
+	} else if err := writeFileAtomic(r.WALChecksumPath(generation, index), EncodeWALChecksum(cw.Checksum(), rc.N()), mode, uid, gid); err != nil {
+		return fmt.Errorf("cannot write wal checksum: %w", err)
+	} else if codec.Ext != "" {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return setModTime(filename+codec.Ext, createdAt)
 }
 
+// WriteCommitTimes writes the commit time index of the WAL file of generation
+// at index.
+func (r *FileReplica) WriteCommitTimes(ctx context.Context, generation string, index int, a []CommitTime) error {
+	filename := r.CommitTimesPath(generation, index)
+	mode, dirmode, uid, gid := r.fileModes()
+	if err := mkdirAll(filepath.Dir(filename), dirmode, uid, gid); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, EncodeCommitTimes(a), mode, uid, gid)
+}
+
+// fileModes returns the permissions & ownership of new files & directories.
+// The database's are used if available.
+func (r *FileReplica) fileModes() (mode, dirmode os.FileMode, uid, gid int) {
+	if r.db == nil {
+		return 0600, 0700, -1, -1
+	}
+	return r.db.mode, r.db.dirmode, r.db.uid, r.db.gid
+}
+
+// writeFileAtomic writes data to a temporary file & moves it to filename.
+func writeFileAtomic(filename string, data []byte, mode os.FileMode, uid, gid int) error {
+	if err := ioutil.WriteFile(filename+".tmp", data, mode); err != nil {
+		return err
+	}
+	_ = os.Chown(filename+".tmp", uid, gid)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// setModTime sets the access & modification times of filename to t.
+// No-op if t is zero.
+func setModTime(filename string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	return os.Chtimes(filename, t, t)
+}
+
+// DefragGeneration renumbers the snapshot & WAL files of a generation so that
+// its indices are contiguous from the lowest index. A gap may only be removed
+// if the index after it has a snapshot as restoring across the gap would skip
+// data. Returns the number of indices which were renumbered. Generations with
+// incremental snapshots cannot be renumbered.
+//
+// The renumbered generation is built in a separate directory from hard links
+// to every file of the generation, including checksum & commit time sidecars,
+// and then swapped into place with two renames. If the swap is interrupted,
+// the original generation is left with an ".old" suffix & is moved back by
+// the next defrag. This should not be run against a generation which is still
+// being written.
+func (r *FileReplica) DefragGeneration(ctx context.Context, generation string) (int, error) {
+	genDir := r.GenerationDir(generation)
+	tmpDir, oldDir := genDir+".defrag", genDir+".old"
+	if _, err := os.Stat(genDir); os.IsNotExist(err) {
+		if err := os.Rename(oldDir, genDir); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("restore interrupted defrag: %w", err)
+		}
+	}
+
+	snapshotFIs, err := ioutil.ReadDir(r.SnapshotDir(generation))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	walFIs, err := ioutil.ReadDir(r.WALDir(generation))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// Determine the set of indices used by snapshots & WAL files.
+	snapshotIndices := make(map[int]struct{})
+	indexSet := make(map[int]struct{})
+	for _, fi := range snapshotFIs {
+		if index, _, err := ParseSnapshotPath(fi.Name()); err == nil {
+			snapshotIndices[index], indexSet[index] = struct{}{}, struct{}{}
+		}
+	}
+	for _, fi := range walFIs {
+		if index, _, _, err := ParseWALPath(fi.Name()); err == nil {
+			indexSet[index] = struct{}{}
+		}
+	}
+	if len(indexSet) == 0 {
+		return 0, fmt.Errorf("generation not found: %s", generation)
+	}
+
+	indices := make([]int, 0, len(indexSet))
+	for index := range indexSet {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	// Map each index to its contiguous position & ensure each gap is followed
+	// by a snapshot so restores never apply WAL files across missing data.
+	m := make(map[int]int, len(indices))
+	var n int
+	for i, index := range indices {
+		m[index] = indices[0] + i
+		if m[index] != index {
+			n++
+		}
+
+		if i > 0 && index != indices[i-1]+1 {
+			if _, ok := snapshotIndices[index]; !ok {
+				return 0, fmt.Errorf("cannot defrag gap at %08x-%08x: no snapshot at index %08x", indices[i-1]+1, index-1, index)
+			}
+		}
+	}
+	if n == 0 {
+		return 0, nil // already contiguous
+	}
+
+	// Incremental snapshots refer to their base by index so renumbering
+	// would break them.
+	for index := range snapshotIndices {
+		if baseIndex, err := SnapshotBaseIndex(ctx, r, generation, index); err != nil {
+			return 0, err
+		} else if baseIndex >= 0 {
+			return 0, fmt.Errorf("cannot defrag generation with incremental snapshot at index %08x", index)
+		}
+	}
+
+	// Build renumbered generation in a temporary directory.
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return 0, err
+	} else if err := linkRenumbered(genDir, tmpDir, m); err != nil {
+		return 0, err
+	}
+
+	// Swap the renumbered generation into place & remove the original.
+	if err := os.RemoveAll(oldDir); err != nil {
+		return 0, err
+	} else if err := os.Rename(genDir, oldDir); err != nil {
+		return 0, err
+	} else if err := os.Rename(tmpDir, genDir); err != nil {
+		_ = os.Rename(oldDir, genDir) // restore original generation
+		return 0, err
+	} else if err := os.RemoveAll(oldDir); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// linkRenumbered hard links every file under src to the same path under dst.
+// Files in the snapshot & WAL directories are named by index, followed by an
+// extension, so their index is renumbered by m. Indexed files with no entry in
+// m, such as sidecars left behind by retention, are not linked.
+func linkRenumbered(src, dst string, m map[int]int) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0700)
+		}
+
+		if dir, name := filepath.Split(rel); dir == "snapshots"+string(filepath.Separator) || dir == "wal"+string(filepath.Separator) {
+			if a := indexedPathRegex.FindStringSubmatch(name); a != nil {
+				index, _ := strconv.ParseUint(a[1], 16, 64)
+				newIndex, ok := m[int(index)]
+				if !ok {
+					return nil
+				}
+				rel = filepath.Join(dir, fmt.Sprintf("%08x%s", newIndex, a[2]))
+			}
+		}
+		return os.Link(path, filepath.Join(dst, rel))
+	})
+}
+
+var indexedPathRegex = regexp.MustCompile(`^([0-9a-f]{8})([._].+)$`)
+
 // EnforceRetention forces a new snapshot once the retention interval has passed.
 // Older snapshots and WAL files are then removed.
 func (r *FileReplica) EnforceRetention(ctx context.Context) (err error) {
+	_, err = r.RunRetention(ctx)
+	return err
+}
+
+// RunRetention enforces retention & returns a summary of the deleted files.
+// It is safe to call while the replica is syncing. The generation of the
+// database & the generation being replicated are never deleted. A new
+// snapshot is only created if the database has been opened.
+func (r *FileReplica) RunRetention(ctx context.Context) (result RetentionResult, err error) {
+	r.retentionMu.Lock()
+	defer r.retentionMu.Unlock()
+
 	// Find current position of database.
 	pos, err := r.db.Pos()
 	if err != nil {
-		return fmt.Errorf("cannot determine current generation: %w", err)
+		return result, fmt.Errorf("cannot determine current generation: %w", err)
 	} else if pos.IsZero() {
-		return fmt.Errorf("no generation, waiting for data")
+		return result, fmt.Errorf("no generation, waiting for data")
 	}
 
 	// Obtain list of snapshots that are within the retention period.
-	snapshots, err := r.Snapshots(ctx)
+	all, err := r.Snapshots(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot obtain snapshot list: %w", err)
+		return result, fmt.Errorf("cannot obtain snapshot list: %w", err)
 	}
-	snapshots = FilterSnapshotsAfter(snapshots, time.Now().Add(-r.Retention))
+	snapshots := RetainedSnapshots(all, time.Now(), r.Retention, r.RetentionSnapshotN)
 
 	// If no retained snapshots exist, create a new snapshot.
-	if len(snapshots) == 0 {
+	if len(snapshots) == 0 && r.db.SQLDB() != nil {
+		if r.db.DeferRetention(r.Name()) {
+			result.Deferred = true
+			return result, nil
+		}
 		if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
-			return fmt.Errorf("cannot snapshot: %w", err)
+			return result, fmt.Errorf("cannot snapshot: %w", err)
 		}
 		snapshots = append(snapshots, &SnapshotInfo{Generation: pos.Generation, Index: pos.Index})
+		result.Snapshotted = true
+	}
+
+	// Keep the snapshots which retained incremental snapshots build on.
+	if snapshots, err = RetainSnapshotBases(ctx, r, all, snapshots); err != nil {
+		return result, fmt.Errorf("cannot find snapshot bases: %w", err)
 	}
 
 	// Loop over generations and delete unretained snapshots & WAL files.
 	generations, err := r.Generations(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot obtain generations: %w", err)
+		return result, fmt.Errorf("cannot obtain generations: %w", err)
 	}
 	for _, generation := range generations {
+		// Skip generations which are being restored.
+		if IsGenerationRestoring(r, generation) {
+			log.Printf("%s(%s): retainer: skipping generation %q, restore in progress", r.db.Path(), r.Name(), generation)
+			continue
+		}
+
 		// Find earliest retained snapshot for this generation.
 		snapshot := FindMinSnapshotByGeneration(snapshots, generation)
 
+		// Never delete the active or replicating generation, even if its
+		// snapshots are not retained.
+		if snapshot == nil && (generation == pos.Generation || generation == r.LastPos().Generation) {
+			continue
+		}
+
 		// Delete generations if it has no snapshots being retained.
 		if snapshot == nil {
 			log.Printf("%s(%s): retainer: deleting generation %q has no retained snapshots, deleting", r.db.Path(), r.Name(), generation)
-			if err := os.RemoveAll(r.GenerationDir(generation)); err != nil {
-				return fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
+			if err := r.deleteGeneration(ctx, generation, &result); err != nil {
+				return result, fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
 			}
+			result.Generations = append(result.Generations, generation)
 			continue
 		}
 
 		// Otherwise delete all snapshots & WAL files before a lowest retained index.
-		if err := r.deleteGenerationSnapshotsBefore(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("cannot delete generation %q snapshots before index %d: %w", generation, snapshot.Index, err)
-		} else if err := r.deleteGenerationWALBefore(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("cannot delete generation %q wal before index %d: %w", generation, snapshot.Index, err)
+		if err := r.deleteGenerationSnapshotsBefore(ctx, generation, snapshot.Index, &result); err != nil {
+			return result, fmt.Errorf("cannot delete generation %q snapshots before index %d: %w", generation, snapshot.Index, err)
+		} else if err := r.deleteGenerationWALBefore(ctx, generation, snapshot.Index, &result); err != nil {
+			return result, fmt.Errorf("cannot delete generation %q wal before index %d: %w", generation, snapshot.Index, err)
 		}
 	}
 
+	// Delete the oldest generations beyond the maximum generation count.
+	if err := r.pruneGenerations(ctx, pos, &result); err != nil {
+		return result, err
+	}
+
+	// Delete deduplicated snapshot contents no longer linked to a snapshot.
+	if err := r.pruneDedupObjects(ctx); err != nil {
+		return result, fmt.Errorf("cannot prune dedup objects: %w", err)
+	}
+	return result, nil
+}
+
+// pruneGenerations deletes the oldest generations beyond MaxGenerations. The
+// generation of the database at pos & the replicating generation are kept.
+func (r *FileReplica) pruneGenerations(ctx context.Context, pos Pos, result *RetentionResult) error {
+	excess, err := ExcessGenerations(ctx, r, r.MaxGenerations, pos.Generation, r.LastPos().Generation)
+	if err != nil {
+		return fmt.Errorf("cannot find excess generations: %w", err)
+	}
+
+	for _, g := range excess {
+		size := result.Size
+		if err := r.deleteGeneration(ctx, g.Generation, result); err != nil {
+			return fmt.Errorf("cannot delete generation %q: %w", g.Generation, err)
+		}
+		result.Generations = append(result.Generations, g.Generation)
+		log.Printf("%s(%s): retainer: pruned generation %q beyond max generations; age=%s size=%d", r.db.Path(), r.Name(), g.Generation, g.Age(time.Now()).Round(time.Second), result.Size-size)
+	}
 	return nil
 }
 
 // deleteGenerationSnapshotsBefore deletes snapshot before a given index.
-func (r *FileReplica) deleteGenerationSnapshotsBefore(ctx context.Context, generation string, index int) (err error) {
+func (r *FileReplica) deleteGenerationSnapshotsBefore(ctx context.Context, generation string, index int, result *RetentionResult) (err error) {
 	dir := r.SnapshotDir(generation)
 
 	fis, err := ioutil.ReadDir(dir)
@@ -888,29 +1730,40 @@ func (r *FileReplica) deleteGenerationSnapshotsBefore(ctx context.Context, gener
 		return err
 	}
 
-	var n int
+	var filenames, others []string
+	var size int64
 	for _, fi := range fis {
+		// Checksums are removed with their snapshots.
+		if idx, err := ParseSnapshotChecksumPath(fi.Name()); err == nil && idx < index {
+			others = append(others, filepath.Join(dir, fi.Name()))
+			size += fi.Size()
+			continue
+		}
+
 		idx, _, err := ParseSnapshotPath(fi.Name())
 		if err != nil {
 			continue
 		} else if idx >= index {
 			continue
 		}
+		filenames = append(filenames, filepath.Join(dir, fi.Name()))
+		size += fi.Size()
+	}
 
-		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
-			return err
-		}
-		n++
+	if err := r.removeFiles(ctx, append(filenames, others...)); err != nil {
+		return err
 	}
-	if n > 0 {
+	if n := len(filenames); n > 0 {
 		log.Printf("%s(%s): retainer: deleting snapshots before %s/%08x; n=%d", r.db.Path(), r.Name(), generation, index, n)
 	}
+	result.SnapshotN += len(filenames)
+	result.Size += size
 
 	return nil
 }
 
 // deleteGenerationWALBefore deletes WAL files before a given index.
-func (r *FileReplica) deleteGenerationWALBefore(ctx context.Context, generation string, index int) (err error) {
+func (r *FileReplica) deleteGenerationWALBefore(ctx context.Context, generation string, index int, result *RetentionResult) (err error) {
 	dir := r.WALDir(generation)
 
 	fis, err := ioutil.ReadDir(dir)
@@ -920,27 +1773,93 @@ func (r *FileReplica) deleteGenerationWALBefore(ctx context.Context, generation
 		return err
 	}
 
-	var n int
+	var filenames, others []string
+	var size int64
 	for _, fi := range fis {
+		// Commit time indexes & checksums are removed with their WAL files.
+		if idx, err := ParseCommitTimesPath(fi.Name()); err == nil && idx < index {
+			others = append(others, filepath.Join(dir, fi.Name()))
+			size += fi.Size()
+			continue
+		} else if idx, err := ParseWALChecksumPath(fi.Name()); err == nil && idx < index {
+			others = append(others, filepath.Join(dir, fi.Name()))
+			size += fi.Size()
+			continue
+		}
+
 		idx, _, _, err := ParseWALPath(fi.Name())
 		if err != nil {
 			continue
 		} else if idx >= index {
 			continue
 		}
+		filenames = append(filenames, filepath.Join(dir, fi.Name()))
+		size += fi.Size()
+	}
+
+	if err := r.removeFiles(ctx, append(others, filenames...)); err != nil {
+		return err
+	}
+	if n := len(filenames); n > 0 {
+		log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, n)
+	}
+	result.WALN += len(filenames)
+	result.Size += size
 
-		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+	return nil
+}
+
+// deleteGeneration removes all files in a generation concurrently and then
+// removes the generation directory itself.
+func (r *FileReplica) deleteGeneration(ctx context.Context, generation string, result *RetentionResult) error {
+	var filenames []string
+	var snapshotN, walN int
+	var size int64
+	for _, dir := range []string{r.SnapshotDir(generation), r.WALDir(generation)} {
+		fis, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
 			return err
 		}
-		n++
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+			filenames = append(filenames, filepath.Join(dir, fi.Name()))
+			size += fi.Size()
+
+			if _, _, err := ParseSnapshotPath(fi.Name()); err == nil {
+				snapshotN++
+			} else if _, _, _, err := ParseWALPath(fi.Name()); err == nil {
+				walN++
+			}
+		}
 	}
-	if n > 0 {
-		log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, n)
+
+	if err := r.removeFiles(ctx, filenames); err != nil {
+		return err
+	} else if err := os.RemoveAll(r.GenerationDir(generation)); err != nil {
+		return err
 	}
+	result.SnapshotN += snapshotN
+	result.WALN += walN
+	result.Size += size
 
 	return nil
 }
 
+// removeFiles deletes files using up to DeleteConcurrency goroutines.
+// Files which no longer exist are ignored.
+func (r *FileReplica) removeFiles(ctx context.Context, filenames []string) error {
+	return internal.ParallelBatches(ctx, r.DeleteConcurrency, len(filenames), 1, func(ctx context.Context, i, j int) error {
+		if err := os.Remove(filenames[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
 // SnapshotIndexAt returns the highest index for a snapshot within a generation
 // that occurs before timestamp. If timestamp is zero, returns the latest snapshot.
 func SnapshotIndexAt(ctx context.Context, r Replica, generation string, timestamp time.Time) (int, error) {
@@ -954,7 +1873,9 @@ func SnapshotIndexAt(ctx context.Context, r Replica, generation string, timestam
 	index := -1
 	var max time.Time
 	for _, snapshot := range snapshots {
-		if !timestamp.IsZero() && snapshot.CreatedAt.After(timestamp) {
+		if generation != "" && snapshot.Generation != generation {
+			continue // different generation, skip
+		} else if !timestamp.IsZero() && snapshot.CreatedAt.After(timestamp) {
 			continue // after timestamp, skip
 		}
 
@@ -1002,8 +1923,66 @@ func WALIndexAt(ctx context.Context, r Replica, generation string, maxIndex int,
 	return index, nil
 }
 
-// compressFile compresses a file and replaces it with a new file with a .lz4 extension.
-func compressFile(src, dst string, uid, gid int) error {
+// IsRestorable reports whether the replica can restore to timestamp t & returns
+// the position the restore would end at. The generation is chosen the same way
+// as CalcReplicaRestoreTarget. Returns false if t is outside the coverage of
+// every generation or if a WAL index between the selected snapshot & the
+// target index is missing, such as after retention pruned it.
+func IsRestorable(ctx context.Context, r Replica, t time.Time) (bool, Pos, error) {
+	opt := NewRestoreOptions()
+	opt.Timestamp = t
+
+	generation, _, err := CalcReplicaRestoreTarget(ctx, r, opt)
+	if err != nil {
+		return false, Pos{}, err
+	} else if generation == "" {
+		return false, Pos{}, nil // no generation covers timestamp
+	}
+
+	// Find latest snapshot before the timestamp.
+	minIndex, err := SnapshotIndexAt(ctx, r, generation, t)
+	if err == ErrNoSnapshots {
+		return false, Pos{}, nil
+	} else if err != nil {
+		return false, Pos{}, fmt.Errorf("cannot find snapshot index: %w", err)
+	}
+
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return false, Pos{}, fmt.Errorf("wals: %w", err)
+	}
+
+	// Collect the end offset of each WAL index after the snapshot. The restore
+	// applies whole WAL files so every segment of an index is included.
+	maxIndex := minIndex
+	offsets := make(map[int]int64)
+	for _, info := range wals {
+		if info.Generation != generation || info.Index < minIndex {
+			continue
+		}
+		if end := info.Offset + info.Size; end > offsets[info.Index] {
+			offsets[info.Index] = end
+		}
+		if info.CreatedAt.After(t) {
+			continue // after timestamp, not applied
+		} else if info.Index > maxIndex {
+			maxIndex = info.Index
+		}
+	}
+
+	// Ensure every WAL file up to the target index is still available. A
+	// snapshot-only restore does not require a WAL file.
+	for index := minIndex; index <= maxIndex; index++ {
+		if _, ok := offsets[index]; !ok && minIndex != maxIndex {
+			return false, Pos{}, nil
+		}
+	}
+	return true, Pos{Generation: generation, Index: maxIndex, Offset: offsets[maxIndex]}, nil
+}
+
+// compressFile compresses a file into a new file, dst, with codec c.
+// The workers argument limits the number of goroutines used by the compressor.
+func compressFile(src, dst string, uid, gid int, c *Codec, workers int) error {
 	r, err := os.Open(src)
 	if err != nil {
 		return err
@@ -1014,14 +1993,22 @@ func compressFile(src, dst string, uid, gid int) error {
 	if err != nil {
 		return err
 	}
+	return compressReader(r, dst, fi.Mode(), uid, gid, c, workers)
+}
 
-	w, err := createFile(dst+".tmp", fi.Mode(), uid, gid)
+// compressReader compresses the contents of r into a new file, dst, with
+// codec c. The file is written to a temporary file & then moved into place.
+func compressReader(r io.Reader, dst string, mode os.FileMode, uid, gid int, c *Codec, workers int) error {
+	w, err := createFile(dst+".tmp", mode, uid, gid)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	zr := lz4.NewWriter(w)
+	zr, err := NewObjectWriter(w, c, workers)
+	if err != nil {
+		return err
+	}
 	defer zr.Close()
 
 	// Copy & compress file contents to temporary file.
@@ -1054,7 +2041,7 @@ func ValidateReplica(ctx context.Context, r Replica) error {
 	// Compute checksum of primary database under lock. This prevents a
 	// sync from occurring and the database will not be written.
 	primaryPath := filepath.Join(tmpdir, "primary")
-	chksum0, pos, err := db.CRC64()
+	chksum0, pos, err := db.IntegrityChecksum()
 	if err != nil {
 		return fmt.Errorf("cannot compute checksum: %w", err)
 	}
@@ -1066,17 +2053,18 @@ func ValidateReplica(ctx context.Context, r Replica) error {
 
 	restorePath := filepath.Join(tmpdir, "replica")
 	if err := RestoreReplica(ctx, r, RestoreOptions{
-		OutputPath:  restorePath,
-		ReplicaName: r.Name(),
-		Generation:  pos.Generation,
-		Index:       pos.Index - 1,
-		Logger:      log.New(os.Stderr, "", 0),
+		OutputPath:      restorePath,
+		ReplicaName:     r.Name(),
+		Generation:      pos.Generation,
+		Index:           pos.Index - 1,
+		ValidateWALSalt: true,
+		Logger:          log.New(os.Stderr, "", 0),
 	}); err != nil {
 		return fmt.Errorf("cannot restore: %w", err)
 	}
 
 	// Open file handle for restored database.
-	chksum1, err := checksumFile(restorePath)
+	chksum1, err := integrityChecksumFile(db.IntegrityHash, restorePath)
 	if err != nil {
 		return err
 	}
@@ -1086,16 +2074,17 @@ func ValidateReplica(ctx context.Context, r Replica) error {
 	if mismatch {
 		status = "mismatch"
 	}
-	log.Printf("%s(%s): validator: status=%s db=%016x replica=%016x pos=%s", db.Path(), r.Name(), status, chksum0, chksum1, pos)
+	log.Printf("%s(%s): validator: status=%s hash=%s db=%s replica=%s pos=%s", db.Path(), r.Name(), status, db.IntegrityHash, chksum0, chksum1, pos)
 
 	// Validate checksums match.
 	if mismatch {
 		internal.ReplicaValidationTotalCounterVec.WithLabelValues(db.Path(), r.Name(), "error").Inc()
 
 		// Compress mismatched databases and report temporary path for investigation.
-		if err := compressFile(primaryPath, primaryPath+".lz4", db.uid, db.gid); err != nil {
+		codec := LookupCodec(DefaultCompression)
+		if err := compressFile(primaryPath, primaryPath+codec.Ext, db.uid, db.gid, codec, DefaultCompressionWorkers); err != nil {
 			return fmt.Errorf("cannot compress primary db: %w", err)
-		} else if err := compressFile(restorePath, restorePath+".lz4", db.uid, db.gid); err != nil {
+		} else if err := compressFile(restorePath, restorePath+codec.Ext, db.uid, db.gid, codec, DefaultCompressionWorkers); err != nil {
 			return fmt.Errorf("cannot compress replica db: %w", err)
 		}
 		log.Printf("%s(%s): validator: mismatch files @ %s", db.Path(), r.Name(), tmpdir)
@@ -1,8 +1,18 @@
 package litestream_test
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/litestream"
 )
@@ -79,6 +89,1035 @@ func TestFileReplica_Sync(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+
+	// Ensure changes are batched by the sync interval.
+	t.Run("SyncInterval", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SyncInterval = 100 * time.Millisecond
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first sync is performed immediately.
+		synced := db.ReplicaSyncNotify(r.Name())
+		start := time.Now()
+		r.MonitorEnabled = true
+		r.Start(context.Background())
+		defer r.Stop()
+		MustWaitReplicaSync(t, synced)
+		if got, want := r.LastPos(), pos0; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+
+		// Later changes are synced on the next tick of the sync interval.
+		synced = db.ReplicaSyncNotify(r.Name())
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		MustWaitReplicaSync(t, synced)
+		if elapsed := time.Since(start); elapsed < r.SyncInterval {
+			t.Fatalf("synced after %s, want at least %s", elapsed, r.SyncInterval)
+		} else if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure changes waiting for the sync interval are copied when
+	// replication stops.
+	t.Run("FlushOnStop", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SyncInterval = time.Hour
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		synced := db.ReplicaSyncNotify(r.Name())
+		r.MonitorEnabled = true
+		r.Start(context.Background())
+		MustWaitReplicaSync(t, synced)
+
+		// The change waits for the next tick, an hour away.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos0; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+
+		r.Stop()
+		if pos, err := db.Pos(); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+// Ensure changes to priority tables are copied without waiting for the sync interval.
+func TestFileReplica_PriorityTables(t *testing.T) {
+	db, sqldb := MustOpenPriorityDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+	r.SyncInterval = time.Hour
+	r.MonitorEnabled = true
+
+	MustReplicatePriorityChange(t, db, sqldb, r)
+}
+
+func TestFileReplica_Snapshot(t *testing.T) {
+	// Ensure a snapshot spanning multiple lz4 blocks round trips when
+	// compressed & decompressed with multiple workers.
+	t.Run("ParallelCompression", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.CompressionWorkers = 4
+
+		// Write more than several 4MB lz4 blocks into the database file.
+		MustInsertBlobs(t, sqldb, 3000)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := MustOpenSQLDB(t, opt.OutputPath)
+		defer MustCloseSQLDB(t, restored)
+		if got, want := MustQueryBlobs(t, restored), MustQueryBlobs(t, sqldb); len(got) != len(want) {
+			t.Fatalf("n=%d, want %d", len(got), len(want))
+		} else {
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Fatalf("blob mismatch: row=%d", i)
+				}
+			}
+		}
+	})
+
+	// Ensure a snapshot is taken in the background once more WAL files than
+	// the threshold have been replicated since the latest snapshot.
+	t.Run("AfterWALN", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SnapshotAfterWALN = 1
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		if n := MustSnapshotN(t, r); n != 1 {
+			t.Fatalf("n=%d, want 1 before threshold", n)
+		}
+
+		MustRollWALIndex(t, db, sqldb, r)
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the background snapshot at the replica position.
+		for i := 0; ; i++ {
+			if _, err := os.Stat(r.SnapshotPath(pos.Generation, pos.Index)); err == nil {
+				break
+			} else if i > 100 {
+				t.Fatalf("snapshot not found at %08x: %s", pos.Index, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Restore from the new snapshot.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := MustCountRows(t, opt.OutputPath, "foo"), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure the replicated WAL size threshold triggers a snapshot.
+	t.Run("AfterWALBytes", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SnapshotAfterWALBytes = 1
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		for i := 0; MustSnapshotN(t, r) < 2; i++ {
+			if i > 100 {
+				t.Fatal("expected background snapshot")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestFileReplica_Checksum(t *testing.T) {
+	// Ensure restore fails if a snapshot does not match its checksum.
+	t.Run("Snapshot", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.SnapshotChecksumPath(pos.Generation, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(r.SnapshotChecksumPath(pos.Generation, 0), []byte("0\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure restore fails if a WAL file is corrupted after it is replicated.
+	t.Run("WAL", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos := r.LastPos()
+		if got, want := MustRestoreRowCount(t, r, pos.Generation), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Flip a byte in the last frame of the WAL file.
+		MustFlipLastByte(t, r.WALPath(pos.Generation, pos.Index))
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a missing WAL checksum, such as one written by an older version,
+	// is recalculated from the WAL file on the next sync.
+	t.Run("MissingWALChecksum", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos := r.LastPos()
+		if err := os.Remove(r.WALChecksumPath(pos.Generation, pos.Index)); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos = r.LastPos()
+		buf, err := ioutil.ReadFile(r.WALChecksumPath(pos.Generation, pos.Index))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, size, err := litestream.DecodeWALChecksum(buf); err != nil {
+			t.Fatal(err)
+		} else if size != pos.Offset {
+			t.Fatalf("size=%d, want %d", size, pos.Offset)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestFileReplica_CompressionStats(t *testing.T) {
+	// Ensure the warning condition triggers when compressing random data.
+	t.Run("Incompressible", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE blobs (data BLOB);`); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 4096)
+		rnd := rand.New(rand.NewSource(0))
+		for i := 0; i < 512; i++ {
+			rnd.Read(data)
+			if _, err := sqldb.Exec(`INSERT INTO blobs (data) VALUES (?)`, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if ratio := r.CompressionStats().Ratio(); ratio <= 0 || ratio >= litestream.DefaultCompressionWarnRatio {
+			t.Fatalf("unexpected ratio: %f", ratio)
+		} else if !r.CompressionStats().Poor() {
+			t.Fatal("expected poor compression")
+		}
+	})
+
+	// Ensure the warning condition does not trigger for compressible data.
+	t.Run("Compressible", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE blobs (data BLOB);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 512; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO blobs (data) VALUES (zeroblob(4096))`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if ratio := r.CompressionStats().Ratio(); ratio < 2 {
+			t.Fatalf("unexpected ratio: %f", ratio)
+		} else if r.CompressionStats().Poor() {
+			t.Fatal("expected good compression")
+		}
+	})
+}
+
+func TestDB_CompressionTotals(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseSQLDB(t, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Ensure totals grow with each snapshot & WAL segment written.
+	var prev litestream.CompressionTotals
+	for i := 0; i < 3; i++ {
+		MustRollWALIndex(t, db, sqldb, r)
+
+		totals := db.CompressionTotals()
+		if totals.RawBytes <= prev.RawBytes {
+			t.Fatalf("RawBytes=%d, want > %d", totals.RawBytes, prev.RawBytes)
+		} else if totals.CompressedBytes <= prev.CompressedBytes {
+			t.Fatalf("CompressedBytes=%d, want > %d", totals.CompressedBytes, prev.CompressedBytes)
+		} else if got, want := float64(totals.RawBytes)/float64(totals.CompressedBytes), r.CompressionStats().Ratio(); got != want {
+			t.Fatalf("ratio=%f, want %f", got, want)
+		}
+		prev = totals
+	}
+	if prev.SavedBytes() <= 0 {
+		t.Fatalf("SavedBytes=%d, want > 0", prev.SavedBytes())
+	}
+
+	// Ensure the totals are persisted & restored when the database reopens.
+	if totals, err := litestream.ReadCompressionTotals(db.CompressionTotalsPath()); err != nil {
+		t.Fatal(err)
+	} else if totals != prev {
+		t.Fatalf("persisted totals=%+v, want %+v", totals, prev)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = MustOpenDBAt(t, db.Path())
+	defer MustCloseDB(t, db)
+	if totals := db.CompressionTotals(); totals != prev {
+		t.Fatalf("restored totals=%+v, want %+v", totals, prev)
+	}
+}
+
+func TestValidateReplica(t *testing.T) {
+	// Ensure validation succeeds using each integrity hash.
+	for _, integrityHash := range []string{litestream.IntegrityHashCRC64, litestream.IntegrityHashSHA256} {
+		integrityHash := integrityHash
+		t.Run(integrityHash, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			db.IntegrityHash = integrityHash
+			r := NewTestFileReplica(t, db)
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+			MustSyncDBReplica(t, db, r)
+
+			// Continuously sync the replica as validation waits for it to catch up.
+			done, stopped := make(chan struct{}), make(chan struct{})
+			defer func() { close(done); <-stopped }()
+			go func() {
+				defer close(stopped)
+				ticker := time.NewTicker(10 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						_ = db.Sync()
+						_ = r.Sync(context.Background())
+					}
+				}
+			}()
+
+			if err := litestream.ValidateReplica(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFileReplica_EnforceRetention(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+	r.DeleteConcurrency = 3
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write an expired generation with many files & a generation with a
+	// retained snapshot. Expire the snapshot of the active generation.
+	expired := time.Now().Add(-2 * r.Retention)
+	MustWriteGenerationFiles(t, r, "0000000000000001", 100, expired)
+	MustWriteGenerationFiles(t, r, "0000000000000002", 1, time.Now())
+	if err := os.Chtimes(r.SnapshotPath(pos.Generation, 0), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.EnforceRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure the expired generation is removed but the active generation is not.
+	if _, err := os.Stat(r.GenerationDir("0000000000000001")); !os.IsNotExist(err) {
+		t.Fatalf("expected expired generation to be deleted: %v", err)
+	} else if _, err := os.Stat(r.GenerationDir("0000000000000002")); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(r.SnapshotPath(pos.Generation, 0)); err != nil {
+		t.Fatalf("expected active generation to be retained: %v", err)
+	}
+}
+
+func TestFileReplica_RunRetention(t *testing.T) {
+	// Ensure unretained files are deleted & summarized in the result.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Write an expired generation & a generation with an expired snapshot
+		// followed by a retained snapshot at index 2.
+		expired := time.Now().Add(-2 * r.Retention)
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000001", 0), 100, expired)
+		for i := 0; i < 3; i++ {
+			MustWriteFileAt(t, r.WALPath("0000000000000001", i)+".lz4", 10, expired)
+		}
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000002", 0), 100, expired)
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000002", 2), 100, time.Now())
+		for i := 0; i < 4; i++ {
+			MustWriteFileAt(t, r.WALPath("0000000000000002", i)+".lz4", 10, time.Now())
+		}
+
+		result, err := r.RunRetention(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := result.Generations, []string{"0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations=%v, want %v", got, want)
+		} else if got, want := result.SnapshotN, 2; got != want {
+			t.Fatalf("SnapshotN=%d, want %d", got, want)
+		} else if got, want := result.WALN, 5; got != want {
+			t.Fatalf("WALN=%d, want %d", got, want)
+		} else if got, want := result.Size, int64(250); got != want {
+			t.Fatalf("Size=%d, want %d", got, want)
+		} else if result.Snapshotted {
+			t.Fatal("expected no new snapshot")
+		}
+
+		// Ensure retained files & the active generation remain.
+		if _, err := os.Stat(r.GenerationDir("0000000000000001")); !os.IsNotExist(err) {
+			t.Fatalf("expected expired generation to be deleted: %v", err)
+		} else if _, err := os.Stat(r.SnapshotPath("0000000000000002", 0)); !os.IsNotExist(err) {
+			t.Fatalf("expected expired snapshot to be deleted: %v", err)
+		} else if _, err := os.Stat(r.SnapshotPath("0000000000000002", 2)); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.WALPath("0000000000000002", 2) + ".lz4"); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.SnapshotPath(pos.Generation, 0)); err != nil {
+			t.Fatalf("expected active generation to be retained: %v", err)
+		}
+
+		// Ensure a second run has nothing to delete.
+		if result, err := r.RunRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(result, litestream.RetentionResult{}) {
+			t.Fatalf("unexpected result: %#v", result)
+		}
+	})
+
+	// Ensure retention is deferred if a snapshot is required inside a
+	// maintenance window so files are not deleted without a retained snapshot.
+	t.Run("MaintenanceWindow", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Expire every snapshot, including the current generation's.
+		expired := time.Now().Add(-2 * r.Retention)
+		if err := os.Chtimes(r.SnapshotPath(pos.Generation, 0), expired, expired); err != nil {
+			t.Fatal(err)
+		}
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000001", 0), 100, expired)
+
+		db.MaintenanceWindows = []litestream.MaintenanceWindow{{Start: 11 * time.Hour, End: 13 * time.Hour}}
+		db.Now = func() time.Time { return time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+		if result, err := r.RunRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(result, litestream.RetentionResult{Deferred: true}) {
+			t.Fatalf("unexpected result: %#v", result)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		} else if _, err := os.Stat(r.SnapshotPath("0000000000000001", 0)); err != nil {
+			t.Fatalf("expected expired snapshot to be retained: %v", err)
+		}
+
+		// Ensure retention runs once the maintenance window ends.
+		db.Now = func() time.Time { return time.Date(2000, 1, 1, 14, 0, 0, 0, time.UTC) }
+		if result, err := r.RunRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !result.Snapshotted || result.Deferred {
+			t.Fatalf("unexpected result: %#v", result)
+		} else if _, err := os.Stat(r.GenerationDir("0000000000000001")); !os.IsNotExist(err) {
+			t.Fatalf("expected expired generation to be deleted: %v", err)
+		}
+	})
+
+	// Ensure only the most recent snapshots are kept when retaining by count.
+	t.Run("SnapshotCount", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Retention, r.RetentionSnapshotN = 0, 2
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000001", 0), 100, time.Now().Add(-3*time.Hour))
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000002", 0), 100, time.Now().Add(-2*time.Hour))
+		MustWriteFileAt(t, r.SnapshotPath("0000000000000002", 2), 100, time.Now().Add(-1*time.Hour))
+		for i := 0; i < 3; i++ {
+			MustWriteFileAt(t, r.WALPath("0000000000000002", i)+".lz4", 10, time.Now().Add(-1*time.Hour))
+		}
+
+		result, err := r.RunRetention(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := result.Generations, []string{"0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations=%v, want %v", got, want)
+		} else if got, want := result.SnapshotN, 2; got != want {
+			t.Fatalf("SnapshotN=%d, want %d", got, want)
+		} else if got, want := result.WALN, 2; got != want {
+			t.Fatalf("WALN=%d, want %d", got, want)
+		} else if _, err := os.Stat(r.SnapshotPath("0000000000000002", 2)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure the oldest generations beyond the maximum are deleted entirely
+	// & the active generation is always kept.
+	t.Run("MaxGenerations", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.MaxGenerations = 2
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Write generations with retained snapshots & WAL files of increasing age.
+		for i, generation := range []string{"0000000000000003", "0000000000000002", "0000000000000001"} {
+			modTime := time.Now().Add(-time.Duration(i+1) * time.Hour)
+			MustWriteFileAt(t, r.SnapshotPath(generation, 0), 100, modTime)
+			MustWriteFileAt(t, r.WALPath(generation, 0)+".lz4", 10, modTime)
+		}
+
+		result, err := r.RunRetention(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := result.Generations, []string{"0000000000000001", "0000000000000002"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations=%v, want %v", got, want)
+		} else if got, want := result.SnapshotN, 2; got != want {
+			t.Fatalf("SnapshotN=%d, want %d", got, want)
+		} else if got, want := result.WALN, 2; got != want {
+			t.Fatalf("WALN=%d, want %d", got, want)
+		} else if _, err := os.Stat(r.GenerationDir("0000000000000001")); !os.IsNotExist(err) {
+			t.Fatalf("expected oldest generation to be deleted: %v", err)
+		} else if _, err := os.Stat(r.SnapshotPath("0000000000000003", 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ensure the active generation is kept even if it exceeds the maximum.
+		r.MaxGenerations = 1
+		if result, err := r.RunRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := result.Generations, []string{"0000000000000003"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations=%v, want %v", got, want)
+		} else if generations, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{pos.Generation}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure retention can run while the replica syncs without losing data.
+	t.Run("ConcurrentSync", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Retention = time.Nanosecond
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			for ctx.Err() == nil {
+				if _, err := r.RunRetention(ctx); err != nil && ctx.Err() == nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+
+		for i := 0; i < 10; i++ {
+			MustRollWALIndex(t, db, sqldb, r)
+		}
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := MustRestoreRowCount(t, r, pos.Generation), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestFileReplica_DefragGeneration(t *testing.T) {
+	// Ensure a gap followed by a snapshot is removed & the generation restores
+	// to the same data before and after.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := pos.Index, 2; got != want {
+			t.Fatalf("Index=%d, want %d", got, want)
+		}
+
+		// Create a snapshot at index 2 & remove WAL index 1 to create a gap.
+		MustWriteSnapshotAt(t, r, pos.Generation, 2)
+		MustRemoveWAL(t, r, pos.Generation, 1)
+
+		want := MustRestoreRowCount(t, r, pos.Generation)
+		if n, err := r.DefragGeneration(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Verify indices are contiguous & data is unchanged.
+		if _, err := os.Stat(r.SnapshotPath(pos.Generation, 1)); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(r.SnapshotPath(pos.Generation, 2)); !os.IsNotExist(err) {
+			t.Fatalf("expected old snapshot to be removed: %v", err)
+		} else if got := MustRestoreRowCount(t, r, pos.Generation); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Defragmenting again should be a no-op.
+		if n, err := r.DefragGeneration(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if n != 0 {
+			t.Fatalf("unexpected renumber count: %d", n)
+		}
+	})
+
+	// Ensure checksum & commit time sidecars are renumbered with their files
+	// & the generation still restores by timestamp afterward.
+	t.Run("Sidecars", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.CommitTimeIndex = true
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		MustWriteSnapshotAt(t, r, pos.Generation, 2)
+		MustRemoveWAL(t, r, pos.Generation, 1)
+		if err := os.Remove(r.CommitTimesPath(pos.Generation, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		want := MustRestoreRowCount(t, r, pos.Generation)
+		if _, err := r.DefragGeneration(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, filename := range []string{
+			r.SnapshotChecksumPath(pos.Generation, 1),
+			r.CommitTimesPath(pos.Generation, 1),
+		} {
+			if _, err := os.Stat(filename); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, filename := range []string{
+			r.SnapshotChecksumPath(pos.Generation, 2),
+			r.CommitTimesPath(pos.Generation, 2),
+		} {
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be renumbered: %v", filename, err)
+			}
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation, opt.Timestamp = pos.Generation, time.Now()
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got := MustCountRows(t, opt.OutputPath, "foo"); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a generation left in place of a swap interrupted between renames
+	// is moved back by the next defrag.
+	t.Run("InterruptedSwap", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		MustWriteSnapshotAt(t, r, pos.Generation, 2)
+		MustRemoveWAL(t, r, pos.Generation, 1)
+		rows := MustRestoreRowCount(t, r, pos.Generation)
+
+		genDir := r.GenerationDir(pos.Generation)
+		if err := os.Rename(genDir, genDir+".old"); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := r.DefragGeneration(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		} else if _, err := os.Stat(genDir + ".old"); !os.IsNotExist(err) {
+			t.Fatalf("expected original generation to be removed: %v", err)
+		} else if got := MustRestoreRowCount(t, r, pos.Generation); got != rows {
+			t.Fatalf("n=%d, want %d", got, rows)
+		}
+	})
+
+	// Ensure a gap without a following snapshot is not removed.
+	t.Run("ErrNoSnapshotAfterGap", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		MustRemoveWAL(t, r, pos.Generation, 1)
+
+		if _, err := r.DefragGeneration(context.Background(), pos.Generation); err == nil || err.Error() != `cannot defrag gap at 00000001-00000001: no snapshot at index 00000002` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// Ensure snapshot compression speeds up with additional workers on a large database.
+func BenchmarkFileReplica_Snapshot(b *testing.B) {
+	for _, n := range []int{1, 2, 4} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkFileReplicaSnapshot(b, n)
+		})
+	}
+}
+
+func benchmarkFileReplicaSnapshot(b *testing.B, n int) {
+	db, sqldb := MustOpenDBs(b)
+	defer MustCloseDBs(b, db, sqldb)
+
+	// Generate a ~64MB database & checkpoint it into the database file.
+	MustInsertBlobs(b, sqldb, 16000)
+	if err := db.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	fi, err := os.Stat(db.Path())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(fi.Size())
+
+	// Each sync to a new replica path creates a new snapshot.
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := litestream.NewFileReplica(db, "", filepath.Join(dir, fmt.Sprint(i)))
+		r.MonitorEnabled = false
+		r.CompressionWorkers = n
+		if err := r.Sync(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare snapshot throughput & compression ratio of the built-in codecs.
+func BenchmarkFileReplica_SnapshotCodec(b *testing.B) {
+	for _, name := range []string{litestream.CompressionLZ4, litestream.CompressionGzip, litestream.CompressionZstd, litestream.CompressionNone} {
+		b.Run(name, func(b *testing.B) {
+			benchmarkFileReplicaSnapshotCodec(b, litestream.LookupCodec(name))
+		})
+	}
+}
+
+func benchmarkFileReplicaSnapshotCodec(b *testing.B, codec *litestream.Codec) {
+	db, sqldb := MustOpenDBs(b)
+	defer MustCloseDBs(b, db, sqldb)
+
+	// Generate a ~64MB database & checkpoint it into the database file.
+	MustInsertBlobs(b, sqldb, 16000)
+	if err := db.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	fi, err := os.Stat(db.Path())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(fi.Size())
+
+	// Each sync to a new replica path creates a new snapshot.
+	dir := b.TempDir()
+	var ratio float64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := litestream.NewFileReplica(db, "", filepath.Join(dir, fmt.Sprint(i)))
+		r.MonitorEnabled = false
+		r.Codec = codec
+		if err := r.Sync(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		ratio = r.CompressionStats().Ratio()
+	}
+	b.ReportMetric(ratio, "ratio")
+}
+
+// MustInsertBlobs inserts n semi-compressible 4KB blobs into a new "blobs" table.
+func MustInsertBlobs(tb testing.TB, sqldb *sql.DB, n int) {
+	tb.Helper()
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE blobs (data BLOB);`); err != nil {
+		tb.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+	data := make([]byte, 4096)
+	for i := 0; i < n; i++ {
+		rnd.Read(data[:len(data)/2])
+		if _, err := tx.Exec(`INSERT INTO blobs (data) VALUES (?)`, data); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustQueryBlobs returns all blobs from the "blobs" table in insertion order.
+func MustQueryBlobs(tb testing.TB, sqldb *sql.DB) [][]byte {
+	tb.Helper()
+
+	rows, err := sqldb.Query(`SELECT data FROM blobs ORDER BY rowid`)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rows.Close()
+
+	var a [][]byte
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			tb.Fatal(err)
+		}
+		a = append(a, data)
+	}
+	if err := rows.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return a
 }
 
 // NewTestFileReplica returns a new replica using a temp directory & with monitoring disabled.
@@ -88,3 +1127,177 @@ func NewTestFileReplica(tb testing.TB, db *litestream.DB) *litestream.FileReplic
 	db.Replicas = []litestream.Replica{r}
 	return r
 }
+
+// MustOpenPriorityDBs returns a DB which syncs changes to the "critical"
+// table immediately & otherwise only syncs when called.
+func MustOpenPriorityDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 1 * time.Hour
+	db.PriorityInterval = 10 * time.Millisecond
+	db.PriorityTables = []string{"critical"}
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return db, MustOpenSQLDB(tb, db.Path())
+}
+
+// MustReplicatePriorityChange starts r & ensures a write to the "critical"
+// table is replicated long before the sync interval of r. Stops r on return.
+func MustReplicatePriorityChange(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r litestream.Replica) {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE critical (x TEXT);`); err != nil {
+		tb.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	}
+	pos0, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// The first sync is performed immediately.
+	synced := db.ReplicaSyncNotify(r.Name())
+	r.Start(context.Background())
+	defer r.Stop()
+	MustWaitReplicaSync(tb, synced)
+	if got, want := r.LastPos(), pos0; got != want {
+		tb.Fatalf("pos=%s, want %s", got, want)
+	}
+
+	// The next sync copies the change without waiting for the interval.
+	synced = db.ReplicaSyncNotify(r.Name())
+	if _, err := sqldb.Exec(`INSERT INTO critical (x) VALUES ('foo')`); err != nil {
+		tb.Fatal(err)
+	}
+	MustWaitReplicaSync(tb, synced)
+
+	if pos, err := db.Pos(); err != nil {
+		tb.Fatal(err)
+	} else if got, want := r.LastPos(), pos; got != want {
+		tb.Fatalf("pos=%s, want %s", got, want)
+	}
+}
+
+// MustWaitReplicaSync waits for ch, returned by DB.ReplicaSyncNotify, to close.
+func MustWaitReplicaSync(tb testing.TB, ch <-chan struct{}) {
+	tb.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("timeout waiting for replica sync")
+	}
+}
+
+// MustFlipLastByte inverts the bits of the last byte of a file.
+func MustFlipLastByte(tb testing.TB, filename string) {
+	tb.Helper()
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		tb.Fatal(err)
+	} else if len(buf) == 0 {
+		tb.Fatalf("empty file: %s", filename)
+	}
+	buf[len(buf)-1] ^= 0xff
+	if err := ioutil.WriteFile(filename, buf, 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustRollWALIndex writes enough to the "foo" table to checkpoint and start a
+// new WAL index and then syncs the database & replica.
+func MustRollWALIndex(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *litestream.FileReplica) {
+	tb.Helper()
+	for i := 0; i < db.MinCheckpointPageN; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	MustSyncDBReplica(tb, db, r)
+
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		tb.Fatal(err)
+	}
+	MustSyncDBReplica(tb, db, r)
+}
+
+// MustWriteSnapshotAt restores the replica up to the WAL before index and
+// writes the result as a snapshot at index along with its checksum.
+func MustWriteSnapshotAt(tb testing.TB, r *litestream.FileReplica, generation string, index int) {
+	tb.Helper()
+
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(tb.TempDir(), "db")
+	opt.Generation, opt.Index = generation, index-1
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(opt.OutputPath)
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := r.WriteSnapshot(context.Background(), generation, index, bytes.NewReader(buf), time.Time{}); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustRemoveWAL removes the compressed or uncompressed WAL file at index.
+func MustRemoveWAL(tb testing.TB, r *litestream.FileReplica, generation string, index int) {
+	tb.Helper()
+	for _, filename := range []string{r.WALPath(generation, index), r.WALPath(generation, index) + ".lz4"} {
+		if err := os.Remove(filename); err == nil {
+			return
+		} else if !os.IsNotExist(err) {
+			tb.Fatal(err)
+		}
+	}
+	tb.Fatalf("wal not found: %s/%08x", generation, index)
+}
+
+// MustRestoreRowCount restores the latest position of a generation and
+// returns the number of rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r litestream.Replica, generation string) int {
+	tb.Helper()
+
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(tb.TempDir(), "db")
+	opt.Generation = generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+	return MustCountRows(tb, opt.OutputPath, "foo")
+}
+
+// MustWriteFileAt writes a file of n bytes with a given modification time.
+func MustWriteFileAt(tb testing.TB, filename string, n int, t time.Time) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		tb.Fatal(err)
+	} else if err := ioutil.WriteFile(filename, make([]byte, n), 0666); err != nil {
+		tb.Fatal(err)
+	} else if err := os.Chtimes(filename, t, t); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustWriteGenerationFiles writes a snapshot & n WAL files for generation
+// with their modification times set to t.
+func MustWriteGenerationFiles(tb testing.TB, r *litestream.FileReplica, generation string, n int, t time.Time) {
+	tb.Helper()
+
+	filenames := []string{r.SnapshotPath(generation, 0)}
+	for i := 0; i < n; i++ {
+		filenames = append(filenames, r.WALPath(generation, i)+".lz4")
+	}
+
+	for _, filename := range filenames {
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			tb.Fatal(err)
+		} else if err := ioutil.WriteFile(filename, nil, 0666); err != nil {
+			tb.Fatal(err)
+		} else if err := os.Chtimes(filename, t, t); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package litestream_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// Ensure identical snapshots of replicas sharing a dedup directory are hard
+// links to the same file & unlinked files are deleted by retention.
+func TestFileReplica_DedupSnapshots(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	dir := t.TempDir()
+	r0 := litestream.NewFileReplica(db, "r0", t.TempDir())
+	r1 := litestream.NewFileReplica(db, "r1", t.TempDir())
+	for _, r := range []*litestream.FileReplica{r0, r1} {
+		r.MonitorEnabled = false
+		r.DedupSnapshots, r.DedupDir = true, dir
+	}
+	db.Replicas = []litestream.Replica{r0, r1}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r0)
+	if err := r1.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pos := r0.LastPos()
+
+	fi0, err := os.Stat(r0.SnapshotPath(pos.Generation, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi1, err := os.Stat(r1.SnapshotPath(pos.Generation, 0))
+	if err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(fi0, fi1) {
+		t.Fatal("expected snapshots to be linked")
+	} else if got, want := uint64(fi0.Sys().(*syscall.Stat_t).Nlink), uint64(3); got != want {
+		t.Fatalf("links=%d, want %d", got, want)
+	}
+
+	// Ensure deleting a snapshot keeps the contents for the other replica.
+	unlinked := filepath.Join(dir, "ff", strings.Repeat("f", 64))
+	if err := os.MkdirAll(filepath.Dir(unlinked), 0777); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(unlinked, []byte("unlinked"), 0666); err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(r0.SnapshotPath(pos.Generation, 0)); err != nil {
+		t.Fatal(err)
+	} else if _, err := r1.RunRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(unlinked); !os.IsNotExist(err) {
+		t.Fatalf("expected unlinked file to be deleted: %v", err)
+	} else if got, want := MustRestoreRowCount(t, r1, pos.Generation), 1; got != want {
+		t.Fatalf("restored rows=%d, want %d", got, want)
+	}
+
+	if fi1, err = os.Stat(r1.SnapshotPath(pos.Generation, 0)); err != nil {
+		t.Fatal(err)
+	} else if got, want := uint64(fi1.Sys().(*syscall.Stat_t).Nlink), uint64(2); got != want {
+		t.Fatalf("links=%d, want %d", got, want)
+	}
+}
+
+// Ensure compression CPU usage is bounded by the number of compression workers
+// under sustained WAL writes. Reports the average number of CPUs in use.
+func BenchmarkFileReplica_CompressionWorkers(b *testing.B) {
+	for _, n := range []int{1, 2, 4} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkFileReplicaCompressionWorkers(b, n)
+		})
+	}
+}
+
+func benchmarkFileReplicaCompressionWorkers(b *testing.B, n int) {
+	db, sqldb := MustOpenDBs(b)
+	defer MustCloseDBs(b, db, sqldb)
+	r := NewTestFileReplica(b, db)
+	r.CompressionWorkers = n
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar BLOB);`); err != nil {
+		b.Fatal(err)
+	}
+
+	// Generate semi-compressible data so the compressor has real work to do.
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(0)).Read(data[:len(data)/2])
+
+	b.ResetTimer()
+	startTime, startCPU := time.Now(), cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		// Write enough pages to force a checkpoint & a new compressed WAL file.
+		for j := 0; j < db.MinCheckpointPageN; j++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (?)`, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if err := db.Sync(); err != nil {
+			b.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(cpuTime(b)-startCPU)/float64(time.Since(startTime)), "cpus")
+}
+
+// cpuTime returns the total user & system CPU time used by the process.
+func cpuTime(tb testing.TB) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		tb.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,130 @@
+package litestream_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestIsRestorable(t *testing.T) {
+	// Ensure a timestamp after the latest WAL upload within the generation
+	// resolves to the latest position.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		wals, err := r.WALs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var updatedAt time.Time
+		for _, info := range wals {
+			if info.CreatedAt.After(updatedAt) {
+				updatedAt = info.CreatedAt
+			}
+		}
+
+		ok, pos, err := litestream.IsRestorable(context.Background(), r, updatedAt)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected timestamp to be restorable")
+		} else if got, want := pos, r.LastPos(); got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure a timestamp before the earliest snapshot is not restorable.
+	t.Run("BeforeSnapshot", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if ok, pos, err := litestream.IsRestorable(context.Background(), r, time.Now().Add(-1*time.Hour)); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatalf("expected timestamp to not be restorable, got %s", pos)
+		} else if !pos.IsZero() {
+			t.Fatalf("unexpected pos: %s", pos)
+		}
+	})
+
+	// Ensure a timestamp past a WAL index removed by pruning is not restorable.
+	t.Run("WALGap", func(t *testing.T) {
+		r := &mockReplica{
+			snapshots: []*litestream.SnapshotInfo{{Generation: "0000000000000000", Index: 2, CreatedAt: time.Unix(1000, 0)}},
+			wals: []*litestream.WALInfo{
+				{Generation: "0000000000000000", Index: 2, Size: 4152, CreatedAt: time.Unix(1000, 0)},
+				{Generation: "0000000000000000", Index: 4, Size: 4152, CreatedAt: time.Unix(3000, 0)},
+			},
+		}
+
+		// Timestamps before the gap are still restorable.
+		if ok, pos, err := litestream.IsRestorable(context.Background(), r, time.Unix(2000, 0)); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected timestamp before gap to be restorable")
+		} else if got, want := pos, (litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 4152}); got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+
+		if ok, pos, err := litestream.IsRestorable(context.Background(), r, time.Unix(3000, 0)); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatalf("expected timestamp after gap to not be restorable, got %s", pos)
+		}
+	})
+}
+
+func (r *mockReplica) Name() string { return "mock" }
+
+func (r *mockReplica) Generations(ctx context.Context) ([]string, error) {
+	m := make(map[string]struct{})
+	for _, info := range r.snapshots {
+		m[info.Generation] = struct{}{}
+	}
+	var a []string
+	for generation := range m {
+		a = append(a, generation)
+	}
+	return a, nil
+}
+
+func (r *mockReplica) GenerationStats(ctx context.Context, generation string) (stats litestream.GenerationStats, err error) {
+	for _, info := range r.snapshots {
+		if info.Generation != generation {
+			continue
+		}
+		stats.SnapshotN++
+		if stats.CreatedAt.IsZero() || info.CreatedAt.Before(stats.CreatedAt) {
+			stats.CreatedAt = info.CreatedAt
+		}
+		if info.CreatedAt.After(stats.UpdatedAt) {
+			stats.UpdatedAt = info.CreatedAt
+		}
+	}
+	for _, info := range r.wals {
+		if info.Generation != generation {
+			continue
+		}
+		stats.WALN++
+		if info.CreatedAt.After(stats.UpdatedAt) {
+			stats.UpdatedAt = info.CreatedAt
+		}
+	}
+	return stats, nil
+}
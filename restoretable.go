@@ -0,0 +1,213 @@
+package litestream
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Formats written by RestoreTable.
+const (
+	TableFormatSQL = "sql" // one INSERT statement per row
+	TableFormatCSV = "csv" // header row of column names & one record per row
+)
+
+// RestoreTable restores the database from a replica into a temporary file &
+// writes the rows of a single table to w in the format set by
+// opt.TableFormat. The temporary file is created in the default directory for
+// temporary files & is removed before returning.
+//
+// The snapshot & WAL files are selected as in RestoreReplica. The output
+// path of opt is ignored. Returns ErrTableNotFound if the restored database
+// does not contain the table.
+//
+// SQL output contains an INSERT statement for each row with values quoted by
+// SQLite, wrapped in a transaction. CSV output contains the text value of
+// each column with NULL written as an empty field.
+func RestoreTable(ctx context.Context, r Replica, opt RestoreOptions, table string, w io.Writer) (err error) {
+	switch opt.TableFormat {
+	case "":
+		opt.TableFormat = TableFormatSQL
+	case TableFormatSQL, TableFormatCSV:
+	default:
+		return fmt.Errorf("invalid table format: %q", opt.TableFormat)
+	}
+
+	if table == "" {
+		return fmt.Errorf("table name required")
+	} else if opt.DryRun {
+		return fmt.Errorf("cannot perform dry run when restoring table")
+	}
+
+	// Determine generation to restore from, if not specified.
+	if opt.Generation == "" {
+		if opt.Generation, _, err = CalcReplicaRestoreTarget(ctx, r, opt); err != nil {
+			return err
+		} else if opt.Generation == "" {
+			return fmt.Errorf("no matching backups found")
+		}
+	}
+
+	dir, err := ioutil.TempDir(opt.TempDir, "litestream-table-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The restored database is only read so skip the work done to prepare
+	// it for use by an application.
+	opt.OutputPath = filepath.Join(dir, "db")
+	opt.EnableWAL = false
+	opt.ConvertPageSize = false
+	opt.Deterministic = false
+	if err := RestoreReplica(ctx, r, opt); err != nil {
+		return err
+	}
+
+	d, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	columns, err := tableColumns(ctx, d, table)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if opt.TableFormat == TableFormatCSV {
+		err = writeTableCSV(ctx, d, table, columns, bw)
+	} else {
+		err = writeTableSQL(ctx, d, table, columns, bw)
+	}
+	if err != nil {
+		return err
+	} else if err := bw.Flush(); err != nil {
+		return err
+	}
+	return d.Close()
+}
+
+// tableColumns returns the names of the columns of table which hold stored
+// values. Returns ErrTableNotFound if the table does not exist.
+func tableColumns(ctx context.Context, d *sql.DB, table string) ([]string, error) {
+	var n int
+	if err := d.QueryRowContext(ctx, `SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+
+	rows, err := d.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Close()
+}
+
+// writeTableSQL writes an INSERT statement for each row of table to w.
+func writeTableSQL(ctx context.Context, d *sql.DB, table string, columns []string, w io.Writer) error {
+	exprs := make([]string, len(columns))
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = quoteIdent(column)
+		exprs[i] = "quote(" + names[i] + ")"
+	}
+	prefix := "INSERT INTO " + quoteIdent(table) + "(" + strings.Join(names, ",") + ") VALUES("
+
+	rows, err := d.QueryContext(ctx, `SELECT `+strings.Join(exprs, ", ")+` FROM `+quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, "BEGIN TRANSACTION;\n"); err != nil {
+		return err
+	}
+
+	values := make([]string, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		} else if _, err := io.WriteString(w, prefix+strings.Join(values, ",")+");\n"); err != nil {
+			return err
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "COMMIT;\n")
+	return err
+}
+
+// writeTableCSV writes a header of column names & a record for each row of
+// table to w.
+func writeTableCSV(ctx context.Context, d *sql.DB, table string, columns []string, w io.Writer) error {
+	exprs := make([]string, len(columns))
+	for i, column := range columns {
+		exprs[i] = "CAST(" + quoteIdent(column) + " AS TEXT)"
+	}
+
+	rows, err := d.QueryContext(ctx, `SELECT `+strings.Join(exprs, ", ")+` FROM `+quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			record[i] = v.String
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// quoteIdent returns name quoted as an SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,112 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreTable(t *testing.T) {
+	// Ensure the INSERT statements recreate the rows of the table, including
+	// values which must be quoted.
+	t.Run("SQL", func(t *testing.T) {
+		db, sqldb, r, pos := MustOpenRestoreTableDB(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		var buf bytes.Buffer
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreTable(context.Background(), r, opt, "foo bar", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		if _, err := d.Exec(`CREATE TABLE "foo bar" (id INTEGER PRIMARY KEY, name TEXT, data BLOB, score REAL);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := d.Exec(buf.String()); err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		if err := d.QueryRow(`SELECT COUNT(1) FROM "foo bar" WHERE id = 1 AND name = 'it''s' AND data = X'00FF' AND score = 1.5`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("unexpected row count: %d", n)
+		}
+		if err := d.QueryRow(`SELECT COUNT(1) FROM "foo bar" WHERE id = 2 AND name IS NULL AND data IS NULL AND score IS NULL`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("unexpected row count: %d", n)
+		}
+	})
+
+	// Ensure CSV output has a header & the text value of each column.
+	t.Run("CSV", func(t *testing.T) {
+		db, sqldb, r, pos := MustOpenRestoreTableDB(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		var buf bytes.Buffer
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos.Generation
+		opt.TableFormat = litestream.TableFormatCSV
+		if err := litestream.RestoreTable(context.Background(), r, opt, "foo bar", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := records, [][]string{
+			{"id", "name", "data", "score"},
+			{"1", "it's", "\x00\xff", "1.5"},
+			{"2", "", "", ""},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("records=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure an error is returned if the restored schema has no such table.
+	t.Run("ErrTableNotFound", func(t *testing.T) {
+		db, sqldb, r, pos := MustOpenRestoreTableDB(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos.Generation
+		if err := litestream.RestoreTable(context.Background(), r, opt, "baz", &bytes.Buffer{}); !errors.Is(err, litestream.ErrTableNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenRestoreTableDB opens a database replicated to a file replica with
+// a table of two rows, one of which is all NULL except its id.
+func MustOpenRestoreTableDB(tb testing.TB) (*litestream.DB, *sql.DB, *litestream.FileReplica, litestream.Pos) {
+	tb.Helper()
+
+	db, sqldb := MustOpenDBs(tb)
+	r := NewTestFileReplica(tb, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE "foo bar" (id INTEGER PRIMARY KEY, name TEXT, data BLOB, score REAL);`); err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO "foo bar" VALUES (1, 'it''s', X'00FF', 1.5), (2, NULL, NULL, NULL);`); err != nil {
+		tb.Fatal(err)
+	}
+	MustSyncDBReplica(tb, db, r)
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db, sqldb, r, pos
+}
@@ -0,0 +1,94 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Default backoff between retries of a failed WAL chunk upload.
+const (
+	DefaultWALChunkInitialBackoff = 1 * time.Second
+	DefaultWALChunkMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy determines how many times & how often a failed operation is
+// retried. Retries wait an exponentially increasing backoff, starting at
+// InitialBackoff & limited to MaxBackoff, with up to half of each wait
+// randomized so replicas failing together do not retry together.
+//
+// Only errors for which IsRetryableError returns true are retried.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration // if zero, retries are not delayed
+	MaxBackoff     time.Duration // if zero, backoff is not limited
+
+	// If set, called before waiting to retry after a failed attempt.
+	OnRetry func(err error, attempt int, delay time.Duration)
+}
+
+// Backoff returns the delay before retrying after failed attempt i, starting
+// from zero.
+func (p RetryPolicy) Backoff(i int) time.Duration {
+	d := p.InitialBackoff
+	for ; i > 0 && d > 0 && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i-- {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Do calls fn until it succeeds, it returns an error which is not retryable,
+// or it has been retried MaxRetries times. Waiting between attempts stops
+// when ctx is canceled. Returns the last error from fn.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	for i := 0; ; i++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		} else if i >= p.MaxRetries || ctx.Err() != nil || !IsRetryableError(err) {
+			return err
+		}
+
+		delay := p.Backoff(i)
+		if p.OnRetry != nil {
+			p.OnRetry(err, i+1, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (retry canceled: %s)", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// IsRetryableError returns true if an operation which failed with err may
+// succeed when retried. Errors with an HTTP status code from storage, such as
+// from S3 or B2, are only retryable for server errors, request timeouts &
+// rate limiting. Missing files, permission errors & canceled contexts are not
+// retryable. Other errors, such as timeouts & connection resets, are.
+func IsRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	} else if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return false
+	}
+
+	var e interface{ StatusCode() int }
+	if errors.As(err, &e) && e.StatusCode() != 0 {
+		code := e.StatusCode()
+		return code >= 500 || code == 408 || code == 429
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRetryPolicy_Do(t *testing.T) {
+	// Ensure retryable errors are retried until fn succeeds.
+	t.Run("OK", func(t *testing.T) {
+		var n, retries int
+		p := litestream.RetryPolicy{
+			MaxRetries: 3,
+			OnRetry:    func(err error, attempt int, delay time.Duration) { retries++ },
+		}
+		if err := p.Do(context.Background(), func(ctx context.Context) error {
+			if n++; n < 3 {
+				return &statusError{code: 503}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 3 || retries != 2 {
+			t.Fatalf("n=%d retries=%d, want 3 & 2", n, retries)
+		}
+	})
+
+	// Ensure errors which are not retryable are returned immediately.
+	t.Run("ErrNotRetryable", func(t *testing.T) {
+		var n int
+		p := litestream.RetryPolicy{MaxRetries: 3}
+		if err := p.Do(context.Background(), func(ctx context.Context) error {
+			n++
+			return &statusError{code: 403}
+		}); err == nil {
+			t.Fatal("expected error")
+		} else if n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+	})
+
+	// Ensure waiting for a retry stops when the context is canceled.
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		p := litestream.RetryPolicy{MaxRetries: 3, InitialBackoff: time.Minute}
+		startTime := time.Now()
+		if err := p.Do(ctx, func(ctx context.Context) error { return errors.New("marker") }); err == nil {
+			t.Fatal("expected error")
+		} else if d := time.Since(startTime); d > 10*time.Second {
+			t.Fatalf("retry not canceled after %s", d)
+		}
+	})
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := litestream.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, want := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		for j := 0; j < 20; j++ {
+			if d := p.Backoff(i); d < want/2 || d > want {
+				t.Fatalf("backoff(%d)=%s, want between %s & %s", i, d, want/2, want)
+			}
+		}
+	}
+
+	if d := (litestream.RetryPolicy{}).Backoff(3); d != 0 {
+		t.Fatalf("backoff=%s, want 0", d)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{code: 500}, true},
+		{&statusError{code: 503}, true},
+		{&statusError{code: 429}, true},
+		{fmt.Errorf("upload: %w", &statusError{code: 503}), true},
+		{&statusError{code: 403}, false},
+		{&statusError{code: 404}, false},
+		{syscall.ECONNRESET, true},
+		{os.ErrDeadlineExceeded, true},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}, false},
+		{context.Canceled, false},
+	} {
+		if got := litestream.IsRetryableError(tt.err); got != tt.want {
+			t.Errorf("IsRetryableError(%v)=%v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// statusError is an error with an HTTP status code, such as from S3.
+type statusError struct{ code int }
+
+func (e *statusError) Error() string   { return fmt.Sprintf("status %d", e.code) }
+func (e *statusError) StatusCode() int { return e.code }
@@ -0,0 +1,174 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/benbjohnson/litestream"
+)
+
+// Default & minimum size of each part of a resumable snapshot upload.
+const (
+	DefaultPartSize = 16 * 1024 * 1024
+	MinPartSize     = s3manager.MinUploadPartSize
+)
+
+// snapshotUpload is an incomplete multipart upload of a snapshot & its
+// uploaded parts by part number.
+type snapshotUpload struct {
+	id    string
+	parts map[int64]*s3.Part
+}
+
+// partSize returns the size of each part of a resumable snapshot upload.
+func (r *Replica) partSize() int64 {
+	if r.PartSize < MinPartSize {
+		return DefaultPartSize
+	}
+	return r.PartSize
+}
+
+// findSnapshotUpload returns the latest incomplete multipart upload of key
+// with its uploaded parts if resume is true. All other incomplete uploads
+// within the replica's generations cannot be resumed so they are aborted to
+// avoid storage charges. Returns nil if there is no upload to resume.
+func (r *Replica) findSnapshotUpload(ctx context.Context, key string, resume bool) (*snapshotUpload, error) {
+	var latest *s3.MultipartUpload
+	var stale []*s3.MultipartUpload
+	if err := r.s3.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(r.Bucket),
+		Prefix: aws.String(path.Join(r.Path, "generations") + "/"),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			if !resume || aws.StringValue(u.Key) != key {
+				stale = append(stale, u)
+			} else if latest == nil || aws.TimeValue(u.Initiated).After(aws.TimeValue(latest.Initiated)) {
+				if latest != nil {
+					stale = append(stale, latest)
+				}
+				latest = u
+			} else {
+				stale = append(stale, u)
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, u := range stale {
+		if _, err := r.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(r.Bucket),
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		}); err != nil {
+			log.Printf("%s(%s): snapshot: cannot abort stale upload %s: %s", r.DB().Path(), r.Name(), aws.StringValue(u.Key), err)
+			continue
+		}
+		log.Printf("%s(%s): snapshot: aborted stale upload %s", r.DB().Path(), r.Name(), aws.StringValue(u.Key))
+	}
+
+	if latest == nil {
+		return nil, nil
+	}
+
+	upload := &snapshotUpload{id: aws.StringValue(latest.UploadId), parts: make(map[int64]*s3.Part)}
+	if err := r.s3.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(r.Bucket),
+		Key:      aws.String(key),
+		UploadId: latest.UploadId,
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			upload.parts[aws.Int64Value(part.PartNumber)] = part
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// uploadSnapshotMultipart uploads rd to key in parts of PartSize, resuming
+// upload if it is not nil. The contents of each part are compared with the
+// part already uploaded at the same number, if any, so only parts which
+// differ are sent, at the rate allowed by limiter. A snapshot of an unchanged
+// database is compressed to the same bytes so an interrupted upload resumes
+// from its last part. Encrypted snapshots always differ so every part is sent.
+//
+// The upload is not aborted on error so it can be resumed by the next
+// snapshot. Returns the number of bytes read from rd.
+func (r *Replica) uploadSnapshotMultipart(ctx context.Context, key string, rd io.Reader, upload *snapshotUpload, limiter *litestream.RateLimiter) (n int64, err error) {
+	var sentN int64
+	if upload == nil {
+		out, err := r.s3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:       aws.String(r.Bucket),
+			Key:          aws.String(key),
+			StorageClass: storageClass(r.SnapshotStorageClass),
+		})
+		if err != nil {
+			return 0, err
+		}
+		upload = &snapshotUpload{id: aws.StringValue(out.UploadId)}
+	}
+
+	var completed []*s3.CompletedPart
+	buf := make([]byte, r.partSize())
+	for num := int64(1); ; num++ {
+		m, err := io.ReadFull(rd, buf)
+		if err == io.EOF && num > 1 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return n, err
+		}
+		n += int64(m)
+
+		sum := md5.Sum(buf[:m])
+		etag := hex.EncodeToString(sum[:])
+		if part := upload.parts[num]; part != nil && aws.Int64Value(part.Size) == int64(m) && strings.Trim(aws.StringValue(part.ETag), `"`) == etag {
+			completed = append(completed, &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(num)})
+		} else {
+			if err := limiter.WaitN(ctx, m); err != nil {
+				return n, err
+			}
+			out, err := r.s3.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(r.Bucket),
+				Key:        aws.String(key),
+				UploadId:   aws.String(upload.id),
+				PartNumber: aws.Int64(num),
+				Body:       bytes.NewReader(buf[:m]),
+			})
+			if err != nil {
+				return n, err
+			}
+			sentN += int64(m)
+			completed = append(completed, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(num)})
+		}
+
+		if m < len(buf) {
+			break
+		}
+	}
+
+	if _, err := r.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(r.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(upload.id),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		return n, err
+	}
+
+	if resumedN := n - sentN; resumedN > 0 {
+		log.Printf("%s(%s): snapshot: resumed upload %s, skipped=%d sent=%d", r.DB().Path(), r.Name(), key, resumedN, sentN)
+	}
+	return n, nil
+}
@@ -0,0 +1,1284 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/s3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if generations, err := r.Generations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(generations) != 1 || generations[0] != pos.Generation {
+		t.Fatalf("Generations()=%v, want [%s]", generations, pos.Generation)
+	}
+
+	// Ensure the WAL checksums are stored as object metadata.
+	for _, key := range s.Keys(r.WALDir(pos.Generation) + "/") {
+		if s.Object(key).Metadata[litestream.ChecksumMetadataKey] == "" {
+			t.Fatalf("checksum metadata not set: %s", key)
+		}
+	}
+
+	if n := MustRestoreRowCount(t, r, pos.Generation); n != 5 {
+		t.Fatalf("n=%d, want 5", n)
+	}
+}
+
+func TestReplica_StorageClass(t *testing.T) {
+	// Ensure snapshots & WAL segments are uploaded with their storage class.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		s := NewServer(t)
+		r := NewTestReplica(t, db, s)
+		r.SnapshotStorageClass = "STANDARD_IA"
+		r.WALStorageClass = "GLACIER"
+
+		MustSyncReplica(t, db, sqldb, r)
+
+		pos := r.LastPos()
+		if obj := s.Object(r.SnapshotPath(pos.Generation, 0)); obj == nil {
+			t.Fatal("expected snapshot")
+		} else if got, want := obj.StorageClass, "STANDARD_IA"; got != want {
+			t.Fatalf("snapshot storage class=%q, want %q", got, want)
+		}
+
+		keys := s.Keys(r.WALDir(pos.Generation) + "/")
+		if len(keys) == 0 {
+			t.Fatal("expected wal segments")
+		}
+		for _, key := range keys {
+			if got, want := s.Object(key).StorageClass, "GLACIER"; got != want {
+				t.Fatalf("wal storage class=%q, want %q", got, want)
+			}
+		}
+	})
+
+	// Ensure no storage class is sent if blank so the bucket default is used.
+	t.Run("Default", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		s := NewServer(t)
+		r := NewTestReplica(t, db, s)
+
+		MustSyncReplica(t, db, sqldb, r)
+
+		for _, key := range s.Keys(r.GenerationDir(r.LastPos().Generation) + "/") {
+			if got := s.Object(key).StorageClass; got != "" {
+				t.Fatalf("storage class=%q, want blank: %s", got, key)
+			}
+		}
+	})
+
+	// Ensure snapshots uploaded in parts use the snapshot storage class.
+	t.Run("Multipart", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		s := NewServer(t)
+		r := NewTestReplica(t, db, s)
+		r.SnapshotStorageClass = "STANDARD_IA"
+		r.WALStorageClass = "GLACIER"
+		r.MultipartThreshold = 1
+
+		MustSyncReplica(t, db, sqldb, r)
+
+		pos := r.LastPos()
+		if obj := s.Object(r.SnapshotPath(pos.Generation, 0)); obj == nil || !obj.Multipart {
+			t.Fatal("expected multipart upload")
+		} else if got, want := obj.StorageClass, "STANDARD_IA"; got != want {
+			t.Fatalf("snapshot storage class=%q, want %q", got, want)
+		} else if n := MustRestoreRowCount(t, r, pos.Generation); n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+	})
+}
+
+func TestReplica_GetObject(t *testing.T) {
+	// Ensure a missing object is reported as not existing.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		r := NewTestReplica(t, nil, NewServer(t))
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if _, _, err := r.GetObject(context.Background(), "backups/missing"); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure metadata keys are returned in lowercase.
+	t.Run("Metadata", func(t *testing.T) {
+		r := NewTestReplica(t, nil, NewServer(t))
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if _, err := r.PutObject(context.Background(), "backups/obj", strings.NewReader("data"), litestream.PutOptions{
+			Metadata: map[string]string{"Foo-Bar": "baz"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		rc, info, err := r.GetObject(context.Background(), "backups/obj")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		if buf, err := ioutil.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(buf), "data"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		} else if got, want := info.Metadata["foo-bar"], "baz"; got != want {
+			t.Fatalf("metadata=%v, want foo-bar=%q", info.Metadata, want)
+		}
+	})
+}
+
+func TestReplica_DeleteObjects(t *testing.T) {
+	// Ensure only the given objects are deleted.
+	t.Run("OK", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		MustPutObjects(t, r, "backups/a", "backups/b", "backups/c")
+
+		if err := r.DeleteObjects(context.Background(), []litestream.ObjectInfo{{Key: "backups/a"}, {Key: "backups/c"}}); err != nil {
+			t.Fatal(err)
+		} else if got, want := s.Keys("backups/"), []string{"backups/b"}; !equalStrings(got, want) {
+			t.Fatalf("keys=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure an error for a single key fails the batch.
+	t.Run("ErrKey", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		MustPutObjects(t, r, "backups/a", "backups/b")
+		s.SetDeleteError("backups/b")
+
+		if err := r.DeleteObjects(context.Background(), []litestream.ObjectInfo{{Key: "backups/a"}, {Key: "backups/b"}}); err == nil || err.Error() != `cannot delete backups/b: Access Denied` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure more keys than a single request allows are refused.
+	t.Run("ErrMaxKeys", func(t *testing.T) {
+		r := NewTestReplica(t, nil, NewServer(t))
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.DeleteObjects(context.Background(), make([]litestream.ObjectInfo, s3.MaxKeys+1)); err == nil || err.Error() != `cannot delete more than 1000 objects at once` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_Init(t *testing.T) {
+	// Ensure API errors are returned with their error code.
+	t.Run("ErrAccessDenied", func(t *testing.T) {
+		s := NewServer(t)
+		s.Fail = true
+		r := NewTestReplica(t, nil, s)
+
+		_, err := r.Generations(context.Background())
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != "AccessDenied" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the bucket region is looked up from the endpoint if not set.
+	t.Run("FindBucketRegion", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.Region = ""
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if _, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure a failed region lookup is returned.
+	t.Run("ErrFindBucketRegion", func(t *testing.T) {
+		s := NewServer(t)
+		s.Fail = true
+		r := NewTestReplica(t, nil, s)
+		r.Region = ""
+
+		if err := r.Init(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "cannot lookup bucket region: AccessDenied") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_UserAgent(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		userAgent   string
+		findRegion  bool // look up the bucket region before connecting
+		shareClient bool
+	}{
+		{name: "Default", userAgent: s3.DefaultUserAgent},
+		{name: "Custom", userAgent: "litestream/v1.0.0 (app)"},
+		{name: "FindBucketRegion", userAgent: "litestream/v1.0.0", findRegion: true},
+		{name: "ShareClient", userAgent: "litestream/v1.0.0", shareClient: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			s := NewServer(t)
+			r := NewTestReplica(t, db, s)
+			r.UserAgent = tt.userAgent
+			r.ShareClient = tt.shareClient
+			if tt.findRegion {
+				r.Region = ""
+			}
+			defer r.Close()
+
+			// Ensure every request, including uploads, listing & deletes,
+			// sends the replica's User-Agent instead of the SDK default.
+			MustSyncReplica(t, db, sqldb, r)
+			if err := r.DeleteObjects(context.Background(), []litestream.ObjectInfo{{Key: r.SnapshotPath(r.LastPos().Generation, 0)}}); err != nil {
+				t.Fatal(err)
+			}
+
+			userAgents := s.UserAgents()
+			if len(userAgents) == 0 {
+				t.Fatal("expected requests")
+			}
+			for _, ua := range userAgents {
+				if ua != tt.userAgent {
+					t.Fatalf("User-Agent=%q, want %q", ua, tt.userAgent)
+				}
+			}
+		})
+	}
+
+	// Ensure replicas with different User-Agents do not share a client.
+	t.Run("ShareClientByUserAgent", func(t *testing.T) {
+		s := NewServer(t)
+		r0, r1 := NewTestReplica(t, nil, s), NewTestReplica(t, nil, s)
+		r0.ShareClient, r1.ShareClient = true, true
+		r0.UserAgent, r1.UserAgent = "litestream/a", "litestream/b"
+		defer r0.Close()
+		defer r1.Close()
+
+		MustPutObjects(t, r0, "backups/a")
+		MustPutObjects(t, r1, "backups/b")
+		if got, want := s.UserAgents(), []string{"litestream/a", "litestream/b"}; !equalStrings(got, want) {
+			t.Fatalf("User-Agents=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_ReloadCredentials(t *testing.T) {
+	// Ensure keys are read from the credential files in place of the static
+	// keys & re-read on reload.
+	t.Run("OK", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.AccessKeyIDFile = MustWriteFile(t, "", "FILEKEY0\n")
+		r.SecretAccessKeyFile = MustWriteFile(t, "", "FILESECRET0\n")
+
+		MustPutObjects(t, r, "backups/a")
+		MustWriteFile(t, r.AccessKeyIDFile, "FILEKEY1\n")
+		MustPutObjects(t, r, "backups/b")
+		if err := r.ReloadCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		MustPutObjects(t, r, "backups/c")
+
+		if got, want := s.AccessKeyIDs(), []string{"FILEKEY0", "FILEKEY0", "FILEKEY1"}; !equalStrings(got, want) {
+			t.Fatalf("AccessKeyIDs=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the static key is used if only the secret is read from a file.
+	t.Run("SecretFileOnly", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.SecretAccessKeyFile = MustWriteFile(t, "", "FILESECRET")
+
+		MustPutObjects(t, r, "backups/a")
+		if got, want := s.AccessKeyIDs(), []string{"AKID"}; !equalStrings(got, want) {
+			t.Fatalf("AccessKeyIDs=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure a failed reload keeps the previous keys.
+	t.Run("ErrEmptyFile", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.AccessKeyIDFile = MustWriteFile(t, "", "FILEKEY0")
+		r.SecretAccessKeyFile = MustWriteFile(t, "", "FILESECRET0")
+
+		MustPutObjects(t, r, "backups/a")
+		MustWriteFile(t, r.AccessKeyIDFile, " \n")
+		if err := r.ReloadCredentials(); err == nil || err.Error() != "credentials file is empty: "+r.AccessKeyIDFile {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		MustPutObjects(t, r, "backups/b")
+
+		if got, want := s.AccessKeyIDs(), []string{"FILEKEY0", "FILEKEY0"}; !equalStrings(got, want) {
+			t.Fatalf("AccessKeyIDs=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure a missing file is reported without its contents or keys.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		r := NewTestReplica(t, nil, NewServer(t))
+		r.AccessKeyIDFile = filepath.Join(t.TempDir(), "missing")
+		if err := r.ReloadCredentials(); err == nil || !strings.HasPrefix(err.Error(), "cannot read credentials file: ") || !os.IsNotExist(errors.Unwrap(err)) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure reloading any replica sharing a client updates the client.
+	t.Run("ShareClient", func(t *testing.T) {
+		s := NewServer(t)
+		keyFile, secretFile := MustWriteFile(t, "", "FILEKEY0"), MustWriteFile(t, "", "FILESECRET0")
+		r0, r1 := NewTestReplica(t, nil, s), NewTestReplica(t, nil, s)
+		for _, r := range []*s3.Replica{r0, r1} {
+			r.AccessKeyIDFile, r.SecretAccessKeyFile = keyFile, secretFile
+			r.ShareClient = true
+			defer r.Close()
+		}
+
+		MustPutObjects(t, r0, "backups/a")
+		MustPutObjects(t, r1, "backups/b")
+		MustWriteFile(t, keyFile, "FILEKEY1")
+		if err := r1.ReloadCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		MustPutObjects(t, r0, "backups/c")
+
+		if got, want := s.AccessKeyIDs(), []string{"FILEKEY0", "FILEKEY0", "FILEKEY1"}; !equalStrings(got, want) {
+			t.Fatalf("AccessKeyIDs=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_ShareClient(t *testing.T) {
+	// Ensure replicas with the same settings share a connection pool which
+	// is closed once the last replica is closed.
+	t.Run("OK", func(t *testing.T) {
+		s := NewServer(t)
+		r0, r1 := NewTestReplica(t, nil, s), NewTestReplica(t, nil, s)
+		r0.ShareClient, r1.ShareClient = true, true
+		r1.Path = "other"
+
+		MustPutObjects(t, r0, "backups/a")
+		MustPutObjects(t, r1, "other/b")
+		if n, openN := s.ConnN(); n != 1 || openN != 1 {
+			t.Fatalf("ConnN()=%d/%d, want 1/1", n, openN)
+		}
+
+		// Ensure the pool stays open while a replica still uses it.
+		if err := r0.Close(); err != nil {
+			t.Fatal(err)
+		}
+		MustPutObjects(t, r1, "other/c")
+		if n, openN := s.ConnN(); n != 1 || openN != 1 {
+			t.Fatalf("ConnN()=%d/%d, want 1/1", n, openN)
+		}
+
+		if err := r1.Close(); err != nil {
+			t.Fatal(err)
+		}
+		MustWaitConnsClosed(t, s)
+	})
+
+	// Ensure replicas with different settings do not share a client.
+	t.Run("Region", func(t *testing.T) {
+		s := NewServer(t)
+		r0, r1 := NewTestReplica(t, nil, s), NewTestReplica(t, nil, s)
+		r0.ShareClient, r1.ShareClient = true, true
+		r1.Region = "us-west-2"
+		defer r0.Close()
+		defer r1.Close()
+
+		MustPutObjects(t, r0, "backups/a")
+		MustPutObjects(t, r1, "backups/b")
+		if n, _ := s.ConnN(); n != 2 {
+			t.Fatalf("ConnN()=%d, want 2", n)
+		}
+	})
+
+	// Ensure a closed replica reconnects when it is used again.
+	t.Run("Reopen", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.ShareClient = true
+
+		MustPutObjects(t, r, "backups/a")
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		MustWaitConnsClosed(t, s)
+
+		MustPutObjects(t, r, "backups/b")
+		defer r.Close()
+		if got, want := s.Keys("backups/"), []string{"backups/a", "backups/b"}; !equalStrings(got, want) {
+			t.Fatalf("keys=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure closing the database releases the client of its replicas.
+	t.Run("DBClose", func(t *testing.T) {
+		db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+		db.MonitorInterval = 0
+		s := NewServer(t)
+		r := NewTestReplica(t, db, s)
+		r.ShareClient = true
+		db.Replicas = append(db.Replicas, r)
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		MustPutObjects(t, r, "backups/a")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		MustWaitConnsClosed(t, s)
+	})
+}
+
+func TestReplica_RunRetention(t *testing.T) {
+	// Ensure retention only deletes objects below the replica's path so
+	// hosts can share a bucket under different prefixes.
+	db0, sqldb0 := MustOpenDBs(t)
+	db1, sqldb1 := MustOpenDBs(t)
+	s := NewServer(t)
+	r0, r1 := NewTestReplica(t, db0, s), NewTestReplica(t, db1, s)
+	r0.Path, r1.Path = "hosts/a/db", "hosts/ab/db"
+	MustSyncReplica(t, db0, sqldb0, r0)
+	MustSyncReplica(t, db1, sqldb1, r1)
+
+	// Write the same expired generation under both prefixes.
+	const generation = "0000000000000001"
+	s.SetNow(time.Now().Add(-2 * r0.Retention))
+	for _, r := range []*s3.Replica{r0, r1} {
+		if err := r.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data"), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetNow(time.Time{})
+	otherKeys := s.Keys("hosts/ab/")
+
+	if result, err := r0.RunRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := result.Generations, []string{generation}; !equalStrings(got, want) {
+		t.Fatalf("Generations=%v, want %v", got, want)
+	} else if keys := s.Keys(r0.GenerationDir(generation) + "/"); len(keys) != 0 {
+		t.Fatalf("unexpected objects: %v", keys)
+	} else if got, want := s.Keys("hosts/ab/"), otherKeys; !equalStrings(got, want) {
+		t.Fatalf("other prefix keys=%v, want %v", got, want)
+	}
+}
+
+func TestReplica_PutObject_Multipart(t *testing.T) {
+	const key = "backups/generations/0000000000000001/snapshots/00000000.snapshot.lz4"
+	const otherKey = "backups/generations/0000000000000001/snapshots/00000001.snapshot.lz4"
+
+	// Ensure snapshots above the threshold are uploaded in parts.
+	t.Run("OK", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+		data := MustRandomBytes(t, s3.MinPartSize+1024)
+
+		MustPutSnapshot(t, r, key, bytes.NewReader(data))
+		if obj := s.Object(key); obj == nil || !obj.Multipart || !bytes.Equal(obj.Data, data) {
+			t.Fatal("expected multipart object with data")
+		} else if got, want := s.PartNums(), []int{1, 2}; !equalInts(got, want) {
+			t.Fatalf("parts=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure snapshots below the threshold are uploaded in a single request.
+	t.Run("BelowThreshold", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+
+		if _, err := r.PutObject(context.Background(), key, strings.NewReader("data"), litestream.PutOptions{
+			Type:       litestream.ObjectTypeSnapshot,
+			SourceSize: r.MultipartThreshold - 1,
+		}); err != nil {
+			t.Fatal(err)
+		} else if obj := s.Object(key); obj == nil || obj.Multipart {
+			t.Fatal("expected single request upload")
+		}
+	})
+
+	// Ensure an interrupted upload is resumed by only sending the parts
+	// which were not uploaded.
+	t.Run("Resume", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+		data := MustRandomBytes(t, s3.MinPartSize+1024)
+
+		MustPutInterruptedSnapshot(t, r, key, data[:s3.MinPartSize])
+		if got, want := s.UploadKeys(), []string{key}; !equalStrings(got, want) {
+			t.Fatalf("uploads=%v, want %v", got, want)
+		}
+
+		MustPutSnapshot(t, r, key, bytes.NewReader(data))
+		if obj := s.Object(key); obj == nil || !bytes.Equal(obj.Data, data) {
+			t.Fatal("expected object with data")
+		} else if got, want := s.PartNums(), []int{1, 2}; !equalInts(got, want) {
+			t.Fatalf("parts=%v, want %v", got, want)
+		} else if keys := s.UploadKeys(); len(keys) != 0 {
+			t.Fatalf("unexpected uploads: %v", keys)
+		}
+	})
+
+	// Ensure parts which differ from the interrupted upload are sent again.
+	t.Run("ResumeChanged", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+
+		MustPutInterruptedSnapshot(t, r, key, MustRandomBytes(t, s3.MinPartSize))
+
+		data := MustRandomBytes(t, s3.MinPartSize+1024)
+		MustPutSnapshot(t, r, key, bytes.NewReader(data))
+		if obj := s.Object(key); obj == nil || !bytes.Equal(obj.Data, data) {
+			t.Fatal("expected object with new data")
+		} else if got, want := s.PartNums(), []int{1, 1, 2}; !equalInts(got, want) {
+			t.Fatalf("parts=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure incomplete uploads of other snapshots are aborted.
+	t.Run("AbortStale", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+
+		MustPutInterruptedSnapshot(t, r, otherKey, MustRandomBytes(t, s3.MinPartSize))
+		MustPutSnapshot(t, r, key, bytes.NewReader(MustRandomBytes(t, s3.MinPartSize+1024)))
+		if keys := s.UploadKeys(); len(keys) != 0 {
+			t.Fatalf("unexpected uploads: %v", keys)
+		}
+	})
+
+	// Ensure a failed part is returned & the upload is kept to be resumed.
+	t.Run("ErrUploadPart", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestMultipartReplica(t, s)
+		s.FailParts = true
+
+		_, err := r.PutObject(context.Background(), key, bytes.NewReader(MustRandomBytes(t, 1024)), litestream.PutOptions{
+			Type:       litestream.ObjectTypeSnapshot,
+			SourceSize: r.MultipartThreshold,
+		})
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) || aerr.Code() != "AccessDenied" {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := s.UploadKeys(), []string{key}; !equalStrings(got, want) {
+			t.Fatalf("uploads=%v, want %v", got, want)
+		} else if s.Object(key) != nil {
+			t.Fatal("unexpected object")
+		}
+	})
+}
+
+// NewTestMultipartReplica returns a replica which uploads all snapshots in
+// parts of the minimum size.
+func NewTestMultipartReplica(tb testing.TB, s *Server) *s3.Replica {
+	tb.Helper()
+	r := NewTestReplica(tb, litestream.NewDB(filepath.Join(tb.TempDir(), "db")), s)
+	r.MultipartThreshold = 1024
+	r.PartSize = s3.MinPartSize
+	if err := r.Init(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+// MustPutSnapshot uploads the snapshot in rd to key.
+func MustPutSnapshot(tb testing.TB, r *s3.Replica, key string, rd io.Reader) {
+	tb.Helper()
+	if _, err := r.PutObject(context.Background(), key, rd, litestream.PutOptions{
+		Type:       litestream.ObjectTypeSnapshot,
+		SourceSize: r.MultipartThreshold,
+	}); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustPutInterruptedSnapshot uploads data to key in parts & then fails
+// before the upload is completed.
+func MustPutInterruptedSnapshot(tb testing.TB, r *s3.Replica, key string, data []byte) {
+	tb.Helper()
+	errInterrupted := errors.New("interrupted")
+	rd := io.MultiReader(bytes.NewReader(data), &errReader{err: errInterrupted})
+	if _, err := r.PutObject(context.Background(), key, rd, litestream.PutOptions{
+		Type:       litestream.ObjectTypeSnapshot,
+		SourceSize: r.MultipartThreshold,
+	}); err != errInterrupted {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// MustRandomBytes returns n random bytes.
+func MustRandomBytes(tb testing.TB, n int64) []byte {
+	tb.Helper()
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		tb.Fatal(err)
+	}
+	return buf
+}
+
+// errReader is a reader which always returns err.
+type errReader struct{ err error }
+
+func (r *errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// NewTestReplica returns a replica for db which stores objects on s.
+func NewTestReplica(tb testing.TB, db *litestream.DB, s *Server) *s3.Replica {
+	tb.Helper()
+
+	r := s3.NewReplica(db, "")
+	r.AccessKeyID = "AKID"
+	r.SecretAccessKey = "SECRET"
+	r.Region = "us-east-1"
+	r.Bucket = "bkt"
+	r.Path = "backups"
+	r.Endpoint = s.URL
+	r.ForcePathStyle = true
+	r.MonitorEnabled = false
+	return r
+}
+
+// MustOpenDBs returns a new instance of a DB & associated SQL DB. Both are
+// closed when the test ends.
+func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return db, sqldb
+}
+
+// MustSyncReplica writes a row to a new table & syncs it to the replica.
+func MustSyncReplica(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *s3.Replica) {
+	tb.Helper()
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		tb.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustPutObjects uploads an object for each key.
+func MustPutObjects(tb testing.TB, r *s3.Replica, keys ...string) {
+	tb.Helper()
+	if err := r.Init(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := r.PutObject(context.Background(), key, strings.NewReader(key), litestream.PutOptions{}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// MustRestoreRowCount restores the latest position of a generation and
+// returns the number of rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r *s3.Replica, generation string) int {
+	tb.Helper()
+
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(tb.TempDir(), "db")
+	opt.Generation = generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer sqldb.Close()
+
+	var n int
+	if err := sqldb.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+// MustWaitConnsClosed waits for all client connections to s to close.
+func MustWaitConnsClosed(tb testing.TB, s *Server) {
+	tb.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, openN := s.ConnN(); openN == 0 {
+			return
+		} else if time.Now().After(deadline) {
+			tb.Fatalf("%d connections still open", openN)
+		}
+	}
+}
+
+// MustWriteFile writes data to filename, or to a new temporary file if
+// filename is blank, & returns the filename.
+func MustWriteFile(tb testing.TB, filename, data string) string {
+	tb.Helper()
+	if filename == "" {
+		filename = filepath.Join(tb.TempDir(), "file")
+	}
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Server is a fake S3 server which implements the path-style REST API calls
+// used by the replica for bucket "bkt" & stores objects in memory.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]*ServerObject
+	uploads   map[string]*serverUpload // by upload ID
+	uploadSeq int
+	deleteErr map[string]bool
+	userAgent []string
+	keyIDs    []string
+	now       time.Time // modification time of new objects, if set
+	partNums  []int     // part numbers received, in order
+
+	// If true, every part upload fails as access denied.
+	FailParts bool
+
+	connMu sync.Mutex
+	conns  map[net.Conn]http.ConnState // by client connection
+
+	// If true, every request fails as access denied.
+	Fail bool
+}
+
+// ServerObject is an object stored on the fake server.
+type ServerObject struct {
+	Data         []byte
+	Metadata     map[string]string
+	StorageClass string
+	Multipart    bool
+	ModTime      time.Time
+}
+
+type serverUpload struct {
+	key          string
+	storageClass string
+	parts        map[int][]byte
+	initiated    time.Time
+}
+
+// NewServer returns a running fake S3 server which is closed when the test ends.
+func NewServer(tb testing.TB) *Server {
+	s := &Server{
+		objects:   make(map[string]*ServerObject),
+		uploads:   make(map[string]*serverUpload),
+		deleteErr: make(map[string]bool),
+		conns:     make(map[net.Conn]http.ConnState),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.Config.ConnState = s.setConnState
+	s.Start()
+	tb.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) setConnState(conn net.Conn, state http.ConnState) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.conns[conn] = state
+}
+
+// ConnN returns the number of connections opened by clients & the number
+// which are still open.
+func (s *Server) ConnN() (n, openN int) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	for _, state := range s.conns {
+		if state != http.StateClosed && state != http.StateHijacked {
+			openN++
+		}
+	}
+	return len(s.conns), openN
+}
+
+// Keys returns the sorted keys of all objects beginning with prefix.
+func (s *Server) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(prefix)
+}
+
+func (s *Server) keys(prefix string) []string {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the object stored at key, or nil if it does not exist.
+func (s *Server) Object(key string) *ServerObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+// SetNow sets the modification time of new objects. Uses the current time
+// if zero.
+func (s *Server) SetNow(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = t
+}
+
+func (s *Server) modTime() time.Time {
+	if s.now.IsZero() {
+		return time.Now().UTC()
+	}
+	return s.now.UTC()
+}
+
+// PartNums returns the number of every part uploaded, in order.
+func (s *Server) PartNums() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.partNums...)
+}
+
+// UploadKeys returns the sorted keys of incomplete multipart uploads.
+func (s *Server) UploadKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.uploads))
+	for _, u := range s.uploads {
+		keys = append(keys, u.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetDeleteError causes deletes of key to be reported as failed.
+func (s *Server) SetDeleteError(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteErr[key] = true
+}
+
+// UserAgents returns the User-Agent header of every request received.
+func (s *Server) UserAgents() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.userAgent...)
+}
+
+// AccessKeyIDs returns the access key ID which signed each request received.
+func (s *Server) AccessKeyIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keyIDs...)
+}
+
+// accessKeyID returns the access key ID from the signature of r.
+func accessKeyID(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		auth = auth[i+len("Credential="):]
+		if i := strings.Index(auth, "/"); i >= 0 {
+			return auth[:i]
+		}
+	}
+	return ""
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userAgent = append(s.userAgent, r.Header.Get("User-Agent"))
+	s.keyIDs = append(s.keyIDs, accessKeyID(r))
+
+	if s.Fail {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	} else if r.URL.Path != "/bkt" && !strings.HasPrefix(r.URL.Path, "/bkt/") {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	q := r.URL.Query()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bkt"), "/")
+	switch {
+	case key == "" && r.Method == "GET" && q["location"] != nil:
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case key == "" && r.Method == "GET" && q["uploads"] != nil:
+		s.listUploads(w, r)
+	case key == "" && r.Method == "GET":
+		s.list(w, r)
+	case key == "" && r.Method == "POST" && q["delete"] != nil:
+		s.delete(w, r)
+	case r.Method == "POST" && q["uploads"] != nil:
+		s.createUpload(w, r, key)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		s.uploadPart(w, r, key)
+	case r.Method == "GET" && q.Get("uploadId") != "":
+		s.listParts(w, r)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		s.completeUpload(w, r, key)
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		s.put(w, r, key)
+	case r.Method == "GET":
+		s.get(w, key)
+	default:
+		writeError(w, http.StatusBadRequest, "InvalidRequest")
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	var result struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}
+	result.Name = "bkt"
+
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	result.Prefix = prefix
+	seen := make(map[string]bool)
+	for _, key := range s.keys(prefix) {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				if p := key[:len(prefix)+i+1]; !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, LastModified: obj.ModTime.Format(time.RFC3339Nano), Size: len(obj.Data)})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	metadata := make(map[string]string)
+	for k := range r.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(name, "x-amz-meta-")] = r.Header.Get(k)
+		}
+	}
+
+	s.objects[key] = &ServerObject{
+		Data:         data,
+		Metadata:     metadata,
+		StorageClass: r.Header.Get("X-Amz-Storage-Class"),
+		ModTime:      s.modTime(),
+	}
+	w.Header().Set("ETag", etag(data))
+}
+
+func (s *Server) get(w http.ResponseWriter, key string) {
+	obj := s.objects[key]
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	for k, v := range obj.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+	w.Header().Set("Last-Modified", obj.ModTime.Format(http.TimeFormat))
+	_, _ = w.Write(obj.Data)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	var result struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Errors  []deleteError `xml:"Error"`
+	}
+	for _, obj := range req.Objects {
+		if s.deleteErr[obj.Key] {
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "AccessDenied", Message: "Access Denied"})
+			continue
+		}
+		delete(s.objects, obj.Key)
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) listUploads(w http.ResponseWriter, r *http.Request) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	var result struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}
+	result.Bucket = "bkt"
+
+	prefix := r.URL.Query().Get("prefix")
+	for id, u := range s.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id, Initiated: u.initiated.Format(time.RFC3339Nano)})
+		}
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.uploadSeq++
+	id := fmt.Sprintf("upload%d", s.uploadSeq)
+	s.uploads[id] = &serverUpload{
+		key:          key,
+		storageClass: r.Header.Get("X-Amz-Storage-Class"),
+		parts:        make(map[int][]byte),
+		initiated:    time.Now().UTC(),
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: "bkt", Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, key string) {
+	u := s.uploads[r.URL.Query().Get("uploadId")]
+	num, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if u == nil || u.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	} else if s.FailParts {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	s.partNums = append(s.partNums, num)
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	u.parts[num] = data
+	w.Header().Set("ETag", etag(data))
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request) {
+	u := s.uploads[r.URL.Query().Get("uploadId")]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int
+	}
+	var result struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}
+	for num, data := range u.parts {
+		result.Parts = append(result.Parts, part{PartNumber: num, ETag: etag(data), Size: len(data)})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, key string) {
+	id := r.URL.Query().Get("uploadId")
+	u := s.uploads[id]
+	if u == nil || u.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var req struct {
+		Parts []struct{ PartNumber int } `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, part := range req.Parts {
+		data, ok := u.parts[part.PartNumber]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		buf.Write(data)
+	}
+	delete(s.uploads, id)
+
+	s.objects[key] = &ServerObject{
+		Data:         buf.Bytes(),
+		StorageClass: u.storageClass,
+		Multipart:    true,
+		ModTime:      s.modTime(),
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: "bkt", Key: key, ETag: etag(buf.Bytes())})
+}
+
+// etag returns the quoted MD5 hex digest S3 returns as the ETag of data.
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(status)})
+}
@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// sessions holds the clients shared by replicas with ShareClient set.
+var sessions = struct {
+	mu sync.Mutex
+	m  map[sessionKey]*sharedSession
+}{m: make(map[sessionKey]*sharedSession)}
+
+// sessionKey identifies the replicas which can share a client. Each replica
+// still uses its own bucket, path & position.
+type sessionKey struct {
+	region         string
+	endpoint       string
+	forcePathStyle bool
+	userAgent      string
+
+	accessKeyID         string
+	secretAccessKey     string
+	accessKeyIDFile     string
+	secretAccessKeyFile string
+}
+
+// sharedSession is an S3 client & HTTP connection pool shared by replicas.
+type sharedSession struct {
+	key       sessionKey
+	s3        *s3.S3
+	uploader  *s3manager.Uploader
+	fileCreds *fileCredentials // credential file provider, if used
+	transport *http.Transport
+	refN      int // number of replicas using the session
+}
+
+// acquireSession returns the shared session for the replica's credentials in
+// region, creating it if no other replica uses one. The caller must release
+// the session with releaseSession.
+func (r *Replica) acquireSession(region string) (*sharedSession, error) {
+	key := sessionKey{
+		region:              region,
+		endpoint:            r.Endpoint,
+		forcePathStyle:      r.ForcePathStyle,
+		userAgent:           r.UserAgent,
+		accessKeyID:         r.AccessKeyID,
+		secretAccessKey:     r.SecretAccessKey,
+		accessKeyIDFile:     r.AccessKeyIDFile,
+		secretAccessKeyFile: r.SecretAccessKeyFile,
+	}
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	ss := sessions.m[key]
+	if ss == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+
+		config := r.config()
+		config.Region = aws.String(region)
+		config.HTTPClient = &http.Client{Transport: transport}
+		sess, err := r.newSession(config)
+		if err != nil {
+			return nil, err
+		}
+
+		ss = &sharedSession{
+			key:       key,
+			s3:        s3.New(sess),
+			uploader:  s3manager.NewUploader(sess),
+			transport: transport,
+		}
+		if key.accessKeyIDFile != "" || key.secretAccessKeyFile != "" {
+			ss.fileCreds = r.credentialFiles()
+		}
+		sessions.m[key] = ss
+	}
+	ss.refN++
+
+	// Reload the credential files used by the session, not a copy.
+	if ss.fileCreds != nil {
+		r.credsMu.Lock()
+		r.fileCreds = ss.fileCreds
+		r.credsMu.Unlock()
+	}
+	return ss, nil
+}
+
+// releaseSession decrements the reference count of ss & closes its idle
+// connections once no replica uses it.
+func releaseSession(ss *sharedSession) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	if ss.refN--; ss.refN > 0 {
+		return
+	}
+	delete(sessions.m, ss.key)
+	ss.transport.CloseIdleConnections()
+}
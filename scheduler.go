@@ -0,0 +1,99 @@
+package litestream
+
+import (
+	"context"
+	"sync"
+)
+
+// UploadScheduler bounds the number of uploads running concurrently across
+// all databases that share it. When every slot is in use, waiting uploads are
+// granted slots in order of their priority so uploads for critical databases
+// are started before queued uploads for bulk databases. Uploads of equal
+// priority are granted slots in the order they were requested.
+//
+// Uploads which have already started are never interrupted.
+type UploadScheduler struct {
+	mu      sync.Mutex
+	n       int // maximum concurrent uploads
+	active  int // number of slots in use
+	seq     uint64
+	waiters []*uploadWaiter
+}
+
+type uploadWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// NewUploadScheduler returns a scheduler that allows n concurrent uploads.
+func NewUploadScheduler(n int) *UploadScheduler {
+	if n < 1 {
+		n = 1
+	}
+	return &UploadScheduler{n: n}
+}
+
+// Acquire waits for an upload slot. Higher priorities are granted slots first.
+// The returned function must be called to release the slot once the upload is
+// complete. Returns an error if ctx is canceled before a slot is available.
+func (s *UploadScheduler) Acquire(ctx context.Context, priority int) (release func(), err error) {
+	s.mu.Lock()
+	if s.active < s.n && len(s.waiters) == 0 {
+		s.active++
+		s.mu.Unlock()
+		return s.releaseFunc(), nil
+	}
+
+	s.seq++
+	w := &uploadWaiter{priority: priority, seq: s.seq, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaseFunc(), nil
+	case <-ctx.Done():
+	}
+
+	// Remove from the queue. If the slot was granted while canceling then
+	// pass it on to the next waiter.
+	s.mu.Lock()
+	for i := range s.waiters {
+		if s.waiters[i] == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	s.mu.Unlock()
+	s.releaseFunc()()
+	return nil, ctx.Err()
+}
+
+// releaseFunc returns a function that releases a slot exactly once.
+func (s *UploadScheduler) releaseFunc() func() {
+	var once sync.Once
+	return func() { once.Do(s.release) }
+}
+
+// release hands the slot to the highest priority waiter, if any.
+func (s *UploadScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiters) == 0 {
+		s.active--
+		return
+	}
+
+	next := 0
+	for i, w := range s.waiters {
+		if w.priority > s.waiters[next].priority || (w.priority == s.waiters[next].priority && w.seq < s.waiters[next].seq) {
+			next = i
+		}
+	}
+	w := s.waiters[next]
+	s.waiters = append(s.waiters[:next], s.waiters[next+1:]...)
+	close(w.ready)
+}
@@ -0,0 +1,151 @@
+package litestream_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestUploadScheduler(t *testing.T) {
+	// Ensure that queued high priority uploads are started before queued low
+	// priority uploads when the link is saturated.
+	t.Run("Priority", func(t *testing.T) {
+		s := litestream.NewUploadScheduler(1)
+
+		// Simulate a slow upload holding the only slot.
+		release, err := s.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var order []string
+		var wg sync.WaitGroup
+		enqueue := func(name string, priority int) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := s.Acquire(context.Background(), priority)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				release()
+			}()
+			time.Sleep(10 * time.Millisecond) // ensure queue order
+		}
+
+		enqueue("low0", 0)
+		enqueue("low1", 0)
+		enqueue("high", 10)
+		enqueue("mid", 5)
+
+		release()
+		wg.Wait()
+
+		if got, want := order, []string{"high", "mid", "low0", "low1"}; !equalStrings(got, want) {
+			t.Fatalf("order=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure a canceled waiter is removed from the queue.
+	t.Run("Canceled", func(t *testing.T) {
+		s := litestream.NewUploadScheduler(1)
+		release, err := s.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := s.Acquire(ctx, 0); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Slot should be available again once released.
+		release()
+		if release, err = s.Acquire(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+		release()
+	})
+}
+
+func TestDB_UploadScheduler(t *testing.T) {
+	// Ensure replicas of a high priority database upload before replicas of a
+	// low priority database while sharing a saturated scheduler.
+	s := litestream.NewUploadScheduler(1)
+
+	var dbs []*litestream.DB
+	var replicas []*litestream.FileReplica
+	for _, priority := range []int{0, 10} {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.Priority, db.UploadScheduler = priority, s
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		dbs, replicas = append(dbs, db), append(replicas, r)
+	}
+
+	// Hold the only slot to simulate a slow in-flight upload.
+	release, err := s.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := range replicas {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := replicas[i].Sync(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, dbs[i].Priority)
+			mu.Unlock()
+		}()
+		time.Sleep(50 * time.Millisecond) // ensure low priority is queued first
+	}
+
+	// Neither replica can upload while the slot is held.
+	mu.Lock()
+	if len(order) != 0 {
+		t.Fatalf("unexpected uploads while slot held: %v", order)
+	}
+	mu.Unlock()
+
+	release()
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != 10 || order[1] != 0 {
+		t.Fatalf("unexpected upload order: %v", order)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package litestream
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SnapshotReasonSchemaChange is the snapshot reason recorded when a change to
+// the schema or user version of the database is detected.
+const SnapshotReasonSchemaChange = "schema change"
+
+// schemaState tracks the versions of the database schema as of the last sync.
+type schemaState struct {
+	valid         bool // true once versions have been read
+	schemaVersion int
+	userVersion   int
+}
+
+// snapshotRequest describes the latest snapshot requested by the database.
+// Replicas snapshot once for each increment of seq.
+type snapshotRequest struct {
+	seq    int
+	reason string
+}
+
+// schemaChanged reads the schema & user versions of the database within tx
+// and returns true if either differs from the previous sync. Always returns
+// false on the first read as there is no previous version to compare to.
+func (db *DB) schemaChanged(tx *sql.Tx) (bool, error) {
+	var schemaVersion, userVersion int
+	if err := tx.QueryRow(`PRAGMA schema_version;`).Scan(&schemaVersion); err != nil {
+		return false, fmt.Errorf("schema_version: %w", err)
+	} else if err := tx.QueryRow(`PRAGMA user_version;`).Scan(&userVersion); err != nil {
+		return false, fmt.Errorf("user_version: %w", err)
+	}
+
+	prev := db.schema
+	db.schema = schemaState{valid: true, schemaVersion: schemaVersion, userVersion: userVersion}
+	return prev.valid && (prev.schemaVersion != schemaVersion || prev.userVersion != userVersion), nil
+}
+
+// requestSnapshot records that replicas should take a new snapshot. Must be
+// called while holding the write lock.
+func (db *DB) requestSnapshot(reason string) {
+	db.snapshotRequest.seq++
+	db.snapshotRequest.reason = reason
+}
+
+// SnapshotRequest returns the sequence number & reason of the latest snapshot
+// requested by the database. A replica should snapshot when seq is greater
+// than the sequence it last handled. Returns a zero seq if none requested.
+func (db *DB) SnapshotRequest() (seq int, reason string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.snapshotRequest.seq, db.snapshotRequest.reason
+}
@@ -0,0 +1,119 @@
+package litestream_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestDB_SnapshotOnSchemaChange(t *testing.T) {
+	// Ensure a DDL statement triggers a new snapshot with the schema change reason.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.SnapshotOnSchemaChange = true
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustSyncDBReplica(t, db, r)
+
+		if seq, _ := db.SnapshotRequest(); seq != 0 {
+			t.Fatalf("unexpected snapshot request: seq=%d", seq)
+		} else if n := MustSnapshotN(t, r); n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+
+		if _, err := sqldb.Exec(`ALTER TABLE foo ADD COLUMN baz TEXT;`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if seq, reason := db.SnapshotRequest(); seq != 1 {
+			t.Fatalf("seq=%d, want 1", seq)
+		} else if reason != litestream.SnapshotReasonSchemaChange {
+			t.Fatalf("reason=%q, want %q", reason, litestream.SnapshotReasonSchemaChange)
+		} else if n := MustSnapshotN(t, r); n != 2 {
+			t.Fatalf("n=%d, want 2", n)
+		}
+
+		// Ensure the new snapshot starts after the migration was checkpointed.
+		if index, err := r.MaxSnapshotIndex(r.LastPos().Generation); err != nil {
+			t.Fatal(err)
+		} else if index == 0 {
+			t.Fatal("expected snapshot at new index")
+		}
+
+		// Ensure a regular write does not trigger another snapshot.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar, baz) VALUES ('x', 'y');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if n := MustSnapshotN(t, r); n != 2 {
+			t.Fatalf("n=%d, want 2", n)
+		} else if got, want := MustRestoreRowCount(t, r, r.LastPos().Generation), 2; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure changes to the user version are also detected.
+	t.Run("UserVersion", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.SnapshotOnSchemaChange = true
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if _, err := sqldb.Exec(`PRAGMA user_version = 2;`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if seq, _ := db.SnapshotRequest(); seq != 1 {
+			t.Fatalf("seq=%d, want 1", seq)
+		} else if n := MustSnapshotN(t, r); n != 2 {
+			t.Fatalf("n=%d, want 2", n)
+		}
+	})
+
+	// Ensure schema changes are ignored if not enabled.
+	t.Run("Disabled", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if _, err := sqldb.Exec(`CREATE TABLE bar (baz TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if seq, _ := db.SnapshotRequest(); seq != 0 {
+			t.Fatalf("seq=%d, want 0", seq)
+		} else if n := MustSnapshotN(t, r); n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+	})
+}
+
+// MustSnapshotN returns the number of snapshots in the replica.
+func MustSnapshotN(tb testing.TB, r litestream.Replica) int {
+	tb.Helper()
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return len(snapshots)
+}
@@ -0,0 +1,510 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP replica default settings.
+const (
+	DefaultSyncInterval = 10 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+
+	DefaultCompressionWorkers = 1
+
+	DefaultPort = 22
+
+	DefaultDialTimeout = 30 * time.Second
+)
+
+// MetadataExt is the extension of the file stored next to a file with the
+// JSON-encoded metadata of the file, such as the checksum of a WAL segment.
+// SFTP has no file metadata.
+const MetadataExt = ".metadata"
+
+// ErrHostKeyRequired is returned when no known_hosts file is available to
+// verify the server's host key & host key checking is not disabled.
+var ErrHostKeyRequired = errors.New("sftp host key path required")
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.ObjectWriter = (*Replica)(nil)
+var _ litestream.CommitTimeReader = (*Replica)(nil)
+var _ litestream.ReplicaWriter = (*Replica)(nil)
+var _ litestream.ObjectClient = (*Replica)(nil)
+var _ litestream.ObjectDirRemover = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to a directory on a remote server
+// over SFTP. Files are written with the same layout as S3 replicas.
+type Replica struct {
+	*litestream.ObjectReplica
+
+	clientMu  sync.Mutex
+	client    *sftp.Client // sftp client, nil if not connected
+	sshClient *ssh.Client  // underlying ssh connection
+
+	// Server address. Port defaults to 22 if zero.
+	Host string
+	Port int
+
+	// User to authenticate as. The password & the private key, if set, are
+	// both offered to the server. KeyPassphrase decrypts a protected key.
+	User          string
+	Password      string
+	KeyPath       string
+	KeyPassphrase string
+
+	// Path to a known_hosts file used to verify the server's host key.
+	// Defaults to ~/.ssh/known_hosts if blank. Connecting fails if the file
+	// does not exist unless InsecureIgnoreHostKey is set.
+	HostKeyPath string
+
+	// If true, the server's host key is not verified. This allows a
+	// man-in-the-middle to read & alter replicated data so it should only be
+	// used on trusted networks.
+	InsecureIgnoreHostKey bool
+
+	// Maximum time to wait to connect & complete the SSH handshake.
+	DialTimeout time.Duration
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		Port:        DefaultPort,
+		DialTimeout: DefaultDialTimeout,
+	}
+
+	r.ObjectReplica = litestream.NewObjectReplica(db, name, r, operationTotalCounterVec, operationBytesCounterVec)
+	r.SyncInterval = DefaultSyncInterval
+	r.Retention = DefaultRetention
+	r.RetentionCheckInterval = DefaultRetentionCheckInterval
+	r.CompressionWorkers = DefaultCompressionWorkers
+
+	return r
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "sftp"
+}
+
+// URL returns the location of the replica as an "sftp" URL.
+func (r *Replica) URL() string {
+	u := &url.URL{Scheme: "sftp", Host: r.addr(), Path: path.Join("/", r.Path)}
+	if r.User != "" {
+		u.User = url.User(r.User)
+	}
+	return u.String()
+}
+
+// addr returns the host & port of the server.
+func (r *Replica) addr() string {
+	port := r.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(r.Host, strconv.Itoa(port))
+}
+
+// Init connects to the SFTP server. No-op if already connected. If the
+// connection drops, the next call reconnects.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	_, err = r.connect(ctx)
+	return err
+}
+
+// Stop cancels any outstanding replication & disconnects from the server.
+func (r *Replica) Stop() {
+	r.ObjectReplica.Stop()
+	r.disconnect()
+}
+
+// connect returns the SFTP client, connecting to the server if necessary.
+func (r *Replica) connect(ctx context.Context) (_ *sftp.Client, err error) {
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	if r.Host == "" {
+		return nil, fmt.Errorf("sftp host required")
+	} else if r.User == "" {
+		return nil, fmt.Errorf("sftp user required")
+	}
+
+	config, err := r.sshConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dial & complete the handshake within the dial timeout.
+	addr := r.addr()
+	dialer := net.Dialer{Timeout: r.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.DialTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(r.DialTimeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	sshClient := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	r.client, r.sshClient = client, sshClient
+
+	// Forget the client once the connection drops so the next call reconnects.
+	go func() {
+		_ = client.Wait()
+
+		r.clientMu.Lock()
+		defer r.clientMu.Unlock()
+		if r.client == client {
+			r.client, r.sshClient = nil, nil
+			sshClient.Close()
+		}
+	}()
+
+	return client, nil
+}
+
+// disconnect closes the connection to the server, if connected.
+func (r *Replica) disconnect() {
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+
+	if r.client == nil {
+		return
+	}
+	r.client.Close()
+	r.sshClient.Close()
+	r.client, r.sshClient = nil, nil
+}
+
+// sshConfig returns the SSH client configuration for the replica.
+func (r *Replica) sshConfig() (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{
+		User:    r.User,
+		Timeout: r.DialTimeout,
+	}
+
+	if r.KeyPath != "" {
+		buf, err := ioutil.ReadFile(r.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read sftp key: %w", err)
+		}
+
+		var signer ssh.Signer
+		if r.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(r.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(buf)
+		}
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, fmt.Errorf("sftp key passphrase required: %s", r.KeyPath)
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot parse sftp key: %w", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if r.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(r.Password))
+	}
+	if len(config.Auth) == 0 {
+		return nil, fmt.Errorf("sftp password or key path required")
+	}
+
+	callback, err := r.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = callback
+
+	return config, nil
+}
+
+// hostKeyCallback returns the callback used to verify the server's host key.
+// Host keys are read from HostKeyPath or, if blank, the user's known_hosts
+// file. Returns ErrHostKeyRequired if no known_hosts file exists.
+func (r *Replica) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if r.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	filename := r.HostKeyPath
+	if filename == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, ErrHostKeyRequired
+		}
+		filename = filepath.Join(homeDir, ".ssh", "known_hosts")
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return nil, ErrHostKeyRequired
+		}
+	}
+
+	callback, err := knownhosts.New(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sftp host keys: %w", err)
+	}
+	return callback, nil
+}
+
+// readDir returns the entries of a remote directory sorted by name.
+// Returns no entries if the directory does not exist.
+func (r *Replica) readDir(ctx context.Context, dir string) ([]os.FileInfo, error) {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := client.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// ListObjects calls fn for each file in the directory of prefix whose path
+// begins with prefix. Subdirectories are passed as directories. Partially
+// written temporary files & metadata files are skipped. Metadata is only
+// returned by GetObject.
+func (r *Replica) ListObjects(ctx context.Context, prefix string, fn func(litestream.ObjectInfo) error) error {
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+
+	fis, err := r.readDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		key := path.Join(dir, fi.Name())
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".tmp") || strings.HasSuffix(key, MetadataExt) {
+			continue
+		}
+
+		obj := litestream.ObjectInfo{Key: key, IsDir: fi.IsDir()}
+		if !fi.IsDir() {
+			obj.Size, obj.ModTime = fi.Size(), fi.ModTime().UTC()
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutObject writes the contents of rd to the file at key & sets its
+// modification time to opts.ModTime, if set. Metadata is written to a
+// separate file first so the file is never listed without it.
+func (r *Replica) PutObject(ctx context.Context, key string, rd io.Reader, opts litestream.PutOptions) (int64, error) {
+	if len(opts.Metadata) > 0 {
+		buf, err := json.Marshal(opts.Metadata)
+		if err != nil {
+			return 0, err
+		} else if _, err := r.writeFile(ctx, key+MetadataExt, bytes.NewReader(buf)); err != nil {
+			return 0, fmt.Errorf("cannot write metadata: %w", err)
+		}
+	}
+
+	n, err := r.writeFile(ctx, key, litestream.NewThrottledReader(ctx, rd, opts.Limiter))
+	if err != nil {
+		return n, err
+	} else if err := r.setModTime(ctx, key, opts.ModTime); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// GetObject returns a reader for the file at key along with its metadata,
+// if any.
+func (r *Replica) GetObject(ctx context.Context, key string) (io.ReadCloser, litestream.ObjectInfo, error) {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return nil, litestream.ObjectInfo{}, err
+	}
+
+	f, err := client.Open(key)
+	if os.IsNotExist(err) {
+		return nil, litestream.ObjectInfo{}, os.ErrNotExist
+	} else if err != nil {
+		return nil, litestream.ObjectInfo{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, litestream.ObjectInfo{}, err
+	}
+
+	metadata, err := r.readMetadata(client, key)
+	if err != nil {
+		f.Close()
+		return nil, litestream.ObjectInfo{}, err
+	}
+	return f, litestream.ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime().UTC(), Metadata: metadata}, nil
+}
+
+// readMetadata returns the metadata written with the file at key. Returns
+// nil if the file has no metadata, such as files written by older versions.
+func (r *Replica) readMetadata(client *sftp.Client, key string) (map[string]string, error) {
+	f, err := client.Open(key + MetadataExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var metadata map[string]string
+	if err := json.NewDecoder(f).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("cannot decode metadata: %s: %w", key, err)
+	}
+	return metadata, nil
+}
+
+// DeleteObjects removes each file & its metadata. Files already removed, such
+// as by a previous failed run, are ignored.
+func (r *Replica) DeleteObjects(ctx context.Context, objs []litestream.ObjectInfo) error {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		for _, filename := range []string{obj.Key, obj.Key + MetadataExt} {
+			if err := client.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveDir removes dir if it is empty. No-op if dir does not exist.
+func (r *Replica) RemoveDir(ctx context.Context, dir string) error {
+	fis, err := r.readDir(ctx, dir)
+	if err != nil {
+		return err
+	} else if len(fis) > 0 {
+		return nil
+	}
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.RemoveDirectory(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes the contents of rd to a temporary file & renames it to
+// filename so a dropped connection never leaves a partial file in its place.
+// Parent directories are created as needed. Returns the bytes written.
+func (r *Replica) writeFile(ctx context.Context, filename string, rd io.Reader) (n int64, err error) {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := client.MkdirAll(path.Dir(filename)); err != nil {
+		return 0, fmt.Errorf("cannot make parent directory: %w", err)
+	}
+
+	tmpPath := filename + ".tmp"
+	f, err := client.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if n, err = io.Copy(f, rd); err != nil {
+		return n, err
+	} else if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	// Replace any existing file, such as an earlier commit time index.
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return n, client.PosixRename(tmpPath, filename)
+	}
+	if err := client.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	return n, client.Rename(tmpPath, filename)
+}
+
+// setModTime sets the access & modification times of filename to t.
+// No-op if t is zero.
+func (r *Replica) setModTime(ctx context.Context, filename string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Chtimes(filename, t, t)
+}
+
+// SFTP metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "sftp",
+		Name:      "operation_total",
+		Help:      "The number of SFTP operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "sftp",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by SFTP operations",
+	}, []string{"db", "name", "type"})
+)
@@ -0,0 +1,393 @@
+package sftp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	lsftp "github.com/benbjohnson/litestream/sftp"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if generations, err := r.Generations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(generations) != 1 || generations[0] != pos.Generation {
+		t.Fatalf("Generations()=%v, want [%s]", generations, pos.Generation)
+	}
+
+	// Ensure the database is restored from the stored files.
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(t.TempDir(), "db")
+	opt.Generation = pos.Generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var n int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Fatalf("n=%d, want 5", n)
+	}
+}
+
+func TestReplica_WALReader(t *testing.T) {
+	// Ensure segments are validated against the checksum written on upload.
+	t.Run("ErrChecksumMismatch", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		s := NewServer(t)
+		r := NewTestReplica(t, db, s)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		pos := r.LastPos()
+
+		if _, err := r.WALReader(context.Background(), pos.Generation, pos.Index); err != nil {
+			t.Fatal(err)
+		}
+
+		// Store a different checksum for each segment of the WAL file.
+		filenames, err := filepath.Glob(filepath.Join(r.WALDir(pos.Generation), "*"+lsftp.MetadataExt))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(filenames) == 0 {
+			t.Fatal("expected segment metadata")
+		}
+		for _, filename := range filenames {
+			if err := ioutil.WriteFile(filename, []byte(`{"litestream-checksum":"0"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := r.WALReader(context.Background(), pos.Generation, pos.Index); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_RunRetention(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	s := NewServer(t)
+	r := NewTestReplica(t, db, s)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a generation whose only snapshot is older than the retention.
+	const generation = "0000000000000001"
+	createdAt := time.Now().Add(-2 * r.Retention)
+	if err := r.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data"), createdAt); err != nil {
+		t.Fatal(err)
+	} else if err := r.WriteWAL(context.Background(), generation, 0, bytes.NewReader(make([]byte, 32)), createdAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := r.RunRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(result.Generations) != 1 || result.Generations[0] != generation {
+		t.Fatalf("Generations=%v, want [%s]", result.Generations, generation)
+	}
+
+	// Ensure the emptied generation directory, including segment metadata,
+	// is removed as well.
+	if _, err := os.Stat(r.GenerationDir(generation)); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := os.Stat(r.GenerationDir(r.LastPos().Generation)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplica_Init(t *testing.T) {
+	// Ensure connecting fails without a known_hosts file to verify the server.
+	t.Run("ErrHostKeyRequired", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.HostKeyPath = ""
+		setHomeDir(t, t.TempDir())
+
+		if err := r.Init(context.Background()); err != lsftp.ErrHostKeyRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the user's known_hosts file is used by default.
+	t.Run("DefaultHostKeyPath", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.HostKeyPath = ""
+
+		homeDir := t.TempDir()
+		setHomeDir(t, homeDir)
+		if err := os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		s.MustWriteKnownHosts(t, filepath.Join(homeDir, ".ssh", "known_hosts"), s.HostKey)
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure a server presenting an unknown host key is rejected.
+	t.Run("ErrHostKeyMismatch", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		s.MustWriteKnownHosts(t, r.HostKeyPath, MustGenerateSigner(t).PublicKey())
+
+		if err := r.Init(context.Background()); err == nil || !strings.Contains(err.Error(), "key mismatch") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure host key checking is only skipped when explicitly disabled.
+	t.Run("InsecureIgnoreHostKey", func(t *testing.T) {
+		s := NewServer(t)
+		r := NewTestReplica(t, nil, s)
+		r.HostKeyPath = ""
+		r.InsecureIgnoreHostKey = true
+		setHomeDir(t, t.TempDir())
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// NewTestReplica returns a replica for db which writes to a directory on s.
+// The server's host key is trusted through a temporary known_hosts file.
+func NewTestReplica(tb testing.TB, db *litestream.DB, s *Server) *lsftp.Replica {
+	tb.Helper()
+
+	host, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	r := lsftp.NewReplica(db, "")
+	r.Host, r.User, r.Password = host, "user", "pass"
+	if r.Port, err = net.LookupPort("tcp", port); err != nil {
+		tb.Fatal(err)
+	}
+	r.HostKeyPath = filepath.Join(tb.TempDir(), "known_hosts")
+	r.Path = filepath.Join(tb.TempDir(), "backups")
+	r.MonitorEnabled = false
+	s.MustWriteKnownHosts(tb, r.HostKeyPath, s.HostKey)
+
+	tb.Cleanup(r.Stop)
+	return r
+}
+
+// MustOpenDBs returns a new instance of a DB & associated SQL DB. Both are
+// closed when the test ends.
+func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
+	tb.Helper()
+
+	db := litestream.NewDB(filepath.Join(tb.TempDir(), "db"))
+	db.MonitorInterval = 0 // disable background goroutine
+	if err := db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := sqldb.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Fatal(err)
+		} else if err := sqldb.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return db, sqldb
+}
+
+// MustGenerateSigner returns a new ed25519 SSH key.
+func MustGenerateSigner(tb testing.TB) ssh.Signer {
+	tb.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return signer
+}
+
+// setHomeDir sets the home directory of the user until the test ends.
+func setHomeDir(tb testing.TB, dir string) {
+	tb.Helper()
+
+	prev, ok := os.LookupEnv("HOME")
+	if err := os.Setenv("HOME", dir); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if ok {
+			os.Setenv("HOME", prev)
+		} else {
+			os.Unsetenv("HOME")
+		}
+	})
+}
+
+// Server is an SSH server which serves the local file system over SFTP to
+// clients authenticating as "user" with the password "pass".
+type Server struct {
+	ln      net.Listener
+	config  *ssh.ServerConfig
+	HostKey ssh.PublicKey
+}
+
+// NewServer returns a running SFTP server which is closed when the test ends.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	signer := MustGenerateSigner(tb)
+	s := &Server{
+		HostKey: signer.PublicKey(),
+		config: &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if c.User() != "user" || string(password) != "pass" {
+					return nil, os.ErrPermission
+				}
+				return nil, nil
+			},
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	var err error
+	if s.ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.ln.Close() })
+
+	go s.serve()
+	return s
+}
+
+// Addr returns the host & port the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// MustWriteKnownHosts writes a known_hosts file which lists key for the server.
+func (s *Server) MustWriteKnownHosts(tb testing.TB, filename string, key ssh.PublicKey) {
+	tb.Helper()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, key)
+	if err := ioutil.WriteFile(filename, []byte(line+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for ch := range chans {
+		if ch.ChannelType() != "session" {
+			_ = ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveSession(channel, requests)
+	}
+}
+
+// serveSession starts the SFTP subsystem once it is requested by the client.
+func (s *Server) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		// The payload is the subsystem name prefixed by its length.
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		_ = req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		_ = server.Serve()
+		return
+	}
+}
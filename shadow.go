@@ -0,0 +1,123 @@
+package litestream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Shadow WAL fsync policies.
+//
+// Buffering & fsync only affect durability of the shadow WAL on the local
+// disk. Buffered frames are always written before a sync from the real WAL
+// completes so replicas, which are notified after the sync, never miss or
+// upload a partial transaction. Regardless of policy, the shadow WAL is
+// fsynced before a checkpoint as the real WAL may be restarted afterward.
+const (
+	// Fsync after every flush of buffered frames.
+	ShadowWALSyncAlways = "always"
+
+	// Fsync once after all frames have been copied from the real WAL.
+	ShadowWALSyncBatch = "batch"
+
+	// Only fsync before a checkpoint. Frames written since the last
+	// checkpoint may be lost from the shadow WAL on power failure but they
+	// are recopied on restart as the real WAL is not yet checkpointed.
+	ShadowWALSyncNone = "none"
+)
+
+// Default shadow WAL settings. A zero flush size writes each transaction as
+// soon as its commit frame is read.
+const (
+	DefaultShadowWALFlushSize = 0
+	DefaultShadowWALSync      = ShadowWALSyncBatch
+)
+
+// IsShadowWALSyncMode returns true if s is a valid shadow WAL fsync policy.
+func IsShadowWALSyncMode(s string) bool {
+	switch s {
+	case ShadowWALSyncAlways, ShadowWALSyncBatch, ShadowWALSyncNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// SyncWriter is a writer which can flush its data to stable storage.
+type SyncWriter interface {
+	io.Writer
+	Sync() error
+}
+
+// ShadowWALWriter buffers committed transactions in memory & writes them to
+// the shadow WAL in batches of at least FlushSize bytes. Only whole
+// transactions are buffered so every write ends on a commit boundary and a
+// crash between flushes leaves a shadow WAL without partial transactions.
+type ShadowWALWriter struct {
+	w   SyncWriter
+	buf bytes.Buffer
+
+	// Number of bytes to buffer before writing. Zero writes every transaction.
+	FlushSize int
+
+	// Fsync policy. See ShadowWALSyncAlways, ShadowWALSyncBatch, ShadowWALSyncNone.
+	SyncMode string
+
+	// Number of write & fsync calls issued to the underlying writer.
+	WriteN int
+	SyncN  int
+}
+
+// NewShadowWALWriter returns a new instance of ShadowWALWriter which writes to w.
+func NewShadowWALWriter(w SyncWriter, flushSize int, syncMode string) *ShadowWALWriter {
+	return &ShadowWALWriter{w: w, FlushSize: flushSize, SyncMode: syncMode}
+}
+
+// WriteTx buffers the frames of a committed transaction. Buffered frames are
+// written once they exceed the flush size.
+func (w *ShadowWALWriter) WriteTx(frames []byte) error {
+	_, _ = w.buf.Write(frames)
+	if w.buf.Len() < w.FlushSize {
+		return nil
+	}
+	return w.flush()
+}
+
+// flush writes buffered transactions & fsyncs if required by the policy.
+func (w *ShadowWALWriter) flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	w.WriteN++
+	if _, err := w.buf.WriteTo(w.w); err != nil {
+		return fmt.Errorf("write shadow wal: %w", err)
+	}
+
+	if w.SyncMode == ShadowWALSyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *ShadowWALWriter) sync() error {
+	w.SyncN++
+	return w.w.Sync()
+}
+
+// Close writes any buffered transactions. The shadow WAL is fsynced unless
+// the policy is ShadowWALSyncNone & force is false.
+func (w *ShadowWALWriter) Close(force bool) error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case w.SyncMode == ShadowWALSyncAlways && w.SyncN > 0 && !force:
+		return nil // already synced after last flush
+	case w.SyncMode == ShadowWALSyncNone && !force:
+		return nil
+	default:
+		return w.sync()
+	}
+}
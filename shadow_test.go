@@ -0,0 +1,183 @@
+package litestream_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestShadowWALWriter(t *testing.T) {
+	// Build transactions of varying sizes with a unique byte per transaction.
+	var txs [][]byte
+	for i := 0; i < 10; i++ {
+		txs = append(txs, bytes.Repeat([]byte{byte(i)}, 100*(i%3+1)))
+	}
+
+	// Ensure transactions are batched & every write ends on a transaction
+	// boundary so a crash after any write leaves only whole transactions.
+	t.Run("CrashConsistency", func(t *testing.T) {
+		var w mockSyncWriter
+		sw := litestream.NewShadowWALWriter(&w, 500, litestream.ShadowWALSyncBatch)
+
+		var boundaries []int
+		var n int
+		for _, tx := range txs {
+			if err := sw.WriteTx(tx); err != nil {
+				t.Fatal(err)
+			}
+			n += len(tx)
+			boundaries = append(boundaries, n)
+
+			// Unflushed data must stay below the flush size.
+			if pending := n - w.buf.Len(); pending >= sw.FlushSize {
+				t.Fatalf("pending=%d, expected less than flush size", pending)
+			}
+		}
+		if err := sw.Close(false); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := w.buf.Len(), n; got != want {
+			t.Fatalf("size=%d, want %d", got, want)
+		} else if sw.WriteN >= len(txs) {
+			t.Fatalf("expected batched writes, got %d writes for %d transactions", sw.WriteN, len(txs))
+		}
+
+		for _, off := range w.writes {
+			if !containsInt(boundaries, off) {
+				t.Fatalf("write ended at offset %d, not on a transaction boundary", off)
+			}
+		}
+	})
+
+	// Ensure each transaction is written immediately if flush size is zero.
+	t.Run("Unbuffered", func(t *testing.T) {
+		var w mockSyncWriter
+		sw := litestream.NewShadowWALWriter(&w, 0, litestream.ShadowWALSyncBatch)
+		for _, tx := range txs {
+			if err := sw.WriteTx(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sw.Close(false); err != nil {
+			t.Fatal(err)
+		} else if got, want := sw.WriteN, len(txs); got != want {
+			t.Fatalf("WriteN=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure fsync calls follow the configured policy.
+	t.Run("SyncMode", func(t *testing.T) {
+		for _, tt := range []struct {
+			mode  string
+			force bool
+			syncN int
+		}{
+			{litestream.ShadowWALSyncAlways, false, 5},
+			{litestream.ShadowWALSyncBatch, false, 1},
+			{litestream.ShadowWALSyncNone, false, 0},
+			{litestream.ShadowWALSyncNone, true, 1},
+		} {
+			t.Run(fmt.Sprintf("%s/force=%v", tt.mode, tt.force), func(t *testing.T) {
+				var w mockSyncWriter
+				sw := litestream.NewShadowWALWriter(&w, 1, tt.mode)
+				for _, tx := range txs[:5] {
+					if err := sw.WriteTx(tx); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := sw.Close(tt.force); err != nil {
+					t.Fatal(err)
+				} else if got, want := w.syncN, tt.syncN; got != want {
+					t.Fatalf("syncN=%d, want %d", got, want)
+				}
+			})
+		}
+	})
+}
+
+func TestDB_ShadowWALFlushSize(t *testing.T) {
+	// Ensure buffered shadow WAL writes replicate & restore every transaction.
+	for _, mode := range []string{litestream.ShadowWALSyncAlways, litestream.ShadowWALSyncBatch, litestream.ShadowWALSyncNone} {
+		t.Run(mode, func(t *testing.T) {
+			db, sqldb := MustOpenDBs(t)
+			defer MustCloseDBs(t, db, sqldb)
+			db.ShadowWALFlushSize, db.ShadowWALSync = 64*1024, mode
+			r := NewTestFileReplica(t, db)
+
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+				t.Fatal(err)
+			}
+			MustSyncDBReplica(t, db, r)
+			for i := 0; i < 100; i++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			MustSyncDBReplica(t, db, r)
+			MustRollWALIndex(t, db, sqldb, r)
+
+			if got, want := MustRestoreRowCount(t, r, r.LastPos().Generation), 100+db.MinCheckpointPageN+1; got != want {
+				t.Fatalf("n=%d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// BenchmarkShadowWALWriter reports the number of writes issued to the shadow
+// WAL when copying 1,000 single-frame transactions.
+func BenchmarkShadowWALWriter(b *testing.B) {
+	const frameSize = litestream.WALFrameHeaderSize + 4096
+	tx := make([]byte, frameSize)
+
+	for _, flushSize := range []int{0, 64 * 1024, 1 << 20} {
+		b.Run(fmt.Sprintf("%d", flushSize), func(b *testing.B) {
+			b.SetBytes(1000 * frameSize)
+
+			var writeN int
+			for i := 0; i < b.N; i++ {
+				var w mockSyncWriter
+				sw := litestream.NewShadowWALWriter(&w, flushSize, litestream.ShadowWALSyncBatch)
+				for j := 0; j < 1000; j++ {
+					if err := sw.WriteTx(tx); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := sw.Close(false); err != nil {
+					b.Fatal(err)
+				}
+				writeN += sw.WriteN
+			}
+			b.ReportMetric(float64(writeN)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// mockSyncWriter records the ending offset of each write & the number of syncs.
+type mockSyncWriter struct {
+	buf    bytes.Buffer
+	writes []int
+	syncN  int
+}
+
+func (w *mockSyncWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	w.writes = append(w.writes, w.buf.Len())
+	return n, err
+}
+
+func (w *mockSyncWriter) Sync() error {
+	w.syncN++
+	return nil
+}
+
+func containsInt(a []int, v int) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package litestream
+
+import (
+	"time"
+)
+
+// Snapshot reasons recorded when SnapshotInterval or SnapshotWALByteThreshold
+// is exceeded.
+const (
+	SnapshotReasonInterval = "interval"
+	SnapshotReasonWALBytes = "wal bytes"
+)
+
+// snapshotSchedule tracks the WAL copied to the shadow WAL since the latest
+// snapshot requested of replicas, or since the generation started.
+type snapshotSchedule struct {
+	generation string    // generation of latest snapshot
+	start      time.Time // time of latest snapshot
+	size       int64     // WAL bytes copied since latest snapshot
+}
+
+// reset records a snapshot of generation at the current time.
+func (s *snapshotSchedule) reset(generation string) {
+	s.generation, s.start, s.size = generation, time.Now(), 0
+}
+
+// snapshotDue returns the reason a snapshot should be requested from replicas
+// if more than SnapshotWALByteThreshold bytes of WAL have been copied since
+// the latest snapshot, or if SnapshotInterval has passed and any WAL has been
+// copied so idle databases are not snapshotted. Returns a blank string if no
+// snapshot is due. Must be called while holding the write lock.
+func (db *DB) snapshotDue(generation string) string {
+	s := &db.snapshotSchedule
+	if s.generation != generation {
+		s.reset(generation)
+		return ""
+	}
+
+	if db.SnapshotWALByteThreshold > 0 && s.size > db.SnapshotWALByteThreshold {
+		return SnapshotReasonWALBytes
+	} else if db.SnapshotInterval > 0 && s.size > 0 && time.Since(s.start) >= db.SnapshotInterval {
+		return SnapshotReasonInterval
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package litestream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestDB_SnapshotSchedule(t *testing.T) {
+	// Ensure a snapshot is requested once enough WAL has been copied.
+	t.Run("WALByteThreshold", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.SnapshotWALByteThreshold = 3 * 4096
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if seq, _ := db.SnapshotRequest(); seq != 0 {
+			t.Fatalf("unexpected snapshot request: seq=%d", seq)
+		} else if n := MustSnapshotN(t, r); n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		MustSyncDBReplica(t, db, r)
+		if seq, reason := db.SnapshotRequest(); seq != 1 {
+			t.Fatalf("seq=%d, want 1", seq)
+		} else if reason != litestream.SnapshotReasonWALBytes {
+			t.Fatalf("reason=%q, want %q", reason, litestream.SnapshotReasonWALBytes)
+		} else if n := MustSnapshotN(t, r); n != 2 {
+			t.Fatalf("n=%d, want 2", n)
+		}
+
+		// Ensure bytes are counted from the latest request.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if seq, _ := db.SnapshotRequest(); seq != 1 {
+			t.Fatalf("seq=%d, want 1", seq)
+		} else if got, want := MustRestoreRowCount(t, r, r.LastPos().Generation), 5; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a snapshot is requested after the interval only if WAL was copied.
+	t.Run("Interval", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		db.SnapshotInterval = 50 * time.Millisecond
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		time.Sleep(2 * db.SnapshotInterval)
+		MustSyncDBReplica(t, db, r)
+		if seq, _ := db.SnapshotRequest(); seq != 0 {
+			t.Fatalf("unexpected snapshot request while idle: seq=%d", seq)
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if seq, reason := db.SnapshotRequest(); seq != 1 {
+			t.Fatalf("seq=%d, want 1", seq)
+		} else if reason != litestream.SnapshotReasonInterval {
+			t.Fatalf("reason=%q, want %q", reason, litestream.SnapshotReasonInterval)
+		} else if n := MustSnapshotN(t, r); n != 2 {
+			t.Fatalf("n=%d, want 2", n)
+		}
+	})
+}
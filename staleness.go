@@ -0,0 +1,70 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/benbjohnson/litestream/internal"
+)
+
+// CheckSnapshotStaleness returns an error wrapping ErrSnapshotStale if the
+// latest snapshot of the current generation is older than maxAge or is
+// followed by more than maxWALN WAL indices. Restores must replay every WAL
+// file after the snapshot so a stale snapshot makes restores slow. Thresholds
+// of zero are ignored.
+//
+// The snapshot age & WAL count are recorded in the replica metrics and a
+// warning is logged when a threshold is exceeded.
+func CheckSnapshotStaleness(ctx context.Context, r Replica, maxAge time.Duration, maxWALN int) error {
+	db := r.DB()
+
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if generation == "" {
+		return nil // no active generation
+	}
+
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+
+	// Find the latest snapshot for the generation.
+	var snapshot *SnapshotInfo
+	for _, info := range snapshots {
+		if info.Generation == generation && (snapshot == nil || info.Index > snapshot.Index) {
+			snapshot = info
+		}
+	}
+	if snapshot == nil {
+		return nil // initial snapshot not yet created
+	}
+
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return fmt.Errorf("wals: %w", err)
+	}
+
+	// Count WAL indices after the snapshot.
+	maxIndex := snapshot.Index
+	for _, info := range wals {
+		if info.Generation == generation && info.Index > maxIndex {
+			maxIndex = info.Index
+		}
+	}
+	walN := maxIndex - snapshot.Index
+	age := db.now().Sub(snapshot.CreatedAt)
+
+	internal.ReplicaSnapshotAgeGaugeVec.WithLabelValues(db.Path(), r.Name()).Set(age.Seconds())
+	internal.ReplicaSnapshotWALCountGaugeVec.WithLabelValues(db.Path(), r.Name()).Set(float64(walN))
+
+	if (maxAge > 0 && age > maxAge) || (maxWALN > 0 && walN > maxWALN) {
+		log.Printf("%s(%s): WARNING: latest snapshot %s/%08x is %s old with %d wal files since, consider a shorter retention to snapshot more often",
+			db.Path(), r.Name(), generation, snapshot.Index, age.Round(time.Second), walN)
+		return fmt.Errorf("%w: generation=%s index=%08x age=%s wal=%d", ErrSnapshotStale, generation, snapshot.Index, age.Round(time.Second), walN)
+	}
+	return nil
+}
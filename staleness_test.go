@@ -0,0 +1,71 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestCheckSnapshotStaleness(t *testing.T) {
+	// Ensure a warning is returned once the snapshot is older than the threshold.
+	t.Run("Age", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		now := time.Now()
+		db.Now = func() time.Time { return now }
+		if err := litestream.CheckSnapshotStaleness(context.Background(), r, 24*time.Hour, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// Move clock past the threshold.
+		now = now.Add(25 * time.Hour)
+		if err := litestream.CheckSnapshotStaleness(context.Background(), r, 24*time.Hour, 0); !errors.Is(err, litestream.ErrSnapshotStale) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Ensure the age threshold is ignored if not set.
+		if err := litestream.CheckSnapshotStaleness(context.Background(), r, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure a warning is returned once too many WAL files follow the snapshot.
+	t.Run("WALN", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		if err := litestream.CheckSnapshotStaleness(context.Background(), r, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		MustRollWALIndex(t, db, sqldb, r)
+		if err := litestream.CheckSnapshotStaleness(context.Background(), r, 0, 1); !errors.Is(err, litestream.ErrSnapshotStale) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Ensure a new snapshot resets the count.
+		r.Retention = time.Nanosecond
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := litestream.CheckSnapshotStaleness(context.Background(), r, 0, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package litestream
+
+import (
+	"fmt"
+	"time"
+)
+
+// DBStatus is a summary of the replication state of a database & its
+// replicas, such as for reporting health to a monitoring service.
+type DBStatus struct {
+	Path       string          `json:"path"`
+	Generation string          `json:"generation"`
+	Index      int             `json:"index"`
+	Offset     int64           `json:"offset"`
+	PageSize   int             `json:"page_size"`
+	Error      string          `json:"error,omitempty"` // set if position is unavailable
+	Paused     bool            `json:"paused"`          // true if replication is paused
+	Replicas   []ReplicaStatus `json:"replicas"`
+}
+
+// ReplicaStatus is a summary of the replication state of a single replica.
+type ReplicaStatus struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Last successfully replicated position. Zero until the replica has
+	// determined its position after starting or after a failed sync.
+	Generation string `json:"generation"`
+	Index      int    `json:"index"`
+	Offset     int64  `json:"offset"`
+
+	// Time of the last snapshot taken by the replica in this process. Nil
+	// if it has not taken a snapshot since starting.
+	LastSnapshotAt *time.Time `json:"last_snapshot_at,omitempty"`
+
+	// Error returned by the last sync, if it failed.
+	LastSyncError string `json:"last_sync_error,omitempty"`
+
+	// Seconds the oldest change to the shadow WAL has waited to be uploaded.
+	// Zero if the replica has uploaded all changes.
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// Health returns a one word summary of the status for health checks: "error"
+// if the position is unavailable or a replica failed its last sync,
+// "untracked" if the database has no generation, "lagging" if a replica lags
+// by more than maxLag & otherwise "ok". Lag is ignored if maxLag is zero.
+func (s *DBStatus) Health(maxLag time.Duration) string {
+	if s.LastError() != "" {
+		return "error"
+	} else if s.Generation == "" {
+		return "untracked"
+	} else if maxLag > 0 && s.MaxLag() > maxLag {
+		return "lagging"
+	}
+	return "ok"
+}
+
+// LastError returns the error of the position or, if none, of the first
+// replica which failed its last sync. Returns blank if there is no error.
+func (s *DBStatus) LastError() string {
+	if s.Error != "" {
+		return s.Error
+	}
+	for _, rs := range s.Replicas {
+		if rs.LastSyncError != "" {
+			return fmt.Sprintf("%s: %s", rs.Name, rs.LastSyncError)
+		}
+	}
+	return ""
+}
+
+// MaxLag returns the highest lag of the replicas.
+func (s *DBStatus) MaxLag() time.Duration {
+	var d time.Duration
+	for _, rs := range s.Replicas {
+		if v := time.Duration(rs.LagSeconds * float64(time.Second)); v > d {
+			d = v
+		}
+	}
+	return d
+}
+
+// replicaState holds the results of a replica's last sync & snapshot.
+type replicaState struct {
+	lastSnapshotAt time.Time
+	lastSyncErr    error
+	syncNotify     chan struct{} // closes on next sync result, if requested
+}
+
+// MarkReplicaSyncResult is called by a replica after each sync with the error
+// it returned, if any.
+func (db *DB) MarkReplicaSyncResult(name string, err error) {
+	db.statusMu.Lock()
+	defer db.statusMu.Unlock()
+
+	if db.replicaStates == nil {
+		db.replicaStates = make(map[string]replicaState)
+	}
+	state := db.replicaStates[name]
+	state.lastSyncErr = err
+	if state.syncNotify != nil {
+		close(state.syncNotify)
+		state.syncNotify = nil
+	}
+	db.replicaStates[name] = state
+}
+
+// ReplicaSyncNotify returns a channel which closes when the named replica
+// next reports the result of a sync, whether or not the sync succeeded.
+func (db *DB) ReplicaSyncNotify(name string) <-chan struct{} {
+	db.statusMu.Lock()
+	defer db.statusMu.Unlock()
+
+	if db.replicaStates == nil {
+		db.replicaStates = make(map[string]replicaState)
+	}
+	state := db.replicaStates[name]
+	if state.syncNotify == nil {
+		state.syncNotify = make(chan struct{})
+		db.replicaStates[name] = state
+	}
+	return state.syncNotify
+}
+
+// MarkReplicaSnapshotted is called by a replica after it has written a
+// snapshot at time t.
+func (db *DB) MarkReplicaSnapshotted(name string, t time.Time) {
+	db.statusMu.Lock()
+	defer db.statusMu.Unlock()
+
+	if db.replicaStates == nil {
+		db.replicaStates = make(map[string]replicaState)
+	}
+	state := db.replicaStates[name]
+	state.lastSnapshotAt = t
+	db.replicaStates[name] = state
+}
+
+// Status returns the current replication state of the database & each of its
+// replicas. It only reads positions already tracked by the database & its
+// replicas so it is safe to call while they are syncing.
+func (db *DB) Status() DBStatus {
+	replicas := db.ReplicaList()
+	status := DBStatus{
+		Path:     db.Path(),
+		PageSize: db.PageSize(),
+		Paused:   db.Paused(),
+		Replicas: make([]ReplicaStatus, 0, len(replicas)),
+	}
+
+	if pos, err := db.Pos(); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Generation, status.Index, status.Offset = pos.Generation, pos.Index, pos.Offset
+	}
+
+	db.statusMu.Lock()
+	defer db.statusMu.Unlock()
+
+	for _, r := range replicas {
+		pos := r.LastPos()
+		rs := ReplicaStatus{
+			Name:       r.Name(),
+			Type:       r.Type(),
+			Generation: pos.Generation,
+			Index:      pos.Index,
+			Offset:     pos.Offset,
+			LagSeconds: db.ReplicaLag(r.Name()).Seconds(),
+		}
+
+		state := db.replicaStates[r.Name()]
+		if !state.lastSnapshotAt.IsZero() {
+			t := state.lastSnapshotAt.UTC()
+			rs.LastSnapshotAt = &t
+		}
+		if state.lastSyncErr != nil {
+			rs.LastSyncError = state.lastSyncErr.Error()
+		}
+		status.Replicas = append(status.Replicas, rs)
+	}
+	return status
+}
@@ -0,0 +1,165 @@
+package litestream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// RestoreReplicaTo restores the database from a replica in memory & writes
+// the resulting database file to w. No files are written to the local disk.
+//
+// The snapshot & WAL files are selected as in RestoreReplica using the
+// Generation, Index & Timestamp options. WAL frames are validated with their
+// checksums & only committed transactions are applied, as SQLite does when
+// recovering a WAL. Options which operate on a restored file are ignored.
+func RestoreReplicaTo(ctx context.Context, r Replica, opt RestoreOptions, w io.Writer) error {
+	if opt.Generation == "" {
+		return fmt.Errorf("generation required")
+	} else if opt.Index != math.MaxInt64 && !opt.Timestamp.IsZero() {
+		return fmt.Errorf("cannot specify index & timestamp to restore")
+	}
+
+	logger := opt.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	logPrefix := r.Name()
+	if db := r.DB(); db != nil {
+		logPrefix = fmt.Sprintf("%s(%s)", db.Path(), r.Name())
+	}
+	defer acquireRestoreLease(r, opt.Generation)()
+
+	minWALIndex, err := SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp)
+	if errors.Is(err, ErrNoSnapshots) && !opt.Timestamp.IsZero() {
+		if _, e := SnapshotIndexAt(ctx, r, opt.Generation, time.Time{}); e == nil {
+			return fmt.Errorf("cannot restore to %s: %w", opt.Timestamp.Format(time.RFC3339Nano), ErrBeforeSnapshots)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot find snapshot index for restore: %w", err)
+	}
+
+	maxWALIndex, err := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp)
+	if err != nil {
+		return fmt.Errorf("cannot find max wal index for restore: %w", err)
+	}
+
+	logger.Printf("%s: restoring snapshot %s/%08x to memory", logPrefix, opt.Generation, minWALIndex)
+	image, err := readReplicaSnapshot(ctx, r, opt.Generation, minWALIndex)
+	if err != nil {
+		return fmt.Errorf("cannot read snapshot: %w", err)
+	}
+
+	for index := minWALIndex; index <= maxWALIndex; index++ {
+		wal, err := readReplicaWAL(ctx, r, opt.Generation, index)
+		if os.IsNotExist(err) && index == minWALIndex && index == maxWALIndex {
+			logger.Printf("%s: no wal available, snapshot only", logPrefix)
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot read wal %s/%08x: %w", opt.Generation, index, err)
+		}
+
+		if opt.ValidateWALSalt {
+			if err := verifyWALSaltBytes(wal); err != nil {
+				return fmt.Errorf("generation=%s index=%08x: %w", opt.Generation, index, err)
+			}
+		}
+
+		if image, err = applyWALFrames(image, wal); err != nil {
+			return fmt.Errorf("cannot apply wal %s/%08x: %w", opt.Generation, index, err)
+		}
+		if opt.Verbose {
+			logger.Printf("%s: restored wal %s/%08x", logPrefix, opt.Generation, index)
+		}
+	}
+
+	_, err = w.Write(image)
+	return err
+}
+
+// readReplicaSnapshot returns the full contents of a snapshot from the replica.
+func readReplicaSnapshot(ctx context.Context, r Replica, generation string, index int) ([]byte, error) {
+	rd, err := snapshotImageReader(ctx, r, generation, index)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// applyWALFrames applies the committed frames of wal to the database file
+// image & returns the updated image. Frames after the last valid commit, or
+// after a frame with an invalid salt or checksum, are ignored.
+func applyWALFrames(image, wal []byte) ([]byte, error) {
+	if len(wal) < WALHeaderSize {
+		return image, nil
+	}
+
+	hdr := wal[:WALHeaderSize]
+	bo, err := headerByteOrder(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite ignores the entire WAL if the header checksum is invalid.
+	s0, s1 := Checksum(bo, 0, 0, hdr[:WALHeaderChecksumOffset])
+	if s0 != binary.BigEndian.Uint32(hdr[24:]) || s1 != binary.BigEndian.Uint32(hdr[28:]) {
+		return image, nil
+	}
+
+	pageSize := int(binary.BigEndian.Uint32(hdr[8:]))
+	if !isValidPageSize(pageSize) {
+		return nil, fmt.Errorf("invalid wal page size: %d", pageSize)
+	}
+
+	// Buffer the pages of each transaction until its commit frame.
+	pending := make(map[uint32][]byte)
+	frameSize := WALFrameHeaderSize + pageSize
+	for off := WALHeaderSize; off+frameSize <= len(wal); off += frameSize {
+		fhdr, data := wal[off:off+WALFrameHeaderSize], wal[off+WALFrameHeaderSize:off+frameSize]
+		if !bytes.Equal(fhdr[8:16], hdr[16:24]) {
+			break
+		}
+		s0, s1 = Checksum(bo, s0, s1, fhdr[:8])
+		s0, s1 = Checksum(bo, s0, s1, data)
+		if s0 != binary.BigEndian.Uint32(fhdr[16:]) || s1 != binary.BigEndian.Uint32(fhdr[20:]) {
+			break
+		}
+
+		pgno := binary.BigEndian.Uint32(fhdr[0:])
+		if pgno == 0 {
+			return nil, fmt.Errorf("invalid page number in wal frame at offset %d", off)
+		}
+		pending[pgno] = data
+
+		// Commit frames store the size of the database, in pages.
+		if commit := binary.BigEndian.Uint32(fhdr[4:]); commit != 0 {
+			image = resizeImage(image, int(commit)*pageSize)
+			for pgno, data := range pending {
+				if pos := int(pgno-1) * pageSize; pos < len(image) {
+					copy(image[pos:], data)
+				}
+			}
+			pending = make(map[uint32][]byte)
+		}
+	}
+	return image, nil
+}
+
+// resizeImage truncates or zero-extends image to n bytes.
+func resizeImage(image []byte, n int) []byte {
+	if n <= len(image) {
+		return image[:n]
+	}
+	return append(image, make([]byte, n-len(image))...)
+}
@@ -0,0 +1,94 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreReplicaTo(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+	MustRollWALIndex(t, db, sqldb, r)
+	pos0 := r.LastPos()
+	MustRollWALIndex(t, db, sqldb, r)
+	for i := 0; i < 10; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Ensure the latest position & an earlier index are restored in memory.
+	t.Run("OK", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos0.Generation
+		if got, want := MustCountImageRows(t, r, opt), MustCountRows(t, db.Path(), "foo"); got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+
+		opt.Index = pos0.Index - 1
+		if got, want := MustCountImageRows(t, r, opt), db.MinCheckpointPageN; got != want {
+			t.Fatalf("restored rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure the image matches a restore to disk.
+	t.Run("MatchesRestoreReplica", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos0.Generation
+
+		var buf bytes.Buffer
+		if err := litestream.RestoreReplicaTo(context.Background(), r, opt, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if other, err := ioutil.ReadFile(opt.OutputPath); err != nil {
+			t.Fatal(err)
+		} else if got, want := buf.Len(), len(other); got != want {
+			t.Fatalf("size=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a timestamp before the earliest snapshot is reported.
+	t.Run("ErrBeforeSnapshots", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.Generation = pos0.Generation
+		opt.Timestamp = time.Now().Add(-time.Hour)
+		if err := litestream.RestoreReplicaTo(context.Background(), r, opt, ioutil.Discard); !errors.Is(err, litestream.ErrBeforeSnapshots) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustCountImageRows restores the replica in memory and returns the number of
+// rows in the "foo" table of the restored database.
+func MustCountImageRows(tb testing.TB, r litestream.Replica, opt litestream.RestoreOptions) int {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	if err := litestream.RestoreReplicaTo(context.Background(), r, opt, &buf); err != nil {
+		tb.Fatal(err)
+	}
+
+	filename := filepath.Join(tb.TempDir(), "db")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return MustCountRows(tb, filename, "foo")
+}
@@ -0,0 +1,143 @@
+package litestream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket which limits the number of bytes transferred
+// per second. It is safe for concurrent use so a single limiter can be
+// shared by all uploads of a replica.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // tokens added per second
+	burst  int       // maximum tokens held
+	tokens float64   // available tokens, negative if reserved in advance
+	last   time.Time // time tokens were last updated
+}
+
+// NewRateLimiter returns a limiter which allows bytesPerSecond bytes per
+// second with a burst of up to one second of bytes. Returns nil, which is
+// unlimited, if bytesPerSecond is zero or negative.
+func NewRateLimiter(bytesPerSecond int) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Burst returns the maximum number of bytes allowed by a single WaitN call.
+func (l *RateLimiter) Burst() int {
+	return l.burst
+}
+
+// WaitN blocks until n bytes are allowed or ctx is done. Requests larger than
+// the burst are split into several waits. Bytes reserved by a wait which is
+// cancelled are returned to the bucket. No-op on a nil limiter.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	for n > 0 {
+		m := n
+		if m > l.burst {
+			m = l.burst
+		}
+		if err := l.wait(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// wait reserves n tokens & waits until they are available.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.cancel(n)
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reserve takes n tokens from the bucket & returns how long the caller must
+// wait until the bucket is no longer in debt.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		l.last = now
+	}
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns n reserved tokens to the bucket.
+func (l *RateLimiter) cancel(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += float64(n)
+}
+
+// NewThrottledReader returns a reader which limits reads from rd using l.
+// Reads fail with the context error if ctx is done while waiting. Returns rd
+// unchanged if l is nil.
+func NewThrottledReader(ctx context.Context, rd io.Reader, l *RateLimiter) io.Reader {
+	if l == nil {
+		return rd
+	}
+	return &throttledReader{ctx: ctx, rd: rd, limiter: l}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	rd      io.Reader
+	limiter *RateLimiter
+}
+
+// Read reads at most one burst of bytes from the underlying reader & waits
+// until the bytes read are allowed by the limiter.
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		if e := r.limiter.WaitN(r.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
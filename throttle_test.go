@@ -0,0 +1,91 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRateLimiter_WaitN(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		if l := litestream.NewRateLimiter(0); l != nil {
+			t.Fatal("expected nil limiter")
+		} else if err := l.WaitN(context.Background(), 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure concurrent callers share the same limit.
+	t.Run("Shared", func(t *testing.T) {
+		l := litestream.NewRateLimiter(10000)
+
+		startTime := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.WaitN(context.Background(), 5000); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The initial burst allows 10000 bytes so the rest must wait 0.5s.
+		if d := time.Since(startTime); d < 400*time.Millisecond {
+			t.Fatalf("unexpected elapsed time: %s", d)
+		}
+	})
+
+	// Ensure a cancelled wait returns immediately & does not consume the limit.
+	t.Run("Canceled", func(t *testing.T) {
+		l := litestream.NewRateLimiter(1000)
+		if err := l.WaitN(context.Background(), 1000); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := l.WaitN(ctx, 1000000); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		startTime := time.Now()
+		if err := l.WaitN(context.Background(), 100); err != nil {
+			t.Fatal(err)
+		} else if d := time.Since(startTime); d > 500*time.Millisecond {
+			t.Fatalf("unexpected elapsed time: %s", d)
+		}
+	})
+}
+
+func TestNewThrottledReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 15000)
+
+	t.Run("OK", func(t *testing.T) {
+		startTime := time.Now()
+		rd := litestream.NewThrottledReader(context.Background(), bytes.NewReader(data), litestream.NewRateLimiter(10000))
+		if buf, err := ioutil.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data) {
+			t.Fatal("data mismatch")
+		} else if d := time.Since(startTime); d < 400*time.Millisecond {
+			t.Fatalf("unexpected elapsed time: %s", d)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rd := litestream.NewThrottledReader(ctx, bytes.NewReader(data), litestream.NewRateLimiter(100))
+		if _, err := ioutil.ReadAll(rd); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"log"
+)
+
+// VerifyResult is the outcome of verifying a replica against its database.
+type VerifyResult struct {
+	Generation string // generation restored from the replica
+	Index      int    // last WAL index applied to the restored database
+
+	DBChecksum      uint64 // CRC64 of the local database
+	ReplicaChecksum uint64 // CRC64 of the restored database
+}
+
+// Match returns true if the restored database is identical to the local database.
+func (r VerifyResult) Match() bool {
+	return r.DBChecksum == r.ReplicaChecksum
+}
+
+// VerifyError is returned by VerifyReplica when the database restored from a
+// replica differs from the local database. It wraps ErrChecksumMismatch.
+type VerifyError struct {
+	Replica string
+	Result  VerifyResult
+}
+
+// Error returns the string representation of the error.
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("replica %q: generation=%s index=%08x db=%016x replica=%016x: %s",
+		e.Replica, e.Result.Generation, e.Result.Index, e.Result.DBChecksum, e.Result.ReplicaChecksum, ErrChecksumMismatch)
+}
+
+// Unwrap returns ErrChecksumMismatch.
+func (e *VerifyError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// VerifyReplica checkpoints the database, waits for the replica to reach the
+// database's position & restores the replica in memory from its latest
+// snapshot. Returns a *VerifyError if the CRC64 of the restored database does
+// not match the CRC64 of the local database.
+//
+// Unlike ValidateReplica, no files are written to disk. The replica must be
+// replicating the database, such as by a running monitor.
+func VerifyReplica(ctx context.Context, r Replica) (VerifyResult, error) {
+	db := r.DB()
+
+	chksum, pos, err := db.CRC64()
+	if err != nil {
+		return VerifyResult{}, fmt.Errorf("cannot compute checksum: %w", err)
+	}
+
+	// The checkpoint starts a new WAL index so the database contains the
+	// WAL files before the current index.
+	result := VerifyResult{Generation: pos.Generation, Index: pos.Index - 1, DBChecksum: chksum}
+	if err := waitForReplica(ctx, r, pos); err != nil {
+		return result, fmt.Errorf("cannot wait for replica: %w", err)
+	}
+
+	opt := NewRestoreOptions()
+	opt.Generation, opt.Index = pos.Generation, result.Index
+	opt.ValidateWALSalt = true
+	opt.Logger = log.New(ioutil.Discard, "", 0)
+
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if err := RestoreReplicaTo(ctx, r, opt, h); err != nil {
+		return result, fmt.Errorf("cannot restore: %w", err)
+	}
+	result.ReplicaChecksum = h.Sum64()
+
+	status := "ok"
+	if !result.Match() {
+		status = "mismatch"
+	}
+	log.Printf("%s(%s): verify: status=%s db=%016x replica=%016x generation=%s index=%08x", db.Path(), r.Name(), status, result.DBChecksum, result.ReplicaChecksum, result.Generation, result.Index)
+
+	if !result.Match() {
+		return result, &VerifyError{Replica: r.Name(), Result: result}
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package litestream_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestVerifyReplica(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+
+		defer MustSyncInBackground(t, db, r)()
+		result, err := litestream.VerifyReplica(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		} else if !result.Match() {
+			t.Fatalf("unexpected mismatch: %#v", result)
+		} else if got, want := result.Generation, r.LastPos().Generation; got != want {
+			t.Fatalf("generation=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure a replica which restores to a different database is reported.
+	t.Run("Mismatch", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Codec = litestream.LookupCodec("none")
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+
+		// Checkpoint so the WAL is complete in the replica and then change the
+		// last page written to it without invalidating the frame checksums.
+		if _, _, err := db.CRC64(); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		pos := r.LastPos()
+		MustCorruptWALPage(t, r, pos.Generation, pos.Index-1)
+
+		defer MustSyncInBackground(t, db, r)()
+		var e *litestream.VerifyError
+		if _, err := litestream.VerifyReplica(context.Background(), r); !errors.As(err, &e) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatal("expected checksum mismatch")
+		} else if e.Result.Match() {
+			t.Fatal("expected result mismatch")
+		} else if got, want := e.Result.Generation, pos.Generation; got != want {
+			t.Fatalf("generation=%s, want %s", got, want)
+		}
+	})
+}
+
+// MustSyncInBackground syncs the database & replica until the returned
+// function is called, as the replica monitor would.
+func MustSyncInBackground(tb testing.TB, db *litestream.DB, r *litestream.FileReplica) (stop func()) {
+	tb.Helper()
+
+	done, closed := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := db.Sync(); err != nil {
+					tb.Error(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					tb.Error(err)
+				}
+			}
+		}
+	}()
+	return func() { close(done); <-closed }
+}
+
+// MustCorruptWALPage flips a byte in the last frame of an uncompressed WAL
+// file & recalculates the checksums of all frames, and of the file, so the
+// frame still applies.
+func MustCorruptWALPage(tb testing.TB, r *litestream.FileReplica, generation string, index int) {
+	tb.Helper()
+
+	filename := r.WALPath(generation, index)
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var bo binary.ByteOrder = binary.BigEndian
+	if binary.BigEndian.Uint32(buf[0:]) == 0x377f0682 {
+		bo = binary.LittleEndian
+	}
+
+	pageSize := int(binary.BigEndian.Uint32(buf[8:]))
+	frameSize := litestream.WALFrameHeaderSize + pageSize
+	frameN := (len(buf) - litestream.WALHeaderSize) / frameSize
+	if frameN == 0 {
+		tb.Fatal("no wal frames")
+	}
+	buf[litestream.WALHeaderSize+frameN*frameSize-1] ^= 0xFF
+
+	s0, s1 := binary.BigEndian.Uint32(buf[24:]), binary.BigEndian.Uint32(buf[28:])
+	for i := 0; i < frameN; i++ {
+		frame := buf[litestream.WALHeaderSize+i*frameSize:][:frameSize]
+		s0, s1 = litestream.Checksum(bo, s0, s1, frame[:8])
+		s0, s1 = litestream.Checksum(bo, s0, s1, frame[litestream.WALFrameHeaderSize:])
+		binary.BigEndian.PutUint32(frame[16:], s0)
+		binary.BigEndian.PutUint32(frame[20:], s1)
+	}
+
+	if err := ioutil.WriteFile(filename, buf, 0600); err != nil {
+		tb.Fatal(err)
+	}
+
+	cw := litestream.NewChecksumWriter()
+	_, _ = cw.Write(buf)
+	if err := ioutil.WriteFile(r.WALChecksumPath(generation, index), litestream.EncodeWALChecksum(cw.Checksum(), int64(len(buf))), 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,214 @@
+#include <stdlib.h>
+#include <string.h>
+#include "vfs.h"
+#include "_cgo_export.h"
+
+/*
+** Read-only VFS which forwards main database reads to a Go ReplicaVFS.
+** All other files (such as temporary files used for sorting) are opened
+** using the default VFS.
+*/
+
+typedef struct litestream_file {
+  sqlite3_file base;
+  int handle;
+} litestream_file;
+
+static sqlite3_vfs *default_vfs(void) {
+  return sqlite3_vfs_find(0);
+}
+
+static int xClose(sqlite3_file *f) {
+  return litestreamVFSClose(((litestream_file*)f)->handle);
+}
+
+static int xRead(sqlite3_file *f, void *buf, int n, sqlite3_int64 off) {
+  return litestreamVFSRead(((litestream_file*)f)->handle, buf, n, off);
+}
+
+static int xWrite(sqlite3_file *f, const void *buf, int n, sqlite3_int64 off) {
+  return SQLITE_READONLY;
+}
+
+static int xTruncate(sqlite3_file *f, sqlite3_int64 size) {
+  return SQLITE_READONLY;
+}
+
+static int xSync(sqlite3_file *f, int flags) {
+  return SQLITE_OK;
+}
+
+static int xFileSize(sqlite3_file *f, sqlite3_int64 *size) {
+  return litestreamVFSFileSize(((litestream_file*)f)->handle, size);
+}
+
+static int xLock(sqlite3_file *f, int level) {
+  return SQLITE_OK;
+}
+
+static int xUnlock(sqlite3_file *f, int level) {
+  return SQLITE_OK;
+}
+
+static int xCheckReservedLock(sqlite3_file *f, int *out) {
+  *out = 0;
+  return SQLITE_OK;
+}
+
+static int xFileControl(sqlite3_file *f, int op, void *arg) {
+  return SQLITE_NOTFOUND;
+}
+
+static int xSectorSize(sqlite3_file *f) {
+  return 0;
+}
+
+static int xDeviceCharacteristics(sqlite3_file *f) {
+  return SQLITE_IOCAP_IMMUTABLE;
+}
+
+static const sqlite3_io_methods io_methods = {
+  1,
+  xClose,
+  xRead,
+  xWrite,
+  xTruncate,
+  xSync,
+  xFileSize,
+  xLock,
+  xUnlock,
+  xCheckReservedLock,
+  xFileControl,
+  xSectorSize,
+  xDeviceCharacteristics,
+};
+
+static int xOpen(sqlite3_vfs *vfs, const char *name, sqlite3_file *f, int flags, int *outFlags) {
+  litestream_file *p = (litestream_file*)f;
+  p->base.pMethods = 0;
+
+  if (!(flags & SQLITE_OPEN_MAIN_DB)) {
+    sqlite3_vfs *dflt = default_vfs();
+    return dflt->xOpen(dflt, name, f, flags, outFlags);
+  }
+
+  int rc = litestreamVFSOpen((char*)vfs->pAppData, &p->handle);
+  if (rc != SQLITE_OK) {
+    return rc;
+  }
+  p->base.pMethods = &io_methods;
+  if (outFlags) {
+    *outFlags = SQLITE_OPEN_READONLY;
+  }
+  return SQLITE_OK;
+}
+
+static int xDelete(sqlite3_vfs *vfs, const char *name, int syncDir) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xDelete(dflt, name, syncDir);
+}
+
+static int xAccess(sqlite3_vfs *vfs, const char *name, int flags, int *out) {
+  *out = 0; /* journal & wal files never exist for the replica database */
+  return SQLITE_OK;
+}
+
+static int xFullPathname(sqlite3_vfs *vfs, const char *name, int n, char *out) {
+  strncpy(out, name, n);
+  out[n-1] = 0;
+  return SQLITE_OK;
+}
+
+static void *xDlOpen(sqlite3_vfs *vfs, const char *filename) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xDlOpen(dflt, filename);
+}
+
+static void xDlError(sqlite3_vfs *vfs, int n, char *msg) {
+  sqlite3_vfs *dflt = default_vfs();
+  dflt->xDlError(dflt, n, msg);
+}
+
+static void (*xDlSym(sqlite3_vfs *vfs, void *p, const char *sym))(void) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xDlSym(dflt, p, sym);
+}
+
+static void xDlClose(sqlite3_vfs *vfs, void *p) {
+  sqlite3_vfs *dflt = default_vfs();
+  dflt->xDlClose(dflt, p);
+}
+
+static int xRandomness(sqlite3_vfs *vfs, int n, char *out) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xRandomness(dflt, n, out);
+}
+
+static int xSleep(sqlite3_vfs *vfs, int us) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xSleep(dflt, us);
+}
+
+static int xCurrentTime(sqlite3_vfs *vfs, double *t) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xCurrentTime(dflt, t);
+}
+
+static int xGetLastError(sqlite3_vfs *vfs, int n, char *msg) {
+  sqlite3_vfs *dflt = default_vfs();
+  return dflt->xGetLastError(dflt, n, msg);
+}
+
+int litestream_vfs_register(const char *name) {
+  sqlite3_vfs *dflt = default_vfs();
+  if (!dflt) {
+    return SQLITE_ERROR;
+  }
+
+  sqlite3_vfs *vfs = calloc(1, sizeof(sqlite3_vfs));
+  char *zName = strdup(name);
+  if (!vfs || !zName) {
+    free(vfs);
+    free(zName);
+    return SQLITE_ERROR;
+  }
+
+  vfs->iVersion = 1;
+  vfs->szOsFile = dflt->szOsFile > (int)sizeof(litestream_file) ? dflt->szOsFile : (int)sizeof(litestream_file);
+  vfs->mxPathname = dflt->mxPathname;
+  vfs->zName = zName;
+  vfs->pAppData = zName;
+  vfs->xOpen = xOpen;
+  vfs->xDelete = xDelete;
+  vfs->xAccess = xAccess;
+  vfs->xFullPathname = xFullPathname;
+  vfs->xDlOpen = xDlOpen;
+  vfs->xDlError = xDlError;
+  vfs->xDlSym = xDlSym;
+  vfs->xDlClose = xDlClose;
+  vfs->xRandomness = xRandomness;
+  vfs->xSleep = xSleep;
+  vfs->xCurrentTime = xCurrentTime;
+  vfs->xGetLastError = xGetLastError;
+
+  int rc = sqlite3_vfs_register(vfs, 0);
+  if (rc != SQLITE_OK) {
+    free(vfs);
+    free(zName);
+  }
+  return rc;
+}
+
+int litestream_vfs_unregister(const char *name) {
+  sqlite3_vfs *vfs = sqlite3_vfs_find(name);
+  if (!vfs || vfs->xOpen != xOpen) {
+    return SQLITE_OK;
+  }
+
+  int rc = sqlite3_vfs_unregister(vfs);
+  if (rc == SQLITE_OK) {
+    free((void*)vfs->zName);
+    free(vfs);
+  }
+  return rc;
+}
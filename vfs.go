@@ -0,0 +1,391 @@
+package litestream
+
+/*
+#include <stdlib.h>
+#include "vfs.h"
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// ReplicaVFS is a read-only SQLite VFS which serves a database directly from
+// a replica so it can be queried without restoring it first. WAL frames are
+// read when the VFS is registered as they are typically small relative to the
+// snapshot. Snapshot pages are only fetched once SQLite reads them.
+//
+// Snapshots are read as a stream so reading a page before the last fetched
+// page reopens the snapshot. Fetched pages are cached for the lifetime of the
+// VFS so each page is fetched at most once. Incremental snapshots are
+// rebuilt from their base in a temporary file each time they are opened.
+type ReplicaVFS struct {
+	mu       sync.Mutex
+	name     string
+	replica  Replica
+	ctx      context.Context
+	pageSize int
+	pageN    uint32 // database size, in pages
+
+	generation    string
+	snapshotIndex int
+	snapshot      io.ReadCloser // open snapshot stream
+	snapshotPgno  uint32        // next page in snapshot stream
+
+	pages   map[uint32][]byte // pages from WAL frames & fetched snapshot pages
+	walN    int               // number of pages read from WAL
+	fetchN  int               // number of pages fetched from snapshot
+	handleN int               // number of open file handles
+}
+
+// vfs registry & open main database file handles.
+var vfsRegistry = struct {
+	sync.Mutex
+	vfs     map[string]*ReplicaVFS
+	handles map[C.int]*ReplicaVFS
+	next    C.int
+}{vfs: make(map[string]*ReplicaVFS), handles: make(map[C.int]*ReplicaVFS)}
+
+// RegisterReplicaVFS registers a read-only SQLite VFS with the given name that
+// serves the database in r at the position described by opt. The generation
+// is required. Open the database with the "vfs" URI parameter, for example:
+//
+//	sql.Open("sqlite3", "file:db?vfs=NAME")
+//
+// The file name is ignored as every main database opened through the VFS
+// refers to the replica database. Close the VFS to unregister it.
+func RegisterReplicaVFS(ctx context.Context, name string, r Replica, opt RestoreOptions) (_ *ReplicaVFS, err error) {
+	if opt.Generation == "" {
+		return nil, fmt.Errorf("generation required")
+	}
+
+	snapshotIndex, err := SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find snapshot index: %w", err)
+	}
+	maxWALIndex, err := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find max wal index: %w", err)
+	}
+
+	v := &ReplicaVFS{
+		name:          name,
+		replica:       r,
+		ctx:           ctx,
+		generation:    opt.Generation,
+		snapshotIndex: snapshotIndex,
+		pages:         make(map[uint32][]byte),
+	}
+	defer func() {
+		if err != nil {
+			v.closeSnapshot()
+		}
+	}()
+
+	// Read the page size & database size from the snapshot header.
+	hdr, err := v.fetchPage(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read snapshot header: %w", err)
+	}
+
+	// Apply committed frames from each WAL file. The database size is
+	// updated by each commit frame.
+	for index := snapshotIndex; index <= maxWALIndex; index++ {
+		if err := v.readWAL(ctx, index); os.IsNotExist(err) && index == snapshotIndex && index == maxWALIndex {
+			break // snapshot only
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read wal %s/%08x: %w", v.generation, index, err)
+		}
+	}
+	if v.pageN == 0 {
+		v.pageN = binary.BigEndian.Uint32(hdr[28:])
+	}
+
+	vfsRegistry.Lock()
+	defer vfsRegistry.Unlock()
+	if _, ok := vfsRegistry.vfs[name]; ok {
+		return nil, fmt.Errorf("vfs already registered: %q", name)
+	}
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	if rc := C.litestream_vfs_register(cname); rc != C.SQLITE_OK {
+		return nil, fmt.Errorf("cannot register vfs: rc=%d", rc)
+	}
+	vfsRegistry.vfs[name] = v
+
+	return v, nil
+}
+
+// Close unregisters the VFS. Returns an error if a database is still open.
+func (v *ReplicaVFS) Close() error {
+	vfsRegistry.Lock()
+	defer vfsRegistry.Unlock()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.handleN > 0 {
+		return fmt.Errorf("cannot close vfs with open databases")
+	} else if vfsRegistry.vfs[v.name] != v {
+		return nil // already closed
+	}
+
+	cname := C.CString(v.name)
+	defer C.free(unsafe.Pointer(cname))
+	if rc := C.litestream_vfs_unregister(cname); rc != C.SQLITE_OK {
+		return fmt.Errorf("cannot unregister vfs: rc=%d", rc)
+	}
+	delete(vfsRegistry.vfs, v.name)
+
+	return v.closeSnapshot()
+}
+
+// Name returns the name the VFS is registered under.
+func (v *ReplicaVFS) Name() string { return v.name }
+
+// PageN returns the size of the database, in pages.
+func (v *ReplicaVFS) PageN() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return int(v.pageN)
+}
+
+// FetchN returns the number of pages fetched from the snapshot so far.
+// Pages which are superseded by WAL frames are never fetched.
+func (v *ReplicaVFS) FetchN() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fetchN
+}
+
+// readWAL reads the committed frames of a WAL file into the page cache.
+func (v *ReplicaVFS) readWAL(ctx context.Context, index int) error {
+	wal, err := readReplicaWAL(ctx, v.replica, v.generation, index)
+	if err != nil {
+		return err
+	} else if len(wal) < WALHeaderSize {
+		return nil
+	}
+
+	pageSize := int(binary.BigEndian.Uint32(wal[8:]))
+	if pageSize != v.pageSize {
+		return fmt.Errorf("wal page size mismatch: %d != %d", pageSize, v.pageSize)
+	}
+
+	var pending []uint32
+	var pendingData [][]byte
+	frameSize := WALFrameHeaderSize + pageSize
+	for off := WALHeaderSize; off+frameSize <= len(wal); off += frameSize {
+		pgno := binary.BigEndian.Uint32(wal[off:])
+		pending = append(pending, pgno)
+		pendingData = append(pendingData, wal[off+WALFrameHeaderSize:off+frameSize])
+
+		// Only apply frames once their transaction has committed.
+		if commit := binary.BigEndian.Uint32(wal[off+4:]); commit != 0 {
+			for i, pgno := range pending {
+				v.pages[pgno] = vfsPatchPage(pgno, pendingData[i])
+			}
+			v.walN += len(pending)
+			pending, pendingData = pending[:0], pendingData[:0]
+			v.pageN = commit
+		}
+	}
+	return nil
+}
+
+// fileSize returns the size of the database, in bytes.
+func (v *ReplicaVFS) fileSize() int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return int64(v.pageN) * int64(v.pageSize)
+}
+
+// readAt reads len(p) bytes of the database at offset into p. Returns the
+// number of bytes read which is less than len(p) when reading past the end.
+func (v *ReplicaVFS) readAt(p []byte, offset int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		off := offset + int64(n)
+		pgno := uint32(off/int64(v.pageSize)) + 1
+		if pgno > v.pageN {
+			break
+		}
+
+		page, err := v.page(pgno)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], page[off%int64(v.pageSize):])
+	}
+	return n, nil
+}
+
+// page returns the latest version of a page, fetching it from the snapshot
+// if it is not cached. Pages beyond the snapshot are returned as zeros.
+func (v *ReplicaVFS) page(pgno uint32) ([]byte, error) {
+	if page, ok := v.pages[pgno]; ok {
+		return page, nil
+	}
+	return v.fetchPage(pgno, v.pageSize)
+}
+
+// fetchPage reads a page from the snapshot stream & caches it. The page size
+// is read from the database header when fetching the first page.
+func (v *ReplicaVFS) fetchPage(pgno uint32, pageSize int) ([]byte, error) {
+	// Reopen the snapshot if the page is behind the current stream position.
+	if v.snapshot == nil || pgno < v.snapshotPgno {
+		if err := v.closeSnapshot(); err != nil {
+			return nil, err
+		}
+		rd, err := snapshotImageReader(v.ctx, v.replica, v.generation, v.snapshotIndex)
+		if err != nil {
+			return nil, err
+		}
+		v.snapshot, v.snapshotPgno = rd, 1
+	}
+
+	// Determine page size from the header if this is the first read.
+	if pageSize == 0 {
+		hdr := make([]byte, 100)
+		if _, err := io.ReadFull(v.snapshot, hdr); err != nil {
+			return nil, err
+		} else if string(hdr[:len(sqliteHeader)]) != sqliteHeader {
+			return nil, fmt.Errorf("snapshot is not a sqlite database")
+		}
+		if pageSize = int(binary.BigEndian.Uint16(hdr[16:])); pageSize == 1 {
+			pageSize = 65536
+		}
+		v.pageSize = pageSize
+
+		buf := make([]byte, pageSize)
+		copy(buf, hdr)
+		if _, err := io.ReadFull(v.snapshot, buf[len(hdr):]); err != nil {
+			return nil, err
+		}
+		v.snapshotPgno = 2
+		v.fetchN++
+		v.pages[1] = vfsPatchPage(1, buf)
+		return v.pages[1], nil
+	}
+
+	// Skip pages until the requested page. Skipped pages are not cached.
+	if _, err := io.CopyN(ioutil.Discard, v.snapshot, int64(pgno-v.snapshotPgno)*int64(pageSize)); err == io.EOF {
+		return make([]byte, pageSize), nil
+	} else if err != nil {
+		return nil, err
+	}
+	v.snapshotPgno = pgno
+
+	buf := make([]byte, pageSize)
+	if _, err := io.ReadFull(v.snapshot, buf); err == io.EOF {
+		return buf, nil // past end of snapshot
+	} else if err != nil {
+		return nil, err
+	}
+	v.snapshotPgno++
+	v.fetchN++
+	v.pages[pgno] = vfsPatchPage(pgno, buf)
+	return v.pages[pgno], nil
+}
+
+// closeSnapshot closes the snapshot stream, if open.
+func (v *ReplicaVFS) closeSnapshot() error {
+	if v.snapshot == nil {
+		return nil
+	}
+	err := v.snapshot.Close()
+	v.snapshot, v.snapshotPgno = nil, 0
+	return err
+}
+
+// vfsPatchPage returns the page with the header on the first page changed
+// from WAL mode to rollback mode so SQLite does not look for a WAL file.
+func vfsPatchPage(pgno uint32, page []byte) []byte {
+	if pgno == 1 && len(page) >= 20 && page[18] == 2 && page[19] == 2 {
+		page = append([]byte(nil), page...)
+		page[18], page[19] = 1, 1
+	}
+	return page
+}
+
+//export litestreamVFSOpen
+func litestreamVFSOpen(name *C.char, handle *C.int) C.int {
+	vfsRegistry.Lock()
+	defer vfsRegistry.Unlock()
+
+	v := vfsRegistry.vfs[C.GoString(name)]
+	if v == nil {
+		return C.SQLITE_CANTOPEN
+	}
+
+	v.mu.Lock()
+	v.handleN++
+	v.mu.Unlock()
+
+	vfsRegistry.next++
+	vfsRegistry.handles[vfsRegistry.next] = v
+	*handle = vfsRegistry.next
+	return C.SQLITE_OK
+}
+
+//export litestreamVFSClose
+func litestreamVFSClose(handle C.int) C.int {
+	vfsRegistry.Lock()
+	defer vfsRegistry.Unlock()
+
+	if v := vfsRegistry.handles[handle]; v != nil {
+		v.mu.Lock()
+		v.handleN--
+		v.mu.Unlock()
+	}
+	delete(vfsRegistry.handles, handle)
+	return C.SQLITE_OK
+}
+
+//export litestreamVFSRead
+func litestreamVFSRead(handle C.int, buf unsafe.Pointer, n C.int, offset C.sqlite3_int64) C.int {
+	v := vfsHandle(handle)
+	if v == nil {
+		return C.SQLITE_IOERR
+	}
+
+	p := (*[1 << 30]byte)(buf)[:n:n]
+	nn, err := v.readAt(p, int64(offset))
+	if err != nil {
+		return C.SQLITE_IOERR
+	} else if nn < len(p) {
+		// SQLite requires unread bytes to be zero-filled on a short read.
+		for i := nn; i < len(p); i++ {
+			p[i] = 0
+		}
+		return C.SQLITE_IOERR_SHORT_READ
+	}
+	return C.SQLITE_OK
+}
+
+//export litestreamVFSFileSize
+func litestreamVFSFileSize(handle C.int, size *C.sqlite3_int64) C.int {
+	v := vfsHandle(handle)
+	if v == nil {
+		return C.SQLITE_IOERR
+	}
+	*size = C.sqlite3_int64(v.fileSize())
+	return C.SQLITE_OK
+}
+
+// vfsHandle returns the VFS for an open file handle.
+func vfsHandle(handle C.int) *ReplicaVFS {
+	vfsRegistry.Lock()
+	defer vfsRegistry.Unlock()
+	return vfsRegistry.handles[handle]
+}
@@ -0,0 +1,15 @@
+#ifndef LITESTREAM_VFS_H
+#define LITESTREAM_VFS_H
+
+/*
+** The SQLite library itself is compiled into the binary by the go-sqlite3
+** package. Only its header is used here so the VFS structs & constants always
+** match the real API. It is provided by the sqlite3 development package
+** (e.g. libsqlite3-dev).
+*/
+#include <sqlite3.h>
+
+int litestream_vfs_register(const char *zName);
+int litestream_vfs_unregister(const char *zName);
+
+#endif
@@ -0,0 +1,81 @@
+package litestream_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestReplicaVFS(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	// Write a small table followed by a large one & checkpoint so both are
+	// stored in the snapshot instead of the WAL.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	}
+	MustInsertBlobs(t, sqldb, 1000)
+	if _, err := sqldb.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Write to the small table after the snapshot so it is read from the WAL.
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := litestream.NewRestoreOptions()
+	opt.Generation = pos.Generation
+	v, err := litestream.RegisterReplicaVFS(context.Background(), "litestream-test", r, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := v.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	d, err := sql.Open("sqlite3", "file:db?vfs="+v.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Ensure only the pages needed for the small table are fetched.
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if got, want := n, 2; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	} else if fetchN, pageN := v.FetchN(), v.PageN(); fetchN > 10 || fetchN >= pageN {
+		t.Fatalf("expected lazy fetch: fetched=%d pages=%d", fetchN, pageN)
+	}
+
+	// Ensure the remaining pages are fetched when the large table is read.
+	if got, want := len(MustQueryBlobs(t, d)), 1000; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	} else if fetchN, pageN := v.FetchN(), v.PageN(); fetchN < pageN/2 {
+		t.Fatalf("expected pages to be fetched: fetched=%d pages=%d", fetchN, pageN)
+	}
+
+	// Ensure the database is read-only.
+	if _, err := d.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err == nil {
+		t.Fatal("expected error")
+	} else if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package litestream
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultShadowWALCacheSize is the default number of shadow WAL bytes kept in
+// memory so replicas of the same database share a single read from disk.
+const DefaultShadowWALCacheSize = 4 * 1024 * 1024
+
+// shadowWALCache holds the most recently read section of each shadow WAL
+// file. Shadow WAL files are only appended to so a cached section remains
+// valid until the file is removed. Each reader tracks its own offset into
+// the shared bytes so a slow replica never holds up a faster one; the lock
+// is only held while reading from disk.
+type shadowWALCache struct {
+	mu      sync.Mutex
+	entries []*shadowWALCacheEntry // ordered from least to most recently used
+	size    int64
+}
+
+// shadowWALCacheEntry holds bytes of a shadow WAL file from offset onward.
+type shadowWALCacheEntry struct {
+	generation string
+	index      int
+	offset     int64
+	data       []byte
+}
+
+func (e *shadowWALCacheEntry) end() int64 { return e.offset + int64(len(e.data)) }
+
+// read returns the bytes of f, the shadow WAL file for pos, from pos.Offset
+// to end. Bytes are served from the cache if available & any bytes past the
+// end of the cached section are read from f and added to the cache. Returns
+// nil if the section cannot be cached within maxSize bytes.
+func (c *shadowWALCache) read(f File, pos Pos, end, maxSize int64) ([]byte, error) {
+	if end-pos.Offset > maxSize {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Reuse the cached section of the file if the position is within it.
+	// Otherwise start a new section at the position.
+	e := c.remove(pos.Generation, pos.Index)
+	if e == nil || pos.Offset < e.offset || pos.Offset > e.end() || end-e.offset > maxSize {
+		e = &shadowWALCacheEntry{generation: pos.Generation, index: pos.Index, offset: pos.Offset}
+	}
+
+	// Read any bytes written to the file since it was cached.
+	if n := end - e.end(); n > 0 {
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, e.end()); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		e.data = append(e.data, buf...)
+	}
+
+	// Move the entry to the end of the list & evict the least recently used
+	// entries until the cache fits.
+	c.entries = append(c.entries, e)
+	c.size += int64(len(e.data))
+	for c.size > maxSize && len(c.entries) > 1 {
+		c.size -= int64(len(c.entries[0].data))
+		c.entries[0], c.entries = nil, c.entries[1:]
+	}
+
+	// Limit capacity so later appends to the entry never touch the bytes of
+	// a reader in use.
+	data := e.data[pos.Offset-e.offset : end-e.offset]
+	return data[:len(data):len(data)], nil
+}
+
+// remove removes & returns the entry for a shadow WAL file, if cached.
+func (c *shadowWALCache) remove(generation string, index int) *shadowWALCacheEntry {
+	for i, e := range c.entries {
+		if e.generation == generation && e.index == index {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			c.size -= int64(len(e.data))
+			return e
+		}
+	}
+	return nil
+}
+
+// evict removes all entries for a generation before the given index.
+func (c *shadowWALCache) evict(generation string, index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	other := c.entries[:0]
+	for _, e := range c.entries {
+		if e.generation == generation && e.index >= index {
+			other = append(other, e)
+			continue
+		}
+		c.size -= int64(len(e.data))
+	}
+	for i := len(other); i < len(c.entries); i++ {
+		c.entries[i] = nil
+	}
+	c.entries = other
+}
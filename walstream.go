@@ -0,0 +1,187 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// WALStreamReader streams the decompressed WAL files of a generation from a
+// replica in index order, similar to "tail -f". Once all available WAL has
+// been read, the replica is polled every Interval & reads block until more
+// WAL is uploaded.
+//
+// The WAL file of the latest index grows until the primary database starts
+// a new index so it is reread & only bytes after those already returned are
+// streamed. Bytes are therefore returned exactly once & in order. Frames are
+// not parsed so a read may end in the middle of a frame.
+//
+// Once the generation has been read completely & the replica has started a
+// new generation, Read returns ErrGenerationChanged. A missing WAL index below
+// the lowest available index, such as one removed by retention, returns
+// ErrWALGap.
+type WALStreamReader struct {
+	ctx    context.Context
+	cancel func()
+	r      Replica
+
+	pos  Pos           // position of next byte returned
+	info *WALInfo      // listing of WAL file at pos.Index when rd was opened
+	rd   io.ReadCloser // reader for WAL file at pos.Index positioned at offset
+
+	// Time between polls of the replica once all WAL has been read.
+	Interval time.Duration
+}
+
+// NewWALStreamReader returns a reader which streams WAL from generation of r
+// starting at index. The reader stops once ctx is canceled or it is closed.
+func NewWALStreamReader(ctx context.Context, r Replica, generation string, index int) *WALStreamReader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &WALStreamReader{
+		ctx:      ctx,
+		cancel:   cancel,
+		r:        r,
+		pos:      Pos{Generation: generation, Index: index},
+		Interval: DefaultFollowInterval,
+	}
+}
+
+// Pos returns the generation, index & offset of the next byte to be read.
+func (s *WALStreamReader) Pos() Pos {
+	return s.pos
+}
+
+// Close stops the reader & unblocks any pending read.
+func (s *WALStreamReader) Close() error {
+	s.cancel()
+	if s.rd != nil {
+		err := s.rd.Close()
+		s.rd = nil
+		return err
+	}
+	return nil
+}
+
+// Read reads WAL bytes into p. Blocks until WAL is available.
+func (s *WALStreamReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if s.rd == nil {
+			if err := s.next(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		n, err := s.rd.Read(p)
+		s.pos.Offset += int64(n)
+		if err == io.EOF {
+			if e := s.rd.Close(); e != nil {
+				return n, e
+			}
+			s.rd, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// next blocks until more WAL is available & opens a reader for it.
+func (s *WALStreamReader) next() error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		if ok, err := s.open(); err != nil || ok {
+			return err
+		}
+
+		// Only report a new generation once this generation has been read.
+		if generation, _, err := CalcReplicaRestoreTarget(s.ctx, s.r, NewRestoreOptions()); err != nil {
+			return err
+		} else if generation != "" && generation != s.pos.Generation {
+			return fmt.Errorf("%s: %w", s.pos.Generation, ErrGenerationChanged)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// open opens a reader for the WAL which has not been read yet. Returns false
+// if no unread WAL is available.
+func (s *WALStreamReader) open() (bool, error) {
+	wals, err := s.r.WALs(s.ctx)
+	if err != nil {
+		return false, fmt.Errorf("cannot list wal files: %w", err)
+	}
+
+	m := make(map[int]*WALInfo)
+	minIndex := -1
+	for _, info := range wals {
+		if info.Generation != s.pos.Generation {
+			continue
+		}
+		m[info.Index] = info
+		if minIndex == -1 || info.Index < minIndex {
+			minIndex = info.Index
+		}
+	}
+
+	for {
+		info := m[s.pos.Index]
+		if info == nil {
+			if minIndex > s.pos.Index {
+				return false, fmt.Errorf("wal %s/%08x: %w", s.pos.Generation, s.pos.Index, ErrWALGap)
+			}
+			return false, nil // not uploaded yet
+		}
+
+		// The WAL file may have grown since it was last opened.
+		if s.info == nil || info.Size != s.info.Size || !info.CreatedAt.Equal(s.info.CreatedAt) {
+			return true, s.openAt(info)
+		}
+
+		// The WAL file is complete once the next index exists.
+		if m[s.pos.Index+1] == nil {
+			return false, nil
+		}
+		s.pos.Index, s.pos.Offset, s.info = s.pos.Index+1, 0, nil
+	}
+}
+
+// openAt opens the WAL file at the current index & skips the bytes which have
+// already been read.
+func (s *WALStreamReader) openAt(info *WALInfo) error {
+	rd, err := s.r.WALReader(s.ctx, s.pos.Generation, s.pos.Index)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("wal %s/%08x: %w", s.pos.Generation, s.pos.Index, ErrWALGap)
+	} else if err != nil {
+		return fmt.Errorf("cannot open wal %s/%08x: %w", s.pos.Generation, s.pos.Index, err)
+	}
+
+	if n, err := io.CopyN(ioutil.Discard, rd, s.pos.Offset); err == io.EOF {
+		rd.Close()
+		return fmt.Errorf("wal %s/%08x: file truncated to %d bytes, %d bytes already read", s.pos.Generation, s.pos.Index, n, s.pos.Offset)
+	} else if err != nil {
+		rd.Close()
+		return fmt.Errorf("cannot read wal %s/%08x: %w", s.pos.Generation, s.pos.Index, err)
+	}
+
+	s.rd, s.info = rd, info
+	return nil
+}
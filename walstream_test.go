@@ -0,0 +1,139 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestWALStreamReader(t *testing.T) {
+	// Ensure WAL files are streamed in order & reads block until more WAL
+	// is replicated.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		generation := r.LastPos().Generation
+
+		s := litestream.NewWALStreamReader(context.Background(), r, generation, 0)
+		s.Interval = 10 * time.Millisecond
+		defer s.Close()
+
+		want := MustReadReplicaWAL(t, r, generation)
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, want) {
+			t.Fatal("wal mismatch")
+		}
+
+		// Block on the next byte until more WAL is replicated.
+		ch := make(chan error, 1)
+		b := make([]byte, 1)
+		go func() {
+			_, err := io.ReadFull(s, b)
+			ch <- err
+		}()
+		select {
+		case err := <-ch:
+			t.Fatalf("unexpected read: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+
+		want = MustReadReplicaWAL(t, r, generation)[len(want):]
+		buf = make([]byte, len(want)-1)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(append(b, buf...), want) {
+			t.Fatal("appended wal mismatch")
+		}
+	})
+
+	// Ensure a new generation is reported once the generation is read.
+	t.Run("ErrGenerationChanged", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		pos0 := MustRestartWALExternally(t, db, sqldb, r)
+
+		want := MustReadReplicaWAL(t, r, pos0.Generation)
+		if len(want) == 0 {
+			t.Fatal("expected wal")
+		}
+
+		// Reopen with the same replica path so a new generation is replicated.
+		db = litestream.NewDB(db.Path())
+		db.MonitorInterval = 0
+		r = litestream.NewFileReplica(db, "", r.Path())
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+		MustSyncDBReplica(t, db, r)
+		if r.LastPos().Generation == pos0.Generation {
+			t.Fatal("expected new generation")
+		}
+
+		s := litestream.NewWALStreamReader(context.Background(), r, pos0.Generation, 0)
+		s.Interval = 10 * time.Millisecond
+		defer s.Close()
+
+		if buf, err := ioutil.ReadAll(s); !errors.Is(err, litestream.ErrGenerationChanged) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !bytes.Equal(buf, want) {
+			t.Fatal("wal mismatch")
+		}
+	})
+}
+
+// MustReadReplicaWAL returns the concatenated WAL files of a generation.
+func MustReadReplicaWAL(tb testing.TB, r litestream.Replica, generation string) []byte {
+	tb.Helper()
+
+	wals, err := r.WALs(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for index := 0; ; index++ {
+		var found bool
+		for _, info := range wals {
+			found = found || (info.Generation == generation && info.Index == index)
+		}
+		if !found {
+			return buf.Bytes()
+		}
+
+		rd, err := r.WALReader(context.Background(), generation, index)
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := io.Copy(&buf, rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
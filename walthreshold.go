@@ -0,0 +1,81 @@
+package litestream
+
+import (
+	"sync"
+)
+
+// SnapshotReasonWALThreshold is the snapshot reason logged when a replica
+// snapshots because too much WAL has been replicated since its last snapshot.
+const SnapshotReasonWALThreshold = "wal threshold"
+
+// WALThreshold tracks the WAL replicated since a replica's latest snapshot so
+// the replica can snapshot before restores must apply too much WAL. WAL
+// replicated before the replica started is not counted until the replica
+// takes its first snapshot.
+//
+// The zero value is ready to use & it is safe for concurrent use.
+type WALThreshold struct {
+	mu         sync.Mutex
+	generation string // generation of latest snapshot
+	index      int    // index of latest snapshot
+	size       int64  // raw WAL bytes replicated since latest snapshot
+	pending    bool   // true while a threshold snapshot is in progress
+}
+
+// Reset records a snapshot of generation at index.
+func (t *WALThreshold) Reset(generation string, index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.generation, t.index, t.size = generation, index, 0
+}
+
+// Add records n raw bytes of WAL replicated after the latest snapshot.
+func (t *WALThreshold) Add(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size += n
+}
+
+// Begin returns true if a snapshot should be taken at pos because more than
+// maxN WAL files or maxSize bytes of WAL have been replicated since the latest
+// snapshot. Thresholds of zero are ignored. Once Begin returns true it
+// returns false until End is called so only one snapshot is taken at a time.
+func (t *WALThreshold) Begin(pos Pos, maxN int, maxSize int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pos.IsZero() || t.pending {
+		return false
+	}
+
+	// Start counting from the current position in a new generation or if
+	// no snapshot has been recorded since the replica started.
+	if t.generation != pos.Generation {
+		t.generation, t.index, t.size = pos.Generation, pos.Index, 0
+		return false
+	}
+
+	if (maxN > 0 && pos.Index-t.index > maxN) || (maxSize > 0 && t.size > maxSize) {
+		t.pending = true
+		return true
+	}
+	return false
+}
+
+// End marks a snapshot started after Begin as finished.
+func (t *WALThreshold) End() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = false
+}
+
+// Stats returns the number of WAL files after the latest snapshot up to pos
+// & the raw bytes of WAL replicated since.
+func (t *WALThreshold) Stats(pos Pos) (n int, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation != pos.Generation {
+		return 0, 0
+	}
+	return pos.Index - t.index, t.size
+}
@@ -0,0 +1,122 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"log"
+	"time"
+)
+
+// Default watcher settings.
+const (
+	DefaultWatchInterval = 1 * time.Minute
+)
+
+// Watcher continuously verifies that a replica can be restored without
+// writing to it, such as from a standby host while another host replicates
+// the database. Each check plans a restore of the latest generation, verifies
+// its WAL indices are contiguous & restores it into an in-memory image, which
+// validates the salt & checksum of every WAL frame applied.
+//
+// A watcher only lists & reads the replica. It never starts, syncs or runs
+// retention on the replica so the replica does not require a database.
+type Watcher struct {
+	r Replica
+
+	last WatchResult // last successful check
+
+	// Time between checks of the replica.
+	Interval time.Duration
+}
+
+// WatchResult is the outcome of a successful check by a Watcher.
+type WatchResult struct {
+	Plan     RestorePlan // snapshot & WAL files restored
+	Checksum uint64      // CRC64 of the restored database
+	Skipped  bool        // true if the replica had not changed since the last check
+}
+
+// NewWatcher returns a new instance of Watcher for r.
+func NewWatcher(r Replica) *Watcher {
+	return &Watcher{
+		r:        r,
+		Interval: DefaultWatchInterval,
+	}
+}
+
+// Replica returns the replica being watched.
+func (w *Watcher) Replica() Replica {
+	return w.r
+}
+
+// Run checks the replica every interval until ctx is canceled. Failed checks
+// are logged & the watcher continues with the next interval.
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for initial := true; ; initial = false {
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+
+		if _, err := w.Check(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("%s: watch error: %s", w.r.Name(), err)
+		}
+	}
+}
+
+// Check verifies that the latest generation of the replica can be restored.
+// Returns an error wrapping ErrWALGap if a WAL index is missing. The restore
+// is skipped if the files in the plan have not changed since the last
+// successful check.
+func (w *Watcher) Check(ctx context.Context) (WatchResult, error) {
+	opt := NewRestoreOptions()
+	generation, _, err := CalcReplicaRestoreTarget(ctx, w.r, opt)
+	if err != nil {
+		return WatchResult{}, fmt.Errorf("cannot determine generation: %w", err)
+	} else if generation == "" {
+		return WatchResult{}, fmt.Errorf("no generation available")
+	}
+	opt.Generation = generation
+
+	// Check for gaps before planning so a missing index is reported as a gap
+	// rather than as an unreachable restore.
+	if err := VerifyWALContinuity(ctx, w.r, generation); errors.Is(err, ErrWALGap) {
+		log.Printf("%s: CRITICAL: %s", w.r.Name(), err)
+		return WatchResult{}, err
+	} else if err != nil {
+		return WatchResult{}, fmt.Errorf("cannot verify wal continuity: %w", err)
+	}
+
+	plan, err := CalcRestorePlan(ctx, w.r, opt)
+	if err != nil {
+		return WatchResult{}, fmt.Errorf("cannot plan restore: %w", err)
+	}
+
+	if last := w.last.Plan; last.Generation == plan.Generation && last.SnapshotIndex == plan.SnapshotIndex &&
+		last.MaxIndex == plan.MaxIndex && last.ObjectN == plan.ObjectN && last.Size == plan.Size {
+		Tracef("%s: watch: unchanged, %s", w.r.Name(), &plan)
+		return WatchResult{Plan: plan, Checksum: w.last.Checksum, Skipped: true}, nil
+	}
+
+	// Restore through the planned index so files uploaded after planning
+	// are checked on the next interval.
+	opt.Index = plan.MaxIndex
+	opt.ValidateWALSalt = true
+
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if err := RestoreReplicaTo(ctx, w.r, opt, h); err != nil {
+		return WatchResult{Plan: plan}, fmt.Errorf("cannot restore: %w", err)
+	}
+
+	w.last = WatchResult{Plan: plan, Checksum: h.Sum64()}
+	log.Printf("%s: watch: status=ok generation=%s snapshot=%08x wal=%08x-%08x checksum=%016x", w.r.Name(), plan.Generation, plan.SnapshotIndex, plan.SnapshotIndex, plan.MaxIndex, w.last.Checksum)
+	return w.last, nil
+}
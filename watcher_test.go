@@ -0,0 +1,120 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestWatcher_Check(t *testing.T) {
+	// Ensure a replica is restored without writing to it & the restore is
+	// skipped until the replica changes.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Watch the replica directly without its database.
+		w := litestream.NewWatcher(litestream.NewFileReplica(nil, "file", r.Path()))
+		files := MustListFiles(t, r.Path())
+		if result, err := w.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if result.Skipped {
+			t.Fatal("expected restore")
+		} else if got, want := result.Plan.Generation, pos.Generation; got != want {
+			t.Fatalf("generation=%s, want %s", got, want)
+		} else if got, want := result.Plan.MaxIndex, pos.Index; got != want {
+			t.Fatalf("max index=%d, want %d", got, want)
+		}
+		if other := MustListFiles(t, r.Path()); !reflect.DeepEqual(files, other) {
+			t.Fatalf("replica modified: %v, want %v", other, files)
+		}
+
+		if result, err := w.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !result.Skipped {
+			t.Fatal("expected skipped restore")
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		if result, err := w.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if result.Skipped {
+			t.Fatal("expected restore after change")
+		}
+	})
+
+	// Ensure a missing WAL index is reported as a gap.
+	t.Run("ErrWALGap", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncDBReplica(t, db, r)
+		MustRollWALIndex(t, db, sqldb, r)
+		MustRollWALIndex(t, db, sqldb, r)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := filepath.Glob(filepath.Join(r.WALDir(pos.Generation), litestream.FormatWALPath(pos.Index-1)+"*"))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(matches) == 0 {
+			t.Fatal("expected wal file")
+		}
+		for _, filename := range matches {
+			if err := os.Remove(filename); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := litestream.NewWatcher(litestream.NewFileReplica(nil, "file", r.Path()))
+		if _, err := w.Check(context.Background()); !errors.Is(err, litestream.ErrWALGap) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustListFiles returns the size & modification time of each file under dir.
+func MustListFiles(tb testing.TB, dir string) map[string]string {
+	tb.Helper()
+
+	m := make(map[string]string)
+	if err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !fi.IsDir() {
+			m[path] = fmt.Sprintf("size=%d mtime=%s", fi.Size(), fi.ModTime().Format(time.RFC3339Nano))
+		}
+		return nil
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
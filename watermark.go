@@ -0,0 +1,124 @@
+package litestream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// ReadWatermark reads a position from an external watermark file, such as the
+// last position a failover controller observed as durable. The file is a JSON
+// object with "generation", "index" & "offset" fields.
+func ReadWatermark(filename string) (Pos, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Pos{}, err
+	}
+
+	var w struct {
+		Generation string `json:"generation"`
+		Index      int    `json:"index"`
+		Offset     int64  `json:"offset"`
+	}
+	if err := json.Unmarshal(buf, &w); err != nil {
+		return Pos{}, fmt.Errorf("cannot parse watermark: %w", err)
+	} else if !IsGenerationName(w.Generation) {
+		return Pos{}, fmt.Errorf("invalid watermark generation: %q", w.Generation)
+	} else if w.Index < 0 || w.Index > MaxIndex {
+		return Pos{}, fmt.Errorf("invalid watermark index: %d", w.Index)
+	} else if w.Offset < WALHeaderSize {
+		return Pos{}, fmt.Errorf("invalid watermark offset: %d", w.Offset)
+	}
+	return Pos{Generation: w.Generation, Index: w.Index, Offset: w.Offset}, nil
+}
+
+// restoreReplicaToOffset restores the snapshot at minWALIndex & applies WAL
+// files through exactly opt.Offset bytes into the WAL file at opt.Index. The
+// restore fails if the replica does not contain the entire position instead
+// of restoring to an earlier one.
+func restoreReplicaToOffset(ctx context.Context, r Replica, opt RestoreOptions, minWALIndex int, logger *log.Logger, logPrefix string) error {
+	reportRestorePlan(ctx, r, opt, minWALIndex, opt.Index, logger, logPrefix)
+
+	tmpPath := restoreTempPath(opt, ".tmp")
+	defer func() { _ = removeDBFiles(tmpPath) }()
+	logger.Printf("%s: restoring snapshot %s/%08x to %s", logPrefix, opt.Generation, minWALIndex, tmpPath)
+	if err := restoreSnapshot(ctx, r, opt.Generation, minWALIndex, tmpPath); err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+
+	for index := minWALIndex; index <= opt.Index; index++ {
+		wal, err := readReplicaWAL(ctx, r, opt.Generation, index)
+		if os.IsNotExist(err) && index == opt.Index && opt.Offset == WALHeaderSize {
+			break // no frames written to the last wal
+		} else if err != nil {
+			return fmt.Errorf("cannot read wal %s/%08x: %w", opt.Generation, index, err)
+		}
+
+		if opt.ValidateWALSalt {
+			if err := verifyWALSaltBytes(wal); err != nil {
+				return fmt.Errorf("generation=%s index=%08x: %w", opt.Generation, index, err)
+			}
+		}
+
+		// Only apply the last WAL up to the offset. The offset must end on a
+		// commit so the database is not restored to a partial transaction.
+		if index == opt.Index {
+			if int64(len(wal)) < opt.Offset {
+				return fmt.Errorf("wal %s/%08x is %d bytes, shorter than offset %d", opt.Generation, index, len(wal), opt.Offset)
+			} else if !isWALCommitOffset(wal, opt.Offset) {
+				return fmt.Errorf("offset %d is not at the end of a commit in wal %s/%08x", opt.Offset, opt.Generation, index)
+			}
+			wal = wal[:opt.Offset]
+		}
+
+		if err := applyWALBytes(tmpPath, wal); err != nil {
+			return fmt.Errorf("cannot restore wal: %w", err)
+		}
+		if opt.Verbose {
+			logger.Printf("%s: restored wal %s/%08x", logPrefix, opt.Generation, index)
+		}
+	}
+	logger.Printf("%s: restored to position %s/%08x:%d", logPrefix, opt.Generation, opt.Index, opt.Offset)
+
+	if err := finalizeRestore(ctx, tmpPath, opt, logger, logPrefix); err != nil {
+		return err
+	}
+	return installRestoredDB(ctx, tmpPath, opt, logger, logPrefix)
+}
+
+// snapshotIndexBefore returns the highest snapshot index of the generation
+// which is at or before index.
+func snapshotIndexBefore(ctx context.Context, r Replica, generation string, index int) (int, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	minWALIndex := -1
+	for _, info := range snapshots {
+		if info.Generation == generation && info.Index <= index && info.Index > minWALIndex {
+			minWALIndex = info.Index
+		}
+	}
+	if minWALIndex == -1 {
+		return 0, ErrNoSnapshots
+	}
+	return minWALIndex, nil
+}
+
+// isWALCommitOffset returns true if offset is the end of the WAL header,
+// before any frames, or the end of a commit frame in wal.
+func isWALCommitOffset(wal []byte, offset int64) bool {
+	if offset == WALHeaderSize {
+		return true
+	}
+	for _, off := range walCommitOffsets(wal) {
+		if int64(off) == offset {
+			return true
+		}
+	}
+	return false
+}
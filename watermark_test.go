@@ -0,0 +1,121 @@
+package litestream_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRestoreReplica_Watermark(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	MustSyncDBReplica(t, db, r)
+
+	// Record watermarks between syncs, within & after a WAL rollover.
+	type watermark struct {
+		path string
+		n    int
+	}
+	var watermarks []watermark
+	record := func() {
+		MustSyncDBReplica(t, db, r)
+		watermarks = append(watermarks, watermark{
+			path: MustWriteWatermark(t, r.LastPos()),
+			n:    MustCountRows(t, db.Path(), "foo"),
+		})
+	}
+	insertN := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	insertN(5)
+	record()
+	insertN(3)
+	record()
+	MustRollWALIndex(t, db, sqldb, r)
+	insertN(4)
+	record()
+	insertN(7)
+	MustSyncDBReplica(t, db, r)
+
+	for i, w := range watermarks {
+		pos, err := litestream.ReadWatermark(w.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation, opt.Index, opt.Offset = pos.Generation, pos.Index, pos.Offset
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath, "foo"), w.n; got != want {
+			t.Fatalf("%d. restored rows=%d, want %d", i, got, want)
+		}
+	}
+
+	// Ensure a position beyond the replicated WAL fails instead of restoring
+	// to an earlier position.
+	t.Run("ErrShortWAL", func(t *testing.T) {
+		pos := r.LastPos()
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation, opt.Index, opt.Offset = pos.Generation, pos.Index, pos.Offset+int64(db.PageSize()+litestream.WALFrameHeaderSize)
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "shorter than offset") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure an offset within a transaction is rejected.
+	t.Run("ErrNotCommit", func(t *testing.T) {
+		pos := r.LastPos()
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		opt.Generation, opt.Index, opt.Offset = pos.Generation, pos.Index, pos.Offset-1
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "not at the end of a commit") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReadWatermark(t *testing.T) {
+	// Ensure invalid positions are rejected.
+	for _, s := range []string{
+		`{"generation":"xyz","index":0,"offset":32}`,
+		`{"generation":"0123456789abcdef","index":-1,"offset":32}`,
+		`{"generation":"0123456789abcdef","index":0,"offset":0}`,
+		`{`,
+	} {
+		filename := filepath.Join(t.TempDir(), "watermark.json")
+		if err := ioutil.WriteFile(filename, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		} else if _, err := litestream.ReadWatermark(filename); err == nil {
+			t.Fatalf("expected error: %s", s)
+		}
+	}
+}
+
+// MustWriteWatermark writes pos to a watermark file & returns its path.
+func MustWriteWatermark(tb testing.TB, pos litestream.Pos) string {
+	tb.Helper()
+	filename := filepath.Join(tb.TempDir(), "watermark.json")
+	s := fmt.Sprintf(`{"generation":%q,"index":%d,"offset":%d}`, pos.Generation, pos.Index, pos.Offset)
+	if err := ioutil.WriteFile(filename, []byte(s), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}